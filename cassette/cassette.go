@@ -0,0 +1,305 @@
+// Package cassette records outbound HTTP to a file and replays it, so an
+// executor can be run repeatedly against the exact responses of one real
+// run. Credentials in headers and query strings are redacted before
+// anything is written, and requests are matched on the redacted form, so
+// cassettes can be committed and replayed without the original keys.
+package cassette
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Mode decides whether requests reach the network.
+type Mode string
+
+const (
+	// Record sends every request and overwrites the cassette.
+	Record Mode = "record"
+	// Replay answers only from the cassette; unknown requests fail.
+	Replay Mode = "replay"
+	// Auto replays an existing cassette and records a missing one.
+	Auto Mode = "auto"
+)
+
+const redacted = "REDACTED"
+
+var secretHeaders = map[string]bool{
+	"authorization":       true,
+	"proxy-authorization": true,
+	"cookie":              true,
+	"set-cookie":          true,
+	"x-api-key":           true,
+	"x-apikey":            true,
+	"api-key":             true,
+}
+
+var secretParams = map[string]bool{
+	"key":          true,
+	"api_key":      true,
+	"apikey":       true,
+	"appid":        true,
+	"access_token": true,
+	"token":        true,
+	"secret":       true,
+}
+
+// Interaction is one recorded request and its response.
+type Interaction struct {
+	Request  Request  `json:"request"`
+	Response Response `json:"response"`
+}
+
+type Request struct {
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    Body              `json:"body,omitempty"`
+}
+
+type Response struct {
+	Status  int                 `json:"status"`
+	Headers map[string][]string `json:"headers,omitempty"`
+	Body    Body                `json:"body,omitempty"`
+}
+
+// Body is stored as text when it is valid UTF-8 and as base64 otherwise.
+type Body []byte
+
+func (b Body) MarshalJSON() ([]byte, error) {
+	if utf8.Valid(b) {
+		return json.Marshal(string(b))
+	}
+	return json.Marshal(map[string]string{"base64": base64.StdEncoding.EncodeToString(b)})
+}
+
+func (b *Body) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*b = Body(s)
+		return nil
+	}
+	var enc struct {
+		Base64 string `json:"base64"`
+	}
+	if err := json.Unmarshal(data, &enc); err != nil {
+		return err
+	}
+	raw, err := base64.StdEncoding.DecodeString(enc.Base64)
+	*b = raw
+	return err
+}
+
+// Cassette is an http.RoundTripper backed by a cassette file.
+type Cassette struct {
+	path      string
+	recording bool
+	next      http.RoundTripper
+
+	mu           sync.Mutex
+	interactions []Interaction
+	used         []bool
+	replayed     int
+}
+
+// Load opens the cassette at path. next carries requests in record mode;
+// nil means http.DefaultTransport.
+func Load(path string, mode Mode, next http.RoundTripper) (*Cassette, error) {
+
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	c := &Cassette{path: path, next: next}
+
+	data, err := os.ReadFile(path)
+	switch {
+	case mode == Record:
+		c.recording = true
+	case err == nil:
+		if err := json.Unmarshal(data, &c.interactions); err != nil {
+			return nil, fmt.Errorf("cassette %s: %w", path, err)
+		}
+		c.used = make([]bool, len(c.interactions))
+	case os.IsNotExist(err) && mode == Auto:
+		c.recording = true
+	default:
+		return nil, fmt.Errorf("cassette %s: %w", path, err)
+	}
+
+	return c, nil
+}
+
+// Recording reports whether requests go to the network.
+func (c *Cassette) Recording() bool {
+	return c.recording
+}
+
+// Stats returns how many interactions were recorded and replayed.
+func (c *Cassette) Stats() (recorded, replayed int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.recording {
+		return len(c.interactions), 0
+	}
+	return 0, c.replayed
+}
+
+// Save writes recorded interactions. It does nothing when replaying.
+func (c *Cassette) Save() error {
+
+	if !c.recording {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	data, err := json.MarshalIndent(c.interactions, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(c.path, append(data, '\n'), 0o644)
+}
+
+// Wrap returns a RoundTripper that shares this cassette but records
+// through next rather than the transport given to Load, so a client with
+// its own transport keeps it while recording.
+func (c *Cassette) Wrap(next http.RoundTripper) http.RoundTripper {
+	return wrapped{c: c, next: next}
+}
+
+type wrapped struct {
+	c    *Cassette
+	next http.RoundTripper
+}
+
+func (w wrapped) RoundTrip(req *http.Request) (*http.Response, error) {
+	return w.c.roundTrip(req, w.next)
+}
+
+func (c *Cassette) RoundTrip(req *http.Request) (*http.Response, error) {
+	return c.roundTrip(req, c.next)
+}
+
+func (c *Cassette) roundTrip(req *http.Request, next http.RoundTripper) (*http.Response, error) {
+
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	recorded := Request{
+		Method:  req.Method,
+		URL:     redactURL(req.URL),
+		Headers: redactHeaders(req.Header),
+		Body:    body,
+	}
+
+	if c.recording {
+		return c.record(req, recorded, next)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Identical requests are answered in the order they were recorded
+	for i, in := range c.interactions {
+		if c.used[i] || in.Request.Method != recorded.Method || in.Request.URL != recorded.URL || !bytes.Equal(in.Request.Body, recorded.Body) {
+			continue
+		}
+		c.used[i] = true
+		c.replayed++
+		return in.Response.httpResponse(req), nil
+	}
+
+	return nil, fmt.Errorf("cassette %s has no recorded response for %s %s", c.path, recorded.Method, recorded.URL)
+}
+
+func (c *Cassette) record(req *http.Request, recorded Request, next http.RoundTripper) (*http.Response, error) {
+
+	resp, err := next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	headers := map[string][]string{}
+	for k, v := range resp.Header {
+		if secretHeaders[strings.ToLower(k)] {
+			v = []string{redacted}
+		}
+		headers[k] = v
+	}
+
+	c.mu.Lock()
+	c.interactions = append(c.interactions, Interaction{
+		Request:  recorded,
+		Response: Response{Status: resp.StatusCode, Headers: headers, Body: body},
+	})
+	c.mu.Unlock()
+
+	return resp, nil
+}
+
+func (r Response) httpResponse(req *http.Request) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", r.Status, http.StatusText(r.Status)),
+		StatusCode:    r.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header(r.Headers).Clone(),
+		Body:          io.NopCloser(bytes.NewReader(r.Body)),
+		ContentLength: int64(len(r.Body)),
+		Request:       req,
+	}
+}
+
+func redactURL(u *url.URL) string {
+
+	copied := *u
+	q := copied.Query()
+	for k := range q {
+		if secretParams[strings.ToLower(k)] {
+			q.Set(k, redacted)
+		}
+	}
+	copied.RawQuery = q.Encode()
+	copied.User = nil
+
+	return copied.String()
+}
+
+func redactHeaders(h http.Header) map[string]string {
+
+	out := map[string]string{}
+	for k, v := range h {
+		value := strings.Join(v, ", ")
+		if secretHeaders[strings.ToLower(k)] {
+			value = redacted
+		}
+		out[k] = value
+	}
+	return out
+}
@@ -0,0 +1,74 @@
+package cassette
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+type countingTransport struct {
+	next  http.RoundTripper
+	calls int
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.calls++
+	if t.next == nil {
+		return nil, errors.New("network used during replay")
+	}
+	return t.next.RoundTrip(req)
+}
+
+func get(t *testing.T, rt http.RoundTripper, url string) string {
+	t.Helper()
+
+	resp, err := (&http.Client{Transport: rt}).Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return string(body)
+}
+
+func TestWrapRecordsThroughOwnTransport(t *testing.T) {
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "pong")
+	}))
+	path := filepath.Join(t.TempDir(), "tape.json")
+
+	tape, err := Load(path, Record, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	own := &countingTransport{next: &http.Transport{DisableKeepAlives: true}}
+	if got := get(t, tape.Wrap(own), srv.URL+"/ping?token=secret"); got != "pong" {
+		t.Fatalf("recorded body %q, want pong", got)
+	}
+	if own.calls != 1 {
+		t.Errorf("recording used the client's transport %d times, want 1", own.calls)
+	}
+	if err := tape.Save(); err != nil {
+		t.Fatal(err)
+	}
+	srv.Close()
+
+	tape, err = Load(path, Replay, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offline := &countingTransport{}
+	if got := get(t, tape.Wrap(offline), srv.URL+"/ping?token=other"); got != "pong" {
+		t.Errorf("replayed body %q, want pong", got)
+	}
+	if offline.calls != 0 {
+		t.Errorf("replay used the client's transport %d times", offline.calls)
+	}
+	if _, replayed := tape.Stats(); replayed != 1 {
+		t.Errorf("replayed %d interactions, want 1", replayed)
+	}
+}
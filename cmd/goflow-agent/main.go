@@ -0,0 +1,212 @@
+// Command goflow-agent is a remote worker: it connects to a GoFlow server
+// over WebSocket, advertises the job types and queues it handles, and runs
+// the jobs it is sent with the built-in executors. Agents have no database
+// access, so only self-contained job types can run remotely.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"goflow/jobs"
+
+	"golang.org/x/net/websocket"
+)
+
+// Types that enqueue follow-up jobs need the server's transaction; the
+// ones that use GoFlow's tables are jobs.NeedsDatabase.
+var serverOnlyTypes = map[string]bool{
+	"cron_schedule": true,
+	"delay":         true,
+}
+
+type message struct {
+	Type        string          `json:"type"`
+	Name        string          `json:"name,omitempty"`
+	JobTypes    []string        `json:"job_types,omitempty"`
+	Queues      []string        `json:"queues,omitempty"`
+	Concurrency int             `json:"concurrency,omitempty"`
+	Job         *job            `json:"job,omitempty"`
+	JobID       int             `json:"job_id,omitempty"`
+	StatusCode  int             `json:"status_code,omitempty"`
+	Response    json.RawMessage `json:"response,omitempty"`
+	Error       string          `json:"error,omitempty"`
+	Permanent   bool            `json:"permanent,omitempty"`
+	RetryAfter  int             `json:"retry_after_seconds,omitempty"`
+	Defer       int             `json:"defer_seconds,omitempty"`
+}
+
+type job struct {
+	ID             int                    `json:"id"`
+	Type           string                 `json:"type"`
+	Payload        map[string]interface{} `json:"payload"`
+	TimeoutSeconds *int                   `json:"timeout_seconds"`
+}
+
+func main() {
+
+	server := flag.String("server", "ws://localhost:8080/agents/connect", "GoFlow agent endpoint")
+	name := flag.String("name", hostname(), "agent name")
+	types := flag.String("types", "http_request,data_extract", "comma separated job types to handle")
+	queues := flag.String("queues", "default", "comma separated queues to handle")
+	concurrency := flag.Int("concurrency", 2, "jobs to run at once")
+	logLevel := flag.String("log-level", "info", "debug, info, warn or error")
+	flag.Parse()
+
+	// JSON lines, like the server's
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		fmt.Fprintln(os.Stderr, "-log-level must be debug, info, warn or error")
+		os.Exit(2)
+	}
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+
+	token := os.Getenv("GOFLOW_AGENT_TOKEN")
+	if token == "" {
+		slog.Error("GOFLOW_AGENT_TOKEN not set")
+		os.Exit(1)
+	}
+
+	jobs.Use(jobs.Recover())
+
+	jobTypes := splitList(*types)
+	for _, t := range jobTypes {
+		if serverOnlyTypes[t] || jobs.NeedsDatabase(t) {
+			slog.Error("Job type cannot run on a remote agent", "job_type", t)
+			os.Exit(1)
+		}
+	}
+
+	for {
+		err := run(*server, token, message{
+			Type:        "hello",
+			Name:        *name,
+			JobTypes:    jobTypes,
+			Queues:      splitList(*queues),
+			Concurrency: *concurrency,
+		})
+		slog.Warn("Disconnected, reconnecting in 5s", "server", *server, "error", err)
+		time.Sleep(5 * time.Second)
+	}
+}
+
+func run(server, token string, hello message) error {
+
+	origin := &url.URL{Scheme: "http", Host: "goflow-agent"}
+	location, err := url.Parse(server)
+	if err != nil {
+		return err
+	}
+
+	cfg := &websocket.Config{
+		Location: location,
+		Origin:   origin,
+		Version:  websocket.ProtocolVersionHybi13,
+		Header:   http.Header{"Authorization": {"Bearer " + token}},
+	}
+
+	conn, err := websocket.DialConfig(cfg)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := websocket.JSON.Send(conn, hello); err != nil {
+		return err
+	}
+
+	slog.Info("Connected", "server", server, "agent", hello.Name)
+
+	var sendMu sync.Mutex
+
+	for {
+		var msg message
+		if err := websocket.JSON.Receive(conn, &msg); err != nil {
+			return err
+		}
+
+		if msg.Type != "job" || msg.Job == nil {
+			continue
+		}
+
+		go func(j *job) {
+			result := execute(j)
+
+			sendMu.Lock()
+			defer sendMu.Unlock()
+			if err := websocket.JSON.Send(conn, result); err != nil {
+				slog.Error("Failed to report job", "job_id", j.ID, "error", err)
+			}
+		}(msg.Job)
+	}
+}
+
+func execute(j *job) message {
+
+	slog.Info("Executing job", "job_id", j.ID, "job_type", j.Type)
+
+	ctx := jobs.WithJobID(context.Background(), j.ID)
+
+	if j.TimeoutSeconds != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(*j.TimeoutSeconds)*time.Second)
+		defer cancel()
+	}
+
+	statusCode, responseBody, execErr := jobs.Execute(ctx, j.Type, j.Payload)
+
+	if ctx.Err() == context.DeadlineExceeded {
+		execErr = fmt.Errorf("timed out after %ds", *j.TimeoutSeconds)
+	}
+
+	result := message{
+		Type:       "result",
+		JobID:      j.ID,
+		StatusCode: statusCode,
+	}
+
+	if len(responseBody) > 0 {
+		if json.Valid(responseBody) {
+			result.Response = responseBody
+		} else {
+			result.Response, _ = json.Marshal(map[string]string{"raw": string(responseBody)})
+		}
+	}
+
+	if execErr != nil {
+		result.Error = execErr.Error()
+		result.Permanent = jobs.IsPermanent(execErr)
+		if after, ok := jobs.RetryAfterOf(execErr); ok {
+			result.RetryAfter = int(after.Seconds())
+		}
+		if after, ok := jobs.DeferredBy(execErr); ok {
+			result.Defer = max(int((after+time.Second-1)/time.Second), 1)
+		}
+	}
+
+	return result
+}
+
+func splitList(raw string) []string {
+	var out []string
+	for _, s := range strings.Split(raw, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func hostname() string {
+	h, _ := os.Hostname()
+	return h
+}
@@ -0,0 +1,436 @@
+// Command goflow is a command-line client for the GoFlow HTTP API:
+//
+//	goflow submit -t http_request -f payload.json [-q queue] [-priority n] [-tag t] [-at time]
+//	goflow get <id>
+//	goflow list [-status s] [-type t] [-queue q] [-tag t]
+//	goflow cancel <id>
+//	goflow retry <id>
+//	goflow events <id>
+//	goflow tail [<id>] [-type t] [-queue q]
+//
+// The server defaults to $GOFLOW_URL, or http://localhost:8080; -server
+// before the subcommand overrides it. The API key comes from
+// $GOFLOW_API_KEY or -api-key. Responses are printed as indented
+// JSON; tail prints one line per job event until interrupted, or until
+// the job it follows finishes.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	server = "http://localhost:8080"
+	apiKey string
+)
+
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{
+	"submit": {"submit -t type [-f payload.json | -d json] [flags]", submit},
+	"get":    {"get <id>", get},
+	"list":   {"list [-status s] [-type t] [-queue q] [-tag t]", list},
+	"cancel": {"cancel <id>", cancel},
+	"retry":  {"retry <id>", retry},
+	"events": {"events <id>", events},
+	"tail":   {"tail [<id>] [-type t] [-queue q]", tail},
+}
+
+// errUsage makes main print the subcommand's usage.
+var errUsage = errors.New("usage")
+
+// stringList collects a repeatable flag.
+type stringList []string
+
+func (l *stringList) String() string     { return strings.Join(*l, ",") }
+func (l *stringList) Set(v string) error { *l = append(*l, v); return nil }
+
+func main() {
+
+	if v := os.Getenv("GOFLOW_URL"); v != "" {
+		server = v
+	}
+	apiKey = os.Getenv("GOFLOW_API_KEY")
+
+	fs := flag.NewFlagSet("goflow", flag.ExitOnError)
+	fs.StringVar(&server, "server", server, "GoFlow server URL")
+	fs.StringVar(&apiKey, "api-key", apiKey, "API key")
+	fs.Usage = usage
+	fs.Parse(os.Args[1:])
+
+	if fs.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	name := fs.Arg(0)
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "goflow: unknown command %q\n", name)
+		usage()
+		os.Exit(2)
+	}
+
+	server = strings.TrimRight(server, "/")
+
+	if err := cmd.run(fs.Args()[1:]); err != nil {
+		if err == errUsage {
+			fmt.Fprintln(os.Stderr, "usage: goflow", cmd.usage)
+			os.Exit(2)
+		}
+		fmt.Fprintln(os.Stderr, "goflow:", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: goflow [-server url] [-api-key key] <command> [args]")
+	for _, name := range []string{"submit", "get", "list", "cancel", "retry", "events", "tail"} {
+		fmt.Fprintln(os.Stderr, "  goflow", commands[name].usage)
+	}
+}
+
+func submit(args []string) error {
+
+	fs := flag.NewFlagSet("submit", flag.ContinueOnError)
+	jobType := fs.String("t", "", "job type")
+	file := fs.String("f", "", "payload JSON file, - for stdin")
+	data := fs.String("d", "", "payload JSON")
+	queue := fs.String("q", "", "queue")
+	priority := fs.Int("priority", 0, "priority, higher runs first")
+	at := fs.String("at", "", "run_at (RFC 3339) or a delay such as 10m")
+	key := fs.String("idempotency-key", "", "Idempotency-Key header")
+	var tags stringList
+	fs.Var(&tags, "tag", "tag (repeatable)")
+
+	if err := fs.Parse(args); err != nil || *jobType == "" || fs.NArg() > 0 {
+		return errUsage
+	}
+
+	payload := json.RawMessage(`{}`)
+	switch {
+	case *file != "" && *data != "":
+		return errors.New("-f and -d are mutually exclusive")
+	case *file == "-":
+		b, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		payload = b
+	case *file != "":
+		b, err := os.ReadFile(*file)
+		if err != nil {
+			return err
+		}
+		payload = b
+	case *data != "":
+		payload = json.RawMessage(*data)
+	}
+	if !json.Valid(payload) {
+		return errors.New("payload is not valid JSON")
+	}
+
+	req := map[string]interface{}{
+		"type":    *jobType,
+		"payload": payload,
+	}
+	if *queue != "" {
+		req["queue"] = *queue
+	}
+	if *priority != 0 {
+		req["priority"] = *priority
+	}
+	if len(tags) > 0 {
+		req["tags"] = tags
+	}
+	if *at != "" {
+		runAt, err := parseRunAt(*at)
+		if err != nil {
+			return err
+		}
+		req["run_at"] = runAt
+	}
+
+	body, _ := json.Marshal(req)
+
+	header := http.Header{"Content-Type": {"application/json"}}
+	if *key != "" {
+		header.Set("Idempotency-Key", *key)
+	}
+
+	return call(http.MethodPost, "/jobs", body, header)
+}
+
+// parseRunAt reads an RFC 3339 time or a delay from now.
+func parseRunAt(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("-at must be an RFC 3339 time or a duration")
+	}
+	return time.Now().Add(d), nil
+}
+
+func get(args []string) error {
+	id, err := jobID(args)
+	if err != nil {
+		return err
+	}
+	return call(http.MethodGet, "/jobs/"+id, nil, nil)
+}
+
+func list(args []string) error {
+
+	fs := flag.NewFlagSet("list", flag.ContinueOnError)
+	status := fs.String("status", "", "status")
+	jobType := fs.String("type", "", "job type")
+	queue := fs.String("queue", "", "queue")
+	var tags stringList
+	fs.Var(&tags, "tag", "tag (repeatable)")
+
+	if err := fs.Parse(args); err != nil || fs.NArg() > 0 {
+		return errUsage
+	}
+
+	q := url.Values{}
+	for name, v := range map[string]string{"status": *status, "type": *jobType, "queue": *queue} {
+		if v != "" {
+			q.Set(name, v)
+		}
+	}
+	q["tag"] = tags
+
+	path := "/jobs"
+	if len(q) > 0 {
+		path += "?" + q.Encode()
+	}
+	return call(http.MethodGet, path, nil, nil)
+}
+
+func cancel(args []string) error {
+	id, err := jobID(args)
+	if err != nil {
+		return err
+	}
+	return call(http.MethodDelete, "/jobs/"+id, nil, nil)
+}
+
+func retry(args []string) error {
+	id, err := jobID(args)
+	if err != nil {
+		return err
+	}
+	return call(http.MethodPost, "/jobs/"+id+"/retry", nil, nil)
+}
+
+func events(args []string) error {
+	id, err := jobID(args)
+	if err != nil {
+		return err
+	}
+	return call(http.MethodGet, "/jobs/"+id+"/events", nil, nil)
+}
+
+func jobID(args []string) (string, error) {
+	if len(args) != 1 {
+		return "", errUsage
+	}
+	if _, err := strconv.Atoi(args[0]); err != nil {
+		return "", fmt.Errorf("invalid job id %q", args[0])
+	}
+	return args[0], nil
+}
+
+// call sends a request and prints the JSON response. Non-2xx responses
+// become errors carrying the server's message.
+func call(method, path string, body []byte, header http.Header) error {
+
+	req, err := http.NewRequest(method, server+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	authorize(req)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	out, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(out)))
+	}
+
+	var pretty bytes.Buffer
+	if json.Indent(&pretty, out, "", "  ") != nil {
+		os.Stdout.Write(out)
+		return nil
+	}
+	pretty.WriteByte('\n')
+	pretty.WriteTo(os.Stdout)
+	return nil
+}
+
+func authorize(req *http.Request) {
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+}
+
+type event struct {
+	ID        int64     `json:"id"`
+	JobID     int       `json:"job_id"`
+	JobType   string    `json:"job_type"`
+	Queue     string    `json:"queue"`
+	Event     string    `json:"event"`
+	Status    string    `json:"status"`
+	Worker    *string   `json:"worker"`
+	Attempt   *int      `json:"attempt"`
+	Error     *string   `json:"error"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// tail follows GET /events, or one job's stream, reconnecting with the
+// last event id when the connection drops.
+func tail(args []string) error {
+
+	fs := flag.NewFlagSet("tail", flag.ContinueOnError)
+	jobType := fs.String("type", "", "only this job type")
+	queue := fs.String("queue", "", "only this queue")
+
+	// The job id may come before or after the flags
+	var id string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		id, args = args[0], args[1:]
+	}
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+	if id == "" && fs.NArg() == 1 {
+		id = fs.Arg(0)
+	} else if fs.NArg() > 0 {
+		return errUsage
+	}
+
+	path := "/events"
+	q := url.Values{}
+	if id != "" {
+		if _, err := jobID([]string{id}); err != nil {
+			return err
+		}
+		if *jobType != "" || *queue != "" {
+			return errors.New("-type and -queue only apply without a job id")
+		}
+		path = "/jobs/" + id + "/stream"
+	}
+	if *jobType != "" {
+		q.Set("type", *jobType)
+	}
+	if *queue != "" {
+		q.Set("queue", *queue)
+	}
+
+	lastID := ""
+	for {
+		done, err := follow(path, q, &lastID)
+		if done {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "goflow: stream interrupted (%v), reconnecting\n", err)
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// follow reads one connection's worth of events. done is true when the
+// server ended the stream on purpose or refused it.
+func follow(path string, q url.Values, lastID *string) (done bool, err error) {
+
+	req, err := http.NewRequest(http.MethodGet, server+path+"?"+q.Encode(), nil)
+	if err != nil {
+		return true, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	authorize(req)
+	if *lastID != "" {
+		req.Header.Set("Last-Event-ID", *lastID)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		out, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode != http.StatusServiceUnavailable,
+			fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(out)))
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			*lastID = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			var e event
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e); err != nil {
+				continue
+			}
+			printEvent(e)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return false, err
+	}
+
+	// A job stream ends by itself once the job is finished
+	if strings.HasSuffix(path, "/stream") {
+		return true, nil
+	}
+	return false, io.ErrUnexpectedEOF
+}
+
+func printEvent(e event) {
+
+	line := fmt.Sprintf("%s  job %-6d %-16s %-10s %s",
+		e.CreatedAt.Local().Format("15:04:05"), e.JobID, e.JobType, e.Event, e.Status)
+	if e.Attempt != nil {
+		line += fmt.Sprintf("  attempt=%d", *e.Attempt)
+	}
+	if e.Worker != nil {
+		line += "  worker=" + *e.Worker
+	}
+	if e.Error != nil {
+		line += "  error=" + strconv.Quote(*e.Error)
+	}
+	fmt.Println(line)
+}
@@ -0,0 +1,349 @@
+package engine
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"goflow/jobs"
+	"goflow/routing"
+
+	"golang.org/x/net/websocket"
+)
+
+// ==================== REMOTE AGENTS ====================
+//
+// Remote agents connect to /agents/connect over WebSocket, advertise the
+// job types and queues they handle, and receive claimed jobs as messages.
+// The server keeps ownership of the job row: it claims, heartbeats and
+// finalizes jobs exactly like a local worker, so agents never need
+// database access.
+//
+//	agent  -> server  {"type": "hello", "name": "scraper-1", "job_types": ["data_extract"], "queues": ["scraper"], "concurrency": 2}
+//	server -> agent   {"type": "job", "job": {"id": 1, "type": "data_extract", "payload": {...}}}
+//	agent  -> server  {"type": "result", "job_id": 1, "status_code": 200, "response": {...}, "error": ""}
+//	server -> agent   {"type": "ping"}
+
+type agentMessage struct {
+	Type string `json:"type"`
+
+	// hello
+	Name        string   `json:"name,omitempty"`
+	JobTypes    []string `json:"job_types,omitempty"`
+	Queues      []string `json:"queues,omitempty"`
+	Concurrency int      `json:"concurrency,omitempty"`
+
+	// job
+	Job *Job `json:"job,omitempty"`
+
+	// result
+	JobID      int             `json:"job_id,omitempty"`
+	StatusCode int             `json:"status_code,omitempty"`
+	Response   json.RawMessage `json:"response,omitempty"`
+	Error      string          `json:"error,omitempty"`
+	Permanent  bool            `json:"permanent,omitempty"`
+
+	RetryAfterSeconds int `json:"retry_after_seconds,omitempty"`
+	DeferSeconds      int `json:"defer_seconds,omitempty"`
+}
+
+type agentInfo struct {
+	Name        string    `json:"name"`
+	JobTypes    []string  `json:"job_types"`
+	Queues      []string  `json:"queues"`
+	Concurrency int       `json:"concurrency"`
+	InFlight    int       `json:"in_flight"`
+	ConnectedAt time.Time `json:"connected_at"`
+}
+
+type agentSession struct {
+	conn *websocket.Conn
+	info agentInfo
+
+	sendMu sync.Mutex
+
+	mu       sync.Mutex
+	inFlight map[int]*agentJob
+}
+
+type agentJob struct {
+	job           Job
+	started       time.Time
+	stopHeartbeat func()
+}
+
+var agents = struct {
+	sync.Mutex
+	sessions map[*agentSession]struct{}
+}{sessions: make(map[*agentSession]struct{})}
+
+// agentsHandler upgrades /agents/connect. Agents authenticate with
+// "Authorization: Bearer <agent_token>"; without a configured token the
+// endpoint is disabled.
+func agentsHandler() http.Handler {
+	return websocket.Server{
+		Handshake: func(_ *websocket.Config, r *http.Request) error {
+			token := cfg.AgentToken
+			if token == "" {
+				return errors.New("remote agents are disabled")
+			}
+			got := r.Header.Get("Authorization")
+			if subtle.ConstantTimeCompare([]byte(got), []byte("Bearer "+token)) != 1 {
+				return errors.New("invalid agent token")
+			}
+			return nil
+		},
+		Handler: serveAgent,
+	}
+}
+
+func agentListHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	agents.Lock()
+	list := make([]agentInfo, 0, len(agents.sessions))
+	for s := range agents.sessions {
+		s.mu.Lock()
+		info := s.info
+		info.InFlight = len(s.inFlight)
+		s.mu.Unlock()
+		list = append(list, info)
+	}
+	agents.Unlock()
+
+	json.NewEncoder(w).Encode(list)
+}
+
+func serveAgent(conn *websocket.Conn) {
+	defer conn.Close()
+
+	var hello agentMessage
+	if err := websocket.JSON.Receive(conn, &hello); err != nil || hello.Type != "hello" {
+		slog.Warn("Agent handshake failed", "error", err)
+		return
+	}
+
+	if hello.Concurrency <= 0 {
+		hello.Concurrency = 1
+	}
+	if len(hello.Queues) == 0 {
+		hello.Queues = []string{routing.DefaultGroup()}
+	}
+
+	s := &agentSession{
+		conn: conn,
+		info: agentInfo{
+			Name:        hello.Name,
+			JobTypes:    hello.JobTypes,
+			Queues:      hello.Queues,
+			Concurrency: hello.Concurrency,
+			ConnectedAt: time.Now(),
+		},
+		inFlight: make(map[int]*agentJob),
+	}
+
+	agents.Lock()
+	agents.sessions[s] = struct{}{}
+	agents.Unlock()
+
+	slog.Info("Agent connected", "agent", s.info.Name, "job_types", s.info.JobTypes,
+		"queues", s.info.Queues, "concurrency", s.info.Concurrency)
+
+	done := make(chan struct{})
+	go s.dispatch(done)
+
+	// Read results until the connection drops
+	for {
+		var msg agentMessage
+		if err := websocket.JSON.Receive(conn, &msg); err != nil {
+			break
+		}
+		if msg.Type == "result" {
+			s.handleResult(msg)
+		}
+	}
+
+	close(done)
+
+	agents.Lock()
+	delete(agents.sessions, s)
+	agents.Unlock()
+
+	// Anything the agent still held goes back to the queue
+	s.mu.Lock()
+	for id, aj := range s.inFlight {
+		aj.stopHeartbeat()
+		releaseJob(id)
+		releaseTypeSlot(id)
+	}
+	s.inFlight = nil
+	s.mu.Unlock()
+
+	slog.Info("Agent disconnected", "agent", s.info.Name)
+}
+
+func (s *agentSession) send(msg agentMessage) error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	return websocket.JSON.Send(s.conn, msg)
+}
+
+// dispatch claims jobs on the agent's behalf while it has spare capacity.
+func (s *agentSession) dispatch(done chan struct{}) {
+
+	ping := time.NewTicker(30 * time.Second)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ping.C:
+			s.send(agentMessage{Type: "ping"})
+			continue
+		default:
+		}
+
+		s.mu.Lock()
+		busy := len(s.inFlight) >= s.info.Concurrency
+		s.mu.Unlock()
+
+		if busy {
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+
+		wake := jobWakeup()
+
+		id, err := s.claim()
+		if err == sql.ErrNoRows {
+			// Wake at least as often as the agent is pinged
+			wait := idleWait(s.info.Queues)
+			if wait > 30*time.Second {
+				wait = 30 * time.Second
+			}
+			waitForJobs(done, wake, wait)
+			continue
+		}
+		if err != nil {
+			slog.Error("Claim failed", "agent", s.info.Name, "error", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		job, ok := loadClaimedJob(0, id)
+		if !ok {
+			releaseTypeSlot(id)
+			continue
+		}
+
+		aj := &agentJob{job: job, started: time.Now(), stopHeartbeat: startHeartbeat(job.ID)}
+
+		s.mu.Lock()
+		if s.inFlight == nil {
+			// Disconnected while claiming
+			s.mu.Unlock()
+			aj.stopHeartbeat()
+			releaseJob(job.ID)
+			releaseTypeSlot(job.ID)
+			return
+		}
+		s.inFlight[job.ID] = aj
+		s.mu.Unlock()
+
+		jobLogger(0, job).Info("Dispatching job", "agent", s.info.Name)
+
+		// Agents have no database, so they get secrets and outputs
+		// resolved; the copy kept in aj still holds the references
+		sent := job
+		sent.Payload, err = jobs.ResolveSecrets(context.Background(), job.TenantID, job.Payload)
+		if err == nil {
+			sent.Payload, err = jobs.ResolveOutputs(context.Background(), job.TenantID, sent.Payload)
+		}
+		if err != nil {
+			s.handleResult(agentMessage{Type: "result", JobID: job.ID, Error: err.Error()})
+			continue
+		}
+
+		if err := s.send(agentMessage{Type: "job", Job: &sent}); err != nil {
+			// The read loop notices the broken connection and releases it
+			slog.Warn("Agent send failed", "agent", s.info.Name, "job_id", job.ID, "error", err)
+			return
+		}
+	}
+}
+
+func (s *agentSession) claim() (int, error) {
+
+	limited, err := claimLimitedTypes()
+	if err != nil {
+		return 0, err
+	}
+
+	claimed, err := store.ClaimJobs(ClaimRequest{
+		Queues:    s.info.Queues,
+		Types:     s.info.JobTypes,
+		SkipTypes: append(internalJobTypes(), limited...),
+		Limit:     1,
+		Worker:    agentWorkerName(s.info.Name),
+	})
+	if err != nil {
+		return 0, err
+	}
+	if len(claimed) == 0 {
+		return 0, sql.ErrNoRows
+	}
+
+	id := claimed[0].ID
+	if !admitClaimedJob(id, claimed[0].Type) {
+		return id, sql.ErrNoRows
+	}
+	return id, nil
+}
+
+func (s *agentSession) handleResult(msg agentMessage) {
+
+	s.mu.Lock()
+	aj, ok := s.inFlight[msg.JobID]
+	if ok {
+		delete(s.inFlight, msg.JobID)
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		slog.Warn("Result for unknown job ignored", "agent", s.info.Name, "job_id", msg.JobID)
+		return
+	}
+
+	aj.stopHeartbeat()
+	defer releaseTypeSlot(msg.JobID)
+
+	var execErr error
+	if msg.Error != "" {
+		execErr = fmt.Errorf("%s", msg.Error)
+		if msg.DeferSeconds > 0 {
+			execErr = jobs.Defer(execErr, time.Duration(msg.DeferSeconds)*time.Second)
+		} else if msg.Permanent {
+			execErr = jobs.Permanent(execErr)
+		} else if msg.RetryAfterSeconds > 0 {
+			execErr = jobs.RetryAfter(execErr, time.Duration(msg.RetryAfterSeconds)*time.Second)
+		}
+	}
+
+	duration := time.Since(aj.started).Milliseconds()
+
+	jobLogger(0, aj.job).Info("Agent job finished", "agent", s.info.Name, "duration_ms", duration)
+
+	finalizeJob(0, aj.job, msg.StatusCode, msg.Response, execErr, duration, nil)
+}
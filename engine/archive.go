@@ -0,0 +1,155 @@
+package engine
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// ==================== ARCHIVE ====================
+//
+// With archive: true, the retention janitor and POST /admin/purge move
+// finished jobs into jobs_archive instead of deleting them. The archive
+// keeps their history out of the claim path, and GET /jobs and
+// GET /jobs/export read it too when asked:
+//
+//	GET /jobs?include_archived=true&type=send_email
+//
+// An archived job keeps its events and logs, and GET /jobs/{id} and its
+// events and logs pages still serve it, read-only.
+//
+// jobs_archive has the columns of jobs plus archived_at; a migration that
+// adds a column to jobs adds it to the archive too. archive_retention, when
+// set, deletes archived jobs for good after that long.
+
+// archiveColumns is the quoted column list of jobs, which jobs_archive
+// shares; set by initArchive.
+var archiveColumns string
+
+// initArchive reads the columns of jobs for moving rows to jobs_archive.
+// The migrations keep both tables' columns the same.
+func initArchive() error {
+
+	rows, err := db.Query(`
+		SELECT attname
+		FROM pg_attribute
+		WHERE attrelid = 'jobs'::regclass AND attnum > 0 AND NOT attisdropped
+		ORDER BY attnum
+	`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		names = append(names, pq.QuoteIdentifier(name))
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	archiveColumns = strings.Join(names, ", ")
+	return nil
+}
+
+// archivedJobsSource stands in for "jobs" in a FROM clause to read live and
+// archived jobs together.
+func archivedJobsSource() string {
+	return `(
+		SELECT ` + archiveColumns + ` FROM jobs
+		UNION ALL
+		SELECT ` + archiveColumns + ` FROM jobs_archive
+	) AS jobs`
+}
+
+// moveToArchive wraps a DELETE ... FROM jobs statement so the deleted rows
+// are inserted into jobs_archive. Their events and logs stay where they
+// are. The statement returns how many jobs it moved.
+func moveToArchive(deleteSQL string) string {
+	return `
+		WITH moved AS (` + deleteSQL + ` RETURNING ` + archiveColumns + `),
+		archived AS (
+			INSERT INTO jobs_archive (` + archiveColumns + `)
+			SELECT ` + archiveColumns + ` FROM moved
+		)
+		SELECT COUNT(*) FROM moved
+	`
+}
+
+// withoutHistory wraps a DELETE of live or archived jobs so their events
+// and logs are deleted too. The statement returns how many jobs it
+// deleted.
+func withoutHistory(deleteSQL string) string {
+	return `
+		WITH gone AS (` + deleteSQL + ` RETURNING id)` + jobHistoryCleanup("gone") + `
+		SELECT COUNT(*) FROM gone
+	`
+}
+
+// jobHistoryCleanup is the WITH clauses deleting the events and logs of
+// the jobs whose ids the query named cte returns.
+func jobHistoryCleanup(cte string) string {
+	return `,
+		gone_events AS (DELETE FROM job_events WHERE job_id IN (SELECT id FROM ` + cte + `)),
+		gone_logs AS (DELETE FROM job_logs WHERE job_id IN (SELECT id FROM ` + cte + `))`
+}
+
+// isArchived reports whether the job has been moved to jobs_archive.
+func isArchived(jobID int) bool {
+	var ok bool
+	err := db.QueryRow(`SELECT TRUE FROM jobs_archive WHERE id = $1`, jobID).Scan(&ok)
+	return err == nil && ok
+}
+
+// archivedJobHandler serves the read-only pages of an archived job:
+// GET /jobs/{id}, /jobs/{id}/events and /jobs/{id}/logs.
+func archivedJobHandler(w http.ResponseWriter, r *http.Request, jobID int, parts []string) {
+
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		getJob(w, r, jobID, "jobs_archive")
+	case len(parts) == 2 && parts[1] == "events":
+		jobEventsHandler(w, r, jobID)
+	case len(parts) == 2 && parts[1] == "logs":
+		jobLogsHandler(w, r, jobID)
+	default:
+		http.Error(w, "Job is archived", http.StatusConflict)
+	}
+}
+
+// pruneArchive deletes archived jobs older than archive_retention.
+func pruneArchive(ctx context.Context) (int, error) {
+
+	total := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return total, err
+		}
+
+		var n int
+		err := db.QueryRowContext(ctx, withoutHistory(`
+			DELETE FROM jobs_archive
+			WHERE id IN (
+				SELECT id FROM jobs_archive
+				WHERE archived_at < NOW() - make_interval(secs => $1)
+				LIMIT `+strconv.Itoa(bulkBatchSize)+`
+			)
+		`), cfg.ArchiveRetention.Seconds()).Scan(&n)
+		if err != nil {
+			return total, err
+		}
+
+		total += n
+		if n < bulkBatchSize {
+			return total, nil
+		}
+	}
+}
@@ -0,0 +1,312 @@
+package engine
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ==================== BATCHES ====================
+//
+// Jobs submitted with the same batch_id are followed as one group:
+//
+//	POST /jobs {"type": "send_email", "batch_id": "newsletter-42", "payload": {...}}
+//	GET  /batches/newsletter-42
+//
+// Any batch_id can be used without declaring it. Declaring the batch first
+// with POST /batches adds a callback, sent once through the outbox when
+// the last member finishes, and an optional size: with one, the batch is
+// not complete before that many jobs have joined, so a callback cannot
+// fire while the batch is still being submitted.
+
+type Batch struct {
+	ID          string     `json:"id"`
+	Size        *int       `json:"size,omitempty"`
+	CallbackURL string     `json:"callback_url,omitempty"`
+	Complete    bool       `json:"complete"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+
+	Total      int `json:"total"`
+	Pending    int `json:"pending"`
+	Processing int `json:"processing"`
+	Completed  int `json:"completed"`
+	Failed     int `json:"failed"`
+	Cancelled  int `json:"cancelled"`
+	Expired    int `json:"expired"`
+}
+
+// batchCountsSQL counts a batch's members by status; $1 is the tenant and
+// $2 the batch id.
+const batchCountsSQL = `
+	SELECT COUNT(*),
+		COUNT(*) FILTER (WHERE status = 'pending'),
+		COUNT(*) FILTER (WHERE status = 'processing'),
+		COUNT(*) FILTER (WHERE status = 'completed'),
+		COUNT(*) FILTER (WHERE status = 'failed'),
+		COUNT(*) FILTER (WHERE status = 'cancelled'),
+		COUNT(*) FILTER (WHERE status = 'expired')
+	FROM jobs
+	WHERE tenant_id = $1 AND batch_id = $2
+`
+
+func (b *Batch) scanCounts(row rowScanner) error {
+	return row.Scan(&b.Total, &b.Pending, &b.Processing, &b.Completed, &b.Failed, &b.Cancelled, &b.Expired)
+}
+
+// finished reports whether every member has finished and, for a batch
+// with a size, all of them have joined.
+func (b *Batch) finished() bool {
+	if b.Total == 0 || b.Pending+b.Processing > 0 {
+		return false
+	}
+	return b.Size == nil || b.Total >= *b.Size
+}
+
+// validBatchID checks a batch id given in field of a request.
+func validBatchID(field, id string) error {
+	if strings.TrimSpace(id) != id || id == "" {
+		return fmt.Errorf("'%s' must be a non-empty string without surrounding spaces", field)
+	}
+	if strings.Contains(id, "/") {
+		return fmt.Errorf("'%s' must not contain '/'", field)
+	}
+	return nil
+}
+
+// batchesHandler serves POST /batches, declaring a batch before its jobs
+// are submitted.
+func batchesHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		ID             string `json:"id"`
+		Size           *int   `json:"size"`
+		CallbackURL    string `json:"callback_url"`
+		CallbackSecret string `json:"callback_secret"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if err := validBatchID("id", req.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Size != nil && *req.Size < 1 {
+		http.Error(w, "'size' must be at least 1", http.StatusBadRequest)
+		return
+	}
+
+	if req.CallbackURL == "" && req.CallbackSecret != "" {
+		http.Error(w, "'callback_secret' needs a 'callback_url'", http.StatusBadRequest)
+		return
+	}
+
+	// Stored like a job's callback_secret: encrypted when the server can
+	secret := map[string]interface{}{}
+	if req.CallbackSecret != "" {
+		secret["callback_secret"] = req.CallbackSecret
+	}
+	if !encryptSensitive(w, secret, nil) {
+		return
+	}
+	storedSecret, _ := secret["callback_secret"].(string)
+
+	tenant := tenantOf(r)
+
+	res, err := db.Exec(`
+		INSERT INTO batches (tenant_id, id, size, callback_url, callback_secret)
+		VALUES ($1, $2, $3, NULLIF($4, ''), NULLIF($5, ''))
+		ON CONFLICT (tenant_id, id) DO NOTHING
+	`, tenant, req.ID, req.Size, req.CallbackURL, storedSecret)
+
+	if err != nil {
+		http.Error(w, "Insert failed", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Batch "+req.ID+" already exists", http.StatusConflict)
+		return
+	}
+
+	b, err := loadBatch(tenant, req.ID)
+	if err != nil {
+		http.Error(w, "Query failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(b)
+}
+
+// batchDetailHandler serves GET /batches/{id}.
+func batchDetailHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/batches/")
+	if validBatchID("id", id) != nil {
+		http.Error(w, "Invalid batch id", http.StatusBadRequest)
+		return
+	}
+
+	b, err := loadBatch(tenantOf(r), id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Batch not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Query failed", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(b)
+}
+
+// loadBatch returns the batch with its counts, or sql.ErrNoRows when it
+// was neither declared nor used by any job.
+func loadBatch(tenant, id string) (*Batch, error) {
+
+	b := &Batch{ID: id}
+	var callbackURL sql.NullString
+
+	err := db.QueryRow(`
+		SELECT size, callback_url, completed_at
+		FROM batches
+		WHERE tenant_id = $1 AND id = $2
+	`, tenant, id).Scan(&b.Size, &callbackURL, &b.CompletedAt)
+
+	declared := err == nil
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	b.CallbackURL = callbackURL.String
+
+	if err := b.scanCounts(db.QueryRow(batchCountsSQL, tenant, id)); err != nil {
+		return nil, err
+	}
+
+	if !declared && b.Total == 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	b.Complete = b.CompletedAt != nil || b.finished()
+	return b, nil
+}
+
+// checkBatchOpen rejects jobs joining a declared batch that has already
+// completed.
+func checkBatchOpen(tenant, id string) error {
+
+	var completed bool
+
+	err := db.QueryRow(`
+		SELECT completed_at IS NOT NULL
+		FROM batches
+		WHERE tenant_id = $1 AND id = $2
+	`, tenant, id).Scan(&completed)
+
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if completed {
+		return errBatchComplete
+	}
+	return nil
+}
+
+var errBatchComplete = errors.New("batch is already complete")
+
+// enqueueBatchCallback runs inside the transaction that finalizes a batch
+// member. When that member was the last one, the batch is marked complete
+// and its callback recorded in the outbox. The batch row is locked first,
+// so of two members finishing together the second one to commit sees
+// both and sends the callback.
+func enqueueBatchCallback(tx *sql.Tx, job Job) error {
+
+	if job.BatchID == "" {
+		return nil
+	}
+
+	b := &Batch{ID: job.BatchID}
+	var callbackURL, secret sql.NullString
+
+	err := tx.QueryRow(`
+		SELECT size, callback_url, callback_secret
+		FROM batches
+		WHERE tenant_id = $1 AND id = $2 AND completed_at IS NULL
+		FOR UPDATE
+	`, job.TenantID, job.BatchID).Scan(&b.Size, &callbackURL, &secret)
+
+	// Undeclared or already complete
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := b.scanCounts(tx.QueryRow(batchCountsSQL, job.TenantID, job.BatchID)); err != nil {
+		return err
+	}
+
+	if !b.finished() {
+		return nil
+	}
+
+	err = tx.QueryRow(`
+		UPDATE batches
+		SET completed_at = NOW()
+		WHERE tenant_id = $1 AND id = $2
+		RETURNING completed_at
+	`, job.TenantID, job.BatchID).Scan(&b.CompletedAt)
+
+	if err != nil || !callbackURL.Valid {
+		return err
+	}
+
+	deliveryID := "batch-" + job.TenantID + "-" + job.BatchID
+
+	status := "completed"
+	if b.Failed+b.Cancelled+b.Expired > 0 {
+		status = "completed_with_failures"
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"delivery_id": deliveryID,
+		"batch_id":    b.ID,
+		"status":      status,
+		"total":       b.Total,
+		"completed":   b.Completed,
+		"failed":      b.Failed,
+		"cancelled":   b.Cancelled,
+		"expired":     b.Expired,
+	})
+
+	// The job that finished last stands in for the batch: delivery looks
+	// up the tenant through it to resolve the secret
+	_, err = tx.Exec(`
+		INSERT INTO outbox (job_id, kind, target_url, secret, body, delivery_id)
+		VALUES ($1, 'batch_callback', $2, $3, $4, $5)
+		ON CONFLICT (delivery_id) DO NOTHING
+	`, job.ID, callbackURL.String, secret, body, deliveryID)
+
+	return err
+}
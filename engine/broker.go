@@ -0,0 +1,387 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/redis/go-redis/v9"
+)
+
+// ==================== REDIS BROKER ====================
+//
+// Claiming from Postgres costs every claim a locked scan of the pending
+// jobs and every idle worker a query per poll, which caps throughput for
+// floods of small fire-and-forget jobs. With
+//
+//	broker: redis
+//	redis_url: "redis://redis:6379/0"
+//
+// Postgres still holds every job, its status and its result, but the ids
+// of ready jobs travel through Redis:
+//
+//	goflow:ready:<queue>  sorted set of due job ids, scored by -priority;
+//	                      equal priorities pop the oldest id first
+//	goflow:delayed        jobs not due yet, scored by run_at
+//
+// Each server runs a feeder that hands newly pending jobs (brokered is
+// false) to Redis in batches and promotes delayed ones as they fall due.
+// Workers block on BZPOPMIN and claim what they pop with a primary key
+// update that re-checks the job is still runnable, so an id popped twice,
+// or popped after its job was cancelled, is simply dropped.
+//
+// Redis is not the record. A job Redis lost, for example on a restart
+// without persistence, is fed again once it has been due for
+// brokerRequeueAfter. Agents that only take some job types still claim
+// from Postgres.
+//
+// The brokered column comes from migration 0002, whose trigger clears it
+// whenever a change makes a job pending again or moves it, so the feeder
+// hands the job over anew.
+
+const (
+	brokerDelayedKey   = "goflow:delayed"
+	brokerReadyPrefix  = "goflow:ready:"
+	brokerFeedBatch    = 1000
+	brokerTick         = 250 * time.Millisecond
+	brokerBlock        = 2 * time.Second
+	brokerRequeueAfter = 5 * time.Minute
+)
+
+// promoteScript moves up to ARGV[2] delayed jobs due by ARGV[1] (unix ms)
+// to their ready sets. Delayed members are "<priority>:<id>:<queue>".
+var promoteScript = redis.NewScript(`
+local due = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+for _, member in ipairs(due) do
+	local priority, id, queue = string.match(member, '^(-?%d+):(%d+):(.*)$')
+	redis.call('ZADD', ARGV[3] .. queue, -tonumber(priority), id)
+	redis.call('ZREM', KEYS[1], member)
+end
+return #due
+`)
+
+type redisBroker struct {
+	client *redis.Client
+}
+
+// broker is set when cfg.Broker is "redis".
+var broker *redisBroker
+
+func openRedisBroker(redisURL string) (*redisBroker, error) {
+
+	opts, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return nil, err
+	}
+
+	client := redis.NewClient(opts)
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	return &redisBroker{client: client}, nil
+}
+
+// readyMember is a job's member in its ready set; the padding makes equal
+// priorities pop in id order.
+func readyMember(id int) string {
+	return fmt.Sprintf("%012d", id)
+}
+
+// brokeredJob is a job on its way to Redis.
+type brokeredJob struct {
+	ID       int
+	Queue    string
+	Priority int
+	RunAt    time.Time
+	Due      bool
+}
+
+// push adds jobs to their ready sets, or the delayed set if not due yet.
+// Adding a job that is already there only updates its score.
+func (b *redisBroker) push(ctx context.Context, jobs []brokeredJob) error {
+
+	pipe := b.client.Pipeline()
+	for _, j := range jobs {
+		if j.Due {
+			pipe.ZAdd(ctx, brokerReadyPrefix+j.Queue, redis.Z{Score: float64(-j.Priority), Member: readyMember(j.ID)})
+		} else {
+			pipe.ZAdd(ctx, brokerDelayedKey, redis.Z{
+				Score:  float64(j.RunAt.UnixMilli()),
+				Member: fmt.Sprintf("%d:%s:%s", j.Priority, readyMember(j.ID), j.Queue),
+			})
+		}
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// pop takes up to n job ids from queues, waiting up to brokerBlock for
+// the first. Queues are tried in order.
+func (b *redisBroker) pop(ctx context.Context, queues []string, n int) ([]int, error) {
+
+	keys := make([]string, len(queues))
+	for i, q := range queues {
+		keys[i] = brokerReadyPrefix + q
+	}
+
+	first, err := b.client.BZPopMin(ctx, brokerBlock, keys...).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	members := []redis.Z{first.Z}
+	if n > 1 {
+		more, err := b.client.ZPopMin(ctx, first.Key, int64(n-1)).Result()
+		if err != nil {
+			// The first one is ours either way
+			slog.Warn("Broker pop failed", "error", err)
+		}
+		members = append(members, more...)
+	}
+
+	ids := make([]int, 0, len(members))
+	for _, m := range members {
+		s, _ := m.Member.(string)
+		id, err := strconv.Atoi(s)
+		if err != nil {
+			slog.Warn("Dropping malformed broker entry", "member", m.Member)
+			continue
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// promote moves the delayed jobs that are due to their ready sets.
+func (b *redisBroker) promote(ctx context.Context) (int, error) {
+	return promoteScript.Run(ctx, b.client, []string{brokerDelayedKey},
+		time.Now().UnixMilli(), brokerFeedBatch, brokerReadyPrefix).Int()
+}
+
+// feed hands up to brokerFeedBatch pending jobs that Redis does not have
+// yet to it. The mark is only committed once Redis has them.
+func (b *redisBroker) feed(ctx context.Context) (int, error) {
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		UPDATE jobs
+		SET brokered = TRUE
+		WHERE id IN (
+			SELECT id FROM jobs
+			WHERE status = 'pending'
+			AND NOT brokered
+			ORDER BY id
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, queue, priority, run_at, run_at <= NOW()
+	`, brokerFeedBatch)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var fed []brokeredJob
+	for rows.Next() {
+		var j brokeredJob
+		if err := rows.Scan(&j.ID, &j.Queue, &j.Priority, &j.RunAt, &j.Due); err != nil {
+			return 0, err
+		}
+		fed = append(fed, j)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(fed) == 0 {
+		return 0, nil
+	}
+
+	if err := b.push(ctx, fed); err != nil {
+		return 0, err
+	}
+	return len(fed), tx.Commit()
+}
+
+// requeueLost clears the mark of jobs that have been due for
+// brokerRequeueAfter without being claimed, in case Redis lost them.
+// Handing over a job Redis still has is harmless.
+func (b *redisBroker) requeueLost() (int64, error) {
+	res, err := db.Exec(`
+		UPDATE jobs
+		SET brokered = FALSE
+		WHERE status = 'pending'
+		AND brokered
+		AND run_at < NOW() - make_interval(secs => $1)
+		AND retry_count < COALESCE(max_retries, $2)
+	`, brokerRequeueAfter.Seconds(), maxRetries)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// retryLater puts popped jobs that could not be claimed yet (paused, over
+// a type limit, or moved to a later run_at) back in the delayed set, to
+// be looked at again after a poll interval.
+func (b *redisBroker) retryLater(ctx context.Context, ids []int) error {
+
+	rows, err := db.Query(`
+		SELECT id, queue, priority, GREATEST(run_at, NOW() + make_interval(secs => $2))
+		FROM jobs
+		WHERE id = ANY($1)
+		AND status = 'pending'
+		AND retry_count < COALESCE(max_retries, $3)
+	`, pq.Array(ids), cfg.PollInterval.Seconds(), maxRetries)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var later []brokeredJob
+	for rows.Next() {
+		var j brokeredJob
+		if err := rows.Scan(&j.ID, &j.Queue, &j.Priority, &j.RunAt); err != nil {
+			return err
+		}
+		later = append(later, j)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(later) == 0 {
+		return nil
+	}
+	return b.push(ctx, later)
+}
+
+func startBrokerLoop(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	ticker := time.NewTicker(brokerTick)
+	defer ticker.Stop()
+
+	lastRequeue := time.Now()
+
+	for {
+		wake := jobWakeup()
+
+		select {
+		case <-ctx.Done():
+			slog.Info("Broker loop shutting down")
+			return
+		case <-wake:
+		case <-ticker.C:
+		}
+
+		if _, err := broker.promote(ctx); err != nil {
+			slog.Error("Promoting delayed jobs failed", "error", err)
+		}
+
+		for {
+			n, err := broker.feed(ctx)
+			if err != nil {
+				slog.Error("Feeding the broker failed", "error", err)
+				break
+			}
+			if n < brokerFeedBatch {
+				break
+			}
+		}
+
+		if time.Since(lastRequeue) >= time.Minute {
+			lastRequeue = time.Now()
+			if n, err := broker.requeueLost(); err != nil {
+				slog.Error("Broker requeue failed", "error", err)
+			} else if n > 0 {
+				slog.Warn("Handing jobs to the broker again", "jobs", n)
+			}
+		}
+	}
+}
+
+// brokerStore is the Postgres store with claims served from Redis.
+type brokerStore struct {
+	*pgStore
+	broker *redisBroker
+}
+
+func (s *brokerStore) ClaimJobs(req ClaimRequest) ([]ClaimedJob, error) {
+
+	// Redis only knows queues, not which types a session takes
+	if len(req.Types) > 0 {
+		return s.pgStore.ClaimJobs(req)
+	}
+
+	ctx := context.Background()
+
+	ids, err := s.broker.pop(ctx, req.Queues, req.Limit)
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+
+	rows, err := s.db.Query(`
+		UPDATE jobs
+		SET status = 'processing',
+		    claimed_by = $2,
+		    updated_at = NOW()
+		WHERE id = ANY($1)
+		AND status = 'pending'
+		AND retry_count < COALESCE(max_retries, $3)
+		AND run_at <= NOW()
+		AND type <> ALL($4)
+		AND (expires_at IS NULL OR expires_at > NOW())
+		AND `+notPausedSQL+`
+		RETURNING id, type
+	`, pq.Array(ids), req.Worker, maxRetries, pq.Array(req.SkipTypes))
+	if err != nil {
+		// Popped but not claimed: requeueLost hands them over again
+		return nil, err
+	}
+	defer rows.Close()
+
+	types := map[int]string{}
+	for rows.Next() {
+		var id int
+		var jobType string
+		if err := rows.Scan(&id, &jobType); err != nil {
+			return nil, err
+		}
+		types[id] = jobType
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Pop order is priority order
+	var claimed []ClaimedJob
+	var missed []int
+	for _, id := range ids {
+		if jobType, ok := types[id]; ok {
+			claimed = append(claimed, ClaimedJob{ID: id, Type: jobType})
+		} else {
+			missed = append(missed, id)
+		}
+	}
+
+	if len(missed) > 0 {
+		if err := s.broker.retryLater(ctx, missed); err != nil {
+			slog.Warn("Broker retry failed", "jobs", len(missed), "error", err)
+		}
+	}
+
+	return claimed, nil
+}
@@ -0,0 +1,381 @@
+package engine
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ==================== BULK OPERATIONS ====================
+//
+// POST /jobs/bulk records an operation and enqueues a "bulk_operation" job
+// for it. The job walks the matching jobs in id order, a batch at a time,
+// so a large retry neither holds one huge transaction nor blocks the API.
+// GET /jobs/bulk/{id} reports progress.
+
+const bulkBatchSize = 500
+
+type bulkRequest struct {
+	Action string                 `json:"action"`
+	Filter map[string]interface{} `json:"filter"`
+	RunAt  *time.Time             `json:"run_at,omitempty"`
+}
+
+type bulkOperation struct {
+	ID         int                    `json:"id"`
+	Action     string                 `json:"action"`
+	Filter     map[string]interface{} `json:"filter"`
+	RunAt      *time.Time             `json:"run_at,omitempty"`
+	Status     string                 `json:"status"`
+	Total      *int                   `json:"total"`
+	Processed  int                    `json:"processed"`
+	Error      *string                `json:"error"`
+	JobID      *int                   `json:"job_id"`
+	TenantID   string                 `json:"tenant_id"`
+	CreatedAt  time.Time              `json:"created_at"`
+	FinishedAt *time.Time             `json:"finished_at"`
+}
+
+// bulkActions holds, per action, the statement applied to each batch and
+// the condition a job must meet to be touched. Jobs being processed are
+// never modified underneath a worker.
+var bulkActions = map[string]struct {
+	apply string
+	where string
+}{
+	"retry": {
+		apply: `UPDATE jobs SET status = 'pending', retry_count = 0, last_error = NULL, attempt_errors = '[]', run_at = NOW(), updated_at = NOW()`,
+		// A unique job is only revived if no other job holds its key, and
+		// only the newest failed job per key
+		where: `status = 'failed' AND (unique_key IS NULL OR (
+			NOT EXISTS (SELECT 1 FROM jobs o WHERE o.tenant_id = jobs.tenant_id AND o.type = jobs.type AND o.unique_key = jobs.unique_key AND o.status IN ('pending', 'processing'))
+			AND id = (SELECT MAX(f.id) FROM jobs f WHERE f.tenant_id = jobs.tenant_id AND f.type = jobs.type AND f.unique_key = jobs.unique_key AND f.status = 'failed')))`,
+	},
+	"cancel": {
+		apply: `UPDATE jobs SET status = 'cancelled', updated_at = NOW()`,
+		where: `status = 'pending'`,
+	},
+	"delete": {
+		apply: `DELETE FROM jobs`,
+		where: `status <> 'processing'`,
+	},
+	"reschedule": {
+		apply: `UPDATE jobs SET run_at = ?, updated_at = NOW()`,
+		where: `status = 'pending'`,
+	},
+}
+
+func bulkHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req bulkRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	startBulkOperation(w, r, req)
+}
+
+// bulkRetryHandler serves POST /jobs/retry?type=send_email, a bulk retry
+// whose filter is the query string. Without ?status= it targets failed
+// jobs, the only ones a retry touches anyway.
+func bulkRetryHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filter := map[string]interface{}{"status": "failed"}
+	for key, values := range r.URL.Query() {
+		if len(values) == 1 {
+			filter[key] = values[0]
+			continue
+		}
+		list := make([]interface{}, len(values))
+		for i, v := range values {
+			list[i] = v
+		}
+		filter[key] = list
+	}
+
+	startBulkOperation(w, r, bulkRequest{Action: "retry", Filter: filter})
+}
+
+// startBulkOperation validates req, records it and enqueues the job that
+// carries it out.
+func startBulkOperation(w http.ResponseWriter, r *http.Request, req bulkRequest) {
+
+	if _, ok := bulkActions[req.Action]; !ok {
+		http.Error(w, "action must be one of retry, cancel, delete, reschedule", http.StatusBadRequest)
+		return
+	}
+
+	if req.Action == "reschedule" && req.RunAt == nil {
+		http.Error(w, "reschedule requires 'run_at'", http.StatusBadRequest)
+		return
+	}
+
+	// An empty filter would match every job in the system
+	if len(req.Filter) == 0 {
+		http.Error(w, "filter is required", http.StatusBadRequest)
+		return
+	}
+
+	q, err := filterValues(req.Filter)
+	var filter *jobFilter
+	if err == nil {
+		filter, err = parseJobFilter(q)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if filter.archived {
+		http.Error(w, "bulk operations only apply to live jobs, not include_archived", http.StatusBadRequest)
+		return
+	}
+
+	filterJSON, _ := json.Marshal(req.Filter)
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Insert failed", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var op bulkOperation
+
+	err = tx.QueryRow(`
+		INSERT INTO bulk_operations (action, filter, run_at, status, tenant_id)
+		VALUES ($1, $2, $3, 'pending', $4)
+		RETURNING id, created_at
+	`, req.Action, filterJSON, req.RunAt, tenantOf(r)).Scan(&op.ID, &op.CreatedAt)
+	if err != nil {
+		http.Error(w, "Insert failed", http.StatusInternalServerError)
+		return
+	}
+
+	payload, _ := json.Marshal(map[string]interface{}{"operation_id": op.ID})
+
+	// Run on this server's own workers: the operation needs the database
+	var jobID int
+	err = tx.QueryRow(`
+		INSERT INTO jobs (type, payload, status, queue, tenant_id)
+		VALUES ('bulk_operation', $1, 'pending', $2, $3)
+		RETURNING id
+	`, payload, localQueues()[0], tenantOf(r)).Scan(&jobID)
+	if err != nil {
+		http.Error(w, "Insert failed", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = tx.Exec(`UPDATE bulk_operations SET job_id = $1 WHERE id = $2`, jobID, op.ID)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "Insert failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"operation_id": op.ID,
+		"job_id":       jobID,
+		"status":       "pending",
+	})
+}
+
+func bulkDetailHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/jobs/bulk/"))
+	if err != nil {
+		http.Error(w, "Invalid operation id", http.StatusBadRequest)
+		return
+	}
+
+	op, err := loadBulkOperation(id)
+	if err != nil || op.TenantID != tenantOf(r) {
+		http.Error(w, "Operation not found", http.StatusNotFound)
+		return
+	}
+
+	json.NewEncoder(w).Encode(op)
+}
+
+func loadBulkOperation(id int) (*bulkOperation, error) {
+
+	var op bulkOperation
+	var filterBytes []byte
+
+	err := db.QueryRow(`
+		SELECT id, action, filter, run_at, status, total, processed,
+		       error, job_id, tenant_id, created_at, finished_at
+		FROM bulk_operations
+		WHERE id = $1
+	`, id).Scan(&op.ID, &op.Action, &filterBytes, &op.RunAt, &op.Status, &op.Total, &op.Processed,
+		&op.Error, &op.JobID, &op.TenantID, &op.CreatedAt, &op.FinishedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	json.Unmarshal(filterBytes, &op.Filter)
+	return &op, nil
+}
+
+// runBulkOperation is the executor behind "bulk_operation" jobs. Jobs drop
+// out of the filter once handled, so a retried or recovered run resumes
+// where the previous one stopped.
+func runBulkOperation(ctx context.Context, payload map[string]interface{}) (status int, body []byte, err error) {
+
+	opID, ok := payload["operation_id"].(float64)
+	if !ok {
+		return 0, nil, fmt.Errorf("missing 'operation_id'")
+	}
+
+	op, err := loadBulkOperation(int(opID))
+	if err != nil {
+		return 0, nil, fmt.Errorf("load operation %d: %w", int(opID), err)
+	}
+
+	defer func() {
+		if err != nil {
+			db.Exec(`UPDATE bulk_operations SET status = 'failed', error = $2 WHERE id = $1`, op.ID, err.Error())
+		}
+	}()
+
+	if op.Status == "completed" {
+		body, _ = json.Marshal(op)
+		return 200, body, nil
+	}
+
+	action := bulkActions[op.Action]
+
+	q, err := filterValues(op.Filter)
+	if err != nil {
+		return 0, nil, err
+	}
+	filter, err := parseJobFilter(q)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	filter.add(action.where)
+	filter.add("type <> 'bulk_operation'")
+	filter.add("tenant_id = ?", op.TenantID)
+	if op.Action == "reschedule" {
+		// Already rescheduled jobs drop out, so a rerun resumes
+		filter.add("run_at <> ?", op.RunAt)
+	}
+
+	var remaining int
+	err = db.QueryRowContext(ctx, `SELECT COUNT(*) FROM jobs `+filter.where(), filter.args...).Scan(&remaining)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	_, err = db.Exec(`
+		UPDATE bulk_operations
+		SET status = 'running', total = processed + $2, started_at = COALESCE(started_at, NOW())
+		WHERE id = $1
+	`, op.ID, remaining)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	processed := op.Processed
+	cursor := 0
+
+	for {
+		if ctx.Err() != nil {
+			return 0, nil, ctx.Err()
+		}
+
+		batch := &jobFilter{
+			clauses: append([]string{}, filter.clauses...),
+			args:    append([]interface{}{}, filter.args...),
+		}
+		batch.add("id > ?", cursor)
+
+		apply := action.apply
+		if op.Action == "reschedule" {
+			apply = strings.Replace(apply, "?", batch.param(op.RunAt), 1)
+		}
+
+		// Retried jobs leave the dead-letter queue
+		cleanup := ""
+		if op.Action == "retry" {
+			cleanup = `, revived AS (DELETE FROM dead_letter WHERE job_id IN (SELECT id FROM batch))`
+		}
+		if op.Action == "delete" {
+			cleanup = jobHistoryCleanup("batch")
+		}
+
+		var n int
+		var last sql.NullInt64
+
+		err = db.QueryRowContext(ctx, `
+			WITH batch AS (
+				`+apply+`
+				WHERE id IN (
+					SELECT id FROM jobs
+					`+batch.where()+`
+					ORDER BY id
+					LIMIT `+strconv.Itoa(bulkBatchSize)+`
+					FOR UPDATE
+				)
+				RETURNING id
+			)`+cleanup+`
+			SELECT COUNT(*), MAX(id) FROM batch
+		`, batch.args...).Scan(&n, &last)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		if n == 0 {
+			break
+		}
+
+		processed += n
+		cursor = int(last.Int64)
+
+		db.Exec(`UPDATE bulk_operations SET processed = $2 WHERE id = $1`, op.ID, processed)
+	}
+
+	_, err = db.Exec(`
+		UPDATE bulk_operations
+		SET status = 'completed', processed = $2, finished_at = NOW()
+		WHERE id = $1
+	`, op.ID, processed)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	slog.Info("Bulk operation finished", "operation_id", op.ID, "action", op.Action, "jobs", processed)
+
+	body, _ = json.Marshal(map[string]interface{}{
+		"operation_id": op.ID,
+		"action":       op.Action,
+		"processed":    processed,
+	})
+	return 200, body, nil
+}
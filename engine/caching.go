@@ -0,0 +1,47 @@
+package engine
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ==================== CONDITIONAL READS ====================
+
+// jobETag identifies one version of a job. Every write to a job row bumps
+// updated_at, so it changes whenever the job does.
+func jobETag(jobID int, updatedAt time.Time) string {
+	return fmt.Sprintf(`"%d-%d"`, jobID, updatedAt.UnixMicro())
+}
+
+// notModified sets the caching headers for a resource and reports whether
+// the client's copy is current (and a 304 has been written). If-None-Match
+// takes precedence over If-Modified-Since, as in RFC 9110.
+func notModified(w http.ResponseWriter, r *http.Request, etag string, modified time.Time) bool {
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "no-cache")
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == etag || candidate == "*" {
+				w.WriteHeader(http.StatusNotModified)
+				return true
+			}
+		}
+		return false
+	}
+
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		since, err := http.ParseTime(ims)
+		if err == nil && !modified.Truncate(time.Second).After(since) {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+
+	return false
+}
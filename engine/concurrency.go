@@ -0,0 +1,102 @@
+package engine
+
+import "sync"
+
+// ==================== JOB TYPE CONCURRENCY ====================
+//
+// Some job types must not run many at a time, such as scrapers hitting one
+// site or queries against a small database:
+//
+//	type_concurrency:
+//	  data_extract: 2
+//	  db_query: 1
+//
+// Each server counts the jobs of a capped type that its own workers and
+// the agents connected to it are running. Claims skip a type while it is
+// at its cap, so its jobs stay in the queue for whichever worker frees a
+// slot first.
+
+// typeSlots holds the running capped jobs: a count per type and the type
+// of each job holding a slot.
+var typeSlots = struct {
+	sync.Mutex
+	running map[string]int
+	held    map[int]string
+}{running: make(map[string]int), held: make(map[int]string)}
+
+// saturatedJobTypes lists the capped types running at their cap, for the
+// claim queries to skip.
+func saturatedJobTypes() []string {
+
+	typeSlots.Lock()
+	defer typeSlots.Unlock()
+
+	var full []string
+	for jobType, limit := range cfg.TypeConcurrency {
+		if typeSlots.running[jobType] >= limit {
+			full = append(full, jobType)
+		}
+	}
+	return full
+}
+
+// acquireTypeSlot takes a slot of jobType for job id. It fails when
+// another worker took the last one since the claim query ran.
+func acquireTypeSlot(id int, jobType string) bool {
+
+	limit, capped := cfg.TypeConcurrency[jobType]
+	if !capped {
+		return true
+	}
+
+	typeSlots.Lock()
+	defer typeSlots.Unlock()
+
+	if typeSlots.running[jobType] >= limit {
+		return false
+	}
+	typeSlots.running[jobType]++
+	typeSlots.held[id] = jobType
+	return true
+}
+
+// releaseTypeSlot frees the slot job id holds, if any.
+func releaseTypeSlot(id int) {
+
+	typeSlots.Lock()
+	defer typeSlots.Unlock()
+
+	jobType, ok := typeSlots.held[id]
+	if !ok {
+		return
+	}
+	delete(typeSlots.held, id)
+	typeSlots.running[jobType]--
+}
+
+// claimLimitedTypes lists the types claims must skip right now: those out
+// of their rate limit or at their concurrency cap.
+func claimLimitedTypes() ([]string, error) {
+
+	throttled, err := throttledJobTypes()
+	if err != nil {
+		return nil, err
+	}
+	return append(throttled, saturatedJobTypes()...), nil
+}
+
+// admitClaimedJob applies the concurrency cap, then the rate limit, to a
+// job just claimed. A job that does not pass goes back in the queue.
+func admitClaimedJob(id int, jobType string) bool {
+
+	if !acquireTypeSlot(id, jobType) {
+		releaseJob(id)
+		return false
+	}
+
+	if !admitClaimed(id, jobType) {
+		releaseTypeSlot(id)
+		return false
+	}
+	return true
+}
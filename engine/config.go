@@ -0,0 +1,684 @@
+package engine
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"goflow/jobs"
+)
+
+// ==================== CONFIG ====================
+//
+// Runtime settings come from, in increasing precedence: built-in
+// defaults, a YAML file (-config or GOFLOW_CONFIG), environment variables
+// and command-line flags.
+//
+//	database_url: "postgres://goflow:secret@db:5432/goflowdb?sslmode=disable"
+//	listen_addr: ":8080"
+//	workers: 10
+//	worker_queues: [default, scraper]
+//	poll_interval: 5s
+//	log_level: debug
+//	api_keys:
+//	  - { key: "s3cret", tenant: billing, rate_limit: 5, daily_quota: 10000 }
+//	secrets_key: "q5N0...base64 of 32 random bytes...="
+//	hooks:
+//	  stripe: { provider: stripe, secret: "secret://stripe_hook", job: { type: http_request, payload: {...} } }
+//	max_retry_delay: 1h
+//	retention: 720h
+//	archive: true
+//	backoff_by_type:
+//	  http_request: { backoff: exponential_jitter, base_delay: 2s, max_delay: 10m }
+//	run_command:
+//	  enabled: true
+//	  allowlist: [/usr/bin/convert]
+//	containers: { runtime: docker, images: [ghcr.io/acme/] }
+//	smtp:
+//	  host: smtp.example.com
+
+type Config struct {
+	DatabaseURL       string        `yaml:"database_url"`
+	ListenAddr        string        `yaml:"listen_addr"`
+	Workers           int           `yaml:"workers"`
+	WorkerQueues      []string      `yaml:"worker_queues"`
+	ClaimBatch        int           `yaml:"claim_batch"`
+	PollInterval      time.Duration `yaml:"poll_interval"`
+	ProcessingTimeout time.Duration `yaml:"processing_timeout"`
+	DrainTimeout      time.Duration `yaml:"drain_timeout"`
+	IdempotencyTTL    time.Duration `yaml:"idempotency_ttl"`
+	RoutingConfig     string        `yaml:"routing_config"`
+	PluginsConfig     string        `yaml:"plugins_config"`
+	LogLevel          string        `yaml:"log_level"`
+	LogFormat         string        `yaml:"log_format"`
+	APIKeys           []APIKey      `yaml:"api_keys"`
+	SecretsKey        string        `yaml:"secrets_key"`
+
+	// SigningKeys let submitters sign POST /jobs instead of sending an
+	// API key; RequireSignature makes POST /jobs accept nothing else
+	SigningKeys      []SigningKey `yaml:"signing_keys"`
+	RequireSignature bool         `yaml:"require_signature"`
+
+	// Hooks are the inbound webhook receivers under /hooks/{name}
+	Hooks map[string]InboundHook `yaml:"hooks"`
+
+	// ReportQueries are the stored queries export_report runs by name
+	ReportQueries map[string]jobs.StoredQuery `yaml:"report_queries"`
+
+	// Store is "database" (Postgres, or SQLite for a "sqlite:"
+	// database_url) or "memory", which keeps jobs in memory
+	Store string `yaml:"store"`
+
+	// AutoMigrate applies pending schema migrations at startup; without
+	// it the server refuses to start until "goflow migrate up" has run
+	AutoMigrate bool `yaml:"auto_migrate"`
+
+	// Broker hands ready jobs to workers: "postgres" claims them from the
+	// jobs table, "redis" passes their ids through RedisURL
+	Broker   string `yaml:"broker"`
+	RedisURL string `yaml:"redis_url"`
+
+	// ExecutorMiddleware names the built-in middleware wrapping every
+	// execution, outermost first: recover, secrets and outputs. Middleware
+	// is added inside them; embedders set it in code
+	ExecutorMiddleware []string          `yaml:"executor_middleware"`
+	Middleware         []jobs.Middleware `yaml:"-"`
+
+	// ReadySMTP adds the SMTP server to the /readyz checks
+	ReadySMTP bool `yaml:"ready_smtp"`
+
+	// Per-host circuit breakers for outbound HTTP jobs; 0 failures turns
+	// them off
+	BreakerFailures int           `yaml:"breaker_failures"`
+	BreakerCooldown time.Duration `yaml:"breaker_cooldown"`
+
+	// TypeRateLimits caps how often jobs of a type start ("10/min")
+	TypeRateLimits map[string]string `yaml:"type_rate_limits"`
+	typeRates      map[string]typeRate
+
+	// TypeConcurrency caps how many jobs of a type this server runs at once
+	TypeConcurrency map[string]int `yaml:"type_concurrency"`
+
+	// How long finished jobs are kept; 0 keeps them forever
+	Retention       time.Duration            `yaml:"retention"`
+	RetentionByType map[string]time.Duration `yaml:"retention_by_type"`
+
+	// Archive moves old jobs to jobs_archive instead of deleting them,
+	// for ArchiveRetention (0 keeps them forever)
+	Archive          bool          `yaml:"archive"`
+	ArchiveRetention time.Duration `yaml:"archive_retention"`
+
+	// Retry backoff for jobs that do not set their own
+	MaxRetryDelay time.Duration            `yaml:"max_retry_delay"`
+	BackoffByType map[string]BackoffPolicy `yaml:"backoff_by_type"`
+
+	// AgentToken lets remote agents connect to /agents/connect; without
+	// it the endpoint is disabled
+	AgentToken string `yaml:"agent_token"`
+
+	// ExecutionGuarantees override the built-in guarantee of job types
+	// (at_least_once or effectively_once)
+	ExecutionGuarantees map[string]jobs.Guarantee `yaml:"execution_guarantees"`
+
+	// RunCommand enables run_command and sets its allowlist and limits
+	RunCommand jobs.CommandSettings `yaml:"run_command"`
+
+	// Containers is where container_run and k8s_job run containers
+	Containers jobs.ContainerSettings `yaml:"containers"`
+
+	// PDFRenderURL is a Gotenberg-compatible endpoint for generate_report
+	PDFRenderURL string `yaml:"pdf_render_url"`
+
+	SMTP struct {
+		Host string `yaml:"host"`
+		Port string `yaml:"port"`
+		User string `yaml:"user"`
+		Pass string `yaml:"pass"`
+	} `yaml:"smtp"`
+}
+
+// BackoffPolicy is a job type's default retry backoff. Zero fields fall
+// back to exponential from 5s, capped at max_retry_delay.
+type BackoffPolicy struct {
+	Backoff   string        `yaml:"backoff"`
+	BaseDelay time.Duration `yaml:"base_delay"`
+	MaxDelay  time.Duration `yaml:"max_delay"`
+}
+
+// cfg is the configuration the server was started with.
+var cfg = DefaultConfig()
+
+// DefaultConfig is the configuration before any file, environment or
+// flags; embedders start from it.
+func DefaultConfig() Config {
+
+	c := Config{
+		DatabaseURL:       defaultConnStr,
+		Store:             "database",
+		ListenAddr:        ":8080",
+		Workers:           5,
+		ClaimBatch:        1,
+		PollInterval:      defaultPollEvery,
+		ProcessingTimeout: 30 * time.Second,
+		DrainTimeout:      defaultDrainTimeout,
+		IdempotencyTTL:    defaultIdempotencyTTL,
+		MaxRetryDelay:     maxRetryDelay,
+		BreakerFailures:   5,
+		BreakerCooldown:   30 * time.Second,
+		LogLevel:          "info",
+		LogFormat:         "json",
+		AutoMigrate:       true,
+		Broker:            "postgres",
+
+		ExecutorMiddleware: []string{"recover", "secrets", "outputs"},
+		RunCommand:         jobs.DefaultCommandSettings(),
+	}
+	c.SMTP.Host = "smtp.gmail.com"
+	c.SMTP.Port = "587"
+
+	return c
+}
+
+// LoadConfig builds the configuration from args (the server's command
+// line) and the environment.
+func LoadConfig(args []string) (Config, error) {
+
+	c := DefaultConfig()
+
+	fs := flag.NewFlagSet("goflow", flag.ContinueOnError)
+	path := fs.String("config", os.Getenv("GOFLOW_CONFIG"), "YAML config file")
+	dsn := fs.String("db", "", "Postgres connection string")
+	storeKind := fs.String("store", "", "database or memory")
+	addr := fs.String("addr", "", "HTTP listen address")
+	workers := fs.Int("workers", 0, "number of in-process workers")
+	queues := fs.String("queues", "", "comma separated queues the workers claim from")
+	batch := fs.Int("claim-batch", 0, "jobs claimed per query")
+	poll := fs.Duration("poll-interval", 0, "longest idle sleep while notifications work")
+	drain := fs.Duration("drain-timeout", 0, "how long shutdown waits for in-flight jobs")
+	logLevel := fs.String("log-level", "", "debug, info, warn or error")
+
+	if err := fs.Parse(args); err != nil {
+		return c, err
+	}
+
+	if *path != "" {
+		data, err := os.ReadFile(*path)
+		if err != nil {
+			return c, err
+		}
+		if err := yaml.Unmarshal(data, &c); err != nil {
+			return c, fmt.Errorf("%s: %w", *path, err)
+		}
+	}
+
+	if err := c.applyEnv(); err != nil {
+		return c, err
+	}
+
+	// Only flags given on the command line override the file and env
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "db":
+			c.DatabaseURL = *dsn
+		case "store":
+			c.Store = *storeKind
+		case "addr":
+			c.ListenAddr = *addr
+		case "workers":
+			c.Workers = *workers
+		case "queues":
+			c.WorkerQueues = splitList(*queues)
+		case "claim-batch":
+			c.ClaimBatch = *batch
+		case "poll-interval":
+			c.PollInterval = *poll
+		case "drain-timeout":
+			c.DrainTimeout = *drain
+		case "log-level":
+			c.LogLevel = *logLevel
+		}
+	})
+
+	for i := range c.APIKeys {
+		if c.APIKeys[i].Name == "" {
+			c.APIKeys[i].Name = c.APIKeys[i].Tenant
+		}
+	}
+	for i := range c.SigningKeys {
+		if c.SigningKeys[i].Name == "" {
+			c.SigningKeys[i].Name = c.SigningKeys[i].Tenant
+		}
+	}
+
+	// validate also fills in c's parsed settings
+	if err := c.validate(); err != nil {
+		return c, err
+	}
+	return c, nil
+}
+
+// applyEnv overrides c with any GOFLOW_* and SMTP_* variables that are set.
+func (c *Config) applyEnv() error {
+
+	strs := map[string]*string{
+		"GOFLOW_DATABASE_URL":   &c.DatabaseURL,
+		"GOFLOW_STORE":          &c.Store,
+		"GOFLOW_LISTEN_ADDR":    &c.ListenAddr,
+		"GOFLOW_ROUTING_CONFIG": &c.RoutingConfig,
+		"GOFLOW_PLUGINS_CONFIG": &c.PluginsConfig,
+		"GOFLOW_LOG_LEVEL":      &c.LogLevel,
+		"GOFLOW_LOG_FORMAT":     &c.LogFormat,
+		"GOFLOW_SECRETS_KEY":    &c.SecretsKey,
+		"GOFLOW_BROKER":         &c.Broker,
+		"GOFLOW_REDIS_URL":      &c.RedisURL,
+		"GOFLOW_AGENT_TOKEN":    &c.AgentToken,
+		"GOFLOW_PDF_RENDER_URL": &c.PDFRenderURL,
+
+		"GOFLOW_CONTAINER_RUNTIME": &c.Containers.Runtime,
+		"GOFLOW_DOCKER_HOST":       &c.Containers.DockerHost,
+		"GOFLOW_K8S_API":           &c.Containers.K8sAPI,
+		"GOFLOW_K8S_TOKEN":         &c.Containers.K8sToken,
+
+		"SMTP_HOST": &c.SMTP.Host,
+		"SMTP_PORT": &c.SMTP.Port,
+		"SMTP_USER": &c.SMTP.User,
+		"SMTP_PASS": &c.SMTP.Pass,
+	}
+	for name, dst := range strs {
+		if v := os.Getenv(name); v != "" {
+			*dst = v
+		}
+	}
+
+	ints := map[string]*int{
+		"GOFLOW_WORKERS":          &c.Workers,
+		"GOFLOW_CLAIM_BATCH":      &c.ClaimBatch,
+		"GOFLOW_BREAKER_FAILURES": &c.BreakerFailures,
+
+		"GOFLOW_COMMAND_TIMEOUT_SECONDS":     &c.RunCommand.TimeoutSeconds,
+		"GOFLOW_COMMAND_MAX_TIMEOUT_SECONDS": &c.RunCommand.MaxTimeoutSeconds,
+		"GOFLOW_COMMAND_CPU_SECONDS":         &c.RunCommand.CPUSeconds,
+		"GOFLOW_COMMAND_MAX_CPU_SECONDS":     &c.RunCommand.MaxCPUSeconds,
+		"GOFLOW_COMMAND_MEMORY_MB":           &c.RunCommand.MemoryMB,
+		"GOFLOW_COMMAND_MAX_MEMORY_MB":       &c.RunCommand.MaxMemoryMB,
+	}
+	for name, dst := range ints {
+		if v := os.Getenv(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			*dst = n
+		}
+	}
+
+	durations := map[string]*time.Duration{
+		"GOFLOW_POLL_INTERVAL":      &c.PollInterval,
+		"GOFLOW_PROCESSING_TIMEOUT": &c.ProcessingTimeout,
+		"GOFLOW_DRAIN_TIMEOUT":      &c.DrainTimeout,
+		"GOFLOW_IDEMPOTENCY_TTL":    &c.IdempotencyTTL,
+		"GOFLOW_MAX_RETRY_DELAY":    &c.MaxRetryDelay,
+		"GOFLOW_BREAKER_COOLDOWN":   &c.BreakerCooldown,
+		"GOFLOW_RETENTION":          &c.Retention,
+		"GOFLOW_ARCHIVE_RETENTION":  &c.ArchiveRetention,
+	}
+	for name, dst := range durations {
+		if v := os.Getenv(name); v != "" {
+			d, err := parseSeconds(v)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			*dst = d
+		}
+	}
+
+	if v := os.Getenv("GOFLOW_WORKER_QUEUES"); v != "" {
+		c.WorkerQueues = splitList(v)
+	}
+
+	// Docker's own variable, when nothing names the host for GoFlow
+	if c.Containers.DockerHost == "" {
+		c.Containers.DockerHost = os.Getenv("DOCKER_HOST")
+	}
+
+	if v := os.Getenv("GOFLOW_CONTAINER_IMAGES"); v != "" {
+		c.Containers.Images = splitList(v)
+	}
+
+	if v := os.Getenv("GOFLOW_COMMAND_ALLOWLIST"); v != "" {
+		c.RunCommand.Allowlist = splitList(v)
+	}
+
+	if v := os.Getenv("GOFLOW_ENABLE_RUN_COMMAND"); v != "" {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("GOFLOW_ENABLE_RUN_COMMAND: %w", err)
+		}
+		c.RunCommand.Enabled = enabled
+	}
+
+	if v, ok := os.LookupEnv("GOFLOW_EXECUTOR_MIDDLEWARE"); ok {
+		c.ExecutorMiddleware = splitList(v)
+	}
+
+	if v := os.Getenv("GOFLOW_AUTO_MIGRATE"); v != "" {
+		auto, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("GOFLOW_AUTO_MIGRATE: %w", err)
+		}
+		c.AutoMigrate = auto
+	}
+
+	if v := os.Getenv("GOFLOW_READY_SMTP"); v != "" {
+		ready, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("GOFLOW_READY_SMTP: %w", err)
+		}
+		c.ReadySMTP = ready
+	}
+
+	if v := os.Getenv("GOFLOW_REQUIRE_SIGNATURE"); v != "" {
+		require, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("GOFLOW_REQUIRE_SIGNATURE: %w", err)
+		}
+		c.RequireSignature = require
+	}
+
+	if v := os.Getenv("GOFLOW_ARCHIVE"); v != "" {
+		archive, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("GOFLOW_ARCHIVE: %w", err)
+		}
+		c.Archive = archive
+	}
+
+	// type=rate pairs, comma separated
+	if v := os.Getenv("GOFLOW_TYPE_RATE_LIMITS"); v != "" {
+		c.TypeRateLimits = map[string]string{}
+		for _, pair := range splitList(v) {
+			jobType, rate, ok := strings.Cut(pair, "=")
+			if !ok {
+				return fmt.Errorf("GOFLOW_TYPE_RATE_LIMITS: expected type=count/period, got %q", pair)
+			}
+			c.TypeRateLimits[jobType] = rate
+		}
+	}
+
+	// type=guarantee pairs, comma separated
+	if v := os.Getenv("GOFLOW_EXECUTION_GUARANTEES"); v != "" {
+		c.ExecutionGuarantees = map[string]jobs.Guarantee{}
+		for _, pair := range splitList(v) {
+			jobType, g, ok := strings.Cut(pair, "=")
+			if !ok {
+				return fmt.Errorf("GOFLOW_EXECUTION_GUARANTEES: expected type=guarantee, got %q", pair)
+			}
+			c.ExecutionGuarantees[jobType] = jobs.Guarantee(g)
+		}
+	}
+
+	// type=count pairs, comma separated
+	if v := os.Getenv("GOFLOW_TYPE_CONCURRENCY"); v != "" {
+		c.TypeConcurrency = map[string]int{}
+		for _, pair := range splitList(v) {
+			jobType, count, ok := strings.Cut(pair, "=")
+			n, err := strconv.Atoi(count)
+			if !ok || err != nil {
+				return fmt.Errorf("GOFLOW_TYPE_CONCURRENCY: expected type=count, got %q", pair)
+			}
+			c.TypeConcurrency[jobType] = n
+		}
+	}
+
+	// type=duration pairs, comma separated
+	if v := os.Getenv("GOFLOW_RETENTION_BY_TYPE"); v != "" {
+		c.RetentionByType = map[string]time.Duration{}
+		for _, pair := range splitList(v) {
+			jobType, window, ok := strings.Cut(pair, "=")
+			d, err := parseSeconds(window)
+			if !ok || err != nil {
+				return fmt.Errorf("GOFLOW_RETENTION_BY_TYPE: expected type=duration, got %q", pair)
+			}
+			c.RetentionByType[jobType] = d
+		}
+	}
+
+	// tenant=key pairs, comma separated
+	if v := os.Getenv("GOFLOW_API_KEYS"); v != "" {
+		c.APIKeys = nil
+		for _, pair := range splitList(v) {
+			tenant, key, ok := strings.Cut(pair, "=")
+			if !ok {
+				return fmt.Errorf("GOFLOW_API_KEYS: expected tenant=key, got %q", pair)
+			}
+			c.APIKeys = append(c.APIKeys, APIKey{Key: key, Tenant: tenant})
+		}
+	}
+
+	// tenant=secret pairs, comma separated
+	if v := os.Getenv("GOFLOW_SIGNING_KEYS"); v != "" {
+		c.SigningKeys = nil
+		for _, pair := range splitList(v) {
+			tenant, secret, ok := strings.Cut(pair, "=")
+			if !ok {
+				return fmt.Errorf("GOFLOW_SIGNING_KEYS: expected tenant=secret, got %q", pair)
+			}
+			c.SigningKeys = append(c.SigningKeys, SigningKey{Secret: secret, Tenant: tenant})
+		}
+	}
+
+	return nil
+}
+
+func (c *Config) validate() error {
+
+	switch {
+	case c.Store != "database" && c.Store != "memory":
+		return fmt.Errorf("store must be database or memory")
+	case c.DatabaseURL == "" && c.Store == "database":
+		return fmt.Errorf("database_url is required")
+	case c.Workers < 0:
+		return fmt.Errorf("workers must not be negative")
+	case c.ClaimBatch < 1:
+		return fmt.Errorf("claim_batch must be at least 1")
+	case c.PollInterval <= 0:
+		return fmt.Errorf("poll_interval must be positive")
+	case c.ProcessingTimeout < 3*time.Second:
+		return fmt.Errorf("processing_timeout must be at least 3s")
+	case c.DrainTimeout < 0:
+		return fmt.Errorf("drain_timeout must not be negative")
+	case c.IdempotencyTTL <= 0:
+		return fmt.Errorf("idempotency_ttl must be positive")
+	case c.MaxRetryDelay <= 0:
+		return fmt.Errorf("max_retry_delay must be positive")
+	case c.BreakerFailures < 0:
+		return fmt.Errorf("breaker_failures must not be negative")
+	case c.BreakerCooldown < time.Second:
+		return fmt.Errorf("breaker_cooldown must be at least 1s")
+	case c.Retention < 0:
+		return fmt.Errorf("retention must not be negative")
+	case c.ArchiveRetention < 0:
+		return fmt.Errorf("archive_retention must not be negative")
+	case c.Broker != "postgres" && c.Broker != "redis":
+		return fmt.Errorf("broker must be postgres or redis")
+	case c.Broker == "redis" && c.RedisURL == "":
+		return fmt.Errorf("broker redis needs redis_url")
+	}
+
+	for jobType, g := range c.ExecutionGuarantees {
+		if g != jobs.AtLeastOnce && g != jobs.EffectivelyOnce {
+			return fmt.Errorf("execution_guarantees.%s must be at_least_once or effectively_once", jobType)
+		}
+	}
+
+	rc := c.RunCommand
+	switch {
+	case rc.TimeoutSeconds < 1 || rc.MaxTimeoutSeconds < 1 || rc.CPUSeconds < 1 || rc.MaxCPUSeconds < 1 || rc.MemoryMB < 1 || rc.MaxMemoryMB < 1:
+		return fmt.Errorf("run_command limits must be at least 1")
+	case rc.Enabled && len(rc.Allowlist) == 0:
+		return fmt.Errorf("run_command.enabled needs an allowlist")
+	}
+	for _, path := range rc.Allowlist {
+		if !filepath.IsAbs(path) {
+			return fmt.Errorf("run_command.allowlist: %q is not an absolute path", path)
+		}
+	}
+
+	switch c.Containers.Runtime {
+	case "", "docker", "kubernetes":
+	default:
+		return fmt.Errorf("containers.runtime must be docker or kubernetes")
+	}
+
+	for jobType, d := range c.RetentionByType {
+		if d < 0 {
+			return fmt.Errorf("retention_by_type.%s must not be negative", jobType)
+		}
+	}
+
+	for _, name := range c.ExecutorMiddleware {
+		if _, ok := jobs.NamedMiddleware(name); !ok {
+			return fmt.Errorf("executor_middleware: unknown middleware %q", name)
+		}
+	}
+
+	c.typeRates = map[string]typeRate{}
+	for jobType, v := range c.TypeRateLimits {
+		r, err := parseTypeRate(v)
+		if err != nil {
+			return fmt.Errorf("type_rate_limits.%s: %w", jobType, err)
+		}
+		c.typeRates[jobType] = r
+	}
+
+	// Only the workers go through the Store; these features query
+	// Postgres directly (see standalone.go)
+	if _, ok := sqlitePath(c.DatabaseURL); ok || c.Store == "memory" {
+		if len(c.TypeRateLimits) > 0 {
+			return fmt.Errorf("type_rate_limits need Postgres; remove them to use SQLite or memory")
+		}
+		if c.Broker == "redis" {
+			return fmt.Errorf("broker redis needs Postgres for job metadata")
+		}
+		if len(c.SigningKeys) > 0 || c.RequireSignature {
+			return fmt.Errorf("signing_keys and require_signature need Postgres; remove them to use SQLite or memory")
+		}
+		for i, k := range c.APIKeys {
+			if k.RateLimit > 0 || k.DailyQuota > 0 || k.MonthlyQuota > 0 {
+				return fmt.Errorf("api_keys[%d]: rate limits and quotas need Postgres; remove them to use SQLite or memory", i)
+			}
+		}
+		if c.Retention > 0 || len(c.RetentionByType) > 0 || c.Archive {
+			return fmt.Errorf("retention and archive need Postgres; remove them to use SQLite or memory")
+		}
+	}
+
+	for name, q := range c.ReportQueries {
+		if strings.TrimSpace(q.SQL) == "" {
+			return fmt.Errorf("report_queries.%s needs sql", name)
+		}
+		for _, p := range q.Params {
+			if p == "" {
+				return fmt.Errorf("report_queries.%s: empty param name", name)
+			}
+		}
+	}
+
+	for jobType, n := range c.TypeConcurrency {
+		if n < 1 {
+			return fmt.Errorf("type_concurrency.%s must be at least 1", jobType)
+		}
+	}
+
+	for jobType, p := range c.BackoffByType {
+		switch {
+		case p.Backoff != "" && !slices.Contains(backoffStrategies, p.Backoff):
+			return fmt.Errorf("backoff_by_type.%s: backoff must be fixed, linear, exponential or exponential_jitter", jobType)
+		case p.BaseDelay < 0 || p.MaxDelay < 0:
+			return fmt.Errorf("backoff_by_type.%s: delays must not be negative", jobType)
+		}
+	}
+
+	seen := map[string]bool{}
+	names := map[string]bool{}
+	for i, k := range c.APIKeys {
+		switch {
+		case k.Key == "" || k.Tenant == "":
+			return fmt.Errorf("api_keys[%d] needs a key and a tenant", i)
+		case seen[k.Key]:
+			return fmt.Errorf("api_keys[%d] repeats a key", i)
+		case names[k.Name]:
+			return fmt.Errorf("api_keys[%d]: name %q is taken; name keys that share a tenant", i, k.Name)
+		case k.RateLimit < 0 || k.Burst < 0 || k.DailyQuota < 0 || k.MonthlyQuota < 0:
+			return fmt.Errorf("api_keys[%d]: limits must not be negative", i)
+		}
+		seen[k.Key] = true
+		names[k.Name] = true
+	}
+
+	for i, k := range c.SigningKeys {
+		switch {
+		case k.Secret == "" || k.Tenant == "":
+			return fmt.Errorf("signing_keys[%d] needs a secret and a tenant", i)
+		case names[k.Name]:
+			return fmt.Errorf("signing_keys[%d]: name %q is taken; name keys that share a tenant", i, k.Name)
+		case k.RateLimit < 0 || k.Burst < 0 || k.DailyQuota < 0 || k.MonthlyQuota < 0:
+			return fmt.Errorf("signing_keys[%d]: limits must not be negative", i)
+		}
+		names[k.Name] = true
+	}
+
+	if c.RequireSignature && len(c.SigningKeys) == 0 {
+		return fmt.Errorf("require_signature needs signing_keys")
+	}
+
+	for name, h := range c.Hooks {
+		switch {
+		case !hookName.MatchString(name):
+			return fmt.Errorf("hooks.%s: names are letters, digits, '_' or '-'", name)
+		case !slices.Contains(hookProviders, h.Provider):
+			return fmt.Errorf("hooks.%s: provider must be github, stripe or generic", name)
+		case h.Secret == "":
+			return fmt.Errorf("hooks.%s needs a secret", name)
+		case h.Job.Type == "":
+			return fmt.Errorf("hooks.%s needs a job type", name)
+		case h.Provider == "generic" && len(h.Events) > 0:
+			return fmt.Errorf("hooks.%s: events only apply to github and stripe hooks", name)
+		}
+	}
+
+	if c.SecretsKey != "" {
+		if key, err := base64.StdEncoding.DecodeString(c.SecretsKey); err != nil || len(key) != 32 {
+			return fmt.Errorf("secrets_key must be 32 bytes, base64 encoded")
+		}
+	}
+
+	return nil
+}
+
+// parseSeconds reads a Go duration ("90s", "2h") or, as the older
+// variables were documented, a bare number of seconds.
+func parseSeconds(v string) (time.Duration, error) {
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(secs) * time.Second, nil
+	}
+	return time.ParseDuration(v)
+}
+
+func splitList(raw string) []string {
+	var queues []string
+	for _, q := range strings.Split(raw, ",") {
+		if q = strings.TrimSpace(q); q != "" {
+			queues = append(queues, q)
+		}
+	}
+	return queues
+}
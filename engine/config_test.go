@@ -0,0 +1,58 @@
+package engine
+
+import (
+	"slices"
+	"testing"
+
+	"goflow/jobs"
+)
+
+func TestLoadConfigJobTypeSettingsFromEnv(t *testing.T) {
+
+	t.Setenv("GOFLOW_AGENT_TOKEN", "agent-secret")
+	t.Setenv("GOFLOW_ENABLE_RUN_COMMAND", "true")
+	t.Setenv("GOFLOW_COMMAND_ALLOWLIST", "/bin/true, /bin/echo")
+	t.Setenv("GOFLOW_COMMAND_MAX_MEMORY_MB", "4096")
+	t.Setenv("GOFLOW_EXECUTION_GUARANTEES", "send_email=at_least_once")
+	t.Setenv("GOFLOW_CONTAINER_IMAGES", "ghcr.io/acme/")
+	t.Setenv("GOFLOW_DOCKER_HOST", "")
+	t.Setenv("DOCKER_HOST", "tcp://docker:2375")
+	t.Setenv("GOFLOW_PDF_RENDER_URL", "http://gotenberg:3000/forms/chromium/convert/html")
+
+	c, err := LoadConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	switch {
+	case c.AgentToken != "agent-secret":
+		t.Errorf("agent token %q", c.AgentToken)
+	case !c.RunCommand.Enabled || !slices.Equal(c.RunCommand.Allowlist, []string{"/bin/true", "/bin/echo"}):
+		t.Errorf("run_command %+v", c.RunCommand)
+	case c.RunCommand.MaxMemoryMB != 4096 || c.RunCommand.MemoryMB != 512:
+		t.Errorf("run_command memory %d of %d, want the default 512 of 4096", c.RunCommand.MemoryMB, c.RunCommand.MaxMemoryMB)
+	case c.ExecutionGuarantees["send_email"] != jobs.AtLeastOnce:
+		t.Errorf("guarantees %v", c.ExecutionGuarantees)
+	case c.Containers.DockerHost != "tcp://docker:2375" || !slices.Equal(c.Containers.Images, []string{"ghcr.io/acme/"}):
+		t.Errorf("containers %+v", c.Containers)
+	case c.PDFRenderURL == "":
+		t.Error("no pdf_render_url")
+	}
+}
+
+func TestValidateJobTypeSettings(t *testing.T) {
+
+	for name, change := range map[string]func(*Config){
+		"unknown guarantee":     func(c *Config) { c.ExecutionGuarantees = map[string]jobs.Guarantee{"send_email": "exactly_once"} },
+		"enabled, no allowlist": func(c *Config) { c.RunCommand.Enabled = true },
+		"relative command":      func(c *Config) { c.RunCommand.Allowlist = []string{"true"} },
+		"zero limit":            func(c *Config) { c.RunCommand.MaxCPUSeconds = 0 },
+		"unknown runtime":       func(c *Config) { c.Containers.Runtime = "podman" },
+	} {
+		c := DefaultConfig()
+		change(&c)
+		if err := c.validate(); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
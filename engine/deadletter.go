@@ -0,0 +1,254 @@
+package engine
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"goflow/jobs"
+
+	"github.com/lib/pq"
+)
+
+// ==================== DEAD LETTER ====================
+//
+// A job that runs out of retries is copied to dead_letter in the same
+// transaction that marks it failed: its final payload, every attempt's
+// error and the last response. Entries stay until they are requeued (as a
+// new job) or purged, even if the job row itself is later deleted.
+
+type deadLetterEntry struct {
+	ID        int       `json:"id"`
+	JobID     int       `json:"job_id"`
+	Type      string    `json:"type"`
+	Queue     string    `json:"queue"`
+	Tags      []string  `json:"tags"`
+	Attempts  int       `json:"attempts"`
+	LastError *string   `json:"last_error"`
+	FailedAt  time.Time `json:"failed_at"`
+
+	Payload        json.RawMessage `json:"payload,omitempty"`
+	Errors         json.RawMessage `json:"errors,omitempty"`
+	ResponseStatus *int            `json:"response_status,omitempty"`
+	ResponseBody   json.RawMessage `json:"response_body,omitempty"`
+}
+
+const deadLetterColumns = `id, job_id, type, queue, tags, attempts, last_error, failed_at`
+
+// deadLetter snapshots a job that has just been marked failed.
+func deadLetter(tx *sql.Tx, jobID int) error {
+
+	_, err := tx.Exec(`
+		INSERT INTO dead_letter (job_id, type, payload, queue, tags, attempts, last_error, errors, response_status, response_body, tenant_id)
+		SELECT id, type, payload, queue, tags, retry_count, last_error, attempt_errors, response_status, response_body, tenant_id
+		FROM jobs
+		WHERE id = $1
+		ON CONFLICT (job_id) DO UPDATE SET
+			payload = EXCLUDED.payload,
+			attempts = EXCLUDED.attempts,
+			last_error = EXCLUDED.last_error,
+			errors = EXCLUDED.errors,
+			response_status = EXCLUDED.response_status,
+			response_body = EXCLUDED.response_body,
+			failed_at = NOW()
+	`, jobID)
+
+	return err
+}
+
+// deadLetterFilter reads ?type=, ?queue= and ?before= (failed before an
+// RFC 3339 time) into a WHERE clause over the request's tenant.
+func deadLetterFilter(r *http.Request) (string, []interface{}, error) {
+
+	clauses := []string{"tenant_id = $1"}
+	args := []interface{}{tenantOf(r)}
+
+	q := r.URL.Query()
+	for _, col := range []string{"type", "queue"} {
+		if v := q.Get(col); v != "" {
+			args = append(args, v)
+			clauses = append(clauses, col+" = $"+strconv.Itoa(len(args)))
+		}
+	}
+
+	if v := q.Get("before"); v != "" {
+		before, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return "", nil, err
+		}
+		args = append(args, before)
+		clauses = append(clauses, "failed_at < $"+strconv.Itoa(len(args)))
+	}
+
+	return " WHERE " + strings.Join(clauses, " AND "), args, nil
+}
+
+// deadLetterListHandler serves GET /dead-letter, listing entries newest
+// first, and DELETE /dead-letter, purging every entry that matches the
+// filter.
+func deadLetterListHandler(w http.ResponseWriter, r *http.Request) {
+
+	where, args, err := deadLetterFilter(r)
+	if err != nil {
+		http.Error(w, "'before' must be an RFC 3339 time", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+
+	case http.MethodGet:
+		rows, err := db.Query(`SELECT `+deadLetterColumns+` FROM dead_letter`+where+` ORDER BY failed_at DESC, id DESC`, args...)
+		if err != nil {
+			http.Error(w, "Query failed", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		entries := []deadLetterEntry{}
+		for rows.Next() {
+			e, err := scanDeadLetter(rows, false)
+			if err != nil {
+				http.Error(w, "Scan failed", http.StatusInternalServerError)
+				return
+			}
+			entries = append(entries, e)
+		}
+
+		json.NewEncoder(w).Encode(entries)
+
+	case http.MethodDelete:
+		res, err := db.Exec(`DELETE FROM dead_letter`+where, args...)
+		if err != nil {
+			http.Error(w, "Purge failed", http.StatusInternalServerError)
+			return
+		}
+		purged, _ := res.RowsAffected()
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"purged": purged,
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// deadLetterDetailHandler serves GET and DELETE /dead-letter/{id} and
+// POST /dead-letter/{id}/requeue.
+func deadLetterDetailHandler(w http.ResponseWriter, r *http.Request) {
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/dead-letter/"), "/")
+
+	id, err := strconv.Atoi(parts[0])
+	if err != nil {
+		http.Error(w, "Invalid dead-letter id", http.StatusBadRequest)
+		return
+	}
+
+	switch {
+
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		e, err := scanDeadLetter(db.QueryRow(`
+			SELECT `+deadLetterColumns+`, payload, errors, response_status, response_body
+			FROM dead_letter
+			WHERE id = $1 AND tenant_id = $2
+		`, id, tenantOf(r)), true)
+		if err != nil {
+			http.Error(w, "Dead-letter entry not found", http.StatusNotFound)
+			return
+		}
+
+		json.NewEncoder(w).Encode(e)
+
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		res, err := db.Exec(`DELETE FROM dead_letter WHERE id = $1 AND tenant_id = $2`, id, tenantOf(r))
+		if err != nil {
+			http.Error(w, "Delete failed", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "Dead-letter entry not found", http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+
+	case len(parts) == 2 && parts[1] == "requeue" && r.Method == http.MethodPost:
+		requeueDeadLetter(w, r, id)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// requeueDeadLetter submits the entry's payload as a new job, with the
+// same optional overrides as a clone, and removes the entry. The entry
+// stays locked until then, so concurrent requeues create one job.
+func requeueDeadLetter(w http.ResponseWriter, r *http.Request, id int) {
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Requeue failed", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var job Job
+	var payloadBytes []byte
+
+	err = tx.QueryRow(`
+		SELECT job_id, type, payload, tags, tenant_id
+		FROM dead_letter
+		WHERE id = $1 AND tenant_id = $2
+		FOR UPDATE
+	`, id, tenantOf(r)).Scan(&job.ID, &job.Type, &payloadBytes, pq.Array(&job.Tags), &job.TenantID)
+	if err != nil {
+		http.Error(w, "Dead-letter entry not found", http.StatusNotFound)
+		return
+	}
+
+	if err := json.Unmarshal(payloadBytes, &job.Payload); err != nil {
+		http.Error(w, "Stored payload is invalid", http.StatusInternalServerError)
+		return
+	}
+
+	rw := &recordingWriter{ResponseWriter: w}
+	cloneJob(rw, r, job)
+	if rw.status != http.StatusOK {
+		return
+	}
+
+	if _, err := tx.Exec(`DELETE FROM dead_letter WHERE id = $1`, id); err != nil {
+		return
+	}
+	tx.Commit()
+}
+
+// scanDeadLetter reads deadLetterColumns, followed by payload, errors,
+// response_status and response_body when detail is set.
+func scanDeadLetter(row rowScanner, detail bool) (deadLetterEntry, error) {
+
+	var e deadLetterEntry
+	var payload, errs, body []byte
+
+	dest := []interface{}{&e.ID, &e.JobID, &e.Type, &e.Queue, pq.Array(&e.Tags), &e.Attempts, &e.LastError, &e.FailedAt}
+	if detail {
+		dest = append(dest, &payload, &errs, &e.ResponseStatus, &body)
+	}
+
+	if err := row.Scan(dest...); err != nil {
+		return e, err
+	}
+
+	if e.Tags == nil {
+		e.Tags = []string{}
+	}
+	e.Payload = jobs.RedactJSON(payload)
+	e.Errors = errs
+	e.ResponseBody = body
+
+	return e, nil
+}
@@ -0,0 +1,82 @@
+package engine
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"goflow/jobs"
+)
+
+// ==================== DIGESTS ====================
+
+// digestEventsHandler serves /digests/{name}/events. POST buffers an event
+// for the tenant's next "digest" job; GET lists the events still waiting.
+func digestEventsHandler(w http.ResponseWriter, r *http.Request) {
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/digests/"), "/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] != "events" {
+		http.NotFound(w, r)
+		return
+	}
+	name := parts[0]
+
+	switch r.Method {
+
+	case http.MethodPost:
+		var req struct {
+			Kind    string          `json:"kind"`
+			Summary string          `json:"summary"`
+			Data    json.RawMessage `json:"data"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+
+		if req.Summary == "" && len(req.Data) == 0 {
+			http.Error(w, "'summary' or 'data' is required", http.StatusBadRequest)
+			return
+		}
+
+		id, err := jobs.AddDigestEvent(r.Context(), tenantOf(r), name, req.Kind, req.Summary, req.Data)
+		if err != nil {
+			http.Error(w, "Failed to add event", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{"digest": name, "event_id": id})
+
+	case http.MethodGet:
+		rows, err := db.Query(`
+			SELECT id, kind, summary, data, created_at FROM digest_events
+			WHERE tenant_id = $1 AND digest = $2 AND digest_job_id IS NULL
+			ORDER BY id
+			LIMIT 1000
+		`, tenantOf(r), name)
+		if err != nil {
+			http.Error(w, "Query failed", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		events := []jobs.DigestEvent{}
+		for rows.Next() {
+			var e jobs.DigestEvent
+			var data []byte
+			if err := rows.Scan(&e.ID, &e.Kind, &e.Summary, &data, &e.CreatedAt); err != nil {
+				http.Error(w, "Scan failed", http.StatusInternalServerError)
+				return
+			}
+			e.Data = data
+			events = append(events, e)
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{"digest": name, "pending": events})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,307 @@
+// Package engine is the GoFlow server: the job queue, its workers and the
+// HTTP API. The goflow binary is a thin wrapper around it, and a Go
+// service can embed it instead of deploying a separate process:
+//
+//	c := engine.DefaultConfig()
+//	c.DatabaseURL = "postgres://goflow:secret@db:5432/goflowdb"
+//	c.ListenAddr = "" // mount e.Handler() on your own server instead
+//
+//	e, err := engine.New(c)
+//	if err != nil { ... }
+//	if err := e.Start(ctx); err != nil { ... }
+//	defer e.Shutdown()
+//
+//	job, err := e.Enqueue(engine.Job{Type: "send_email", Payload: payload})
+//
+// The engine keeps its state in package variables, so a process runs at
+// most one at a time. After Shutdown, New may be called again.
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"goflow/jobs"
+	"goflow/workflow"
+)
+
+// Engine is a running GoFlow server: workers, background loops and API.
+type Engine struct {
+	handler http.Handler
+	server  *http.Server
+
+	// close releases the database
+	close func() error
+
+	cancel     context.CancelFunc
+	execCancel context.CancelFunc
+	wg         sync.WaitGroup
+	workerWG   sync.WaitGroup
+
+	shutdown sync.Once
+}
+
+// created is set by New and cleared by Shutdown.
+var created atomic.Bool
+
+// New opens the queue c points at (Postgres, SQLite or memory), creating
+// or migrating its schema, and configures the job executors. Nothing runs
+// until Start.
+func New(c Config) (*Engine, error) {
+
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	if !created.CompareAndSwap(false, true) {
+		return nil, errors.New("engine: another engine is running in this process")
+	}
+	cfg = c
+
+	e, err := open()
+	if err != nil {
+		resetState()
+		return nil, err
+	}
+	return e, nil
+}
+
+// open is New once cfg is set.
+func open() (*Engine, error) {
+
+	e := &Engine{close: func() error { return nil }}
+	mux := standaloneMux()
+
+	switch path, isSQLite := sqlitePath(cfg.DatabaseURL); {
+
+	case cfg.Store == "memory":
+		slog.Warn("Keeping jobs in memory; they are lost when the server stops")
+		localDB = newMemoryStore()
+		store = localDB
+
+	case isSQLite:
+		st, err := openSQLite(path)
+		if err != nil {
+			return nil, err
+		}
+		localDB = st
+		store = st
+		e.close = st.db.Close
+
+	default:
+		if err := openPostgres(); err != nil {
+			if db != nil {
+				db.Close()
+			}
+			return nil, err
+		}
+		e.close = db.Close
+		mux = apiMux()
+	}
+
+	if err := configureExecutors(); err != nil {
+		e.close()
+		return nil, err
+	}
+
+	e.handler = enableCORS(withSignedSubmit(withTenant(mux)))
+	return e, nil
+}
+
+// openPostgres sets up the database, and the Redis broker if configured,
+// for the full server.
+func openPostgres() error {
+
+	if err := initDB(cfg.DatabaseURL); err != nil {
+		return err
+	}
+	jobs.DB = db
+	workflow.DB = db
+	workflow.SealPayload = jobs.SealPayload
+
+	if cfg.Broker == "redis" {
+		b, err := openRedisBroker(cfg.RedisURL)
+		if err != nil {
+			return fmt.Errorf("connect to Redis: %w", err)
+		}
+		broker = b
+		store = &brokerStore{pgStore: newPGStore(db), broker: b}
+	}
+
+	if cfg.SMTP.User == "" || cfg.SMTP.Pass == "" {
+		return errors.New("SMTP credentials not configured: set smtp.user / smtp.pass or SMTP_USER / SMTP_PASS")
+	}
+	return nil
+}
+
+// Handler is the HTTP API, for embedders that serve it themselves.
+func (e *Engine) Handler() http.Handler {
+	return e.handler
+}
+
+// Start runs the workers and background loops, and serves the API on
+// listen_addr unless it is empty. The workers stop claiming jobs when ctx
+// is done; Shutdown waits for the jobs they are running.
+func (e *Engine) Start(ctx context.Context) error {
+
+	if e.cancel != nil {
+		return errors.New("engine: already started")
+	}
+
+	var ln net.Listener
+	if cfg.ListenAddr != "" {
+		var err error
+		ln, err = net.Listen("tcp", cfg.ListenAddr)
+		if err != nil {
+			return err
+		}
+	}
+
+	ctx, e.cancel = context.WithCancel(ctx)
+	execCtx, execCancel := context.WithCancel(context.Background())
+	e.execCancel = execCancel
+
+	if localDB == nil {
+		recoverStuckJobs()
+	}
+
+	for i := 1; i <= cfg.Workers; i++ {
+		e.workerWG.Add(1)
+		go startWorker(ctx, execCtx, &e.workerWG, i, cfg)
+	}
+
+	if localDB != nil {
+		e.wg.Add(1)
+		go startLocalExpiryLoop(ctx, &e.wg)
+	} else {
+		e.wg.Add(1)
+		go startJobListener(ctx, &e.wg)
+
+		e.wg.Add(1)
+		go startRecoveryLoop(ctx, &e.wg)
+
+		e.wg.Add(1)
+		go startOutboxLoop(ctx, &e.wg)
+
+		e.wg.Add(1)
+		go startSchedulerLoop(ctx, &e.wg)
+
+		e.wg.Add(1)
+		go startJanitorLoop(ctx, &e.wg)
+
+		if broker != nil {
+			e.wg.Add(1)
+			go startBrokerLoop(ctx, &e.wg)
+		}
+	}
+
+	if ln != nil {
+		e.server = &http.Server{Handler: e.handler}
+
+		go func() {
+			slog.Info("Server running", "addr", ln.Addr().String())
+			if err := e.server.Serve(ln); err != nil && err != http.ErrServerClosed {
+				slog.Error("HTTP server failed", "error", err)
+			}
+		}()
+	}
+
+	return nil
+}
+
+// Shutdown stops claiming jobs and lets in-flight ones finish, cancelling
+// whatever is still running after drain_timeout. Then it hands back jobs
+// that were claimed but never started, stops the API server and closes
+// the database.
+func (e *Engine) Shutdown() {
+	e.shutdown.Do(func() {
+
+		shuttingDown.Store(true)
+
+		if e.cancel != nil {
+
+			// Stop claiming new jobs
+			e.cancel()
+
+			// Let in-flight jobs finish, then cancel whatever is left
+			timeout := cfg.DrainTimeout
+			slog.Info("Waiting for in-flight jobs", "drain_timeout", timeout.String())
+
+			if !waitTimeout(&e.workerWG, timeout) {
+				slog.Warn("Drain timeout reached, cancelling in-flight jobs")
+				e.execCancel()
+
+				if !waitTimeout(&e.workerWG, 5*time.Second) {
+					slog.Warn("Some executors ignored cancellation")
+				}
+			}
+			e.execCancel()
+			releaseInFlightJobs()
+		}
+
+		closeEventStreams()
+
+		if e.server != nil {
+			shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer shutdownCancel()
+			e.server.Shutdown(shutdownCtx)
+		}
+
+		e.wg.Wait()
+		e.close()
+		resetState()
+
+		slog.Info("Graceful shutdown complete")
+	})
+}
+
+// resetState forgets the queue and connections New set up, so New can run
+// again.
+func resetState() {
+
+	db, localDB, store, broker = nil, nil, nil, nil
+	jobs.DB = nil
+	workflow.DB = nil
+
+	eventStreams.Lock()
+	eventStreams.closed = false
+	eventStreams.Unlock()
+
+	shuttingDown.Store(false)
+	created.Store(false)
+}
+
+// EnqueueError is a job Enqueue refused, with the status POST /jobs would
+// have answered.
+type EnqueueError struct {
+	Status  int
+	Message string
+}
+
+func (err *EnqueueError) Error() string {
+	return err.Message
+}
+
+// Enqueue submits job exactly as POST /jobs would, for job.TenantID or
+// the default tenant, and returns it with its id and run_at. A job the
+// API would refuse is an *EnqueueError.
+func (e *Engine) Enqueue(job Job) (Job, error) {
+
+	var err error
+	if localDB != nil {
+		job, err = enqueueLocalJob(job)
+	} else {
+		job, err = enqueueJob(job)
+	}
+	if err != nil {
+		return Job{}, err
+	}
+	return job.redacted(), nil
+}
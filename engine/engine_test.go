@@ -0,0 +1,52 @@
+package engine
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestEnqueueAndNewAfterShutdown(t *testing.T) {
+
+	oldCfg := cfg
+	t.Cleanup(func() { cfg = oldCfg })
+
+	c := DefaultConfig()
+	c.Store = "memory"
+	c.ListenAddr = ""
+
+	e, err := New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job, err := e.Enqueue(Job{Type: "http_request", Payload: map[string]interface{}{"url": "https://example.com"}})
+	if err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+	if job.ID == 0 || job.Status != "pending" || job.TenantID != defaultTenant {
+		t.Errorf("enqueued %+v, want a pending job of the default tenant with an id", job)
+	}
+
+	_, err = e.Enqueue(Job{Type: "http_request", Payload: map[string]interface{}{}})
+	var refused *EnqueueError
+	if !errors.As(err, &refused) || refused.Status != http.StatusBadRequest {
+		t.Errorf("enqueue without a url: got %v, want a 400 EnqueueError", err)
+	}
+
+	if _, err := New(c); err == nil {
+		t.Fatal("a second New while the first engine runs succeeded")
+	}
+
+	e.Shutdown()
+
+	e, err = New(c)
+	if err != nil {
+		t.Fatalf("New after Shutdown: %v", err)
+	}
+	defer e.Shutdown()
+
+	if _, err := store.GetJob(job.ID); err == nil {
+		t.Error("the new engine's memory store still has the old engine's job")
+	}
+}
@@ -0,0 +1,90 @@
+package engine
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// ==================== JOB EVENTS ====================
+//
+// Every status change of a job is appended to job_events by a trigger
+// (created by the baseline migration), so inserts and updates from any
+// path (API, workflows, follow-ups, bulk operations, recovery) are
+// recorded the same way. Claims stamp the job with claimed_by, which the
+// trigger copies onto each event as the worker. Each event is also sent
+// with NOTIFY goflow_job_events for live streams.
+//
+//	created    inserted
+//	claimed    pending -> processing
+//	released   processing -> pending, same attempt (shutdown, recovery)
+//	retried    processing -> pending after a failed attempt
+//	completed, failed, cancelled
+//	requeued   failed or cancelled -> pending (bulk retry)
+
+type jobEvent struct {
+	ID        int64     `json:"id"`
+	Event     string    `json:"event"`
+	Status    string    `json:"status"`
+	Worker    *string   `json:"worker"`
+	Attempt   *int      `json:"attempt"`
+	Error     *string   `json:"error"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// instanceName tells apart workers of different server processes.
+var instanceName = func() string {
+	host, err := os.Hostname()
+	if err != nil {
+		return "goflow"
+	}
+	return host
+}()
+
+// workerName is the claimed_by value of an in-process worker.
+func workerName(workerID int) string {
+	return instanceName + "/worker-" + strconv.Itoa(workerID)
+}
+
+// agentWorkerName is the claimed_by value of a remote agent.
+func agentWorkerName(agent string) string {
+	return "agent/" + agent
+}
+
+// jobEventsHandler serves GET /jobs/{id}/events, oldest first.
+func jobEventsHandler(w http.ResponseWriter, r *http.Request, jobID int) {
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT id, event, status, worker, attempt, error, created_at
+		FROM job_events
+		WHERE job_id = $1
+		ORDER BY id
+	`, jobID)
+	if err != nil {
+		http.Error(w, "Query failed", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	events := []jobEvent{}
+	for rows.Next() {
+		var e jobEvent
+		if err := rows.Scan(&e.ID, &e.Event, &e.Status, &e.Worker, &e.Attempt, &e.Error, &e.CreatedAt); err != nil {
+			http.Error(w, "Scan failed", http.StatusInternalServerError)
+			return
+		}
+		events = append(events, e)
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"job_id": jobID,
+		"events": events,
+	})
+}
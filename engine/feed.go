@@ -0,0 +1,147 @@
+package engine
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// ==================== WEBSOCKET FEED ====================
+//
+// /ws sends the same job events as GET /events, one JSON message each,
+// for dashboards that prefer a WebSocket. Filters come from the query
+// string and can be changed at any time by sending a message:
+//
+//	ws://host/ws?type=http_request,send_email&status=failed
+//	client -> server  {"types": ["data_extract"], "statuses": []}
+//	server -> client  {"id": 9, "job_id": 42, "job_type": "http_request", "event": "failed", "status": "failed", ...}
+//
+// ?last_event_id= replays what was missed since that event first. A
+// client that falls behind is disconnected and should reconnect with the
+// last id it saw.
+
+const feedWriteTimeout = 10 * time.Second
+
+type feedFilter struct {
+	Types    []string `json:"types"`
+	Statuses []string `json:"statuses"`
+}
+
+func (f feedFilter) match(e streamEvent) bool {
+	return matchAny(f.Types, e.JobType) && matchAny(f.Statuses, e.Status)
+}
+
+// matchAny is true when list is empty or holds v.
+func matchAny(list []string, v string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, s := range list {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// feedHandler upgrades /ws. Unlike /agents/connect it accepts any origin,
+// like the rest of the API.
+func feedHandler() http.Handler {
+	return websocket.Server{
+		Handshake: func(cfg *websocket.Config, r *http.Request) error {
+			return nil
+		},
+		Handler: serveFeed,
+	}
+}
+
+func serveFeed(conn *websocket.Conn) {
+	defer conn.Close()
+
+	q := conn.Request().URL.Query()
+	tenant := tenantOf(conn.Request())
+
+	var mu sync.Mutex
+	filter := feedFilter{
+		Types:    splitList(q.Get("type")),
+		Statuses: splitList(q.Get("status")),
+	}
+
+	matches := func(e streamEvent) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return e.TenantID == tenant && filter.match(e)
+	}
+
+	send := func(e streamEvent) bool {
+		conn.SetWriteDeadline(time.Now().Add(feedWriteTimeout))
+		return websocket.JSON.Send(conn, e) == nil
+	}
+
+	live, unsubscribe, ok := subscribeEvents()
+	if !ok {
+		return
+	}
+	defer unsubscribe()
+
+	// Read filter updates until the client goes away
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			var update feedFilter
+			if err := websocket.JSON.Receive(conn, &update); err != nil {
+				return
+			}
+			mu.Lock()
+			filter = update
+			mu.Unlock()
+		}
+	}()
+
+	var after int64
+	if v := q.Get("last_event_id"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return
+		}
+
+		sent := true
+		after, err = replayEvents(n, 0, func(e streamEvent) bool {
+			if matches(e) {
+				sent = send(e)
+			}
+			return sent
+		})
+		if err != nil {
+			slog.Error("Event replay failed", "error", err)
+			return
+		}
+		if !sent {
+			return
+		}
+	}
+
+	for {
+		select {
+		case <-gone:
+			return
+
+		case e, ok := <-live:
+			if !ok {
+				return
+			}
+			if e.ID <= after || !matches(e) {
+				continue
+			}
+			if !send(e) {
+				return
+			}
+			after = e.ID
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"goflow/jobs"
+
+	"github.com/lib/pq"
+)
+
+// ==================== JOB FILTERS ====================
+
+// jobFilter builds the WHERE clause shared by every endpoint that selects
+// jobs from query parameters.
+type jobFilter struct {
+	clauses []string
+	args    []interface{}
+
+	// archived also reads jobs_archive
+	archived bool
+}
+
+// add appends a condition. Each "?" in clause is replaced with the next
+// positional parameter.
+func (f *jobFilter) add(clause string, args ...interface{}) {
+	for _, arg := range args {
+		clause = strings.Replace(clause, "?", f.param(arg), 1)
+	}
+	f.clauses = append(f.clauses, clause)
+}
+
+// param registers arg and returns its placeholder, for statements that
+// need parameters outside the WHERE clause.
+func (f *jobFilter) param(arg interface{}) string {
+	f.args = append(f.args, arg)
+	return fmt.Sprintf("$%d", len(f.args))
+}
+
+// from is the table to select jobs from.
+func (f *jobFilter) from() string {
+	if f.archived {
+		return archivedJobsSource()
+	}
+	return "jobs"
+}
+
+func (f *jobFilter) where() string {
+	if len(f.clauses) == 0 {
+		return ""
+	}
+	return "WHERE " + strings.Join(f.clauses, " AND ")
+}
+
+// parseJobFilter understands:
+//
+//	status=failed            type=send_email          queue=scraper
+//	batch_id=newsletter-42
+//	tag=billing&tag=urgent   (jobs carrying every listed tag)
+//	created_after=2024-01-01T00:00:00Z             created_before=...
+//	payload.email=x@y.com    payload.user.id=42       (JSONB containment)
+//	include_archived=true    (also jobs moved to jobs_archive)
+func parseJobFilter(q url.Values) (*jobFilter, error) {
+
+	f := &jobFilter{}
+
+	if v := q.Get("include_archived"); v != "" {
+		archived, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("include_archived must be true or false")
+		}
+		f.archived = archived
+	}
+
+	if v := q.Get("status"); v != "" {
+		f.add("status = ?", v)
+	}
+
+	if v := q.Get("type"); v != "" {
+		f.add("type = ?", v)
+	}
+
+	if v := q.Get("queue"); v != "" {
+		f.add("queue = ?", v)
+	}
+
+	if v := q.Get("batch_id"); v != "" {
+		f.add("batch_id = ?", v)
+	}
+
+	if tags := q["tag"]; len(tags) > 0 {
+		f.add("tags @> ?", pq.Array(tags))
+	}
+
+	for _, bound := range []struct{ param, op string }{
+		{"created_after", ">="},
+		{"created_before", "<"},
+	} {
+		v := q.Get(bound.param)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be an RFC3339 timestamp", bound.param)
+		}
+		f.add("created_at "+bound.op+" ?", t)
+	}
+
+	for key, values := range q {
+		if !strings.HasPrefix(key, "payload.") {
+			continue
+		}
+
+		path := strings.Split(strings.TrimPrefix(key, "payload."), ".")
+		for _, p := range path {
+			if p == "" {
+				return nil, fmt.Errorf("invalid payload filter %q", key)
+			}
+		}
+
+		for _, value := range values {
+			asString, typed := payloadContainment(path, value)
+			if typed == nil {
+				f.add("payload @> ?", asString)
+			} else {
+				// Query strings are untyped: match 42 and "42" alike
+				f.add("(payload @> ? OR payload @> ?)", asString, typed)
+			}
+		}
+	}
+
+	return f, nil
+}
+
+// payloadContainment builds the JSONB documents matching value at path,
+// once as a string and, if value is valid JSON scalar, once typed.
+func payloadContainment(path []string, value string) ([]byte, []byte) {
+
+	nest := func(leaf interface{}) []byte {
+		doc := leaf
+		for i := len(path) - 1; i >= 0; i-- {
+			doc = map[string]interface{}{path[i]: doc}
+		}
+		b, _ := json.Marshal(doc)
+		return b
+	}
+
+	asString := nest(value)
+
+	var parsed interface{}
+	if err := json.Unmarshal([]byte(value), &parsed); err == nil {
+		switch parsed.(type) {
+		case float64, bool, nil:
+			return asString, nest(parsed)
+		}
+	}
+
+	return asString, nil
+}
+
+// filterValues turns a JSON filter object ({"status": "failed", "tag":
+// ["a", "b"]}) into the query parameters parseJobFilter understands.
+func filterValues(raw map[string]interface{}) (url.Values, error) {
+
+	q := url.Values{}
+
+	for key, v := range raw {
+		switch val := v.(type) {
+		case []interface{}:
+			for _, item := range val {
+				q.Add(key, fmt.Sprint(item))
+			}
+		case string:
+			q.Add(key, val)
+		case float64, bool:
+			q.Add(key, fmt.Sprint(val))
+		default:
+			return nil, fmt.Errorf("unsupported value for filter %q", key)
+		}
+	}
+
+	return q, nil
+}
+
+// listFields are the fields GET /jobs returns by default, matching Job.
+var listFields = []string{"id", "type", "payload", "status", "run_at", "queue", "tags", "priority"}
+
+// jobFields lists the columns that can be selected with ?fields= and
+// ?include=, in the order they are emitted by default.
+var jobFields = []string{
+	"id", "type", "status", "queue", "tags", "priority", "payload", "run_at",
+	"retry_count", "max_retries", "backoff", "base_delay_seconds", "max_delay_seconds", "expires_at", "last_error", "attempt_errors", "unique_key", "timeout_seconds", "response_status", "response_body",
+	"execution_time_ms", "tenant_id", "batch_id", "created_at", "updated_at",
+}
+
+// parseJobFields reads ?fields=id,status (replacing defaults) and
+// ?include=response_body (adding to them).
+func parseJobFields(q url.Values, defaults []string) ([]string, error) {
+
+	fields := defaults
+	if v := q.Get("fields"); v != "" {
+		fields = strings.Split(v, ",")
+	}
+
+	if v := q.Get("include"); v != "" {
+		fields = append(slices.Clone(fields), strings.Split(v, ",")...)
+	}
+
+	var out []string
+	for _, f := range fields {
+		f = strings.TrimSpace(f)
+		if !slices.Contains(jobFields, f) {
+			return nil, fmt.Errorf("unknown field %q", f)
+		}
+		if !slices.Contains(out, f) {
+			out = append(out, f)
+		}
+	}
+
+	return out, nil
+}
+
+// jobObjectSQL builds a json_build_object expression over fields. Only
+// names from jobFields reach it, never raw request input.
+func jobObjectSQL(fields []string) string {
+	pairs := make([]string, 0, len(fields))
+	for _, f := range fields {
+		pairs = append(pairs, fmt.Sprintf("'%s', %s", f, f))
+	}
+	return "json_build_object(" + strings.Join(pairs, ", ") + ")"
+}
+
+// listJobFields serves GET /jobs?fields=id,status&include=response_body,
+// returning only the requested fields of each job.
+func listJobFields(w http.ResponseWriter, r *http.Request, filter *jobFilter) {
+
+	fields, err := parseJobFields(r.URL.Query(), listFields)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT `+jobObjectSQL(fields)+`
+		FROM `+filter.from()+`
+		`+filter.where()+`
+		ORDER BY id
+	`, filter.args...)
+	if err != nil {
+		http.Error(w, "Query failed", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	list := []json.RawMessage{}
+
+	for rows.Next() {
+		var row json.RawMessage
+		if err := rows.Scan(&row); err != nil {
+			http.Error(w, "Scan failed", http.StatusInternalServerError)
+			return
+		}
+		list = append(list, jobs.RedactJSON(row))
+	}
+
+	json.NewEncoder(w).Encode(list)
+}
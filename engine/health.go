@@ -0,0 +1,104 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// ==================== HEALTH ====================
+//
+// /healthz answers as long as the process serves HTTP; a failing liveness
+// probe means restart it. /readyz checks what the server needs to do
+// useful work, so a load balancer stops sending it traffic while the
+// database is unreachable, its workers have died or it is shutting down:
+//
+//	{"status": "degraded", "checks": {"database": "ok", "workers": "3 of 5 running"}}
+
+const readyCheckTimeout = 2 * time.Second
+
+// runningWorkers counts the worker loops that have not exited.
+var runningWorkers atomic.Int32
+
+// shuttingDown is set once a shutdown signal arrives.
+var shuttingDown atomic.Bool
+
+// healthHandler serves /healthz and the older /health.
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// readyHandler serves /readyz: 200 when every check passes, else 503 with
+// the failing checks' reasons.
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+
+	ctx, cancel := context.WithTimeout(r.Context(), readyCheckTimeout)
+	defer cancel()
+
+	checks := map[string]string{}
+	ready := true
+
+	check := func(name string, err error) {
+		if err != nil {
+			checks[name] = err.Error()
+			ready = false
+			return
+		}
+		checks[name] = "ok"
+	}
+
+	check("database", pingDB(ctx))
+
+	if running := int(runningWorkers.Load()); running < cfg.Workers {
+		check("workers", fmt.Errorf("%d of %d running", running, cfg.Workers))
+	} else {
+		check("workers", nil)
+	}
+
+	if broker != nil {
+		check("redis", broker.client.Ping(ctx).Err())
+	}
+
+	if cfg.ReadySMTP {
+		check("smtp", dialSMTP(ctx))
+	}
+
+	if shuttingDown.Load() {
+		check("shutdown", errors.New("shutting down"))
+	}
+
+	status := "ready"
+	if !ready {
+		status = "degraded"
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": status,
+		"checks": checks,
+	})
+}
+
+// pingDB checks the database the server runs on.
+func pingDB(ctx context.Context) error {
+	if localDB != nil {
+		return localDB.ping(ctx)
+	}
+	return db.PingContext(ctx)
+}
+
+// dialSMTP checks that the SMTP server accepts connections.
+func dialSMTP(ctx context.Context) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(cfg.SMTP.Host, cfg.SMTP.Port))
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
@@ -0,0 +1,147 @@
+package engine
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"goflow/jobs"
+)
+
+// ==================== HOOKS ====================
+//
+// A job can name the job to run after it in its payload:
+//
+//	{"type": "data_extract", "payload": {"url": "...", "selector": "h1",
+//	  "on_success": {"type": "send_email", "payload": {"to": "...", "subject": "...", "body": "..."}},
+//	  "on_failure": {"type": "webhook_delivery", "payload": {...}, "delay_seconds": 60}}}
+//
+// on_success is enqueued when the job completes and on_failure when it
+// fails for good, in the same transaction as the final status. The new
+// job's payload gets a "parent" object with the finished job's id, type,
+// status, response and error. Hook jobs can declare hooks of their own.
+
+var hookFields = []string{"on_success", "on_failure"}
+
+// validateHooks checks the hooks in payload, and in theirs, the way
+// submitJob checks a job.
+func validateHooks(payload map[string]interface{}) error {
+
+	for _, hook := range hookFields {
+		raw, ok := payload[hook]
+		if !ok || raw == nil {
+			continue
+		}
+
+		def, ok := raw.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("'%s' must be an object", hook)
+		}
+
+		jobType, _ := def["type"].(string)
+		if jobType == "" {
+			return fmt.Errorf("'%s.type' is required", hook)
+		}
+		if _, ok := internalExecutors[jobType]; ok {
+			return fmt.Errorf("'%s': %s is an internal job type", hook, jobType)
+		}
+
+		hookPayload := map[string]interface{}{}
+		if p, ok := def["payload"]; ok && p != nil {
+			if hookPayload, ok = p.(map[string]interface{}); !ok {
+				return fmt.Errorf("'%s.payload' must be an object", hook)
+			}
+		}
+		if d, ok := def["delay_seconds"]; ok {
+			if n, ok := d.(float64); !ok || n < 0 {
+				return fmt.Errorf("'%s.delay_seconds' must be a non-negative number", hook)
+			}
+		}
+
+		if err := jobs.ValidatePayload(jobType, hookPayload); err != nil {
+			return fmt.Errorf("'%s': %w", hook, err)
+		}
+		if err := validateHooks(hookPayload); err != nil {
+			return fmt.Errorf("'%s': %w", hook, err)
+		}
+	}
+
+	return nil
+}
+
+// enqueueHook records the job's on_success or on_failure job inside tx,
+// after its final status has been written there.
+func enqueueHook(tx *sql.Tx, job Job, hook string) error {
+
+	def, ok := job.Payload[hook].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	jobType, _ := def["type"].(string)
+	if jobType == "" {
+		return errors.New(hook + " has no type")
+	}
+
+	var status string
+	var responseBody []byte
+	var lastError *string
+
+	err := tx.QueryRow(`
+		SELECT status, response_body, last_error
+		FROM jobs
+		WHERE id = $1
+	`, job.ID).Scan(&status, &responseBody, &lastError)
+
+	if err != nil {
+		return err
+	}
+
+	parent := map[string]interface{}{
+		"job_id": job.ID,
+		"type":   job.Type,
+		"status": status,
+	}
+
+	if responseBody != nil {
+		var parsed interface{}
+		json.Unmarshal(responseBody, &parsed)
+		parent["response"] = parsed
+	}
+
+	if lastError != nil {
+		parent["error"] = *lastError
+	}
+
+	payload := map[string]interface{}{}
+	if p, ok := def["payload"].(map[string]interface{}); ok {
+		for k, v := range p {
+			payload[k] = v
+		}
+	}
+	payload["parent"] = parent
+
+	if err := jobs.SealPayload(payload); err != nil {
+		return err
+	}
+
+	payloadJSON, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	f := jobs.FollowUp{Type: jobType, Payload: payloadJSON, Tenant: job.TenantID}
+	if d, ok := def["delay_seconds"].(float64); ok {
+		f.DelaySeconds = int(d)
+	}
+	if tags, ok := def["tags"].([]interface{}); ok {
+		for _, t := range tags {
+			if s, ok := t.(string); ok {
+				f.Tags = append(f.Tags, s)
+			}
+		}
+	}
+
+	return jobs.InsertFollowUps(tx, []jobs.FollowUp{f})
+}
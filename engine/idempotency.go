@@ -0,0 +1,154 @@
+package engine
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// ==================== IDEMPOTENCY KEYS ====================
+//
+// POST /jobs honours an Idempotency-Key header. The first request with a
+// key is executed and its response stored; replays within the TTL get the
+// stored response back instead of creating another job. This guards the
+// HTTP call itself — it is unrelated to the payload idempotency_key that
+// effectively-once executors use.
+
+const (
+	idempotencyHeader     = "Idempotency-Key"
+	defaultIdempotencyTTL = 24 * time.Hour
+)
+
+// recordingWriter passes the response through while keeping a copy.
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rw *recordingWriter) WriteHeader(status int) {
+	rw.status = status
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *recordingWriter) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	rw.body.Write(b)
+	return rw.ResponseWriter.Write(b)
+}
+
+// withIdempotencyKey runs next at most once per Idempotency-Key. Requests
+// without the header go straight through.
+func withIdempotencyKey(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		key := r.Header.Get(idempotencyHeader)
+		if key == "" || r.Method != http.MethodPost {
+			next(w, r)
+			return
+		}
+		// Tenants pick their keys independently
+		key = tenantOf(r) + ":" + key
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Invalid body", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		sum := sha256.Sum256(append([]byte(r.URL.Path+"\n"), body...))
+		requestHash := hex.EncodeToString(sum[:])
+
+		ttl := int(cfg.IdempotencyTTL.Seconds())
+
+		// Claim the key, taking over an expired entry if there is one
+		res, err := db.Exec(`
+			INSERT INTO idempotency_keys (key, request_hash)
+			VALUES ($1, $2)
+			ON CONFLICT (key) DO UPDATE
+			SET request_hash = EXCLUDED.request_hash,
+			    response_status = NULL,
+			    response_body = NULL,
+			    created_at = NOW()
+			WHERE idempotency_keys.created_at < NOW() - ($3 || ' seconds')::interval
+		`, key, requestHash, ttl)
+		if err != nil {
+			http.Error(w, "Idempotency check failed", http.StatusInternalServerError)
+			return
+		}
+
+		if claimed, _ := res.RowsAffected(); claimed == 0 {
+			replayIdempotent(w, key, requestHash)
+			return
+		}
+
+		rw := &recordingWriter{ResponseWriter: w}
+		next(rw, r)
+
+		// Server errors and throttling are not remembered so the client
+		// can retry them
+		if rw.status >= 500 || rw.status == http.StatusTooManyRequests || rw.status == 0 {
+			db.Exec(`DELETE FROM idempotency_keys WHERE key = $1`, key)
+			return
+		}
+
+		_, err = db.Exec(`
+			UPDATE idempotency_keys
+			SET response_status = $2, response_body = $3
+			WHERE key = $1
+		`, key, rw.status, rw.body.Bytes())
+		if err != nil {
+			slog.Error("Idempotency response save failed", "error", err)
+		}
+	}
+}
+
+func replayIdempotent(w http.ResponseWriter, key string, requestHash string) {
+
+	var storedHash string
+	var status sql.NullInt64
+	var body []byte
+
+	err := db.QueryRow(`
+		SELECT request_hash, response_status, response_body
+		FROM idempotency_keys
+		WHERE key = $1
+	`, key).Scan(&storedHash, &status, &body)
+	if err != nil {
+		http.Error(w, "Idempotency check failed", http.StatusInternalServerError)
+		return
+	}
+
+	if storedHash != requestHash {
+		http.Error(w, "Idempotency-Key was already used with a different request", http.StatusUnprocessableEntity)
+		return
+	}
+
+	if !status.Valid {
+		http.Error(w, "A request with this Idempotency-Key is still in progress", http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(int(status.Int64))
+	w.Write(body)
+}
+
+func pruneIdempotencyKeys() {
+	_, err := db.Exec(`
+		DELETE FROM idempotency_keys
+		WHERE created_at < NOW() - ($1 || ' seconds')::interval
+	`, int(cfg.IdempotencyTTL.Seconds()))
+	if err != nil {
+		slog.Error("Idempotency key cleanup failed", "error", err)
+	}
+}
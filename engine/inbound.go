@@ -0,0 +1,310 @@
+package engine
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"goflow/jobs"
+)
+
+// ==================== INBOUND WEBHOOKS ====================
+
+// POST /hooks/{name} receives webhooks from other services and turns each
+// delivery into a job, from the template in the hook's config:
+//
+//	hooks:
+//	  github-push:
+//	    provider: github
+//	    secret: "secret://github_hook"
+//	    events: [push]
+//	    job:
+//	      type: http_request
+//	      unique_key: "{{delivery}}"
+//	      on_conflict: coalesce
+//	      payload:
+//	        url: "https://ci.example.com/build"
+//	        method: POST
+//	        body: { repo: "{{body.repository.full_name}}", sha: "{{body.after}}" }
+//
+// The template sees the parsed body, the headers (lower case), the event
+// and delivery id, and the hook's name. Deliveries are authenticated by
+// their signature, not an API key: GitHub's X-Hub-Signature-256, Stripe's
+// Stripe-Signature, or for generic hooks an HMAC-SHA256 of the body in
+// signature_header, the way GoFlow signs its own webhooks.
+
+// InboundHook receives one service's webhooks.
+type InboundHook struct {
+	// Provider is github, stripe or generic
+	Provider string `yaml:"provider"`
+
+	// Secret signs deliveries; it may be a secret:// reference of Tenant
+	Secret string `yaml:"secret"`
+
+	// SignatureHeader carries a generic hook's signature, "sha256=<hex>"
+	// or bare hex; it defaults to X-GoFlow-Signature
+	SignatureHeader string `yaml:"signature_header"`
+
+	// Events limits GitHub and Stripe hooks to these event types; others
+	// are acknowledged without a job
+	Events []string `yaml:"events"`
+
+	// Tenant owns the jobs, "default" if unset
+	Tenant string `yaml:"tenant"`
+
+	Job HookJob `yaml:"job"`
+}
+
+// HookJob is the job a delivery becomes. Payload, tags and unique_key
+// may hold {{placeholders}}.
+type HookJob struct {
+	Type       string                 `yaml:"type"`
+	Payload    map[string]interface{} `yaml:"payload"`
+	Queue      string                 `yaml:"queue"`
+	Tags       []string               `yaml:"tags"`
+	Priority   int                    `yaml:"priority"`
+	UniqueKey  string                 `yaml:"unique_key"`
+	OnConflict string                 `yaml:"on_conflict"`
+}
+
+var (
+	hookProviders = []string{"github", "stripe", "generic"}
+	hookName      = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+)
+
+const (
+	// maxHookBody bounds a delivery; GitHub caps payloads at 25 MB, but
+	// jobs are not the place for anything that size
+	maxHookBody = 1 << 20
+
+	// stripeTolerance is how old a Stripe signature may be, against replays
+	stripeTolerance = 5 * time.Minute
+)
+
+// inboundHookHandler serves POST /hooks/{name}.
+func inboundHookHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/hooks/")
+	hook, ok := cfg.Hooks[name]
+	if !ok {
+		http.Error(w, "Hook not found", http.StatusNotFound)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxHookBody))
+	if err != nil {
+		http.Error(w, "Body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	tenant := hook.Tenant
+	if tenant == "" {
+		tenant = defaultTenant
+	}
+
+	secret, err := jobs.ResolveSecret(r.Context(), tenant, hook.Secret)
+	if err != nil {
+		slog.Error("Hook secret unavailable", "hook", name, "error", err)
+		http.Error(w, "Hook secret unavailable", http.StatusInternalServerError)
+		return
+	}
+
+	if err := verifyHook(hook, secret, r.Header, body, time.Now()); err != nil {
+		slog.Warn("Rejected webhook", "hook", name, "error", err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var doc interface{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	event, delivery := hookEvent(hook, r.Header, doc)
+
+	// GitHub pings a new hook once; it is not an event to act on
+	if hook.Provider == "github" && event == "ping" {
+		json.NewEncoder(w).Encode(map[string]interface{}{"hook": name, "ping": true})
+		return
+	}
+
+	// Acknowledge other events, or the sender retries them
+	if len(hook.Events) > 0 && !slices.Contains(hook.Events, event) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"hook": name, "event": event, "ignored": true})
+		return
+	}
+
+	headers := map[string]interface{}{}
+	for k, v := range r.Header {
+		headers[strings.ToLower(k)] = v[0]
+	}
+
+	job, err := hook.Job.render(map[string]interface{}{
+		"hook":     name,
+		"event":    event,
+		"delivery": delivery,
+		"headers":  headers,
+		"body":     doc,
+	})
+	if err != nil {
+		http.Error(w, "Hook "+name+": "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	job.TenantID = tenant
+
+	slog.Info("Webhook received", "hook", name, "event", event, "delivery", delivery)
+
+	if localDB != nil {
+		standaloneSubmit(w, job)
+	} else {
+		submitJob(w, job)
+	}
+}
+
+// verifyHook checks the delivery's signature.
+func verifyHook(hook InboundHook, secret string, h http.Header, body []byte, now time.Time) error {
+
+	switch hook.Provider {
+
+	case "github":
+		sig, ok := strings.CutPrefix(h.Get("X-Hub-Signature-256"), "sha256=")
+		if !ok {
+			return errors.New("missing X-Hub-Signature-256")
+		}
+		return checkHMAC(secret, body, sig)
+
+	case "stripe":
+		var ts string
+		var sigs []string
+		for _, part := range strings.Split(h.Get("Stripe-Signature"), ",") {
+			k, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+			switch k {
+			case "t":
+				ts = v
+			case "v1":
+				sigs = append(sigs, v)
+			}
+		}
+		if ts == "" || len(sigs) == 0 {
+			return errors.New("missing Stripe-Signature")
+		}
+
+		sec, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil {
+			return errors.New("invalid Stripe-Signature timestamp")
+		}
+		if age := now.Sub(time.Unix(sec, 0)); age > stripeTolerance || age < -stripeTolerance {
+			return errors.New("Stripe-Signature timestamp is outside the tolerance")
+		}
+
+		signed := append([]byte(ts+"."), body...)
+		for _, sig := range sigs {
+			if checkHMAC(secret, signed, sig) == nil {
+				return nil
+			}
+		}
+		return errors.New("signature mismatch")
+
+	default:
+		header := hook.SignatureHeader
+		if header == "" {
+			header = "X-GoFlow-Signature"
+		}
+		sig := strings.TrimPrefix(h.Get(header), "sha256=")
+		if sig == "" {
+			return fmt.Errorf("missing %s", header)
+		}
+		return checkHMAC(secret, body, sig)
+	}
+}
+
+// checkHMAC compares a hex HMAC-SHA256 of msg in constant time.
+func checkHMAC(secret string, msg []byte, sig string) error {
+
+	got, err := hex.DecodeString(sig)
+	if err != nil {
+		return errors.New("signature is not hex")
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(msg)
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
+
+// hookEvent returns the delivery's event type and id, where the provider
+// sends them.
+func hookEvent(hook InboundHook, h http.Header, doc interface{}) (string, string) {
+
+	switch hook.Provider {
+	case "github":
+		return h.Get("X-GitHub-Event"), h.Get("X-GitHub-Delivery")
+	case "stripe":
+		obj, _ := doc.(map[string]interface{})
+		event, _ := obj["type"].(string)
+		id, _ := obj["id"].(string)
+		return event, id
+	}
+	return "", ""
+}
+
+// render builds the job for one delivery.
+func (t HookJob) render(data map[string]interface{}) (Job, error) {
+
+	job := Job{
+		Type:       t.Type,
+		Queue:      t.Queue,
+		Priority:   t.Priority,
+		OnConflict: t.OnConflict,
+	}
+
+	payload, err := jobs.RenderTemplate(t.Payload, data)
+	if err != nil {
+		return job, err
+	}
+	job.Payload, _ = payload.(map[string]interface{})
+	if job.Payload == nil {
+		job.Payload = map[string]interface{}{}
+	}
+
+	for _, tag := range t.Tags {
+		v, err := jobs.RenderTemplate(tag, data)
+		if err != nil {
+			return job, err
+		}
+		if s := fmt.Sprint(v); v != nil && s != "" {
+			job.Tags = append(job.Tags, s)
+		}
+	}
+
+	if t.UniqueKey != "" {
+		v, err := jobs.RenderTemplate(t.UniqueKey, data)
+		if err != nil {
+			return job, err
+		}
+		if v != nil {
+			job.UniqueKey = fmt.Sprint(v)
+		}
+	}
+
+	return job, nil
+}
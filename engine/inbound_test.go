@@ -0,0 +1,73 @@
+package engine
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func hexHMAC(secret, msg string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(msg))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifyHook(t *testing.T) {
+
+	const secret = "whsec"
+	body := `{"action":"opened"}`
+	now := time.Now()
+	ts := now.Unix()
+
+	stripeSig := func(ts int64, sigs ...string) http.Header {
+		v := fmt.Sprintf("t=%d", ts)
+		for _, s := range sigs {
+			v += ",v1=" + s
+		}
+		return http.Header{"Stripe-Signature": {v}}
+	}
+	stripeMAC := func(ts int64) string { return hexHMAC(secret, fmt.Sprintf("%d.%s", ts, body)) }
+
+	github := InboundHook{Provider: "github"}
+	stripe := InboundHook{Provider: "stripe"}
+	generic := InboundHook{Provider: "generic"}
+	custom := InboundHook{Provider: "generic", SignatureHeader: "X-Shopify-Hmac-Sha256"}
+
+	for _, tc := range []struct {
+		name   string
+		hook   InboundHook
+		header http.Header
+		body   string
+		ok     bool
+	}{
+		{"github valid", github, http.Header{"X-Hub-Signature-256": {"sha256=" + hexHMAC(secret, body)}}, body, true},
+		{"github tampered body", github, http.Header{"X-Hub-Signature-256": {"sha256=" + hexHMAC(secret, body)}}, body + " ", false},
+		{"github wrong key", github, http.Header{"X-Hub-Signature-256": {"sha256=" + hexHMAC("other", body)}}, body, false},
+		{"github no prefix", github, http.Header{"X-Hub-Signature-256": {hexHMAC(secret, body)}}, body, false},
+		{"github non-hex", github, http.Header{"X-Hub-Signature-256": {"sha256=zz"}}, body, false},
+		{"github missing", github, http.Header{}, body, false},
+
+		{"stripe valid", stripe, stripeSig(ts, stripeMAC(ts)), body, true},
+		{"stripe rolled secret", stripe, stripeSig(ts, hexHMAC("old", body), stripeMAC(ts)), body, true},
+		{"stripe tampered body", stripe, stripeSig(ts, stripeMAC(ts)), body + " ", false},
+		{"stripe expired", stripe, stripeSig(ts-600, stripeMAC(ts-600)), body, false},
+		{"stripe from the future", stripe, stripeSig(ts+600, stripeMAC(ts+600)), body, false},
+		{"stripe timestamp not signed", stripe, stripeSig(ts, stripeMAC(ts-1)), body, false},
+		{"stripe no v1", stripe, stripeSig(ts), body, false},
+
+		{"generic valid", generic, http.Header{"X-Goflow-Signature": {"sha256=" + hexHMAC(secret, body)}}, body, true},
+		{"generic without prefix", generic, http.Header{"X-Goflow-Signature": {hexHMAC(secret, body)}}, body, true},
+		{"generic wrong key", generic, http.Header{"X-Goflow-Signature": {hexHMAC("other", body)}}, body, false},
+		{"generic custom header", custom, http.Header{"X-Shopify-Hmac-Sha256": {hexHMAC(secret, body)}}, body, true},
+		{"generic default header ignored", custom, http.Header{"X-Goflow-Signature": {hexHMAC(secret, body)}}, body, false},
+	} {
+		err := verifyHook(tc.hook, secret, tc.header, []byte(tc.body), now)
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: got %v, want ok=%v", tc.name, err, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package engine
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"goflow/jobs"
+)
+
+// ==================== JOB TYPES ====================
+
+// jobTypesHandler serves GET /job-types: every job type this server can
+// run, and whether it is built in, a WASM plugin, an external executor or
+// registered by the embedding program (see jobs.Register).
+func jobTypesHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	json.NewEncoder(w).Encode(jobs.Types())
+}
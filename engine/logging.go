@@ -0,0 +1,47 @@
+package engine
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// ==================== LOGGING ====================
+//
+// Everything logs through log/slog, by default as one JSON object per
+// line on stderr, so aggregators can filter on fields such as job_id,
+// job_type, worker_id, attempt and duration_ms instead of parsing text.
+// log_level (debug, info, warn, error) drops anything less severe;
+// log_format "text" gives key=value lines for reading in a terminal.
+
+// SetupLogging installs the default logger for this process and the
+// jobs and workflow packages.
+func SetupLogging(level, format string) error {
+
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("log_level must be debug, info, warn or error")
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "", "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("log_format must be json or text")
+	}
+
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// jobLogger carries the fields every line about a job execution should
+// have. Agent-run jobs use worker_id 0.
+func jobLogger(workerID int, job Job) *slog.Logger {
+	return slog.With("worker_id", workerID, "job_id", job.ID, "job_type", job.Type)
+}
@@ -0,0 +1,63 @@
+package engine
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ==================== JOB LOGS ====================
+
+type jobLogLine struct {
+	ID        int64     `json:"id"`
+	Message   string    `json:"message"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// jobLogsHandler serves GET /jobs/{id}/logs. Pass the last seen line's id
+// as ?after= to follow a running job.
+func jobLogsHandler(w http.ResponseWriter, r *http.Request, jobID int) {
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var after int64
+	if v := r.URL.Query().Get("after"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid 'after'", http.StatusBadRequest)
+			return
+		}
+		after = n
+	}
+
+	rows, err := db.Query(`
+		SELECT id, message, created_at FROM job_logs
+		WHERE job_id = $1 AND id > $2
+		ORDER BY id
+		LIMIT 1000
+	`, jobID, after)
+	if err != nil {
+		http.Error(w, "Query failed", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	lines := []jobLogLine{}
+	for rows.Next() {
+		var l jobLogLine
+		if err := rows.Scan(&l.ID, &l.Message, &l.CreatedAt); err != nil {
+			http.Error(w, "Scan failed", http.StatusInternalServerError)
+			return
+		}
+		lines = append(lines, l)
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"job_id": jobID,
+		"logs":   lines,
+	})
+}
@@ -0,0 +1,126 @@
+package engine
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// ==================== METRICS ====================
+//
+// GET /metrics serves Prometheus metrics. Counters and the duration
+// histogram are kept in memory by this process, so they reset on restart
+// and each server reports only the jobs it submitted or finished; sum
+// them across instances. Queue depth is read from the database on every
+// scrape and is the same whichever instance is asked.
+
+var (
+	jobsEnqueued = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "goflow_jobs_enqueued_total",
+		Help: "Jobs submitted through the API, by type.",
+	}, []string{"type"})
+
+	jobsCompleted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "goflow_jobs_completed_total",
+		Help: "Jobs that finished successfully, by type.",
+	}, []string{"type"})
+
+	jobsFailed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "goflow_jobs_failed_total",
+		Help: "Jobs that failed for good after their last attempt, by type.",
+	}, []string{"type"})
+
+	jobRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "goflow_job_retries_total",
+		Help: "Failed attempts that were scheduled to run again, by type.",
+	}, []string{"type"})
+
+	jobDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "goflow_job_duration_seconds",
+		Help:    "Execution time of each attempt, by type and outcome.",
+		Buckets: []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300},
+	}, []string{"type", "outcome"})
+
+	workersBusy = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "goflow_workers_busy",
+		Help: "In-process workers currently executing a job.",
+	})
+
+	workersTotal = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "goflow_workers",
+		Help: "In-process workers started by this server.",
+	}, func() float64 {
+		return float64(cfg.Workers)
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		jobsEnqueued,
+		jobsCompleted,
+		jobsFailed,
+		jobRetries,
+		jobDuration,
+		workersBusy,
+		workersTotal,
+		queueDepthCollector{},
+	)
+}
+
+// observeAttempt records one finished execution.
+func observeAttempt(jobType string, execErr error, duration int64) {
+	outcome := "success"
+	if execErr != nil {
+		outcome = "error"
+	}
+	jobDuration.WithLabelValues(jobType, outcome).Observe((time.Duration(duration) * time.Millisecond).Seconds())
+}
+
+var queueDepthDesc = prometheus.NewDesc(
+	"goflow_queue_depth",
+	"Jobs per queue and status (pending or processing).",
+	[]string{"queue", "status"}, nil,
+)
+
+// queueDepthCollector counts unfinished jobs when scraped.
+type queueDepthCollector struct{}
+
+func (queueDepthCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- queueDepthDesc
+}
+
+func (queueDepthCollector) Collect(ch chan<- prometheus.Metric) {
+
+	if db == nil {
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT queue, status, COUNT(*)
+		FROM jobs
+		WHERE status IN ('pending', 'processing')
+		GROUP BY queue, status
+	`)
+	if err != nil {
+		slog.Error("Queue depth query failed", "error", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var queue, status string
+		var count int
+		if err := rows.Scan(&queue, &status, &count); err != nil {
+			slog.Error("Queue depth scan failed", "error", err)
+			return
+		}
+		ch <- prometheus.MustNewConstMetric(queueDepthDesc, prometheus.GaugeValue, float64(count), queue, status)
+	}
+}
+
+func metricsHandler() http.Handler {
+	return promhttp.Handler()
+}
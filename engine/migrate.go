@@ -0,0 +1,159 @@
+package engine
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+
+	"goflow/migrations"
+)
+
+// ==================== MIGRATIONS ====================
+//
+// The whole schema is built by the numbered migrations in migrations/sql,
+// which initDB applies at startup. With auto_migrate: false, applying them
+// is left to the operator and the server refuses to start on an outdated
+// or missing schema:
+//
+//	goflow migrate status [server flags]
+//	goflow migrate up     [server flags]
+//	goflow migrate down [n] [server flags]
+
+// applyMigrations brings the schema up to date, or checks that it is.
+func applyMigrations() error {
+
+	if !cfg.AutoMigrate {
+		pending, err := migrations.Pending(db)
+		if err != nil {
+			return err
+		}
+		if len(pending) > 0 {
+			return fmt.Errorf("%d migrations pending; run goflow migrate up", len(pending))
+		}
+		return nil
+	}
+
+	applied, err := migrations.Up(db)
+	for _, m := range applied {
+		slog.Info("Applied migration", "version", m.Version, "name", m.Name)
+	}
+	return err
+}
+
+// RunMigrate runs "goflow migrate" with args and returns its exit code.
+func RunMigrate(args []string) int {
+
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: goflow migrate status|up|down [n] [server flags]")
+		return 2
+	}
+	action, rest := args[0], args[1:]
+
+	steps := 1
+	if action == "down" && len(rest) > 0 && !strings.HasPrefix(rest[0], "-") {
+		n, err := strconv.Atoi(rest[0])
+		if err != nil || n < 1 {
+			fmt.Fprintln(os.Stderr, "down takes a positive number of migrations to revert")
+			return 2
+		}
+		steps, rest = n, rest[1:]
+	}
+
+	c, err := LoadConfig(rest)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	if _, ok := sqlitePath(c.DatabaseURL); ok {
+		fmt.Fprintln(os.Stderr, "migrations are for Postgres; the SQLite schema is created at startup")
+		return 2
+	}
+
+	switch action {
+
+	case "up":
+		conn, err := openDB(c.DatabaseURL)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer conn.Close()
+
+		applied, err := migrations.Up(conn)
+		for _, m := range applied {
+			fmt.Printf("applied %04d %s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if len(applied) == 0 {
+			fmt.Println("nothing to apply")
+		}
+		return 0
+
+	case "down":
+		conn, err := openDB(c.DatabaseURL)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer conn.Close()
+
+		reverted, err := migrations.Down(conn, steps)
+		for _, m := range reverted {
+			fmt.Printf("reverted %04d %s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if len(reverted) == 0 {
+			fmt.Println("nothing to revert")
+		}
+		return 0
+
+	case "status":
+
+	default:
+		fmt.Fprintf(os.Stderr, "unknown migrate action %q; expected status, up or down\n", action)
+		return 2
+	}
+
+	conn, err := openDB(c.DatabaseURL)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer conn.Close()
+
+	states, err := migrations.Status(conn)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	for _, s := range states {
+		applied := "pending"
+		if s.AppliedAt != nil {
+			applied = "applied " + s.AppliedAt.Format("2006-01-02 15:04:05Z07:00")
+		}
+		fmt.Printf("%04d %-32s %s\n", s.Version, s.Name, applied)
+	}
+	return 0
+}
+
+func openDB(connStr string) (*sql.DB, error) {
+	conn, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.Ping(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
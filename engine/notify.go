@@ -0,0 +1,157 @@
+package engine
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ==================== JOB NOTIFICATIONS ====================
+//
+// A trigger on jobs sends NOTIFY goflow_jobs whenever a row becomes
+// pending. One LISTEN connection per process turns those into wakeups for
+// idle workers and agent sessions, which otherwise sleep until the next
+// job is due or the fallback poll interval passes. While the listener is
+// disconnected, workers fall back to the short poll they used before.
+// The same connection receives job events for the SSE streams. The
+// triggers are created by the migrations, which name the channels too.
+
+const (
+	jobsChannel      = "goflow_jobs"
+	jobEventsChannel = "goflow_job_events"
+	disconnectedPoll = 200 * time.Millisecond
+	defaultPollEvery = 5 * time.Second
+)
+
+// dbConnStr is the connection string initDB opened, reused by the
+// listener's dedicated connection.
+var dbConnStr string
+
+// listening is true while the LISTEN connection is up.
+var listening atomic.Bool
+
+// jobWakeups is closed and replaced on every notification, so any number
+// of waiters can select on it.
+var jobWakeups = struct {
+	sync.Mutex
+	ch chan struct{}
+}{ch: make(chan struct{})}
+
+// jobWakeup returns a channel that is closed by the next notification.
+// Take it before looking for work, so a job inserted in between is not
+// missed.
+func jobWakeup() <-chan struct{} {
+	jobWakeups.Lock()
+	defer jobWakeups.Unlock()
+	return jobWakeups.ch
+}
+
+func wakeWaiters() {
+	jobWakeups.Lock()
+	defer jobWakeups.Unlock()
+	close(jobWakeups.ch)
+	jobWakeups.ch = make(chan struct{})
+}
+
+// idleWait is how long a worker that found nothing to claim should sleep:
+// until the next pending job in its queues is due, capped at
+// cfg.PollInterval.
+func idleWait(queues []string) time.Duration {
+
+	if !listening.Load() {
+		return disconnectedPoll
+	}
+
+	wait := cfg.PollInterval
+
+	var next *time.Time
+	err := db.QueryRow(`
+		SELECT MIN(run_at) FROM jobs
+		WHERE status = 'pending'
+		AND queue = ANY($1)
+		AND retry_count < COALESCE(max_retries, $2)
+	`, pq.Array(queues), maxRetries).Scan(&next)
+
+	if err == nil && next != nil {
+		if until := time.Until(*next); until < wait {
+			wait = until
+		}
+	}
+
+	if wait < disconnectedPoll {
+		wait = disconnectedPoll
+	}
+	return wait
+}
+
+// waitForJobs blocks until a notification arrives, wait passes or done
+// is closed.
+func waitForJobs(done <-chan struct{}, wake <-chan struct{}, wait time.Duration) {
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+	case <-wake:
+	case <-timer.C:
+	}
+}
+
+func startJobListener(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	listener := pq.NewListener(dbConnStr, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		switch ev {
+		case pq.ListenerEventConnected, pq.ListenerEventReconnected:
+			listening.Store(true)
+		case pq.ListenerEventDisconnected, pq.ListenerEventConnectionAttemptFailed:
+			listening.Store(false)
+			slog.Warn("Job listener disconnected, polling", "error", err)
+		}
+	})
+	defer listener.Close()
+
+	for _, channel := range []string{jobsChannel, jobEventsChannel} {
+		if err := listener.Listen(channel); err != nil {
+			listener.Close()
+			listening.Store(false)
+			slog.Warn("Job listener LISTEN failed, polling", "channel", channel, "error", err)
+			return
+		}
+	}
+	listening.Store(true)
+
+	ping := time.NewTicker(90 * time.Second)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			listening.Store(false)
+			slog.Info("Job listener shutting down")
+			return
+
+		// A nil notification follows a reconnect, after which anything
+		// sent meanwhile was lost; waking everyone covers it, and stream
+		// clients reconnect and replay from their last event id
+		case n := <-listener.Notify:
+			switch {
+			case n == nil:
+				wakeWaiters()
+				dropEventStreams()
+			case n.Channel == jobEventsChannel:
+				publishJobEvent(n.Extra)
+			default:
+				wakeWaiters()
+			}
+
+		case <-ping.C:
+			go listener.Ping()
+		}
+	}
+}
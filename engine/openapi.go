@@ -0,0 +1,573 @@
+package engine
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"goflow/jobs"
+)
+
+// ==================== OPENAPI ====================
+
+// GET /openapi.json describes the API as an OpenAPI 3.1 document, so
+// clients in other languages can be generated instead of written. The
+// operations are listed by hand below, so a new endpoint needs an entry
+// too. Bodies that are Go types are described from their json tags, and
+// job payloads from the rules POST /jobs checks them with (jobs/schema.go).
+//
+// Errors are the one-line text/plain bodies every handler writes with
+// http.Error. Without Postgres the document only lists what the smaller
+// API serves.
+
+// apiOperation is one method on one path. Path parameters come from the
+// {braces} in path.
+type apiOperation struct {
+	method  string
+	path    string
+	summary string
+
+	query []apiParam
+	body  interface{}
+
+	// optional bodies may be left out
+	optional bool
+
+	// status is the success status; result its body, nil for none
+	status int
+	result interface{}
+
+	errors []int
+
+	served apiMode
+}
+
+// apiMode says which API serves an operation: the full one on Postgres,
+// the smaller one on SQLite and memory, or both.
+type apiMode int
+
+const (
+	postgresOnly apiMode = iota
+	localOnly
+	everywhere
+)
+
+type apiParam struct {
+	name        string
+	schema      interface{}
+	description string
+}
+
+// jobFilterParams are the GET /jobs filters (see parseJobFilter).
+var jobFilterParams = []apiParam{
+	{"status", str(), "Only jobs in this status"},
+	{"type", str(), "Only jobs of this type"},
+	{"queue", str(), "Only jobs on this queue"},
+	{"batch_id", str(), "Only jobs of this batch"},
+	{"tag", arrayOf(str()), "Only jobs carrying every listed tag"},
+	{"created_after", dateTime(), "Created at or after this time"},
+	{"created_before", dateTime(), "Created before this time"},
+	{"include_archived", boolean(), "Also read archived jobs"},
+}
+
+// jobFieldParams select the fields of a job (see parseJobFields).
+var jobFieldParams = []apiParam{
+	{"fields", str(), "Comma-separated fields to return instead of the defaults"},
+	{"include", str(), "Comma-separated fields to return besides the defaults"},
+}
+
+// pauseScope is the body of the pause endpoints; empty means every job.
+var pauseScope = object(map[string]interface{}{
+	"type":   str(),
+	"queue":  str(),
+	"reason": str(),
+})
+
+var drainScope = object(map[string]interface{}{
+	"type":         str(),
+	"queue":        str(),
+	"reason":       str(),
+	"wait_seconds": integer(),
+})
+
+var apiOperations = []apiOperation{
+	{method: "get", path: "/healthz", summary: "Liveness probe", status: 200, result: object(map[string]interface{}{"status": str()}), served: everywhere},
+	{method: "get", path: "/readyz", summary: "Readiness probe: 503 when a dependency check fails", status: 200, result: object(map[string]interface{}{"status": str(), "checks": mapOf(str())}), errors: []int{503}, served: everywhere},
+	{method: "get", path: "/metrics", summary: "Prometheus metrics", status: 200, result: "text/plain", served: everywhere},
+	{method: "get", path: "/openapi.json", summary: "This document", status: 200, result: object(nil), served: everywhere},
+	{method: "get", path: "/job-types", summary: "Job types the server can run", status: 200, result: arrayOf(ref("JobType")), served: everywhere},
+
+	{method: "post", path: "/jobs", summary: "Submit a job", body: ref("JobRequest"), status: 200, result: ref("Job"), errors: []int{400, 409, 422, 429}, served: everywhere},
+	{method: "get", path: "/jobs", summary: "List jobs. payload.<path>=value filters on payload fields", query: append(jobFilterParams, jobFieldParams...), status: 200, result: arrayOf(ref("Job")), errors: []int{400}},
+	{method: "get", path: "/jobs", summary: "List jobs", query: jobFilterParams, status: 200, result: arrayOf(ref("Job")), errors: []int{400}, served: localOnly},
+	{method: "get", path: "/jobs/{id}", summary: "Get a job", query: jobFieldParams, status: 200, result: ref("JobRecord"), errors: []int{400, 404}},
+	{method: "get", path: "/jobs/{id}", summary: "Get a job", status: 200, result: ref("Job"), errors: []int{400, 404}, served: localOnly},
+	{method: "patch", path: "/jobs/{id}", summary: "Edit a pending job", body: ref("JobPatch"), status: 200, result: ref("Job"), errors: []int{400, 404, 409}},
+	{method: "delete", path: "/jobs/{id}", summary: "Cancel a pending job", status: 200, result: ref("Job"), errors: []int{400, 404, 409}},
+	{method: "post", path: "/jobs/{id}/clone", summary: "Submit a copy of a job", body: object(map[string]interface{}{"payload": object(nil), "run_at": dateTime(), "queue": str(), "tags": arrayOf(str())}), optional: true, status: 200, result: ref("Job"), errors: []int{400, 404, 409}},
+	{method: "post", path: "/jobs/{id}/retry", summary: "Retry a failed job", body: object(map[string]interface{}{"reset_retries": boolean()}), optional: true, status: 200, result: ref("Job"), errors: []int{400, 404, 409}},
+	{method: "get", path: "/jobs/{id}/logs", summary: "Lines the job logged", query: []apiParam{{"after", integer(), "Only lines after this id"}}, status: 200, result: object(map[string]interface{}{"job_id": integer(), "logs": arrayOf(ref("JobLogLine"))}), errors: []int{400, 404}},
+	{method: "get", path: "/jobs/{id}/events", summary: "The job's status history", status: 200, result: object(map[string]interface{}{"job_id": integer(), "events": arrayOf(ref("JobEvent"))}), errors: []int{400, 404}},
+	{method: "get", path: "/jobs/{id}/stream", summary: "The job's events as server-sent events", status: 200, result: "text/event-stream", errors: []int{400, 404}},
+	{method: "get", path: "/jobs/stats", summary: "Job counts per group and status", query: append([]apiParam{{"group_by", enum("status", "type", "queue", "tag"), "Defaults to status"}}, jobFilterParams...), status: 200, result: object(map[string]interface{}{"group_by": str(), "groups": mapOf(mapOf(integer()))}), errors: []int{400}},
+	{method: "get", path: "/jobs/export", summary: "Every matching job as NDJSON or CSV", query: append(append([]apiParam{{"format", enum("ndjson", "csv"), "Defaults to ndjson"}}, jobFilterParams...), jobFieldParams...), status: 200, result: "application/x-ndjson", errors: []int{400}},
+	{method: "post", path: "/jobs/bulk", summary: "Retry, cancel, delete or reschedule every job matching a filter", body: ref("BulkRequest"), status: 202, result: ref("BulkStarted"), errors: []int{400}},
+	{method: "get", path: "/jobs/bulk/{id}", summary: "Progress of a bulk operation", status: 200, result: ref("BulkOperation"), errors: []int{400, 404}},
+	{method: "post", path: "/jobs/retry", summary: "Retry every failed job matching the GET /jobs filters", query: jobFilterParams, status: 202, result: ref("BulkStarted"), errors: []int{400}},
+
+	{method: "post", path: "/workflows", summary: "Start a workflow", body: object(map[string]interface{}{"steps": arrayOf(object(nil))}, "steps"), status: 201, result: ref("WorkflowStatus"), errors: []int{400}},
+	{method: "get", path: "/workflows", summary: "List workflows", status: 200, result: arrayOf(ref("Workflow"))},
+	{method: "get", path: "/workflows/{id}", summary: "Get a workflow", status: 200, result: ref("Workflow"), errors: []int{400, 404}},
+	{method: "get", path: "/workflows/{id}/steps", summary: "Each step's job and status", status: 200, result: arrayOf(ref("WorkflowStep")), errors: []int{400, 404}},
+	{method: "get", path: "/workflows/{id}/context", summary: "Outputs collected so far", status: 200, result: object(map[string]interface{}{"context": object(nil)}), errors: []int{400, 404}},
+	{method: "post", path: "/workflows/{id}/run", summary: "Run a workflow", status: 200, result: ref("WorkflowStatus"), errors: []int{400, 404}},
+	{method: "post", path: "/workflows/{id}/cancel", summary: "Cancel a workflow", status: 200, result: ref("WorkflowStatus"), errors: []int{400, 404}},
+
+	{method: "post", path: "/batches", summary: "Declare a batch before its jobs", body: object(map[string]interface{}{"id": str(), "size": integer(), "callback_url": str(), "callback_secret": str()}, "id"), status: 201, result: ref("Batch"), errors: []int{400, 409}},
+	{method: "get", path: "/batches/{id}", summary: "A batch's progress", status: 200, result: ref("Batch"), errors: []int{400, 404}},
+
+	{method: "get", path: "/schedules", summary: "List cron schedules", query: []apiParam{{"enabled", boolean(), "Only enabled or paused schedules"}}, status: 200, result: arrayOf(ref("Schedule")), errors: []int{400}},
+	{method: "post", path: "/schedules", summary: "Create a cron schedule", body: ref("ScheduleRequest"), status: 201, result: ref("Schedule"), errors: []int{400}},
+	{method: "get", path: "/schedules/{id}", summary: "Get a schedule", status: 200, result: ref("Schedule"), errors: []int{400, 404}},
+	{method: "put", path: "/schedules/{id}", summary: "Replace a schedule", body: ref("ScheduleRequest"), status: 200, result: ref("Schedule"), errors: []int{400, 404}},
+	{method: "patch", path: "/schedules/{id}", summary: "Pause or resume a schedule", body: object(map[string]interface{}{"enabled": boolean()}, "enabled"), status: 200, result: ref("Schedule"), errors: []int{400, 404, 409}},
+	{method: "delete", path: "/schedules/{id}", summary: "Delete a schedule", status: 204, errors: []int{400, 404}},
+	{method: "post", path: "/schedules/preview", summary: "The next runs of a cron expression", body: object(map[string]interface{}{"cron": str(), "timezone": str(), "count": integer(), "from": dateTime()}, "cron"), status: 200, result: object(map[string]interface{}{"cron": str(), "timezone": str(), "next_runs": arrayOf(dateTime())}), errors: []int{400}},
+
+	{method: "get", path: "/secrets", summary: "List secret names", status: 200, result: arrayOf(ref("Secret"))},
+	{method: "get", path: "/secrets/{name}", summary: "A secret's metadata; values are never returned", status: 200, result: ref("Secret"), errors: []int{400, 404}},
+	{method: "put", path: "/secrets/{name}", summary: "Create or replace a secret", body: object(map[string]interface{}{"value": str()}, "value"), status: 200, result: ref("Secret"), errors: []int{400, 503}},
+	{method: "delete", path: "/secrets/{name}", summary: "Delete a secret", status: 204, errors: []int{400, 404}},
+
+	{method: "get", path: "/usage", summary: "The calling key's limits and usage", status: 200, result: object(map[string]interface{}{"key": str(), "tenant": str(), "rate_limit": nullable(number()), "burst": nullable(integer()), "daily": ref("QuotaUsage"), "monthly": ref("QuotaUsage")}), errors: []int{404}},
+	{method: "post", path: "/hooks/{name}", summary: "Receive a webhook configured under hooks and submit its job; the signature replaces the API key", body: object(nil), status: 200, result: ref("Job"), errors: []int{400, 404, 409, 413}, served: everywhere},
+	{method: "get", path: "/agents", summary: "Connected remote agents", status: 200, result: arrayOf(ref("Agent"))},
+	{method: "get", path: "/agents/connect", summary: "WebSocket for remote agents", status: 101},
+	{method: "get", path: "/events", summary: "Events of every job as server-sent events", query: []apiParam{{"type", str(), "Only jobs of this type"}, {"queue", str(), "Only jobs on this queue"}}, status: 200, result: "text/event-stream"},
+	{method: "get", path: "/ws", summary: "Job events over WebSocket", status: 101},
+
+	{method: "get", path: "/digests/{name}/events", summary: "Events waiting for the next digest", status: 200, result: object(map[string]interface{}{"digest": str(), "pending": arrayOf(ref("DigestEvent"))}), errors: []int{400}},
+	{method: "post", path: "/digests/{name}/events", summary: "Buffer an event for a digest", body: object(map[string]interface{}{"kind": str(), "summary": str(), "data": map[string]interface{}{}}), status: 201, result: object(map[string]interface{}{"digest": str(), "event_id": integer()}), errors: []int{400}},
+
+	{method: "get", path: "/webhooks/subscriptions", summary: "List webhook subscriptions", query: []apiParam{{"topic", str(), "Only this topic"}}, status: 200, result: arrayOf(ref("WebhookSubscription"))},
+	{method: "post", path: "/webhooks/subscriptions", summary: "Subscribe a URL to a topic", body: object(map[string]interface{}{"topic": str(), "url": str(), "secret": str()}, "topic", "url"), status: 201, result: ref("WebhookSubscription"), errors: []int{400}},
+	{method: "delete", path: "/webhooks/subscriptions/{id}", summary: "Delete a subscription", status: 204, errors: []int{400, 404}},
+	{method: "get", path: "/webhooks/fanouts/{id}", summary: "Deliveries of a webhook_fanout job", status: 200, result: object(map[string]interface{}{"fanout_id": integer(), "counts": mapOf(integer()), "endpoints": arrayOf(object(nil))}), errors: []int{400, 404}},
+
+	{method: "get", path: "/dead-letter", summary: "Jobs that failed for good, newest first", query: deadLetterParams, status: 200, result: arrayOf(ref("DeadLetterEntry")), errors: []int{400}},
+	{method: "delete", path: "/dead-letter", summary: "Purge matching dead-letter entries", query: deadLetterParams, status: 200, result: object(map[string]interface{}{"purged": integer()}), errors: []int{400}},
+	{method: "get", path: "/dead-letter/{id}", summary: "A dead-letter entry with its payload and errors", status: 200, result: ref("DeadLetterEntry"), errors: []int{400, 404}},
+	{method: "delete", path: "/dead-letter/{id}", summary: "Delete a dead-letter entry", status: 204, errors: []int{400, 404}},
+	{method: "post", path: "/dead-letter/{id}/requeue", summary: "Submit the job again", status: 200, result: ref("Job"), errors: []int{400, 404}},
+
+	{method: "post", path: "/admin/purge", summary: "Delete or archive finished jobs", body: object(map[string]interface{}{"older_than_seconds": integer(), "type": str()}, "older_than_seconds"), status: 200, result: object(map[string]interface{}{"deleted": integer(), "archived": integer()}), errors: []int{400, 403}},
+	{method: "get", path: "/admin/pause", summary: "Current claim pauses", status: 200, result: arrayOf(ref("ClaimPause")), errors: []int{403}},
+	{method: "post", path: "/admin/pause", summary: "Stop claiming jobs of a type or queue, or every job", body: pauseScope, optional: true, status: 200, result: ref("ClaimPause"), errors: []int{400, 403}},
+	{method: "post", path: "/admin/resume", summary: "Lift a pause", body: pauseScope, optional: true, status: 200, result: object(map[string]interface{}{"resumed": boolean(), "type": str(), "queue": str()}), errors: []int{400, 403, 404}},
+	{method: "post", path: "/admin/drain", summary: "Pause, then wait for running jobs to finish", body: drainScope, optional: true, status: 200, result: object(map[string]interface{}{"type": str(), "queue": str(), "reason": str(), "paused_at": dateTime(), "processing": integer(), "drained": boolean()}), errors: []int{400, 403}},
+}
+
+var deadLetterParams = []apiParam{
+	{"type", str(), "Only jobs of this type"},
+	{"queue", str(), "Only jobs on this queue"},
+	{"before", dateTime(), "Failed before this time"},
+}
+
+// apiTypes are the response types described from their json tags.
+var apiTypes = map[string]interface{}{
+	"Job":                 Job{},
+	"JobType":             jobs.TypeInfo{},
+	"JobEvent":            jobEvent{},
+	"JobLogLine":          jobLogLine{},
+	"BulkOperation":       bulkOperation{},
+	"Workflow":            Workflow{},
+	"WorkflowStep":        WorkflowStepRun{},
+	"Batch":               Batch{},
+	"Schedule":            Schedule{},
+	"Secret":              secretInfo{},
+	"QuotaUsage":          quotaUsage{},
+	"Agent":               agentInfo{},
+	"DigestEvent":         jobs.DigestEvent{},
+	"WebhookSubscription": webhookSubscription{},
+	"DeadLetterEntry":     deadLetterEntry{},
+	"ClaimPause":          claimPause{},
+}
+
+// openapiHandler serves GET /openapi.json.
+func openapiHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(openapiDocument(localDB != nil))
+}
+
+func openapiDocument(local bool) map[string]interface{} {
+
+	paths := map[string]map[string]interface{}{}
+	for _, op := range apiOperations {
+		if op.served != everywhere && (op.served == localOnly) != local {
+			continue
+		}
+		if paths[op.path] == nil {
+			paths[op.path] = map[string]interface{}{}
+		}
+		paths[op.path][op.method] = op.document()
+	}
+
+	schemas := map[string]interface{}{
+		"JobRequest":      jobRequestSchema(),
+		"JobRecord":       jobRecordSchema(),
+		"JobPatch":        object(map[string]interface{}{"payload": object(nil), "run_at": dateTime(), "max_retries": integer(), "backoff": str(), "base_delay_seconds": integer(), "max_delay_seconds": integer()}),
+		"BulkRequest":     requestSchema(bulkRequest{}, "action", "filter"),
+		"BulkStarted":     object(map[string]interface{}{"operation_id": integer(), "job_id": integer(), "status": str()}),
+		"ScheduleRequest": requestSchema(scheduleRequest{}, "cron", "job"),
+		"WorkflowStatus":  object(map[string]interface{}{"workflow_id": integer(), "status": str()}),
+		"Error":           map[string]interface{}{"type": "string", "description": "One line of plain text"},
+	}
+	for name, v := range apiTypes {
+		schemas[name] = schemaOf(reflect.TypeOf(v), true)
+	}
+	for _, t := range jobs.Types() {
+		if s, ok := jobs.PayloadSchema(t.Name); ok {
+			schemas[payloadSchemaName(t.Name)] = s
+		}
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.1.0",
+		"info": map[string]interface{}{
+			"title":   "GoFlow",
+			"version": "1",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas":   schemas,
+			"responses": errorResponses(),
+			"securitySchemes": map[string]interface{}{
+				"bearer": map[string]interface{}{"type": "http", "scheme": "bearer"},
+				"apiKey": map[string]interface{}{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+			},
+		},
+		"security": []interface{}{
+			map[string]interface{}{"bearer": []string{}},
+			map[string]interface{}{"apiKey": []string{}},
+		},
+	}
+}
+
+var pathParam = regexp.MustCompile(`\{(\w+)\}`)
+
+func (op apiOperation) document() map[string]interface{} {
+
+	var params []interface{}
+	for _, m := range pathParam.FindAllStringSubmatch(op.path, -1) {
+		schema := str()
+		if m[1] == "id" && !strings.HasPrefix(op.path, "/batches/") {
+			schema = integer()
+		}
+		params = append(params, map[string]interface{}{"name": m[1], "in": "path", "required": true, "schema": schema})
+	}
+	for _, p := range op.query {
+		param := map[string]interface{}{"name": p.name, "in": "query", "schema": p.schema, "description": p.description}
+		if _, ok := p.schema.(map[string]interface{})["items"]; ok {
+			param["explode"] = true
+		}
+		params = append(params, param)
+	}
+	if op.method == "post" && op.path == "/jobs" {
+		params = append(params, map[string]interface{}{
+			"name": "Idempotency-Key", "in": "header", "schema": str(),
+			"description": "Replays the first response to a retried request",
+		}, map[string]interface{}{
+			"name": "X-GoFlow-Signature", "in": "header", "schema": str(),
+			"description": "sha256=<hex HMAC-SHA256 of \"<timestamp>.<body>\"> with a signing key, instead of an API key",
+		}, map[string]interface{}{
+			"name": "X-GoFlow-Timestamp", "in": "header", "schema": integer(),
+			"description": "Unix time the request was signed",
+		})
+	}
+
+	responses := map[string]interface{}{}
+	success := map[string]interface{}{"description": http.StatusText(op.status)}
+	switch result := op.result.(type) {
+	case nil:
+	case string:
+		success["content"] = map[string]interface{}{result: map[string]interface{}{"schema": str()}}
+	default:
+		success["content"] = map[string]interface{}{"application/json": map[string]interface{}{"schema": result}}
+	}
+	responses[strconv.Itoa(op.status)] = success
+
+	errors := op.errors
+	if !isPublic(op.path) {
+		errors = append([]int{401}, errors...)
+	}
+	if op.status != 101 {
+		errors = append(errors, 500)
+	}
+	for _, code := range errors {
+		responses[strconv.Itoa(code)] = ref(strconv.Itoa(code), "responses")
+	}
+
+	doc := map[string]interface{}{
+		"summary":     op.summary,
+		"operationId": operationID(op.method, op.path),
+		"responses":   responses,
+	}
+	if len(params) > 0 {
+		doc["parameters"] = params
+	}
+	if op.body != nil {
+		doc["requestBody"] = map[string]interface{}{
+			"required": !op.optional,
+			"content":  map[string]interface{}{"application/json": map[string]interface{}{"schema": op.body}},
+		}
+	}
+	if isPublic(op.path) {
+		doc["security"] = []interface{}{}
+	}
+	return doc
+}
+
+// errorResponses are the shared error responses. Every error is written
+// by http.Error, as one line of text.
+func errorResponses() map[string]interface{} {
+
+	responses := map[string]interface{}{}
+	for _, code := range []int{400, 401, 403, 404, 409, 413, 422, 429, 500, 503} {
+		resp := map[string]interface{}{
+			"description": http.StatusText(code),
+			"content": map[string]interface{}{
+				"text/plain": map[string]interface{}{"schema": ref("Error")},
+			},
+		}
+		if code == 429 {
+			resp["headers"] = map[string]interface{}{
+				"Retry-After": map[string]interface{}{"description": "Seconds to wait", "schema": integer()},
+			}
+		}
+		responses[strconv.Itoa(code)] = resp
+	}
+	return responses
+}
+
+// jobRequestSchema is the body of POST /jobs. The payload of a built-in
+// type is checked against the type's payload schema.
+func jobRequestSchema() map[string]interface{} {
+
+	s := requestSchema(Job{}, "type")
+	props := s["properties"].(map[string]interface{})
+	for _, serverSet := range []string{"id", "status", "tenant_id"} {
+		delete(props, serverSet)
+	}
+	props["on_conflict"] = enum("reject", "coalesce", "replace")
+	props["type"] = map[string]interface{}{"type": "string", "description": "A job type from GET /job-types"}
+
+	var byType []interface{}
+	for _, t := range jobs.Types() {
+		if _, ok := jobs.PayloadSchema(t.Name); !ok {
+			continue
+		}
+		byType = append(byType, map[string]interface{}{
+			"if": map[string]interface{}{
+				"properties": map[string]interface{}{"type": map[string]interface{}{"const": t.Name}},
+				"required":   []string{"type"},
+			},
+			"then": map[string]interface{}{
+				"properties": map[string]interface{}{"payload": ref(payloadSchemaName(t.Name))},
+				"required":   []string{"payload"},
+			},
+		})
+	}
+	if len(byType) > 0 {
+		s["allOf"] = byType
+	}
+	return s
+}
+
+// jobRecordSchema is a job as GET /jobs/{id} returns it: the fields in
+// jobFields, or those picked with ?fields= and ?include=.
+func jobRecordSchema() map[string]interface{} {
+
+	job := schemaOf(reflect.TypeOf(Job{}), false)["properties"].(map[string]interface{})
+
+	extra := map[string]interface{}{
+		"retry_count":       integer(),
+		"last_error":        nullable(str()),
+		"attempt_errors":    arrayOf(object(nil)),
+		"response_status":   nullable(integer()),
+		"response_body":     map[string]interface{}{},
+		"execution_time_ms": nullable(integer()),
+		"created_at":        dateTime(),
+		"updated_at":        dateTime(),
+	}
+
+	props := map[string]interface{}{}
+	for _, f := range jobFields {
+		if s, ok := job[f]; ok {
+			props[f] = s
+		} else if s, ok := extra[f]; ok {
+			props[f] = s
+		}
+	}
+	return object(props)
+}
+
+// payloadSchemaName names a job type's payload schema: send_email is
+// SendEmailPayload.
+func payloadSchemaName(jobType string) string {
+	var b strings.Builder
+	for _, part := range strings.Split(jobType, "_") {
+		if part != "" {
+			b.WriteString(strings.ToUpper(part[:1]) + part[1:])
+		}
+	}
+	return b.String() + "Payload"
+}
+
+// operationID names an operation for generated clients, e.g.
+// get_jobs_id_logs.
+func operationID(method, path string) string {
+	name := strings.NewReplacer("{", "", "}", "", ".", "_", "-", "_").Replace(path)
+	return method + strings.ReplaceAll(name, "/", "_")
+}
+
+// ==================== SCHEMAS ====================
+
+var timeType = reflect.TypeOf(time.Time{})
+var rawType = reflect.TypeOf(json.RawMessage{})
+
+// schemaOf describes t from its json tags. With required, fields without
+// omitempty are required, as they always are in a response.
+func schemaOf(t reflect.Type, required bool) map[string]interface{} {
+
+	switch {
+	case t == timeType:
+		return dateTime()
+	case t == rawType, t.Kind() == reflect.Interface:
+		return map[string]interface{}{}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return nullable(schemaOf(t.Elem(), required))
+	case reflect.String:
+		return str()
+	case reflect.Bool:
+		return boolean()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return integer()
+	case reflect.Float32, reflect.Float64:
+		return number()
+	case reflect.Slice, reflect.Array:
+		return arrayOf(schemaOf(t.Elem(), required))
+	case reflect.Map:
+		return mapOf(schemaOf(t.Elem(), required))
+	case reflect.Struct:
+	default:
+		return map[string]interface{}{}
+	}
+
+	props := map[string]interface{}{}
+	var names []string
+	addFields(t, required, props, &names)
+	return object(props, names...)
+}
+
+func addFields(t reflect.Type, required bool, props map[string]interface{}, names *[]string) {
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+
+		tag := f.Tag.Get("json")
+		if tag == "-" || (!f.IsExported() && !f.Anonymous) {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			addFields(f.Type, required, props, names)
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+
+		props[name] = schemaOf(f.Type, required)
+		if required && !strings.Contains(opts, "omitempty") {
+			*names = append(*names, name)
+		}
+	}
+}
+
+// requestSchema describes a request body type, which only needs the
+// fields listed.
+func requestSchema(v interface{}, required ...string) map[string]interface{} {
+	s := schemaOf(reflect.TypeOf(v), false)
+	if len(required) > 0 {
+		s["required"] = required
+	}
+	return s
+}
+
+func object(props map[string]interface{}, required ...string) map[string]interface{} {
+	s := map[string]interface{}{"type": "object"}
+	if props != nil {
+		s["properties"] = props
+	}
+	if len(required) > 0 {
+		sort.Strings(required)
+		s["required"] = required
+	}
+	return s
+}
+
+func ref(name string, section ...string) map[string]interface{} {
+	kind := "schemas"
+	if len(section) > 0 {
+		kind = section[0]
+	}
+	return map[string]interface{}{"$ref": "#/components/" + kind + "/" + name}
+}
+
+func nullable(s map[string]interface{}) map[string]interface{} {
+	if t, ok := s["type"].(string); ok {
+		out := map[string]interface{}{}
+		for k, v := range s {
+			out[k] = v
+		}
+		out["type"] = []string{t, "null"}
+		return out
+	}
+	return map[string]interface{}{"anyOf": []interface{}{s, map[string]interface{}{"type": "null"}}}
+}
+
+func arrayOf(items map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"type": "array", "items": items}
+}
+
+func mapOf(values map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"type": "object", "additionalProperties": values}
+}
+
+func enum(values ...string) map[string]interface{} {
+	return map[string]interface{}{"type": "string", "enum": values}
+}
+
+func str() map[string]interface{}     { return map[string]interface{}{"type": "string"} }
+func integer() map[string]interface{} { return map[string]interface{}{"type": "integer"} }
+func number() map[string]interface{}  { return map[string]interface{}{"type": "number"} }
+func boolean() map[string]interface{} { return map[string]interface{}{"type": "boolean"} }
+func dateTime() map[string]interface{} {
+	return map[string]interface{}{"type": "string", "format": "date-time"}
+}
@@ -0,0 +1,254 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"goflow/jobs"
+)
+
+// ==================== OUTBOX ====================
+
+const (
+	outboxMaxAttempts = 10
+	outboxLease       = 30 * time.Second
+)
+
+type outboxEntry struct {
+	ID         int
+	DeliveryID string
+	JobID      int
+	TargetURL  string
+	Secret     string
+	Body       []byte
+	Attempts   int
+}
+
+// enqueueCallback records the auto callback for a finalized job inside tx,
+// so the notification is committed together with the job's final state.
+func enqueueCallback(tx *sql.Tx, jobID int, payload map[string]interface{}) error {
+
+	callbackURL, ok := payload["callback_url"].(string)
+	if !ok || callbackURL == "" {
+		return nil
+	}
+
+	secret, _ := payload["callback_secret"].(string)
+
+	var status string
+	var retryCount int
+	var responseBody []byte
+	var lastError *string
+
+	err := tx.QueryRow(`
+		SELECT status, retry_count, response_body, last_error
+		FROM jobs
+		WHERE id = $1
+	`, jobID).Scan(&status, &retryCount, &responseBody, &lastError)
+
+	if err != nil {
+		return err
+	}
+
+	// The same final state of the same attempt always maps to the same
+	// delivery, so a job finalized twice after recovery notifies once.
+	deliveryID := fmt.Sprintf("callback-%d-%d-%s", jobID, retryCount, status)
+
+	body := map[string]interface{}{
+		"delivery_id": deliveryID,
+		"job_id":      jobID,
+		"status":      status,
+	}
+
+	if responseBody != nil {
+		var parsed interface{}
+		json.Unmarshal(responseBody, &parsed)
+		body["response"] = parsed
+	}
+
+	if lastError != nil {
+		body["error"] = *lastError
+	}
+
+	bodyBytes, _ := json.Marshal(body)
+
+	_, err = tx.Exec(`
+		INSERT INTO outbox (job_id, kind, target_url, secret, body, delivery_id)
+		VALUES ($1, 'callback', $2, $3, $4, $5)
+		ON CONFLICT (delivery_id) DO NOTHING
+	`, jobID, callbackURL, secret, bodyBytes, deliveryID)
+
+	return err
+}
+
+// claimOutboxEntry leases the oldest due entry. A worker that crashes while
+// sending simply lets the lease expire and the entry is picked up again.
+func claimOutboxEntry() (*outboxEntry, error) {
+
+	var e outboxEntry
+	var secret sql.NullString
+	var deliveryID sql.NullString
+
+	err := db.QueryRow(`
+		UPDATE outbox
+		SET attempts = attempts + 1,
+		    next_attempt_at = NOW() + ($1 || ' seconds')::interval
+		WHERE id = (
+			SELECT id FROM outbox
+			WHERE status = 'pending'
+			AND next_attempt_at <= NOW()
+			ORDER BY id
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, delivery_id, job_id, target_url, secret, body, attempts
+	`, int(outboxLease.Seconds())).Scan(&e.ID, &deliveryID, &e.JobID, &e.TargetURL, &secret, &e.Body, &e.Attempts)
+
+	if err != nil {
+		return nil, err
+	}
+
+	e.Secret = secret.String
+	e.DeliveryID = deliveryID.String
+	if e.DeliveryID == "" {
+		e.DeliveryID = fmt.Sprintf("outbox-%d", e.ID)
+	}
+	return &e, nil
+}
+
+func deliverOutboxEntry(e *outboxEntry) error {
+
+	// Already acknowledged by the receiver (e.g. the lease expired after a
+	// successful send) — do not deliver it again.
+	acked, _, _, err := jobs.DeliveryAcknowledged(context.Background(), e.DeliveryID)
+	if err != nil {
+		return err
+	}
+	if acked {
+		return nil
+	}
+
+	req, err := http.NewRequest("POST", e.TargetURL, bytes.NewBuffer(e.Body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(jobs.DeliveryHeader, e.DeliveryID)
+
+	// callback_secret is stored as submitted: encrypted, a reference, or
+	// both
+	secret := e.Secret
+	if jobs.IsSecretRef(secret) || jobs.IsEncrypted(secret) {
+		var tenant string
+		if err := db.QueryRow(`SELECT tenant_id FROM jobs WHERE id = $1`, e.JobID).Scan(&tenant); err != nil {
+			return err
+		}
+		if secret, err = jobs.ResolveSecret(context.Background(), tenant, secret); err != nil {
+			return err
+		}
+	}
+
+	if secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(e.Body)
+		signature := hex.EncodeToString(mac.Sum(nil))
+		req.Header.Set("X-GoFlow-Signature", "sha256="+signature)
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("callback returned status %d", resp.StatusCode)
+	}
+
+	return jobs.RecordDelivery(context.Background(), e.DeliveryID, e.JobID, e.TargetURL, resp.StatusCode, nil)
+}
+
+func processOutboxEntry(e *outboxEntry) {
+
+	err := deliverOutboxEntry(e)
+	if err == nil {
+		_, err = db.Exec(`
+			UPDATE outbox
+			SET status = 'delivered',
+			    delivered_at = NOW(),
+			    last_error = NULL
+			WHERE id = $1
+		`, e.ID)
+
+		if err != nil {
+			slog.Error("Outbox delivered update failed", "outbox_id", e.ID, "error", err)
+		}
+
+		slog.Info("Auto callback sent", "job_id", e.JobID)
+		return
+	}
+
+	slog.Warn("Auto callback failed", "job_id", e.JobID, "attempt", e.Attempts, "error", err)
+
+	if e.Attempts >= outboxMaxAttempts {
+		_, err = db.Exec(`
+			UPDATE outbox
+			SET status = 'failed',
+			    last_error = $2
+			WHERE id = $1
+		`, e.ID, err.Error())
+	} else {
+		nextDelay := baseDelay * time.Duration(1<<(e.Attempts-1))
+		_, err = db.Exec(`
+			UPDATE outbox
+			SET last_error = $2,
+			    next_attempt_at = NOW() + ($3 || ' seconds')::interval
+			WHERE id = $1
+		`, e.ID, err.Error(), int(nextDelay.Seconds()))
+	}
+
+	if err != nil {
+		slog.Error("Outbox failure update failed", "outbox_id", e.ID, "error", err)
+	}
+}
+
+func startOutboxLoop(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info("Outbox loop shutting down")
+			return
+		default:
+		}
+
+		e, err := claimOutboxEntry()
+
+		if err == sql.ErrNoRows {
+			time.Sleep(time.Second)
+			continue
+		}
+
+		if err != nil {
+			slog.Error("Outbox claim failed", "error", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		processOutboxEntry(e)
+	}
+}
@@ -0,0 +1,281 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ==================== PAUSING CLAIMS ====================
+//
+// Operators can stop workers from claiming new jobs, everywhere or for one
+// job type or queue, during a deploy or an incident:
+//
+//	POST /admin/pause  {"queue": "scraper", "reason": "site down"}
+//	POST /admin/drain  {"wait_seconds": 60}
+//	POST /admin/resume {"queue": "scraper"}
+//
+// Pauses live in the database, so every server and agent honors them.
+// Jobs already running finish normally; paused jobs stay pending and keep
+// their place in the queue. Drain pauses too, then waits for the jobs in
+// the scope that are still processing.
+
+// notPausedSQL is the claim queries' condition on the candidate row, which
+// they call jobs.
+const notPausedSQL = `NOT EXISTS (
+	SELECT 1 FROM claim_pauses p
+	WHERE p.scope IN ('*', 'type:' || jobs.type, 'queue:' || jobs.queue)
+)`
+
+// drainWaitLimit bounds how long a drain request holds its connection.
+const drainWaitLimit = 5 * time.Minute
+
+type claimPause struct {
+	Type     string    `json:"type,omitempty"`
+	Queue    string    `json:"queue,omitempty"`
+	Reason   string    `json:"reason,omitempty"`
+	PausedAt time.Time `json:"paused_at"`
+}
+
+// scope is the key a pause is stored under: "*", "type:<type>" or
+// "queue:<queue>".
+func (p claimPause) scope() string {
+	switch {
+	case p.Type != "":
+		return "type:" + p.Type
+	case p.Queue != "":
+		return "queue:" + p.Queue
+	}
+	return "*"
+}
+
+func pauseFromScope(scope string) claimPause {
+	var p claimPause
+	if t, ok := strings.CutPrefix(scope, "type:"); ok {
+		p.Type = t
+	} else if q, ok := strings.CutPrefix(scope, "queue:"); ok {
+		p.Queue = q
+	}
+	return p
+}
+
+var errPauseScope = errors.New("give at most one of 'type' and 'queue'")
+
+// pauseRequest reads the body shared by the pause endpoints. An empty body
+// means every job.
+func pauseRequest(r *http.Request) (claimPause, int, error) {
+
+	var req struct {
+		claimPause
+		WaitSeconds int `json:"wait_seconds"`
+	}
+
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return req.claimPause, 0, errors.New("Invalid JSON")
+		}
+	}
+
+	if req.Type != "" && req.Queue != "" {
+		return req.claimPause, 0, errPauseScope
+	}
+	if req.WaitSeconds < 0 {
+		return req.claimPause, 0, errors.New("'wait_seconds' must not be negative")
+	}
+
+	return req.claimPause, req.WaitSeconds, nil
+}
+
+// pauseClaims records p, or updates its reason if the scope is already
+// paused.
+func pauseClaims(p claimPause) (claimPause, error) {
+
+	err := db.QueryRow(`
+		INSERT INTO claim_pauses (scope, reason)
+		VALUES ($1, NULLIF($2, ''))
+		ON CONFLICT (scope) DO UPDATE SET reason = EXCLUDED.reason
+		RETURNING paused_at
+	`, p.scope(), p.Reason).Scan(&p.PausedAt)
+
+	if err == nil {
+		slog.Warn("Claims paused", "scope", p.scope(), "reason", p.Reason)
+	}
+	return p, err
+}
+
+// processingIn counts the jobs of p's scope that are still running.
+func processingIn(p claimPause) (int, error) {
+	var n int
+	err := db.QueryRow(`
+		SELECT COUNT(*) FROM jobs
+		WHERE status = 'processing'
+		AND ($1 = '' OR type = $1)
+		AND ($2 = '' OR queue = $2)
+	`, p.Type, p.Queue).Scan(&n)
+	return n, err
+}
+
+// requireAdmin answers 403 unless the request may use operator endpoints.
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if !isAdmin(r) {
+		http.Error(w, "Admin API key required", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// pauseHandler serves POST /admin/pause and, listing the current pauses,
+// GET /admin/pause.
+func pauseHandler(w http.ResponseWriter, r *http.Request) {
+
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	switch r.Method {
+
+	case http.MethodGet:
+		rows, err := db.Query(`
+			SELECT scope, COALESCE(reason, ''), paused_at
+			FROM claim_pauses
+			ORDER BY paused_at
+		`)
+		if err != nil {
+			http.Error(w, "Query failed", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		pauses := []claimPause{}
+		for rows.Next() {
+			var scope, reason string
+			var pausedAt time.Time
+			if err := rows.Scan(&scope, &reason, &pausedAt); err != nil {
+				http.Error(w, "Scan failed", http.StatusInternalServerError)
+				return
+			}
+			p := pauseFromScope(scope)
+			p.Reason, p.PausedAt = reason, pausedAt
+			pauses = append(pauses, p)
+		}
+
+		json.NewEncoder(w).Encode(pauses)
+
+	case http.MethodPost:
+		p, _, err := pauseRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		p, err = pauseClaims(p)
+		if err != nil {
+			http.Error(w, "Pause failed", http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(p)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// resumeHandler serves POST /admin/resume, lifting the pause of exactly
+// the given scope.
+func resumeHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	p, _, err := pauseRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	res, err := db.Exec(`DELETE FROM claim_pauses WHERE scope = $1`, p.scope())
+	if err != nil {
+		http.Error(w, "Resume failed", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Not paused", http.StatusNotFound)
+		return
+	}
+
+	slog.Info("Claims resumed", "scope", p.scope())
+
+	// Wake idle workers everywhere instead of leaving them to their poll
+	db.Exec(`SELECT pg_notify($1, '')`, jobsChannel)
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"resumed": true,
+		"type":    p.Type,
+		"queue":   p.Queue,
+	})
+}
+
+// drainHandler serves POST /admin/drain: it pauses the scope, then waits
+// up to wait_seconds for its running jobs to finish.
+func drainHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	p, waitSeconds, err := pauseRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	p, err = pauseClaims(p)
+	if err != nil {
+		http.Error(w, "Pause failed", http.StatusInternalServerError)
+		return
+	}
+
+	deadline := time.Now().Add(min(time.Duration(waitSeconds)*time.Second, drainWaitLimit))
+
+	var processing int
+	for {
+		processing, err = processingIn(p)
+		if err != nil {
+			http.Error(w, "Query failed", http.StatusInternalServerError)
+			return
+		}
+		if processing == 0 || !time.Now().Before(deadline) {
+			break
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"type":       p.Type,
+		"queue":      p.Queue,
+		"reason":     p.Reason,
+		"paused_at":  p.PausedAt,
+		"processing": processing,
+		"drained":    processing == 0,
+	})
+}
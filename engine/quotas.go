@@ -0,0 +1,228 @@
+package engine
+
+import (
+	"database/sql"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ==================== RATE LIMITS AND QUOTAS ====================
+//
+// Each API key or signing key can limit how fast and how much it submits
+// through POST /jobs:
+//
+//	api_keys:
+//	  - { key: "s3cret", tenant: billing, rate_limit: 5, burst: 20, daily_quota: 10000, monthly_quota: 200000 }
+//
+// rate_limit is a token bucket of jobs per second, kept in memory by each
+// server. Quotas are counted in api_key_usage per UTC day and month, so
+// they hold across servers. Either limit answers 429 with Retry-After.
+// Every accepted submission counts; rejected ones are given back.
+// GET /usage reports the calling key's limits and what it has used.
+
+// submitBuckets holds each key's token bucket, by key name.
+var submitBuckets = struct {
+	sync.Mutex
+	tokens map[string]float64
+	last   map[string]time.Time
+}{tokens: make(map[string]float64), last: make(map[string]time.Time)}
+
+// takeToken spends one of the key's tokens. Without one it returns how
+// long until the next is available.
+func takeToken(k APIKey, now time.Time) (time.Duration, bool) {
+
+	if k.RateLimit == 0 {
+		return 0, true
+	}
+
+	burst := float64(bucketSize(k))
+
+	submitBuckets.Lock()
+	defer submitBuckets.Unlock()
+
+	tokens, ok := submitBuckets.tokens[k.Name]
+	if !ok {
+		tokens = burst
+	} else {
+		tokens = math.Min(burst, tokens+now.Sub(submitBuckets.last[k.Name]).Seconds()*k.RateLimit)
+	}
+	submitBuckets.last[k.Name] = now
+
+	if tokens < 1 {
+		submitBuckets.tokens[k.Name] = tokens
+		return time.Duration((1 - tokens) / k.RateLimit * float64(time.Second)), false
+	}
+
+	submitBuckets.tokens[k.Name] = tokens - 1
+	return 0, true
+}
+
+// bucketSize is the key's burst, or a second's worth of jobs when unset.
+func bucketSize(k APIKey) int {
+	if k.Burst > 0 {
+		return k.Burst
+	}
+	return int(math.Max(1, math.Ceil(k.RateLimit)))
+}
+
+// quotaPeriod is one quota window of a key.
+type quotaPeriod struct {
+	name   string // api_key_usage.period
+	limit  int
+	resets time.Time
+}
+
+func quotaPeriods(k APIKey, now time.Time) []quotaPeriod {
+	now = now.UTC()
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	return []quotaPeriod{
+		{day.Format("2006-01-02"), k.DailyQuota, day.AddDate(0, 0, 1)},
+		{month.Format("2006-01"), k.MonthlyQuota, month.AddDate(0, 1, 0)},
+	}
+}
+
+// reserveQuota counts one job against the key's day and month. When a
+// quota is used up nothing is counted, and it returns when that quota
+// resets.
+func reserveQuota(k APIKey, now time.Time) (time.Time, bool, error) {
+
+	tx, err := db.Begin()
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	defer tx.Rollback()
+
+	for _, p := range quotaPeriods(k, now) {
+		var used int
+		err := tx.QueryRow(`
+			INSERT INTO api_key_usage (key_name, period, jobs)
+			VALUES ($1, $2, 1)
+			ON CONFLICT (key_name, period) DO UPDATE SET jobs = api_key_usage.jobs + 1
+			WHERE $3 = 0 OR api_key_usage.jobs < $3
+			RETURNING jobs
+		`, k.Name, p.name, p.limit).Scan(&used)
+		if err == sql.ErrNoRows {
+			return p.resets, false, nil
+		}
+		if err != nil {
+			return time.Time{}, false, err
+		}
+	}
+
+	return time.Time{}, true, tx.Commit()
+}
+
+// releaseQuota gives back a job reserved for a submission that failed.
+func releaseQuota(k APIKey, now time.Time) {
+	periods := quotaPeriods(k, now)
+	db.Exec(`
+		UPDATE api_key_usage
+		SET jobs = jobs - 1
+		WHERE key_name = $1 AND period IN ($2, $3) AND jobs > 0
+	`, k.Name, periods[0].name, periods[1].name)
+}
+
+// withSubmitLimits applies the calling key's rate limit and quotas to
+// POST requests. Requests without a key go straight through.
+func withSubmitLimits(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		k, ok := apiKeyOf(r)
+		if !ok || r.Method != http.MethodPost {
+			next(w, r)
+			return
+		}
+
+		now := time.Now()
+
+		if wait, ok := takeToken(k, now); !ok {
+			w.Header().Set("Retry-After", retryAfter(wait))
+			http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+
+		resets, ok, err := reserveQuota(k, now)
+		if err != nil {
+			http.Error(w, "Quota check failed", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			w.Header().Set("Retry-After", retryAfter(resets.Sub(now)))
+			http.Error(w, "Job quota exceeded until "+resets.Format(time.RFC3339), http.StatusTooManyRequests)
+			return
+		}
+
+		rw := &recordingWriter{ResponseWriter: w}
+		next(rw, r)
+		if rw.status >= 300 {
+			releaseQuota(k, now)
+		}
+	}
+}
+
+// retryAfter formats a wait as whole seconds, rounded up.
+func retryAfter(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+type quotaUsage struct {
+	Used     int       `json:"used"`
+	Limit    *int      `json:"limit"`
+	ResetsAt time.Time `json:"resets_at"`
+}
+
+// usageHandler serves GET /usage: the calling key's limits and how much
+// of its quotas it has used. A null limit is unlimited.
+func usageHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	k, ok := apiKeyOf(r)
+	if !ok {
+		http.Error(w, "Usage is tracked per API key, and none are configured", http.StatusNotFound)
+		return
+	}
+
+	periods := quotaPeriods(k, time.Now())
+	usage := make([]quotaUsage, len(periods))
+
+	for i, p := range periods {
+		err := db.QueryRow(`
+			SELECT jobs FROM api_key_usage WHERE key_name = $1 AND period = $2
+		`, k.Name, p.name).Scan(&usage[i].Used)
+		if err != nil && err != sql.ErrNoRows {
+			http.Error(w, "Query failed", http.StatusInternalServerError)
+			return
+		}
+		if p.limit > 0 {
+			limit := p.limit
+			usage[i].Limit = &limit
+		}
+		usage[i].ResetsAt = p.resets
+	}
+
+	var rateLimit *float64
+	var burst *int
+	if k.RateLimit > 0 {
+		b := bucketSize(k)
+		rateLimit, burst = &k.RateLimit, &b
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"key":        k.Name,
+		"tenant":     k.Tenant,
+		"rate_limit": rateLimit,
+		"burst":      burst,
+		"daily":      usage[0],
+		"monthly":    usage[1],
+	})
+}
@@ -0,0 +1,201 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ==================== RETENTION ====================
+//
+// Finished jobs pile up in the jobs table, which every claim query works
+// on. With a retention window, the janitor deletes jobs that finished
+// longer ago than that:
+//
+//	retention: 720h
+//	retention_by_type:
+//	  uptime_check: 24h
+//	  generate_report: 0s
+//
+// A type's own window replaces the default one; 0 keeps its jobs forever.
+// Jobs whose callback is still in the outbox, or that belong to a declared
+// batch that has not completed, are kept until that is done. Dead-letter
+// entries are kept either way. With archive: true, jobs are moved to
+// jobs_archive instead (see archive.go).
+
+// retainedStatuses are the final states the janitor may delete.
+var retainedStatuses = []string{"completed", "failed", "cancelled", "expired"}
+
+const janitorInterval = time.Minute
+
+func startJanitorLoop(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	ticker := time.NewTicker(janitorInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info("Janitor loop shutting down")
+			return
+		case <-ticker.C:
+			runJanitor(ctx)
+		}
+	}
+}
+
+// runJanitor applies the configured retention windows to every tenant.
+func runJanitor(ctx context.Context) {
+
+	var ownWindow []string
+
+	for jobType, window := range cfg.RetentionByType {
+		ownWindow = append(ownWindow, jobType)
+		if window <= 0 {
+			continue
+		}
+
+		n, err := purgeJobs(ctx, purgeScope{Type: jobType, OlderThan: window})
+		if err != nil {
+			slog.Error("Job purge failed", "job_type", jobType, "error", err)
+			continue
+		}
+		if n > 0 {
+			slog.Info("Purged old jobs", "job_type", jobType, "count", n)
+		}
+	}
+
+	if cfg.Retention > 0 {
+		n, err := purgeJobs(ctx, purgeScope{OlderThan: cfg.Retention, ExceptTypes: ownWindow})
+		if err != nil {
+			slog.Error("Job purge failed", "error", err)
+		} else if n > 0 {
+			slog.Info("Purged old jobs", "count", n)
+		}
+	}
+
+	if cfg.ArchiveRetention > 0 {
+		n, err := pruneArchive(ctx)
+		if err != nil {
+			slog.Error("Archive cleanup failed", "error", err)
+		} else if n > 0 {
+			slog.Info("Deleted archived jobs", "count", n)
+		}
+	}
+}
+
+// purgeScope selects the finished jobs to delete. Empty fields match
+// everything.
+type purgeScope struct {
+	Tenant      string
+	Type        string
+	ExceptTypes []string
+	OlderThan   time.Duration
+}
+
+// purgeJobs deletes, or archives, the finished jobs in scope, bulkBatchSize
+// at a time so no single statement holds many locks, and returns how many
+// it removed from jobs.
+func purgeJobs(ctx context.Context, s purgeScope) (int, error) {
+
+	if s.ExceptTypes == nil {
+		s.ExceptTypes = []string{}
+	}
+
+	total := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return total, err
+		}
+
+		purge := `
+			DELETE FROM jobs
+			WHERE id IN (
+				SELECT id FROM jobs
+				WHERE status = ANY($1)
+				AND updated_at < NOW() - make_interval(secs => $2)
+				AND ($3 = '' OR tenant_id = $3)
+				AND ($4 = '' OR type = $4)
+				AND type <> ALL($5)
+				AND NOT EXISTS (
+					SELECT 1 FROM outbox o
+					WHERE o.job_id = jobs.id AND o.status = 'pending'
+				)
+				AND NOT EXISTS (
+					SELECT 1 FROM batches b
+					WHERE b.tenant_id = jobs.tenant_id AND b.id = jobs.batch_id
+					AND b.completed_at IS NULL
+				)
+				LIMIT ` + strconv.Itoa(bulkBatchSize) + `
+				FOR UPDATE SKIP LOCKED
+			)
+		`
+		if cfg.Archive {
+			purge = moveToArchive(purge)
+		} else {
+			purge = withoutHistory(purge)
+		}
+
+		var n int
+		err := db.QueryRowContext(ctx, purge, pq.Array(retainedStatuses), s.OlderThan.Seconds(), s.Tenant, s.Type, pq.Array(s.ExceptTypes)).Scan(&n)
+		if err != nil {
+			return total, err
+		}
+
+		total += n
+		if n < bulkBatchSize {
+			return total, nil
+		}
+	}
+}
+
+// purgeHandler serves POST /admin/purge, deleting or archiving the
+// tenant's finished jobs older than older_than_seconds at once instead of
+// waiting for the janitor.
+func purgeHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		OlderThanSeconds *int   `json:"older_than_seconds"`
+		Type             string `json:"type"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if req.OlderThanSeconds == nil || *req.OlderThanSeconds < 0 {
+		http.Error(w, "'older_than_seconds' is required and must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	olderThan := time.Duration(*req.OlderThanSeconds) * time.Second
+
+	n, err := purgeJobs(r.Context(), purgeScope{Tenant: tenantOf(r), Type: req.Type, OlderThan: olderThan})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Purge failed after %d jobs", n), http.StatusInternalServerError)
+		return
+	}
+
+	result := "deleted"
+	if cfg.Archive {
+		result = "archived"
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		result: n,
+	})
+}
@@ -0,0 +1,645 @@
+package engine
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"goflow/jobs"
+	"goflow/routing"
+
+	"github.com/lib/pq"
+)
+
+// ==================== SCHEDULES ====================
+//
+// A schedule submits its job template every time its cron expression
+// fires. The scheduler loop materializes due runs as ordinary jobs, so a
+// run that fails is retried and dead-lettered like any other job while
+// the schedule itself carries on.
+//
+//	POST /schedules
+//	{"name": "nightly-report", "cron": "0 2 * * *", "timezone": "Europe/Berlin",
+//	 "job": {"type": "generate_report", "payload": {...}}}
+//
+// Runs missed while no server was up are not made up: the first tick
+// afterwards submits one run and moves on to the next future time.
+
+// Overlap policies: what a run does while the schedule's previous job is
+// still pending or processing.
+const (
+	overlapAllow = "allow" // submit it anyway
+	overlapSkip  = "skip"  // drop it and wait for the next time
+	overlapQueue = "queue" // hold it until the previous job finishes
+)
+
+const maxPreviewRuns = 100
+
+// Schedule is a recurring job definition.
+type Schedule struct {
+	ID       int         `json:"id"`
+	Name     string      `json:"name,omitempty"`
+	Cron     string      `json:"cron"`
+	Timezone string      `json:"timezone"`
+	Job      scheduleJob `json:"job"`
+	Enabled  bool        `json:"enabled"`
+	Overlap  string      `json:"overlap"`
+
+	// NextRunAt is null while the schedule is paused
+	NextRunAt *time.Time `json:"next_run_at"`
+	LastRunAt *time.Time `json:"last_run_at"`
+	LastJobID *int       `json:"last_job_id"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+// scheduleJob is the job a schedule submits on every run.
+type scheduleJob struct {
+	Type      string                 `json:"type"`
+	Payload   map[string]interface{} `json:"payload"`
+	Queue     string                 `json:"queue"`
+	Tags      []string               `json:"tags"`
+	Priority  int                    `json:"priority"`
+	Sensitive []string               `json:"sensitive,omitempty"`
+}
+
+// redacted returns the schedule with encrypted payload values hidden.
+func (s Schedule) redacted() Schedule {
+	s.Job.Payload = jobs.RedactPayload(s.Job.Payload)
+	return s
+}
+
+// scheduleColumns is the column list scanSchedule expects.
+const scheduleColumns = `id, COALESCE(name, ''), cron, timezone, job_type, payload, queue, tags, priority, sensitive,
+	enabled, overlap, CASE WHEN enabled THEN next_run_at END, last_run_at, last_job_id, created_at, updated_at`
+
+func scanSchedule(row rowScanner) (Schedule, error) {
+
+	var s Schedule
+	var payloadBytes []byte
+
+	err := row.Scan(&s.ID, &s.Name, &s.Cron, &s.Timezone, &s.Job.Type, &payloadBytes, &s.Job.Queue,
+		pq.Array(&s.Job.Tags), &s.Job.Priority, pq.Array(&s.Job.Sensitive),
+		&s.Enabled, &s.Overlap, &s.NextRunAt, &s.LastRunAt, &s.LastJobID, &s.CreatedAt, &s.UpdatedAt)
+	if err != nil {
+		return s, err
+	}
+
+	if s.Job.Tags == nil {
+		s.Job.Tags = []string{}
+	}
+
+	return s, json.Unmarshal(payloadBytes, &s.Job.Payload)
+}
+
+// scheduleRequest is the body of POST /schedules and PUT /schedules/{id}.
+type scheduleRequest struct {
+	Name     string      `json:"name"`
+	Cron     string      `json:"cron"`
+	Timezone string      `json:"timezone"`
+	Job      scheduleJob `json:"job"`
+	Enabled  *bool       `json:"enabled"`
+	Overlap  string      `json:"overlap"`
+}
+
+// prepare validates the request the way submitJob validates a job and
+// returns the schedule's first run after now.
+func (req *scheduleRequest) prepare(now time.Time) (time.Time, error) {
+
+	if req.Cron == "" {
+		return time.Time{}, errors.New("'cron' is required")
+	}
+	if req.Timezone == "" {
+		req.Timezone = "UTC"
+	}
+
+	schedule, loc, err := jobs.ParseCron(req.Cron, req.Timezone)
+	if err != nil {
+		return time.Time{}, err
+	}
+	next := schedule.Next(now.In(loc))
+	if next.IsZero() {
+		return time.Time{}, errors.New("'cron' never fires")
+	}
+
+	switch req.Overlap {
+	case "":
+		req.Overlap = overlapAllow
+	case overlapAllow, overlapSkip, overlapQueue:
+	default:
+		return time.Time{}, errors.New("'overlap' must be allow, skip or queue")
+	}
+
+	job := &req.Job
+	if job.Type == "" {
+		return time.Time{}, errors.New("'job.type' is required")
+	}
+	if _, ok := internalExecutors[job.Type]; ok {
+		return time.Time{}, errors.New(job.Type + " is an internal job type")
+	}
+	if job.Payload == nil {
+		job.Payload = map[string]interface{}{}
+	}
+	if err := jobs.ValidatePayload(job.Type, job.Payload); err != nil {
+		return time.Time{}, err
+	}
+	if err := validateHooks(job.Payload); err != nil {
+		return time.Time{}, err
+	}
+
+	job.Queue = routing.GroupFor(job.Type, job.Payload, job.Queue)
+
+	if job.Tags == nil {
+		job.Tags = []string{}
+	}
+	for _, tag := range job.Tags {
+		if strings.TrimSpace(tag) == "" {
+			return time.Time{}, errors.New("Tags must not be empty")
+		}
+	}
+
+	return next, nil
+}
+
+// schedulesHandler serves GET and POST /schedules. GET takes
+// ?enabled=true|false to list only running or paused schedules.
+func schedulesHandler(w http.ResponseWriter, r *http.Request) {
+
+	tenant := tenantOf(r)
+
+	switch r.Method {
+
+	case http.MethodGet:
+		var enabled *bool
+		if v := r.URL.Query().Get("enabled"); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				http.Error(w, "'enabled' must be true or false", http.StatusBadRequest)
+				return
+			}
+			enabled = &b
+		}
+
+		rows, err := db.Query(`
+			SELECT `+scheduleColumns+`
+			FROM schedules
+			WHERE tenant_id = $1 AND ($2::boolean IS NULL OR enabled = $2)
+			ORDER BY id
+		`, tenant, enabled)
+		if err != nil {
+			http.Error(w, "Query failed", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		schedules := []Schedule{}
+		for rows.Next() {
+			s, err := scanSchedule(rows)
+			if err != nil {
+				http.Error(w, "Scan failed", http.StatusInternalServerError)
+				return
+			}
+			schedules = append(schedules, s.redacted())
+		}
+
+		json.NewEncoder(w).Encode(schedules)
+
+	case http.MethodPost:
+		var req scheduleRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+
+		now, err := jobs.SchedulerClock.Now(r.Context())
+		if err != nil {
+			http.Error(w, "Clock unavailable", http.StatusInternalServerError)
+			return
+		}
+
+		next, err := req.prepare(now)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !encryptSensitive(w, req.Job.Payload, req.Job.Sensitive) {
+			return
+		}
+
+		payloadJSON, err := json.Marshal(req.Job.Payload)
+		if err != nil {
+			http.Error(w, "Payload error", http.StatusInternalServerError)
+			return
+		}
+
+		enabled := req.Enabled == nil || *req.Enabled
+
+		s, err := scanSchedule(db.QueryRow(`
+			INSERT INTO schedules (tenant_id, name, cron, timezone, job_type, payload, queue, tags, priority, sensitive, enabled, next_run_at, overlap)
+			VALUES ($1, NULLIF($2, ''), $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+			RETURNING `+scheduleColumns,
+			tenant, req.Name, req.Cron, req.Timezone, req.Job.Type, payloadJSON, req.Job.Queue,
+			pq.Array(req.Job.Tags), req.Job.Priority, pq.Array(req.Job.Sensitive), enabled, next, req.Overlap))
+		if err != nil {
+			http.Error(w, "Insert failed", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(s.redacted())
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// scheduleDetailHandler serves GET, PUT, PATCH and DELETE
+// /schedules/{id}. PUT replaces the definition and computes the next run
+// from the new expression. PATCH {"enabled": false} pauses the schedule
+// and {"enabled": true} resumes it from its next future time; runs that
+// fell due while it was paused are skipped. DELETE removes it; jobs it
+// already submitted are left alone.
+func scheduleDetailHandler(w http.ResponseWriter, r *http.Request) {
+
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/schedules/"))
+	if err != nil {
+		http.Error(w, "Invalid schedule id", http.StatusBadRequest)
+		return
+	}
+
+	tenant := tenantOf(r)
+
+	switch r.Method {
+
+	case http.MethodGet:
+		s, err := scanSchedule(db.QueryRow(`
+			SELECT `+scheduleColumns+`
+			FROM schedules
+			WHERE id = $1 AND tenant_id = $2
+		`, id, tenant))
+		if err == sql.ErrNoRows {
+			http.Error(w, "Schedule not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Query failed", http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(s.redacted())
+
+	case http.MethodPut:
+		var req scheduleRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+
+		now, err := jobs.SchedulerClock.Now(r.Context())
+		if err != nil {
+			http.Error(w, "Clock unavailable", http.StatusInternalServerError)
+			return
+		}
+
+		next, err := req.prepare(now)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !encryptSensitive(w, req.Job.Payload, req.Job.Sensitive) {
+			return
+		}
+
+		payloadJSON, err := json.Marshal(req.Job.Payload)
+		if err != nil {
+			http.Error(w, "Payload error", http.StatusInternalServerError)
+			return
+		}
+
+		// enabled is left as it was unless the body sets it
+		s, err := scanSchedule(db.QueryRow(`
+			UPDATE schedules SET
+				name = NULLIF($3, ''), cron = $4, timezone = $5, job_type = $6, payload = $7,
+				queue = $8, tags = $9, priority = $10, sensitive = $11,
+				enabled = COALESCE($12, enabled), next_run_at = $13, overlap = $14, updated_at = NOW()
+			WHERE id = $1 AND tenant_id = $2
+			RETURNING `+scheduleColumns,
+			id, tenant, req.Name, req.Cron, req.Timezone, req.Job.Type, payloadJSON, req.Job.Queue,
+			pq.Array(req.Job.Tags), req.Job.Priority, pq.Array(req.Job.Sensitive), req.Enabled, next, req.Overlap))
+		if err == sql.ErrNoRows {
+			http.Error(w, "Schedule not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Update failed", http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(s.redacted())
+
+	case http.MethodPatch:
+		var req struct {
+			Enabled *bool `json:"enabled"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if req.Enabled == nil {
+			http.Error(w, "'enabled' is required", http.StatusBadRequest)
+			return
+		}
+
+		s, err := setScheduleEnabled(r.Context(), id, tenant, *req.Enabled)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Schedule not found", http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, errScheduleNeverFires) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Update failed", http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(s.redacted())
+
+	case http.MethodDelete:
+		res, err := db.Exec(`DELETE FROM schedules WHERE id = $1 AND tenant_id = $2`, id, tenant)
+		if err != nil {
+			http.Error(w, "Delete failed", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "Schedule not found", http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+var errScheduleNeverFires = errors.New("schedule has no future runs")
+
+// setScheduleEnabled pauses or resumes a schedule. Resuming a paused
+// schedule moves next_run_at to the first run after now, so the loop does
+// not submit a run for time spent paused.
+func setScheduleEnabled(ctx context.Context, id int, tenant string, enabled bool) (Schedule, error) {
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return Schedule{}, err
+	}
+	defer tx.Rollback()
+
+	var expr, tz string
+	var wasEnabled bool
+	err = tx.QueryRow(`
+		SELECT cron, timezone, enabled
+		FROM schedules
+		WHERE id = $1 AND tenant_id = $2
+		FOR UPDATE
+	`, id, tenant).Scan(&expr, &tz, &wasEnabled)
+	if err != nil {
+		return Schedule{}, err
+	}
+
+	var next *time.Time
+	if enabled && !wasEnabled {
+		now, err := jobs.SchedulerClock.Now(ctx)
+		if err != nil {
+			return Schedule{}, err
+		}
+		schedule, loc, err := jobs.ParseCron(expr, tz)
+		if err != nil {
+			return Schedule{}, fmt.Errorf("%w: %v", errScheduleNeverFires, err)
+		}
+		n := schedule.Next(now.In(loc))
+		if n.IsZero() {
+			return Schedule{}, errScheduleNeverFires
+		}
+		next = &n
+	}
+
+	s, err := scanSchedule(tx.QueryRow(`
+		UPDATE schedules
+		SET enabled = $2, next_run_at = COALESCE($3, next_run_at), updated_at = NOW()
+		WHERE id = $1
+		RETURNING `+scheduleColumns,
+		id, enabled, next))
+	if err != nil {
+		return Schedule{}, err
+	}
+
+	return s, tx.Commit()
+}
+
+// startSchedulerLoop submits the runs of due schedules. Each run is
+// claimed with SKIP LOCKED, so any number of servers can run the loop.
+func startSchedulerLoop(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info("Scheduler loop shutting down")
+			return
+		case <-ticker.C:
+		}
+
+		for {
+			ran, err := runDueSchedule(ctx)
+			if err != nil {
+				slog.Error("Schedule run failed", "error", err)
+				break
+			}
+			if !ran {
+				break
+			}
+		}
+	}
+}
+
+// scheduleBusy is true while schedule s's last job has not finished.
+const scheduleBusy = `EXISTS (
+	SELECT 1 FROM jobs j
+	WHERE j.id = s.last_job_id AND j.status IN ('pending', 'processing')
+)`
+
+// runDueSchedule submits the run of one due schedule and moves it on to
+// its next time, in one transaction. It reports false when none are due.
+// A queued run stays due, and is not picked up, until the job before it
+// finishes; a skipped one only moves the schedule on.
+func runDueSchedule(ctx context.Context) (bool, error) {
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var (
+		id               int
+		tenant, expr, tz string
+		jobType, queue   string
+		overlap          string
+		busy             bool
+		payload          []byte
+		tags, sensitive  []string
+		priority         int
+		dueAt            time.Time
+	)
+
+	err = tx.QueryRow(`
+		SELECT s.id, s.tenant_id, s.cron, s.timezone, s.job_type, s.payload, s.queue, s.tags, s.priority, s.sensitive,
+			s.next_run_at, s.overlap, `+scheduleBusy+`
+		FROM schedules s
+		WHERE s.enabled AND s.next_run_at <= NOW()
+			AND (s.overlap <> 'queue' OR NOT `+scheduleBusy+`)
+		ORDER BY s.next_run_at
+		LIMIT 1
+		FOR UPDATE OF s SKIP LOCKED
+	`).Scan(&id, &tenant, &expr, &tz, &jobType, &payload, &queue, pq.Array(&tags), &priority, pq.Array(&sensitive), &dueAt, &overlap, &busy)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	now, err := jobs.SchedulerClock.Now(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	// Validated on save; a schedule that stops parsing (a timezone
+	// removed from tzdata) or never fires again is switched off.
+	schedule, loc, err := jobs.ParseCron(expr, tz)
+	var next time.Time
+	if err == nil {
+		next = schedule.Next(now.In(loc))
+	}
+	if next.IsZero() {
+		slog.Warn("Disabling schedule that no longer fires", "schedule_id", id, "cron", expr, "timezone", tz, "error", err)
+		_, err = tx.Exec(`UPDATE schedules SET enabled = FALSE, updated_at = NOW() WHERE id = $1`, id)
+		if err != nil {
+			return false, err
+		}
+		return true, tx.Commit()
+	}
+
+	if busy && overlap == overlapSkip {
+		_, err = tx.Exec(`UPDATE schedules SET next_run_at = $2, updated_at = NOW() WHERE id = $1`, id, next)
+		if err != nil {
+			return false, err
+		}
+		slog.Info("Schedule run skipped, previous job still running", "schedule_id", id, "next_run_at", next)
+		return true, tx.Commit()
+	}
+
+	if tags == nil {
+		tags = []string{}
+	}
+
+	var jobID int
+	err = tx.QueryRow(`
+		INSERT INTO jobs (type, payload, status, run_at, queue, tags, priority, tenant_id, sensitive)
+		VALUES ($1, $2, 'pending', $3, $4, $5, $6, $7, $8)
+		RETURNING id
+	`, jobType, payload, dueAt, queue, pq.Array(tags), priority, tenant, pq.Array(sensitive)).Scan(&jobID)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE schedules
+		SET next_run_at = $2, last_run_at = $3, last_job_id = $4, updated_at = NOW()
+		WHERE id = $1
+	`, id, next, dueAt, jobID)
+	if err != nil {
+		return false, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+
+	jobsEnqueued.WithLabelValues(jobType).Inc()
+	slog.Info("Schedule run submitted", "schedule_id", id, "job_id", jobID, "type", jobType, "next_run_at", next)
+	return true, nil
+}
+
+// schedulePreviewHandler serves POST /schedules/preview:
+//
+//	{"cron": "0 9 * * 1-5", "timezone": "America/New_York", "count": 5}
+//
+// It evaluates the expression exactly as the scheduler would.
+func schedulePreviewHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Cron     string     `json:"cron"`
+		Timezone string     `json:"timezone"`
+		Count    int        `json:"count"`
+		From     *time.Time `json:"from"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if req.Cron == "" {
+		http.Error(w, "'cron' is required", http.StatusBadRequest)
+		return
+	}
+
+	if req.Count <= 0 {
+		req.Count = 5
+	}
+	if req.Count > maxPreviewRuns {
+		req.Count = maxPreviewRuns
+	}
+
+	from := time.Now()
+	if req.From != nil {
+		from = *req.From
+	}
+
+	runs, err := jobs.PreviewCron(req.Cron, req.Timezone, from, req.Count)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	timezone := req.Timezone
+	if timezone == "" {
+		timezone = "UTC"
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"cron":      req.Cron,
+		"timezone":  timezone,
+		"next_runs": runs,
+	})
+}
@@ -0,0 +1,147 @@
+package engine
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"goflow/jobs"
+)
+
+// ==================== SECRETS ====================
+//
+// Credentials are stored once per tenant and referenced from payloads as
+// "secret://name" (see jobs/secrets.go), instead of travelling in every
+// job. Values are encrypted at rest with secrets_key and write-only: the
+// API lists names and dates, never values.
+//
+//	PUT    /secrets/openai_prod   {"value": "sk-..."}
+//	POST   /jobs                  {"type": "ai_prompt", "payload": {"api_key": "secret://openai_prod", ...}}
+
+var secretNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,128}$`)
+
+type secretInfo struct {
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// secretsHandler serves GET /secrets.
+func secretsHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT name, created_at, updated_at
+		FROM secrets
+		WHERE tenant_id = $1
+		ORDER BY name
+	`, tenantOf(r))
+	if err != nil {
+		http.Error(w, "Query failed", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	secrets := []secretInfo{}
+	for rows.Next() {
+		var s secretInfo
+		if err := rows.Scan(&s.Name, &s.CreatedAt, &s.UpdatedAt); err != nil {
+			http.Error(w, "Scan failed", http.StatusInternalServerError)
+			return
+		}
+		secrets = append(secrets, s)
+	}
+
+	json.NewEncoder(w).Encode(secrets)
+}
+
+// secretDetailHandler serves GET, PUT and DELETE /secrets/{name}.
+func secretDetailHandler(w http.ResponseWriter, r *http.Request) {
+
+	name := strings.TrimPrefix(r.URL.Path, "/secrets/")
+	if !secretNamePattern.MatchString(name) {
+		http.Error(w, "Secret names are 1-128 letters, digits, '_', '.' or '-'", http.StatusBadRequest)
+		return
+	}
+
+	tenant := tenantOf(r)
+
+	switch r.Method {
+
+	case http.MethodGet:
+		var s secretInfo
+		err := db.QueryRow(`
+			SELECT name, created_at, updated_at
+			FROM secrets
+			WHERE tenant_id = $1 AND name = $2
+		`, tenant, name).Scan(&s.Name, &s.CreatedAt, &s.UpdatedAt)
+		if err != nil {
+			http.Error(w, "Secret not found", http.StatusNotFound)
+			return
+		}
+
+		json.NewEncoder(w).Encode(s)
+
+	case http.MethodPut:
+		if !jobs.SecretsEnabled() {
+			http.Error(w, jobs.ErrNoSecretsKey.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		var req struct {
+			Value string `json:"value"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if req.Value == "" {
+			http.Error(w, "'value' is required", http.StatusBadRequest)
+			return
+		}
+
+		sealed, err := jobs.SealSecret(tenant, name, req.Value)
+		if err != nil {
+			http.Error(w, "Encryption failed", http.StatusInternalServerError)
+			return
+		}
+
+		var s secretInfo
+		err = db.QueryRow(`
+			INSERT INTO secrets (tenant_id, name, value)
+			VALUES ($1, $2, $3)
+			ON CONFLICT (tenant_id, name) DO UPDATE SET
+				value = EXCLUDED.value,
+				updated_at = NOW()
+			RETURNING name, created_at, updated_at
+		`, tenant, name, sealed).Scan(&s.Name, &s.CreatedAt, &s.UpdatedAt)
+		if err != nil {
+			http.Error(w, "Save failed", http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(s)
+
+	case http.MethodDelete:
+		res, err := db.Exec(`DELETE FROM secrets WHERE tenant_id = $1 AND name = $2`, tenant, name)
+		if err != nil {
+			http.Error(w, "Delete failed", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "Secret not found", http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
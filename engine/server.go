@@ -0,0 +1,1868 @@
+package engine
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"goflow/jobs"
+	"goflow/routing"
+	"goflow/workflow"
+)
+
+type Job struct {
+	ID      int                    `json:"id"`
+	Type    string                 `json:"type"`
+	Payload map[string]interface{} `json:"payload"`
+	Status  string                 `json:"status"`
+	RunAt   time.Time              `json:"run_at"`
+	Queue   string                 `json:"queue"`
+	Tags    []string               `json:"tags"`
+
+	// Priority orders ready jobs; higher runs first
+	Priority int `json:"priority"`
+
+	// Retry policy; unset fields fall back to the type's backoff_by_type
+	// entry, then to maxRetries and exponential backoff from baseDelay
+	MaxRetries       *int   `json:"max_retries,omitempty"`
+	Backoff          string `json:"backoff,omitempty"`
+	BaseDelaySeconds *int   `json:"base_delay_seconds,omitempty"`
+	MaxDelaySeconds  *int   `json:"max_delay_seconds,omitempty"`
+
+	// UniqueKey allows one pending or processing job per type and key;
+	// OnConflict (reject, coalesce or replace) is only read on submit
+	UniqueKey  string `json:"unique_key,omitempty"`
+	OnConflict string `json:"on_conflict,omitempty"`
+
+	// TimeoutSeconds bounds one execution; an attempt that runs over is
+	// cancelled and counts as a failure
+	TimeoutSeconds *int `json:"timeout_seconds,omitempty"`
+
+	// TenantID comes from the submitter's API key, never the request body
+	TenantID string `json:"tenant_id"`
+
+	// Sensitive lists payload paths ("headers.Authorization") encrypted
+	// at rest, besides the credential fields that always are
+	Sensitive []string `json:"sensitive,omitempty"`
+
+	// BatchID groups jobs followed together under /batches/{id}
+	BatchID string `json:"batch_id,omitempty"`
+
+	// ExpiresAt is when a job that has not run yet stops being worth
+	// running; it then becomes "expired" instead
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// redacted returns the job as the API shows it, without encrypted
+// payload values.
+func (job Job) redacted() Job {
+	job.Payload = jobs.RedactPayload(job.Payload)
+	return job
+}
+
+// jobColumns is the column list scanJob expects.
+const jobColumns = `id, type, payload, status, run_at, queue, tags, priority, timeout_seconds, tenant_id, sensitive, batch_id, expires_at`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanJob(row rowScanner) (Job, error) {
+
+	var job Job
+	var payloadBytes []byte
+	var batchID sql.NullString
+
+	err := row.Scan(&job.ID, &job.Type, &payloadBytes, &job.Status, &job.RunAt, &job.Queue, pq.Array(&job.Tags), &job.Priority, &job.TimeoutSeconds, &job.TenantID, pq.Array(&job.Sensitive), &batchID, &job.ExpiresAt)
+	if err != nil {
+		return job, err
+	}
+	job.BatchID = batchID.String
+
+	if job.Tags == nil {
+		job.Tags = []string{}
+	}
+
+	return job, json.Unmarshal(payloadBytes, &job.Payload)
+}
+
+type Workflow struct {
+	ID        int             `json:"id"`
+	Status    string          `json:"status"`
+	Steps     json.RawMessage `json:"steps"`
+	Context   json.RawMessage `json:"context"`
+	CreatedAt time.Time       `json:"created_at"`
+	UpdatedAt time.Time       `json:"updated_at"`
+
+	StartedAt       *time.Time `json:"started_at"`
+	FinishedAt      *time.Time `json:"finished_at"`
+	ExecutionTimeMs *int64     `json:"execution_time_ms"`
+}
+
+type WorkflowStepRun struct {
+	ID               int             `json:"id"`
+	WorkflowID       int             `json:"workflow_id"`
+	StepID           string          `json:"step_id"`
+	JobID            int             `json:"job_id"`
+	Status           string          `json:"status"`
+	StartedAt        time.Time       `json:"started_at"`
+	FinishedAt       *time.Time      `json:"finished_at"`
+	Error            *string         `json:"error"`
+	ResponseSnapshot json.RawMessage `json:"response_snapshot"`
+}
+
+var db *sql.DB
+
+const (
+	maxRetries    = 3
+	baseDelay     = 5 * time.Second
+	maxRetryDelay = 24 * time.Hour
+)
+
+// backoffStrategies are the accepted values of "backoff".
+var backoffStrategies = []string{"fixed", "linear", "exponential", "exponential_jitter"}
+
+// retryDelay is how long to wait before retry number attempt+1, at most
+// maxDelay.
+func retryDelay(backoff string, base, maxDelay time.Duration, attempt int) time.Duration {
+
+	var delay time.Duration
+
+	switch backoff {
+	case "fixed":
+		delay = base
+	case "linear":
+		delay = base * time.Duration(attempt+1)
+	default:
+		delay = maxDelay
+		if attempt <= 30 {
+			delay = base * time.Duration(1<<attempt)
+		}
+	}
+
+	if delay > maxDelay || delay < 0 {
+		delay = maxDelay
+	}
+
+	// Full jitter: jobs that failed together, say during an outage, come
+	// back spread over the whole window instead of all at once
+	if backoff == "exponential_jitter" && delay > 0 {
+		delay = rand.N(delay + 1)
+	}
+	return delay
+}
+
+// backoffPolicyFor returns the backoff for retries of jobType: its
+// backoff_by_type entry, with the defaults filling what it leaves out.
+func backoffPolicyFor(jobType string) BackoffPolicy {
+
+	p := cfg.BackoffByType[jobType]
+	if p.Backoff == "" {
+		p.Backoff = "exponential"
+	}
+	if p.BaseDelay == 0 {
+		p.BaseDelay = baseDelay
+	}
+	if p.MaxDelay == 0 {
+		p.MaxDelay = cfg.MaxRetryDelay
+	}
+	return p
+}
+
+// timeoutError is recorded for an attempt that exceeded timeout_seconds.
+func timeoutError(seconds int) error {
+	return errors.New("timed out after " + strconv.Itoa(seconds) + "s")
+}
+
+// validRetryPolicy checks the retry fields of a submitted or patched job.
+func validRetryPolicy(limit *int, backoff string, baseDelaySeconds, maxDelaySeconds *int) error {
+
+	if limit != nil && *limit < 1 {
+		return errors.New("'max_retries' must be at least 1")
+	}
+
+	if backoff != "" && !slices.Contains(backoffStrategies, backoff) {
+		return errors.New("'backoff' must be fixed, linear, exponential or exponential_jitter")
+	}
+
+	if baseDelaySeconds != nil && *baseDelaySeconds < 0 {
+		return errors.New("'base_delay_seconds' must not be negative")
+	}
+
+	if maxDelaySeconds != nil && *maxDelaySeconds < 1 {
+		return errors.New("'max_delay_seconds' must be at least 1")
+	}
+
+	return nil
+}
+
+// internalExecutors run job types that belong to the server itself (they
+// need the engine's state). They cannot be submitted through the API and
+// are never handed to remote agents.
+var internalExecutors = map[string]func(ctx context.Context, payload map[string]interface{}) (int, []byte, error){
+	"bulk_operation": runBulkOperation,
+}
+
+func internalJobTypes() []string {
+	types := make([]string, 0, len(internalExecutors))
+	for t := range internalExecutors {
+		types = append(types, t)
+	}
+	return types
+}
+
+// localQueues lists the queues (worker groups) this process's own workers
+// claim from. Jobs routed to other groups are left for their workers.
+func localQueues() []string {
+	if len(cfg.WorkerQueues) == 0 {
+		return []string{routing.DefaultGroup()}
+	}
+	return cfg.WorkerQueues
+}
+
+// expireJobs marks pending jobs past their expires_at as expired. Like any
+// final state, expiry sends the job's callback and can complete its batch;
+// a workflow step that expires fails its workflow.
+func expireJobs() {
+
+	tx, err := db.Begin()
+	if err != nil {
+		slog.Error("Job expiry failed", "error", err)
+		return
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		UPDATE jobs
+		SET status = 'expired',
+		    last_error = 'expired before it could run',
+		    updated_at = NOW()
+		WHERE status = 'pending'
+		AND expires_at <= NOW()
+		RETURNING ` + jobColumns)
+	if err != nil {
+		slog.Error("Job expiry failed", "error", err)
+		return
+	}
+
+	var expired []Job
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			rows.Close()
+			slog.Error("Job expiry failed", "error", err)
+			return
+		}
+		expired = append(expired, job)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		slog.Error("Job expiry failed", "error", err)
+		return
+	}
+
+	for _, job := range expired {
+		if err := enqueueCallback(tx, job.ID, job.Payload); err != nil {
+			slog.Error("Job expiry failed", "job_id", job.ID, "error", err)
+			return
+		}
+		if err := enqueueBatchCallback(tx, job); err != nil {
+			slog.Error("Job expiry failed", "job_id", job.ID, "error", err)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		slog.Error("Job expiry failed", "error", err)
+		return
+	}
+
+	for _, job := range expired {
+		workflow.AdvanceIfNeeded(job.ID, job.Payload, []byte(`{}`))
+	}
+
+	if len(expired) > 0 {
+		slog.Warn("Expired jobs", "count", len(expired))
+	}
+}
+
+func recoverStuckJobs() {
+	result, err := db.Exec(`
+		UPDATE jobs
+		SET status = 'pending',
+		    updated_at = NOW()
+		WHERE status = 'processing'
+		AND updated_at < NOW() - ($1 || ' seconds')::interval
+	`, int(cfg.ProcessingTimeout.Seconds()))
+
+	if err != nil {
+		slog.Error("Stuck job recovery failed", "error", err)
+		return
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected > 0 {
+		slog.Warn("Recovered stuck jobs", "count", rowsAffected)
+	}
+}
+
+// ==================== WORKER ====================
+
+// startWorker claims jobs until ctx is cancelled. Claimed jobs run under
+// execCtx, which is only cancelled once the shutdown drain timeout expires.
+// Each query claims up to cfg.ClaimBatch jobs, run one after another;
+// batches cut round trips for short jobs but hold jobs back from idle
+// workers, so keep them small.
+func startWorker(ctx context.Context, execCtx context.Context, wg *sync.WaitGroup, workerID int, cfg Config) {
+	defer wg.Done()
+
+	runningWorkers.Add(1)
+	defer runningWorkers.Add(-1)
+
+	queues := localQueues()
+	batchSize := cfg.ClaimBatch
+
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info("Worker shutting down", "worker_id", workerID)
+			return
+		default:
+		}
+
+		wake := jobWakeup()
+
+		ids, err := claimJobs(queues, batchSize, workerName(workerID))
+		if err != nil {
+			slog.Error("Claim failed", "worker_id", workerID, "error", err)
+			time.Sleep(500 * time.Millisecond)
+			continue
+		}
+
+		if len(ids) == 0 {
+			// The broker's pop has already waited for work
+			if broker == nil {
+				waitForJobs(ctx.Done(), wake, idleWait(queues))
+			}
+			continue
+		}
+
+		// Jobs waiting their turn keep a heartbeat, or recovery would
+		// hand them to another worker
+		waiting := make([]func(), len(ids))
+		for i, id := range ids {
+			trackInFlight(id)
+			if i > 0 {
+				waiting[i] = startHeartbeat(id)
+			}
+		}
+
+		for i, id := range ids {
+			if waiting[i] != nil {
+				waiting[i]()
+			}
+
+			// Shutting down: give back what has not started
+			if ctx.Err() != nil {
+				releaseJob(id)
+			} else {
+				processJob(execCtx, workerID, id)
+			}
+			releaseTypeSlot(id)
+			untrackInFlight(id)
+		}
+	}
+}
+
+// claimJobs marks up to n ready jobs as processing by worker in one round
+// trip and returns them in the order they should run. Jobs of types that
+// are out of their rate limit or at their concurrency cap are left in the
+// queue.
+func claimJobs(queues []string, n int, worker string) ([]int, error) {
+
+	limited, err := claimLimitedTypes()
+	if err != nil {
+		return nil, err
+	}
+
+	claimed, err := store.ClaimJobs(ClaimRequest{
+		Queues:    queues,
+		SkipTypes: limited,
+		Limit:     n,
+		Worker:    worker,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var admitted []int
+	for _, c := range claimed {
+		if admitClaimedJob(c.ID, c.Type) {
+			admitted = append(admitted, c.ID)
+		}
+	}
+
+	return admitted, nil
+}
+
+func processJob(ctx context.Context, workerID int, id int) {
+
+	job, ok := loadClaimedJob(workerID, id)
+	if !ok {
+		return
+	}
+
+	logger := jobLogger(workerID, job)
+	logger.Info("Executing job")
+
+	start := time.Now()
+
+	// 🔴 DOUBLE CHECK BEFORE EXECUTION
+	if wfID, ok := job.Payload["workflow_id"]; ok {
+		wfIDFloat, ok := wfID.(float64)
+		if ok {
+			var status string
+			err := db.QueryRow(`
+			SELECT status FROM workflows WHERE id = $1
+		`, int(wfIDFloat)).Scan(&status)
+
+			if err == nil && status == "cancelled" {
+				logger.Info("Skipping job before execution, workflow cancelled")
+				return
+			}
+		}
+	}
+
+	// Long-running executors (k8s_job, external binaries) would otherwise
+	// look stuck to recoverStuckJobs and be executed a second time.
+	stopHeartbeat := startHeartbeat(job.ID)
+	defer stopHeartbeat()
+
+	// ctx only ends on shutdown; runCtx also ends at the job's deadline
+	runCtx := ctx
+	if job.TimeoutSeconds != nil {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, time.Duration(*job.TimeoutSeconds)*time.Second)
+		defer cancel()
+	}
+
+	runCtx = jobs.WithJobID(runCtx, job.ID)
+	runCtx = jobs.WithTenant(runCtx, job.TenantID)
+	runCtx, followUps := jobs.WithFollowUps(runCtx)
+
+	var statusCode int
+	var responseBody []byte
+	var execErr error
+
+	workersBusy.Inc()
+	defer workersBusy.Dec()
+
+	if internal, ok := internalExecutors[job.Type]; ok {
+		statusCode, responseBody, execErr = internal(runCtx, job.Payload)
+	} else {
+		statusCode, responseBody, execErr = jobs.Execute(runCtx, job.Type, job.Payload)
+	}
+
+	duration := time.Since(start).Milliseconds()
+
+	// Interrupted by shutdown: hand the job back instead of burning a retry
+	if ctx.Err() != nil {
+		logger.Info("Job interrupted by shutdown")
+		releaseJob(job.ID)
+		return
+	}
+
+	// Over budget: whatever the executor returned, this attempt failed
+	if runCtx.Err() == context.DeadlineExceeded {
+		execErr = timeoutError(*job.TimeoutSeconds)
+		logger.Warn("Job timed out", "timeout_seconds", *job.TimeoutSeconds)
+	}
+
+	finalizeJob(workerID, job, statusCode, responseBody, execErr, duration, followUps.Jobs)
+}
+
+// loadClaimedJob fetches a job this process just claimed. Jobs belonging to
+// a cancelled workflow are marked cancelled and skipped.
+func loadClaimedJob(workerID int, id int) (Job, bool) {
+
+	job, err := store.GetJob(id)
+	if err != nil {
+		slog.Error("Claimed job fetch failed", "worker_id", workerID, "job_id", id, "error", err)
+		return job, false
+	}
+
+	var workflowID float64
+	if wfID, ok := job.Payload["workflow_id"]; ok {
+		wfIDFloat, ok := wfID.(float64)
+		if !ok {
+			jobLogger(workerID, job).Error("Invalid workflow_id type")
+			return job, false
+		}
+		workflowID = wfIDFloat
+
+		var status string
+		err := db.QueryRow(`
+        SELECT status FROM workflows WHERE id = $1
+    `, int(workflowID)).Scan(&status)
+
+		if err == nil && status == "cancelled" {
+			jobLogger(workerID, job).Info("Skipping job, workflow cancelled")
+
+			store.CancelJob(job.ID, "workflow cancelled")
+
+			return job, false
+		}
+	}
+
+	return job, true
+}
+
+// finalizeJob records the outcome of an execution, whether it ran in this
+// process or on a remote agent.
+func finalizeJob(workerID int, job Job, statusCode int, responseBody []byte, execErr error, duration int64, followUps []jobs.FollowUp) {
+
+	// Ensure responseBody is valid JSON
+	var jsonCheck interface{}
+	if len(responseBody) > 0 && json.Unmarshal(responseBody, &jsonCheck) != nil {
+		// Not valid JSON → wrap it
+		wrapped := map[string]string{
+			"raw": string(responseBody),
+		}
+		responseBody, _ = json.Marshal(wrapped)
+	}
+
+	// Not attempted at all (the destination's circuit is open): back in
+	// the queue without using up a retry
+	if after, ok := jobs.DeferredBy(execErr); ok {
+		deferJob(workerID, job, execErr, after)
+		return
+	}
+
+	observeAttempt(job.Type, execErr, duration)
+
+	logger := jobLogger(workerID, job).With("duration_ms", duration)
+
+	// 🔴 If execution failed
+	if execErr != nil {
+
+		if errors.Is(execErr, jobs.ErrOutcomeUnknown) {
+			_ = store.RecordAttempt(job.ID, Attempt{Error: execErr.Error(), OutcomeUnknown: true})
+
+			logger.Error("Job not re-executed", "error", execErr)
+
+			if err := failJob(job); err != nil {
+				logger.Error("Failed to mark job failed", "error", err)
+				return
+			}
+			workflow.AdvanceIfNeeded(job.ID, job.Payload, []byte(`{}`))
+			return
+		}
+
+		_ = store.RecordAttempt(job.ID, Attempt{
+			StatusCode: statusCode,
+			Body:       responseBody,
+			DurationMs: duration,
+			Error:      execErr.Error(),
+		})
+
+		handleRetry(workerID, job, execErr)
+		return
+	}
+
+	// 🟢 If execution succeeded: completion, follow-up jobs and callback
+	// are committed together so none of them can be lost on a crash.
+	err := store.CompleteJob(job, Attempt{StatusCode: statusCode, Body: responseBody, DurationMs: duration}, followUps)
+	if err != nil {
+		logger.Error("Completion update failed", "error", err)
+		return
+	}
+	jobsCompleted.WithLabelValues(job.Type).Inc()
+	logger.Info("Job completed", "status_code", statusCode)
+
+	workflow.AdvanceIfNeeded(job.ID, job.Payload, responseBody)
+}
+
+func enableCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key, X-GoFlow-Timestamp, X-GoFlow-Signature, Idempotency-Key, If-None-Match, If-Modified-Since, Last-Event-ID")
+		w.Header().Set("Access-Control-Expose-Headers", "ETag, Last-Modified, Retry-After")
+
+		if r.Method == "OPTIONS" {
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ==================== DB INIT ====================
+
+const defaultConnStr = "host=127.0.0.1 port=5433 user=goflow password=goflowpass dbname=goflowdb sslmode=disable"
+
+func initDB(connStr string) error {
+
+	dbConnStr = connStr
+
+	var err error
+	db, err = sql.Open("postgres", connStr)
+	if err != nil {
+		return fmt.Errorf("open database: %w", err)
+	}
+
+	err = db.Ping()
+	if err != nil {
+		return fmt.Errorf("connect to database: %w", err)
+	}
+	store = newPGStore(db)
+
+	err = applyMigrations()
+	if err != nil {
+		return fmt.Errorf("migrate database: %w", err)
+	}
+
+	err = initArchive()
+	if err != nil {
+		return fmt.Errorf("read jobs columns: %w", err)
+	}
+
+	slog.Info("Database ready")
+	return nil
+}
+
+func handleRetry(workerID int, job Job, execErr error) {
+
+	logger := jobLogger(workerID, job)
+
+	// DO NOT retry cancelled workflows
+	if wfID, ok := job.Payload["workflow_id"]; ok {
+		wfIDFloat, ok := wfID.(float64)
+		if ok {
+			var status string
+			err := db.QueryRow(`
+			SELECT status FROM workflows WHERE id = $1
+		`, int(wfIDFloat)).Scan(&status)
+
+			if err == nil && status == "cancelled" {
+				logger.Info("Skipping retry, workflow cancelled", "error", execErr)
+				return
+			}
+		}
+	}
+
+	state, err := store.RetryState(job.ID)
+	if err != nil {
+		logger.Error("Retry fetch failed", "error", err, "exec_error", execErr)
+		return
+	}
+
+	retryCount, limit := state.RetryCount, state.Limit
+	logger = logger.With("attempt", retryCount+1)
+
+	if retryCount+1 >= limit || jobs.IsPermanent(execErr) {
+		err = failJob(job)
+		if err != nil {
+			logger.Error("Failed to mark job failed", "error", err)
+			return
+		}
+		if retryCount+1 >= limit {
+			logger.Error("Job failed, no retries left", "error", execErr, "max_retries", limit)
+		} else {
+			logger.Error("Job failed permanently, not retrying", "error", execErr)
+		}
+
+		// 🔥 Notify workflow engine of terminal failure
+		workflow.AdvanceIfNeeded(job.ID, job.Payload, []byte(`{}`))
+		return
+	}
+
+	// The job's own policy wins over its type's
+	policy := backoffPolicyFor(job.Type)
+	if state.Backoff != nil {
+		policy.Backoff = *state.Backoff
+	}
+	if state.BaseDelay != nil {
+		policy.BaseDelay = *state.BaseDelay
+	}
+	if state.MaxDelay != nil {
+		policy.MaxDelay = *state.MaxDelay
+	}
+
+	nextDelay := retryDelay(policy.Backoff, policy.BaseDelay, policy.MaxDelay, retryCount)
+
+	// The server said when to come back (Retry-After); within the cap,
+	// that beats guessing
+	if after, ok := jobs.RetryAfterOf(execErr); ok {
+		nextDelay = min(after, policy.MaxDelay)
+	}
+
+	logger.Warn("Execution failed, retrying", "error", execErr, "retry_in", nextDelay.String())
+
+	err = store.ScheduleRetry(job.ID, nextDelay)
+	if err != nil {
+		logger.Error("Failed scheduling retry", "error", err)
+		return
+	}
+	jobRetries.WithLabelValues(job.Type).Inc()
+}
+
+// deferJob puts a job that was not attempted back in the queue for after,
+// leaving its retry count alone.
+func deferJob(workerID int, job Job, reason error, after time.Duration) {
+
+	logger := jobLogger(workerID, job)
+
+	err := store.DeferJob(job.ID, reason.Error(), after)
+	if err != nil {
+		logger.Error("Failed deferring job", "error", err)
+		return
+	}
+	logger.Info("Job deferred", "reason", reason, "retry_in", after.String())
+}
+
+// failJob marks the job failed for good and counts it.
+func failJob(job Job) error {
+	if err := store.FailJob(job); err != nil {
+		return err
+	}
+	jobsFailed.WithLabelValues(job.Type).Inc()
+	return nil
+}
+
+// startHeartbeat keeps a processing job's updated_at fresh until stopped.
+func startHeartbeat(jobID int) func() {
+
+	done := make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(cfg.ProcessingTimeout / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				store.Heartbeat(jobID)
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+func startRecoveryLoop(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	ticker := time.NewTicker(15 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info("Recovery loop shutting down")
+			return
+		case <-ticker.C:
+			recoverStuckJobs()
+			expireJobs()
+			pruneIdempotencyKeys()
+			pruneUsedSignatures()
+		}
+	}
+}
+
+// ==================== API ====================
+
+// configureExecutors applies cfg to the job executors: mail, circuit
+// breakers, stored report queries, secrets, routing and plugins.
+func configureExecutors() error {
+
+	jobs.ConfigureSMTP(cfg.SMTP.Host, cfg.SMTP.Port, cfg.SMTP.User, cfg.SMTP.Pass)
+	jobs.ConfigureBreakers(cfg.BreakerFailures, cfg.BreakerCooldown)
+	jobs.ConfigureReportQueries(cfg.ReportQueries)
+	configureJobTypes(cfg)
+
+	if cfg.SecretsKey != "" {
+		key, _ := base64.StdEncoding.DecodeString(cfg.SecretsKey)
+		if err := jobs.SetSecretsKey(key); err != nil {
+			return fmt.Errorf("invalid secrets key: %w", err)
+		}
+	}
+
+	for _, name := range cfg.ExecutorMiddleware {
+		mw, _ := jobs.NamedMiddleware(name)
+		jobs.Use(mw)
+	}
+	jobs.Use(cfg.Middleware...)
+
+	if cfg.RoutingConfig != "" {
+		if err := routing.Load(cfg.RoutingConfig); err != nil {
+			return fmt.Errorf("load routing rules: %w", err)
+		}
+	}
+
+	if cfg.PluginsConfig != "" {
+		if err := jobs.LoadWASMPlugins(context.Background(), cfg.PluginsConfig); err != nil {
+			return fmt.Errorf("load WASM plugins: %w", err)
+		}
+	}
+	return nil
+}
+
+// configureJobTypes applies c's settings for individual job types. The
+// test-job command shares it with the server.
+func configureJobTypes(c Config) {
+
+	jobs.ConfigureCommands(c.RunCommand)
+	jobs.ConfigureContainers(c.Containers)
+	jobs.ConfigurePDFRenderer(c.PDFRenderURL)
+
+	for jobType, g := range c.ExecutionGuarantees {
+		jobs.SetGuarantee(jobType, g)
+	}
+}
+
+// apiMux routes the full API, served when the queue is in Postgres.
+func apiMux() *http.ServeMux {
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/health", healthHandler)
+	mux.HandleFunc("/healthz", healthHandler)
+	mux.HandleFunc("/readyz", readyHandler)
+	mux.HandleFunc("/jobs", withIdempotencyKey(withSubmitLimits(jobsHandler)))
+	mux.HandleFunc("/workflows", workflowsHandler)
+	mux.HandleFunc("/workflows/", workflowDetailHandler)
+	mux.HandleFunc("/jobs/stats", jobStatsHandler)
+	mux.HandleFunc("/jobs/export", exportHandler)
+	mux.HandleFunc("/jobs/bulk", bulkHandler)
+	mux.HandleFunc("/jobs/bulk/", bulkDetailHandler)
+	mux.HandleFunc("/jobs/retry", bulkRetryHandler)
+	mux.HandleFunc("/jobs/", jobDetailHandler)
+	mux.HandleFunc("/job-types", jobTypesHandler)
+	mux.HandleFunc("/openapi.json", openapiHandler)
+	mux.HandleFunc("/hooks/", inboundHookHandler)
+	mux.HandleFunc("/usage", usageHandler)
+	mux.HandleFunc("/secrets", secretsHandler)
+	mux.HandleFunc("/secrets/", secretDetailHandler)
+	mux.HandleFunc("/agents", agentListHandler)
+	mux.HandleFunc("/schedules", schedulesHandler)
+	mux.HandleFunc("/schedules/", scheduleDetailHandler)
+	mux.HandleFunc("/schedules/preview", schedulePreviewHandler)
+	mux.HandleFunc("/batches", batchesHandler)
+	mux.HandleFunc("/batches/", batchDetailHandler)
+	mux.HandleFunc("/digests/", digestEventsHandler)
+	mux.HandleFunc("/webhooks/subscriptions", webhookSubscriptionsHandler)
+	mux.HandleFunc("/webhooks/subscriptions/", webhookSubscriptionDetailHandler)
+	mux.HandleFunc("/webhooks/fanouts/", webhookFanoutHandler)
+	mux.HandleFunc("/dead-letter", deadLetterListHandler)
+	mux.HandleFunc("/dead-letter/", deadLetterDetailHandler)
+	mux.HandleFunc("/admin/purge", purgeHandler)
+	mux.HandleFunc("/admin/pause", pauseHandler)
+	mux.HandleFunc("/admin/resume", resumeHandler)
+	mux.HandleFunc("/admin/drain", drainHandler)
+	mux.Handle("/metrics", metricsHandler())
+	mux.HandleFunc("/events", eventsHandler)
+	mux.Handle("/ws", feedHandler())
+	mux.Handle("/agents/connect", agentsHandler())
+
+	return mux
+}
+
+func jobsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+
+	case http.MethodPost:
+		var req Job
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		req.TenantID = tenantOf(r)
+
+		submitJob(w, req)
+
+	case http.MethodGet:
+		filter, err := parseJobFilter(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		filter.add("tenant_id = ?", tenantOf(r))
+
+		if r.URL.Query().Has("fields") || r.URL.Query().Has("include") {
+			listJobFields(w, r, filter)
+			return
+		}
+
+		jobs, err := store.ListJobs(filter)
+		if err != nil {
+			http.Error(w, "Query failed", http.StatusInternalServerError)
+			return
+		}
+		for i := range jobs {
+			jobs[i] = jobs[i].redacted()
+		}
+
+		json.NewEncoder(w).Encode(jobs)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// uniqueJobPredicate is the partial index condition for unique jobs, as
+// the baseline migration creates the index. The ON CONFLICT clauses in
+// submitJob repeat it so Postgres infers the index.
+const uniqueJobPredicate = `WHERE unique_key IS NOT NULL AND status IN ('pending', 'processing')`
+
+// prepareJob validates req and fills in its defaults, answering 400 itself
+// when req is invalid. It does not touch the database.
+func prepareJob(w http.ResponseWriter, req *Job) bool {
+	if err := validateJob(req); err != nil {
+		writeSubmitError(w, err)
+		return false
+	}
+	return true
+}
+
+// validateJob is prepareJob for callers that are not answering a request.
+// A job the API would refuse is an *EnqueueError.
+func validateJob(req *Job) error {
+
+	if _, ok := internalExecutors[req.Type]; ok {
+		return refuse(http.StatusBadRequest, req.Type+" is an internal job type")
+	}
+
+	if err := jobs.ValidatePayload(req.Type, req.Payload); err != nil {
+		return refuse(http.StatusBadRequest, err.Error())
+	}
+
+	if err := validateHooks(req.Payload); err != nil {
+		return refuse(http.StatusBadRequest, err.Error())
+	}
+
+	if jobs.GuaranteeFor(req.Type) == jobs.EffectivelyOnce {
+		if key, _ := req.Payload["idempotency_key"].(string); key == "" {
+			return refuse(http.StatusBadRequest, req.Type+" requires 'idempotency_key' in payload")
+		}
+	}
+
+	if err := validRetryPolicy(req.MaxRetries, req.Backoff, req.BaseDelaySeconds, req.MaxDelaySeconds); err != nil {
+		return refuse(http.StatusBadRequest, err.Error())
+	}
+
+	if req.ExpiresAt != nil {
+		if !req.ExpiresAt.After(time.Now()) {
+			return refuse(http.StatusBadRequest, "'expires_at' is in the past")
+		}
+		if !req.RunAt.IsZero() && !req.ExpiresAt.After(req.RunAt) {
+			return refuse(http.StatusBadRequest, "'expires_at' must be after 'run_at'")
+		}
+	}
+
+	if req.TimeoutSeconds != nil && *req.TimeoutSeconds < 1 {
+		return refuse(http.StatusBadRequest, "'timeout_seconds' must be at least 1")
+	}
+
+	switch req.OnConflict {
+	case "":
+		req.OnConflict = "reject"
+	case "reject", "coalesce", "replace":
+		if req.UniqueKey == "" {
+			return refuse(http.StatusBadRequest, "'on_conflict' needs a 'unique_key'")
+		}
+	default:
+		return refuse(http.StatusBadRequest, "'on_conflict' must be reject, coalesce or replace")
+	}
+
+	req.Status = "pending"
+	if req.TenantID == "" {
+		req.TenantID = defaultTenant
+	}
+
+	req.Queue = routing.GroupFor(req.Type, req.Payload, req.Queue)
+
+	if req.Tags == nil {
+		req.Tags = []string{}
+	}
+	for _, tag := range req.Tags {
+		if strings.TrimSpace(tag) == "" {
+			return refuse(http.StatusBadRequest, "Tags must not be empty")
+		}
+	}
+
+	return sealSensitive(req.Payload, req.Sensitive)
+}
+
+// submitJob validates, routes and inserts req, then writes it back with its
+// id. It backs POST /jobs and POST /jobs/{id}/clone.
+func submitJob(w http.ResponseWriter, req Job) {
+
+	job, err := enqueueJob(req)
+	if err != nil {
+		writeSubmitError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(job.redacted())
+}
+
+// enqueueJob validates, routes and inserts req, and returns it with its
+// id and run_at. With on_conflict coalesce it may return the job already
+// holding the unique_key instead.
+func enqueueJob(req Job) (Job, error) {
+
+	if err := validateJob(&req); err != nil {
+		return Job{}, err
+	}
+
+	if req.BatchID != "" {
+		if err := validBatchID("batch_id", req.BatchID); err != nil {
+			return Job{}, refuse(http.StatusBadRequest, err.Error())
+		}
+		if err := checkBatchOpen(req.TenantID, req.BatchID); err == errBatchComplete {
+			return Job{}, refuse(http.StatusConflict, "Batch "+req.BatchID+" is already complete")
+		} else if err != nil {
+			return Job{}, fmt.Errorf("check batch: %w", err)
+		}
+	}
+
+	// Default run_at comes from the database clock, the same one
+	// the claim query compares against.
+	var runAt *time.Time
+	if !req.RunAt.IsZero() {
+		runAt = &req.RunAt
+	}
+
+	payloadJSON, err := json.Marshal(req.Payload)
+	if err != nil {
+		return Job{}, err
+	}
+
+	// A replaced job keeps its id; only a pending one can be replaced
+	onConflict := ""
+	if req.UniqueKey != "" {
+		onConflict = `ON CONFLICT (tenant_id, type, unique_key) ` + uniqueJobPredicate + ` DO NOTHING`
+		if req.OnConflict == "replace" {
+			onConflict = `ON CONFLICT (tenant_id, type, unique_key) ` + uniqueJobPredicate + ` DO UPDATE SET
+				payload = EXCLUDED.payload, run_at = EXCLUDED.run_at, queue = EXCLUDED.queue,
+				tags = EXCLUDED.tags, max_retries = EXCLUDED.max_retries, priority = EXCLUDED.priority,
+				backoff = EXCLUDED.backoff, base_delay_seconds = EXCLUDED.base_delay_seconds, max_delay_seconds = EXCLUDED.max_delay_seconds,
+				expires_at = EXCLUDED.expires_at,
+				timeout_seconds = EXCLUDED.timeout_seconds, sensitive = EXCLUDED.sensitive, batch_id = EXCLUDED.batch_id, updated_at = NOW()
+			WHERE jobs.status = 'pending'`
+		}
+	}
+
+	// The existing job can finish between the conflict and the lookup;
+	// then the insert is simply tried again.
+	for attempt := 0; attempt < 3; attempt++ {
+
+		err = db.QueryRow(`
+			INSERT INTO jobs (type, payload, status, run_at, queue, tags, max_retries, priority, backoff, base_delay_seconds, unique_key, timeout_seconds, tenant_id, sensitive, batch_id, max_delay_seconds, expires_at)
+			VALUES ($1, $2, $3, COALESCE($4::timestamptz, NOW()), $5, $6, $7, $8, NULLIF($9, ''), $10, NULLIF($11, ''), $12, $13, $14, NULLIF($15, ''), $16, $17)
+			`+onConflict+`
+			RETURNING id, run_at
+		`, req.Type, payloadJSON, req.Status, runAt, req.Queue, pq.Array(req.Tags), req.MaxRetries, req.Priority, req.Backoff, req.BaseDelaySeconds, req.UniqueKey, req.TimeoutSeconds, req.TenantID, pq.Array(req.Sensitive), req.BatchID, req.MaxDelaySeconds, req.ExpiresAt).Scan(&req.ID, &req.RunAt)
+
+		if err == nil {
+			jobsEnqueued.WithLabelValues(req.Type).Inc()
+			req.OnConflict = ""
+			return req, nil
+		}
+
+		if err != sql.ErrNoRows {
+			return Job{}, fmt.Errorf("insert job: %w", err)
+		}
+
+		existing, err := scanJob(db.QueryRow(`
+			SELECT `+jobColumns+`
+			FROM jobs
+			WHERE tenant_id = $3 AND type = $1 AND unique_key = $2 AND status IN ('pending', 'processing')
+		`, req.Type, req.UniqueKey, req.TenantID))
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return Job{}, fmt.Errorf("find job with unique_key: %w", err)
+		}
+
+		switch {
+		case req.OnConflict == "coalesce":
+			return existing, nil
+		case existing.Status == "processing":
+			return Job{}, refuse(http.StatusConflict, "Job "+strconv.Itoa(existing.ID)+" with this unique_key is already processing")
+		default:
+			return Job{}, refuse(http.StatusConflict, "Job "+strconv.Itoa(existing.ID)+" with this unique_key is already pending")
+		}
+	}
+
+	return Job{}, errors.New("insert job: unique_key kept changing hands")
+}
+
+// refuse is the error for a job the API refuses with status.
+func refuse(status int, message string) error {
+	return &EnqueueError{Status: status, Message: message}
+}
+
+// writeSubmitError answers a failed submission: a refusal with its own
+// status, anything else as a server error.
+func writeSubmitError(w http.ResponseWriter, err error) {
+
+	var refused *EnqueueError
+	if errors.As(err, &refused) {
+		http.Error(w, refused.Message, refused.Status)
+		return
+	}
+
+	slog.Error("Job submission failed", "error", err)
+	http.Error(w, "Insert failed", http.StatusInternalServerError)
+}
+
+func workflowsHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method == http.MethodPost {
+		startWorkflow(w, r)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT id, status, steps, context, created_at, updated_at,
+       	started_at, finished_at, execution_time_ms
+		FROM workflows
+		WHERE tenant_id = $1
+		ORDER BY id DESC
+	`, tenantOf(r))
+	if err != nil {
+		http.Error(w, "Query failed", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var workflows []Workflow
+
+	for rows.Next() {
+		var wf Workflow
+		err := rows.Scan(
+			&wf.ID,
+			&wf.Status,
+			&wf.Steps,
+			&wf.Context,
+			&wf.CreatedAt,
+			&wf.UpdatedAt,
+			&wf.StartedAt,
+			&wf.FinishedAt,
+			&wf.ExecutionTimeMs,
+		)
+		if err != nil {
+			http.Error(w, "Scan failed", http.StatusInternalServerError)
+			return
+		}
+		workflows = append(workflows, wf)
+	}
+
+	json.NewEncoder(w).Encode(workflows)
+}
+
+// startWorkflow serves POST /workflows: {"steps": [...]}, the payload of
+// a workflow job, started directly.
+func startWorkflow(w http.ResponseWriter, r *http.Request) {
+
+	var req struct {
+		Steps []interface{} `json:"steps"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if err := workflow.ValidateSteps(req.Steps); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, resp, err := workflow.Start(r.Context(), tenantOf(r), map[string]interface{}{"steps": req.Steps})
+	if err != nil {
+		http.Error(w, "Workflow start failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	w.Write(resp)
+}
+
+func workflowDetailHandler(w http.ResponseWriter, r *http.Request) {
+
+	path := strings.TrimPrefix(r.URL.Path, "/workflows/")
+	parts := strings.Split(path, "/")
+
+	idStr := parts[0]
+	workflowID, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "Invalid workflow id", http.StatusBadRequest)
+		return
+	}
+
+	if !workflowInTenant(workflowID, tenantOf(r)) {
+		http.Error(w, "Workflow not found", http.StatusNotFound)
+		return
+	}
+
+	// 🔴 CANCEL WORKFLOW
+	if len(parts) == 2 && parts[1] == "cancel" && r.Method == http.MethodPost {
+		err := workflow.CancelWorkflow(workflowID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"workflow_id": workflowID,
+			"status":      "cancelled",
+		})
+		return
+	}
+
+	// 🟢 RUN WORKFLOW
+	if len(parts) == 2 && parts[1] == "run" && r.Method == http.MethodPost {
+
+		err := workflow.RunWorkflow(workflowID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"workflow_id": workflowID,
+			"status":      "started",
+		})
+
+		return
+	}
+
+	// /workflows/{id}/steps
+	if len(parts) == 2 && parts[1] == "steps" {
+		getWorkflowSteps(w, workflowID)
+		return
+	}
+
+	// /workflows/{id}/context
+	if len(parts) == 2 && parts[1] == "context" {
+		getWorkflowContext(w, workflowID)
+		return
+	}
+
+	// Default: workflow metadata
+	var wf Workflow
+	err = db.QueryRow(`
+		SELECT id, status, steps, context, created_at, updated_at,
+       	started_at, finished_at, execution_time_ms
+		FROM workflows
+		WHERE id = $1
+	`, workflowID).Scan(
+		&wf.ID,
+		&wf.Status,
+		&wf.Steps,
+		&wf.Context,
+		&wf.CreatedAt,
+		&wf.UpdatedAt,
+		&wf.StartedAt,
+		&wf.FinishedAt,
+		&wf.ExecutionTimeMs,
+	)
+
+	if err != nil {
+		http.Error(w, "Workflow not found", http.StatusNotFound)
+		return
+	}
+
+	json.NewEncoder(w).Encode(wf)
+}
+
+func getWorkflowSteps(w http.ResponseWriter, workflowID int) {
+
+	rows, err := db.Query(`
+		SELECT id, workflow_id, step_id, job_id, status,
+		       started_at, finished_at, error, response_snapshot
+		FROM workflow_step_runs
+		WHERE workflow_id = $1
+		ORDER BY id
+	`, workflowID)
+
+	if err != nil {
+		http.Error(w, "Query failed", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	var steps []WorkflowStepRun
+
+	for rows.Next() {
+		var s WorkflowStepRun
+		var rawResp []byte
+		err := rows.Scan(
+			&s.ID,
+			&s.WorkflowID,
+			&s.StepID,
+			&s.JobID,
+			&s.Status,
+			&s.StartedAt,
+			&s.FinishedAt,
+			&s.Error,
+			&rawResp,
+		)
+		if err != nil {
+			slog.Error("Workflow step scan failed", "workflow_id", workflowID, "error", err)
+			http.Error(w, "Scan failed: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if rawResp != nil {
+			s.ResponseSnapshot = rawResp
+		}
+		steps = append(steps, s)
+	}
+
+	json.NewEncoder(w).Encode(steps)
+}
+
+func getWorkflowContext(w http.ResponseWriter, workflowID int) {
+
+	var context json.RawMessage
+
+	err := db.QueryRow(`
+		SELECT context
+		FROM workflows
+		WHERE id = $1
+	`, workflowID).Scan(&context)
+
+	if err != nil {
+		http.Error(w, "Workflow not found", http.StatusNotFound)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]json.RawMessage{
+		"context": context,
+	})
+}
+
+func jobDetailHandler(w http.ResponseWriter, r *http.Request) {
+
+	path := strings.TrimPrefix(r.URL.Path, "/jobs/")
+	parts := strings.Split(path, "/")
+
+	jobID, err := strconv.Atoi(parts[0])
+	if err != nil {
+		http.Error(w, "Invalid job id", http.StatusBadRequest)
+		return
+	}
+
+	// Another tenant's job looks exactly like a missing one
+	if !jobInTenant(jobID, tenantOf(r)) {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	if isArchived(jobID) {
+		archivedJobHandler(w, r, jobID, parts)
+		return
+	}
+
+	if len(parts) == 1 && r.Method == http.MethodDelete {
+		cancelJob(w, jobID)
+		return
+	}
+
+	if len(parts) == 1 && r.Method == http.MethodPatch {
+		patchJob(w, r, jobID)
+		return
+	}
+
+	// Pollers revalidate against updated_at alone, without loading the
+	// payload and response body.
+	if len(parts) == 1 && r.Method == http.MethodGet {
+		var updatedAt time.Time
+		err := db.QueryRow(`SELECT updated_at FROM jobs WHERE id = $1`, jobID).Scan(&updatedAt)
+		if err != nil {
+			http.Error(w, "Job not found", http.StatusNotFound)
+			return
+		}
+		if notModified(w, r, jobETag(jobID, updatedAt), updatedAt) {
+			return
+		}
+		getJob(w, r, jobID, "jobs")
+		return
+	}
+
+	job, err := scanJob(db.QueryRow(`
+		SELECT `+jobColumns+`
+		FROM jobs
+		WHERE id = $1
+	`, jobID))
+
+	if err != nil {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	// 🔁 CLONE JOB
+	if len(parts) == 2 && parts[1] == "clone" && r.Method == http.MethodPost {
+		cloneJob(w, r, job)
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "logs" {
+		jobLogsHandler(w, r, job.ID)
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "retry" && r.Method == http.MethodPost {
+		retryJob(w, r, job.ID)
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "events" {
+		jobEventsHandler(w, r, job.ID)
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == "stream" {
+		jobStreamHandler(w, r, job.ID)
+		return
+	}
+
+	json.NewEncoder(w).Encode(job.redacted())
+}
+
+// getJob serves GET /jobs/{id}: every column of the job, including its
+// retry count, last error, response and timings. ?fields= and ?include=
+// work as on GET /jobs. table is jobs, or jobs_archive for an archived job.
+func getJob(w http.ResponseWriter, r *http.Request, jobID int, table string) {
+
+	fields, err := parseJobFields(r.URL.Query(), jobFields)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var row json.RawMessage
+	err = db.QueryRow(`
+		SELECT `+jobObjectSQL(fields)+`
+		FROM `+table+`
+		WHERE id = $1
+	`, jobID).Scan(&row)
+
+	if err == sql.ErrNoRows {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Query failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(row, '\n'))
+}
+
+// cancelJob serves DELETE /jobs/{id}. Only pending jobs (including ones
+// scheduled for later) can be cancelled; the status check and update are a
+// single statement, so a worker cannot claim the job in between. The row
+// is kept for history.
+func cancelJob(w http.ResponseWriter, jobID int) {
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Cancel failed", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	job, err := scanJob(tx.QueryRow(`
+		UPDATE jobs
+		SET status = 'cancelled', updated_at = NOW()
+		WHERE id = $1 AND status = 'pending'
+		RETURNING `+jobColumns+`
+	`, jobID))
+
+	if err == sql.ErrNoRows {
+		var status string
+		if err := tx.QueryRow(`SELECT status FROM jobs WHERE id = $1`, jobID).Scan(&status); err != nil {
+			http.Error(w, "Job not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Job is already "+status, http.StatusConflict)
+		return
+	}
+
+	// Cancelling a batch's last unfinished job completes the batch
+	if err == nil {
+		err = enqueueBatchCallback(tx, job)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "Cancel failed", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(job.redacted())
+}
+
+// retryJob serves POST /jobs/{id}/retry, putting a failed job back in the
+// queue with a fresh retry budget, as a bulk retry would, and taking it
+// out of the dead-letter queue.
+func retryJob(w http.ResponseWriter, r *http.Request, jobID int) {
+
+	// reset_retries: false keeps the attempt count and errors and allows
+	// one more attempt instead of a fresh budget
+	opts := struct {
+		ResetRetries *bool `json:"reset_retries"`
+	}{}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&opts); err != nil && err != io.EOF {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Retry failed", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	retry := bulkActions["retry"]
+	args := []interface{}{jobID}
+
+	if opts.ResetRetries != nil && !*opts.ResetRetries {
+		retry.apply = `UPDATE jobs SET status = 'pending', max_retries = GREATEST(COALESCE(max_retries, $2), retry_count + 1), run_at = NOW(), updated_at = NOW()`
+		args = append(args, maxRetries)
+	}
+
+	job, err := scanJob(tx.QueryRow(retry.apply+`
+		WHERE id = $1 AND `+retry.where+`
+		RETURNING `+jobColumns, args...))
+
+	if err == sql.ErrNoRows {
+		var status string
+		if err := tx.QueryRow(`SELECT status FROM jobs WHERE id = $1`, jobID).Scan(&status); err != nil {
+			http.Error(w, "Job not found", http.StatusNotFound)
+			return
+		}
+		if status == "failed" {
+			http.Error(w, "Another job holds this job's unique_key", http.StatusConflict)
+			return
+		}
+		http.Error(w, "Job is "+status+"; only failed jobs can be retried", http.StatusConflict)
+		return
+	}
+
+	if err == nil {
+		_, err = tx.Exec(`DELETE FROM dead_letter WHERE job_id = $1`, jobID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "Retry failed", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(job.redacted())
+}
+
+// patchJob serves PATCH /jobs/{id}, editing a job that is still pending.
+// "payload" is merged into the current payload like a clone's, "run_at"
+// moves the job (now or earlier pulls it forward) and the retry policy
+// fields replace the job's own. The edited job is validated like a new
+// submission. The row stays locked while it is edited, so a worker either
+// claims the old version or the new one.
+func patchJob(w http.ResponseWriter, r *http.Request, jobID int) {
+
+	var patch struct {
+		Payload          map[string]interface{} `json:"payload"`
+		RunAt            *time.Time             `json:"run_at"`
+		MaxRetries       *int                   `json:"max_retries"`
+		Backoff          string                 `json:"backoff"`
+		BaseDelaySeconds *int                   `json:"base_delay_seconds"`
+		MaxDelaySeconds  *int                   `json:"max_delay_seconds"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	// Workflow bookkeeping is not the caller's to move
+	for _, key := range []string{"workflow_id", "step_id"} {
+		if _, ok := patch.Payload[key]; ok {
+			http.Error(w, "'"+key+"' cannot be changed", http.StatusBadRequest)
+			return
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Update failed", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	job, err := scanJob(tx.QueryRow(`
+		SELECT `+jobColumns+`
+		FROM jobs
+		WHERE id = $1
+		FOR UPDATE
+	`, jobID))
+	if err != nil {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	if job.Status != "pending" {
+		http.Error(w, "Job is already "+job.Status, http.StatusConflict)
+		return
+	}
+
+	if patch.Payload != nil {
+		oldKey, _ := job.Payload["idempotency_key"].(string)
+		job.Payload = mergePayload(job.Payload, patch.Payload)
+
+		if jobs.GuaranteeFor(job.Type) == jobs.EffectivelyOnce {
+			// Earlier attempts may already have recorded effects under it
+			if key, _ := job.Payload["idempotency_key"].(string); key != oldKey {
+				http.Error(w, "'idempotency_key' cannot be changed", http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	if patch.RunAt != nil {
+		job.RunAt = *patch.RunAt
+	}
+	if patch.MaxRetries != nil {
+		job.MaxRetries = patch.MaxRetries
+	}
+	if patch.Backoff != "" {
+		job.Backoff = patch.Backoff
+	}
+	if patch.BaseDelaySeconds != nil {
+		job.BaseDelaySeconds = patch.BaseDelaySeconds
+	}
+	if patch.MaxDelaySeconds != nil {
+		job.MaxDelaySeconds = patch.MaxDelaySeconds
+	}
+
+	// The same checks as a submission, which also routes the job again
+	// and encrypts the new payload
+	if !prepareJob(w, &job) {
+		return
+	}
+	job.OnConflict = ""
+
+	payloadJSON, err := json.Marshal(job.Payload)
+	if err != nil {
+		http.Error(w, "Payload error", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = tx.Exec(`
+		UPDATE jobs
+		SET payload = $2,
+		    queue = $3,
+		    run_at = $4,
+		    max_retries = $5,
+		    backoff = NULLIF($6, ''),
+		    base_delay_seconds = $7,
+		    max_delay_seconds = $8,
+		    updated_at = NOW()
+		WHERE id = $1
+	`, jobID, payloadJSON, job.Queue, job.RunAt, job.MaxRetries, job.Backoff, job.BaseDelaySeconds, job.MaxDelaySeconds)
+	if err != nil {
+		http.Error(w, "Update failed", http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Update failed", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(job.redacted())
+}
+
+// cloneJob resubmits job as a new pending job with the same retry policy
+// and expiry. The optional body patches it: "payload" is merged into the
+// old payload (null removes a key), and "run_at", "queue", "tags", the
+// retry policy fields and "expires_at" replace the old values. An
+// expires_at that has already passed is not carried over.
+func cloneJob(w http.ResponseWriter, r *http.Request, job Job) {
+
+	var overrides struct {
+		Payload          map[string]interface{} `json:"payload"`
+		RunAt            *time.Time             `json:"run_at"`
+		Queue            *string                `json:"queue"`
+		Tags             []string               `json:"tags"`
+		MaxRetries       *int                   `json:"max_retries"`
+		Backoff          string                 `json:"backoff"`
+		BaseDelaySeconds *int                   `json:"base_delay_seconds"`
+		MaxDelaySeconds  *int                   `json:"max_delay_seconds"`
+		ExpiresAt        *time.Time             `json:"expires_at"`
+	}
+
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&overrides); err != nil && err != io.EOF {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+	}
+
+	oldKey, _ := job.Payload["idempotency_key"].(string)
+
+	clone := Job{
+		Type:     job.Type,
+		Payload:  mergePayload(job.Payload, overrides.Payload),
+		Tags:     job.Tags,
+		Priority: job.Priority,
+
+		MaxRetries:       job.MaxRetries,
+		Backoff:          job.Backoff,
+		BaseDelaySeconds: job.BaseDelaySeconds,
+		MaxDelaySeconds:  job.MaxDelaySeconds,
+
+		TimeoutSeconds: job.TimeoutSeconds,
+		TenantID:       job.TenantID,
+		Sensitive:      job.Sensitive,
+	}
+
+	if job.ExpiresAt != nil && job.ExpiresAt.After(time.Now()) {
+		clone.ExpiresAt = job.ExpiresAt
+	}
+
+	// A clone runs on its own; it must not advance the original's workflow
+	delete(clone.Payload, "workflow_id")
+	delete(clone.Payload, "step_id")
+
+	if overrides.RunAt != nil {
+		clone.RunAt = *overrides.RunAt
+	}
+	if overrides.Queue != nil {
+		clone.Queue = *overrides.Queue
+	}
+	if overrides.Tags != nil {
+		clone.Tags = overrides.Tags
+	}
+	if overrides.MaxRetries != nil {
+		clone.MaxRetries = overrides.MaxRetries
+	}
+	if overrides.Backoff != "" {
+		clone.Backoff = overrides.Backoff
+	}
+	if overrides.BaseDelaySeconds != nil {
+		clone.BaseDelaySeconds = overrides.BaseDelaySeconds
+	}
+	if overrides.MaxDelaySeconds != nil {
+		clone.MaxDelaySeconds = overrides.MaxDelaySeconds
+	}
+	if overrides.ExpiresAt != nil {
+		clone.ExpiresAt = overrides.ExpiresAt
+	}
+
+	// Reusing the key would just replay the original job's stored result
+	if jobs.GuaranteeFor(clone.Type) == jobs.EffectivelyOnce {
+		if key, _ := clone.Payload["idempotency_key"].(string); key != "" && key == oldKey {
+			http.Error(w, "Clone of "+clone.Type+" needs a new 'idempotency_key'", http.StatusBadRequest)
+			return
+		}
+	}
+
+	submitJob(w, clone)
+}
+
+// encryptSensitive encrypts the payload's credential fields and the
+// paths the job marks sensitive, and the credential fields of the jobs it
+// defines (hooks, next_job, workflow steps). Without a secrets key only
+// the paths marked sensitive are an error.
+func encryptSensitive(w http.ResponseWriter, payload map[string]interface{}, sensitive []string) bool {
+
+	err := sealSensitive(payload, sensitive)
+
+	var refused *EnqueueError
+	switch {
+	case err == nil:
+		return true
+	case errors.As(err, &refused):
+		http.Error(w, refused.Message, refused.Status)
+	default:
+		http.Error(w, "Payload encryption failed", http.StatusInternalServerError)
+	}
+	return false
+}
+
+// sealSensitive is encryptSensitive for callers that are not answering a
+// request.
+func sealSensitive(payload map[string]interface{}, sensitive []string) error {
+
+	if !jobs.SecretsEnabled() {
+		if len(sensitive) > 0 {
+			return refuse(http.StatusServiceUnavailable, "'sensitive' needs a secrets_key on the server")
+		}
+		return nil
+	}
+
+	if err := jobs.EncryptPayload(payload, sensitive); err != nil {
+		return fmt.Errorf("payload encryption: %w", err)
+	}
+	return nil
+}
+
+// mergePayload applies patch to base like a JSON merge patch: nested
+// objects merge, null deletes, anything else replaces.
+func mergePayload(base, patch map[string]interface{}) map[string]interface{} {
+
+	merged := make(map[string]interface{}, len(base))
+	for k, v := range base {
+		merged[k] = v
+	}
+
+	for k, v := range patch {
+		if v == nil {
+			delete(merged, k)
+			continue
+		}
+
+		sub, ok := v.(map[string]interface{})
+		existing, wasObject := merged[k].(map[string]interface{})
+		if ok && wasObject {
+			merged[k] = mergePayload(existing, sub)
+			continue
+		}
+
+		merged[k] = v
+	}
+
+	return merged
+}
@@ -0,0 +1,52 @@
+package engine
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+
+	const (
+		base     = 5 * time.Second
+		maxDelay = time.Hour
+	)
+
+	for _, tc := range []struct {
+		backoff string
+		attempt int
+		want    time.Duration
+	}{
+		{"fixed", 0, base},
+		{"fixed", 7, base},
+		{"linear", 0, base},
+		{"linear", 3, 4 * base},
+		{"linear", 1000, maxDelay},
+		{"exponential", 0, base},
+		{"exponential", 3, 8 * base},
+		{"exponential", 10, maxDelay},
+		{"exponential", 31, maxDelay},
+		{"exponential", 62, maxDelay},
+		{"", 2, 4 * base},
+	} {
+		if got := retryDelay(tc.backoff, base, maxDelay, tc.attempt); got != tc.want {
+			t.Errorf("%q attempt %d: got %s, want %s", tc.backoff, tc.attempt, got, tc.want)
+		}
+	}
+
+	// Jitter picks anywhere up to the exponential delay, capped
+	for _, tc := range []struct {
+		attempt int
+		ceiling time.Duration
+	}{
+		{0, base},
+		{3, 8 * base},
+		{20, maxDelay},
+	} {
+		for range 100 {
+			if got := retryDelay("exponential_jitter", base, maxDelay, tc.attempt); got < 0 || got > tc.ceiling {
+				t.Fatalf("jitter attempt %d: got %s, want within [0, %s]", tc.attempt, got, tc.ceiling)
+			}
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package engine
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// ==================== SHUTDOWN ====================
+
+const defaultDrainTimeout = 25 * time.Second
+
+// inFlight tracks the jobs this process has claimed and not yet finalized.
+var inFlight = struct {
+	sync.Mutex
+	ids map[int]struct{}
+}{ids: make(map[int]struct{})}
+
+func trackInFlight(jobID int) {
+	inFlight.Lock()
+	inFlight.ids[jobID] = struct{}{}
+	inFlight.Unlock()
+}
+
+func untrackInFlight(jobID int) {
+	inFlight.Lock()
+	delete(inFlight.ids, jobID)
+	inFlight.Unlock()
+}
+
+// releaseJob hands a claimed job back to the queue without consuming a
+// retry, used when the execution was interrupted by shutdown.
+func releaseJob(jobID int) {
+	if err := store.ReleaseJob(jobID); err != nil {
+		slog.Error("Failed to release job", "job_id", jobID, "error", err)
+		return
+	}
+
+	slog.Info("Released job back to pending", "job_id", jobID)
+}
+
+// releaseInFlightJobs re-marks every job still held by this process as
+// pending, so recovery does not have to wait for the processing timeout.
+func releaseInFlightJobs() {
+	inFlight.Lock()
+	ids := make([]int, 0, len(inFlight.ids))
+	for id := range inFlight.ids {
+		ids = append(ids, id)
+	}
+	inFlight.Unlock()
+
+	for _, id := range ids {
+		releaseJob(id)
+	}
+}
+
+// waitTimeout waits for wg, giving up after d. It reports whether wg finished.
+func waitTimeout(wg *sync.WaitGroup, d time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(d):
+		return false
+	}
+}
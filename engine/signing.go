@@ -0,0 +1,163 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ==================== SIGNED SUBMISSION ====================
+
+// Machine submitters can sign POST /jobs with a shared secret instead of
+// sending an API key, the way GoFlow signs its own webhooks:
+//
+//	X-GoFlow-Timestamp: 1718000000
+//	X-GoFlow-Signature: sha256=<hex HMAC-SHA256 of "<timestamp>.<body>">
+//
+// The secret never travels with the request, and a captured request stops
+// verifying after signatureTolerance. Within that window each signature is
+// accepted once; used ones are kept in used_signatures so this holds
+// across servers. A valid signature authenticates the request as its
+// signing key's tenant, under the key's own rate limit and quotas. With
+// require_signature, POST /jobs must be signed even when the caller has an
+// API key.
+
+// SigningKey is a shared secret a submitter signs POST /jobs with.
+type SigningKey struct {
+	Secret string `yaml:"secret"`
+	Tenant string `yaml:"tenant"`
+
+	// Name identifies the key in logs and usage; it defaults to the tenant
+	Name string `yaml:"name"`
+
+	// Limits on POST /jobs (see quotas.go); zero means unlimited
+	RateLimit    float64 `yaml:"rate_limit"`
+	Burst        int     `yaml:"burst"`
+	DailyQuota   int     `yaml:"daily_quota"`
+	MonthlyQuota int     `yaml:"monthly_quota"`
+}
+
+// signatureTolerance is how far a signed request's timestamp may be from
+// the server's clock.
+const signatureTolerance = 5 * time.Minute
+
+// withSignedSubmit verifies signed job submissions before withTenant
+// looks for an API key.
+func withSignedSubmit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if r.Method != http.MethodPost || r.URL.Path != "/jobs" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if r.Header.Get("X-GoFlow-Signature") == "" {
+			if cfg.RequireSignature {
+				http.Error(w, "Signature required", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Failed to read body", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		now := time.Now()
+		k, ok := verifySubmission(r.Header, body, now)
+		if !ok {
+			http.Error(w, "Invalid signature", http.StatusUnauthorized)
+			return
+		}
+
+		fresh, err := claimSignature(r.Header.Get("X-GoFlow-Signature"), now)
+		if err != nil {
+			http.Error(w, "Signature check failed", http.StatusInternalServerError)
+			return
+		}
+		if !fresh {
+			http.Error(w, "Signature already used; sign the request again", http.StatusUnauthorized)
+			return
+		}
+
+		key := APIKey{
+			Tenant:       k.Tenant,
+			Name:         k.Name,
+			RateLimit:    k.RateLimit,
+			Burst:        k.Burst,
+			DailyQuota:   k.DailyQuota,
+			MonthlyQuota: k.MonthlyQuota,
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiKeyContext{}, key)))
+	})
+}
+
+// verifySubmission returns the signing key that signed body, if any.
+func verifySubmission(h http.Header, body []byte, now time.Time) (SigningKey, bool) {
+
+	ts := h.Get("X-GoFlow-Timestamp")
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return SigningKey{}, false
+	}
+	if age := now.Sub(time.Unix(sec, 0)); age > signatureTolerance || age < -signatureTolerance {
+		return SigningKey{}, false
+	}
+
+	sig, err := hex.DecodeString(strings.TrimPrefix(h.Get("X-GoFlow-Signature"), "sha256="))
+	if err != nil {
+		return SigningKey{}, false
+	}
+
+	var match SigningKey
+	found := false
+	for _, k := range cfg.SigningKeys {
+		// Check every key, so timing does not reveal which one matched
+		mac := hmac.New(sha256.New, []byte(k.Secret))
+		mac.Write([]byte(ts + "."))
+		mac.Write(body)
+		if hmac.Equal(sig, mac.Sum(nil)) {
+			match, found = k, true
+		}
+	}
+	return match, found
+}
+
+// claimSignature records a verified signature as used. It reports false
+// when the signature was used before. Nothing signed at now can verify
+// after now plus twice the tolerance, so the record is kept that long.
+func claimSignature(header string, now time.Time) (bool, error) {
+
+	// Hex case does not change the signature
+	sig := strings.ToLower(strings.TrimPrefix(header, "sha256="))
+
+	res, err := db.Exec(`
+		INSERT INTO used_signatures (signature, expires_at)
+		VALUES ($1, $2)
+		ON CONFLICT (signature) DO NOTHING
+	`, sig, now.Add(2*signatureTolerance))
+	if err != nil {
+		return false, err
+	}
+
+	claimed, err := res.RowsAffected()
+	return claimed == 1, err
+}
+
+func pruneUsedSignatures() {
+	if _, err := db.Exec(`DELETE FROM used_signatures WHERE expires_at < NOW()`); err != nil {
+		slog.Error("Used signature cleanup failed", "error", err)
+	}
+}
@@ -0,0 +1,179 @@
+package engine
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// usedSignatures stands in for Postgres behind claimSignature. It only
+// understands the insert into used_signatures.
+type usedSignatures struct {
+	mu   sync.Mutex
+	seen map[string]bool
+}
+
+func (u *usedSignatures) Connect(context.Context) (driver.Conn, error) {
+	return usedSignaturesConn{u}, nil
+}
+
+func (u *usedSignatures) Driver() driver.Driver {
+	return u
+}
+
+func (u *usedSignatures) Open(string) (driver.Conn, error) {
+	return usedSignaturesConn{u}, nil
+}
+
+type usedSignaturesConn struct{ u *usedSignatures }
+
+func (usedSignaturesConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("not supported")
+}
+
+func (usedSignaturesConn) Close() error {
+	return nil
+}
+
+func (usedSignaturesConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("not supported")
+}
+
+func (c usedSignaturesConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+
+	if !strings.Contains(query, "INSERT INTO used_signatures") {
+		return nil, fmt.Errorf("unexpected query: %s", query)
+	}
+	sig := args[0].Value.(string)
+
+	c.u.mu.Lock()
+	defer c.u.mu.Unlock()
+	if c.u.seen[sig] {
+		return driver.RowsAffected(0), nil
+	}
+	c.u.seen[sig] = true
+	return driver.RowsAffected(1), nil
+}
+
+// useSigning configures keys and a fresh used-signature table for the test.
+func useSigning(t *testing.T, keys ...SigningKey) {
+	t.Helper()
+
+	oldDB, oldKeys := db, cfg.SigningKeys
+	t.Cleanup(func() { db, cfg.SigningKeys = oldDB, oldKeys })
+
+	db = sql.OpenDB(&usedSignatures{seen: map[string]bool{}})
+	cfg.SigningKeys = keys
+}
+
+func sign(secret string, ts int64, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.%s", ts, body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func signedHeader(ts int64, sig string) http.Header {
+	h := http.Header{}
+	h.Set("X-GoFlow-Timestamp", strconv.FormatInt(ts, 10))
+	h.Set("X-GoFlow-Signature", sig)
+	return h
+}
+
+func TestVerifySubmission(t *testing.T) {
+
+	useSigning(t,
+		SigningKey{Secret: "acme-secret", Tenant: "acme", Name: "acme"},
+		SigningKey{Secret: "globex-secret", Tenant: "globex", Name: "globex"},
+	)
+
+	now := time.Now()
+	ts := now.Unix()
+	body := `{"type":"http_request"}`
+
+	for _, tc := range []struct {
+		name   string
+		header http.Header
+		body   string
+		tenant string
+	}{
+		{"valid", signedHeader(ts, sign("acme-secret", ts, body)), body, "acme"},
+		{"second key", signedHeader(ts, sign("globex-secret", ts, body)), body, "globex"},
+		{"upper case hex", signedHeader(ts, "sha256="+strings.ToUpper(strings.TrimPrefix(sign("acme-secret", ts, body), "sha256="))), body, "acme"},
+		{"tampered body", signedHeader(ts, sign("acme-secret", ts, body)), body + " ", ""},
+		{"expired", signedHeader(ts-600, sign("acme-secret", ts-600, body)), body, ""},
+		{"from the future", signedHeader(ts+600, sign("acme-secret", ts+600, body)), body, ""},
+		{"wrong key", signedHeader(ts, sign("other-secret", ts, body)), body, ""},
+		{"timestamp not signed", signedHeader(ts, sign("acme-secret", ts-1, body)), body, ""},
+		{"non-hex signature", signedHeader(ts, "sha256=not-hex"), body, ""},
+		{"no timestamp", http.Header{"X-Goflow-Signature": {sign("acme-secret", ts, body)}}, body, ""},
+	} {
+		k, ok := verifySubmission(tc.header, []byte(tc.body), now)
+		if ok != (tc.tenant != "") || k.Tenant != tc.tenant {
+			t.Errorf("%s: got %q, %v; want %q", tc.name, k.Tenant, ok, tc.tenant)
+		}
+	}
+}
+
+func TestClaimSignature(t *testing.T) {
+
+	useSigning(t)
+	now := time.Now()
+
+	for _, tc := range []struct {
+		name, header string
+		fresh        bool
+	}{
+		{"first use", "sha256=abc123", true},
+		{"replayed", "sha256=abc123", false},
+		{"replayed in upper case", "sha256=ABC123", false},
+		{"replayed without prefix", "abc123", false},
+		{"another signature", "sha256=def456", true},
+	} {
+		fresh, err := claimSignature(tc.header, now)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if fresh != tc.fresh {
+			t.Errorf("%s: fresh = %v, want %v", tc.name, fresh, tc.fresh)
+		}
+	}
+}
+
+func TestSignedSubmitRejectsReplay(t *testing.T) {
+
+	useSigning(t, SigningKey{Secret: "acme-secret", Tenant: "acme", Name: "acme"})
+
+	var tenants []string
+	handler := withSignedSubmit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenants = append(tenants, tenantOf(r))
+	}))
+
+	ts := time.Now().Unix()
+	body := `{"type":"http_request"}`
+	header := signedHeader(ts, sign("acme-secret", ts, body))
+
+	for i, want := range []int{http.StatusOK, http.StatusUnauthorized} {
+		req := httptest.NewRequest("POST", "/jobs", strings.NewReader(body))
+		req.Header = header.Clone()
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Errorf("submission %d: got %d, want %d", i+1, rec.Code, want)
+		}
+	}
+	if len(tenants) != 1 || tenants[0] != "acme" {
+		t.Errorf("handler saw tenants %v, want one acme submission", tenants)
+	}
+}
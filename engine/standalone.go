@@ -0,0 +1,303 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"goflow/jobs"
+)
+
+// ==================== STANDALONE (SQLITE, MEMORY) ====================
+//
+// With a "sqlite:" database_url the server keeps its queue in one SQLite
+// file and needs nothing else running, for local development and small
+// single-server deployments:
+//
+//	database_url: "sqlite:goflow.db"
+//
+// With store: memory (or -store=memory) it keeps the queue in memory
+// instead, for tests and demos; jobs are gone when it stops.
+//
+// Either way it runs the workers and the core job API: POST /jobs, GET /jobs,
+// GET /jobs/{id}, the health probes and /metrics. Only the workers go
+// through the Store; everything else is built on Postgres and is off:
+// workflows, schedules, batches, unique jobs, hooks and callbacks, the
+// dead-letter queue, agents, secrets, quotas, signed submission,
+// retention and the admin endpoints. So are the job types that keep state
+// in Postgres (jobs.NeedsDatabase), among them every effectively-once type
+// such as send_email. Submissions that need one of those are rejected
+// rather than silently half-run, the endpoints answer 501, and config
+// that turns them on stops the server at startup (Config.validate).
+//
+// Without LISTEN/NOTIFY, idle workers poll the store every
+// disconnectedPoll; jobs submitted to this server wake them at once.
+
+// errNeedsPostgres marks requests standalone mode cannot serve.
+var errNeedsPostgres = errors.New("not available without Postgres")
+
+// localStore is a Store standalone mode can run on: it also takes
+// submissions and expires jobs, which Postgres mode does elsewhere.
+type localStore interface {
+	Store
+	InsertJob(job Job) (Job, error)
+	expireJobs() (int64, error)
+	ping(ctx context.Context) error
+}
+
+// localDB is the store in standalone mode; nil otherwise.
+var localDB localStore
+
+// openSQLite opens the store for a "sqlite:" database_url.
+func openSQLite(path string) (*sqliteStore, error) {
+
+	st, err := openSQLiteStore(path)
+	if err != nil {
+		return nil, fmt.Errorf("open SQLite database: %w", err)
+	}
+
+	if n, err := st.requeueProcessing(); err != nil {
+		st.db.Close()
+		return nil, fmt.Errorf("requeue interrupted jobs: %w", err)
+	} else if n > 0 {
+		slog.Warn("Requeued jobs interrupted by the last shutdown", "jobs", n)
+	}
+
+	slog.Info("Database ready", "sqlite", path)
+	return st, nil
+}
+
+// standaloneMux routes the part of the API standalone mode serves.
+func standaloneMux() *http.ServeMux {
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/health", healthHandler)
+	mux.HandleFunc("/healthz", healthHandler)
+	mux.HandleFunc("/readyz", readyHandler)
+	mux.HandleFunc("/jobs", standaloneJobsHandler)
+	mux.HandleFunc("/jobs/", standaloneJobDetailHandler)
+	mux.HandleFunc("/job-types", jobTypesHandler)
+	mux.HandleFunc("/openapi.json", openapiHandler)
+	mux.HandleFunc("/hooks/", inboundHookHandler)
+	mux.Handle("/metrics", metricsHandler())
+	mux.HandleFunc("/", standaloneFallback)
+
+	return mux
+}
+
+// standaloneFallback answers what standaloneMux does not serve: 501 for
+// an operation of the Postgres API, 404 for anything else.
+func standaloneFallback(w http.ResponseWriter, r *http.Request) {
+
+	if op, ok := postgresOperation(r); ok {
+		http.Error(w, strings.ToUpper(op.method)+" "+op.path+" is "+errNeedsPostgres.Error(), http.StatusNotImplemented)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// postgresOperation finds the Postgres-only API operation r asks for.
+// The most literal path wins, as in http.ServeMux, and operations
+// standalone mode serves in a smaller form do not count.
+func postgresOperation(r *http.Request) (apiOperation, bool) {
+
+	var best *apiOperation
+	for i := range apiOperations {
+		op := &apiOperations[i]
+		if !strings.EqualFold(op.method, r.Method) || !pathMatches(op.path, r.URL.Path) {
+			continue
+		}
+
+		switch {
+		case best == nil, strings.Count(op.path, "{") < strings.Count(best.path, "{"):
+			best = op
+		case op.path == best.path && op.served != postgresOnly:
+			best = op
+		}
+	}
+
+	if best == nil || best.served != postgresOnly {
+		return apiOperation{}, false
+	}
+	return *best, true
+}
+
+// pathMatches reports whether path fits pattern, a path with {param}
+// segments.
+func pathMatches(pattern, path string) bool {
+
+	want := strings.Split(strings.Trim(pattern, "/"), "/")
+	got := strings.Split(strings.Trim(path, "/"), "/")
+	if len(want) != len(got) {
+		return false
+	}
+
+	for i, p := range want {
+		if !strings.HasPrefix(p, "{") && p != got[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// startLocalExpiryLoop does expireJobs' work for the standalone store.
+func startLocalExpiryLoop(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	ticker := time.NewTicker(15 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info("Expiry loop shutting down")
+			return
+		case <-ticker.C:
+			n, err := localDB.expireJobs()
+			if err != nil {
+				slog.Error("Expiring jobs failed", "error", err)
+			} else if n > 0 {
+				slog.Info("Expired jobs", "jobs", n)
+			}
+		}
+	}
+}
+
+// standaloneUnsupported names the first feature req uses that needs
+// Postgres, if any.
+func standaloneUnsupported(req Job) error {
+
+	switch {
+	case jobs.NeedsDatabase(req.Type):
+		return fmt.Errorf("job type %s: %w", req.Type, errNeedsPostgres)
+	case req.UniqueKey != "":
+		return fmt.Errorf("'unique_key': %w", errNeedsPostgres)
+	case req.BatchID != "":
+		return fmt.Errorf("'batch_id': %w", errNeedsPostgres)
+	}
+
+	for _, field := range append([]string{"workflow_id", "callback_url"}, hookFields...) {
+		if _, ok := req.Payload[field]; ok {
+			return fmt.Errorf("'%s': %w", field, errNeedsPostgres)
+		}
+	}
+	return nil
+}
+
+// standaloneSubmit is submitJob for the standalone store.
+func standaloneSubmit(w http.ResponseWriter, req Job) {
+
+	job, err := enqueueLocalJob(req)
+	if err != nil {
+		writeSubmitError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(job.redacted())
+}
+
+// enqueueLocalJob is enqueueJob for the standalone store.
+func enqueueLocalJob(req Job) (Job, error) {
+
+	if err := standaloneUnsupported(req); err != nil {
+		return Job{}, refuse(http.StatusBadRequest, err.Error())
+	}
+
+	if err := validateJob(&req); err != nil {
+		return Job{}, err
+	}
+
+	job, err := localDB.InsertJob(req)
+	if err != nil {
+		return Job{}, fmt.Errorf("insert job: %w", err)
+	}
+	jobsEnqueued.WithLabelValues(job.Type).Inc()
+	wakeWaiters()
+
+	job.OnConflict = ""
+	return job, nil
+}
+
+func standaloneJobsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+
+	case http.MethodPost:
+		var req Job
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		req.TenantID = tenantOf(r)
+
+		standaloneSubmit(w, req)
+
+	case http.MethodGet:
+		if r.URL.Query().Has("fields") || r.URL.Query().Has("include") {
+			http.Error(w, "'fields' and 'include': "+errNeedsPostgres.Error(), http.StatusBadRequest)
+			return
+		}
+
+		filter, err := parseJobFilter(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		filter.add("tenant_id = ?", tenantOf(r))
+
+		jobs, err := store.ListJobs(filter)
+		if errors.Is(err, errNeedsPostgres) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Query failed", http.StatusInternalServerError)
+			return
+		}
+		for i := range jobs {
+			jobs[i] = jobs[i].redacted()
+		}
+
+		json.NewEncoder(w).Encode(jobs)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// standaloneJobDetailHandler serves GET /jobs/{id}.
+func standaloneJobDetailHandler(w http.ResponseWriter, r *http.Request) {
+
+	jobID, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/jobs/"))
+	if err != nil || r.Method != http.MethodGet {
+		if _, ok := postgresOperation(r); ok {
+			standaloneFallback(w, r)
+			return
+		}
+	}
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Invalid job id", http.StatusBadRequest)
+		return
+	}
+
+	// Another tenant's job looks exactly like a missing one
+	job, err := store.GetJob(jobID)
+	if err != nil || job.TenantID != tenantOf(r) {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	json.NewEncoder(w).Encode(job.redacted())
+}
@@ -0,0 +1,54 @@
+package engine
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStandaloneRejectsPostgresEndpoints(t *testing.T) {
+
+	useMemoryStore(t)
+	localDB = store.(*memoryStore)
+	t.Cleanup(func() { localDB = nil })
+
+	mux := standaloneMux()
+
+	for _, tc := range []struct {
+		method, path string
+		want         int
+	}{
+		{"GET", "/jobs", http.StatusOK},
+		{"GET", "/jobs/1", http.StatusNotFound},
+		{"GET", "/jobs/abc", http.StatusBadRequest},
+		{"PATCH", "/jobs/1", http.StatusNotImplemented},
+		{"POST", "/jobs/1/retry", http.StatusNotImplemented},
+		{"GET", "/jobs/stats", http.StatusNotImplemented},
+		{"GET", "/workflows", http.StatusNotImplemented},
+		{"DELETE", "/webhooks/subscriptions/3", http.StatusNotImplemented},
+		{"GET", "/no-such-thing", http.StatusNotFound},
+	} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(tc.method, tc.path, nil))
+		if rec.Code != tc.want {
+			t.Errorf("%s %s: got %d, want %d", tc.method, tc.path, rec.Code, tc.want)
+		}
+	}
+}
+
+func TestStandaloneConfigNeedsPostgres(t *testing.T) {
+
+	for name, change := range map[string]func(*Config){
+		"signing_keys": func(c *Config) { c.SigningKeys = []SigningKey{{Secret: "s", Tenant: "t", Name: "t"}} },
+		"quota":        func(c *Config) { c.APIKeys = []APIKey{{Key: "k", Tenant: "t", Name: "t", DailyQuota: 10}} },
+		"retention":    func(c *Config) { c.Retention = 1 },
+		"archive":      func(c *Config) { c.Archive = true },
+	} {
+		c := DefaultConfig()
+		c.Store = "memory"
+		change(&c)
+		if err := c.validate(); err == nil {
+			t.Errorf("%s on the memory store: no error", name)
+		}
+	}
+}
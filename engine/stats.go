@@ -0,0 +1,79 @@
+package engine
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// ==================== STATS ====================
+
+// jobStatsGroups maps a group_by value to the expression it groups on.
+// Tags are unnested, so a job with two tags counts towards both.
+var jobStatsGroups = map[string]string{
+	"status": "status",
+	"type":   "type",
+	"queue":  "queue",
+	"tag":    "unnest(tags)",
+}
+
+// jobStatsHandler serves GET /jobs/stats?group_by=tag, counting jobs per
+// group and status. It accepts the same filters as GET /jobs.
+func jobStatsHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	groupBy := r.URL.Query().Get("group_by")
+	if groupBy == "" {
+		groupBy = "status"
+	}
+
+	expr, ok := jobStatsGroups[groupBy]
+	if !ok {
+		http.Error(w, "group_by must be one of status, type, queue, tag", http.StatusBadRequest)
+		return
+	}
+
+	filter, err := parseJobFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter.add("tenant_id = ?", tenantOf(r))
+
+	rows, err := db.Query(`
+		SELECT grp, status, COUNT(*)
+		FROM (SELECT `+expr+` AS grp, status FROM `+filter.from()+` `+filter.where()+`) j
+		GROUP BY grp, status
+		ORDER BY grp, status
+	`, filter.args...)
+	if err != nil {
+		http.Error(w, "Query failed", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	stats := map[string]map[string]int{}
+
+	for rows.Next() {
+		var group, status string
+		var count int
+
+		if err := rows.Scan(&group, &status, &count); err != nil {
+			http.Error(w, "Scan failed", http.StatusInternalServerError)
+			return
+		}
+
+		if stats[group] == nil {
+			stats[group] = map[string]int{}
+		}
+		stats[group][status] = count
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"group_by": groupBy,
+		"groups":   stats,
+	})
+}
@@ -0,0 +1,105 @@
+package engine
+
+import (
+	"time"
+
+	"goflow/jobs"
+)
+
+// ==================== STORE ====================
+//
+// Store is the job lifecycle as the workers and agent sessions see it:
+// claiming, heartbeats, and recording each outcome. Workers only talk to
+// the queue through it, so another backend, or a fake in a test, only has
+// to implement these methods. pgStore (store_postgres.go) is the default.
+//
+// Only this lifecycle is behind the interface. The API handlers,
+// workflows, maintenance loops and the jobs package still query Postgres
+// directly, which is why SQLite and memory serve only the core job API
+// (see standalone.go).
+
+type Store interface {
+	// ClaimJobs marks up to req.Limit runnable jobs as processing by
+	// req.Worker and returns them in claim order.
+	ClaimJobs(req ClaimRequest) ([]ClaimedJob, error)
+
+	// GetJob loads one job.
+	GetJob(id int) (Job, error)
+
+	// ListJobs returns the jobs matching filter, in id order.
+	ListJobs(filter *jobFilter) ([]Job, error)
+
+	// Heartbeat tells recovery that a processing job is still running.
+	Heartbeat(id int) error
+
+	// ReleaseJob puts a processing job back in the queue without using up
+	// an attempt.
+	ReleaseJob(id int) error
+
+	// CancelJob marks a claimed job cancelled, without callbacks, when its
+	// workflow was cancelled before it ran.
+	CancelJob(id int, reason string) error
+
+	// RecordAttempt stores a failed attempt's error and, unless the
+	// outcome is unknown, its response.
+	RecordAttempt(id int, a Attempt) error
+
+	// RetryState returns how many attempts the job has used and its retry
+	// policy.
+	RetryState(id int) (RetryState, error)
+
+	// ScheduleRetry counts an attempt and makes the job runnable again
+	// after delay.
+	ScheduleRetry(id int, delay time.Duration) error
+
+	// DeferJob makes the job runnable again after delay without counting
+	// an attempt.
+	DeferJob(id int, reason string, delay time.Duration) error
+
+	// CompleteJob marks the job completed. Its follow-up jobs, hooks and
+	// callbacks are stored atomically with it.
+	CompleteJob(job Job, a Attempt, followUps []jobs.FollowUp) error
+
+	// FailJob marks the job failed for good, with the same guarantees.
+	FailJob(job Job) error
+}
+
+// ClaimRequest selects the jobs ClaimJobs may take.
+type ClaimRequest struct {
+	Queues []string
+	// Types limits the claim to these types; empty means any
+	Types     []string
+	SkipTypes []string
+	Limit     int
+	Worker    string
+}
+
+type ClaimedJob struct {
+	ID   int
+	Type string
+}
+
+// Attempt is the outcome of one execution.
+type Attempt struct {
+	StatusCode int
+	Body       []byte
+	DurationMs int64
+	Error      string
+
+	// OutcomeUnknown means the executor cannot tell whether the work
+	// happened, so there is no response to keep
+	OutcomeUnknown bool
+}
+
+// RetryState is a job's retry count and its own retry policy; nil fields
+// fall back to the type's.
+type RetryState struct {
+	RetryCount int
+	Limit      int
+	Backoff    *string
+	BaseDelay  *time.Duration
+	MaxDelay   *time.Duration
+}
+
+// store is the backend the workers use.
+var store Store
@@ -0,0 +1,436 @@
+package engine
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"goflow/jobs"
+	"goflow/routing"
+)
+
+// memoryStore keeps the queue in the server's memory, for tests and demos
+// that should not need a database (see standalone.go). Nothing survives a
+// restart.
+type memoryStore struct {
+	mu     sync.Mutex
+	nextID int
+	jobs   map[int]*memoryJob
+}
+
+// memoryJob is a stored job with the columns the API does not show.
+type memoryJob struct {
+	Job
+	retryCount      int
+	claimedBy       string
+	lastError       *string
+	responseStatus  int
+	responseBody    []byte
+	executionTimeMs int64
+	createdAt       time.Time
+	updatedAt       time.Time
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{jobs: map[int]*memoryJob{}}
+}
+
+func (s *memoryStore) ping(ctx context.Context) error {
+	return nil
+}
+
+// copyJob returns j's job with a payload of its own, as a database read
+// would, so executors cannot change the stored one.
+func (j *memoryJob) copyJob() Job {
+
+	job := j.Job
+	job.Tags = slices.Clone(j.Tags)
+	job.Sensitive = slices.Clone(j.Sensitive)
+
+	if j.Payload != nil {
+		b, _ := json.Marshal(j.Payload)
+		job.Payload = nil
+		json.Unmarshal(b, &job.Payload)
+	}
+	return job
+}
+
+// retryLimit is the job's max_retries, or the default.
+func (j *memoryJob) retryLimit() int {
+	if j.MaxRetries != nil {
+		return *j.MaxRetries
+	}
+	return maxRetries
+}
+
+// find returns the job with id; s.mu must be held.
+func (s *memoryStore) find(id int) (*memoryJob, error) {
+	j, ok := s.jobs[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return j, nil
+}
+
+// insert stores job as a new pending job; s.mu must be held.
+func (s *memoryStore) insert(job Job) Job {
+
+	now := time.Now()
+
+	s.nextID++
+	job.ID = s.nextID
+	if job.RunAt.IsZero() {
+		job.RunAt = now
+	}
+	if job.Tags == nil {
+		job.Tags = []string{}
+	}
+	job.OnConflict = ""
+
+	j := &memoryJob{Job: job, createdAt: now, updatedAt: now}
+	s.jobs[job.ID] = j
+	return j.copyJob()
+}
+
+// InsertJob stores a job prepared by prepareJob and returns it with its
+// id and run_at.
+func (s *memoryStore) InsertJob(job Job) (Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.insert(job), nil
+}
+
+// expireJobs marks pending jobs past their expires_at as expired.
+func (s *memoryStore) expireJobs() (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	reason := "expired before it could run"
+
+	var n int64
+	for _, j := range s.jobs {
+		if j.Status == "pending" && j.ExpiresAt != nil && !j.ExpiresAt.After(now) {
+			j.Status = "expired"
+			j.lastError = &reason
+			j.updatedAt = now
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *memoryStore) ClaimJobs(req ClaimRequest) ([]ClaimedJob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	var ready []*memoryJob
+	for _, j := range s.jobs {
+		switch {
+		case j.Status != "pending",
+			j.retryCount >= j.retryLimit(),
+			j.RunAt.After(now),
+			!slices.Contains(req.Queues, j.Queue),
+			len(req.Types) > 0 && !slices.Contains(req.Types, j.Type),
+			slices.Contains(req.SkipTypes, j.Type),
+			j.ExpiresAt != nil && !j.ExpiresAt.After(now):
+			continue
+		}
+		ready = append(ready, j)
+	}
+
+	sort.Slice(ready, func(a, b int) bool {
+		x, y := ready[a], ready[b]
+		if x.Priority != y.Priority {
+			return x.Priority > y.Priority
+		}
+		if !x.RunAt.Equal(y.RunAt) {
+			return x.RunAt.Before(y.RunAt)
+		}
+		return x.ID < y.ID
+	})
+
+	if len(ready) > req.Limit {
+		ready = ready[:req.Limit]
+	}
+
+	claimed := make([]ClaimedJob, len(ready))
+	for i, j := range ready {
+		j.Status = "processing"
+		j.claimedBy = req.Worker
+		j.updatedAt = now
+		claimed[i] = ClaimedJob{ID: j.ID, Type: j.Type}
+	}
+	return claimed, nil
+}
+
+func (s *memoryStore) GetJob(id int) (Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, err := s.find(id)
+	if err != nil {
+		return Job{}, err
+	}
+	return j.copyJob(), nil
+}
+
+// memoryClause is the one shape of filter clause ListJobs evaluates:
+// a column compared with a parameter.
+var memoryClause = regexp.MustCompile(`^(\w+) (=|>=|<) \$(\d+)$`)
+
+func (s *memoryStore) ListJobs(filter *jobFilter) ([]Job, error) {
+
+	if filter.archived {
+		return nil, fmt.Errorf("include_archived: %w", errNeedsPostgres)
+	}
+
+	type condition struct {
+		column, op string
+		arg        interface{}
+	}
+
+	var conds []condition
+	for _, clause := range filter.clauses {
+		m := memoryClause.FindStringSubmatch(clause)
+		if m == nil {
+			return nil, fmt.Errorf("tag and payload filters: %w", errNeedsPostgres)
+		}
+		n, _ := strconv.Atoi(m[3])
+		conds = append(conds, condition{m[1], m[2], filter.args[n-1]})
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := []Job{}
+	for _, j := range s.jobs {
+		match := true
+		for _, c := range conds {
+			if !j.matches(c.column, c.op, c.arg) {
+				match = false
+				break
+			}
+		}
+		if match {
+			list = append(list, j.copyJob())
+		}
+	}
+
+	sort.Slice(list, func(a, b int) bool { return list[a].ID < list[b].ID })
+	return list, nil
+}
+
+// matches evaluates one filter condition against the job.
+func (j *memoryJob) matches(column, op string, arg interface{}) bool {
+
+	if column == "created_at" {
+		t, _ := arg.(time.Time)
+		if op == "<" {
+			return j.createdAt.Before(t)
+		}
+		return !j.createdAt.Before(t)
+	}
+
+	var value string
+	switch column {
+	case "status":
+		value = j.Status
+	case "type":
+		value = j.Type
+	case "queue":
+		value = j.Queue
+	case "batch_id":
+		value = j.BatchID
+	case "tenant_id":
+		value = j.TenantID
+	default:
+		return false
+	}
+	return value == arg
+}
+
+func (s *memoryStore) Heartbeat(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if j, ok := s.jobs[id]; ok && j.Status == "processing" {
+		j.updatedAt = time.Now()
+	}
+	return nil
+}
+
+func (s *memoryStore) ReleaseJob(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if j, ok := s.jobs[id]; ok && j.Status == "processing" {
+		j.Status = "pending"
+		j.updatedAt = time.Now()
+	}
+	return nil
+}
+
+func (s *memoryStore) CancelJob(id int, reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, err := s.find(id)
+	if err != nil {
+		return err
+	}
+	j.Status = "cancelled"
+	j.lastError = &reason
+	j.updatedAt = time.Now()
+	return nil
+}
+
+func (s *memoryStore) RecordAttempt(id int, a Attempt) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, err := s.find(id)
+	if err != nil {
+		return err
+	}
+
+	j.lastError = &a.Error
+	if !a.OutcomeUnknown {
+		j.responseStatus = a.StatusCode
+		j.responseBody = a.Body
+		j.executionTimeMs = a.DurationMs
+	}
+	j.updatedAt = time.Now()
+	return nil
+}
+
+func (s *memoryStore) RetryState(id int) (RetryState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, err := s.find(id)
+	if err != nil {
+		return RetryState{}, err
+	}
+
+	st := RetryState{RetryCount: j.retryCount, Limit: j.retryLimit()}
+
+	if j.Backoff != "" {
+		backoff := j.Backoff
+		st.Backoff = &backoff
+	}
+	if j.BaseDelaySeconds != nil {
+		d := time.Duration(*j.BaseDelaySeconds) * time.Second
+		st.BaseDelay = &d
+	}
+	if j.MaxDelaySeconds != nil {
+		d := time.Duration(*j.MaxDelaySeconds) * time.Second
+		st.MaxDelay = &d
+	}
+	return st, nil
+}
+
+func (s *memoryStore) ScheduleRetry(id int, delay time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, err := s.find(id)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	j.Status = "pending"
+	j.retryCount++
+	j.RunAt = now.Add(delay.Truncate(time.Second))
+	j.updatedAt = now
+	return nil
+}
+
+func (s *memoryStore) DeferJob(id int, reason string, delay time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, err := s.find(id)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	j.Status = "pending"
+	j.lastError = &reason
+	j.RunAt = now.Add(delay)
+	j.updatedAt = now
+	return nil
+}
+
+// CompleteJob stores the completion and the job's follow-up jobs. Hooks,
+// callbacks and batches need Postgres; standalone mode rejects jobs that
+// use them.
+func (s *memoryStore) CompleteJob(job Job, a Attempt, followUps []jobs.FollowUp) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, err := s.find(job.ID)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	j.Status = "completed"
+	j.responseStatus = a.StatusCode
+	j.responseBody = a.Body
+	j.executionTimeMs = a.DurationMs
+	j.lastError = nil
+	j.updatedAt = now
+
+	for _, f := range followUps {
+
+		var payload map[string]interface{}
+		json.Unmarshal(f.Payload, &payload)
+
+		runAt := now.Add(time.Duration(f.DelaySeconds) * time.Second)
+		if f.RunAt != nil {
+			runAt = *f.RunAt
+		}
+
+		tenant := f.Tenant
+		if tenant == "" {
+			tenant = defaultTenant
+		}
+
+		s.insert(Job{
+			Type:     f.Type,
+			Payload:  payload,
+			Status:   "pending",
+			RunAt:    runAt,
+			Queue:    routing.GroupFor(f.Type, payload, ""),
+			Tags:     f.Tags,
+			TenantID: tenant,
+		})
+	}
+	return nil
+}
+
+// FailJob marks the job failed. There is no dead-letter queue without
+// Postgres; failed jobs stay listed under status=failed.
+func (s *memoryStore) FailJob(job Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, err := s.find(job.ID)
+	if err != nil {
+		return err
+	}
+	j.Status = "failed"
+	j.retryCount++
+	j.updatedAt = time.Now()
+	return nil
+}
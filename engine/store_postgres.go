@@ -0,0 +1,295 @@
+package engine
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+
+	"goflow/jobs"
+)
+
+// pgStore is the Postgres Store. Claims use FOR UPDATE SKIP LOCKED so any
+// number of servers and agents can share the queue.
+type pgStore struct {
+	db *sql.DB
+}
+
+func newPGStore(db *sql.DB) *pgStore {
+	return &pgStore{db: db}
+}
+
+func (s *pgStore) ClaimJobs(req ClaimRequest) ([]ClaimedJob, error) {
+
+	rows, err := s.db.Query(`
+		WITH claimed AS (
+			UPDATE jobs
+			SET status = 'processing',
+			    claimed_by = $4,
+			    updated_at = NOW()
+			WHERE id IN (
+				SELECT id FROM jobs
+				WHERE status = 'pending'
+				AND retry_count < COALESCE(max_retries, $1)
+				AND run_at <= NOW()
+				AND queue = ANY($2)
+				AND (cardinality($5::text[]) = 0 OR type = ANY($5))
+				AND type <> ALL($6)
+				AND (expires_at IS NULL OR expires_at > NOW())
+				AND `+notPausedSQL+`
+				ORDER BY priority DESC, run_at, id
+				LIMIT $3
+				FOR UPDATE SKIP LOCKED
+			)
+			RETURNING id, type, priority, run_at
+		)
+		SELECT id, type FROM claimed
+		ORDER BY priority DESC, run_at, id
+	`, maxRetries, pq.Array(req.Queues), req.Limit, req.Worker, pq.Array(req.Types), pq.Array(req.SkipTypes))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var claimed []ClaimedJob
+	for rows.Next() {
+		var c ClaimedJob
+		if err := rows.Scan(&c.ID, &c.Type); err != nil {
+			return nil, err
+		}
+		claimed = append(claimed, c)
+	}
+	return claimed, rows.Err()
+}
+
+func (s *pgStore) GetJob(id int) (Job, error) {
+	return scanJob(s.db.QueryRow(`
+		SELECT `+jobColumns+`
+		FROM jobs
+		WHERE id = $1
+	`, id))
+}
+
+func (s *pgStore) ListJobs(filter *jobFilter) ([]Job, error) {
+
+	rows, err := s.db.Query(`
+		SELECT `+jobColumns+`
+		FROM `+filter.from()+`
+		`+filter.where()+`
+		ORDER BY id
+	`, filter.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []Job
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, job)
+	}
+	return list, rows.Err()
+}
+
+func (s *pgStore) Heartbeat(id int) error {
+	_, err := s.db.Exec(`
+		UPDATE jobs
+		SET updated_at = NOW()
+		WHERE id = $1
+		AND status = 'processing'
+	`, id)
+	return err
+}
+
+func (s *pgStore) ReleaseJob(id int) error {
+	_, err := s.db.Exec(`
+		UPDATE jobs
+		SET status = 'pending',
+		    updated_at = NOW()
+		WHERE id = $1
+		AND status = 'processing'
+	`, id)
+	return err
+}
+
+func (s *pgStore) CancelJob(id int, reason string) error {
+	_, err := s.db.Exec(`
+		UPDATE jobs
+		SET status = 'cancelled',
+		    last_error = $2,
+		    updated_at = NOW()
+		WHERE id = $1
+	`, id, reason)
+	return err
+}
+
+// attemptErrorSQL is the attempt_errors entry for a failed attempt, built
+// from last_error ($2) and response status ($3).
+const attemptErrorSQL = `jsonb_build_array(jsonb_build_object(
+	'attempt', retry_count + 1, 'error', $2::text, 'status', $3::int, 'at', NOW()))`
+
+func (s *pgStore) RecordAttempt(id int, a Attempt) error {
+
+	if a.OutcomeUnknown {
+		_, err := s.db.Exec(`
+			UPDATE jobs
+			SET last_error = $2,
+			    attempt_errors = attempt_errors || `+attemptErrorSQL+`,
+			    updated_at = NOW()
+			WHERE id = $1
+		`, id, a.Error, nil)
+		return err
+	}
+
+	_, err := s.db.Exec(`
+		UPDATE jobs
+		SET last_error = $2,
+		    response_status = $3,
+		    response_body = $4,
+		    execution_time_ms = $5,
+		    attempt_errors = attempt_errors || `+attemptErrorSQL+`,
+		    updated_at = NOW()
+		WHERE id = $1
+	`, id, a.Error, a.StatusCode, a.Body, a.DurationMs)
+	return err
+}
+
+func (s *pgStore) RetryState(id int) (RetryState, error) {
+
+	var st RetryState
+	var backoff sql.NullString
+	var baseSeconds, maxDelaySeconds sql.NullInt64
+
+	err := s.db.QueryRow(`
+		SELECT retry_count, COALESCE(max_retries, $2), backoff, base_delay_seconds, max_delay_seconds
+		FROM jobs WHERE id = $1
+	`, id, maxRetries).Scan(&st.RetryCount, &st.Limit, &backoff, &baseSeconds, &maxDelaySeconds)
+	if err != nil {
+		return st, err
+	}
+
+	if backoff.Valid {
+		st.Backoff = &backoff.String
+	}
+	if baseSeconds.Valid {
+		d := time.Duration(baseSeconds.Int64) * time.Second
+		st.BaseDelay = &d
+	}
+	if maxDelaySeconds.Valid {
+		d := time.Duration(maxDelaySeconds.Int64) * time.Second
+		st.MaxDelay = &d
+	}
+	return st, nil
+}
+
+func (s *pgStore) ScheduleRetry(id int, delay time.Duration) error {
+	_, err := s.db.Exec(`
+		UPDATE jobs
+		SET status = 'pending',
+		    retry_count = retry_count + 1,
+		    run_at = NOW() + ($2 || ' seconds')::interval,
+		    updated_at = NOW()
+		WHERE id = $1
+	`, id, int(delay.Seconds()))
+	return err
+}
+
+func (s *pgStore) DeferJob(id int, reason string, delay time.Duration) error {
+
+	// Whole seconds, rounded up: never earlier than asked
+	seconds := int((delay + time.Second - 1) / time.Second)
+
+	_, err := s.db.Exec(`
+		UPDATE jobs
+		SET status = 'pending',
+		    last_error = $2,
+		    run_at = NOW() + ($3 || ' seconds')::interval,
+		    updated_at = NOW()
+		WHERE id = $1
+	`, id, reason, seconds)
+	return err
+}
+
+func (s *pgStore) CompleteJob(job Job, a Attempt, followUps []jobs.FollowUp) error {
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE jobs
+		SET status = 'completed',
+		    response_status = $2,
+		    response_body = $3,
+		    execution_time_ms = $4,
+		    last_error = NULL,
+		    updated_at = NOW()
+		WHERE id = $1
+	`, job.ID, a.StatusCode, a.Body, a.DurationMs)
+
+	if err != nil {
+		return err
+	}
+
+	if err := jobs.InsertFollowUps(tx, followUps); err != nil {
+		return err
+	}
+
+	if err := enqueueHook(tx, job, "on_success"); err != nil {
+		return err
+	}
+
+	if err := enqueueCallback(tx, job.ID, job.Payload); err != nil {
+		return err
+	}
+
+	if err := enqueueBatchCallback(tx, job); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *pgStore) FailJob(job Job) error {
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE jobs
+		SET status = 'failed',
+		    retry_count = retry_count + 1,
+		    updated_at = NOW()
+		WHERE id = $1
+	`, job.ID)
+
+	if err != nil {
+		return err
+	}
+
+	if err := deadLetter(tx, job.ID); err != nil {
+		return err
+	}
+
+	if err := enqueueHook(tx, job, "on_failure"); err != nil {
+		return err
+	}
+
+	if err := enqueueCallback(tx, job.ID, job.Payload); err != nil {
+		return err
+	}
+
+	if err := enqueueBatchCallback(tx, job); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,478 @@
+package engine
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	_ "modernc.org/sqlite"
+
+	"goflow/jobs"
+	"goflow/routing"
+)
+
+// sqliteStore keeps the queue in a single SQLite file, for deployments
+// small enough to run one server (see standalone.go). Claims are a single
+// UPDATE ... RETURNING; SQLite lets one writer in at a time and the busy
+// timeout makes the others wait their turn instead of failing.
+//
+// Times are stored as UTC text in sqliteTimeLayout, which sorts the same
+// way as the times themselves. Tags and sensitive paths use Postgres array
+// syntax so scanJob reads rows of either backend.
+type sqliteStore struct {
+	db *sql.DB
+}
+
+const (
+	sqliteTimeLayout  = "2006-01-02 15:04:05.000"
+	sqliteBusyTimeout = 5 * time.Second
+
+	// sqliteNow is the current time in sqliteTimeLayout
+	sqliteNow = `strftime('%Y-%m-%d %H:%M:%f', 'now')`
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS jobs (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	type TEXT NOT NULL,
+	payload TEXT,
+	status TEXT NOT NULL,
+	retry_count INTEGER NOT NULL DEFAULT 0,
+	run_at TIMESTAMP NOT NULL,
+	last_error TEXT,
+	response_status INTEGER,
+	response_body TEXT,
+	execution_time_ms INTEGER,
+	created_at TIMESTAMP NOT NULL,
+	updated_at TIMESTAMP NOT NULL,
+	queue TEXT NOT NULL DEFAULT 'default',
+	tags TEXT NOT NULL DEFAULT '{}',
+	max_retries INTEGER,
+	backoff TEXT,
+	base_delay_seconds INTEGER,
+	max_delay_seconds INTEGER,
+	expires_at TIMESTAMP,
+	attempt_errors TEXT NOT NULL DEFAULT '[]',
+	timeout_seconds INTEGER,
+	claimed_by TEXT,
+	sensitive TEXT,
+	tenant_id TEXT NOT NULL DEFAULT 'default',
+	priority INTEGER NOT NULL DEFAULT 0,
+	batch_id TEXT
+);
+
+CREATE INDEX IF NOT EXISTS idx_jobs_claim ON jobs (status, queue, priority DESC, run_at, id);
+`
+
+// sqlitePath returns the file a "sqlite:" database_url points at.
+func sqlitePath(databaseURL string) (string, bool) {
+	return strings.CutPrefix(databaseURL, "sqlite:")
+}
+
+// openSQLiteStore opens (creating it if needed) the database at path.
+func openSQLiteStore(path string) (*sqliteStore, error) {
+
+	dsn := fmt.Sprintf("file:%s?_pragma=busy_timeout(%d)&_pragma=journal_mode(WAL)&_txlock=immediate",
+		(&url.URL{Path: path}).EscapedPath(), sqliteBusyTimeout.Milliseconds())
+
+	conn, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.Exec(sqliteSchema); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &sqliteStore{db: conn}, nil
+}
+
+func (s *sqliteStore) ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+// sqliteTime formats t the way the store keeps times.
+func sqliteTime(t time.Time) string {
+	return t.UTC().Format(sqliteTimeLayout)
+}
+
+// nullText stores b as text, or NULL when there is none.
+func nullText(b []byte) interface{} {
+	if b == nil {
+		return nil
+	}
+	return string(b)
+}
+
+// sqliteAfter is the time delay from now, in SQL.
+func sqliteAfter(delay time.Duration) string {
+	return fmt.Sprintf(`strftime('%%Y-%%m-%%d %%H:%%M:%%f', 'now', '+%.3f seconds')`, delay.Seconds())
+}
+
+// requeueProcessing hands back every job left processing. Only one server
+// uses the file, so at startup those were cut short by a crash.
+func (s *sqliteStore) requeueProcessing() (int64, error) {
+	res, err := s.db.Exec(`
+		UPDATE jobs
+		SET status = 'pending',
+		    updated_at = ` + sqliteNow + `
+		WHERE status = 'processing'
+	`)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// expireJobs marks pending jobs past their expires_at as expired.
+func (s *sqliteStore) expireJobs() (int64, error) {
+	res, err := s.db.Exec(`
+		UPDATE jobs
+		SET status = 'expired',
+		    last_error = 'expired before it could run',
+		    updated_at = ` + sqliteNow + `
+		WHERE status = 'pending'
+		AND expires_at <= ` + sqliteNow)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// InsertJob stores a job prepared by prepareJob and returns it with its
+// id and run_at.
+func (s *sqliteStore) InsertJob(job Job) (Job, error) {
+
+	payloadJSON, err := json.Marshal(job.Payload)
+	if err != nil {
+		return job, err
+	}
+
+	var runAt, expiresAt *string
+	if !job.RunAt.IsZero() {
+		t := sqliteTime(job.RunAt)
+		runAt = &t
+	}
+	if job.ExpiresAt != nil {
+		t := sqliteTime(*job.ExpiresAt)
+		expiresAt = &t
+	}
+
+	err = s.db.QueryRow(`
+		INSERT INTO jobs (type, payload, status, run_at, queue, tags, max_retries, priority, backoff, base_delay_seconds, timeout_seconds, tenant_id, sensitive, max_delay_seconds, expires_at, created_at, updated_at)
+		VALUES ($1, $2, $3, COALESCE($4, `+sqliteNow+`), $5, $6, $7, $8, NULLIF($9, ''), $10, $11, $12, $13, $14, $15, `+sqliteNow+`, `+sqliteNow+`)
+		RETURNING id, run_at
+	`, job.Type, string(payloadJSON), job.Status, runAt, job.Queue, pq.Array(job.Tags), job.MaxRetries, job.Priority, job.Backoff, job.BaseDelaySeconds, job.TimeoutSeconds, job.TenantID, pq.Array(job.Sensitive), job.MaxDelaySeconds, expiresAt).Scan(&job.ID, &job.RunAt)
+
+	return job, err
+}
+
+func (s *sqliteStore) ClaimJobs(req ClaimRequest) ([]ClaimedJob, error) {
+
+	// SQLite has no arrays to bind; the lists become json_each tables
+	queues, _ := json.Marshal(req.Queues)
+	types, _ := json.Marshal(req.Types)
+	skip, _ := json.Marshal(req.SkipTypes)
+
+	rows, err := s.db.Query(`
+		UPDATE jobs
+		SET status = 'processing',
+		    claimed_by = $4,
+		    updated_at = `+sqliteNow+`
+		WHERE id IN (
+			SELECT id FROM jobs
+			WHERE status = 'pending'
+			AND retry_count < COALESCE(max_retries, $1)
+			AND run_at <= `+sqliteNow+`
+			AND queue IN (SELECT value FROM json_each($2))
+			AND (json_array_length($5) = 0 OR type IN (SELECT value FROM json_each($5)))
+			AND type NOT IN (SELECT value FROM json_each($6))
+			AND (expires_at IS NULL OR expires_at > `+sqliteNow+`)
+			ORDER BY priority DESC, run_at, id
+			LIMIT $3
+		)
+		RETURNING id, type, priority, run_at
+	`, maxRetries, string(queues), req.Limit, req.Worker, string(types), string(skip))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	type row struct {
+		ClaimedJob
+		priority int
+		runAt    time.Time
+	}
+
+	var claimed []row
+	for rows.Next() {
+		var r row
+		if err := rows.Scan(&r.ID, &r.Type, &r.priority, &r.runAt); err != nil {
+			return nil, err
+		}
+		claimed = append(claimed, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// RETURNING comes back in no particular order
+	sort.Slice(claimed, func(i, j int) bool {
+		a, b := claimed[i], claimed[j]
+		if a.priority != b.priority {
+			return a.priority > b.priority
+		}
+		if !a.runAt.Equal(b.runAt) {
+			return a.runAt.Before(b.runAt)
+		}
+		return a.ID < b.ID
+	})
+
+	ordered := make([]ClaimedJob, len(claimed))
+	for i, r := range claimed {
+		ordered[i] = r.ClaimedJob
+	}
+	return ordered, nil
+}
+
+func (s *sqliteStore) GetJob(id int) (Job, error) {
+	return scanJob(s.db.QueryRow(`
+		SELECT `+jobColumns+`
+		FROM jobs
+		WHERE id = $1
+	`, id))
+}
+
+func (s *sqliteStore) ListJobs(filter *jobFilter) ([]Job, error) {
+
+	if filter.archived {
+		return nil, fmt.Errorf("include_archived: %w", errNeedsPostgres)
+	}
+	for _, clause := range filter.clauses {
+		if strings.Contains(clause, "@>") {
+			return nil, fmt.Errorf("tag and payload filters: %w", errNeedsPostgres)
+		}
+	}
+
+	args := make([]interface{}, len(filter.args))
+	for i, arg := range filter.args {
+		if t, ok := arg.(time.Time); ok {
+			arg = sqliteTime(t)
+		}
+		args[i] = arg
+	}
+
+	rows, err := s.db.Query(`
+		SELECT `+jobColumns+`
+		FROM jobs
+		`+filter.where()+`
+		ORDER BY id
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []Job
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, job)
+	}
+	return list, rows.Err()
+}
+
+func (s *sqliteStore) Heartbeat(id int) error {
+	_, err := s.db.Exec(`
+		UPDATE jobs
+		SET updated_at = `+sqliteNow+`
+		WHERE id = $1
+		AND status = 'processing'
+	`, id)
+	return err
+}
+
+func (s *sqliteStore) ReleaseJob(id int) error {
+	_, err := s.db.Exec(`
+		UPDATE jobs
+		SET status = 'pending',
+		    updated_at = `+sqliteNow+`
+		WHERE id = $1
+		AND status = 'processing'
+	`, id)
+	return err
+}
+
+func (s *sqliteStore) CancelJob(id int, reason string) error {
+	_, err := s.db.Exec(`
+		UPDATE jobs
+		SET status = 'cancelled',
+		    last_error = $2,
+		    updated_at = `+sqliteNow+`
+		WHERE id = $1
+	`, id, reason)
+	return err
+}
+
+// sqliteAttemptError appends the attempt_errors entry for a failed attempt,
+// built from last_error ($2) and response status ($3).
+const sqliteAttemptError = `json_insert(attempt_errors, '$[#]', json_object(
+	'attempt', retry_count + 1, 'error', $2, 'status', $3, 'at', ` + sqliteNow + `))`
+
+func (s *sqliteStore) RecordAttempt(id int, a Attempt) error {
+
+	if a.OutcomeUnknown {
+		_, err := s.db.Exec(`
+			UPDATE jobs
+			SET last_error = $2,
+			    attempt_errors = `+sqliteAttemptError+`,
+			    updated_at = `+sqliteNow+`
+			WHERE id = $1
+		`, id, a.Error, nil)
+		return err
+	}
+
+	_, err := s.db.Exec(`
+		UPDATE jobs
+		SET last_error = $2,
+		    response_status = $3,
+		    response_body = $4,
+		    execution_time_ms = $5,
+		    attempt_errors = `+sqliteAttemptError+`,
+		    updated_at = `+sqliteNow+`
+		WHERE id = $1
+	`, id, a.Error, a.StatusCode, nullText(a.Body), a.DurationMs)
+	return err
+}
+
+func (s *sqliteStore) RetryState(id int) (RetryState, error) {
+
+	var st RetryState
+	var backoff sql.NullString
+	var baseSeconds, maxDelaySeconds sql.NullInt64
+
+	err := s.db.QueryRow(`
+		SELECT retry_count, COALESCE(max_retries, $2), backoff, base_delay_seconds, max_delay_seconds
+		FROM jobs WHERE id = $1
+	`, id, maxRetries).Scan(&st.RetryCount, &st.Limit, &backoff, &baseSeconds, &maxDelaySeconds)
+	if err != nil {
+		return st, err
+	}
+
+	if backoff.Valid {
+		st.Backoff = &backoff.String
+	}
+	if baseSeconds.Valid {
+		d := time.Duration(baseSeconds.Int64) * time.Second
+		st.BaseDelay = &d
+	}
+	if maxDelaySeconds.Valid {
+		d := time.Duration(maxDelaySeconds.Int64) * time.Second
+		st.MaxDelay = &d
+	}
+	return st, nil
+}
+
+func (s *sqliteStore) ScheduleRetry(id int, delay time.Duration) error {
+	_, err := s.db.Exec(`
+		UPDATE jobs
+		SET status = 'pending',
+		    retry_count = retry_count + 1,
+		    run_at = `+sqliteAfter(delay.Truncate(time.Second))+`,
+		    updated_at = `+sqliteNow+`
+		WHERE id = $1
+	`, id)
+	return err
+}
+
+func (s *sqliteStore) DeferJob(id int, reason string, delay time.Duration) error {
+	_, err := s.db.Exec(`
+		UPDATE jobs
+		SET status = 'pending',
+		    last_error = $2,
+		    run_at = `+sqliteAfter(delay)+`,
+		    updated_at = `+sqliteNow+`
+		WHERE id = $1
+	`, id, reason)
+	return err
+}
+
+// CompleteJob stores the completion and the job's follow-up jobs. Hooks,
+// callbacks and batches need Postgres; standalone mode rejects jobs that
+// use them.
+func (s *sqliteStore) CompleteJob(job Job, a Attempt, followUps []jobs.FollowUp) error {
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE jobs
+		SET status = 'completed',
+		    response_status = $2,
+		    response_body = $3,
+		    execution_time_ms = $4,
+		    last_error = NULL,
+		    updated_at = `+sqliteNow+`
+		WHERE id = $1
+	`, job.ID, a.StatusCode, nullText(a.Body), a.DurationMs)
+
+	if err != nil {
+		return err
+	}
+
+	for _, f := range followUps {
+
+		var payload map[string]interface{}
+		json.Unmarshal(f.Payload, &payload)
+
+		runAt := sqliteAfter(time.Duration(f.DelaySeconds) * time.Second)
+		if f.RunAt != nil {
+			runAt = "'" + sqliteTime(*f.RunAt) + "'"
+		}
+
+		tenant := f.Tenant
+		if tenant == "" {
+			tenant = defaultTenant
+		}
+
+		tags := f.Tags
+		if tags == nil {
+			tags = []string{}
+		}
+
+		_, err := tx.Exec(`
+			INSERT INTO jobs (type, payload, status, run_at, queue, tags, tenant_id, created_at, updated_at)
+			VALUES ($1, $2, 'pending', `+runAt+`, $3, $4, $5, `+sqliteNow+`, `+sqliteNow+`)
+		`, f.Type, string(f.Payload), routing.GroupFor(f.Type, payload, ""), pq.Array(tags), tenant)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// FailJob marks the job failed. There is no dead-letter queue without
+// Postgres; failed jobs stay listed under status=failed.
+func (s *sqliteStore) FailJob(job Job) error {
+	_, err := s.db.Exec(`
+		UPDATE jobs
+		SET status = 'failed',
+		    retry_count = retry_count + 1,
+		    updated_at = `+sqliteNow+`
+		WHERE id = $1
+	`, job.ID)
+	return err
+}
@@ -0,0 +1,297 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ==================== EVENT STREAMS ====================
+//
+// GET /jobs/{id}/stream and GET /events push job events (see events.go)
+// as Server-Sent Events. Events reach this process through the job
+// listener, so a stream sees changes made by any server or agent.
+//
+// Every message carries the event id. A client that reconnects with
+// Last-Event-ID (EventSource does so on its own) first gets what it
+// missed from job_events, then live events. Clients that fall behind,
+// and all clients when the listener reconnects, are disconnected so they
+// catch up that way instead of silently missing events.
+
+const (
+	streamBuffer    = 256
+	streamKeepAlive = 15 * time.Second
+	streamReplayMax = 10000
+)
+
+type streamEvent struct {
+	jobEvent
+	JobID    int    `json:"job_id"`
+	JobType  string `json:"job_type"`
+	Queue    string `json:"queue"`
+	TenantID string `json:"tenant_id"`
+}
+
+func (e streamEvent) terminal() bool {
+	switch e.Status {
+	case "completed", "failed", "cancelled", "expired":
+		return true
+	}
+	return false
+}
+
+var eventStreams = struct {
+	sync.Mutex
+	subs   map[chan streamEvent]struct{}
+	closed bool
+}{subs: make(map[chan streamEvent]struct{})}
+
+// subscribeEvents returns a channel of live events and a function to
+// stop receiving them. The channel is closed if the subscriber is dropped.
+func subscribeEvents() (chan streamEvent, func(), bool) {
+
+	eventStreams.Lock()
+	defer eventStreams.Unlock()
+
+	if eventStreams.closed {
+		return nil, nil, false
+	}
+
+	ch := make(chan streamEvent, streamBuffer)
+	eventStreams.subs[ch] = struct{}{}
+
+	return ch, func() {
+		eventStreams.Lock()
+		defer eventStreams.Unlock()
+		if _, ok := eventStreams.subs[ch]; ok {
+			delete(eventStreams.subs, ch)
+			close(ch)
+		}
+	}, true
+}
+
+// publishJobEvent fans a goflow_job_events notification out to every
+// stream.
+func publishJobEvent(payload string) {
+
+	var e streamEvent
+	if err := json.Unmarshal([]byte(payload), &e); err != nil {
+		slog.Error("Invalid job event notification", "error", err)
+		return
+	}
+
+	eventStreams.Lock()
+	defer eventStreams.Unlock()
+
+	for ch := range eventStreams.subs {
+		select {
+		case ch <- e:
+		default:
+			// Too slow: drop it rather than block the listener
+			delete(eventStreams.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// dropEventStreams disconnects every stream client.
+func dropEventStreams() {
+
+	eventStreams.Lock()
+	defer eventStreams.Unlock()
+
+	for ch := range eventStreams.subs {
+		delete(eventStreams.subs, ch)
+		close(ch)
+	}
+}
+
+// closeEventStreams ends all streams for shutdown and refuses new ones.
+func closeEventStreams() {
+	dropEventStreams()
+
+	eventStreams.Lock()
+	eventStreams.closed = true
+	eventStreams.Unlock()
+}
+
+// eventsHandler serves GET /events: events of every job of the tenant,
+// optionally narrowed with ?type= and ?queue=.
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	jobType := r.URL.Query().Get("type")
+	queue := r.URL.Query().Get("queue")
+	tenant := tenantOf(r)
+
+	serveEventStream(w, r, 0, func(e streamEvent) bool {
+		return e.TenantID == tenant &&
+			(jobType == "" || e.JobType == jobType) && (queue == "" || e.Queue == queue)
+	})
+}
+
+// jobStreamHandler serves GET /jobs/{id}/stream: the job's history so
+// far, then its events as they happen. The stream ends once the job is
+// completed, failed or cancelled.
+func jobStreamHandler(w http.ResponseWriter, r *http.Request, jobID int) {
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	serveEventStream(w, r, jobID, func(e streamEvent) bool {
+		return e.JobID == jobID
+	})
+}
+
+// serveEventStream writes matching events until the client goes away.
+// jobID 0 streams every job and only replays when the client asks to
+// resume; a single job's stream always starts with its history.
+func serveEventStream(w http.ResponseWriter, r *http.Request, jobID int, match func(streamEvent) bool) {
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("last_event_id")
+	}
+
+	var after int64
+	resume := lastID != ""
+	if resume {
+		n, err := strconv.ParseInt(lastID, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+		after = n
+	}
+
+	// Subscribe before replaying, so nothing falls in between
+	live, unsubscribe, ok := subscribeEvents()
+	if !ok {
+		http.Error(w, "Server shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	if jobID != 0 || resume {
+		done := false
+		var err error
+		after, err = replayEvents(after, jobID, func(e streamEvent) bool {
+			if !match(e) {
+				return true
+			}
+			writeStreamEvent(w, e)
+			done = jobID != 0 && e.terminal()
+			return !done
+		})
+		flusher.Flush()
+		if err != nil {
+			slog.Error("Event replay failed", "job_id", jobID, "error", err)
+			return
+		}
+		if done {
+			return
+		}
+	}
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case e, ok := <-live:
+			if !ok {
+				return
+			}
+			if e.ID <= after || !match(e) {
+				continue
+			}
+			writeStreamEvent(w, e)
+			flusher.Flush()
+			after = e.ID
+			if jobID != 0 && e.terminal() {
+				return
+			}
+
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		}
+	}
+}
+
+// replayEvents passes each event after the given id, for one job or,
+// with jobID 0, for all of them, to fn until it returns false. It returns
+// the id of the last event seen.
+func replayEvents(after int64, jobID int, fn func(streamEvent) bool) (int64, error) {
+
+	for {
+		rows, err := db.Query(`
+			SELECT e.id, e.event, e.status, e.worker, e.attempt, e.error, e.created_at, e.job_id, j.type, j.queue, j.tenant_id
+			FROM job_events e
+			JOIN jobs j ON j.id = e.job_id
+			WHERE e.id > $1
+			AND ($2 = 0 OR e.job_id = $2)
+			ORDER BY e.id
+			LIMIT $3
+		`, after, jobID, streamReplayMax)
+		if err != nil {
+			return after, err
+		}
+
+		var batch []streamEvent
+		for rows.Next() {
+			var e streamEvent
+			err := rows.Scan(&e.ID, &e.Event, &e.Status, &e.Worker, &e.Attempt, &e.Error, &e.CreatedAt, &e.JobID, &e.JobType, &e.Queue, &e.TenantID)
+			if err != nil {
+				rows.Close()
+				return after, err
+			}
+			batch = append(batch, e)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return after, err
+		}
+
+		for _, e := range batch {
+			after = e.ID
+			if !fn(e) {
+				return after, nil
+			}
+		}
+
+		if len(batch) < streamReplayMax {
+			return after, nil
+		}
+	}
+}
+
+func writeStreamEvent(w http.ResponseWriter, e streamEvent) {
+	data, _ := json.Marshal(e)
+	fmt.Fprintf(w, "id: %d\ndata: %s\n\n", e.ID, data)
+}
@@ -0,0 +1,204 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+
+	"goflow/cassette"
+	"goflow/jobs"
+)
+
+// ==================== TEST-JOB ====================
+//
+// "goflow test-job payload.json" runs one job in-process, without the
+// queue, and prints what it did:
+//
+//	goflow test-job [-mode auto|record|replay] [-cassette file] [-db dsn] [-fixtures file.sql] job.json
+//
+// job.json holds {"type": ..., "payload": {...}}. Outbound HTTP goes
+// through a cassette (default job.cassette.json next to the job file), so
+// the first run records and later runs replay the same responses. Mail is
+// captured instead of sent. With -db the job gets a database: the schema
+// is created and -fixtures is applied first; use a scratch database.
+
+type testJobMail struct {
+	From    string   `json:"from"`
+	To      []string `json:"to"`
+	Message string   `json:"message"`
+}
+
+type testJobFollowUp struct {
+	Type         string          `json:"type"`
+	Payload      json.RawMessage `json:"payload"`
+	RunAt        *time.Time      `json:"run_at,omitempty"`
+	DelaySeconds int             `json:"delay_seconds,omitempty"`
+	Tags         []string        `json:"tags,omitempty"`
+}
+
+// RunTestJob runs "goflow test-job" with args and returns its exit code.
+func RunTestJob(args []string) int {
+
+	fs := flag.NewFlagSet("test-job", flag.ContinueOnError)
+	mode := fs.String("mode", string(cassette.Auto), "cassette mode: auto, record or replay")
+	cassettePath := fs.String("cassette", "", "cassette file (default <job>.cassette.json)")
+	dsn := fs.String("db", "", "Postgres connection string for DB-backed job types")
+	fixtures := fs.String("fixtures", "", "SQL file applied before the job runs (needs -db)")
+	jobID := fs.Int("job-id", 1, "job ID the executor sees")
+	timeout := fs.Duration("timeout", 5*time.Minute, "execution timeout")
+
+	// Flags may come before or after the job file
+	var files []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return 2
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		files = append(files, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+
+	if len(files) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: goflow test-job [flags] job.json")
+		fs.PrintDefaults()
+		return 2
+	}
+	jobFile := files[0]
+
+	data, err := os.ReadFile(jobFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	var job struct {
+		Type    string                 `json:"type"`
+		Payload map[string]interface{} `json:"payload"`
+	}
+	if err := json.Unmarshal(data, &job); err != nil || job.Type == "" {
+		fmt.Fprintf(os.Stderr, "%s: expected {\"type\": ..., \"payload\": {...}}\n", jobFile)
+		return 2
+	}
+	if job.Payload == nil {
+		job.Payload = map[string]interface{}{}
+	}
+
+	if *cassettePath == "" {
+		*cassettePath = strings.TrimSuffix(jobFile, ".json") + ".cassette.json"
+	}
+
+	tape, err := cassette.Load(*cassettePath, cassette.Mode(*mode), nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	// Job types get the server's settings for them, from GOFLOW_CONFIG and
+	// the environment
+	settings, err := LoadConfig(nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	configureJobTypes(settings)
+
+	mails := []testJobMail{}
+	jobs.SetMailSender(func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+		mails = append(mails, testJobMail{From: from, To: to, Message: string(msg)})
+		return nil
+	})
+
+	if *dsn != "" {
+		if err := initDB(*dsn); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		jobs.DB = db
+
+		if *fixtures != "" {
+			sqlBytes, err := os.ReadFile(*fixtures)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 2
+			}
+			if _, err := db.Exec(string(sqlBytes)); err != nil {
+				fmt.Fprintf(os.Stderr, "fixtures: %v\n", err)
+				return 2
+			}
+		}
+	} else {
+		if *fixtures != "" {
+			fmt.Fprintln(os.Stderr, "-fixtures needs -db")
+			return 2
+		}
+		// Effectively-once bookkeeping lives in the database
+		jobs.SetGuarantee(job.Type, jobs.AtLeastOnce)
+	}
+
+	jobs.Use(jobs.Recover(), jobs.InterpolateOutputs())
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	ctx = jobs.WithJobID(ctx, *jobID)
+	ctx = jobs.WithTransport(ctx, tape.Wrap)
+	ctx, followUps := jobs.WithFollowUps(ctx)
+
+	started := time.Now()
+	statusCode, body, execErr := jobs.Execute(ctx, job.Type, job.Payload)
+	elapsed := time.Since(started)
+
+	if err := tape.Save(); err != nil {
+		fmt.Fprintf(os.Stderr, "saving cassette: %v\n", err)
+	}
+
+	staged := []testJobFollowUp{}
+	for _, f := range followUps.Jobs {
+		staged = append(staged, testJobFollowUp{
+			Type:         f.Type,
+			Payload:      json.RawMessage(f.Payload),
+			RunAt:        f.RunAt,
+			DelaySeconds: f.DelaySeconds,
+			Tags:         f.Tags,
+		})
+	}
+
+	var response interface{} = string(body)
+	if json.Valid(body) {
+		response = json.RawMessage(body)
+	}
+
+	recorded, replayed := tape.Stats()
+
+	report := map[string]interface{}{
+		"type":        job.Type,
+		"status_code": statusCode,
+		"response":    response,
+		"duration_ms": elapsed.Milliseconds(),
+		"follow_ups":  staged,
+		"mail":        mails,
+		"http": map[string]interface{}{
+			"cassette": *cassettePath,
+			"recorded": recorded,
+			"replayed": replayed,
+		},
+	}
+	if execErr != nil {
+		report["error"] = execErr.Error()
+	}
+
+	out, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Println(string(out))
+
+	if execErr != nil {
+		return 1
+	}
+	return 0
+}
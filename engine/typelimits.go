@@ -0,0 +1,155 @@
+package engine
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ==================== JOB TYPE RATE LIMITS ====================
+//
+// Some job types must not start faster than a provider allows, whatever
+// the number of workers and servers:
+//
+//	type_rate_limits:
+//	  send_email: 10/min
+//	  ai_prompt: 60/min
+//
+// The limit is kept in the database as a GCRA (a token bucket holding a
+// window's worth of starts), so every server and agent shares it. Workers
+// do not claim jobs of a type that is out of starts; the jobs simply wait
+// in the queue, without using up retries.
+
+// typeRate allows Limit job starts Per period.
+type typeRate struct {
+	Limit int
+	Per   time.Duration
+}
+
+// interval is the steady time between two starts.
+func (r typeRate) interval() time.Duration {
+	return r.Per / time.Duration(r.Limit)
+}
+
+var ratePeriods = map[string]time.Duration{
+	"s": time.Second, "sec": time.Second, "second": time.Second,
+	"m": time.Minute, "min": time.Minute, "minute": time.Minute,
+	"h": time.Hour, "hour": time.Hour,
+	"d": 24 * time.Hour, "day": 24 * time.Hour,
+}
+
+// parseTypeRate reads "10/min", "5/s", "1000/hour" or "200/day".
+func parseTypeRate(v string) (typeRate, error) {
+
+	count, period, ok := strings.Cut(strings.TrimSpace(v), "/")
+	if !ok {
+		return typeRate{}, fmt.Errorf("%q: expected count/period, like 10/min", v)
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(count))
+	if err != nil || n < 1 {
+		return typeRate{}, fmt.Errorf("%q: count must be a positive number", v)
+	}
+
+	per, ok := ratePeriods[strings.TrimSpace(period)]
+	if !ok {
+		return typeRate{}, fmt.Errorf("%q: period must be s, min, hour or day", v)
+	}
+
+	return typeRate{Limit: n, Per: per}, nil
+}
+
+// typeRateFor returns jobType's configured limit, if any.
+func typeRateFor(jobType string) (typeRate, bool) {
+	r, ok := cfg.typeRates[jobType]
+	return r, ok
+}
+
+// throttledJobTypes lists the rate-limited types that have no start left
+// right now, for the claim queries to skip.
+func throttledJobTypes() ([]string, error) {
+
+	if len(cfg.typeRates) == 0 {
+		return []string{}, nil
+	}
+
+	types := make([]string, 0, len(cfg.typeRates))
+	for t := range cfg.typeRates {
+		types = append(types, t)
+	}
+
+	rows, err := db.Query(`
+		SELECT job_type, EXTRACT(EPOCH FROM tat - NOW())
+		FROM job_type_rates
+		WHERE job_type = ANY($1)
+		AND tat > NOW()
+	`, pq.Array(types))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	throttled := []string{}
+	for rows.Next() {
+		var jobType string
+		var ahead float64
+		if err := rows.Scan(&jobType, &ahead); err != nil {
+			return nil, err
+		}
+
+		// One more start would push the bucket past a full window
+		r := cfg.typeRates[jobType]
+		if ahead > (r.Per - r.interval()).Seconds() {
+			throttled = append(throttled, jobType)
+		}
+	}
+
+	return throttled, rows.Err()
+}
+
+// admitJobType spends one start of jobType's limit. It returns false when
+// none is left, which only happens when servers race for the last one.
+func admitJobType(jobType string) (bool, error) {
+
+	r, ok := typeRateFor(jobType)
+	if !ok {
+		return true, nil
+	}
+
+	var tat time.Time
+
+	err := db.QueryRow(`
+		INSERT INTO job_type_rates (job_type, tat)
+		VALUES ($1, NOW() + make_interval(secs => $2))
+		ON CONFLICT (job_type) DO UPDATE
+		SET tat = GREATEST(job_type_rates.tat, NOW()) + make_interval(secs => $2)
+		WHERE GREATEST(job_type_rates.tat, NOW()) + make_interval(secs => $2) <= NOW() + make_interval(secs => $3)
+		RETURNING tat
+	`, jobType, r.interval().Seconds(), r.Per.Seconds()).Scan(&tat)
+
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// admitClaimed checks a claimed job against its type's limit and puts it
+// back in the queue if the limit is spent.
+func admitClaimed(id int, jobType string) bool {
+
+	ok, err := admitJobType(jobType)
+	if err != nil {
+		// The limit is a safeguard for the provider; without the
+		// database to check it, do not start the job
+		slog.Error("Rate limit check failed", "job_id", id, "job_type", jobType, "error", err)
+	}
+	if !ok {
+		releaseJob(id)
+	}
+	return ok
+}
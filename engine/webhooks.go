@@ -0,0 +1,203 @@
+package engine
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ==================== WEBHOOK SUBSCRIPTIONS ====================
+//
+// Subscriptions register endpoints under a topic; a webhook_fanout job
+// with that topic delivers to all of them. Topics are per tenant: a key
+// only sees and changes its own tenant's subscriptions, and a fanout only
+// reaches its own tenant's. Secrets are write-only.
+
+type webhookSubscription struct {
+	ID        int       `json:"id"`
+	Topic     string    `json:"topic"`
+	URL       string    `json:"url"`
+	Active    bool      `json:"active"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// webhookSubscriptionsHandler serves GET /webhooks/subscriptions?topic=
+// and POST /webhooks/subscriptions.
+func webhookSubscriptionsHandler(w http.ResponseWriter, r *http.Request) {
+
+	switch r.Method {
+
+	case http.MethodGet:
+		query := `SELECT id, topic, url, active, created_at FROM webhook_subscriptions WHERE tenant_id = $1`
+		args := []interface{}{tenantOf(r)}
+		if topic := r.URL.Query().Get("topic"); topic != "" {
+			query += ` AND topic = $2`
+			args = append(args, topic)
+		}
+
+		rows, err := db.Query(query+` ORDER BY id`, args...)
+		if err != nil {
+			http.Error(w, "Query failed", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		subs := []webhookSubscription{}
+		for rows.Next() {
+			var s webhookSubscription
+			if err := rows.Scan(&s.ID, &s.Topic, &s.URL, &s.Active, &s.CreatedAt); err != nil {
+				http.Error(w, "Scan failed", http.StatusInternalServerError)
+				return
+			}
+			subs = append(subs, s)
+		}
+
+		json.NewEncoder(w).Encode(subs)
+
+	case http.MethodPost:
+		var req struct {
+			Topic  string `json:"topic"`
+			URL    string `json:"url"`
+			Secret string `json:"secret"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+
+		if req.Topic == "" || req.URL == "" || req.Secret == "" {
+			http.Error(w, "'topic', 'url' and 'secret' are required", http.StatusBadRequest)
+			return
+		}
+
+		if !strings.HasPrefix(req.URL, "https://") && !strings.HasPrefix(req.URL, "http://") {
+			http.Error(w, "'url' must be http or https", http.StatusBadRequest)
+			return
+		}
+
+		// Re-subscribing the same URL rotates its secret and reactivates it
+		var s webhookSubscription
+		err := db.QueryRow(`
+			INSERT INTO webhook_subscriptions (tenant_id, topic, url, secret)
+			VALUES ($1, $2, $3, $4)
+			ON CONFLICT (tenant_id, topic, url) DO UPDATE SET secret = EXCLUDED.secret, active = TRUE
+			RETURNING id, topic, url, active, created_at
+		`, tenantOf(r), req.Topic, req.URL, req.Secret).Scan(&s.ID, &s.Topic, &s.URL, &s.Active, &s.CreatedAt)
+		if err != nil {
+			http.Error(w, "Failed to save subscription", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(s)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// webhookSubscriptionDetailHandler serves DELETE /webhooks/subscriptions/{id}.
+func webhookSubscriptionDetailHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/webhooks/subscriptions/"))
+	if err != nil {
+		http.Error(w, "Invalid subscription id", http.StatusBadRequest)
+		return
+	}
+
+	res, err := db.Exec(`DELETE FROM webhook_subscriptions WHERE id = $1 AND tenant_id = $2`, id, tenantOf(r))
+	if err != nil {
+		http.Error(w, "Delete failed", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Subscription not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// webhookFanoutHandler serves GET /webhooks/fanouts/{job id}, the delivery
+// status of every endpoint a webhook_fanout job sent to. Status follows
+// the endpoint's webhook_delivery job: "pending" until its first attempt,
+// then "retrying", "delivered" or "failed" once retries run out.
+func webhookFanoutHandler(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	fanoutID, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/webhooks/fanouts/"))
+	if err != nil {
+		http.Error(w, "Invalid fanout id", http.StatusBadRequest)
+		return
+	}
+
+	if !jobInTenant(fanoutID, tenantOf(r)) {
+		http.Error(w, "Fanout not found", http.StatusNotFound)
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT d.url, d.delivery_job_id, d.attempts, d.last_status, d.last_error, d.delivered_at,
+		       CASE
+		           WHEN d.delivered_at IS NOT NULL THEN 'delivered'
+		           WHEN j.status = 'failed' THEN 'failed'
+		           WHEN d.attempts > 0 THEN 'retrying'
+		           ELSE 'pending'
+		       END
+		FROM webhook_fanout_deliveries d
+		LEFT JOIN jobs j ON j.id = d.delivery_job_id
+		WHERE d.fanout_job_id = $1
+		ORDER BY d.url
+	`, fanoutID)
+	if err != nil {
+		http.Error(w, "Query failed", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	type endpointStatus struct {
+		URL           string     `json:"url"`
+		Status        string     `json:"status"`
+		DeliveryJobID *int       `json:"delivery_job_id"`
+		Attempts      int        `json:"attempts"`
+		LastStatus    *int       `json:"last_status"`
+		LastError     *string    `json:"last_error"`
+		DeliveredAt   *time.Time `json:"delivered_at"`
+	}
+
+	endpoints := []endpointStatus{}
+	counts := map[string]int{}
+
+	for rows.Next() {
+		var e endpointStatus
+		if err := rows.Scan(&e.URL, &e.DeliveryJobID, &e.Attempts, &e.LastStatus, &e.LastError, &e.DeliveredAt, &e.Status); err != nil {
+			http.Error(w, "Scan failed", http.StatusInternalServerError)
+			return
+		}
+		counts[e.Status]++
+		endpoints = append(endpoints, e)
+	}
+
+	if len(endpoints) == 0 {
+		http.Error(w, "Fanout not found", http.StatusNotFound)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"fanout_id": fanoutID,
+		"counts":    counts,
+		"endpoints": endpoints,
+	})
+}
@@ -0,0 +1,164 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"goflow/jobs"
+)
+
+func TestMain(m *testing.M) {
+	// Workers read cfg from goroutines that may outlive a test, so it is
+	// set once here rather than per test
+	cfg = DefaultConfig()
+	os.Exit(m.Run())
+}
+
+// useMemoryStore points the workers at a fresh memory store, and puts it
+// and the scheduler clock back after the test.
+func useMemoryStore(t *testing.T) *memoryStore {
+	t.Helper()
+
+	oldStore, oldClock := store, jobs.SchedulerClock
+	t.Cleanup(func() {
+		store, jobs.SchedulerClock = oldStore, oldClock
+	})
+
+	s := newMemoryStore()
+	store = s
+	return s
+}
+
+// insertCron stores a cron_schedule job that runs every hour.
+func insertCron(s *memoryStore) {
+	s.InsertJob(Job{
+		Type:   "cron_schedule",
+		Status: "pending",
+		Queue:  "default",
+		Payload: map[string]interface{}{
+			"cron": "0 * * * *",
+			"job": map[string]interface{}{
+				"type":    "http_request",
+				"payload": map[string]interface{}{"url": "https://example.com"},
+			},
+		},
+	})
+}
+
+// runOne claims and processes the one job ready on the default queue.
+func runOne(t *testing.T) {
+	t.Helper()
+
+	ids, err := claimJobs([]string{"default"}, 1, "test")
+	if err != nil {
+		t.Fatalf("claim: %v", err)
+	}
+	if len(ids) != 1 {
+		t.Fatalf("claimed %d jobs, want 1", len(ids))
+	}
+	processJob(context.Background(), 1, ids[0])
+}
+
+func TestCronScheduleUsesSchedulerClock(t *testing.T) {
+
+	// An hour boundary a day ahead, so the next run is clearly the
+	// clock's and not the wall clock's
+	now := time.Now().UTC().Add(24 * time.Hour).Truncate(time.Hour).Add(10 * time.Minute)
+	s := useMemoryStore(t)
+	jobs.SchedulerClock = jobs.FixedClock(now)
+
+	insertCron(s)
+	runOne(t)
+
+	list, err := s.ListJobs(&jobFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 3 {
+		t.Fatalf("got %d jobs, want the cron job and its 2 follow-ups", len(list))
+	}
+	if list[0].Status != "completed" {
+		t.Errorf("cron job is %s, want completed", list[0].Status)
+	}
+
+	want := now.Truncate(time.Hour).Add(time.Hour)
+	for _, j := range list[1:] {
+		if j.Status != "pending" || !j.RunAt.Equal(want) {
+			t.Errorf("follow-up %s: %s at %s, want pending at %s", j.Type, j.Status, j.RunAt, want)
+		}
+	}
+
+	// Neither follow-up is due yet
+	claimed, err := s.ClaimJobs(ClaimRequest{Queues: []string{"default"}, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(claimed) != 0 {
+		t.Errorf("claimed %d jobs before their run_at", len(claimed))
+	}
+}
+
+func TestCronScheduleWithoutDatabase(t *testing.T) {
+
+	// The default clock, which has no database to ask here
+	s := useMemoryStore(t)
+	jobs.SchedulerClock = jobs.DBClock{}
+
+	before := time.Now()
+	insertCron(s)
+	runOne(t)
+
+	list, err := s.ListJobs(&jobFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 3 || list[0].Status != "completed" {
+		t.Fatalf("got %d jobs, cron job %s; want it completed with 2 follow-ups", len(list), list[0].Status)
+	}
+
+	want := before.Truncate(time.Hour).Add(time.Hour)
+	for _, j := range list[1:] {
+		if !j.RunAt.Equal(want) && !j.RunAt.Equal(want.Add(time.Hour)) {
+			t.Errorf("follow-up %s at %s, want the next hour after %s", j.Type, j.RunAt, before)
+		}
+	}
+}
+
+func TestFailedJobRetriesThenFails(t *testing.T) {
+
+	s := useMemoryStore(t)
+
+	jobs.Register("test_always_fails", func(ctx context.Context, payload map[string]interface{}) (int, []byte, error) {
+		return 500, nil, errors.New("boom")
+	})
+
+	retries, delay := 2, 0
+	s.InsertJob(Job{
+		Type:             "test_always_fails",
+		Status:           "pending",
+		Queue:            "default",
+		Payload:          map[string]interface{}{},
+		MaxRetries:       &retries,
+		BaseDelaySeconds: &delay,
+	})
+
+	runOne(t)
+
+	job, _ := s.GetJob(1)
+	if job.Status != "pending" {
+		t.Fatalf("after the first attempt the job is %s, want pending", job.Status)
+	}
+	if st, _ := s.RetryState(1); st.RetryCount != 1 {
+		t.Errorf("retry count %d, want 1", st.RetryCount)
+	}
+
+	runOne(t)
+
+	job, _ = s.GetJob(1)
+	if job.Status != "failed" {
+		t.Errorf("after the last attempt the job is %s, want failed", job.Status)
+	}
+}
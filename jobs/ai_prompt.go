@@ -2,34 +2,34 @@ package jobs
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"time"
-	"context"
 )
 
 func executeAIPrompt(ctx context.Context, payload map[string]interface{}) (int, []byte, error) {
 
 	provider, ok := payload["provider"].(string)
 	if !ok || provider == "" {
-		return 0, nil, fmt.Errorf("missing 'provider'")
+		return 0, nil, Permanent(fmt.Errorf("missing 'provider'"))
 	}
 
 	apiKey, ok := payload["api_key"].(string)
 	if !ok || apiKey == "" {
-		return 0, nil, fmt.Errorf("missing 'api_key'")
+		return 0, nil, Permanent(fmt.Errorf("missing 'api_key'"))
 	}
 
 	model, ok := payload["model"].(string)
 	if !ok || model == "" {
-		return 0, nil, fmt.Errorf("missing 'model'")
+		return 0, nil, Permanent(fmt.Errorf("missing 'model'"))
 	}
 
 	prompt, ok := payload["prompt"].(string)
 	if !ok || prompt == "" {
-		return 0, nil, fmt.Errorf("missing 'prompt'")
+		return 0, nil, Permanent(fmt.Errorf("missing 'prompt'"))
 	}
 
 	extractContent := false
@@ -64,7 +64,7 @@ func executeAIPrompt(ctx context.Context, payload map[string]interface{}) (int,
 		bodyBytes, err = buildGeminiRequest(prompt)
 
 	default:
-		return 0, nil, fmt.Errorf("unsupported provider: %s", provider)
+		return 0, nil, Permanent(fmt.Errorf("unsupported provider: %s", provider))
 	}
 
 	if err != nil {
@@ -72,10 +72,11 @@ func executeAIPrompt(ctx context.Context, payload map[string]interface{}) (int,
 	}
 
 	client := &http.Client{
-		Timeout: 25 * time.Second,
+		Timeout:   25 * time.Second,
+		Transport: transportFor(ctx, nil),
 	}
 
-	req, err := http.NewRequest("POST", endpoint, bytes.NewBuffer(bodyBytes))
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewBuffer(bodyBytes))
 	if err != nil {
 		return 0, nil, err
 	}
@@ -103,7 +104,7 @@ func executeAIPrompt(ctx context.Context, payload map[string]interface{}) (int,
 
 	if resp.StatusCode >= 400 {
 		return resp.StatusCode, responseBytes,
-			fmt.Errorf("provider returned status %d", resp.StatusCode)
+			ResponseError(resp, fmt.Errorf("provider returned status %d", resp.StatusCode))
 	}
 
 	if extractContent {
@@ -132,7 +133,7 @@ func buildOpenAIRequest(model, prompt string) ([]byte, error) {
 
 func buildAnthropicRequest(model, prompt string) ([]byte, error) {
 	body := map[string]interface{}{
-		"model": model,
+		"model":      model,
 		"max_tokens": 1024,
 		"messages": []map[string]string{
 			{"role": "user", "content": prompt},
@@ -184,4 +185,4 @@ func extractProviderContent(provider string, response []byte) (string, error) {
 	}
 
 	return "", fmt.Errorf("unsupported provider for extraction")
-}
\ No newline at end of file
+}
@@ -0,0 +1,284 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// amqp_publish publishes a message to an AMQP 0-9-1 broker such as
+// RabbitMQ:
+//
+//	{"exchange": "orders", "routing_key": "order.created",
+//	 "body": {"id": 42}, "headers": {"tenant": "acme"}}
+//
+// The broker is "url" or GOFLOW_AMQP_URL. A string body is sent as is,
+// anything else as JSON. Messages are persistent unless "persistent" is
+// false, and "mandatory" fails the job when no queue is bound for the
+// routing key. The job succeeds once the broker confirms the message.
+//
+// Connections stay open between jobs, one per broker, and publishing
+// channels are reused; a connection the broker drops is redialed by the
+// next job.
+
+const (
+	amqpDialTimeout  = 10 * time.Second
+	amqpIdleChannels = 8
+)
+
+// amqpBroker is a pooled connection and its idle channels, each already in
+// confirm mode.
+type amqpBroker struct {
+	conn *amqp.Connection
+	idle chan *amqpChannel
+}
+
+type amqpChannel struct {
+	ch      *amqp.Channel
+	returns chan amqp.Return
+	closed  chan *amqp.Error
+}
+
+var amqpBrokers = struct {
+	sync.Mutex
+	byURL map[string]*amqpBroker
+}{byURL: map[string]*amqpBroker{}}
+
+func executeAMQPPublish(ctx context.Context, payload map[string]interface{}) (int, []byte, error) {
+
+	brokerURL, _ := payload["url"].(string)
+	if brokerURL == "" {
+		brokerURL = os.Getenv("GOFLOW_AMQP_URL")
+	}
+	if brokerURL == "" {
+		return 0, nil, Permanent(fmt.Errorf("missing 'url' and GOFLOW_AMQP_URL is not set"))
+	}
+
+	exchange, _ := payload["exchange"].(string)
+	routingKey, _ := payload["routing_key"].(string)
+	if exchange == "" && routingKey == "" {
+		return 0, nil, fmt.Errorf("missing 'routing_key'")
+	}
+
+	msg := amqp.Publishing{
+		DeliveryMode: amqp.Persistent,
+		Timestamp:    time.Now(),
+		MessageId:    deliveryIDFor(ctx, "amqp"),
+	}
+
+	switch body := payload["body"].(type) {
+	case nil:
+	case string:
+		msg.Body = []byte(body)
+		msg.ContentType = "text/plain"
+	default:
+		b, err := json.Marshal(body)
+		if err != nil {
+			return 0, nil, Permanent(err)
+		}
+		msg.Body = b
+		msg.ContentType = "application/json"
+	}
+	if v, ok := payload["content_type"].(string); ok && v != "" {
+		msg.ContentType = v
+	}
+	if v, ok := payload["persistent"].(bool); ok && !v {
+		msg.DeliveryMode = amqp.Transient
+	}
+	if v, ok := payload["message_id"].(string); ok && v != "" {
+		msg.MessageId = v
+	}
+	msg.CorrelationId, _ = payload["correlation_id"].(string)
+	msg.ReplyTo, _ = payload["reply_to"].(string)
+	msg.Type, _ = payload["message_type"].(string)
+	if v, ok := payload["priority"].(float64); ok && v >= 0 && v <= 9 {
+		msg.Priority = uint8(v)
+	}
+	if v, ok := payload["expiration_ms"].(float64); ok && v > 0 {
+		msg.Expiration = fmt.Sprint(int64(v))
+	}
+	if headers, ok := payload["headers"].(map[string]interface{}); ok {
+		msg.Headers = amqpTable(headers)
+		if err := msg.Headers.Validate(); err != nil {
+			return 0, nil, Permanent(fmt.Errorf("invalid headers: %w", err))
+		}
+	}
+
+	mandatory, _ := payload["mandatory"].(bool)
+
+	broker, err := amqpBrokerFor(brokerURL)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	ch, err := broker.channel()
+	if err != nil {
+		return 0, nil, amqpError(err)
+	}
+
+	confirm, err := ch.ch.PublishWithDeferredConfirmWithContext(ctx, exchange, routingKey, mandatory, false, msg)
+	if err != nil {
+		ch.ch.Close()
+		return 0, nil, amqpError(err)
+	}
+
+	acked, err := confirm.WaitContext(ctx)
+	if err != nil {
+		// The confirm may still arrive; the channel cannot be handed to
+		// another job with it outstanding
+		ch.ch.Close()
+		return 0, nil, err
+	}
+	if !acked {
+		// A publish the broker refuses, such as to a missing exchange,
+		// closes the channel instead of being nacked
+		select {
+		case e := <-ch.closed:
+			if e != nil {
+				return 0, nil, amqpError(e)
+			}
+			return 0, nil, fmt.Errorf("channel closed before the broker confirmed the message")
+		default:
+		}
+		broker.release(ch)
+		return 0, nil, fmt.Errorf("broker rejected the message")
+	}
+
+	// The broker sends an unroutable mandatory message back before it
+	// confirms it
+	select {
+	case r := <-ch.returns:
+		broker.release(ch)
+		return 0, nil, Permanent(fmt.Errorf("message returned: %d %s", r.ReplyCode, r.ReplyText))
+	default:
+	}
+	broker.release(ch)
+
+	result := map[string]interface{}{
+		"exchange":    exchange,
+		"routing_key": routingKey,
+		"message_id":  msg.MessageId,
+		"bytes":       len(msg.Body),
+		"confirmed":   true,
+	}
+
+	jsonBytes, _ := json.Marshal(result)
+	return 200, jsonBytes, nil
+}
+
+// amqpBrokerFor returns the pooled connection to brokerURL, dialing it if
+// there is none or the last one was closed.
+func amqpBrokerFor(brokerURL string) (*amqpBroker, error) {
+
+	amqpBrokers.Lock()
+	defer amqpBrokers.Unlock()
+
+	if b, ok := amqpBrokers.byURL[brokerURL]; ok && !b.conn.IsClosed() {
+		return b, nil
+	}
+
+	conn, err := amqp.DialConfig(brokerURL, amqp.Config{
+		Heartbeat:  10 * time.Second,
+		Locale:     "en_US",
+		Dial:       amqp.DefaultDial(amqpDialTimeout),
+		Properties: amqp.Table{"connection_name": "goflow"},
+	})
+	if err != nil {
+		return nil, amqpError(err)
+	}
+
+	b := &amqpBroker{conn: conn, idle: make(chan *amqpChannel, amqpIdleChannels)}
+	amqpBrokers.byURL[brokerURL] = b
+	return b, nil
+}
+
+// channel takes an idle channel, or opens one when none is free.
+func (b *amqpBroker) channel() (*amqpChannel, error) {
+
+	for {
+		select {
+		case c := <-b.idle:
+			if !c.ch.IsClosed() {
+				return c, nil
+			}
+		default:
+			ch, err := b.conn.Channel()
+			if err != nil {
+				return nil, err
+			}
+			if err := ch.Confirm(false); err != nil {
+				ch.Close()
+				return nil, err
+			}
+			return &amqpChannel{
+				ch:      ch,
+				returns: ch.NotifyReturn(make(chan amqp.Return, 1)),
+				closed:  ch.NotifyClose(make(chan *amqp.Error, 1)),
+			}, nil
+		}
+	}
+}
+
+// release hands c back for the next job, closing it if enough are idle.
+func (b *amqpBroker) release(c *amqpChannel) {
+
+	// Drop a return that arrived too late to be matched
+	select {
+	case <-c.returns:
+	default:
+	}
+
+	select {
+	case b.idle <- c:
+	default:
+		c.ch.Close()
+	}
+}
+
+// amqpError marks broker refusals that a retry cannot fix as permanent:
+// a missing exchange, no access, bad arguments, bad credentials.
+func amqpError(err error) error {
+
+	var e *amqp.Error
+	if errors.As(err, &e) {
+		switch e.Code {
+		case amqp.NotFound, amqp.AccessRefused, amqp.PreconditionFailed,
+			amqp.NotAllowed, amqp.SyntaxError, amqp.CommandInvalid:
+			return Permanent(err)
+		}
+	}
+	if errors.Is(err, amqp.ErrCredentials) || errors.Is(err, amqp.ErrVhost) || errors.Is(err, amqp.ErrSASL) {
+		return Permanent(err)
+	}
+	return err
+}
+
+// amqpTable converts JSON objects in headers to AMQP tables.
+func amqpTable(m map[string]interface{}) amqp.Table {
+
+	t := amqp.Table{}
+	for k, v := range m {
+		t[k] = amqpValue(v)
+	}
+	return t
+}
+
+func amqpValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		return amqpTable(val)
+	case []interface{}:
+		out := make([]interface{}, len(val))
+		for i, item := range val {
+			out[i] = amqpValue(item)
+		}
+		return out
+	}
+	return v
+}
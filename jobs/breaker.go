@@ -0,0 +1,120 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Outbound HTTP jobs share one circuit breaker per destination host. After
+// breakerFailures failures in a row (network errors and 5xx responses) the
+// circuit opens: for breakerCooldown, requests to that host fail fast and
+// their jobs go back in the queue without using up an attempt. Then one
+// request goes through as a probe. If it succeeds the circuit closes, if
+// it fails the circuit opens again.
+
+var (
+	breakerFailures = 5
+	breakerCooldown = 30 * time.Second
+)
+
+// ConfigureBreakers sets how many failures in a row open a host's circuit
+// and how long it stays open. failures of 0 turns the breakers off.
+func ConfigureBreakers(failures int, cooldown time.Duration) {
+	breakerFailures, breakerCooldown = failures, cooldown
+}
+
+type circuit struct {
+	failures  int
+	openUntil time.Time
+
+	// probeUntil is set while the probe after a cooldown is in flight;
+	// a probe that never reports back is replaced once it passes
+	probeUntil time.Time
+}
+
+var (
+	circuitsMu sync.Mutex
+	circuits   = map[string]*circuit{}
+)
+
+// circuitAllow reports whether a request to host may be sent now and, if
+// not, how long until it is worth trying again.
+func circuitAllow(host string, now time.Time) (time.Duration, bool) {
+
+	circuitsMu.Lock()
+	defer circuitsMu.Unlock()
+
+	c := circuits[host]
+	if breakerFailures <= 0 || c == nil || c.failures < breakerFailures {
+		return 0, true
+	}
+
+	if now.Before(c.openUntil) {
+		return c.openUntil.Sub(now), false
+	}
+
+	if now.Before(c.probeUntil) {
+		return c.probeUntil.Sub(now), false
+	}
+
+	c.probeUntil = now.Add(breakerCooldown)
+	return 0, true
+}
+
+// circuitRecord counts the outcome of a request to host.
+func circuitRecord(host string, failed bool, now time.Time) {
+
+	circuitsMu.Lock()
+	defer circuitsMu.Unlock()
+
+	if !failed {
+		if c := circuits[host]; c != nil && c.failures >= breakerFailures && breakerFailures > 0 {
+			slog.Info("Circuit closed", "host", host)
+		}
+		delete(circuits, host)
+		return
+	}
+
+	c := circuits[host]
+	if c == nil {
+		c = &circuit{}
+		circuits[host] = c
+	}
+
+	c.failures++
+	c.probeUntil = time.Time{}
+
+	if breakerFailures > 0 && c.failures >= breakerFailures {
+		if c.failures == breakerFailures {
+			slog.Warn("Circuit opened", "host", host, "failures", c.failures)
+		}
+		c.openUntil = now.Add(breakerCooldown)
+	}
+}
+
+// sendThroughBreaker sends req with client unless the circuit for its host
+// is open, in which case the job is deferred until the circuit may close.
+func sendThroughBreaker(client *http.Client, req *http.Request) (*http.Response, error) {
+
+	host := req.URL.Host
+
+	if wait, ok := circuitAllow(host, time.Now()); !ok {
+		return nil, Defer(fmt.Errorf("circuit open for %s", host), wait)
+	}
+
+	resp, err := client.Do(req)
+
+	// A job cancelled on its side says nothing about the destination
+	failed := err != nil && !errors.Is(req.Context().Err(), context.Canceled)
+	if err == nil && resp.StatusCode >= 500 {
+		failed = true
+	}
+	circuitRecord(host, failed, time.Now())
+
+	return resp, err
+}
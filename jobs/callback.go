@@ -2,9 +2,10 @@ package jobs
 
 import (
 	"bytes"
-	"context"   // ✅ ADD
+	"context" // ✅ ADD
 	"crypto/hmac"
 	"crypto/sha256"
+	"database/sql"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
@@ -33,24 +34,38 @@ func executeCallback(ctx context.Context, payload map[string]interface{}) (int,
 	}
 	jobID := int(jobIDFloat)
 
-	// Fetch job from DB
+	// Fetch job from DB; only the callback's own tenant's jobs
 	var status string
 	var responseBody []byte
 	var lastError *string
 
-	err := DB.QueryRow(`
+	err := DB.QueryRowContext(ctx, `
 		SELECT status, response_body, last_error
 		FROM jobs
-		WHERE id = $1
-	`, jobID).Scan(&status, &responseBody, &lastError)
+		WHERE id = $1 AND tenant_id = $2
+	`, jobID, tenantOrDefault(ctx)).Scan(&status, &responseBody, &lastError)
 
+	if err == sql.ErrNoRows {
+		return 0, nil, Permanent(fmt.Errorf("job %d not found", jobID))
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+
+	deliveryID := deliveryIDFor(ctx, "callback")
+
+	acked, ackStatus, ackBody, err := DeliveryAcknowledged(ctx, deliveryID)
 	if err != nil {
 		return 0, nil, err
 	}
+	if acked {
+		return ackStatus, ackBody, nil
+	}
 
 	body := map[string]interface{}{
-		"job_id": jobID,
-		"status": status,
+		"delivery_id": deliveryID,
+		"job_id":      jobID,
+		"status":      status,
 	}
 
 	if includeResponse {
@@ -77,6 +92,7 @@ func executeCallback(ctx context.Context, payload map[string]interface{}) (int,
 	}
 
 	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(DeliveryHeader, deliveryID)
 
 	// Optional HMAC signing
 	if secret != "" {
@@ -87,10 +103,11 @@ func executeCallback(ctx context.Context, payload map[string]interface{}) (int,
 	}
 
 	client := &http.Client{
-		Timeout: 10 * time.Second,
+		Timeout:   10 * time.Second,
+		Transport: transportFor(ctx, nil),
 	}
 
-	resp, err := client.Do(req)
+	resp, err := sendThroughBreaker(client, req)
 	if err != nil {
 
 		// 🔥 HANDLE CANCEL
@@ -109,5 +126,10 @@ func executeCallback(ctx context.Context, payload map[string]interface{}) (int,
 			fmt.Errorf("callback returned status %d", resp.StatusCode)
 	}
 
+	ownJobID, _ := JobIDFromContext(ctx)
+	if err := RecordDelivery(ctx, deliveryID, ownJobID, url, resp.StatusCode, respBytes); err != nil {
+		return 0, nil, err
+	}
+
 	return resp.StatusCode, respBytes, nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,42 @@
+package jobs
+
+import (
+	"context"
+	"time"
+)
+
+// Clock is the single time source for scheduling decisions. Claims compare
+// run_at against the database's NOW(), so schedules must be computed from
+// the same clock to avoid early or late runs when app and DB clocks drift.
+type Clock interface {
+	Now(ctx context.Context) (time.Time, error)
+}
+
+// DBClock reads the current time from Postgres. Without a database (the
+// SQLite and memory stores) the claims compare against this process's
+// clock, so it does too.
+type DBClock struct{}
+
+func (DBClock) Now(ctx context.Context) (time.Time, error) {
+	if DB == nil {
+		return time.Now().UTC(), nil
+	}
+
+	var now time.Time
+	err := DB.QueryRowContext(ctx, `SELECT NOW()`).Scan(&now)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return now.UTC(), nil
+}
+
+// FixedClock always returns the same instant. Useful in tests.
+type FixedClock time.Time
+
+func (c FixedClock) Now(ctx context.Context) (time.Time, error) {
+	return time.Time(c).UTC(), nil
+}
+
+// SchedulerClock is used by every executor that computes a future run_at.
+// Replace it to control time in tests.
+var SchedulerClock Clock = DBClock{}
@@ -0,0 +1,256 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// condition tests a finished job's response and enqueues one of two jobs:
+//
+//	{"job_id": 41, "path": "$.price", "operator": "<", "value": 100,
+//	 "then": {"type": "send_email", "payload": {...}},
+//	 "else": {"type": "http_request", "payload": {...}}}
+//
+// Without job_id it tests the "parent" response an on_success or
+// on_failure hook is given, so a condition can follow a job directly.
+// The job it enqueues gets the tested job as its own "parent".
+// "else" is optional; when the branch taken has no job, nothing is
+// enqueued.
+
+func executeCondition(ctx context.Context, payload map[string]interface{}) (int, []byte, error) {
+
+	path, _ := payload["path"].(string)
+	if path == "" {
+		return 0, nil, fmt.Errorf("missing 'path'")
+	}
+
+	operator, _ := payload["operator"].(string)
+	if operator == "" {
+		return 0, nil, fmt.Errorf("missing 'operator'")
+	}
+
+	response, err := conditionResponse(ctx, payload)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	actual, found := lookupJSONPath(response, path)
+
+	matched, err := compareCondition(operator, actual, found, payload["value"])
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// The branch job sees the tested job as its parent
+	parent, _ := payload["parent"].(map[string]interface{})
+	if id, ok := payload["job_id"].(float64); ok {
+		parent = map[string]interface{}{"job_id": id, "response": response}
+	}
+
+	branch := "else"
+	if matched {
+		branch = "then"
+	}
+
+	result := map[string]interface{}{
+		"matched": matched,
+		"actual":  actual,
+		"branch":  branch,
+	}
+
+	if next, ok := payload[branch].(map[string]interface{}); ok {
+
+		nextType, _ := next["type"].(string)
+		if nextType == "" {
+			return 0, nil, fmt.Errorf("'%s' missing type", branch)
+		}
+
+		nextPayload := map[string]interface{}{}
+		if p, ok := next["payload"].(map[string]interface{}); ok {
+			for k, v := range p {
+				nextPayload[k] = v
+			}
+		}
+		if parent != nil {
+			nextPayload["parent"] = parent
+		}
+
+		payloadJSON, err := json.Marshal(nextPayload)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		err = enqueueFollowUp(ctx, FollowUp{
+			Type:    nextType,
+			Payload: payloadJSON,
+		})
+		if err != nil {
+			return 0, nil, err
+		}
+
+		result["enqueued_type"] = nextType
+	}
+
+	jsonBytes, _ := json.Marshal(result)
+
+	return 200, jsonBytes, nil
+}
+
+// conditionResponse loads the response the condition tests: job_id's,
+// which must have completed and belong to the same tenant, or the hook
+// parent's.
+func conditionResponse(ctx context.Context, payload map[string]interface{}) (interface{}, error) {
+
+	idRaw, ok := payload["job_id"].(float64)
+	if !ok {
+		parent, ok := payload["parent"].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("missing 'job_id'")
+		}
+		return parent["response"], nil
+	}
+	jobID := int(idRaw)
+
+	tenant := tenantOrDefault(ctx)
+
+	var status string
+	var body []byte
+
+	err := DB.QueryRowContext(ctx, `
+		SELECT status, response_body
+		FROM jobs
+		WHERE id = $1 AND tenant_id = $2
+	`, jobID, tenant).Scan(&status, &body)
+
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("job %d not found", jobID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Pending or processing: the retry may find it finished
+	if status != "completed" {
+		return nil, fmt.Errorf("job %d is %s, not completed", jobID, status)
+	}
+
+	var response interface{}
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &response); err != nil {
+			return nil, fmt.Errorf("job %d response is not JSON", jobID)
+		}
+	}
+	return response, nil
+}
+
+// lookupJSONPath follows a JSONPath of keys and indexes, such as
+// "$.items[0].price" ("$" and the leading dot are optional).
+func lookupJSONPath(doc interface{}, path string) (interface{}, bool) {
+
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	path = strings.ReplaceAll(path, "[", ".[")
+
+	current := doc
+	for _, part := range strings.Split(path, ".") {
+		if part == "" {
+			continue
+		}
+
+		if strings.HasPrefix(part, "[") && strings.HasSuffix(part, "]") {
+			i, err := strconv.Atoi(part[1 : len(part)-1])
+			list, ok := current.([]interface{})
+			if err != nil || !ok || i < 0 || i >= len(list) {
+				return nil, false
+			}
+			current = list[i]
+			continue
+		}
+
+		obj, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		current, ok = obj[part]
+		if !ok {
+			return nil, false
+		}
+	}
+
+	return current, true
+}
+
+// compareCondition applies operator to the value found at the path.
+func compareCondition(operator string, actual interface{}, found bool, expected interface{}) (bool, error) {
+
+	switch operator {
+	case "exists":
+		return found, nil
+	case "not_exists":
+		return !found, nil
+	}
+
+	if !found {
+		return false, nil
+	}
+
+	switch operator {
+	case "==":
+		return reflect.DeepEqual(actual, expected), nil
+
+	case "!=":
+		return !reflect.DeepEqual(actual, expected), nil
+
+	case "contains":
+		switch a := actual.(type) {
+		case string:
+			s, ok := expected.(string)
+			return ok && strings.Contains(a, s), nil
+		case []interface{}:
+			for _, item := range a {
+				if reflect.DeepEqual(item, expected) {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+
+	case "<", "<=", ">", ">=":
+		a, ok := conditionNumber(actual)
+		if !ok {
+			return false, nil
+		}
+		b, ok := conditionNumber(expected)
+		if !ok {
+			return false, fmt.Errorf("'value' must be a number for %s", operator)
+		}
+		switch operator {
+		case "<":
+			return a < b, nil
+		case "<=":
+			return a <= b, nil
+		case ">":
+			return a > b, nil
+		default:
+			return a >= b, nil
+		}
+	}
+
+	return false, fmt.Errorf("unknown operator %q", operator)
+}
+
+// conditionNumber reads numbers and numeric strings ("19.99").
+func conditionNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(n), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
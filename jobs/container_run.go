@@ -0,0 +1,417 @@
+package jobs
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// container_run runs an image to completion, for work too heavy to run
+// inside GoFlow:
+//
+//	{"image": "ghcr.io/acme/reindex:1.4", "command": ["/bin/reindex"],
+//	 "args": ["--full"], "env": {"SHARD": "3"},
+//	 "max_memory_mb": 2048, "cpus": 2, "timeout_seconds": 3600}
+//
+// "runtime" (or ContainerSettings.Runtime) is "docker", the default, or
+// "kubernetes", which runs the payload as a k8s_job. Docker is reached
+// through ContainerSettings.DockerHost, else the local socket. "command"
+// replaces the image's entrypoint and "args" its command, as in
+// Kubernetes. With ContainerSettings.Images set, only images starting
+// with one of its entries may run.
+//
+// The response records the exit code and the last 200 lines of output. A
+// non-zero exit fails the attempt; the container is removed either way.
+
+const (
+	defaultContainerTimeout = 30 * time.Minute
+	containerLogLines       = 200
+)
+
+// ContainerSettings is where container_run and k8s_job run containers.
+type ContainerSettings struct {
+	// Runtime is the default for payloads without one
+	Runtime string `yaml:"runtime"`
+
+	// Images are the allowed image prefixes; empty allows any image
+	Images []string `yaml:"images"`
+
+	// DockerHost is a unix://, tcp:// or https:// Docker Engine address
+	DockerHost string `yaml:"docker_host"`
+
+	// K8sAPI and K8sToken reach Kubernetes from outside a cluster;
+	// in-cluster the pod's service account is used
+	K8sAPI   string `yaml:"k8s_api"`
+	K8sToken string `yaml:"k8s_token"`
+}
+
+var containerSettings ContainerSettings
+
+// ConfigureContainers sets where container_run and k8s_job run containers.
+func ConfigureContainers(s ContainerSettings) {
+	containerSettings = s
+}
+
+func executeContainerRun(ctx context.Context, payload map[string]interface{}) (int, []byte, error) {
+
+	image, ok := payload["image"].(string)
+	if !ok || image == "" {
+		return 0, nil, fmt.Errorf("missing 'image'")
+	}
+	if !containerImageAllowed(image) {
+		return 0, nil, Permanent(fmt.Errorf("image %s is not allowed on this server", image))
+	}
+
+	runtime, _ := payload["runtime"].(string)
+	if runtime == "" {
+		runtime = containerSettings.Runtime
+	}
+
+	switch runtime {
+	case "", "docker":
+		return runDockerContainer(ctx, image, payload)
+	case "kubernetes":
+		return executeK8sJob(ctx, k8sContainerPayload(payload))
+	default:
+		return 0, nil, Permanent(fmt.Errorf("unsupported runtime: %s", runtime))
+	}
+}
+
+func containerImageAllowed(image string) bool {
+
+	if len(containerSettings.Images) == 0 {
+		return true
+	}
+	for _, prefix := range containerSettings.Images {
+		if prefix != "" && strings.HasPrefix(image, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// k8sContainerPayload turns the resource limits into k8s_job resources.
+func k8sContainerPayload(payload map[string]interface{}) map[string]interface{} {
+
+	if _, ok := payload["resources"]; ok {
+		return payload
+	}
+
+	limits := map[string]interface{}{}
+	if mb, ok := payload["max_memory_mb"].(float64); ok && mb > 0 {
+		limits["memory"] = fmt.Sprintf("%dMi", int64(mb))
+	}
+	if cpus, ok := payload["cpus"].(float64); ok && cpus > 0 {
+		limits["cpu"] = strconv.FormatFloat(cpus, 'f', -1, 64)
+	}
+	if len(limits) == 0 {
+		return payload
+	}
+
+	out := make(map[string]interface{}, len(payload)+1)
+	for k, v := range payload {
+		out[k] = v
+	}
+	out["resources"] = map[string]interface{}{"limits": limits}
+	return out
+}
+
+// dockerClient talks to the Docker Engine API. Paths are unversioned, so
+// the daemon answers in its own API version.
+type dockerClient struct {
+	baseURL string
+	http    *http.Client
+}
+
+func newDockerClient(ctx context.Context) (*dockerClient, error) {
+
+	host := containerSettings.DockerHost
+	if host == "" {
+		host = "unix:///var/run/docker.sock"
+	}
+
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, fmt.Errorf("invalid docker host %q: %w", host, err)
+	}
+
+	switch u.Scheme {
+	case "unix":
+		socket := u.Path
+		return &dockerClient{
+			baseURL: "http://docker",
+			http: &http.Client{Transport: transportFor(ctx, &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socket)
+				},
+			})},
+		}, nil
+	case "tcp", "http":
+		return &dockerClient{baseURL: "http://" + u.Host, http: &http.Client{Transport: transportFor(ctx, nil)}}, nil
+	case "https":
+		return &dockerClient{baseURL: "https://" + u.Host, http: &http.Client{Transport: transportFor(ctx, nil)}}, nil
+	}
+	return nil, fmt.Errorf("unsupported docker host %q", host)
+}
+
+// do sends a request and returns the response for the caller to read and
+// close. Calls that block until the container exits rely on ctx for their
+// deadline.
+func (c *dockerClient) do(ctx context.Context, method, path string, body interface{}) (*http.Response, error) {
+
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
+		var e struct {
+			Message string `json:"message"`
+		}
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		if json.Unmarshal(b, &e) != nil || e.Message == "" {
+			e.Message = strings.TrimSpace(string(b))
+		}
+		return resp, ResponseError(resp, fmt.Errorf("docker API %s %s returned %d: %s", method, path, resp.StatusCode, e.Message))
+	}
+	return resp, nil
+}
+
+// call is do for requests whose response is JSON or nothing.
+func (c *dockerClient) call(ctx context.Context, method, path string, body, out interface{}) (int, error) {
+
+	resp, err := c.do(ctx, method, path, body)
+	if err != nil {
+		if resp != nil {
+			return resp.StatusCode, err
+		}
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp.StatusCode, err
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+func runDockerContainer(ctx context.Context, image string, payload map[string]interface{}) (int, []byte, error) {
+
+	timeout := defaultContainerTimeout
+	if t, ok := payload["timeout_seconds"].(float64); ok && t > 0 {
+		timeout = time.Duration(t) * time.Second
+	}
+
+	network, _ := payload["network"].(string)
+	if network == "host" || strings.HasPrefix(network, "container:") {
+		return 0, nil, Permanent(fmt.Errorf("network %q is not allowed", network))
+	}
+
+	client, err := newDockerClient(ctx)
+	if err != nil {
+		return 0, nil, Permanent(err)
+	}
+
+	// Retries of the same GoFlow job reuse the name, so a container left by
+	// an earlier attempt is picked up instead of started twice
+	name := "goflow-" + strings.ToLower(NewDeliveryID()[:10])
+	labels := map[string]string{"goflow.managed": "true"}
+	if jobID, ok := JobIDFromContext(ctx); ok {
+		name = fmt.Sprintf("goflow-job-%d", jobID)
+		labels["goflow.job_id"] = strconv.Itoa(jobID)
+	}
+
+	hostConfig := map[string]interface{}{}
+	if mb, ok := payload["max_memory_mb"].(float64); ok && mb > 0 {
+		hostConfig["Memory"] = int64(mb) << 20
+	}
+	if cpus, ok := payload["cpus"].(float64); ok && cpus > 0 {
+		hostConfig["NanoCpus"] = int64(cpus * 1e9)
+	}
+	if network != "" {
+		hostConfig["NetworkMode"] = network
+	}
+
+	config := map[string]interface{}{
+		"Image":      image,
+		"Labels":     labels,
+		"HostConfig": hostConfig,
+	}
+	if cmd := stringList(payload["command"]); cmd != nil {
+		config["Entrypoint"] = cmd
+	}
+	if args := stringList(payload["args"]); args != nil {
+		config["Cmd"] = args
+	}
+	if envMap, ok := payload["env"].(map[string]interface{}); ok {
+		var env []string
+		for k, v := range envMap {
+			env = append(env, k+"="+fmt.Sprint(v))
+		}
+		config["Env"] = env
+	}
+	if dir, ok := payload["workdir"].(string); ok && dir != "" {
+		config["WorkingDir"] = dir
+	}
+
+	createPath := "/containers/create?name=" + url.QueryEscape(name)
+
+	status, err := client.call(ctx, "POST", createPath, config, nil)
+	if status == http.StatusNotFound {
+		// The image is not on the host yet
+		if err := pullDockerImage(ctx, client, image); err != nil {
+			return 0, nil, err
+		}
+		status, err = client.call(ctx, "POST", createPath, config, nil)
+	}
+	if err != nil && status != http.StatusConflict {
+		return status, nil, err
+	}
+
+	containerPath := "/containers/" + url.PathEscape(name)
+	remove := func() {
+		client.call(context.Background(), "DELETE", containerPath+"?force=true", nil, nil)
+	}
+
+	// 304 means an earlier attempt already started it
+	if status, err := client.call(ctx, "POST", containerPath+"/start", nil, nil); err != nil && status != http.StatusNotModified {
+		remove()
+		return status, nil, err
+	}
+
+	runCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var wait struct {
+		StatusCode int `json:"StatusCode"`
+		Error      *struct {
+			Message string `json:"Message"`
+		} `json:"Error"`
+	}
+	if _, err := client.call(runCtx, "POST", containerPath+"/wait?condition=not-running", nil, &wait); err != nil {
+		// Don't leave the container running after we give up on it
+		remove()
+
+		if ctx.Err() == context.Canceled {
+			return 0, nil, fmt.Errorf("container run cancelled")
+		}
+		if runCtx.Err() == context.DeadlineExceeded {
+			return 0, nil, fmt.Errorf("container %s timed out after %v", name, timeout)
+		}
+		return 0, nil, err
+	}
+
+	logs := dockerLogs(ctx, client, containerPath)
+	remove()
+
+	result := map[string]interface{}{
+		"runtime":   "docker",
+		"container": name,
+		"image":     image,
+		"succeeded": wait.StatusCode == 0,
+		"exit_code": wait.StatusCode,
+		"logs":      logs,
+	}
+	jsonBytes, _ := json.Marshal(result)
+
+	if wait.Error != nil && wait.Error.Message != "" {
+		return 500, jsonBytes, fmt.Errorf("container %s: %s", name, wait.Error.Message)
+	}
+	if wait.StatusCode != 0 {
+		return 500, jsonBytes, fmt.Errorf("container %s failed with exit code %d", name, wait.StatusCode)
+	}
+
+	return 200, jsonBytes, nil
+}
+
+// pullDockerImage pulls image. The daemon streams progress as JSON lines
+// and reports a failed pull in the stream, after a 200.
+func pullDockerImage(ctx context.Context, client *dockerClient, image string) error {
+
+	jobLog(ctx, "pulling %s", image)
+
+	// Without a tag the daemon would pull every tag of the repository
+	ref := image
+	if !strings.Contains(ref, "@") && !strings.Contains(ref[strings.LastIndex(ref, "/")+1:], ":") {
+		ref += ":latest"
+	}
+
+	resp, err := client.do(ctx, "POST", "/images/create?fromImage="+url.QueryEscape(ref), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var msg struct {
+			Error string `json:"error"`
+		}
+		if err := dec.Decode(&msg); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("pull %s: %w", image, err)
+		}
+		if msg.Error != "" {
+			return fmt.Errorf("pull %s: %s", image, msg.Error)
+		}
+	}
+}
+
+// dockerLogs returns the container's last lines of stdout and stderr,
+// interleaved as written.
+func dockerLogs(ctx context.Context, client *dockerClient, containerPath string) string {
+
+	resp, err := client.do(ctx, "GET", containerPath+"/logs?stdout=true&stderr=true&tail="+strconv.Itoa(containerLogLines), nil)
+	if err != nil {
+		return ""
+	}
+	defer resp.Body.Close()
+
+	raw, _ := io.ReadAll(io.LimitReader(resp.Body, maxCommandOutput))
+
+	// Without a TTY each chunk has an 8 byte header: the stream, three
+	// zero bytes and the big-endian length
+	var out strings.Builder
+	for len(raw) >= 8 && raw[0] <= 2 && raw[1] == 0 && raw[2] == 0 && raw[3] == 0 {
+		n := int(binary.BigEndian.Uint32(raw[4:8]))
+		raw = raw[8:]
+		if n > len(raw) {
+			n = len(raw)
+		}
+		out.Write(raw[:n])
+		raw = raw[n:]
+	}
+	out.Write(raw)
+	return out.String()
+}
@@ -0,0 +1,135 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// crawledPage is one page fetched by crawlSite.
+type crawledPage struct {
+	URL          string
+	Depth        int
+	Status       int
+	HTML         bool
+	LastModified time.Time
+	Links        []string
+	Err          error
+}
+
+const crawlMaxBody = 5 << 20
+
+// crawlSite fetches start and follows links on the same host breadth
+// first, up to maxDepth links away and maxPages pages in total. Links to
+// other hosts are reported on each page but never fetched.
+func crawlSite(ctx context.Context, client *http.Client, start string, maxDepth, maxPages int) ([]crawledPage, error) {
+
+	root, err := url.Parse(start)
+	if err != nil || (root.Scheme != "http" && root.Scheme != "https") || root.Host == "" {
+		return nil, fmt.Errorf("invalid start url: %s", start)
+	}
+	root.Fragment = ""
+
+	type queued struct {
+		url   string
+		depth int
+	}
+
+	queue := []queued{{root.String(), 0}}
+	seen := map[string]bool{root.String(): true}
+	var pages []crawledPage
+
+	for len(queue) > 0 && len(pages) < maxPages {
+		if ctx.Err() != nil {
+			return pages, ctx.Err()
+		}
+
+		next := queue[0]
+		queue = queue[1:]
+
+		page := fetchPage(ctx, client, next.url)
+		page.Depth = next.depth
+		pages = append(pages, page)
+
+		if next.depth >= maxDepth {
+			continue
+		}
+
+		for _, link := range page.Links {
+			u, _ := url.Parse(link)
+			if u.Host != root.Host || seen[link] {
+				continue
+			}
+			seen[link] = true
+			queue = append(queue, queued{link, next.depth + 1})
+		}
+	}
+
+	return pages, nil
+}
+
+func fetchPage(ctx context.Context, client *http.Client, pageURL string) crawledPage {
+
+	page := crawledPage{URL: pageURL}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", pageURL, nil)
+	if err != nil {
+		page.Err = err
+		return page
+	}
+	req.Header.Set("User-Agent", "GoFlow crawler")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		page.Err = err
+		return page
+	}
+	defer resp.Body.Close()
+
+	page.Status = resp.StatusCode
+	if lm, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		page.LastModified = lm
+	}
+
+	page.HTML = strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html")
+	if resp.StatusCode >= 400 || !page.HTML {
+		return page
+	}
+
+	doc, err := goquery.NewDocumentFromReader(io.LimitReader(resp.Body, crawlMaxBody))
+	if err != nil {
+		page.Err = err
+		return page
+	}
+
+	// Redirects change the base that relative links resolve against
+	base := resp.Request.URL
+	if href, ok := doc.Find("base[href]").First().Attr("href"); ok {
+		if b, err := base.Parse(href); err == nil {
+			base = b
+		}
+	}
+
+	unique := map[string]bool{}
+	doc.Find("a[href]").Each(func(_ int, s *goquery.Selection) {
+		href, _ := s.Attr("href")
+		u, err := base.Parse(strings.TrimSpace(href))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return
+		}
+		u.Fragment = ""
+		link := u.String()
+		if !unique[link] {
+			unique[link] = true
+			page.Links = append(page.Links, link)
+		}
+	})
+
+	return page
+}
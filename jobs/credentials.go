@@ -0,0 +1,217 @@
+package jobs
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Executors that call cloud APIs share their credential handling here:
+// key material from the payload or the environment, Google service
+// account access tokens, and the JWTs both are built on.
+
+// googleServiceAccount is a Google Cloud service account key, the JSON
+// file the console downloads.
+type googleServiceAccount struct {
+	ProjectID   string `json:"project_id"`
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+
+	key *rsa.PrivateKey
+}
+
+// keyMaterial returns a key from the payload field, else from the
+// variable, which may name a file instead. A payload never reads files:
+// it comes from API callers.
+func keyMaterial(payload map[string]interface{}, field, env string) (string, error) {
+
+	if v, ok := payload[field].(string); ok && v != "" {
+		return v, nil
+	}
+
+	v := os.Getenv(env)
+	if v == "" || strings.HasPrefix(strings.TrimSpace(v), "{") || strings.Contains(v, "-----BEGIN") {
+		return v, nil
+	}
+	b, err := os.ReadFile(v)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", env, err)
+	}
+	return string(b), nil
+}
+
+// googleTokenURL is Google's OAuth token endpoint. Service accounts name
+// it too, but one from a payload must not choose where its assertion goes.
+const googleTokenURL = "https://oauth2.googleapis.com/token"
+
+// googleCredentials parses a service account's JSON for provider.
+func googleCredentials(provider, s string) (*googleServiceAccount, error) {
+
+	if s == "" {
+		return nil, fmt.Errorf("no credentials for %s", provider)
+	}
+
+	var sa googleServiceAccount
+	if err := json.Unmarshal([]byte(s), &sa); err != nil {
+		return nil, fmt.Errorf("%s credentials: %w", provider, err)
+	}
+	if sa.ClientEmail == "" || sa.PrivateKey == "" {
+		return nil, fmt.Errorf("%s credentials need client_email and private_key", provider)
+	}
+
+	key, err := parsePrivateKey(sa.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("%s credentials: %w", provider, err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s credentials: private_key is not an RSA key", provider)
+	}
+	sa.key = rsaKey
+
+	return &sa, nil
+}
+
+// googleTokens caches OAuth access tokens per service account and scope;
+// they last an hour.
+var googleTokens = struct {
+	sync.Mutex
+	entries map[string]cachedToken
+}{entries: make(map[string]cachedToken)}
+
+type cachedToken struct {
+	token   string
+	expires time.Time
+}
+
+// googleAccessToken trades a signed assertion for an access token.
+func googleAccessToken(ctx context.Context, sa *googleServiceAccount, scope string) (string, error) {
+
+	googleTokens.Lock()
+	defer googleTokens.Unlock()
+
+	// Keyed by the private key too: a payload can name any client_email
+	id := sa.ClientEmail + "/" + keyFingerprint(sa.PrivateKey) + " " + scope
+	if t, ok := googleTokens.entries[id]; ok && time.Until(t.expires) > time.Minute {
+		return t.token, nil
+	}
+
+	now := time.Now()
+	assertion, err := signJWT(
+		map[string]interface{}{"alg": "RS256", "typ": "JWT"},
+		map[string]interface{}{
+			"iss":   sa.ClientEmail,
+			"scope": scope,
+			"aud":   googleTokenURL,
+			"iat":   now.Unix(),
+			"exp":   now.Add(time.Hour).Unix(),
+		},
+		func(digest []byte) ([]byte, error) {
+			return rsa.SignPKCS1v15(rand.Reader, sa.key, crypto.SHA256, digest)
+		},
+	)
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+	form.Set("assertion", assertion)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", googleTokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	client := &http.Client{Timeout: 30 * time.Second, Transport: transportFor(ctx, nil)}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", ResponseError(resp, fmt.Errorf("google token exchange returned status %d: %s", resp.StatusCode, msg))
+	}
+
+	var t struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&t); err != nil || t.AccessToken == "" {
+		return "", errors.New("google token exchange returned no access token")
+	}
+
+	googleTokens.entries[id] = cachedToken{
+		token:   t.AccessToken,
+		expires: now.Add(time.Duration(t.ExpiresIn) * time.Second),
+	}
+	return t.AccessToken, nil
+}
+
+// parsePrivateKey reads a PEM private key in PKCS#8, PKCS#1 or SEC 1
+// form. Service account JSON escapes its newlines, which are restored.
+func parsePrivateKey(s string) (crypto.Signer, error) {
+
+	block, _ := pem.Decode([]byte(strings.ReplaceAll(s, `\n`, "\n")))
+	if block == nil {
+		return nil, errors.New("no PEM private key")
+	}
+
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		if signer, ok := key.(crypto.Signer); ok {
+			return signer, nil
+		}
+		return nil, errors.New("unsupported private key type")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("unsupported private key")
+}
+
+// keyFingerprint identifies key material in a cache key without holding
+// on to it.
+func keyFingerprint(pem string) string {
+	sum := sha256.Sum256([]byte(pem))
+	return hex.EncodeToString(sum[:8])
+}
+
+// signJWT returns a compact JWS; sign gets the SHA-256 digest of the
+// signing input.
+func signJWT(header, claims map[string]interface{}, sign func(digest []byte) ([]byte, error)) (string, error) {
+
+	h, _ := json.Marshal(header)
+	c, _ := json.Marshal(claims)
+
+	input := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	digest := sha256.Sum256([]byte(input))
+
+	sig, err := sign(digest[:])
+	if err != nil {
+		return "", err
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
@@ -42,7 +42,7 @@ func executeCronSchedule(ctx context.Context, payload map[string]interface{}) (i
 		workflowID := int(wfIDRaw.(float64))
 
 		var status string
-		err := DB.QueryRow(`
+		err := DB.QueryRowContext(ctx, `
 			SELECT status FROM workflows WHERE id = $1
 		`, workflowID).Scan(&status)
 
@@ -51,17 +51,18 @@ func executeCronSchedule(ctx context.Context, payload map[string]interface{}) (i
 		}
 	}
 
-	parser := cron.NewParser(
-		cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow,
-	)
+	timezone, _ := payload["timezone"].(string)
 
-	schedule, err := parser.Parse(cronExpr)
+	schedule, loc, err := ParseCron(cronExpr, timezone)
 	if err != nil {
 		return 0, nil, err
 	}
 
-	now := time.Now().UTC()
-	nextRun := schedule.Next(now)
+	now, err := SchedulerClock.Now(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+	nextRun := schedule.Next(now.In(loc))
 
 	payloadJSON, err := json.Marshal(jobPayload)
 	if err != nil {
@@ -69,10 +70,11 @@ func executeCronSchedule(ctx context.Context, payload map[string]interface{}) (i
 	}
 
 	// 🟢 Schedule actual job
-	_, err = DB.Exec(`
-		INSERT INTO jobs (type, payload, status, run_at)
-		VALUES ($1, $2, 'pending', $3)
-	`, jobType, payloadJSON, nextRun)
+	err = enqueueFollowUp(ctx, FollowUp{
+		Type:    jobType,
+		Payload: payloadJSON,
+		RunAt:   &nextRun,
+	})
 
 	if err != nil {
 		return 0, nil, err
@@ -81,12 +83,14 @@ func executeCronSchedule(ctx context.Context, payload map[string]interface{}) (i
 	// 🔴 RECURSIVE CRON — ONLY IF NOT CANCELLED
 	if ctx.Err() != context.Canceled {
 
-		fullPayloadJSON, _ := json.Marshal(payload)
+		// The stored payload, not the copy with its secrets resolved
+		fullPayloadJSON, _ := json.Marshal(StoredPayload(ctx, payload))
 
-		_, err = DB.Exec(`
-			INSERT INTO jobs (type, payload, status, run_at)
-			VALUES ('cron_schedule', $1, 'pending', $2)
-		`, fullPayloadJSON, nextRun)
+		err = enqueueFollowUp(ctx, FollowUp{
+			Type:    "cron_schedule",
+			Payload: fullPayloadJSON,
+			RunAt:   &nextRun,
+		})
 
 		if err != nil {
 			return 0, nil, err
@@ -101,4 +105,51 @@ func executeCronSchedule(ctx context.Context, payload map[string]interface{}) (i
 	jsonBytes, _ := json.Marshal(result)
 
 	return 200, jsonBytes, nil
-}
\ No newline at end of file
+}
+
+// ParseCron parses a five-field cron expression evaluated in timezone (an
+// IANA name such as "Europe/Berlin"; empty means UTC).
+func ParseCron(expr string, timezone string) (cron.Schedule, *time.Location, error) {
+
+	loc := time.UTC
+	if timezone != "" {
+		l, err := time.LoadLocation(timezone)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid timezone %q: %w", timezone, err)
+		}
+		loc = l
+	}
+
+	parser := cron.NewParser(
+		cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow,
+	)
+
+	schedule, err := parser.Parse(expr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return schedule, loc, nil
+}
+
+// PreviewCron returns the next n run times after from, in the schedule's
+// timezone.
+func PreviewCron(expr string, timezone string, from time.Time, n int) ([]time.Time, error) {
+
+	schedule, loc, err := ParseCron(expr, timezone)
+	if err != nil {
+		return nil, err
+	}
+
+	runs := make([]time.Time, 0, n)
+	next := from.In(loc)
+	for i := 0; i < n; i++ {
+		next = schedule.Next(next)
+		if next.IsZero() {
+			break
+		}
+		runs = append(runs, next)
+	}
+
+	return runs, nil
+}
@@ -40,7 +40,8 @@ func executeDataExtract(ctx context.Context, payload map[string]interface{}) (in
 	}
 
 	client := &http.Client{
-		Timeout: 10 * time.Second,
+		Timeout:   10 * time.Second,
+		Transport: transportFor(ctx, nil),
 	}
 
 	// ✅ CONTEXT-AWARE REQUEST
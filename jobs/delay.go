@@ -40,7 +40,7 @@ func executeDelay(ctx context.Context, payload map[string]interface{}) (int, []b
 		workflowID := int(wfIDRaw.(float64))
 
 		var status string
-		err := DB.QueryRow(`
+		err := DB.QueryRowContext(ctx, `
 			SELECT status FROM workflows WHERE id = $1
 		`, workflowID).Scan(&status)
 
@@ -55,10 +55,11 @@ func executeDelay(ctx context.Context, payload map[string]interface{}) (int, []b
 	}
 
 	// ✅ ONLY SCHEDULE IF NOT CANCELLED
-	_, err = DB.Exec(`
-		INSERT INTO jobs (type, payload, status, run_at)
-		VALUES ($1, $2, 'pending', NOW() + ($3 || ' seconds')::interval)
-	`, nextType, payloadJSON, seconds)
+	err = enqueueFollowUp(ctx, FollowUp{
+		Type:         nextType,
+		Payload:      payloadJSON,
+		DelaySeconds: seconds,
+	})
 
 	if err != nil {
 		return 0, nil, err
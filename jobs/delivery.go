@@ -0,0 +1,76 @@
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+)
+
+// DeliveryHeader carries the delivery ID on every outbound callback and
+// webhook so receivers can deduplicate retried sends.
+const DeliveryHeader = "X-GoFlow-Delivery"
+
+type jobIDKey struct{}
+
+// WithJobID records the ID of the job being executed on ctx.
+func WithJobID(ctx context.Context, jobID int) context.Context {
+	return context.WithValue(ctx, jobIDKey{}, jobID)
+}
+
+// JobIDFromContext returns the ID of the job being executed, if known.
+func JobIDFromContext(ctx context.Context) (int, bool) {
+	id, ok := ctx.Value(jobIDKey{}).(int)
+	return id, ok
+}
+
+// deliveryIDFor derives a stable delivery ID for the current job, so every
+// retry of the same job reuses it. Outside a worker a random ID is used.
+func deliveryIDFor(ctx context.Context, kind string) string {
+	if jobID, ok := JobIDFromContext(ctx); ok {
+		return fmt.Sprintf("%s-%d", kind, jobID)
+	}
+	return kind + "-" + NewDeliveryID()
+}
+
+// NewDeliveryID returns a random delivery ID.
+func NewDeliveryID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// DeliveryAcknowledged reports whether deliveryID was already accepted by its
+// receiver, returning the recorded response when it was.
+func DeliveryAcknowledged(ctx context.Context, deliveryID string) (bool, int, []byte, error) {
+
+	var status int
+	var body []byte
+
+	err := DB.QueryRowContext(ctx, `
+		SELECT response_status, response_body
+		FROM deliveries
+		WHERE delivery_id = $1
+	`, deliveryID).Scan(&status, &body)
+
+	if err == sql.ErrNoRows {
+		return false, 0, nil, nil
+	}
+
+	if err != nil {
+		return false, 0, nil, err
+	}
+
+	return true, status, body, nil
+}
+
+// RecordDelivery persists a successful delivery so it is never re-sent.
+func RecordDelivery(ctx context.Context, deliveryID string, jobID int, url string, status int, body []byte) error {
+	_, err := DB.ExecContext(ctx, `
+		INSERT INTO deliveries (delivery_id, job_id, target_url, response_status, response_body)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (delivery_id) DO NOTHING
+	`, deliveryID, jobID, url, status, body)
+	return err
+}
@@ -0,0 +1,222 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Digests batch notifications. Events are buffered in digest_events under
+// a digest name, by POST /digests/{name}/events or a "digest_event" job:
+//
+//	{"digest": "ops", "kind": "uptime.incident", "summary": "api.example.com is down",
+//	 "data": {...}}
+//
+// A "digest" job, usually on a cron_schedule, collects everything buffered
+// since the last run and sends one summary:
+//
+//	{"name": "ops", "email": "ops@example.com", "webhook_url": "https://hooks.example.com/ops"}
+//
+// Digest names are per tenant: a digest job only collects its own
+// tenant's events. Events are claimed by the digest job's ID, so a retried run resends its
+// batch rather than losing it. Events claimed by a job that ended up
+// failed go to the next run.
+
+const maxDigestEvents = 1000
+
+// DigestEvent is one buffered event.
+type DigestEvent struct {
+	ID        int             `json:"id"`
+	Kind      string          `json:"kind"`
+	Summary   string          `json:"summary"`
+	Data      json.RawMessage `json:"data,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// AddDigestEvent buffers an event for tenant's named digest.
+func AddDigestEvent(ctx context.Context, tenant, digest, kind, summary string, data json.RawMessage) (int, error) {
+
+	if digest == "" {
+		return 0, fmt.Errorf("missing 'digest'")
+	}
+	if kind == "" {
+		kind = "event"
+	}
+	if len(data) == 0 {
+		data = nil
+	}
+
+	var id int
+	err := DB.QueryRowContext(ctx, `
+		INSERT INTO digest_events (tenant_id, digest, kind, summary, data)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id
+	`, tenant, digest, kind, summary, []byte(data)).Scan(&id)
+
+	return id, err
+}
+
+func executeDigestEvent(ctx context.Context, payload map[string]interface{}) (int, []byte, error) {
+
+	digest, _ := payload["digest"].(string)
+	kind, _ := payload["kind"].(string)
+	summary, _ := payload["summary"].(string)
+
+	var data json.RawMessage
+	if d, ok := payload["data"]; ok {
+		data, _ = json.Marshal(d)
+	}
+
+	id, err := AddDigestEvent(ctx, tenantOrDefault(ctx), digest, kind, summary, data)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	jsonBytes, _ := json.Marshal(map[string]interface{}{"digest": digest, "event_id": id})
+	return 200, jsonBytes, nil
+}
+
+func executeDigest(ctx context.Context, payload map[string]interface{}) (int, []byte, error) {
+
+	name, ok := payload["name"].(string)
+	if !ok || name == "" {
+		return 0, nil, fmt.Errorf("missing 'name'")
+	}
+
+	email, _ := payload["email"].(string)
+	hook, _ := payload["webhook_url"].(string)
+	if email == "" && hook == "" {
+		return 0, nil, fmt.Errorf("missing 'email' or 'webhook_url'")
+	}
+
+	jobID, ok := JobIDFromContext(ctx)
+	if !ok {
+		return 0, nil, fmt.Errorf("digest must run as a job")
+	}
+
+	// Claim unclaimed events, keeping any this job claimed on an earlier
+	// attempt and taking back any held by a job that gave up
+	rows, err := DB.QueryContext(ctx, `
+		WITH claimed AS (
+			UPDATE digest_events SET digest_job_id = $2, digested_at = NOW()
+			WHERE id IN (
+				SELECT id FROM digest_events
+				WHERE tenant_id = $4 AND digest = $1 AND (
+					digest_job_id IS NULL OR digest_job_id = $2
+					OR digest_job_id IN (SELECT id FROM jobs WHERE status IN ('failed', 'cancelled', 'expired'))
+				)
+				ORDER BY id
+				LIMIT $3
+				FOR UPDATE SKIP LOCKED
+			)
+			RETURNING id, kind, summary, data, created_at
+		)
+		SELECT id, kind, summary, data, created_at FROM claimed ORDER BY id
+	`, name, jobID, maxDigestEvents, tenantOrDefault(ctx))
+	if err != nil {
+		return 0, nil, err
+	}
+	defer rows.Close()
+
+	events := []DigestEvent{}
+	for rows.Next() {
+		var e DigestEvent
+		var data []byte
+		if err := rows.Scan(&e.ID, &e.Kind, &e.Summary, &data, &e.CreatedAt); err != nil {
+			return 0, nil, err
+		}
+		e.Data = data
+		events = append(events, e)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, nil, err
+	}
+
+	counts := map[string]int{}
+	for _, e := range events {
+		counts[e.Kind]++
+	}
+
+	result := map[string]interface{}{
+		"name":   name,
+		"events": len(events),
+		"counts": counts,
+	}
+
+	sendEmpty, _ := payload["send_empty"].(bool)
+	if len(events) == 0 && !sendEmpty {
+		jsonBytes, _ := json.Marshal(result)
+		return 200, jsonBytes, nil
+	}
+
+	if email != "" {
+		subject, _ := payload["subject"].(string)
+		if subject == "" {
+			subject = fmt.Sprintf("%s digest: %d events", name, len(events))
+		}
+
+		mail, _ := json.Marshal(map[string]interface{}{
+			"to":              email,
+			"subject":         subject,
+			"body":            digestText(name, events, counts),
+			"idempotency_key": deliveryIDFor(ctx, "digest-email"),
+		})
+		if err := enqueueFollowUp(ctx, FollowUp{Type: "send_email", Payload: mail}); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	if hook != "" {
+		secret, _ := payload["webhook_secret"].(string)
+
+		hookPayload, _ := json.Marshal(map[string]interface{}{
+			"url":    hook,
+			"event":  "digest",
+			"secret": secret,
+			"data": map[string]interface{}{
+				"name":   name,
+				"counts": counts,
+				"events": events,
+			},
+		})
+		if err := enqueueFollowUp(ctx, FollowUp{Type: "webhook_delivery", Payload: hookPayload}); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	jsonBytes, _ := json.Marshal(result)
+	return 200, jsonBytes, nil
+}
+
+// digestText groups events by kind, oldest first within each kind.
+func digestText(name string, events []DigestEvent, counts map[string]int) string {
+
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "%d events for the %s digest.\n", len(events), name)
+
+	kinds := make([]string, 0, len(counts))
+	for k := range counts {
+		kinds = append(kinds, k)
+	}
+	sort.Strings(kinds)
+
+	for _, kind := range kinds {
+		fmt.Fprintf(&b, "\n%s (%d)\n", kind, counts[kind])
+		for _, e := range events {
+			if e.Kind != kind {
+				continue
+			}
+			summary := e.Summary
+			if summary == "" {
+				summary = string(e.Data)
+			}
+			fmt.Fprintf(&b, "  %s  %s\n", e.CreatedAt.UTC().Format("Jan 2 15:04"), summary)
+		}
+	}
+
+	return b.String()
+}
@@ -0,0 +1,259 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// dns_check resolves records for a name and compares them with expected
+// values and with the previous check's answer (kept in dns_snapshots):
+//
+//	{"name": "example.com", "record_types": ["A", "MX"],
+//	 "expected": {"A": ["93.184.216.34"]}, "nameserver": "1.1.1.1:53",
+//	 "webhook_url": "https://hooks.example.com/dns"}
+//
+// When a record set changes, or first stops matching what is expected, a
+// webhook_delivery is enqueued with the event "dns.mismatch" or
+// "dns.changed". Like uptime_check, findings are results, not failures.
+
+var dnsRecordTypes = []string{"A", "AAAA", "CNAME", "MX", "NS", "TXT"}
+
+type dnsDiff struct {
+	Expected []string `json:"expected,omitempty"`
+	Previous []string `json:"previous,omitempty"`
+	Actual   []string `json:"actual"`
+}
+
+func executeDNSCheck(ctx context.Context, payload map[string]interface{}) (int, []byte, error) {
+
+	name, ok := payload["name"].(string)
+	if !ok || name == "" {
+		return 0, nil, fmt.Errorf("missing 'name'")
+	}
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+
+	types := stringList(payload["record_types"])
+	if len(types) == 0 {
+		types = []string{"A"}
+	}
+	for i, t := range types {
+		types[i] = strings.ToUpper(t)
+		if !slices.Contains(dnsRecordTypes, types[i]) {
+			return 0, nil, fmt.Errorf("unsupported record type: %s", t)
+		}
+	}
+
+	expected := map[string][]string{}
+	if raw, ok := payload["expected"].(map[string]interface{}); ok {
+		for t, v := range raw {
+			values := stringList(v)
+			normalizeDNSValues(values)
+			expected[strings.ToUpper(t)] = values
+		}
+	}
+
+	resolver := net.DefaultResolver
+	if ns, ok := payload["nameserver"].(string); ok && ns != "" {
+		if _, _, err := net.SplitHostPort(ns); err != nil {
+			ns = net.JoinHostPort(ns, "53")
+		}
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				d := net.Dialer{Timeout: 5 * time.Second}
+				return d.DialContext(ctx, network, ns)
+			},
+		}
+	}
+
+	lookupCtx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+
+	records := map[string][]string{}
+	mismatches := map[string]dnsDiff{}
+	changes := map[string]dnsDiff{}
+	newMismatch := false
+
+	for _, t := range types {
+		values, err := lookupDNS(lookupCtx, resolver, name, t)
+		if err != nil {
+			if ctx.Err() != nil {
+				return 0, nil, ctx.Err()
+			}
+			// NXDOMAIN or an empty answer is itself a record set worth comparing
+			if dnsErr, ok := err.(*net.DNSError); !ok || !dnsErr.IsNotFound {
+				return 0, nil, fmt.Errorf("lookup %s %s: %w", t, name, err)
+			}
+			values = []string{}
+		}
+		normalizeDNSValues(values)
+		records[t] = values
+
+		previous, seen, err := swapDNSSnapshot(ctx, name, t, values)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		changed := seen && !slices.Equal(previous, values)
+		if changed {
+			changes[t] = dnsDiff{Previous: previous, Actual: values}
+		}
+
+		if want, ok := expected[t]; ok && !slices.Equal(want, values) {
+			mismatches[t] = dnsDiff{Expected: want, Actual: values}
+			if !seen || changed {
+				newMismatch = true
+			}
+		}
+	}
+
+	result := map[string]interface{}{
+		"name":       name,
+		"records":    records,
+		"ok":         len(mismatches) == 0,
+		"mismatches": mismatches,
+		"changes":    changes,
+	}
+
+	event := ""
+	switch {
+	case newMismatch:
+		event = "dns.mismatch"
+	case len(changes) > 0:
+		event = "dns.changed"
+	}
+
+	if hook, ok := payload["webhook_url"].(string); ok && hook != "" && event != "" {
+		secret, _ := payload["webhook_secret"].(string)
+
+		hookPayload, _ := json.Marshal(map[string]interface{}{
+			"url":    hook,
+			"event":  event,
+			"secret": secret,
+			"data":   result,
+		})
+
+		if err := enqueueFollowUp(ctx, FollowUp{Type: "webhook_delivery", Payload: hookPayload}); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	result["event"] = event
+
+	jsonBytes, _ := json.Marshal(result)
+	return 200, jsonBytes, nil
+}
+
+func lookupDNS(ctx context.Context, r *net.Resolver, name string, recordType string) ([]string, error) {
+
+	var values []string
+
+	switch recordType {
+	case "A", "AAAA":
+		network := "ip4"
+		if recordType == "AAAA" {
+			network = "ip6"
+		}
+		ips, err := r.LookupIP(ctx, network, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			values = append(values, ip.String())
+		}
+
+	case "CNAME":
+		cname, err := r.LookupCNAME(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		// LookupCNAME returns the name itself when there is no alias
+		if strings.TrimSuffix(cname, ".") != name {
+			values = append(values, cname)
+		}
+
+	case "MX":
+		mxs, err := r.LookupMX(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, mx := range mxs {
+			values = append(values, fmt.Sprintf("%d %s", mx.Pref, mx.Host))
+		}
+
+	case "NS":
+		nss, err := r.LookupNS(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, ns := range nss {
+			values = append(values, ns.Host)
+		}
+
+	case "TXT":
+		txts, err := r.LookupTXT(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, txts...)
+	}
+
+	if values == nil {
+		values = []string{}
+	}
+	return values, nil
+}
+
+// normalizeDNSValues lowercases names, drops trailing dots and sorts, so
+// answers compare equal regardless of order or notation.
+func normalizeDNSValues(values []string) {
+	for i, v := range values {
+		values[i] = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(v)), ".")
+	}
+	slices.Sort(values)
+}
+
+// swapDNSSnapshot stores values as the latest answer and returns the one
+// it replaced. Without a database (remote agents) nothing is remembered.
+func swapDNSSnapshot(ctx context.Context, name string, recordType string, values []string) ([]string, bool, error) {
+
+	if DB == nil {
+		return nil, false, nil
+	}
+
+	var previous []string
+	err := DB.QueryRowContext(ctx, `
+		SELECT record_values FROM dns_snapshots
+		WHERE name = $1 AND record_type = $2
+	`, name, recordType).Scan(pq.Array(&previous))
+
+	seen := true
+	if err == sql.ErrNoRows {
+		seen = false
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	_, err = DB.ExecContext(ctx, `
+		INSERT INTO dns_snapshots (name, record_type, record_values, checked_at)
+		VALUES ($1, $2, $3, NOW())
+		ON CONFLICT (name, record_type) DO UPDATE
+		SET record_values = EXCLUDED.record_values, checked_at = NOW()
+	`, name, recordType, pq.Array(values))
+	if err != nil {
+		return nil, false, err
+	}
+
+	if previous == nil {
+		previous = []string{}
+	}
+	return previous, seen, nil
+}
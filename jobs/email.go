@@ -1,10 +1,16 @@
 package jobs
 
 import (
+	"bytes"
 	"context" // ✅ ADD
+	"encoding/base64"
 	"fmt"
+	"mime"
+	"mime/multipart"
 	"net/smtp"
+	"net/textproto"
 	"os"
+	"path/filepath"
 )
 
 var (
@@ -14,6 +20,23 @@ var (
 	smtpPass = os.Getenv("SMTP_PASS")
 )
 
+// ConfigureSMTP sets the server and credentials send_email uses, in place
+// of the SMTP_USER / SMTP_PASS environment defaults.
+func ConfigureSMTP(host, port, user, pass string) {
+	smtpHost, smtpPort, smtpUser, smtpPass = host, port, user, pass
+}
+
+// MailSender has the signature of smtp.SendMail.
+type MailSender func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+
+var sendMail MailSender = smtp.SendMail
+
+// SetMailSender replaces the SMTP transport, e.g. to capture mail when
+// running jobs locally with "goflow test-job".
+func SetMailSender(fn MailSender) {
+	sendMail = fn
+}
+
 func executeSendEmail(ctx context.Context, payload map[string]interface{}) (int, []byte, error) {
 
 	// 🔴 EARLY CANCEL CHECK
@@ -36,21 +59,34 @@ func executeSendEmail(ctx context.Context, payload map[string]interface{}) (int,
 		return 0, nil, fmt.Errorf("missing 'body'")
 	}
 
+	contentType := "text/plain"
+	if html, _ := payload["html"].(bool); html {
+		contentType = "text/html"
+	}
+
 	message := []byte(
 		"To: " + to + "\r\n" +
 			"Subject: " + subject + "\r\n" +
 			"MIME-version: 1.0;\r\n" +
-			"Content-Type: text/plain; charset=\"UTF-8\";\r\n\r\n" +
+			"Content-Type: " + contentType + "; charset=\"UTF-8\";\r\n\r\n" +
 			body + "\r\n",
 	)
 
+	if raw, ok := payload["attachments"].([]interface{}); ok && len(raw) > 0 {
+		var err error
+		message, err = mailWithAttachments(to, subject, contentType, body, raw)
+		if err != nil {
+			return 0, nil, Permanent(err)
+		}
+	}
+
 	auth := smtp.PlainAuth("", smtpUser, smtpPass, smtpHost)
 
 	errChan := make(chan error, 1)
 
 	// 🔥 RUN EMAIL IN GOROUTINE
 	go func() {
-		err := smtp.SendMail(
+		err := sendMail(
 			smtpHost+":"+smtpPort,
 			auth,
 			smtpUser,
@@ -73,4 +109,69 @@ func executeSendEmail(ctx context.Context, payload map[string]interface{}) (int,
 	}
 
 	return 200, []byte(`{"message":"email sent"}`), nil
-}
\ No newline at end of file
+}
+
+// maxAttachmentBytes keeps a message under the common 25 MB limit once
+// base64 has grown it by a third.
+const maxAttachmentBytes = 15 << 20
+
+// mailWithAttachments builds a multipart/mixed message. Each attachment
+// is {"filename": ..., "content": base64, "content_type": ...}.
+func mailWithAttachments(to, subject, contentType, body string, attachments []interface{}) ([]byte, error) {
+
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+
+	buf.WriteString("To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"MIME-version: 1.0;\r\n" +
+		"Content-Type: multipart/mixed; boundary=\"" + w.Boundary() + "\"\r\n\r\n")
+
+	part, _ := w.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {contentType + "; charset=\"UTF-8\""},
+	})
+	part.Write([]byte(body + "\r\n"))
+
+	total := 0
+	for i, raw := range attachments {
+		a, _ := raw.(map[string]interface{})
+		filename, _ := a["filename"].(string)
+		content, _ := a["content"].(string)
+		if filename == "" || content == "" {
+			return nil, fmt.Errorf("attachment %d needs 'filename' and 'content'", i)
+		}
+
+		data, err := base64.StdEncoding.DecodeString(content)
+		if err != nil {
+			return nil, fmt.Errorf("attachment %d: 'content' is not base64", i)
+		}
+		if total += len(data); total > maxAttachmentBytes {
+			return nil, fmt.Errorf("attachments are over the %d byte limit", maxAttachmentBytes)
+		}
+
+		ct, _ := a["content_type"].(string)
+		if ct == "" {
+			ct = mime.TypeByExtension(filepath.Ext(filename))
+		}
+		if ct == "" {
+			ct = "application/octet-stream"
+		}
+
+		part, _ := w.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {ct},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": filename})},
+		})
+
+		// Base64 lines may be at most 76 characters
+		encoded := base64.StdEncoding.EncodeToString(data)
+		for len(encoded) > 76 {
+			part.Write([]byte(encoded[:76] + "\r\n"))
+			encoded = encoded[76:]
+		}
+		part.Write([]byte(encoded + "\r\n"))
+	}
+
+	w.Close()
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,176 @@
+package jobs
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An executor's error is retried under the job's retry policy unless it
+// says otherwise. PermanentError marks a failure another attempt cannot
+// fix, such as a 400 or a payload the executor cannot use: the job fails
+// at once instead of repeating the same doomed work. RetryableError marks
+// the opposite explicitly, for failures that look final but are not.
+
+// PermanentError fails the job without further retries.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string { return e.Err.Error() }
+func (e *PermanentError) Unwrap() error { return e.Err }
+
+// RetryableError is a transient failure; the job is retried. After, when
+// set, replaces the backoff delay, as a server's Retry-After does.
+type RetryableError struct {
+	Err   error
+	After time.Duration
+}
+
+func (e *RetryableError) Error() string { return e.Err.Error() }
+func (e *RetryableError) Unwrap() error { return e.Err }
+
+// Permanent wraps err so the job is not retried. A nil err stays nil.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &PermanentError{Err: err}
+}
+
+// Retryable wraps err so the job is retried. A nil err stays nil.
+func Retryable(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &RetryableError{Err: err}
+}
+
+// RetryAfter wraps err so the job is retried no sooner than after d.
+func RetryAfter(err error, d time.Duration) error {
+	if err == nil {
+		return nil
+	}
+	return &RetryableError{Err: err, After: d}
+}
+
+// RetryAfterOf returns the delay a RetryableError in err asks for.
+func RetryAfterOf(err error) (time.Duration, bool) {
+	var retryable *RetryableError
+	if errors.As(err, &retryable) && retryable.After > 0 {
+		return retryable.After, true
+	}
+	return 0, false
+}
+
+// DeferredError means the work was not attempted at all, for instance
+// because the destination's circuit is open. The job goes back in the
+// queue for After without using up an attempt.
+type DeferredError struct {
+	Err   error
+	After time.Duration
+}
+
+func (e *DeferredError) Error() string { return e.Err.Error() }
+func (e *DeferredError) Unwrap() error { return e.Err }
+
+// Defer wraps err so the job is put back for d without counting an
+// attempt.
+func Defer(err error, d time.Duration) error {
+	if err == nil {
+		return nil
+	}
+	return &DeferredError{Err: err, After: d}
+}
+
+// DeferredBy returns the delay a DeferredError in err asks for.
+func DeferredBy(err error) (time.Duration, bool) {
+	var deferred *DeferredError
+	if errors.As(err, &deferred) {
+		return deferred.After, true
+	}
+	return 0, false
+}
+
+// IsPermanent reports whether retrying the job after err is pointless:
+// err is, or wraps, a PermanentError or a PayloadError, and no
+// RetryableError wraps it.
+func IsPermanent(err error) bool {
+
+	var retryable *RetryableError
+	if errors.As(err, &retryable) {
+		return false
+	}
+
+	var permanent *PermanentError
+	var invalid *PayloadError
+	return errors.As(err, &permanent) || errors.As(err, &invalid)
+}
+
+// StatusError is the error for an HTTP response status of 400 or above.
+// Client errors are permanent, except the ones that ask to come back
+// later (408 Request Timeout, 425 Too Early, 429 Too Many Requests).
+func StatusError(statusCode int, err error) error {
+
+	switch {
+	case statusCode == http.StatusRequestTimeout,
+		statusCode == http.StatusTooEarly,
+		statusCode == http.StatusTooManyRequests:
+		return Retryable(err)
+	case statusCode >= 400 && statusCode < 500:
+		return Permanent(err)
+	}
+	return Retryable(err)
+}
+
+// ResponseError is StatusError for resp, also honoring the Retry-After
+// header of a 429 or 503.
+func ResponseError(resp *http.Response, err error) error {
+
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		if d, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+			return RetryAfter(err, d)
+		}
+	}
+	return StatusError(resp.StatusCode, err)
+}
+
+// httpStatusError is the usual error for a failed HTTP call.
+func httpStatusError(resp *http.Response) error {
+	return ResponseError(resp, fmt.Errorf("http status %d", resp.StatusCode))
+}
+
+// parseRetryAfter reads a Retry-After value, either seconds ("120") or an
+// HTTP date, as a delay from now rounded up to whole seconds.
+func parseRetryAfter(v string, now time.Time) (time.Duration, bool) {
+
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0, false
+	}
+
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+
+	at, err := http.ParseTime(v)
+	if err != nil {
+		return 0, false
+	}
+
+	d := at.Sub(now)
+	if d <= 0 {
+		return 0, false
+	}
+	if r := d % time.Second; r != 0 {
+		d += time.Second - r
+	}
+	return d, true
+}
@@ -0,0 +1,40 @@
+package jobs
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, tc := range []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"120", 2 * time.Minute, true},
+		{" 5 ", 5 * time.Second, true},
+		{"0", 0, true},
+		{"-1", 0, false},
+		{"", 0, false},
+		{"soon", 0, false},
+		{now.Add(90 * time.Second).Format(http.TimeFormat), 90 * time.Second, true},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0, false},
+		{now.Format(http.TimeFormat), 0, false},
+		{"Sun, 01 Mar 2026 12:00:30 GMT", 30 * time.Second, true},
+	} {
+		got, ok := parseRetryAfter(tc.value, now)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("%q: got %s, %v; want %s, %v", tc.value, got, ok, tc.want, tc.ok)
+		}
+	}
+
+	// Dates have whole seconds; a clock part-way through one rounds up
+	got, _ := parseRetryAfter(now.Add(10*time.Second).Format(http.TimeFormat), now.Add(300*time.Millisecond))
+	if got != 10*time.Second {
+		t.Errorf("fractional now: got %s, want 10s", got)
+	}
+}
@@ -1,51 +1,119 @@
 package jobs
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
 	"goflow/workflow"
-	"context"
 )
 
 var DB *sql.DB
 
-func Execute(ctx context.Context, jobType string, payload map[string]interface{}) (int, []byte, error) {
-	switch jobType {
-
-	case "http_request":
-		return executeHTTPRequest(ctx, payload)
-
-	case "send_email":
-		return executeSendEmail(ctx, payload)
-
-	case "webhook_delivery":
-		return executeWebhookDelivery(ctx, payload)
-
-	case "delay":
-		return executeDelay(ctx,payload)
-
-	case "cron_schedule":
-		return executeCronSchedule(ctx, payload)
+// databaseTypes read or write GoFlow's own tables, so they cannot run
+// without DB: on a remote agent or on the SQLite and memory stores.
+var databaseTypes = map[string]bool{
+	"db_query":         true,
+	"callback":         true,
+	"webhook_delivery": true,
+	"workflow":         true,
+	"uptime_check":     true,
+	"pagespeed_audit":  true,
+	"generate_report":  true,
+	"export_report":    true,
+	"digest":           true,
+	"digest_event":     true,
+	"webhook_fanout":   true,
+	"ical_import":      true,
+	"condition":        true,
+}
 
-	case "data_extract":
-		return executeDataExtract(ctx, payload)
+// NeedsDatabase reports whether jobs of this type need DB, including
+// every effectively-once type, whose attempts are recorded there.
+func NeedsDatabase(jobType string) bool {
+	return databaseTypes[jobType] || GuaranteeFor(jobType) == EffectivelyOnce
+}
 
-	case "ai_prompt":
-		return executeAIPrompt(ctx, payload)
+// Execute runs a job through the middleware chain registered with Use.
+func Execute(ctx context.Context, jobType string, payload map[string]interface{}) (int, []byte, error) {
+	return currentChain()(ctx, jobType, payload)
+}
 
-	case "db_query":
-		return executeDBQuery(ctx, payload)
+func execute(ctx context.Context, jobType string, payload map[string]interface{}) (int, []byte, error) {
+	// Jobs that skipped submit-time checks (follow-ups, workflow steps)
+	// or whose placeholders filled in the wrong values stop here for good
+	if err := ValidatePayload(jobType, payload); err != nil {
+		return 0, nil, err
+	}
+	// Standalone servers refuse these at submission; a follow-up or a
+	// hook can still bring one here
+	if DB == nil && NeedsDatabase(jobType) {
+		return 0, nil, Permanent(fmt.Errorf("job type %s needs Postgres", jobType))
+	}
+	if GuaranteeFor(jobType) == EffectivelyOnce {
+		return executeEffectivelyOnce(ctx, jobType, payload)
+	}
+	return dispatch(ctx, jobType, payload)
+}
 
-	case "callback":
-		return executeCallback(ctx, payload)
+// builtinExecutors are the job types GoFlow ships with.
+var builtinExecutors = map[string]ExecutorFunc{
+	"http_request":      executeHTTPRequest,
+	"graphql_request":   executeGraphQLRequest,
+	"send_email":        executeSendEmail,
+	"send_sms":          executeSendSMS,
+	"push_notification": executePushNotification,
+	"file_upload":       executeFileUpload,
+	"image_process":     executeImageProcess,
+	"webhook_delivery":  executeWebhookDelivery,
+	"amqp_publish":      executeAMQPPublish,
+	"delay":             executeDelay,
+	"cron_schedule":     executeCronSchedule,
+	"data_extract":      executeDataExtract,
+	"ai_prompt":         executeAIPrompt,
+	"db_query":          executeDBQuery,
+	"callback":          executeCallback,
+	"run_command":       executeRunCommand,
+	"script":            executeScript,
+	"external":          executeExternal,
+	"k8s_job":           executeK8sJob,
+	"container_run":     executeContainerRun,
+	"fx_convert":        executeFXConvert,
+	"geocode":           executeGeocode,
+	"weather_fetch":     executeWeatherFetch,
+	"uptime_check":      executeUptimeCheck,
+	"dns_check":         executeDNSCheck,
+	"port_check":        executePortCheck,
+	"generate_sitemap":  executeGenerateSitemap,
+	"link_check":        executeLinkCheck,
+	"pagespeed_audit":   executePagespeedAudit,
+	"generate_report":   executeGenerateReport,
+	"export_report":     executeExportReport,
+	"digest":            executeDigest,
+	"digest_event":      executeDigestEvent,
+	"translate_text":    executeTranslateText,
+	"transcode_media":   executeTranscodeMedia,
+	"scan_file":         executeScanFile,
+	"webhook_fanout":    executeWebhookFanout,
+	"ical_import":       executeICalImport,
+	"condition":         executeCondition,
+	"workflow": func(ctx context.Context, payload map[string]interface{}) (int, []byte, error) {
+		return workflow.Start(ctx, TenantFromContext(ctx), payload)
+	},
+}
 
-	case "workflow":
-		return workflow.Start(ctx, payload)
+func init() {
+	for name, fn := range builtinExecutors {
+		register(name, fn, SourceBuiltin)
+	}
+}
 
-	default:
+func dispatch(ctx context.Context, jobType string, payload map[string]interface{}) (int, []byte, error) {
+	fn, ok := lookup(jobType)
+	if !ok {
 		return 0, nil, fmt.Errorf("unknown job type: %s", jobType)
 	}
+	return fn(ctx, payload)
 }
 
 func jsonMarshalSafe(v interface{}) ([]byte, error) {
@@ -0,0 +1,447 @@
+package jobs
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// export_report runs a stored query and delivers its rows as a CSV or
+// XLSX file, by email or to object storage:
+//
+//	{"query": "daily_signups", "period": "1d", "format": "xlsx",
+//	 "params": {"region": "eu"},
+//	 "email": "growth@example.com",
+//	 "bucket": "exports", "key": "signups/{date}.xlsx"}
+//
+// Stored queries are defined in the server config, so API callers name a
+// query instead of sending SQL:
+//
+//	report_queries:
+//	  daily_signups:
+//	    sql: "SELECT day, count FROM signups WHERE day >= $1 AND day < $2 AND region = $3"
+//	    params: [from, to, region]
+//
+// The query's params fill $1, $2, ... in order: "from" and "to" are the
+// report period, read like generate_report's, and any other name comes
+// from "params" in the payload. A query with "tenants" only runs for
+// them. It runs in a read-only transaction.
+//
+// The email, sent as a send_email follow-up, carries the file as an
+// attachment; the upload is stored like file_upload's. "{date}" in
+// "key" and "filename" is the end of the period.
+
+const maxExportRows = 100_000
+
+// StoredQuery is a query export_report can run by name.
+type StoredQuery struct {
+	SQL string `yaml:"sql"`
+
+	// Params name the query's $1, $2, ...: "from" and "to" are the
+	// report period, others come from the job's "params"
+	Params []string `yaml:"params"`
+
+	// Tenants may run the query; empty means every tenant
+	Tenants []string `yaml:"tenants"`
+}
+
+var reportQueries = struct {
+	sync.RWMutex
+	queries map[string]StoredQuery
+}{}
+
+// ConfigureReportQueries sets the stored queries export_report can run.
+func ConfigureReportQueries(queries map[string]StoredQuery) {
+	reportQueries.Lock()
+	reportQueries.queries = queries
+	reportQueries.Unlock()
+}
+
+func executeExportReport(ctx context.Context, payload map[string]interface{}) (int, []byte, error) {
+
+	name, ok := payload["query"].(string)
+	if !ok || name == "" {
+		return 0, nil, fmt.Errorf("missing 'query'")
+	}
+
+	reportQueries.RLock()
+	q, ok := reportQueries.queries[name]
+	reportQueries.RUnlock()
+	if !ok {
+		return 0, nil, Permanent(fmt.Errorf("unknown stored query: %s", name))
+	}
+	if len(q.Tenants) > 0 && !slices.Contains(q.Tenants, TenantFromContext(ctx)) {
+		return 0, nil, Permanent(fmt.Errorf("stored query %s is not available to this tenant", name))
+	}
+
+	format, _ := payload["format"].(string)
+	switch format {
+	case "":
+		format = "csv"
+	case "csv", "xlsx":
+	default:
+		return 0, nil, Permanent(fmt.Errorf("unsupported format %q", format))
+	}
+
+	email, _ := payload["email"].(string)
+	bucket, _ := payload["bucket"].(string)
+	if email == "" && bucket == "" {
+		return 0, nil, fmt.Errorf("missing 'email' or 'bucket'")
+	}
+
+	from, to, err := reportPeriod(payload)
+	if err != nil {
+		return 0, nil, Permanent(err)
+	}
+
+	params, _ := payload["params"].(map[string]interface{})
+	args := make([]interface{}, len(q.Params))
+	for i, p := range q.Params {
+		switch p {
+		case "from":
+			args[i] = from
+		case "to":
+			args[i] = to
+		default:
+			v, ok := params[p]
+			if !ok {
+				return 0, nil, Permanent(fmt.Errorf("missing param '%s'", p))
+			}
+			args[i] = v
+		}
+	}
+
+	if DB == nil {
+		return 0, nil, Permanent(fmt.Errorf("export_report needs a database"))
+	}
+
+	columns, rows, truncated, err := exportQueryRows(ctx, q.SQL, args)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var file []byte
+	var contentType string
+	if format == "xlsx" {
+		file, err = renderXLSX(name, columns, rows)
+		contentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+	} else {
+		file, err = renderCSV(columns, rows)
+		contentType = "text/csv; charset=utf-8"
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+
+	date := to.Format("2006-01-02")
+	filename, _ := payload["filename"].(string)
+	if filename == "" {
+		filename = name + "-{date}." + format
+	}
+	filename = strings.ReplaceAll(filename, "{date}", date)
+
+	jobLog(ctx, "%s: %d rows, %d bytes of %s", name, len(rows), len(file), format)
+
+	result := map[string]interface{}{
+		"query":     name,
+		"from":      from,
+		"to":        to,
+		"format":    format,
+		"rows":      len(rows),
+		"truncated": truncated,
+		"bytes":     len(file),
+		"filename":  filename,
+	}
+
+	if bucket != "" {
+		key, _ := payload["key"].(string)
+		if key == "" {
+			key = filename
+		}
+		key = strings.TrimPrefix(strings.ReplaceAll(key, "{date}", date), "/")
+
+		provider, upload, err := objectStore(payload)
+		if err != nil {
+			return 0, nil, err
+		}
+		acl, _ := payload["acl"].(string)
+
+		stored, err := upload(ctx, uploadObject{
+			bucket:      bucket,
+			key:         key,
+			contentType: contentType,
+			acl:         acl,
+			body:        bytes.NewReader(file),
+			size:        int64(len(file)),
+		})
+		if err != nil {
+			return 0, nil, err
+		}
+		stored["provider"] = provider
+		stored["bucket"] = bucket
+		stored["key"] = key
+		result["upload"] = stored
+	}
+
+	if email != "" {
+		if len(file) > maxAttachmentBytes {
+			return 0, nil, Permanent(fmt.Errorf("%d byte export is too large to email; upload it instead", len(file)))
+		}
+
+		subject, _ := payload["subject"].(string)
+		if subject == "" {
+			subject = fmt.Sprintf("%s: %s to %s", name, from.Format("Jan 2"), to.Format("Jan 2, 2006"))
+		}
+		body, _ := payload["body"].(string)
+		if body == "" {
+			body = fmt.Sprintf("%s is attached: %d rows.", filename, len(rows))
+			if truncated {
+				body += fmt.Sprintf(" The query returned more; only the first %d are included.", maxExportRows)
+			}
+		}
+
+		mail, _ := json.Marshal(map[string]interface{}{
+			"to":      email,
+			"subject": subject,
+			"body":    body,
+			"attachments": []map[string]string{{
+				"filename":     filename,
+				"content_type": contentType,
+				"content":      base64.StdEncoding.EncodeToString(file),
+			}},
+			"idempotency_key": deliveryIDFor(ctx, "export-email"),
+		})
+		if err := enqueueFollowUp(ctx, FollowUp{Type: "send_email", Payload: mail}); err != nil {
+			return 0, nil, err
+		}
+		result["email"] = email
+	}
+
+	jsonBytes, _ := json.Marshal(result)
+	return 200, jsonBytes, nil
+}
+
+// exportQueryRows runs query read-only like reportQueryRows, keeping each
+// value's type for the spreadsheet.
+func exportQueryRows(ctx context.Context, query string, args []interface{}) ([]string, [][]interface{}, bool, error) {
+
+	tx, err := DB.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, nil, false, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	var out [][]interface{}
+	truncated := false
+
+	for rows.Next() {
+		if len(out) == maxExportRows {
+			truncated = true
+			break
+		}
+
+		values := make([]interface{}, len(columns))
+		ptrs := make([]interface{}, len(columns))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, nil, false, err
+		}
+		for i, v := range values {
+			// Drivers hand back numerics and text as bytes
+			if b, ok := v.([]byte); ok {
+				values[i] = string(b)
+			}
+		}
+		out = append(out, values)
+	}
+
+	return columns, out, truncated, rows.Err()
+}
+
+func exportText(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return ""
+	case time.Time:
+		return val.Format(time.RFC3339)
+	}
+	return fmt.Sprint(v)
+}
+
+func renderCSV(columns []string, rows [][]interface{}) ([]byte, error) {
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write(columns)
+
+	record := make([]string, len(columns))
+	for _, row := range rows {
+		for i, v := range row {
+			record[i] = exportText(v)
+		}
+		w.Write(record)
+	}
+
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// renderXLSX writes a one-sheet workbook with a bold header row. Numbers
+// and booleans keep their type; numeric text without leading zeros, as
+// Postgres returns numeric columns, becomes a number too.
+func renderXLSX(sheet string, columns []string, rows [][]interface{}) ([]byte, error) {
+
+	var s strings.Builder
+	s.WriteString(xml.Header)
+	s.WriteString(`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+
+	writeRow := func(r int, values []interface{}, style string) {
+		fmt.Fprintf(&s, `<row r="%d">`, r)
+		for c, v := range values {
+			ref := xlsxColumn(c) + strconv.Itoa(r)
+			switch val := v.(type) {
+			case nil:
+				continue
+			case bool:
+				b := 0
+				if val {
+					b = 1
+				}
+				fmt.Fprintf(&s, `<c r="%s" t="b"%s><v>%d</v></c>`, ref, style, b)
+				continue
+			case int64, int32, int, float64, float32:
+				fmt.Fprintf(&s, `<c r="%s"%s><v>%v</v></c>`, ref, style, val)
+				continue
+			case string:
+				if xlsxNumeric(val) {
+					fmt.Fprintf(&s, `<c r="%s"%s><v>%s</v></c>`, ref, style, val)
+					continue
+				}
+			}
+			fmt.Fprintf(&s, `<c r="%s" t="inlineStr"%s><is><t xml:space="preserve">`, ref, style)
+			xml.EscapeText(&s, []byte(xlsxText(exportText(v))))
+			s.WriteString(`</t></is></c>`)
+		}
+		s.WriteString(`</row>`)
+	}
+
+	header := make([]interface{}, len(columns))
+	for i, c := range columns {
+		header[i] = c
+	}
+	writeRow(1, header, ` s="1"`)
+	for i, row := range rows {
+		writeRow(i+2, row, "")
+	}
+	s.WriteString(`</sheetData></worksheet>`)
+
+	// Sheet names are at most 31 characters, without []:*?/\
+	name := strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`[]:*?/\`, r) {
+			return '_'
+		}
+		return r
+	}, sheet)
+	if len(name) > 31 {
+		name = name[:31]
+	}
+	var escaped strings.Builder
+	xml.EscapeText(&escaped, []byte(name))
+
+	files := []struct{ name, body string }{
+		{"[Content_Types].xml", xml.Header + `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+			`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+			`<Default Extension="xml" ContentType="application/xml"/>` +
+			`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+			`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+			`<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>` +
+			`</Types>`},
+		{"_rels/.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+			`</Relationships>`},
+		{"xl/workbook.xml", xml.Header + `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+			`<sheets><sheet name="` + escaped.String() + `" sheetId="1" r:id="rId1"/></sheets></workbook>`},
+		{"xl/_rels/workbook.xml.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+			`<Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>` +
+			`</Relationships>`},
+		{"xl/styles.xml", xml.Header + `<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` +
+			`<fonts count="2"><font/><font><b/></font></fonts>` +
+			`<fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills>` +
+			`<borders count="1"><border/></borders>` +
+			`<cellStyleXfs count="1"><xf/></cellStyleXfs>` +
+			`<cellXfs count="2"><xf/><xf fontId="1" applyFont="1"/></cellXfs>` +
+			`</styleSheet>`},
+		{"xl/worksheets/sheet1.xml", s.String()},
+	}
+
+	var buf bytes.Buffer
+	z := zip.NewWriter(&buf)
+	for _, f := range files {
+		w, err := z.Create(f.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write([]byte(f.body)); err != nil {
+			return nil, err
+		}
+	}
+	if err := z.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// xlsxColumn is the column letter for a 0-based index: A, ..., Z, AA.
+func xlsxColumn(i int) string {
+	name := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = string(rune('A'+(i-1)%26)) + name
+	}
+	return name
+}
+
+func xlsxNumeric(s string) bool {
+	if s == "" || len(s) > 15 {
+		return false
+	}
+	if t := strings.TrimPrefix(s, "-"); len(t) > 1 && t[0] == '0' && t[1] != '.' {
+		return false
+	}
+	_, err := strconv.ParseFloat(s, 64)
+	return err == nil && !strings.ContainsAny(s, "eEnNiI+")
+}
+
+// xlsxText drops characters XML cannot carry.
+func xlsxText(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 && r != '\t' && r != '\n' && r != '\r' {
+			return -1
+		}
+		return r
+	}, s)
+}
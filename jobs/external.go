@@ -0,0 +1,188 @@
+package jobs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// External executors implement a job type as any binary speaking
+// JSON over stdio (protocol "goflow.executor.v1"):
+//
+// stdin, one JSON document, then EOF:
+//
+//	{"protocol": "goflow.executor.v1", "job_id": 42, "type": "my_task", "payload": {...}}
+//
+// stdout, one JSON document:
+//
+//	{"status": 200, "response": {...}, "error": "optional message"}
+//
+// stderr is captured and attached to failures. A non-zero exit without a
+// result document is treated as a failure.
+const externalProtocol = "goflow.executor.v1"
+
+const defaultExternalTimeout = 60 * time.Second
+
+type externalExecutor struct {
+	name    string
+	path    string
+	timeout time.Duration
+}
+
+func registerExternalExecutor(pc PluginConfig) error {
+
+	if pc.Name == "" || pc.Executor == "" {
+		return fmt.Errorf("name and executor are required")
+	}
+
+	if _, err := os.Stat(pc.Executor); err != nil {
+		return err
+	}
+
+	timeout := defaultExternalTimeout
+	if pc.TimeoutSeconds > 0 {
+		timeout = time.Duration(pc.TimeoutSeconds) * time.Second
+	}
+
+	e := &externalExecutor{name: pc.Name, path: pc.Executor, timeout: timeout}
+	return register(pc.Name, e.execute, SourceExternal)
+}
+
+// executeExternal runs the ad-hoc `external` job type, whose payload names
+// the binary directly. Only binaries inside GOFLOW_EXECUTORS_DIR may run.
+func executeExternal(ctx context.Context, payload map[string]interface{}) (int, []byte, error) {
+
+	executor, ok := payload["executor"].(string)
+	if !ok || executor == "" {
+		return 0, nil, fmt.Errorf("missing 'executor'")
+	}
+
+	dir := os.Getenv("GOFLOW_EXECUTORS_DIR")
+	if dir == "" {
+		return 0, nil, fmt.Errorf("external executors are disabled (GOFLOW_EXECUTORS_DIR not set)")
+	}
+
+	path, err := resolveInside(dir, executor)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	timeout := defaultExternalTimeout
+	if t, ok := payload["timeout_seconds"].(float64); ok && t > 0 {
+		timeout = time.Duration(t) * time.Second
+	}
+
+	inner, _ := payload["payload"].(map[string]interface{})
+	if inner == nil {
+		inner = payload
+	}
+
+	e := &externalExecutor{name: "external", path: path, timeout: timeout}
+	return e.execute(ctx, inner)
+}
+
+// resolveInside resolves name relative to dir and rejects anything that
+// escapes it, including through symlinks.
+func resolveInside(dir, name string) (string, error) {
+
+	base, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", err
+	}
+
+	candidate := name
+	if !filepath.IsAbs(candidate) {
+		candidate = filepath.Join(base, candidate)
+	}
+
+	resolved, err := filepath.EvalSymlinks(candidate)
+	if err != nil {
+		return "", err
+	}
+
+	rel, err := filepath.Rel(base, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("executor %s is outside %s", name, dir)
+	}
+
+	return resolved, nil
+}
+
+func (e *externalExecutor) execute(ctx context.Context, payload map[string]interface{}) (int, []byte, error) {
+
+	if ctx.Err() == context.Canceled {
+		return 0, nil, fmt.Errorf("external executor cancelled")
+	}
+
+	jobID, _ := JobIDFromContext(ctx)
+
+	input, err := json.Marshal(map[string]interface{}{
+		"protocol": externalProtocol,
+		"job_id":   jobID,
+		"type":     e.name,
+		"payload":  payload,
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+
+	runCtx, cancel := context.WithTimeout(ctx, e.timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(runCtx, e.path)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Env = []string{"PATH=/usr/local/bin:/usr/bin:/bin", "GOFLOW_PROTOCOL=" + externalProtocol}
+
+	stdout := &cappedBuffer{limit: maxCommandOutput}
+	stderr := &cappedBuffer{limit: 64 * 1024}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	runErr := cmd.Run()
+
+	if runCtx.Err() == context.DeadlineExceeded {
+		return 0, nil, fmt.Errorf("executor %s timed out after %v", e.name, e.timeout)
+	}
+
+	if ctx.Err() == context.Canceled {
+		return 0, nil, fmt.Errorf("external executor cancelled")
+	}
+
+	var result struct {
+		Status    int             `json:"status"`
+		Response  json.RawMessage `json:"response"`
+		Error     string          `json:"error"`
+		Permanent bool            `json:"permanent"`
+	}
+
+	if err := json.Unmarshal(bytes.TrimSpace(stdout.buf.Bytes()), &result); err != nil {
+		if runErr != nil {
+			return 0, nil, fmt.Errorf("executor %s failed: %v: %s", e.name, runErr, strings.TrimSpace(stderr.buf.String()))
+		}
+		return 0, nil, fmt.Errorf("executor %s returned invalid result: %w", e.name, err)
+	}
+
+	if result.Status == 0 {
+		result.Status = 200
+	}
+
+	if result.Error != "" {
+		err := fmt.Errorf("%s", result.Error)
+		if result.Permanent {
+			err = Permanent(err)
+		}
+		return result.Status, result.Response, err
+	}
+
+	if runErr != nil {
+		return result.Status, result.Response, fmt.Errorf("executor %s exited: %v", e.name, runErr)
+	}
+
+	return result.Status, result.Response, nil
+}
@@ -0,0 +1,523 @@
+package jobs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// file_upload copies a file into object storage:
+//
+//	{"source": "https://cdn.example.com/export.csv",
+//	 "bucket": "reports", "key": "2024/06/export.csv",
+//	 "content_type": "text/csv", "acl": "private"}
+//
+// "content" takes the file inline, base64 encoded, instead of "source".
+// The provider is "provider" or GOFLOW_UPLOAD_PROVIDER: "s3" (the
+// default) or "gcs".
+//
+// S3 requests are signed with SigV4 using GOFLOW_S3_ACCESS_KEY_ID and
+// GOFLOW_S3_SECRET_ACCESS_KEY (or the AWS_ variables), in "region" or
+// GOFLOW_S3_REGION. GOFLOW_S3_ENDPOINT points at an S3-compatible store
+// such as MinIO, addressed path-style. A payload may bring its own
+// "access_key_id" and "secret_access_key", and only then its own
+// "endpoint": server credentials are never signed for a host the caller
+// chose. GCS uploads authenticate with the service account JSON in
+// "credentials" or GOFLOW_GCS_CREDENTIALS.
+//
+// A source that reports its length is streamed straight through;
+// otherwise it is spooled to a temporary file first, since both stores
+// want the length up front. The response body has the object's URL.
+
+// maxUploadBytes is S3's limit for a single PUT
+const maxUploadBytes = 5 << 30
+
+type uploadObject struct {
+	bucket      string
+	key         string
+	contentType string
+	acl         string
+	body        io.Reader
+	size        int64
+}
+
+func executeFileUpload(ctx context.Context, payload map[string]interface{}) (int, []byte, error) {
+
+	obj := uploadObject{}
+	obj.bucket, _ = payload["bucket"].(string)
+	obj.key, _ = payload["key"].(string)
+	obj.contentType, _ = payload["content_type"].(string)
+	obj.acl, _ = payload["acl"].(string)
+
+	if obj.bucket == "" {
+		return 0, nil, fmt.Errorf("missing 'bucket'")
+	}
+	obj.key = strings.TrimPrefix(obj.key, "/")
+	if obj.key == "" {
+		return 0, nil, fmt.Errorf("missing 'key'")
+	}
+
+	provider, upload, err := objectStore(payload)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	body, size, sourceType, cleanup, err := openUploadSource(ctx, payload)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer cleanup()
+
+	// Sniff the type from the first bytes when nobody says what it is
+	br := bufio.NewReaderSize(body, 512)
+	if obj.contentType == "" {
+		obj.contentType = sourceType
+	}
+	if obj.contentType == "" {
+		head, _ := br.Peek(512)
+		obj.contentType = http.DetectContentType(head)
+	}
+
+	sha := sha256.New()
+	counted := &countingReader{r: io.TeeReader(br, sha)}
+	obj.body, obj.size = counted, size
+
+	jobLog(ctx, "uploading %d bytes to %s://%s/%s", size, provider, obj.bucket, obj.key)
+
+	result, err := upload(ctx, obj)
+	if err != nil {
+		return 0, nil, err
+	}
+	if counted.n != size {
+		return 0, nil, fmt.Errorf("source sent %d bytes, expected %d", counted.n, size)
+	}
+
+	result["provider"] = provider
+	result["bucket"] = obj.bucket
+	result["key"] = obj.key
+	result["bytes"] = size
+	result["sha256"] = hex.EncodeToString(sha.Sum(nil))
+	result["content_type"] = obj.contentType
+
+	jsonBytes, _ := json.Marshal(result)
+	return 200, jsonBytes, nil
+}
+
+// objectPut stores one object and describes it.
+type objectPut func(ctx context.Context, obj uploadObject) (map[string]interface{}, error)
+
+// objectStore returns the store the payload's provider and credentials
+// select, as file_upload documents them.
+func objectStore(payload map[string]interface{}) (string, objectPut, error) {
+
+	provider, _ := payload["provider"].(string)
+	if provider == "" {
+		provider = os.Getenv("GOFLOW_UPLOAD_PROVIDER")
+	}
+	if provider == "" {
+		provider = "s3"
+	}
+
+	switch provider {
+	case "s3":
+		creds, err := s3Credentials(payload)
+		if err != nil {
+			return provider, nil, Permanent(err)
+		}
+		return provider, creds.put, nil
+	case "gcs":
+		raw, err := keyMaterial(payload, "credentials", "GOFLOW_GCS_CREDENTIALS")
+		if err != nil {
+			return provider, nil, Permanent(err)
+		}
+		sa, err := googleCredentials("gcs", raw)
+		if err != nil {
+			return provider, nil, Permanent(err)
+		}
+		return provider, func(ctx context.Context, obj uploadObject) (map[string]interface{}, error) {
+			return putGCS(ctx, sa, obj)
+		}, nil
+	}
+	return provider, nil, Permanent(fmt.Errorf("unsupported provider: %s", provider))
+}
+
+// openUploadSource returns the file to upload and its length.
+func openUploadSource(ctx context.Context, payload map[string]interface{}) (io.Reader, int64, string, func(), error) {
+
+	noop := func() {}
+
+	if content, ok := payload["content"].(string); ok && content != "" {
+		b, err := base64.StdEncoding.DecodeString(content)
+		if err != nil {
+			return nil, 0, "", noop, Permanent(fmt.Errorf("'content' is not base64: %w", err))
+		}
+		return bytes.NewReader(b), int64(len(b)), "", noop, nil
+	}
+
+	source, ok := payload["source"].(string)
+	if !ok || source == "" {
+		return nil, 0, "", noop, fmt.Errorf("missing 'source' or 'content'")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", source, nil)
+	if err != nil {
+		return nil, 0, "", noop, Permanent(err)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Minute, Transport: transportFor(ctx, nil)}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, "", noop, err
+	}
+
+	if resp.StatusCode >= 400 {
+		resp.Body.Close()
+		return nil, 0, "", noop, ResponseError(resp, fmt.Errorf("source returned status %d", resp.StatusCode))
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+
+	if resp.ContentLength > maxUploadBytes {
+		resp.Body.Close()
+		return nil, 0, "", noop, Permanent(fmt.Errorf("source is over the %d byte limit", maxUploadBytes))
+	}
+	if resp.ContentLength >= 0 {
+		return resp.Body, resp.ContentLength, contentType, func() { resp.Body.Close() }, nil
+	}
+
+	// No length: spool it to find out
+	defer resp.Body.Close()
+
+	f, err := os.CreateTemp("", "goflow-upload-")
+	if err != nil {
+		return nil, 0, "", noop, err
+	}
+	cleanup := func() {
+		f.Close()
+		os.Remove(f.Name())
+	}
+
+	size, err := io.Copy(f, io.LimitReader(resp.Body, maxUploadBytes+1))
+	if err != nil {
+		cleanup()
+		return nil, 0, "", noop, err
+	}
+	if size > maxUploadBytes {
+		cleanup()
+		return nil, 0, "", noop, Permanent(fmt.Errorf("source is over the %d byte limit", maxUploadBytes))
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		cleanup()
+		return nil, 0, "", noop, err
+	}
+
+	return f, size, contentType, cleanup, nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type s3Creds struct {
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	region       string
+
+	// endpoint is an S3-compatible store's base URL; empty for AWS
+	endpoint  string
+	pathStyle bool
+}
+
+func s3Credentials(payload map[string]interface{}) (*s3Creds, error) {
+
+	c := &s3Creds{}
+	c.accessKey, _ = payload["access_key_id"].(string)
+	c.secretKey, _ = payload["secret_access_key"].(string)
+	c.sessionToken, _ = payload["session_token"].(string)
+	c.pathStyle, _ = payload["path_style"].(bool)
+
+	if c.accessKey != "" || c.secretKey != "" {
+		c.endpoint, _ = payload["endpoint"].(string)
+	} else {
+		c.accessKey = firstEnv("GOFLOW_S3_ACCESS_KEY_ID", "AWS_ACCESS_KEY_ID")
+		c.secretKey = firstEnv("GOFLOW_S3_SECRET_ACCESS_KEY", "AWS_SECRET_ACCESS_KEY")
+		c.sessionToken = firstEnv("GOFLOW_S3_SESSION_TOKEN", "AWS_SESSION_TOKEN")
+		c.endpoint = os.Getenv("GOFLOW_S3_ENDPOINT")
+	}
+	if c.accessKey == "" || c.secretKey == "" {
+		return nil, fmt.Errorf("no credentials for s3")
+	}
+
+	c.region, _ = payload["region"].(string)
+	if c.region == "" {
+		c.region = firstEnv("GOFLOW_S3_REGION", "AWS_REGION")
+	}
+	if c.region == "" {
+		c.region = "us-east-1"
+	}
+
+	if c.endpoint != "" {
+		u, err := url.Parse(c.endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid s3 endpoint %q", c.endpoint)
+		}
+		c.endpoint = strings.TrimSuffix(c.endpoint, "/")
+		c.pathStyle = true
+	}
+
+	return c, nil
+}
+
+func firstEnv(names ...string) string {
+	for _, name := range names {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// objectURL addresses the object virtual-hosted style on AWS, unless the
+// bucket name has dots, which the wildcard certificate does not cover.
+func (c *s3Creds) objectURL(bucket, key string) string {
+	path := "/" + s3Escape(key, false)
+	switch {
+	case c.endpoint != "":
+		return c.endpoint + "/" + s3Escape(bucket, true) + path
+	case c.pathStyle || strings.Contains(bucket, "."):
+		return "https://s3." + c.region + ".amazonaws.com/" + s3Escape(bucket, true) + path
+	}
+	return "https://" + bucket + ".s3." + c.region + ".amazonaws.com" + path
+}
+
+func (c *s3Creds) put(ctx context.Context, obj uploadObject) (map[string]interface{}, error) {
+
+	objectURL := c.objectURL(obj.bucket, obj.key)
+
+	req, err := http.NewRequestWithContext(ctx, "PUT", objectURL, obj.body)
+	if err != nil {
+		return nil, Permanent(err)
+	}
+	req.ContentLength = obj.size
+	req.Header.Set("Content-Type", obj.contentType)
+	if obj.acl != "" {
+		req.Header.Set("x-amz-acl", obj.acl)
+	}
+	if c.sessionToken != "" {
+		req.Header.Set("x-amz-security-token", c.sessionToken)
+	}
+	c.sign(req, time.Now())
+
+	client := &http.Client{Timeout: 30 * time.Minute, Transport: transportFor(ctx, nil)}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		var e struct {
+			Code    string `xml:"Code"`
+			Message string `xml:"Message"`
+		}
+		xml.Unmarshal(body, &e)
+		err := fmt.Errorf("s3 returned status %d: %s", resp.StatusCode, body)
+		if e.Code != "" {
+			err = fmt.Errorf("s3 %s: %s", e.Code, e.Message)
+		}
+		return nil, ResponseError(resp, err)
+	}
+
+	result := map[string]interface{}{
+		"url":  objectURL,
+		"etag": strings.Trim(resp.Header.Get("ETag"), `"`),
+	}
+	if v := resp.Header.Get("x-amz-version-id"); v != "" {
+		result["version_id"] = v
+	}
+	return result, nil
+}
+
+// sign adds a SigV4 Authorization header. The body is sent unsigned, so
+// it can be streamed; TLS protects it instead.
+func (c *s3Creds) sign(req *http.Request, now time.Time) {
+
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", "UNSIGNED-PAYLOAD")
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		if k := strings.ToLower(k); strings.HasPrefix(k, "x-amz-") {
+			headers[k] = strings.TrimSpace(v[0])
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+
+	scope := date + "/" + c.region + "/s3/aws4_request"
+	hashed := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), date)
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, toSign)),
+	))
+}
+
+func hmacSHA256(key []byte, msg string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(msg))
+	return mac.Sum(nil)
+}
+
+// s3Escape is SigV4's URI encoding: everything but unreserved characters,
+// and the slashes of a key unless encodeSlash.
+func s3Escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// gcsACLs maps S3 canned ACL names to GCS predefined ones; GCS names are
+// accepted as they are.
+var gcsACLs = map[string]string{
+	"private":                   "private",
+	"public-read":               "publicRead",
+	"authenticated-read":        "authenticatedRead",
+	"bucket-owner-read":         "bucketOwnerRead",
+	"bucket-owner-full-control": "bucketOwnerFullControl",
+	"project-private":           "projectPrivate",
+}
+
+func putGCS(ctx context.Context, sa *googleServiceAccount, obj uploadObject) (map[string]interface{}, error) {
+
+	token, err := googleAccessToken(ctx, sa, "https://www.googleapis.com/auth/devstorage.read_write")
+	if err != nil {
+		return nil, err
+	}
+
+	q := url.Values{}
+	q.Set("uploadType", "media")
+	q.Set("name", obj.key)
+	if obj.acl != "" {
+		acl := obj.acl
+		if mapped, ok := gcsACLs[acl]; ok {
+			acl = mapped
+		}
+		q.Set("predefinedAcl", acl)
+	}
+
+	endpoint := "https://storage.googleapis.com/upload/storage/v1/b/" + url.PathEscape(obj.bucket) + "/o?" + q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, obj.body)
+	if err != nil {
+		return nil, Permanent(err)
+	}
+	req.ContentLength = obj.size
+	req.Header.Set("Content-Type", obj.contentType)
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	client := &http.Client{Timeout: 30 * time.Minute, Transport: transportFor(ctx, nil)}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		var e struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		json.Unmarshal(body, &e)
+		err := fmt.Errorf("gcs returned status %d: %s", resp.StatusCode, body)
+		if e.Error.Message != "" {
+			err = fmt.Errorf("gcs returned status %d: %s", resp.StatusCode, e.Error.Message)
+		}
+		return nil, ResponseError(resp, err)
+	}
+
+	var o struct {
+		Generation string `json:"generation"`
+		ETag       string `json:"etag"`
+		MediaLink  string `json:"mediaLink"`
+	}
+	json.NewDecoder(resp.Body).Decode(&o)
+
+	result := map[string]interface{}{
+		"url":  "https://storage.googleapis.com/" + url.PathEscape(obj.bucket) + "/" + s3Escape(obj.key, false),
+		"etag": o.ETag,
+	}
+	if o.Generation != "" {
+		result["generation"] = o.Generation
+	}
+	if o.MediaLink != "" {
+		result["media_link"] = o.MediaLink
+	}
+	return result, nil
+}
@@ -0,0 +1,106 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+	"goflow/routing"
+)
+
+// FollowUp is a job an executor wants enqueued once its own execution is
+// committed. Either RunAt or DelaySeconds decides when it becomes ready.
+// Payload is written as is, so its credential fields must already be
+// sealed (see SealPayload).
+type FollowUp struct {
+	Type         string
+	Payload      []byte
+	RunAt        *time.Time
+	DelaySeconds int
+	Tags         []string
+
+	// Tenant is the staging job's tenant; empty means the default one
+	Tenant string
+}
+
+type followUpsKey struct{}
+
+// FollowUps collects the follow-up jobs staged during one execution.
+type FollowUps struct {
+	Jobs []FollowUp
+}
+
+// WithFollowUps attaches a collector to ctx. Executors running under the
+// returned context stage their follow-up jobs instead of inserting them, so
+// the worker can write them in the same transaction as the completion update.
+func WithFollowUps(ctx context.Context) (context.Context, *FollowUps) {
+	f := &FollowUps{}
+	return context.WithValue(ctx, followUpsKey{}, f), f
+}
+
+// enqueueFollowUp stages f on the context collector, or inserts it directly
+// when the executor is running outside a worker. Its payload is sealed
+// first, whichever store ends up writing it.
+func enqueueFollowUp(ctx context.Context, f FollowUp) error {
+
+	f.Tenant = TenantFromContext(ctx)
+
+	if SecretsEnabled() {
+		var payload map[string]interface{}
+		if err := json.Unmarshal(f.Payload, &payload); err != nil {
+			return err
+		}
+		if err := SealPayload(payload); err != nil {
+			return err
+		}
+		sealed, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		f.Payload = sealed
+	}
+
+	if collector, ok := ctx.Value(followUpsKey{}).(*FollowUps); ok {
+		collector.Jobs = append(collector.Jobs, f)
+		return nil
+	}
+
+	if DB == nil {
+		return fmt.Errorf("cannot enqueue %s outside a worker without Postgres", f.Type)
+	}
+	return insertFollowUp(DB, f)
+}
+
+// InsertFollowUps writes the staged follow-up jobs using tx.
+func InsertFollowUps(tx *sql.Tx, followUps []FollowUp) error {
+	for _, f := range followUps {
+		if err := insertFollowUp(tx, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func insertFollowUp(e execer, f FollowUp) error {
+
+	var payload map[string]interface{}
+	json.Unmarshal(f.Payload, &payload)
+
+	tags := f.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+
+	_, err := e.Exec(`
+		INSERT INTO jobs (type, payload, status, run_at, queue, tags, tenant_id)
+		VALUES ($1, $2, 'pending', COALESCE($3::timestamptz, NOW() + ($4 || ' seconds')::interval), $5, $6, COALESCE(NULLIF($7, ''), 'default'))
+	`, f.Type, f.Payload, f.RunAt, f.DelaySeconds, routing.GroupFor(f.Type, payload, ""), pq.Array(tags), f.Tenant)
+	return err
+}
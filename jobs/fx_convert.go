@@ -0,0 +1,236 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fx_convert converts amounts between currencies:
+//
+//	{"from": "USD", "to": ["EUR", "GBP"], "amounts": {"subtotal": 100, "tax": 20}}
+//
+// Rates come from GOFLOW_FX_PROVIDER ("frankfurter", the default and
+// keyless, or "openexchangerates" with GOFLOW_FX_API_KEY) and are cached
+// per base currency for GOFLOW_FX_CACHE_TTL (default 1h).
+
+const defaultFXCacheTTL = time.Hour
+
+type fxRates struct {
+	rates     map[string]float64
+	fetchedAt time.Time
+}
+
+var fxCache = struct {
+	sync.Mutex
+	entries map[string]fxRates
+}{entries: make(map[string]fxRates)}
+
+func fxCacheTTL() time.Duration {
+	if v := os.Getenv("GOFLOW_FX_CACHE_TTL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			return d
+		}
+	}
+	return defaultFXCacheTTL
+}
+
+func executeFXConvert(ctx context.Context, payload map[string]interface{}) (int, []byte, error) {
+
+	from, ok := payload["from"].(string)
+	if !ok || from == "" {
+		return 0, nil, fmt.Errorf("missing 'from'")
+	}
+	from = strings.ToUpper(from)
+
+	targets := stringList(payload["to"])
+	if s, ok := payload["to"].(string); ok && s != "" {
+		targets = []string{s}
+	}
+	if len(targets) == 0 {
+		return 0, nil, fmt.Errorf("missing 'to'")
+	}
+
+	amounts := map[string]float64{}
+	if a, ok := payload["amount"].(float64); ok {
+		amounts["amount"] = a
+	}
+	if raw, ok := payload["amounts"].(map[string]interface{}); ok {
+		for name, v := range raw {
+			a, ok := v.(float64)
+			if !ok {
+				return 0, nil, fmt.Errorf("amount %q is not a number", name)
+			}
+			amounts[name] = a
+		}
+	}
+	if len(amounts) == 0 {
+		return 0, nil, fmt.Errorf("missing 'amount' or 'amounts'")
+	}
+
+	decimals := 2
+	if d, ok := payload["decimals"].(float64); ok && d >= 0 {
+		decimals = int(d)
+	}
+
+	provider := os.Getenv("GOFLOW_FX_PROVIDER")
+	if provider == "" {
+		provider = "frankfurter"
+	}
+
+	rates, fetchedAt, err := fxRatesFor(ctx, provider, from)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	scale := math.Pow(10, float64(decimals))
+
+	converted := map[string]map[string]float64{}
+	usedRates := map[string]float64{}
+
+	for _, to := range targets {
+		to = strings.ToUpper(to)
+
+		rate := 1.0
+		if to != from {
+			r, ok := rates[to]
+			if !ok {
+				return 0, nil, fmt.Errorf("no rate for %s -> %s", from, to)
+			}
+			rate = r
+		}
+
+		usedRates[to] = rate
+		converted[to] = map[string]float64{}
+		for name, a := range amounts {
+			converted[to][name] = math.Round(a*rate*scale) / scale
+		}
+	}
+
+	result := map[string]interface{}{
+		"from":             from,
+		"provider":         provider,
+		"rates":            usedRates,
+		"converted":        converted,
+		"rates_fetched_at": fetchedAt,
+	}
+
+	jsonBytes, _ := json.Marshal(result)
+	return 200, jsonBytes, nil
+}
+
+// fxRatesFor returns every rate quoted against base, from cache while fresh.
+func fxRatesFor(ctx context.Context, provider string, base string) (map[string]float64, time.Time, error) {
+
+	key := provider + ":" + base
+
+	fxCache.Lock()
+	cached, ok := fxCache.entries[key]
+	fxCache.Unlock()
+
+	if ok && time.Since(cached.fetchedAt) < fxCacheTTL() {
+		return cached.rates, cached.fetchedAt, nil
+	}
+
+	var rates map[string]float64
+	var err error
+
+	switch provider {
+	case "frankfurter":
+		rates, err = fetchFrankfurterRates(ctx, base)
+	case "openexchangerates":
+		rates, err = fetchOpenExchangeRates(ctx, base)
+	default:
+		return nil, time.Time{}, fmt.Errorf("unsupported fx provider: %s", provider)
+	}
+
+	if err != nil {
+		// A stale rate beats failing an invoice run on a provider blip
+		if ok {
+			return cached.rates, cached.fetchedAt, nil
+		}
+		return nil, time.Time{}, err
+	}
+
+	entry := fxRates{rates: rates, fetchedAt: time.Now()}
+
+	fxCache.Lock()
+	fxCache.entries[key] = entry
+	fxCache.Unlock()
+
+	return entry.rates, entry.fetchedAt, nil
+}
+
+func fetchFrankfurterRates(ctx context.Context, base string) (map[string]float64, error) {
+
+	endpoint := "https://api.frankfurter.app/latest?from=" + url.QueryEscape(base)
+
+	var body struct {
+		Rates map[string]float64 `json:"rates"`
+	}
+	if err := getFXJSON(ctx, endpoint, &body); err != nil {
+		return nil, err
+	}
+
+	return body.Rates, nil
+}
+
+// fetchOpenExchangeRates always asks for USD (the only base on free plans)
+// and derives cross rates for other bases.
+func fetchOpenExchangeRates(ctx context.Context, base string) (map[string]float64, error) {
+
+	apiKey := os.Getenv("GOFLOW_FX_API_KEY")
+	if apiKey == "" {
+		return nil, fmt.Errorf("GOFLOW_FX_API_KEY is not set")
+	}
+
+	endpoint := "https://openexchangerates.org/api/latest.json?app_id=" + url.QueryEscape(apiKey)
+
+	var body struct {
+		Rates map[string]float64 `json:"rates"`
+	}
+	if err := getFXJSON(ctx, endpoint, &body); err != nil {
+		return nil, err
+	}
+
+	usdToBase, ok := body.Rates[base]
+	if !ok || usdToBase == 0 {
+		return nil, fmt.Errorf("unknown currency: %s", base)
+	}
+
+	rates := make(map[string]float64, len(body.Rates))
+	for currency, usdRate := range body.Rates {
+		rates[currency] = usdRate / usdToBase
+	}
+
+	return rates, nil
+}
+
+func getFXJSON(ctx context.Context, endpoint string, out interface{}) error {
+
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second, Transport: transportFor(ctx, nil)}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("fx provider returned status %d", resp.StatusCode)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,424 @@
+package jobs
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// generate_report renders an HTML report for a period and emails or
+// uploads it:
+//
+//	{"title": "Weekly ops report", "period": "7d",
+//	 "email": "ops@example.com",
+//	 "upload": {"url": "https://bucket.s3.amazonaws.com/ops.pdf?X-Amz-..."},
+//	 "format": "pdf"}
+//
+// The default source is GoFlow's own jobs table: totals per status, per
+// type counts and latencies, and the most common errors. With "query" the
+// report shows the rows of a read-only SQL query instead, where $1 and $2
+// are the start and end of the period. "template" replaces the built-in
+// html/template.
+//
+// Email always carries the HTML. "format": "pdf" converts the uploaded
+// copy through the Gotenberg-compatible service set by
+// ConfigurePDFRenderer.
+
+const maxReportRows = 1000
+
+var pdfRenderURL string
+
+// ConfigurePDFRenderer sets the endpoint generate_report converts HTML to
+// PDF with.
+func ConfigurePDFRenderer(endpoint string) {
+	pdfRenderURL = endpoint
+}
+
+type reportData struct {
+	Title     string
+	From      time.Time
+	To        time.Time
+	Generated time.Time
+	Stats     *jobReportStats
+	Columns   []string
+	Rows      [][]string
+}
+
+type jobReportStats struct {
+	Total    int             `json:"total"`
+	ByStatus map[string]int  `json:"by_status"`
+	ByType   []jobTypeStats  `json:"by_type"`
+	Errors   []jobErrorCount `json:"top_errors"`
+}
+
+type jobTypeStats struct {
+	Type      string  `json:"type"`
+	Total     int     `json:"total"`
+	Completed int     `json:"completed"`
+	Failed    int     `json:"failed"`
+	AvgMs     float64 `json:"avg_ms"`
+	P95Ms     float64 `json:"p95_ms"`
+}
+
+type jobErrorCount struct {
+	Error string `json:"error"`
+	Count int    `json:"count"`
+}
+
+func executeGenerateReport(ctx context.Context, payload map[string]interface{}) (int, []byte, error) {
+
+	from, to, err := reportPeriod(payload)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	data := reportData{
+		Title:     "GoFlow report",
+		From:      from,
+		To:        to,
+		Generated: time.Now(),
+	}
+	if t, ok := payload["title"].(string); ok && t != "" {
+		data.Title = t
+	}
+
+	if query, ok := payload["query"].(string); ok && query != "" {
+		data.Columns, data.Rows, err = reportQueryRows(ctx, query, from, to)
+	} else {
+		data.Stats, err = jobStatsForPeriod(ctx, from, to)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+
+	tmpl := defaultReportTemplate
+	if t, ok := payload["template"].(string); ok && t != "" {
+		tmpl = t
+	}
+
+	parsed, err := template.New("report").Parse(tmpl)
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid template: %w", err)
+	}
+
+	var html bytes.Buffer
+	if err := parsed.Execute(&html, data); err != nil {
+		return 0, nil, fmt.Errorf("template failed: %w", err)
+	}
+
+	result := map[string]interface{}{
+		"title": data.Title,
+		"from":  from,
+		"to":    to,
+	}
+	if data.Stats != nil {
+		result["stats"] = data.Stats
+	} else {
+		result["rows"] = len(data.Rows)
+	}
+
+	email, _ := payload["email"].(string)
+	hasEmail := email != ""
+	upload, hasUpload := payload["upload"].(map[string]interface{})
+
+	if !hasEmail && !hasUpload {
+		result["html"] = html.String()
+	}
+
+	if hasUpload {
+		file, contentType := html.Bytes(), "text/html; charset=utf-8"
+
+		if format, _ := payload["format"].(string); format == "pdf" {
+			if file, err = renderPDF(ctx, file); err != nil {
+				return 0, nil, err
+			}
+			contentType = "application/pdf"
+		}
+
+		status, err := uploadFile(ctx, upload, file, contentType)
+		if err != nil {
+			return 0, nil, err
+		}
+		result["upload_status"] = status
+	}
+
+	if hasEmail {
+		mail, _ := json.Marshal(map[string]interface{}{
+			"to":              email,
+			"subject":         fmt.Sprintf("%s: %s to %s", data.Title, from.Format("Jan 2"), to.Format("Jan 2, 2006")),
+			"body":            html.String(),
+			"html":            true,
+			"idempotency_key": deliveryIDFor(ctx, "report-email"),
+		})
+		if err := enqueueFollowUp(ctx, FollowUp{Type: "send_email", Payload: mail}); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	jsonBytes, _ := json.Marshal(result)
+	return 200, jsonBytes, nil
+}
+
+// reportPeriod reads "from"/"to" (RFC 3339) or a "period" ending now,
+// written as a Go duration or a number of days ("7d"). The default is the
+// last seven days.
+func reportPeriod(payload map[string]interface{}) (time.Time, time.Time, error) {
+
+	to := time.Now()
+	if s, ok := payload["to"].(string); ok && s != "" {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid 'to': %w", err)
+		}
+		to = t
+	}
+
+	if s, ok := payload["from"].(string); ok && s != "" {
+		from, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid 'from': %w", err)
+		}
+		if !from.Before(to) {
+			return time.Time{}, time.Time{}, fmt.Errorf("'from' must be before 'to'")
+		}
+		return from, to, nil
+	}
+
+	period := 7 * 24 * time.Hour
+	if s, ok := payload["period"].(string); ok && s != "" {
+		var err error
+		if days, found := strings.CutSuffix(s, "d"); found {
+			var n int
+			n, err = strconv.Atoi(days)
+			period = time.Duration(n) * 24 * time.Hour
+		} else {
+			period, err = time.ParseDuration(s)
+		}
+		if err != nil || period <= 0 {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid 'period': %s", s)
+		}
+	}
+
+	return to.Add(-period), to, nil
+}
+
+// jobStatsForPeriod summarises the report job's tenant's jobs created
+// between from and to.
+func jobStatsForPeriod(ctx context.Context, from, to time.Time) (*jobReportStats, error) {
+
+	stats := &jobReportStats{ByStatus: map[string]int{}, ByType: []jobTypeStats{}, Errors: []jobErrorCount{}}
+	tenant := tenantOrDefault(ctx)
+
+	rows, err := DB.QueryContext(ctx, `
+		SELECT status, COUNT(*) FROM jobs
+		WHERE tenant_id = $3 AND created_at >= $1 AND created_at < $2
+		GROUP BY status
+	`, from, to, tenant)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var status string
+		var count int
+		if err := rows.Scan(&status, &count); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		stats.ByStatus[status] = count
+		stats.Total += count
+	}
+	rows.Close()
+
+	rows, err = DB.QueryContext(ctx, `
+		SELECT type,
+		       COUNT(*),
+		       COUNT(*) FILTER (WHERE status = 'completed'),
+		       COUNT(*) FILTER (WHERE status = 'failed'),
+		       COALESCE(AVG(execution_time_ms), 0),
+		       COALESCE(percentile_cont(0.95) WITHIN GROUP (ORDER BY execution_time_ms), 0)
+		FROM jobs
+		WHERE tenant_id = $3 AND created_at >= $1 AND created_at < $2
+		GROUP BY type
+		ORDER BY COUNT(*) DESC
+	`, from, to, tenant)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var t jobTypeStats
+		if err := rows.Scan(&t.Type, &t.Total, &t.Completed, &t.Failed, &t.AvgMs, &t.P95Ms); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		stats.ByType = append(stats.ByType, t)
+	}
+	rows.Close()
+
+	rows, err = DB.QueryContext(ctx, `
+		SELECT last_error, COUNT(*) FROM jobs
+		WHERE tenant_id = $3 AND created_at >= $1 AND created_at < $2
+		  AND status = 'failed' AND last_error IS NOT NULL
+		GROUP BY last_error
+		ORDER BY COUNT(*) DESC
+		LIMIT 10
+	`, from, to, tenant)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e jobErrorCount
+		if err := rows.Scan(&e.Error, &e.Count); err != nil {
+			return nil, err
+		}
+		stats.Errors = append(stats.Errors, e)
+	}
+
+	return stats, rows.Err()
+}
+
+// reportQueryRows runs query in a read-only transaction, so a report can
+// never modify data, and returns its rows as text.
+func reportQueryRows(ctx context.Context, query string, from, to time.Time) ([]string, [][]string, error) {
+
+	tx, err := DB.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, query, from, to)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var out [][]string
+
+	for rows.Next() && len(out) < maxReportRows {
+		values := make([]interface{}, len(columns))
+		ptrs := make([]interface{}, len(columns))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, nil, err
+		}
+
+		row := make([]string, len(columns))
+		for i, v := range values {
+			switch val := v.(type) {
+			case nil:
+				row[i] = ""
+			case []byte:
+				row[i] = string(val)
+			case time.Time:
+				row[i] = val.Format(time.RFC3339)
+			default:
+				row[i] = fmt.Sprint(val)
+			}
+		}
+		out = append(out, row)
+	}
+
+	return columns, out, rows.Err()
+}
+
+// renderPDF converts HTML to PDF with a Gotenberg-compatible endpoint,
+// e.g. http://gotenberg:3000/forms/chromium/convert/html.
+func renderPDF(ctx context.Context, html []byte) ([]byte, error) {
+
+	endpoint := pdfRenderURL
+	if endpoint == "" {
+		return nil, fmt.Errorf("pdf output needs pdf_render_url")
+	}
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("files", "index.html")
+	if err != nil {
+		return nil, err
+	}
+	part.Write(html)
+	form.Close()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+
+	client := &http.Client{Timeout: 60 * time.Second, Transport: transportFor(ctx, nil)}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("pdf renderer returned status %d: %s", resp.StatusCode, msg)
+	}
+
+	return io.ReadAll(resp.Body)
+}
+
+const defaultReportTemplate = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: -apple-system, Helvetica, Arial, sans-serif; color: #222; margin: 24px; }
+table { border-collapse: collapse; margin: 12px 0 24px; }
+th, td { border: 1px solid #ddd; padding: 4px 10px; text-align: left; font-size: 13px; }
+th { background: #f4f4f4; }
+.muted { color: #777; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p class="muted">{{.From.Format "Jan 2, 2006 15:04 MST"}} to {{.To.Format "Jan 2, 2006 15:04 MST"}}</p>
+{{with .Stats}}
+<h2>{{.Total}} jobs</h2>
+<table>
+<tr>{{range $status, $n := .ByStatus}}<th>{{$status}}</th>{{end}}</tr>
+<tr>{{range $status, $n := .ByStatus}}<td>{{$n}}</td>{{end}}</tr>
+</table>
+<h2>By type</h2>
+<table>
+<tr><th>Type</th><th>Total</th><th>Completed</th><th>Failed</th><th>Avg ms</th><th>p95 ms</th></tr>
+{{range .ByType}}<tr><td>{{.Type}}</td><td>{{.Total}}</td><td>{{.Completed}}</td><td>{{.Failed}}</td><td>{{printf "%.0f" .AvgMs}}</td><td>{{printf "%.0f" .P95Ms}}</td></tr>
+{{end}}</table>
+{{if .Errors}}
+<h2>Top errors</h2>
+<table>
+<tr><th>Count</th><th>Error</th></tr>
+{{range .Errors}}<tr><td>{{.Count}}</td><td>{{.Error}}</td></tr>
+{{end}}</table>
+{{end}}
+{{else}}
+<table>
+<tr>{{range .Columns}}<th>{{.}}</th>{{end}}</tr>
+{{range .Rows}}<tr>{{range .}}<td>{{.}}</td>{{end}}</tr>
+{{end}}</table>
+{{end}}
+<p class="muted">Generated {{.Generated.Format "Jan 2, 2006 15:04 MST"}}</p>
+</body>
+</html>
+`
@@ -0,0 +1,152 @@
+package jobs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// generate_sitemap crawls a site and builds a sitemap.xml from the HTML
+// pages that answered 200:
+//
+//	{"url": "https://example.com", "max_depth": 3, "max_pages": 500,
+//	 "upload": {"url": "https://bucket.s3.amazonaws.com/sitemap.xml?X-Amz-...",
+//	            "method": "PUT", "headers": {"Content-Type": "application/xml"}}}
+//
+// "upload" sends the file anywhere that accepts an HTTP request: a
+// presigned object storage URL or the site's own API. Without it, the
+// XML is returned in the response.
+
+const maxSitemapURLs = 50000
+
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"urlset"`
+	Xmlns   string       `xml:"xmlns,attr"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+func executeGenerateSitemap(ctx context.Context, payload map[string]interface{}) (int, []byte, error) {
+
+	start, ok := payload["url"].(string)
+	if !ok || start == "" {
+		return 0, nil, fmt.Errorf("missing 'url'")
+	}
+
+	maxDepth := 3
+	if d, ok := payload["max_depth"].(float64); ok && d >= 0 {
+		maxDepth = int(d)
+	}
+
+	maxPages := 500
+	if p, ok := payload["max_pages"].(float64); ok && p >= 1 {
+		maxPages = min(int(p), maxSitemapURLs)
+	}
+
+	client := &http.Client{Timeout: 15 * time.Second, Transport: transportFor(ctx, nil)}
+
+	pages, err := crawlSite(ctx, client, start, maxDepth, maxPages)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	set := sitemapURLSet{Xmlns: "http://www.sitemaps.org/schemas/sitemap/0.9"}
+	for _, p := range pages {
+		if p.Err != nil || p.Status != http.StatusOK || !p.HTML {
+			continue
+		}
+		entry := sitemapURL{Loc: p.URL}
+		if !p.LastModified.IsZero() {
+			entry.LastMod = p.LastModified.UTC().Format("2006-01-02")
+		}
+		set.URLs = append(set.URLs, entry)
+	}
+
+	body, err := xml.MarshalIndent(set, "", "  ")
+	if err != nil {
+		return 0, nil, err
+	}
+	sitemap := append([]byte(xml.Header), body...)
+
+	result := map[string]interface{}{
+		"pages_crawled": len(pages),
+		"urls":          len(set.URLs),
+	}
+
+	upload, ok := payload["upload"].(map[string]interface{})
+	if !ok {
+		result["sitemap"] = string(sitemap)
+		jsonBytes, _ := json.Marshal(result)
+		return 200, jsonBytes, nil
+	}
+
+	status, err := uploadFile(ctx, upload, sitemap, "application/xml")
+	if err != nil {
+		return 0, nil, err
+	}
+
+	result["upload_status"] = status
+
+	jsonBytes, _ := json.Marshal(result)
+	return 200, jsonBytes, nil
+}
+
+// uploadFile sends body to the request described by upload: a url, an
+// optional method (default PUT) and optional headers.
+func uploadFile(ctx context.Context, upload map[string]interface{}, body []byte, contentType string) (int, error) {
+	return uploadStream(ctx, upload, bytes.NewReader(body), int64(len(body)), contentType)
+}
+
+// uploadStream is uploadFile for bodies too large to hold in memory.
+// Presigned object storage URLs need the length up front.
+func uploadStream(ctx context.Context, upload map[string]interface{}, body io.Reader, size int64, contentType string) (int, error) {
+
+	target, ok := upload["url"].(string)
+	if !ok || target == "" {
+		return 0, fmt.Errorf("upload missing 'url'")
+	}
+
+	method := "PUT"
+	if m, ok := upload["method"].(string); ok && m != "" {
+		method = m
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return 0, err
+	}
+	req.ContentLength = size
+
+	req.Header.Set("Content-Type", contentType)
+	if headers, ok := upload["headers"].(map[string]interface{}); ok {
+		for k, v := range headers {
+			if s, ok := v.(string); ok {
+				req.Header.Set(k, s)
+			}
+		}
+	}
+
+	client := &http.Client{Timeout: 30 * time.Minute, Transport: transportFor(ctx, nil)}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return resp.StatusCode, fmt.Errorf("upload returned status %d: %s", resp.StatusCode, msg)
+	}
+
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,359 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// geocode turns an address into coordinates, or coordinates into an
+// address when "lat"/"lon" are given instead of "address":
+//
+//	{"address": "10 Downing St, London"}
+//	{"lat": 51.5034, "lon": -0.1276, "provider": "google"}
+//
+// The provider comes from the payload or GOFLOW_GEOCODE_PROVIDER
+// (nominatim, google, mapbox). Requests are spaced to respect each
+// provider's rate limit across all workers in this process, and results
+// are cached in geocode_cache for GOFLOW_GEOCODE_CACHE_TTL (default 720h).
+
+const defaultGeocodeCacheTTL = 30 * 24 * time.Hour
+
+type geocodeResult struct {
+	Lat         float64 `json:"lat"`
+	Lon         float64 `json:"lon"`
+	DisplayName string  `json:"display_name"`
+}
+
+// geocodeIntervals is the minimum spacing between requests per provider:
+// Nominatim's usage policy allows 1 request/second, Google 50/s and
+// Mapbox 600/minute.
+var geocodeIntervals = map[string]time.Duration{
+	"nominatim": time.Second,
+	"google":    20 * time.Millisecond,
+	"mapbox":    100 * time.Millisecond,
+}
+
+var geocodeSlots = struct {
+	sync.Mutex
+	next map[string]time.Time
+}{next: make(map[string]time.Time)}
+
+// waitGeocodeSlot reserves the provider's next free request slot and
+// sleeps until it arrives.
+func waitGeocodeSlot(ctx context.Context, provider string) error {
+
+	interval := geocodeIntervals[provider]
+	if v := os.Getenv("GOFLOW_GEOCODE_RATE"); v != "" {
+		if rate, err := strconv.ParseFloat(v, 64); err == nil && rate > 0 {
+			interval = time.Duration(float64(time.Second) / rate)
+		}
+	}
+
+	geocodeSlots.Lock()
+	slot := time.Now()
+	if next := geocodeSlots.next[provider]; next.After(slot) {
+		slot = next
+	}
+	geocodeSlots.next[provider] = slot.Add(interval)
+	geocodeSlots.Unlock()
+
+	wait := time.Until(slot)
+	if wait <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func executeGeocode(ctx context.Context, payload map[string]interface{}) (int, []byte, error) {
+
+	provider, _ := payload["provider"].(string)
+	if provider == "" {
+		provider = os.Getenv("GOFLOW_GEOCODE_PROVIDER")
+	}
+	if provider == "" {
+		provider = "nominatim"
+	}
+	if _, ok := geocodeIntervals[provider]; !ok {
+		return 0, nil, fmt.Errorf("unsupported geocode provider: %s", provider)
+	}
+
+	address, _ := payload["address"].(string)
+	lat, hasLat := payload["lat"].(float64)
+	lon, hasLon := payload["lon"].(float64)
+
+	reverse := address == ""
+	if reverse && !(hasLat && hasLon) {
+		return 0, nil, fmt.Errorf("missing 'address' or 'lat'/'lon'")
+	}
+
+	query := strings.TrimSpace(address)
+	if reverse {
+		query = fmt.Sprintf("%.6f,%.6f", lat, lon)
+	}
+	cacheKey := fmt.Sprintf("%s:%t:%s", provider, reverse, strings.ToLower(query))
+
+	results, ok, err := cachedGeocode(ctx, cacheKey)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if !ok {
+		if err := waitGeocodeSlot(ctx, provider); err != nil {
+			return 0, nil, err
+		}
+
+		apiKey, _ := payload["api_key"].(string)
+
+		switch provider {
+		case "nominatim":
+			results, err = geocodeNominatim(ctx, address, lat, lon, reverse)
+		case "google":
+			results, err = geocodeGoogle(ctx, apiKey, address, lat, lon, reverse)
+		case "mapbox":
+			results, err = geocodeMapbox(ctx, apiKey, address, lat, lon, reverse)
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+
+		storeGeocode(cacheKey, results)
+	}
+
+	result := map[string]interface{}{
+		"provider": provider,
+		"query":    query,
+		"reverse":  reverse,
+		"results":  results,
+		"cached":   ok,
+	}
+
+	jsonBytes, _ := json.Marshal(result)
+	return 200, jsonBytes, nil
+}
+
+func cachedGeocode(ctx context.Context, key string) ([]geocodeResult, bool, error) {
+
+	// Remote agents have no database, so they run uncached
+	if DB == nil {
+		return nil, false, nil
+	}
+
+	ttl := defaultGeocodeCacheTTL
+	if v := os.Getenv("GOFLOW_GEOCODE_CACHE_TTL"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			ttl = d
+		}
+	}
+
+	var raw []byte
+	err := DB.QueryRowContext(ctx, `
+		SELECT results FROM geocode_cache
+		WHERE key = $1
+		AND fetched_at > NOW() - ($2 || ' seconds')::interval
+	`, key, int(ttl.Seconds())).Scan(&raw)
+
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	var results []geocodeResult
+	if err := json.Unmarshal(raw, &results); err != nil {
+		return nil, false, nil
+	}
+	return results, true, nil
+}
+
+func storeGeocode(key string, results []geocodeResult) {
+
+	if DB == nil {
+		return
+	}
+
+	raw, _ := json.Marshal(results)
+
+	DB.Exec(`
+		INSERT INTO geocode_cache (key, results, fetched_at)
+		VALUES ($1, $2, NOW())
+		ON CONFLICT (key) DO UPDATE
+		SET results = EXCLUDED.results, fetched_at = NOW()
+	`, key, raw)
+}
+
+func geocodeNominatim(ctx context.Context, address string, lat, lon float64, reverse bool) ([]geocodeResult, error) {
+
+	endpoint := "https://nominatim.openstreetmap.org/search?format=jsonv2&limit=5&q=" + url.QueryEscape(address)
+	if reverse {
+		endpoint = fmt.Sprintf("https://nominatim.openstreetmap.org/reverse?format=jsonv2&lat=%f&lon=%f", lat, lon)
+	}
+
+	type place struct {
+		Lat         string `json:"lat"`
+		Lon         string `json:"lon"`
+		DisplayName string `json:"display_name"`
+	}
+
+	var places []place
+	if reverse {
+		var p place
+		if err := getGeocodeJSON(ctx, "nominatim", endpoint, &p); err != nil {
+			return nil, err
+		}
+		if p.Lat != "" {
+			places = append(places, p)
+		}
+	} else if err := getGeocodeJSON(ctx, "nominatim", endpoint, &places); err != nil {
+		return nil, err
+	}
+
+	results := []geocodeResult{}
+	for _, p := range places {
+		la, _ := strconv.ParseFloat(p.Lat, 64)
+		lo, _ := strconv.ParseFloat(p.Lon, 64)
+		results = append(results, geocodeResult{Lat: la, Lon: lo, DisplayName: p.DisplayName})
+	}
+	return results, nil
+}
+
+func geocodeGoogle(ctx context.Context, apiKey string, address string, lat, lon float64, reverse bool) ([]geocodeResult, error) {
+
+	if apiKey == "" {
+		apiKey = os.Getenv("GOFLOW_GEOCODE_GOOGLE_KEY")
+	}
+	if apiKey == "" {
+		return nil, fmt.Errorf("missing Google API key")
+	}
+
+	endpoint := "https://maps.googleapis.com/maps/api/geocode/json?key=" + url.QueryEscape(apiKey)
+	if reverse {
+		endpoint += fmt.Sprintf("&latlng=%f,%f", lat, lon)
+	} else {
+		endpoint += "&address=" + url.QueryEscape(address)
+	}
+
+	var body struct {
+		Status  string `json:"status"`
+		Results []struct {
+			FormattedAddress string `json:"formatted_address"`
+			Geometry         struct {
+				Location struct {
+					Lat float64 `json:"lat"`
+					Lng float64 `json:"lng"`
+				} `json:"location"`
+			} `json:"geometry"`
+		} `json:"results"`
+	}
+
+	if err := getGeocodeJSON(ctx, "google", endpoint, &body); err != nil {
+		return nil, err
+	}
+
+	if body.Status == "OVER_QUERY_LIMIT" {
+		return nil, fmt.Errorf("google geocoding rate limit exceeded")
+	}
+	if body.Status != "OK" && body.Status != "ZERO_RESULTS" {
+		return nil, fmt.Errorf("google geocoding failed: %s", body.Status)
+	}
+
+	results := []geocodeResult{}
+	for _, r := range body.Results {
+		results = append(results, geocodeResult{
+			Lat:         r.Geometry.Location.Lat,
+			Lon:         r.Geometry.Location.Lng,
+			DisplayName: r.FormattedAddress,
+		})
+	}
+	return results, nil
+}
+
+func geocodeMapbox(ctx context.Context, token string, address string, lat, lon float64, reverse bool) ([]geocodeResult, error) {
+
+	if token == "" {
+		token = os.Getenv("GOFLOW_GEOCODE_MAPBOX_TOKEN")
+	}
+	if token == "" {
+		return nil, fmt.Errorf("missing Mapbox access token")
+	}
+
+	query := url.PathEscape(address)
+	if reverse {
+		query = fmt.Sprintf("%f,%f", lon, lat)
+	}
+
+	endpoint := "https://api.mapbox.com/geocoding/v5/mapbox.places/" + query +
+		".json?limit=5&access_token=" + url.QueryEscape(token)
+
+	var body struct {
+		Features []struct {
+			PlaceName string    `json:"place_name"`
+			Center    []float64 `json:"center"`
+		} `json:"features"`
+	}
+
+	if err := getGeocodeJSON(ctx, "mapbox", endpoint, &body); err != nil {
+		return nil, err
+	}
+
+	results := []geocodeResult{}
+	for _, f := range body.Features {
+		if len(f.Center) != 2 {
+			continue
+		}
+		results = append(results, geocodeResult{Lat: f.Center[1], Lon: f.Center[0], DisplayName: f.PlaceName})
+	}
+	return results, nil
+}
+
+func getGeocodeJSON(ctx context.Context, provider string, endpoint string, out interface{}) error {
+
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return err
+	}
+
+	// Nominatim rejects requests without an identifying User-Agent
+	req.Header.Set("User-Agent", "GoFlow geocode executor")
+
+	client := &http.Client{Timeout: 10 * time.Second, Transport: transportFor(ctx, nil)}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		// Hold back every worker until the provider says it is ready again
+		if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+			geocodeSlots.Lock()
+			geocodeSlots.next[provider] = time.Now().Add(time.Duration(secs) * time.Second)
+			geocodeSlots.Unlock()
+		}
+		return fmt.Errorf("geocode provider rate limit exceeded")
+	}
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("geocode provider returned status %d", resp.StatusCode)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,157 @@
+package jobs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// graphql_request posts a GraphQL operation:
+//
+//	{"url": "https://api.example.com/graphql",
+//	 "query": "mutation($id: ID!) { archive(id: $id) { id } }",
+//	 "variables": {"id": "42"}, "operation_name": "Archive",
+//	 "headers": {"Authorization": "Bearer ..."}}
+//
+// GraphQL reports most failures in the "errors" of a 200 response, where
+// http_request would see a success. Here they fail the job, unless
+// "fail_on_errors" is false. Errors the server raised before running the
+// operation (no "data" in the response, or a parse, validation, input or
+// access error code) are permanent; errors from resolvers are retried.
+
+// graphqlPermanentCodes are extensions.code values that mean the same
+// request will fail again.
+var graphqlPermanentCodes = map[string]bool{
+	"GRAPHQL_PARSE_FAILED":      true,
+	"GRAPHQL_VALIDATION_FAILED": true,
+	"BAD_USER_INPUT":            true,
+	"UNAUTHENTICATED":           true,
+	"FORBIDDEN":                 true,
+	"PERSISTED_QUERY_NOT_FOUND": true,
+}
+
+type graphqlError struct {
+	Message    string                 `json:"message"`
+	Path       []interface{}          `json:"path"`
+	Extensions map[string]interface{} `json:"extensions"`
+}
+
+func executeGraphQLRequest(ctx context.Context, payload map[string]interface{}) (int, []byte, error) {
+
+	url, ok := payload["url"].(string)
+	if !ok || url == "" {
+		return 0, nil, Permanent(fmt.Errorf("missing url"))
+	}
+	query, ok := payload["query"].(string)
+	if !ok || query == "" {
+		return 0, nil, Permanent(fmt.Errorf("missing query"))
+	}
+
+	body := map[string]interface{}{"query": query}
+	if v, ok := payload["variables"]; ok && v != nil {
+		body["variables"] = v
+	}
+	if name, ok := payload["operation_name"].(string); ok && name != "" {
+		body["operationName"] = name
+	}
+	bodyBytes, err := json.Marshal(body)
+	if err != nil {
+		return 0, nil, Permanent(err)
+	}
+
+	failOnErrors := true
+	if v, ok := payload["fail_on_errors"].(bool); ok {
+		failOnErrors = v
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(bodyBytes))
+	if err != nil {
+		return 0, nil, Permanent(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/graphql-response+json, application/json")
+	if headers, ok := payload["headers"].(map[string]interface{}); ok {
+		for k, v := range headers {
+			if s, ok := v.(string); ok {
+				req.Header.Set(k, s)
+			}
+		}
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second, Transport: transportFor(ctx, nil)}
+
+	resp, err := sendThroughBreaker(client, req)
+	if err != nil {
+		if ctx.Err() == context.Canceled {
+			return 0, nil, fmt.Errorf("request cancelled")
+		}
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	responseBytes, err := io.ReadAll(io.LimitReader(resp.Body, 10<<20))
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// A response without "data" is a request error: the operation never
+	// ran. A null "data" is an execution error
+	var r struct {
+		Data   json.RawMessage `json:"data"`
+		Errors []graphqlError  `json:"errors"`
+	}
+	parseErr := json.Unmarshal(responseBytes, &r)
+
+	if resp.StatusCode >= 400 {
+		if parseErr == nil && len(r.Errors) > 0 {
+			return resp.StatusCode, responseBytes, ResponseError(resp, fmt.Errorf("graphql status %d: %s", resp.StatusCode, graphqlErrorText(r.Errors)))
+		}
+		return resp.StatusCode, responseBytes, httpStatusError(resp)
+	}
+	if parseErr != nil {
+		return resp.StatusCode, responseBytes, fmt.Errorf("graphql returned invalid JSON: %w", parseErr)
+	}
+
+	if len(r.Errors) == 0 || !failOnErrors {
+		if len(r.Errors) > 0 {
+			jobLog(ctx, "graphql errors ignored: %s", graphqlErrorText(r.Errors))
+		}
+		return resp.StatusCode, responseBytes, nil
+	}
+
+	err = fmt.Errorf("graphql errors: %s", graphqlErrorText(r.Errors))
+
+	for _, e := range r.Errors {
+		code, _ := e.Extensions["code"].(string)
+		if graphqlPermanentCodes[code] {
+			return resp.StatusCode, responseBytes, Permanent(err)
+		}
+	}
+	if len(r.Data) == 0 {
+		return resp.StatusCode, responseBytes, Permanent(err)
+	}
+	return resp.StatusCode, responseBytes, err
+}
+
+// graphqlErrorText joins the error messages, each with its path.
+func graphqlErrorText(errs []graphqlError) string {
+
+	var parts []string
+	for _, e := range errs {
+		msg := e.Message
+		if len(e.Path) > 0 {
+			path := make([]string, len(e.Path))
+			for i, p := range e.Path {
+				path[i] = fmt.Sprint(p)
+			}
+			msg = strings.Join(path, ".") + ": " + msg
+		}
+		parts = append(parts, msg)
+	}
+	return strings.Join(parts, "; ")
+}
@@ -0,0 +1,136 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// Guarantee is the execution guarantee of a job type.
+//
+// AtLeastOnce types are simply re-run after a failure or a crash recovery.
+// EffectivelyOnce types have side effects that must not be repeated (an
+// email, a payment): every attempt is recorded under the tenant's
+// idempotency key and a job whose previous attempt may have succeeded is
+// never re-executed. Tenants pick their keys independently, so the same
+// key in two tenants is two executions.
+type Guarantee string
+
+const (
+	AtLeastOnce     Guarantee = "at_least_once"
+	EffectivelyOnce Guarantee = "effectively_once"
+)
+
+// ErrOutcomeUnknown is returned when a previous attempt of an
+// effectively-once job started but never recorded its outcome. The job must
+// not be retried automatically.
+var ErrOutcomeUnknown = errors.New("previous attempt outcome unknown; not re-executing")
+
+var guarantees = map[string]Guarantee{
+	"send_email":        EffectivelyOnce,
+	"send_sms":          EffectivelyOnce,
+	"push_notification": EffectivelyOnce,
+	"stripe_operation":  EffectivelyOnce,
+}
+
+// SetGuarantee overrides the guarantee of a job type.
+func SetGuarantee(jobType string, g Guarantee) {
+	guarantees[jobType] = g
+}
+
+// GuaranteeFor returns the guarantee of a job type (AtLeastOnce by default).
+func GuaranteeFor(jobType string) Guarantee {
+	if g, ok := guarantees[jobType]; ok {
+		return g
+	}
+	return AtLeastOnce
+}
+
+// idempotencyKey returns the payload's idempotency token, falling back to
+// the job ID which is stable across retries and recovery of the same job.
+func idempotencyKey(ctx context.Context, payload map[string]interface{}) (string, error) {
+	if key, ok := payload["idempotency_key"].(string); ok && key != "" {
+		return key, nil
+	}
+	if jobID, ok := JobIDFromContext(ctx); ok {
+		return fmt.Sprintf("job:%d", jobID), nil
+	}
+	return "", fmt.Errorf("missing 'idempotency_key'")
+}
+
+func executeEffectivelyOnce(ctx context.Context, jobType string, payload map[string]interface{}) (int, []byte, error) {
+
+	key, err := idempotencyKey(ctx, payload)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	jobID, _ := JobIDFromContext(ctx)
+	tenant := tenantOrDefault(ctx)
+
+	res, err := DB.ExecContext(ctx, `
+		INSERT INTO job_executions (tenant_id, job_type, idempotency_key, job_id, status)
+		VALUES ($4, $1, $2, $3, 'started')
+		ON CONFLICT (tenant_id, job_type, idempotency_key) DO NOTHING
+	`, jobType, key, jobID, tenant)
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	inserted, _ := res.RowsAffected()
+
+	if inserted == 0 {
+		var status string
+		var responseStatus sql.NullInt64
+		var responseBody []byte
+
+		err := DB.QueryRowContext(ctx, `
+			SELECT status, response_status, response_body
+			FROM job_executions
+			WHERE tenant_id = $3 AND job_type = $1 AND idempotency_key = $2
+		`, jobType, key, tenant).Scan(&status, &responseStatus, &responseBody)
+
+		if err != nil {
+			return 0, nil, err
+		}
+
+		if status == "succeeded" {
+			return int(responseStatus.Int64), responseBody, nil
+		}
+
+		return 0, nil, ErrOutcomeUnknown
+	}
+
+	statusCode, responseBody, execErr := dispatch(ctx, jobType, payload)
+
+	if execErr != nil {
+		// An interrupted attempt may still have gone through (an SMTP send
+		// keeps running after cancellation), so leave it marked as started.
+		if ctx.Err() != nil {
+			return statusCode, responseBody, execErr
+		}
+
+		// The attempt definitely failed, so a retry is safe
+		DB.Exec(`
+			DELETE FROM job_executions
+			WHERE tenant_id = $3 AND job_type = $1 AND idempotency_key = $2
+		`, jobType, key, tenant)
+
+		return statusCode, responseBody, execErr
+	}
+
+	// If this update is lost the row stays 'started', which errs on the
+	// side of never repeating the side effect.
+	DB.Exec(`
+		UPDATE job_executions
+		SET status = 'succeeded',
+		    response_status = $3,
+		    response_body = $4,
+		    finished_at = NOW()
+		WHERE tenant_id = $5 AND job_type = $1 AND idempotency_key = $2
+	`, jobType, key, statusCode, responseBody, tenant)
+
+	return statusCode, responseBody, nil
+}
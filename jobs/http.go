@@ -2,7 +2,7 @@ package jobs
 
 import (
 	"bytes"
-	"context"   // ✅ ADD THIS
+	"context" // ✅ ADD THIS
 	"encoding/json"
 	"fmt"
 	"io"
@@ -14,7 +14,7 @@ func executeHTTPRequest(ctx context.Context, payload map[string]interface{}) (in
 
 	url, ok := payload["url"].(string)
 	if !ok {
-		return 0, nil, fmt.Errorf("missing url")
+		return 0, nil, Permanent(fmt.Errorf("missing url"))
 	}
 
 	method := "GET"
@@ -32,7 +32,8 @@ func executeHTTPRequest(ctx context.Context, payload map[string]interface{}) (in
 	}
 
 	client := &http.Client{
-		Timeout: 10 * time.Second, // keep timeout as fallback
+		Timeout:   10 * time.Second, // keep timeout as fallback
+		Transport: transportFor(ctx, nil),
 	}
 
 	// ✅ CRITICAL CHANGE — CONTEXT-AWARE REQUEST
@@ -43,7 +44,7 @@ func executeHTTPRequest(ctx context.Context, payload map[string]interface{}) (in
 
 	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := client.Do(req)
+	resp, err := sendThroughBreaker(client, req)
 	if err != nil {
 
 		// 🔥 HANDLE CANCELLATION CLEANLY
@@ -58,9 +59,8 @@ func executeHTTPRequest(ctx context.Context, payload map[string]interface{}) (in
 	responseBytes, _ := io.ReadAll(resp.Body)
 
 	if resp.StatusCode >= 400 {
-		return resp.StatusCode, responseBytes,
-			fmt.Errorf("http status %d", resp.StatusCode)
+		return resp.StatusCode, responseBytes, httpStatusError(resp)
 	}
 
 	return resp.StatusCode, responseBytes, nil
-}
\ No newline at end of file
+}
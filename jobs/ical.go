@@ -0,0 +1,272 @@
+package jobs
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/teambition/rrule-go"
+)
+
+// icalEvent is one VEVENT from an ICS feed, reduced to what scheduling
+// needs.
+type icalEvent struct {
+	UID          string
+	Summary      string
+	Description  string
+	Location     string
+	Start        time.Time
+	End          time.Time
+	AllDay       bool
+	Cancelled    bool
+	RRule        string
+	RDates       []time.Time
+	ExDates      []time.Time
+	RecurrenceID time.Time
+}
+
+// icalOccurrence is one concrete instance of an event.
+type icalOccurrence struct {
+	Event *icalEvent
+	Start time.Time
+	End   time.Time
+}
+
+// parseICal reads the VEVENTs of a calendar. Nested components such as
+// VALARM are skipped.
+func parseICal(r io.Reader) ([]*icalEvent, error) {
+
+	lines, err := unfoldICal(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var events []*icalEvent
+	var current *icalEvent
+	depth := 0
+
+	for _, line := range lines {
+		name, params, value := splitICalLine(line)
+
+		switch name {
+		case "BEGIN":
+			if value == "VEVENT" && current == nil {
+				current = &icalEvent{}
+				depth = 0
+			} else if current != nil {
+				depth++
+			}
+			continue
+		case "END":
+			if current != nil && depth > 0 {
+				depth--
+			} else if value == "VEVENT" && current != nil {
+				events = append(events, current)
+				current = nil
+			}
+			continue
+		}
+
+		if current == nil || depth > 0 {
+			continue
+		}
+
+		switch name {
+		case "UID":
+			current.UID = value
+		case "SUMMARY":
+			current.Summary = unescapeICalText(value)
+		case "DESCRIPTION":
+			current.Description = unescapeICalText(value)
+		case "LOCATION":
+			current.Location = unescapeICalText(value)
+		case "STATUS":
+			current.Cancelled = strings.EqualFold(value, "CANCELLED")
+		case "RRULE":
+			current.RRule = value
+		case "DTSTART":
+			current.Start, current.AllDay, err = parseICalTime(value, params)
+		case "DTEND":
+			current.End, _, err = parseICalTime(value, params)
+		case "RECURRENCE-ID":
+			current.RecurrenceID, _, err = parseICalTime(value, params)
+		case "EXDATE", "RDATE":
+			for _, v := range strings.Split(value, ",") {
+				t, _, perr := parseICalTime(v, params)
+				if perr != nil {
+					err = perr
+					break
+				}
+				if name == "EXDATE" {
+					current.ExDates = append(current.ExDates, t)
+				} else {
+					current.RDates = append(current.RDates, t)
+				}
+			}
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("event %q: %s: %w", current.UID, name, err)
+		}
+	}
+
+	return events, nil
+}
+
+// unfoldICal joins continuation lines, which start with a space or tab.
+func unfoldICal(r io.Reader) ([]string, error) {
+
+	var lines []string
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	return lines, scanner.Err()
+}
+
+// splitICalLine splits "NAME;PARAM=x;PARAM2=y:value". Quoted parameter
+// values may contain ':' and ';'.
+func splitICalLine(line string) (string, map[string]string, string) {
+
+	inQuote := false
+	colon := -1
+	for i, c := range line {
+		if c == '"' {
+			inQuote = !inQuote
+		} else if c == ':' && !inQuote {
+			colon = i
+			break
+		}
+	}
+	if colon < 0 {
+		return strings.ToUpper(line), nil, ""
+	}
+
+	head, value := line[:colon], line[colon+1:]
+	parts := strings.Split(head, ";")
+
+	params := map[string]string{}
+	for _, p := range parts[1:] {
+		if k, v, ok := strings.Cut(p, "="); ok {
+			params[strings.ToUpper(k)] = strings.Trim(v, `"`)
+		}
+	}
+
+	return strings.ToUpper(parts[0]), params, value
+}
+
+func parseICalTime(value string, params map[string]string) (time.Time, bool, error) {
+
+	if params["VALUE"] == "DATE" || len(value) == 8 {
+		t, err := time.ParseInLocation("20060102", value, time.UTC)
+		return t, true, err
+	}
+
+	if strings.HasSuffix(value, "Z") {
+		t, err := time.Parse("20060102T150405Z", value)
+		return t, false, err
+	}
+
+	loc := time.UTC
+	if tzid := params["TZID"]; tzid != "" {
+		l, err := time.LoadLocation(tzid)
+		if err != nil {
+			return time.Time{}, false, fmt.Errorf("unknown TZID %q", tzid)
+		}
+		loc = l
+	}
+
+	t, err := time.ParseInLocation("20060102T150405", value, loc)
+	return t, false, err
+}
+
+func unescapeICalText(s string) string {
+	return strings.NewReplacer(`\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";", `\\`, `\`).Replace(s)
+}
+
+// expandICal returns the occurrences starting in [from, to), in start
+// order. Instances overridden by a RECURRENCE-ID event are replaced by the
+// override; cancelled instances are dropped.
+func expandICal(events []*icalEvent, from, to time.Time) ([]icalOccurrence, error) {
+
+	overridden := map[string][]time.Time{}
+	for _, e := range events {
+		if !e.RecurrenceID.IsZero() {
+			overridden[e.UID] = append(overridden[e.UID], e.RecurrenceID)
+		}
+	}
+
+	var out []icalOccurrence
+
+	for _, e := range events {
+		if e.Start.IsZero() {
+			continue
+		}
+
+		duration := time.Duration(0)
+		if !e.End.IsZero() {
+			duration = e.End.Sub(e.Start)
+		} else if e.AllDay {
+			duration = 24 * time.Hour
+		}
+
+		if e.RRule == "" || !e.RecurrenceID.IsZero() {
+			if !e.Cancelled && !e.Start.Before(from) && e.Start.Before(to) {
+				out = append(out, icalOccurrence{Event: e, Start: e.Start, End: e.Start.Add(duration)})
+			}
+			continue
+		}
+
+		opts, err := rrule.StrToROption(e.RRule)
+		if err != nil {
+			return nil, fmt.Errorf("event %q: RRULE: %w", e.UID, err)
+		}
+		opts.Dtstart = e.Start
+
+		rule, err := rrule.NewRRule(*opts)
+		if err != nil {
+			return nil, fmt.Errorf("event %q: RRULE: %w", e.UID, err)
+		}
+
+		set := rrule.Set{}
+		set.RRule(rule)
+		for _, t := range e.RDates {
+			set.RDate(t)
+		}
+		for _, t := range e.ExDates {
+			set.ExDate(t)
+		}
+		for _, t := range overridden[e.UID] {
+			set.ExDate(t)
+		}
+
+		if e.Cancelled {
+			continue
+		}
+
+		for _, start := range set.Between(from, to, true) {
+			if start.Equal(to) {
+				continue
+			}
+			out = append(out, icalOccurrence{Event: e, Start: start, End: start.Add(duration)})
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].Start.Before(out[j].Start) })
+
+	return out, nil
+}
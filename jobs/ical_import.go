@@ -0,0 +1,249 @@
+package jobs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ical_import turns calendar events into scheduled jobs:
+//
+//	{"url": "https://calendar.example.com/team.ics", "window_hours": 48,
+//	 "offset_minutes": -15, "match": "Release",
+//	 "job": {"type": "send_email", "payload": {"to": "team@example.com",
+//	         "subject": "Starting soon: {{event.summary}}", "body": "{{event.start}}"}}}
+//
+// Recurring events are expanded for the next "window_hours" (default 24)
+// and each occurrence gets its own job, due "offset_minutes" from its
+// start. Without "job", each occurrence sends a "calendar.occurrence"
+// event to "webhook_url" at that time instead. String values in the job
+// payload may use {{event.summary}}, {{event.description}},
+// {{event.location}}, {{event.uid}}, {{event.start}} and {{event.end}}.
+//
+// Run it on a cron_schedule shorter than the window. Occurrences already
+// scheduled are skipped, and pending jobs for occurrences that have since
+// moved or been cancelled in the calendar are cancelled.
+
+const maxICalOccurrences = 1000
+
+func executeICalImport(ctx context.Context, payload map[string]interface{}) (int, []byte, error) {
+
+	feed, ok := payload["url"].(string)
+	if !ok || feed == "" {
+		return 0, nil, fmt.Errorf("missing 'url'")
+	}
+
+	jobTemplate, hasJob := payload["job"].(map[string]interface{})
+	hook, _ := payload["webhook_url"].(string)
+	if !hasJob && hook == "" {
+		return 0, nil, fmt.Errorf("missing 'job' or 'webhook_url'")
+	}
+
+	var jobType string
+	var jobPayload map[string]interface{}
+	if hasJob {
+		jobType, _ = jobTemplate["type"].(string)
+		jobPayload, _ = jobTemplate["payload"].(map[string]interface{})
+		if jobType == "" || jobPayload == nil {
+			return 0, nil, fmt.Errorf("job needs 'type' and 'payload'")
+		}
+	}
+
+	window := 24 * time.Hour
+	if h, ok := payload["window_hours"].(float64); ok && h > 0 {
+		window = time.Duration(h * float64(time.Hour))
+	}
+
+	offset := time.Duration(0)
+	if m, ok := payload["offset_minutes"].(float64); ok {
+		offset = time.Duration(m * float64(time.Minute))
+	}
+
+	match, _ := payload["match"].(string)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", feed, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second, Transport: transportFor(ctx, nil)}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return 0, nil, fmt.Errorf("feed returned status %d", resp.StatusCode)
+	}
+
+	events, err := parseICal(io.LimitReader(resp.Body, 10<<20))
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// Occurrences are selected by when their job runs, so a negative
+	// offset reaches events just beyond the window
+	now := time.Now()
+	occurrences, err := expandICal(events, now.Add(-offset), now.Add(window-offset))
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if match != "" {
+		kept := occurrences[:0]
+		for _, o := range occurrences {
+			if strings.Contains(strings.ToLower(o.Event.Summary), strings.ToLower(match)) {
+				kept = append(kept, o)
+			}
+		}
+		occurrences = kept
+	}
+
+	if len(occurrences) > maxICalOccurrences {
+		occurrences = occurrences[:maxICalOccurrences]
+	}
+
+	feedTag := "ical-feed:" + shortHash(feed)
+
+	scheduled, err := scheduledICalTags(ctx, feedTag, now)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	current := []string{}
+	created := 0
+
+	for _, o := range occurrences {
+		tag := "ical:" + shortHash(feed, o.Event.UID, o.Start.UTC().Format(time.RFC3339))
+		current = append(current, tag)
+
+		if scheduled[tag] {
+			continue
+		}
+
+		runAt := o.Start.Add(offset)
+		vars := icalVars(o)
+
+		var f FollowUp
+		if hasJob {
+			body, _ := json.Marshal(interpolateICal(jobPayload, vars))
+			f = FollowUp{Type: jobType, Payload: body}
+		} else {
+			secret, _ := payload["webhook_secret"].(string)
+			body, _ := json.Marshal(map[string]interface{}{
+				"url":    hook,
+				"event":  "calendar.occurrence",
+				"secret": secret,
+				"data":   vars,
+			})
+			f = FollowUp{Type: "webhook_delivery", Payload: body}
+		}
+		f.RunAt = &runAt
+		f.Tags = []string{"ical", feedTag, tag}
+
+		if err := enqueueFollowUp(ctx, f); err != nil {
+			return 0, nil, err
+		}
+		created++
+	}
+
+	// Anything still pending for this feed that the calendar no longer has
+	res, err := DB.ExecContext(ctx, `
+		UPDATE jobs SET status = 'cancelled', updated_at = NOW()
+		WHERE status = 'pending'
+		  AND tags @> ARRAY[$1]
+		  AND NOT tags && $2
+		  AND run_at >= $3 AND run_at < $4
+	`, feedTag, pq.Array(current), now, now.Add(window))
+	if err != nil {
+		return 0, nil, err
+	}
+	cancelled, _ := res.RowsAffected()
+
+	jsonBytes, _ := json.Marshal(map[string]interface{}{
+		"url":         feed,
+		"events":      len(events),
+		"occurrences": len(occurrences),
+		"scheduled":   created,
+		"cancelled":   cancelled,
+	})
+	return 200, jsonBytes, nil
+}
+
+// scheduledICalTags returns the occurrence tags of jobs this feed already
+// created, due from "from" on, that have not been cancelled.
+func scheduledICalTags(ctx context.Context, feedTag string, from time.Time) (map[string]bool, error) {
+
+	rows, err := DB.QueryContext(ctx, `
+		SELECT DISTINCT t FROM jobs, unnest(tags) AS t
+		WHERE tags @> ARRAY[$1] AND status <> 'cancelled' AND run_at >= $2 AND t LIKE 'ical:%'
+	`, feedTag, from)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := map[string]bool{}
+	for rows.Next() {
+		var t string
+		if err := rows.Scan(&t); err != nil {
+			return nil, err
+		}
+		tags[t] = true
+	}
+
+	return tags, rows.Err()
+}
+
+func icalVars(o icalOccurrence) map[string]interface{} {
+	return map[string]interface{}{
+		"uid":         o.Event.UID,
+		"summary":     o.Event.Summary,
+		"description": o.Event.Description,
+		"location":    o.Event.Location,
+		"start":       o.Start.Format(time.RFC3339),
+		"end":         o.End.Format(time.RFC3339),
+		"all_day":     o.Event.AllDay,
+	}
+}
+
+// interpolateICal replaces {{event.x}} in every string of v.
+func interpolateICal(v interface{}, vars map[string]interface{}) interface{} {
+
+	switch val := v.(type) {
+	case string:
+		for k, x := range vars {
+			val = strings.ReplaceAll(val, "{{event."+k+"}}", fmt.Sprint(x))
+		}
+		return val
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(val))
+		for k, x := range val {
+			out[k] = interpolateICal(x, vars)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(val))
+		for i, x := range val {
+			out[i] = interpolateICal(x, vars)
+		}
+		return out
+	}
+
+	return v
+}
+
+func shortHash(parts ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,491 @@
+package jobs
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/image/draw"
+
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+)
+
+// image_process resizes, crops and converts an image and stores each
+// result in object storage:
+//
+//	{"source": "https://uploads.example.com/u/42/photo.jpg",
+//	 "bucket": "media",
+//	 "outputs": [
+//	   {"key": "u/42/avatar-512.jpg", "quality": 85,
+//	    "operations": [{"op": "resize", "width": 512, "height": 512}]},
+//	   {"key": "u/42/avatar-64.png", "format": "png",
+//	    "operations": [{"op": "thumbnail", "width": 64, "height": 64}]}]}
+//
+// The source is downloaded and decoded once; each output applies its
+// operations in order to its own copy:
+//
+//	resize     fits within "width" and "height", keeping the aspect ratio;
+//	           "fit": "cover" fills the box and crops the overflow, "fill"
+//	           stretches. With only one of the two, the other follows.
+//	crop       cuts "width" by "height" at "x", "y"; without them, from
+//	           the center.
+//	thumbnail  resize with "fit": "cover", never enlarging.
+//
+// "format" is jpeg, png or gif, the source's format by default (png for
+// WebP, BMP and TIFF sources, which are read but not written). JPEG
+// orientation from EXIF is applied first, so phone photos come out
+// upright. Only the first frame of an animated GIF is used.
+//
+// Outputs are stored like file_upload: "provider" and its credentials at
+// the top level, "bucket" there or per output, and an optional "acl".
+// GOFLOW_IMAGE_MAX_BYTES caps the download (default 50 MiB).
+
+const (
+	defaultImageMaxBytes = 50 << 20
+
+	// maxImagePixels refuses decompression bombs before decoding
+	maxImagePixels = 100_000_000
+
+	// maxImageSide bounds what an operation may ask for
+	maxImageSide = 16384
+)
+
+type imageOutput struct {
+	Key        string           `json:"key"`
+	Bucket     string           `json:"bucket"`
+	Format     string           `json:"format"`
+	Quality    int              `json:"quality"`
+	ACL        string           `json:"acl"`
+	Operations []imageOperation `json:"operations"`
+}
+
+type imageOperation struct {
+	Op     string `json:"op"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	X      *int   `json:"x"`
+	Y      *int   `json:"y"`
+	Fit    string `json:"fit"`
+}
+
+func executeImageProcess(ctx context.Context, payload map[string]interface{}) (int, []byte, error) {
+
+	source, ok := payload["source"].(string)
+	if !ok || source == "" {
+		return 0, nil, fmt.Errorf("missing 'source'")
+	}
+
+	var outputs []imageOutput
+	if raw, ok := payload["outputs"]; ok {
+		b, _ := json.Marshal(raw)
+		if err := json.Unmarshal(b, &outputs); err != nil {
+			return 0, nil, Permanent(fmt.Errorf("invalid 'outputs': %w", err))
+		}
+	}
+	if len(outputs) == 0 {
+		return 0, nil, fmt.Errorf("missing 'outputs'")
+	}
+
+	bucket, _ := payload["bucket"].(string)
+	acl, _ := payload["acl"].(string)
+
+	for i := range outputs {
+		o := &outputs[i]
+		o.Key = strings.TrimPrefix(o.Key, "/")
+		if o.Key == "" {
+			return 0, nil, Permanent(fmt.Errorf("output %d: missing 'key'", i))
+		}
+		if o.Bucket == "" {
+			o.Bucket = bucket
+		}
+		if o.Bucket == "" {
+			return 0, nil, Permanent(fmt.Errorf("output %d: missing 'bucket'", i))
+		}
+		if o.ACL == "" {
+			o.ACL = acl
+		}
+		switch o.Format {
+		case "", "jpeg", "png", "gif":
+		case "jpg":
+			o.Format = "jpeg"
+		default:
+			return 0, nil, Permanent(fmt.Errorf("output %d: unsupported format %q", i, o.Format))
+		}
+		if o.Quality < 0 || o.Quality > 100 {
+			return 0, nil, Permanent(fmt.Errorf("output %d: quality must be 1-100", i))
+		}
+		for j, op := range o.Operations {
+			if err := op.validate(); err != nil {
+				return 0, nil, Permanent(fmt.Errorf("output %d, operation %d: %w", i, j, err))
+			}
+		}
+	}
+
+	provider, upload, err := objectStore(payload)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	data, err := downloadImage(ctx, source)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return 0, nil, Permanent(fmt.Errorf("source is not a supported image: %w", err))
+	}
+	if cfg.Width*cfg.Height > maxImagePixels {
+		return 0, nil, Permanent(fmt.Errorf("source is %dx%d, over the %d pixel limit", cfg.Width, cfg.Height, maxImagePixels))
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return 0, nil, Permanent(fmt.Errorf("decoding source: %w", err))
+	}
+	if format == "jpeg" {
+		img = orient(img, jpegOrientation(data))
+	}
+
+	jobLog(ctx, "decoded %s %dx%d", format, img.Bounds().Dx(), img.Bounds().Dy())
+
+	results := make([]map[string]interface{}, 0, len(outputs))
+
+	for i, o := range outputs {
+		if ctx.Err() != nil {
+			return 0, nil, ctx.Err()
+		}
+
+		out := img
+		for _, op := range o.Operations {
+			out = op.apply(out)
+		}
+
+		outFormat := o.Format
+		if outFormat == "" {
+			outFormat = format
+		}
+		if outFormat != "jpeg" && outFormat != "gif" {
+			outFormat = "png"
+		}
+
+		var buf bytes.Buffer
+		if err := encodeImage(&buf, out, outFormat, o.Quality); err != nil {
+			return 0, nil, fmt.Errorf("output %d: %w", i, err)
+		}
+
+		obj := uploadObject{
+			bucket:      o.Bucket,
+			key:         o.Key,
+			contentType: "image/" + outFormat,
+			acl:         o.ACL,
+			body:        bytes.NewReader(buf.Bytes()),
+			size:        int64(buf.Len()),
+		}
+
+		jobLog(ctx, "output %d: uploading %dx%d %s, %d bytes", i, out.Bounds().Dx(), out.Bounds().Dy(), outFormat, buf.Len())
+
+		stored, err := upload(ctx, obj)
+		if err != nil {
+			return 0, nil, fmt.Errorf("output %d: %w", i, err)
+		}
+
+		stored["bucket"] = o.Bucket
+		stored["key"] = o.Key
+		stored["format"] = outFormat
+		stored["width"] = out.Bounds().Dx()
+		stored["height"] = out.Bounds().Dy()
+		stored["bytes"] = buf.Len()
+		results = append(results, stored)
+	}
+
+	result := map[string]interface{}{
+		"source":   source,
+		"provider": provider,
+		"format":   format,
+		"width":    img.Bounds().Dx(),
+		"height":   img.Bounds().Dy(),
+		"outputs":  results,
+	}
+
+	jsonBytes, _ := json.Marshal(result)
+	return 200, jsonBytes, nil
+}
+
+func downloadImage(ctx context.Context, source string) ([]byte, error) {
+
+	maxBytes := int64(defaultImageMaxBytes)
+	if v, err := strconv.ParseInt(os.Getenv("GOFLOW_IMAGE_MAX_BYTES"), 10, 64); err == nil && v > 0 {
+		maxBytes = v
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", source, nil)
+	if err != nil {
+		return nil, Permanent(err)
+	}
+
+	client := &http.Client{Timeout: 5 * time.Minute, Transport: transportFor(ctx, nil)}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return nil, ResponseError(resp, fmt.Errorf("source returned status %d", resp.StatusCode))
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxBytes {
+		return nil, Permanent(fmt.Errorf("source is over the %d byte limit", maxBytes))
+	}
+	return data, nil
+}
+
+func (op imageOperation) validate() error {
+
+	if op.Width < 0 || op.Height < 0 || op.Width > maxImageSide || op.Height > maxImageSide {
+		return fmt.Errorf("width and height must be 0-%d", maxImageSide)
+	}
+
+	switch op.Op {
+	case "resize":
+		if op.Width == 0 && op.Height == 0 {
+			return fmt.Errorf("resize needs 'width' or 'height'")
+		}
+		switch op.Fit {
+		case "", "contain", "cover", "fill":
+		default:
+			return fmt.Errorf("unknown fit %q", op.Fit)
+		}
+		if op.Fit != "" && op.Fit != "contain" && (op.Width == 0 || op.Height == 0) {
+			return fmt.Errorf("fit %q needs 'width' and 'height'", op.Fit)
+		}
+	case "crop", "thumbnail":
+		if op.Width == 0 || op.Height == 0 {
+			return fmt.Errorf("%s needs 'width' and 'height'", op.Op)
+		}
+		if (op.X != nil && *op.X < 0) || (op.Y != nil && *op.Y < 0) {
+			return fmt.Errorf("x and y cannot be negative")
+		}
+	default:
+		return fmt.Errorf("unknown op %q", op.Op)
+	}
+	return nil
+}
+
+// apply runs one operation. Sizes are clamped to the image, so a crop
+// past the edge is cut short rather than failing the job.
+func (op imageOperation) apply(img image.Image) image.Image {
+
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	switch op.Op {
+	case "resize":
+		switch op.Fit {
+		case "cover":
+			return cover(img, op.Width, op.Height)
+		case "fill":
+			return scale(img, op.Width, op.Height)
+		}
+		tw, th := op.Width, op.Height
+		switch {
+		case tw == 0:
+			tw = max(1, w*th/h)
+		case th == 0:
+			th = max(1, h*tw/w)
+		default:
+			// Contain: the smaller ratio wins
+			if w*th > h*tw {
+				th = max(1, h*tw/w)
+			} else {
+				tw = max(1, w*th/h)
+			}
+		}
+		return scale(img, tw, th)
+
+	case "thumbnail":
+		tw, th := op.Width, op.Height
+		if tw > w || th > h {
+			// Shrink the box to fit, keeping its shape
+			f := min(float64(w)/float64(tw), float64(h)/float64(th))
+			tw, th = max(1, int(float64(tw)*f)), max(1, int(float64(th)*f))
+		}
+		return cover(img, tw, th)
+
+	case "crop":
+		cw, ch := min(op.Width, w), min(op.Height, h)
+		x, y := (w-cw)/2, (h-ch)/2
+		if op.X != nil {
+			x = min(*op.X, w-cw)
+		}
+		if op.Y != nil {
+			y = min(*op.Y, h-ch)
+		}
+		return crop(img, image.Rect(x, y, x+cw, y+ch).Add(b.Min))
+	}
+
+	return img
+}
+
+// cover scales img to fill w x h and crops the overflow from the center.
+func cover(img image.Image, w, h int) image.Image {
+
+	b := img.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+
+	// The source region with the target's aspect ratio
+	cw, ch := sw, sw*h/w
+	if ch > sh {
+		cw, ch = sh*w/h, sh
+	}
+	x, y := (sw-cw)/2, (sh-ch)/2
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, image.Rect(x, y, x+cw, y+ch).Add(b.Min), draw.Src, nil)
+	return dst
+}
+
+func scale(img image.Image, w, h int) image.Image {
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, img.Bounds(), draw.Src, nil)
+	return dst
+}
+
+func crop(img image.Image, r image.Rectangle) image.Image {
+	dst := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, r.Min, draw.Src)
+	return dst
+}
+
+func encodeImage(w io.Writer, img image.Image, format string, quality int) error {
+
+	switch format {
+	case "jpeg":
+		if quality == 0 {
+			quality = 85
+		}
+		// JPEG has no alpha; transparent areas become white, not black
+		flat := image.NewRGBA(img.Bounds())
+		draw.Draw(flat, flat.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+		draw.Draw(flat, flat.Bounds(), img, img.Bounds().Min, draw.Over)
+		return jpeg.Encode(w, flat, &jpeg.Options{Quality: quality})
+	case "gif":
+		return gif.Encode(w, img, nil)
+	}
+	return png.Encode(w, img)
+}
+
+// jpegOrientation reads the EXIF orientation (1-8) of a JPEG, 1 if it
+// has none.
+func jpegOrientation(data []byte) int {
+
+	// Walk the markers up to the image data, looking for APP1 "Exif"
+	for i := 2; i+4 <= len(data) && data[i] == 0xFF; {
+		marker := data[i+1]
+		size := int(binary.BigEndian.Uint16(data[i+2:]))
+		if marker == 0xDA || size < 2 || i+2+size > len(data) {
+			break
+		}
+		seg := data[i+4 : i+2+size]
+		if marker == 0xE1 && len(seg) > 14 && string(seg[:6]) == "Exif\x00\x00" {
+			return exifOrientation(seg[6:])
+		}
+		i += 2 + size
+	}
+	return 1
+}
+
+func exifOrientation(tiff []byte) int {
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd+2 > len(tiff) {
+		return 1
+	}
+	count := int(order.Uint16(tiff[ifd:]))
+	for n := 0; n < count; n++ {
+		entry := ifd + 2 + n*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			if v := int(order.Uint16(tiff[entry+8:])); v >= 1 && v <= 8 {
+				return v
+			}
+			break
+		}
+	}
+	return 1
+}
+
+// orient turns img upright for an EXIF orientation.
+func orient(img image.Image, orientation int) image.Image {
+
+	if orientation <= 1 {
+		return img
+	}
+
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	// Orientations 5-8 swap width and height
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
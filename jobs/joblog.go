@@ -0,0 +1,29 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+// jobLog appends a line to the running job's log in job_logs, served by
+// GET /jobs/{id}/logs. Long-running executors use it to report progress.
+// Agents have no database, so there the line goes to the process log.
+func jobLog(ctx context.Context, format string, args ...interface{}) {
+
+	msg := fmt.Sprintf(format, args...)
+
+	jobID, ok := JobIDFromContext(ctx)
+	if !ok || DB == nil {
+		slog.Info(msg, "job_id", jobID)
+		return
+	}
+
+	// Logging must never fail the job, and must land even if it is cancelled
+	_, err := DB.ExecContext(context.WithoutCancel(ctx), `
+		INSERT INTO job_logs (job_id, message) VALUES ($1, $2)
+	`, jobID, msg)
+	if err != nil {
+		slog.Error(msg, "job_id", jobID, "log_write_error", err)
+	}
+}
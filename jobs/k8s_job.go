@@ -0,0 +1,334 @@
+package jobs
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	k8sServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	defaultK8sJobTimeout = 30 * time.Minute
+	k8sPollInterval      = 3 * time.Second
+)
+
+// k8sClient talks to the Kubernetes API directly over REST. In-cluster it
+// uses the pod's service account; outside a cluster set
+// ContainerSettings.K8sAPI and K8sToken.
+type k8sClient struct {
+	baseURL string
+	token   string
+	http    *http.Client
+}
+
+func newK8sClient(ctx context.Context) (*k8sClient, error) {
+
+	if api := containerSettings.K8sAPI; api != "" {
+		return &k8sClient{
+			baseURL: strings.TrimRight(api, "/"),
+			token:   containerSettings.K8sToken,
+			http:    &http.Client{Timeout: 30 * time.Second, Transport: transportFor(ctx, nil)},
+		}, nil
+	}
+
+	host := os.Getenv("KUBERNETES_SERVICE_HOST")
+	port := os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a cluster and no Kubernetes API configured")
+	}
+
+	token, err := os.ReadFile(k8sServiceAccountDir + "/token")
+	if err != nil {
+		return nil, err
+	}
+
+	caCert, err := os.ReadFile(k8sServiceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(caCert)
+
+	return &k8sClient{
+		baseURL: "https://" + host + ":" + port,
+		token:   strings.TrimSpace(string(token)),
+		http: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: transportFor(ctx, &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}),
+		},
+	}, nil
+}
+
+func (c *k8sClient) do(ctx context.Context, method, path string, body interface{}, out interface{}) (int, error) {
+
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		reader = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	respBytes, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode >= 400 {
+		return resp.StatusCode, fmt.Errorf("kubernetes API %s %s returned %d: %s", method, path, resp.StatusCode, string(respBytes))
+	}
+
+	if out != nil {
+		if s, ok := out.(*string); ok {
+			*s = string(respBytes)
+			return resp.StatusCode, nil
+		}
+		if err := json.Unmarshal(respBytes, out); err != nil {
+			return resp.StatusCode, err
+		}
+	}
+
+	return resp.StatusCode, nil
+}
+
+func defaultK8sNamespace() string {
+	if ns, err := os.ReadFile(k8sServiceAccountDir + "/namespace"); err == nil {
+		return strings.TrimSpace(string(ns))
+	}
+	return "default"
+}
+
+func stringList(v interface{}) []string {
+	raw, ok := v.([]interface{})
+	if !ok {
+		return nil
+	}
+	var out []string
+	for _, item := range raw {
+		if s, ok := item.(string); ok {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func executeK8sJob(ctx context.Context, payload map[string]interface{}) (int, []byte, error) {
+
+	if ctx.Err() == context.Canceled {
+		return 0, nil, fmt.Errorf("k8s job cancelled")
+	}
+
+	image, ok := payload["image"].(string)
+	if !ok || image == "" {
+		return 0, nil, fmt.Errorf("missing 'image'")
+	}
+
+	namespace, _ := payload["namespace"].(string)
+	if namespace == "" {
+		namespace = defaultK8sNamespace()
+	}
+
+	timeout := defaultK8sJobTimeout
+	if t, ok := payload["timeout_seconds"].(float64); ok && t > 0 {
+		timeout = time.Duration(t) * time.Second
+	}
+
+	client, err := newK8sClient(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// Retries of the same GoFlow job reuse the name, so a Job created by an
+	// earlier attempt is picked up instead of launched twice.
+	jobName := "goflow-" + strings.ToLower(NewDeliveryID()[:10])
+	if jobID, ok := JobIDFromContext(ctx); ok {
+		jobName = fmt.Sprintf("goflow-job-%d", jobID)
+	}
+
+	container := map[string]interface{}{
+		"name":  "task",
+		"image": image,
+	}
+	if cmd := stringList(payload["command"]); cmd != nil {
+		container["command"] = cmd
+	}
+	if args := stringList(payload["args"]); args != nil {
+		container["args"] = args
+	}
+	if envMap, ok := payload["env"].(map[string]interface{}); ok {
+		var env []map[string]string
+		for k, v := range envMap {
+			env = append(env, map[string]string{"name": k, "value": fmt.Sprint(v)})
+		}
+		container["env"] = env
+	}
+	if resources, ok := payload["resources"].(map[string]interface{}); ok {
+		container["resources"] = resources
+	}
+
+	backoffLimit := 0
+	if b, ok := payload["backoff_limit"].(float64); ok {
+		backoffLimit = int(b)
+	}
+
+	manifest := map[string]interface{}{
+		"apiVersion": "batch/v1",
+		"kind":       "Job",
+		"metadata": map[string]interface{}{
+			"name":   jobName,
+			"labels": map[string]string{"app.kubernetes.io/managed-by": "goflow"},
+		},
+		"spec": map[string]interface{}{
+			"backoffLimit":            backoffLimit,
+			"ttlSecondsAfterFinished": 3600,
+			"template": map[string]interface{}{
+				"spec": map[string]interface{}{
+					"restartPolicy": "Never",
+					"containers":    []interface{}{container},
+				},
+			},
+		},
+	}
+
+	jobsPath := "/apis/batch/v1/namespaces/" + namespace + "/jobs"
+
+	status, err := client.do(ctx, "POST", jobsPath, manifest, nil)
+	if err != nil && status != http.StatusConflict {
+		return status, nil, err
+	}
+
+	runCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	succeeded, err := waitForK8sJob(runCtx, client, jobsPath+"/"+jobName)
+	if err != nil {
+		// Don't leave an orphaned Job running after we give up on it
+		client.do(context.Background(), "DELETE", jobsPath+"/"+jobName+"?propagationPolicy=Background", nil, nil)
+
+		if ctx.Err() == context.Canceled {
+			return 0, nil, fmt.Errorf("k8s job cancelled")
+		}
+		if runCtx.Err() == context.DeadlineExceeded {
+			return 0, nil, fmt.Errorf("k8s job %s timed out after %v", jobName, timeout)
+		}
+		return 0, nil, err
+	}
+
+	exitCode, logs := k8sJobOutput(ctx, client, namespace, jobName)
+
+	result := map[string]interface{}{
+		"job_name":  jobName,
+		"namespace": namespace,
+		"succeeded": succeeded,
+		"exit_code": exitCode,
+		"logs":      logs,
+	}
+
+	jsonBytes, _ := json.Marshal(result)
+
+	if !succeeded {
+		return 500, jsonBytes, fmt.Errorf("k8s job %s failed with exit code %d", jobName, exitCode)
+	}
+
+	return 200, jsonBytes, nil
+}
+
+func waitForK8sJob(ctx context.Context, client *k8sClient, path string) (bool, error) {
+
+	ticker := time.NewTicker(k8sPollInterval)
+	defer ticker.Stop()
+
+	for {
+		var job struct {
+			Status struct {
+				Succeeded int `json:"succeeded"`
+				Failed    int `json:"failed"`
+				Active    int `json:"active"`
+			} `json:"status"`
+			Spec struct {
+				BackoffLimit int `json:"backoffLimit"`
+			} `json:"spec"`
+		}
+
+		if _, err := client.do(ctx, "GET", path, nil, &job); err != nil {
+			return false, err
+		}
+
+		if job.Status.Succeeded > 0 {
+			return true, nil
+		}
+
+		if job.Status.Failed > job.Spec.BackoffLimit {
+			return false, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// k8sJobOutput returns the exit code and log tail of the Job's latest pod.
+func k8sJobOutput(ctx context.Context, client *k8sClient, namespace, jobName string) (int, string) {
+
+	var pods struct {
+		Items []struct {
+			Metadata struct {
+				Name string `json:"name"`
+			} `json:"metadata"`
+			Status struct {
+				ContainerStatuses []struct {
+					State struct {
+						Terminated *struct {
+							ExitCode int `json:"exitCode"`
+						} `json:"terminated"`
+					} `json:"state"`
+				} `json:"containerStatuses"`
+			} `json:"status"`
+		} `json:"items"`
+	}
+
+	selector := url.QueryEscape("job-name=" + jobName)
+	_, err := client.do(ctx, "GET", "/api/v1/namespaces/"+namespace+"/pods?labelSelector="+selector, nil, &pods)
+	if err != nil || len(pods.Items) == 0 {
+		return -1, ""
+	}
+
+	pod := pods.Items[len(pods.Items)-1]
+
+	exitCode := -1
+	if cs := pod.Status.ContainerStatuses; len(cs) > 0 && cs[0].State.Terminated != nil {
+		exitCode = cs[0].State.Terminated.ExitCode
+	}
+
+	var logs string
+	client.do(ctx, "GET", "/api/v1/namespaces/"+namespace+"/pods/"+pod.Metadata.Name+"/log?tailLines=200", nil, &logs)
+
+	return exitCode, logs
+}
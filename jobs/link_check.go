@@ -0,0 +1,219 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// link_check crawls a site like generate_sitemap and verifies every link
+// it finds, on the site or off it:
+//
+//	{"url": "https://example.com", "max_depth": 2, "max_pages": 200,
+//	 "check_external": true, "email": "web-team@example.com"}
+//
+// The report lists each broken link with its status or error and the
+// pages that link to it. It is the job's response, so callback_url
+// delivers it like any other result; "email" additionally mails a summary
+// when something is broken.
+
+const (
+	maxCheckedLinks  = 2000
+	linkCheckWorkers = 8
+)
+
+type brokenLink struct {
+	URL       string   `json:"url"`
+	Status    int      `json:"status,omitempty"`
+	Error     string   `json:"error,omitempty"`
+	Referrers []string `json:"referrers"`
+}
+
+func executeLinkCheck(ctx context.Context, payload map[string]interface{}) (int, []byte, error) {
+
+	start, ok := payload["url"].(string)
+	if !ok || start == "" {
+		return 0, nil, fmt.Errorf("missing 'url'")
+	}
+
+	maxDepth := 2
+	if d, ok := payload["max_depth"].(float64); ok && d >= 0 {
+		maxDepth = int(d)
+	}
+
+	maxPages := 200
+	if p, ok := payload["max_pages"].(float64); ok && p >= 1 {
+		maxPages = int(p)
+	}
+
+	checkExternal := true
+	if c, ok := payload["check_external"].(bool); ok {
+		checkExternal = c
+	}
+
+	client := &http.Client{Timeout: 15 * time.Second, Transport: transportFor(ctx, nil)}
+
+	pages, err := crawlSite(ctx, client, start, maxDepth, maxPages)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	root, _ := url.Parse(start)
+
+	// Outcome of every URL, starting with the pages the crawl fetched
+	type outcome struct {
+		status int
+		err    string
+	}
+	outcomes := map[string]outcome{}
+	for _, p := range pages {
+		o := outcome{status: p.Status}
+		if p.Err != nil {
+			o.err = p.Err.Error()
+		}
+		outcomes[p.URL] = o
+	}
+
+	referrers := map[string][]string{}
+	var toCheck []string
+
+	for _, p := range pages {
+		for _, link := range p.Links {
+			if _, known := outcomes[link]; !known && len(referrers[link]) == 0 {
+				u, _ := url.Parse(link)
+				if u.Host == root.Host || checkExternal {
+					toCheck = append(toCheck, link)
+				}
+			}
+			referrers[link] = append(referrers[link], p.URL)
+		}
+	}
+
+	truncated := len(toCheck) > maxCheckedLinks
+	if truncated {
+		toCheck = toCheck[:maxCheckedLinks]
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	links := make(chan string)
+
+	for i := 0; i < linkCheckWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for link := range links {
+				status, err := checkLink(ctx, client, link)
+				o := outcome{status: status}
+				if err != nil {
+					o.err = err.Error()
+				}
+				mu.Lock()
+				outcomes[link] = o
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, link := range toCheck {
+		if ctx.Err() != nil {
+			break
+		}
+		links <- link
+	}
+	close(links)
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return 0, nil, ctx.Err()
+	}
+
+	broken := []brokenLink{}
+	for link, o := range outcomes {
+		if o.err == "" && o.status < 400 {
+			continue
+		}
+		refs := referrers[link]
+		if refs == nil {
+			refs = []string{}
+		}
+		broken = append(broken, brokenLink{URL: link, Status: o.status, Error: o.err, Referrers: refs})
+	}
+	sort.Slice(broken, func(i, j int) bool { return broken[i].URL < broken[j].URL })
+
+	report := map[string]interface{}{
+		"url":           start,
+		"pages_crawled": len(pages),
+		"links_checked": len(outcomes),
+		"broken_count":  len(broken),
+		"broken":        broken,
+		"truncated":     truncated,
+	}
+
+	if to, ok := payload["email"].(string); ok && to != "" && len(broken) > 0 {
+		email, _ := json.Marshal(map[string]interface{}{
+			"to":              to,
+			"subject":         fmt.Sprintf("Link check: %d broken links on %s", len(broken), root.Host),
+			"body":            linkReportText(start, len(pages), broken),
+			"idempotency_key": deliveryIDFor(ctx, "link-check-email"),
+		})
+		if err := enqueueFollowUp(ctx, FollowUp{Type: "send_email", Payload: email}); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	jsonBytes, _ := json.Marshal(report)
+	return 200, jsonBytes, nil
+}
+
+// checkLink asks for headers only, falling back to GET for servers that
+// do not implement HEAD.
+func checkLink(ctx context.Context, client *http.Client, link string) (int, error) {
+
+	for _, method := range []string{"HEAD", "GET"} {
+		req, err := http.NewRequestWithContext(ctx, method, link, nil)
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("User-Agent", "GoFlow link checker")
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+
+		if method == "HEAD" && (resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented) {
+			continue
+		}
+		return resp.StatusCode, nil
+	}
+
+	return 0, nil
+}
+
+func linkReportText(start string, pages int, broken []brokenLink) string {
+
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "Checked %d pages from %s and found %d broken links.\n\n", pages, start, len(broken))
+
+	for _, l := range broken {
+		problem := l.Error
+		if problem == "" {
+			problem = fmt.Sprintf("HTTP %d", l.Status)
+		}
+		fmt.Fprintf(&b, "%s (%s)\n", l.URL, problem)
+		for _, ref := range l.Referrers {
+			fmt.Fprintf(&b, "    linked from %s\n", ref)
+		}
+	}
+
+	return b.String()
+}
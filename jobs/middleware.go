@@ -0,0 +1,124 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"sync"
+)
+
+// Handler executes a job of any type. It is what middleware wraps.
+type Handler func(ctx context.Context, jobType string, payload map[string]interface{}) (int, []byte, error)
+
+// Middleware wraps a Handler to add behaviour around every execution —
+// metrics, payload redaction, credential injection, rate limiting — without
+// touching individual executors.
+type Middleware func(next Handler) Handler
+
+var (
+	middlewareMu sync.RWMutex
+	middlewares  []Middleware
+	chain        Handler = execute
+)
+
+// Use appends middleware to the chain. The first middleware registered is
+// the outermost one, so it sees the job first and the result last.
+func Use(mw ...Middleware) {
+	middlewareMu.Lock()
+	defer middlewareMu.Unlock()
+
+	middlewares = append(middlewares, mw...)
+
+	h := Handler(execute)
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	chain = h
+}
+
+func currentChain() Handler {
+	middlewareMu.RLock()
+	defer middlewareMu.RUnlock()
+	return chain
+}
+
+// Recover turns a panicking executor into a failed execution instead of
+// taking the whole worker down.
+func Recover() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, jobType string, payload map[string]interface{}) (status int, body []byte, err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					slog.Error("Executor panicked", "job_type", jobType, "panic", fmt.Sprint(r), "stack", string(debug.Stack()))
+					status, body, err = 0, nil, fmt.Errorf("executor panic: %v", r)
+				}
+			}()
+			return next(ctx, jobType, payload)
+		}
+	}
+}
+
+// Chain composes middleware into one, the first outermost, as Use does.
+func Chain(mw ...Middleware) Middleware {
+	return func(next Handler) Handler {
+		for i := len(mw) - 1; i >= 0; i-- {
+			next = mw[i](next)
+		}
+		return next
+	}
+}
+
+// Hooks run code around every execution without writing a Middleware.
+// Before runs first and its error fails the attempt without running the
+// executor; After sees each success and OnError each failure. Nil hooks
+// are skipped. JobIDFromContext and TenantFromContext identify the job.
+type Hooks struct {
+	Before  func(ctx context.Context, jobType string, payload map[string]interface{}) error
+	After   func(ctx context.Context, jobType string, status int, body []byte)
+	OnError func(ctx context.Context, jobType string, err error)
+}
+
+// Middleware turns the hooks into a Middleware for Use or Chain.
+func (h Hooks) Middleware() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, jobType string, payload map[string]interface{}) (int, []byte, error) {
+
+			if h.Before != nil {
+				if err := h.Before(ctx, jobType, payload); err != nil {
+					if h.OnError != nil {
+						h.OnError(ctx, jobType, err)
+					}
+					return 0, nil, err
+				}
+			}
+
+			status, body, err := next(ctx, jobType, payload)
+
+			switch {
+			case err != nil && h.OnError != nil:
+				h.OnError(ctx, jobType, err)
+			case err == nil && h.After != nil:
+				h.After(ctx, jobType, status, body)
+			}
+			return status, body, err
+		}
+	}
+}
+
+// builtinMiddleware is the middleware the server's executor_middleware
+// setting can name.
+var builtinMiddleware = map[string]func() Middleware{
+	"recover": Recover,
+	"secrets": InjectSecrets,
+	"outputs": InterpolateOutputs,
+}
+
+// NamedMiddleware returns the built-in middleware called name.
+func NamedMiddleware(name string) (Middleware, bool) {
+	mw, ok := builtinMiddleware[name]
+	if !ok {
+		return nil, false
+	}
+	return mw(), true
+}
@@ -0,0 +1,232 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Payload strings can refer to the output of jobs that ran before:
+//
+//	{{job.1234.response.choices[0].message.content}}   any completed job of the tenant
+//	{{parent.response.results[0]}}                     the job a hook or condition follows
+//
+// Placeholders are filled in just before the executor runs, on its copy of
+// the payload, so the stored job keeps them and a retry sees fresh values.
+// A string that is a single placeholder takes the referenced value with
+// its JSON type; inside longer text the value is written out as text.
+// Other {{...}} text, such as workflow step references, is left alone.
+
+var outputPlaceholder = regexp.MustCompile(`\{\{\s*((?:job\.\d+|parent)(?:\.[^}\s]+)?)\s*\}\}`)
+
+// ResolveOutputs returns a copy of payload with every job and parent
+// placeholder replaced by the value it refers to. Template fields are left
+// for the jobs they become.
+func ResolveOutputs(ctx context.Context, tenant string, payload map[string]interface{}) (map[string]interface{}, error) {
+
+	r := &outputResolver{ctx: ctx, tenant: tenant, parent: payload["parent"], jobs: map[int]interface{}{}}
+
+	out := make(map[string]interface{}, len(payload))
+	for k, v := range payload {
+		if templateFields[k] || k == "parent" {
+			out[k] = v
+			continue
+		}
+		resolved, err := r.value(v)
+		if err != nil {
+			return nil, fmt.Errorf("'%s': %w", k, err)
+		}
+		out[k] = resolved
+	}
+	return out, nil
+}
+
+type outputResolver struct {
+	ctx    context.Context
+	tenant string
+	parent interface{}
+
+	// jobs caches loaded responses by job id
+	jobs map[int]interface{}
+}
+
+func (r *outputResolver) value(v interface{}) (interface{}, error) {
+
+	switch v := v.(type) {
+	case string:
+		return r.string(v)
+
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			resolved, err := r.value(item)
+			if err != nil {
+				return nil, err
+			}
+			out[k] = resolved
+		}
+		return out, nil
+
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			resolved, err := r.value(item)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = resolved
+		}
+		return out, nil
+	}
+
+	return v, nil
+}
+
+func (r *outputResolver) string(s string) (interface{}, error) {
+
+	if !strings.Contains(s, "{{") {
+		return s, nil
+	}
+
+	matches := outputPlaceholder.FindAllStringSubmatchIndex(s, -1)
+	if len(matches) == 0 {
+		return s, nil
+	}
+
+	// The whole string is one placeholder: keep the value's type
+	if len(matches) == 1 && matches[0][0] == 0 && matches[0][1] == len(s) {
+		return r.lookup(s[matches[0][2]:matches[0][3]])
+	}
+
+	var b strings.Builder
+	last := 0
+	for _, m := range matches {
+		v, err := r.lookup(s[m[2]:m[3]])
+		if err != nil {
+			return nil, err
+		}
+		b.WriteString(s[last:m[0]])
+		b.WriteString(outputText(v))
+		last = m[1]
+	}
+	b.WriteString(s[last:])
+
+	return b.String(), nil
+}
+
+// lookup resolves "job.1234.response.x" or "parent.response.x".
+func (r *outputResolver) lookup(ref string) (interface{}, error) {
+
+	var root interface{}
+	var path string
+
+	if rest, ok := strings.CutPrefix(ref, "parent"); ok {
+		if r.parent == nil {
+			return nil, fmt.Errorf("{{%s}}: this job has no parent", ref)
+		}
+		root, path = r.parent, rest
+	} else {
+		rest := strings.TrimPrefix(ref, "job.")
+		idStr, after, _ := strings.Cut(rest, ".")
+		id, err := strconv.Atoi(idStr)
+		if err != nil {
+			return nil, fmt.Errorf("{{%s}}: invalid job id", ref)
+		}
+		job, err := r.job(id)
+		if err != nil {
+			return nil, fmt.Errorf("{{%s}}: %w", ref, err)
+		}
+		root, path = job, after
+	}
+
+	v, ok := lookupJSONPath(root, path)
+	if !ok {
+		return nil, fmt.Errorf("{{%s}}: no value at that path", ref)
+	}
+	return v, nil
+}
+
+// job loads a completed job of the tenant as {"id", "type", "status",
+// "response"}.
+func (r *outputResolver) job(id int) (interface{}, error) {
+
+	if job, ok := r.jobs[id]; ok {
+		return job, nil
+	}
+
+	if DB == nil {
+		return nil, errors.New("job references need the database")
+	}
+
+	tenant := r.tenant
+	if tenant == "" {
+		tenant = "default"
+	}
+
+	var jobType, status string
+	var body []byte
+
+	err := DB.QueryRowContext(r.ctx, `
+		SELECT type, status, response_body
+		FROM jobs
+		WHERE id = $1 AND tenant_id = $2
+	`, id, tenant).Scan(&jobType, &status, &body)
+
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("job %d not found", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Not finished yet: the retry may find it completed
+	if status != "completed" {
+		return nil, fmt.Errorf("job %d is %s, not completed", id, status)
+	}
+
+	var response interface{}
+	if len(body) > 0 {
+		json.Unmarshal(body, &response)
+	}
+
+	job := map[string]interface{}{
+		"id":       float64(id),
+		"type":     jobType,
+		"status":   status,
+		"response": response,
+	}
+	r.jobs[id] = job
+	return job, nil
+}
+
+// outputText writes a referenced value into surrounding text.
+func outputText(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case nil:
+		return ""
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// InterpolateOutputs fills in job and parent placeholders before the job
+// runs. It belongs after InjectSecrets, so a secret reference that comes
+// back in another job's output is never resolved.
+func InterpolateOutputs() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, jobType string, payload map[string]interface{}) (int, []byte, error) {
+			resolved, err := ResolveOutputs(ctx, TenantFromContext(ctx), payload)
+			if err != nil {
+				return 0, nil, err
+			}
+			return next(ctx, jobType, resolved)
+		}
+	}
+}
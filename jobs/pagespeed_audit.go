@@ -0,0 +1,226 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// pagespeed_audit runs Google PageSpeed Insights (Lighthouse) for a URL
+// and keeps every run in pagespeed_results:
+//
+//	{"url": "https://example.com", "strategy": "mobile",
+//	 "categories": ["performance", "accessibility"], "threshold": 10,
+//	 "webhook_url": "https://hooks.example.com/perf"}
+//
+// Scores are 0-100. When a category drops "threshold" points or more
+// below the average of the previous five runs (same URL and strategy), a
+// "pagespeed.regression" webhook is enqueued. The API key comes from
+// "api_key" or GOFLOW_PAGESPEED_KEY; without one Google's low anonymous
+// quota applies.
+
+const pagespeedBaselineRuns = 5
+
+// pagespeedMetrics are the Lighthouse audits recorded alongside scores.
+var pagespeedMetrics = []string{
+	"first-contentful-paint",
+	"largest-contentful-paint",
+	"total-blocking-time",
+	"cumulative-layout-shift",
+	"speed-index",
+}
+
+type pagespeedRegression struct {
+	Category string  `json:"category"`
+	Score    float64 `json:"score"`
+	Baseline float64 `json:"baseline"`
+	Drop     float64 `json:"drop"`
+}
+
+func executePagespeedAudit(ctx context.Context, payload map[string]interface{}) (int, []byte, error) {
+
+	target, ok := payload["url"].(string)
+	if !ok || target == "" {
+		return 0, nil, fmt.Errorf("missing 'url'")
+	}
+
+	strategy := "mobile"
+	if s, ok := payload["strategy"].(string); ok && s != "" {
+		strategy = s
+	}
+	if strategy != "mobile" && strategy != "desktop" {
+		return 0, nil, fmt.Errorf("strategy must be mobile or desktop")
+	}
+
+	categories := stringList(payload["categories"])
+	if len(categories) == 0 {
+		categories = []string{"performance"}
+	}
+
+	threshold := 10.0
+	if t, ok := payload["threshold"].(float64); ok && t > 0 {
+		threshold = t
+	}
+
+	apiKey, _ := payload["api_key"].(string)
+	if apiKey == "" {
+		apiKey = os.Getenv("GOFLOW_PAGESPEED_KEY")
+	}
+
+	q := url.Values{}
+	q.Set("url", target)
+	q.Set("strategy", strategy)
+	for _, c := range categories {
+		q.Add("category", c)
+	}
+	if apiKey != "" {
+		q.Set("key", apiKey)
+	}
+
+	// A Lighthouse run routinely takes 20-40 seconds
+	client := &http.Client{Timeout: 2 * time.Minute, Transport: transportFor(ctx, nil)}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", "https://www.googleapis.com/pagespeedonline/v5/runPagespeed?"+q.Encode(), nil)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return 0, nil, fmt.Errorf("pagespeed returned status %d", resp.StatusCode)
+	}
+
+	var body struct {
+		LighthouseResult struct {
+			Categories map[string]struct {
+				Score *float64 `json:"score"`
+			} `json:"categories"`
+			Audits map[string]struct {
+				NumericValue *float64 `json:"numericValue"`
+			} `json:"audits"`
+		} `json:"lighthouseResult"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return 0, nil, err
+	}
+
+	scores := map[string]float64{}
+	for name, c := range body.LighthouseResult.Categories {
+		if c.Score != nil {
+			scores[name] = math.Round(*c.Score * 100)
+		}
+	}
+
+	metrics := map[string]float64{}
+	for _, name := range pagespeedMetrics {
+		if a, ok := body.LighthouseResult.Audits[name]; ok && a.NumericValue != nil {
+			metrics[name] = *a.NumericValue
+		}
+	}
+
+	regressions, err := recordPagespeed(ctx, target, strategy, scores, metrics, threshold)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	result := map[string]interface{}{
+		"url":         target,
+		"strategy":    strategy,
+		"scores":      scores,
+		"metrics":     metrics,
+		"regressions": regressions,
+	}
+
+	if hook, ok := payload["webhook_url"].(string); ok && hook != "" && len(regressions) > 0 {
+		secret, _ := payload["webhook_secret"].(string)
+
+		hookPayload, _ := json.Marshal(map[string]interface{}{
+			"url":    hook,
+			"event":  "pagespeed.regression",
+			"secret": secret,
+			"data":   result,
+		})
+
+		if err := enqueueFollowUp(ctx, FollowUp{Type: "webhook_delivery", Payload: hookPayload}); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	jsonBytes, _ := json.Marshal(result)
+	return 200, jsonBytes, nil
+}
+
+// recordPagespeed compares scores with the recent baseline, then stores
+// the run. Regressions are computed before the insert so a run never
+// counts towards its own baseline.
+func recordPagespeed(ctx context.Context, target, strategy string, scores, metrics map[string]float64, threshold float64) ([]pagespeedRegression, error) {
+
+	regressions := []pagespeedRegression{}
+
+	rows, err := DB.QueryContext(ctx, `
+		SELECT scores FROM pagespeed_results
+		WHERE url = $1 AND strategy = $2
+		ORDER BY fetched_at DESC
+		LIMIT $3
+	`, target, strategy, pagespeedBaselineRuns)
+	if err != nil {
+		return nil, err
+	}
+
+	sums := map[string]float64{}
+	counts := map[string]int{}
+
+	for rows.Next() {
+		var raw []byte
+		if err := rows.Scan(&raw); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		var past map[string]float64
+		json.Unmarshal(raw, &past)
+		for name, score := range past {
+			sums[name] += score
+			counts[name]++
+		}
+	}
+	rows.Close()
+
+	for name, score := range scores {
+		if counts[name] == 0 {
+			continue
+		}
+		baseline := math.Round(sums[name]/float64(counts[name])*10) / 10
+		if drop := baseline - score; drop >= threshold {
+			regressions = append(regressions, pagespeedRegression{
+				Category: name,
+				Score:    score,
+				Baseline: baseline,
+				Drop:     math.Round(drop*10) / 10,
+			})
+		}
+	}
+
+	scoresJSON, _ := json.Marshal(scores)
+	metricsJSON, _ := json.Marshal(metrics)
+
+	_, err = DB.ExecContext(ctx, `
+		INSERT INTO pagespeed_results (url, strategy, scores, metrics)
+		VALUES ($1, $2, $3, $4)
+	`, target, strategy, scoresJSON, metricsJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	return regressions, nil
+}
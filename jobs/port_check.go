@@ -0,0 +1,227 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// port_check tests reachability of a host:
+//
+//	{"host": "db.internal", "port": 5432, "attempts": 3, "timeout_ms": 2000, "icmp": true}
+//
+// Every attempt is a fresh TCP connect; with "icmp" each attempt also
+// sends an echo request. ICMP uses unprivileged ping sockets where the
+// kernel allows them (net.ipv4.ping_group_range on Linux) and raw
+// sockets otherwise. Per-attempt latency is reported either way; an
+// unreachable host is a result, not a job failure.
+
+type reachAttempt struct {
+	Attempt   int     `json:"attempt"`
+	OK        bool    `json:"ok"`
+	LatencyMs float64 `json:"latency_ms,omitempty"`
+	Error     string  `json:"error,omitempty"`
+}
+
+type reachSummary struct {
+	Reachable    bool           `json:"reachable"`
+	Successes    int            `json:"successes"`
+	AvgLatencyMs float64        `json:"avg_latency_ms,omitempty"`
+	Attempts     []reachAttempt `json:"attempts"`
+}
+
+func executePortCheck(ctx context.Context, payload map[string]interface{}) (int, []byte, error) {
+
+	host, ok := payload["host"].(string)
+	if !ok || host == "" {
+		return 0, nil, fmt.Errorf("missing 'host'")
+	}
+
+	port, _ := payload["port"].(float64)
+	useICMP, _ := payload["icmp"].(bool)
+
+	if port <= 0 && !useICMP {
+		return 0, nil, fmt.Errorf("missing 'port' (or set 'icmp': true)")
+	}
+	if port > 65535 {
+		return 0, nil, fmt.Errorf("invalid port %v", port)
+	}
+
+	attempts := 3
+	if a, ok := payload["attempts"].(float64); ok && a >= 1 {
+		attempts = min(int(a), 20)
+	}
+
+	timeout := 2 * time.Second
+	if t, ok := payload["timeout_ms"].(float64); ok && t > 0 {
+		timeout = time.Duration(t) * time.Millisecond
+	}
+
+	result := map[string]interface{}{"host": host}
+
+	if port > 0 {
+		address := net.JoinHostPort(host, strconv.Itoa(int(port)))
+		result["port"] = int(port)
+		result["tcp"] = runReachability(ctx, attempts, func(ctx context.Context) error {
+			d := net.Dialer{Timeout: timeout}
+			conn, err := d.DialContext(ctx, "tcp", address)
+			if err != nil {
+				return err
+			}
+			return conn.Close()
+		})
+	}
+
+	if useICMP {
+		ip, err := resolveOne(ctx, host)
+		if err != nil {
+			result["icmp"] = reachSummary{Attempts: []reachAttempt{{Attempt: 1, Error: err.Error()}}}
+		} else {
+			result["ip"] = ip.String()
+			result["icmp"] = runReachability(ctx, attempts, func(ctx context.Context) error {
+				return pingOnce(ctx, ip, timeout)
+			})
+		}
+	}
+
+	if ctx.Err() != nil {
+		return 0, nil, ctx.Err()
+	}
+
+	jsonBytes, _ := json.Marshal(result)
+	return 200, jsonBytes, nil
+}
+
+func runReachability(ctx context.Context, attempts int, probe func(ctx context.Context) error) reachSummary {
+
+	summary := reachSummary{Attempts: []reachAttempt{}}
+	var total float64
+
+	for i := 1; i <= attempts && ctx.Err() == nil; i++ {
+		start := time.Now()
+		err := probe(ctx)
+		latency := float64(time.Since(start).Microseconds()) / 1000
+
+		a := reachAttempt{Attempt: i, OK: err == nil}
+		if err != nil {
+			a.Error = err.Error()
+		} else {
+			a.LatencyMs = latency
+			summary.Successes++
+			total += latency
+		}
+		summary.Attempts = append(summary.Attempts, a)
+	}
+
+	summary.Reachable = summary.Successes > 0
+	if summary.Successes > 0 {
+		summary.AvgLatencyMs = total / float64(summary.Successes)
+	}
+
+	return summary
+}
+
+func resolveOne(ctx context.Context, host string) (net.IP, error) {
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			return ip, nil
+		}
+	}
+	return ips[0], nil
+}
+
+// pingOnce sends one ICMP echo request and waits for the matching reply.
+func pingOnce(ctx context.Context, ip net.IP, timeout time.Duration) error {
+
+	v4 := ip.To4() != nil
+
+	network, proto := "udp6", 58
+	var echoType icmp.Type = ipv6.ICMPTypeEchoRequest
+	if v4 {
+		network, proto = "udp4", 1
+		echoType = ipv4.ICMPTypeEcho
+	}
+
+	privileged := false
+	conn, err := icmp.ListenPacket(network, "")
+	if err != nil {
+		// No unprivileged ping sockets; raw sockets need CAP_NET_RAW
+		raw := "ip6:ipv6-icmp"
+		if v4 {
+			raw = "ip4:icmp"
+		}
+		conn, err = icmp.ListenPacket(raw, "")
+		if err != nil {
+			return fmt.Errorf("icmp unavailable: %w", err)
+		}
+		privileged = true
+	}
+	defer conn.Close()
+
+	id := os.Getpid() & 0xffff
+	seq := rand.Intn(0xffff)
+
+	msg := icmp.Message{
+		Type: echoType,
+		Body: &icmp.Echo{ID: id, Seq: seq, Data: []byte("goflow")},
+	}
+	wire, err := msg.Marshal(nil)
+	if err != nil {
+		return err
+	}
+
+	var dst net.Addr = &net.UDPAddr{IP: ip}
+	if privileged {
+		dst = &net.IPAddr{IP: ip}
+	}
+
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+
+	if _, err := conn.WriteTo(wire, dst); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+
+		reply, err := icmp.ParseMessage(proto, buf[:n])
+		if err != nil {
+			continue
+		}
+
+		echo, ok := reply.Body.(*icmp.Echo)
+		if !ok || echo.Seq != seq {
+			continue
+		}
+		// Ping sockets rewrite the ID, so only raw sockets can check it
+		if privileged && echo.ID != id {
+			continue
+		}
+
+		switch reply.Type {
+		case ipv4.ICMPTypeEchoReply, ipv6.ICMPTypeEchoReply:
+			return nil
+		}
+	}
+}
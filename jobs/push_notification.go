@@ -0,0 +1,505 @@
+package jobs
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// push_notification sends a notification to device tokens:
+//
+//	{"provider": "fcm", "tokens": ["dT9x...", "eK2m..."],
+//	 "title": "Order shipped", "body": "Arriving Tuesday",
+//	 "data": {"order_id": "8812"}, "idempotency_key": "ship-8812"}
+//
+// "token" takes a single device. The provider is "provider" or
+// GOFLOW_PUSH_PROVIDER: "fcm" (the default; Firebase Cloud Messaging HTTP
+// v1, authenticated with the service account JSON in "credentials" or
+// GOFLOW_FCM_CREDENTIALS, inline or a file path) or "apns" (token auth
+// with the .p8 key in "private_key" or GOFLOW_APNS_KEY, "key_id" or
+// GOFLOW_APNS_KEY_ID, "team_id" or GOFLOW_APNS_TEAM_ID, sent for the app
+// "topic" or GOFLOW_APNS_TOPIC; "sandbox" uses the development server).
+//
+// Each token is sent on its own and reported on its own. Tokens the
+// provider says are unregistered or malformed are listed in
+// "invalid_tokens" for the caller to prune; they do not fail the job.
+// The job fails only for a bad request or bad credentials, which no token
+// can succeed with, or when nothing was sent and a retry could help.
+
+const (
+	// maxPushTokens matches the old FCM multicast limit
+	maxPushTokens = 500
+	pushWorkers   = 10
+)
+
+type pushMessage struct {
+	title   string
+	body    string
+	data    map[string]interface{}
+	badge   *int
+	sound   string
+	topic   string
+	sandbox bool
+}
+
+// pushResult is the outcome for one token.
+type pushResult struct {
+	Token        string `json:"token"`
+	OK           bool   `json:"ok"`
+	MessageID    string `json:"message_id,omitempty"`
+	Error        string `json:"error,omitempty"`
+	InvalidToken bool   `json:"invalid_token,omitempty"`
+	Retryable    bool   `json:"retryable,omitempty"`
+}
+
+// pushSender sends to one token. An error fails the whole job: the
+// request or the credentials are wrong, whatever the token.
+type pushSender func(ctx context.Context, token string) (pushResult, error)
+
+func executePushNotification(ctx context.Context, payload map[string]interface{}) (int, []byte, error) {
+
+	var tokens []string
+	for _, t := range stringList(payload["tokens"]) {
+		if t != "" {
+			tokens = append(tokens, t)
+		}
+	}
+	if t, ok := payload["token"].(string); ok && t != "" {
+		tokens = []string{t}
+	}
+	if len(tokens) == 0 {
+		return 0, nil, fmt.Errorf("missing 'token' or 'tokens'")
+	}
+	if len(tokens) > maxPushTokens {
+		return 0, nil, Permanent(fmt.Errorf("%d tokens; at most %d per job", len(tokens), maxPushTokens))
+	}
+
+	msg := pushMessage{}
+	msg.title, _ = payload["title"].(string)
+	msg.body, _ = payload["body"].(string)
+	msg.data, _ = payload["data"].(map[string]interface{})
+	msg.sound, _ = payload["sound"].(string)
+	msg.sandbox, _ = payload["sandbox"].(bool)
+	if b, ok := payload["badge"].(float64); ok {
+		badge := int(b)
+		msg.badge = &badge
+	}
+	if msg.title == "" && msg.body == "" && len(msg.data) == 0 {
+		return 0, nil, fmt.Errorf("missing 'title', 'body' or 'data'")
+	}
+
+	provider, _ := payload["provider"].(string)
+	if provider == "" {
+		provider = os.Getenv("GOFLOW_PUSH_PROVIDER")
+	}
+	if provider == "" {
+		provider = "fcm"
+	}
+
+	var send pushSender
+
+	switch provider {
+	case "fcm":
+		raw, err := keyMaterial(payload, "credentials", "GOFLOW_FCM_CREDENTIALS")
+		if err != nil {
+			return 0, nil, Permanent(err)
+		}
+		creds, err := googleCredentials("fcm", raw)
+		if err != nil {
+			return 0, nil, Permanent(err)
+		}
+		if creds.ProjectID == "" {
+			return 0, nil, Permanent(fmt.Errorf("fcm credentials need project_id"))
+		}
+		send = func(ctx context.Context, token string) (pushResult, error) {
+			return sendFCM(ctx, creds, token, msg)
+		}
+	case "apns":
+		key, err := apnsCredentials(payload)
+		if err != nil {
+			return 0, nil, Permanent(err)
+		}
+		msg.topic = payloadOrEnv(payload, "topic", "GOFLOW_APNS_TOPIC")
+		if msg.topic == "" {
+			return 0, nil, Permanent(fmt.Errorf("missing 'topic' and GOFLOW_APNS_TOPIC is not set"))
+		}
+		send = func(ctx context.Context, token string) (pushResult, error) {
+			return sendAPNs(ctx, key, token, msg)
+		}
+	default:
+		return 0, nil, Permanent(fmt.Errorf("unsupported provider: %s", provider))
+	}
+
+	results := make([]pushResult, len(tokens))
+	var fatal error
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	indexes := make(chan int)
+
+	for i := 0; i < pushWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				r, err := send(ctx, tokens[i])
+				r.Token = tokens[i]
+				if err != nil && r.Error == "" {
+					r.Error = err.Error()
+				}
+				results[i] = r
+				if err != nil {
+					mu.Lock()
+					if fatal == nil {
+						fatal = err
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	for i := range tokens {
+		mu.Lock()
+		stop := fatal != nil
+		mu.Unlock()
+		if stop || ctx.Err() != nil {
+			break
+		}
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	sent, failed, transient := 0, 0, 0
+	invalid := []string{}
+	for i, r := range results {
+		if r.OK {
+			sent++
+			continue
+		}
+		failed++
+		if r.Token == "" {
+			results[i] = pushResult{Token: tokens[i], Error: "not sent"}
+			continue
+		}
+		if r.InvalidToken {
+			invalid = append(invalid, r.Token)
+		}
+		if r.Retryable {
+			transient++
+		}
+	}
+
+	// Once anything is sent, a retry would notify those devices twice
+	if sent == 0 {
+		if fatal != nil {
+			return 0, nil, fatal
+		}
+		if ctx.Err() != nil {
+			return 0, nil, ctx.Err()
+		}
+		if transient > 0 {
+			return 0, nil, Retryable(fmt.Errorf("%s: %d of %d tokens failed, %d transiently", provider, failed, len(tokens), transient))
+		}
+	}
+
+	result := map[string]interface{}{
+		"provider":       provider,
+		"sent":           sent,
+		"failed":         failed,
+		"invalid_tokens": invalid,
+		"results":        results,
+	}
+	if fatal != nil {
+		result["error"] = fatal.Error()
+	}
+
+	jsonBytes, _ := json.Marshal(result)
+	return 200, jsonBytes, nil
+}
+
+// fcmInvalidToken are FCM error codes that mean the token will never work.
+var fcmInvalidToken = map[string]bool{
+	"UNREGISTERED":       true,
+	"SENDER_ID_MISMATCH": true,
+}
+
+func sendFCM(ctx context.Context, sa *googleServiceAccount, token string, msg pushMessage) (pushResult, error) {
+
+	accessToken, err := googleAccessToken(ctx, sa, "https://www.googleapis.com/auth/firebase.messaging")
+	if err != nil {
+		return pushResult{}, err
+	}
+
+	message := map[string]interface{}{"token": token}
+	if msg.title != "" || msg.body != "" {
+		message["notification"] = map[string]string{"title": msg.title, "body": msg.body}
+	}
+	if len(msg.data) > 0 {
+		// FCM data values must be strings
+		data := make(map[string]string, len(msg.data))
+		for k, v := range msg.data {
+			data[k] = outputText(v)
+		}
+		message["data"] = data
+	}
+	if msg.sound != "" || msg.badge != nil {
+		aps := map[string]interface{}{}
+		if msg.sound != "" {
+			aps["sound"] = msg.sound
+		}
+		if msg.badge != nil {
+			aps["badge"] = *msg.badge
+		}
+		message["apns"] = map[string]interface{}{"payload": map[string]interface{}{"aps": aps}}
+	}
+
+	bodyBytes, _ := json.Marshal(map[string]interface{}{"message": message})
+
+	endpoint := "https://fcm.googleapis.com/v1/projects/" + url.PathEscape(sa.ProjectID) + "/messages:send"
+
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(bodyBytes))
+	if err != nil {
+		return pushResult{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+
+	client := &http.Client{Timeout: 30 * time.Second, Transport: transportFor(ctx, nil)}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return pushResult{Error: err.Error(), Retryable: true}, nil
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 400 {
+		var ok struct {
+			Name string `json:"name"`
+		}
+		json.Unmarshal(body, &ok)
+		return pushResult{OK: true, MessageID: ok.Name}, nil
+	}
+
+	// The FCM error code is in the details; the status is the generic one
+	var e struct {
+		Error struct {
+			Status  string `json:"status"`
+			Message string `json:"message"`
+			Details []struct {
+				ErrorCode string `json:"errorCode"`
+			} `json:"details"`
+		} `json:"error"`
+	}
+	json.Unmarshal(body, &e)
+
+	code := e.Error.Status
+	for _, d := range e.Error.Details {
+		if d.ErrorCode != "" {
+			code = d.ErrorCode
+		}
+	}
+	if code == "" {
+		code = fmt.Sprintf("status %d", resp.StatusCode)
+	}
+
+	r := pushResult{Error: code}
+	if e.Error.Message != "" {
+		r.Error += ": " + e.Error.Message
+	}
+
+	switch {
+	case fcmInvalidToken[code]:
+		r.InvalidToken = true
+		return r, nil
+	case code == "INVALID_ARGUMENT" && strings.Contains(e.Error.Message, "token"):
+		// A malformed token; other invalid arguments are the message's
+		r.InvalidToken = true
+		return r, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		r.Retryable = true
+		return r, nil
+	}
+
+	// THIRD_PARTY_AUTH_ERROR, PERMISSION_DENIED, a bad message: no token
+	// will do better
+	return r, Permanent(fmt.Errorf("fcm %s", r.Error))
+}
+
+type apnsKey struct {
+	keyID  string
+	teamID string
+	key    *ecdsa.PrivateKey
+	pem    string
+}
+
+func apnsCredentials(payload map[string]interface{}) (*apnsKey, error) {
+
+	k := &apnsKey{
+		keyID:  payloadOrEnv(payload, "key_id", "GOFLOW_APNS_KEY_ID"),
+		teamID: payloadOrEnv(payload, "team_id", "GOFLOW_APNS_TEAM_ID"),
+	}
+	p8, err := keyMaterial(payload, "private_key", "GOFLOW_APNS_KEY")
+	if err != nil {
+		return nil, err
+	}
+	if p8 == "" || k.keyID == "" || k.teamID == "" {
+		return nil, errors.New("no credentials for apns")
+	}
+
+	key, err := parsePrivateKey(p8)
+	if err != nil {
+		return nil, fmt.Errorf("apns key: %w", err)
+	}
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("apns key is not an EC key")
+	}
+	k.key, k.pem = ecKey, p8
+
+	return k, nil
+}
+
+// apnsTokens caches provider tokens per key. Apple refuses tokens older
+// than an hour and ones refreshed more often than every 20 minutes.
+var apnsTokens = struct {
+	sync.Mutex
+	entries map[string]cachedToken
+}{entries: make(map[string]cachedToken)}
+
+func apnsProviderToken(k *apnsKey) (string, error) {
+
+	apnsTokens.Lock()
+	defer apnsTokens.Unlock()
+
+	id := k.teamID + "/" + k.keyID + "/" + keyFingerprint(k.pem)
+	if t, ok := apnsTokens.entries[id]; ok && time.Now().Before(t.expires) {
+		return t.token, nil
+	}
+
+	now := time.Now()
+	token, err := signJWT(
+		map[string]interface{}{"alg": "ES256", "kid": k.keyID},
+		map[string]interface{}{"iss": k.teamID, "iat": now.Unix()},
+		func(digest []byte) ([]byte, error) {
+			r, s, err := ecdsa.Sign(rand.Reader, k.key, digest)
+			if err != nil {
+				return nil, err
+			}
+			// JWS wants the raw 64-byte r || s, not ASN.1
+			sig := make([]byte, 64)
+			r.FillBytes(sig[:32])
+			s.FillBytes(sig[32:])
+			return sig, nil
+		},
+	)
+	if err != nil {
+		return "", err
+	}
+
+	apnsTokens.entries[id] = cachedToken{token: token, expires: now.Add(40 * time.Minute)}
+	return token, nil
+}
+
+// apnsInvalidToken are APNs reasons that mean the token will never work
+// for this app.
+var apnsInvalidToken = map[string]bool{
+	"BadDeviceToken":         true,
+	"Unregistered":           true,
+	"DeviceTokenNotForTopic": true,
+	"ExpiredToken":           true,
+}
+
+func sendAPNs(ctx context.Context, k *apnsKey, token string, msg pushMessage) (pushResult, error) {
+
+	providerToken, err := apnsProviderToken(k)
+	if err != nil {
+		return pushResult{}, err
+	}
+
+	aps := map[string]interface{}{}
+	pushType, priority := "alert", "10"
+	if msg.title != "" || msg.body != "" {
+		aps["alert"] = map[string]string{"title": msg.title, "body": msg.body}
+	} else {
+		// Data only: a background push, which Apple requires at priority 5
+		aps["content-available"] = 1
+		pushType, priority = "background", "5"
+	}
+	if msg.sound != "" {
+		aps["sound"] = msg.sound
+	}
+	if msg.badge != nil {
+		aps["badge"] = *msg.badge
+	}
+
+	body := map[string]interface{}{}
+	for k, v := range msg.data {
+		body[k] = v
+	}
+	body["aps"] = aps
+	bodyBytes, _ := json.Marshal(body)
+
+	host := "https://api.push.apple.com"
+	if msg.sandbox {
+		host = "https://api.sandbox.push.apple.com"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", host+"/3/device/"+url.PathEscape(token), bytes.NewReader(bodyBytes))
+	if err != nil {
+		return pushResult{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "bearer "+providerToken)
+	req.Header.Set("apns-topic", msg.topic)
+	req.Header.Set("apns-push-type", pushType)
+	req.Header.Set("apns-priority", priority)
+
+	// APNs only speaks HTTP/2, which the default transport negotiates
+	client := &http.Client{Timeout: 30 * time.Second, Transport: transportFor(ctx, nil)}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return pushResult{Error: err.Error(), Retryable: true}, nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return pushResult{OK: true, MessageID: resp.Header.Get("apns-id")}, nil
+	}
+
+	var e struct {
+		Reason string `json:"reason"`
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&e)
+	if e.Reason == "" {
+		e.Reason = fmt.Sprintf("status %d", resp.StatusCode)
+	}
+
+	r := pushResult{Error: e.Reason}
+
+	switch {
+	case apnsInvalidToken[e.Reason] || resp.StatusCode == http.StatusGone:
+		r.InvalidToken = true
+		return r, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		r.Retryable = true
+		return r, nil
+	}
+
+	// InvalidProviderToken, TopicDisallowed, PayloadTooLarge and the like
+	return r, Permanent(fmt.Errorf("apns %s", e.Reason))
+}
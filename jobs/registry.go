@@ -0,0 +1,97 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// ExecutorFunc runs one job of a registered type. Like the built-in
+// executors it returns the response status and body to store, and an
+// error to fail (and maybe retry) the attempt.
+type ExecutorFunc func(ctx context.Context, payload map[string]interface{}) (int, []byte, error)
+
+// Where a job type's executor comes from.
+const (
+	SourceBuiltin  = "builtin"
+	SourceWASM     = "wasm"
+	SourceExternal = "external"
+	SourceCustom   = "custom"
+)
+
+// TypeInfo describes a registered job type.
+type TypeInfo struct {
+	Name   string `json:"name"`
+	Source string `json:"source"`
+
+	// Overrides is the source of the executor this one replaced
+	Overrides string `json:"overrides,omitempty"`
+}
+
+type registration struct {
+	fn ExecutorFunc
+	TypeInfo
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]registration{}
+)
+
+// Register adds an executor for a new job type. It fails if the type
+// already has one, built-in or registered; use Override to replace it.
+func Register(name string, fn ExecutorFunc) error {
+	return register(name, fn, SourceCustom)
+}
+
+// Override registers fn for name, replacing the executor the type had,
+// if any, built-ins included.
+func Override(name string, fn ExecutorFunc) {
+
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	info := TypeInfo{Name: name, Source: SourceCustom}
+	if old, ok := registry[name]; ok {
+		info.Overrides = old.Source
+	}
+	registry[name] = registration{fn: fn, TypeInfo: info}
+}
+
+func register(name string, fn ExecutorFunc, source string) error {
+
+	if name == "" || fn == nil {
+		return fmt.Errorf("a job type needs a name and an executor")
+	}
+
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if old, ok := registry[name]; ok {
+		return fmt.Errorf("job type %s is already registered (%s)", name, old.Source)
+	}
+	registry[name] = registration{fn: fn, TypeInfo: TypeInfo{Name: name, Source: source}}
+	return nil
+}
+
+func lookup(name string) (ExecutorFunc, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	r, ok := registry[name]
+	return r.fn, ok
+}
+
+// Types lists the registered job types by name.
+func Types() []TypeInfo {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	types := make([]TypeInfo, 0, len(registry))
+	for _, r := range registry {
+		types = append(types, r.TypeInfo)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i].Name < types[j].Name })
+	return types
+}
@@ -0,0 +1,206 @@
+package jobs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
+)
+
+const maxCommandOutput = 1 << 20
+
+// Every command runs under a timeout, a CPU time limit and an address
+// space limit. A payload can ask for other values with timeout_seconds,
+// max_cpu_seconds and max_memory_mb, up to the operator's maximums (see
+// CommandSettings).
+//
+// The limits are set before the command starts (see run_command_linux.go);
+// other platforms refuse to run commands.
+
+// CommandSettings is what the operator lets run_command do. It is disabled
+// unless Enabled, and only the absolute paths in Allowlist may run.
+type CommandSettings struct {
+	Enabled   bool     `yaml:"enabled"`
+	Allowlist []string `yaml:"allowlist"`
+
+	// Defaults and maximums for the payload's limits
+	TimeoutSeconds    int `yaml:"timeout_seconds"`
+	MaxTimeoutSeconds int `yaml:"max_timeout_seconds"`
+	CPUSeconds        int `yaml:"cpu_seconds"`
+	MaxCPUSeconds     int `yaml:"max_cpu_seconds"`
+	MemoryMB          int `yaml:"memory_mb"`
+	MaxMemoryMB       int `yaml:"max_memory_mb"`
+}
+
+// DefaultCommandSettings leaves run_command disabled, with the built-in
+// limits.
+func DefaultCommandSettings() CommandSettings {
+	return CommandSettings{
+		TimeoutSeconds:    60,
+		MaxTimeoutSeconds: 600,
+		CPUSeconds:        60,
+		MaxCPUSeconds:     600,
+		MemoryMB:          512,
+		MaxMemoryMB:       2048,
+	}
+}
+
+var commandSettings = DefaultCommandSettings()
+
+// ConfigureCommands sets what run_command may execute and its limits.
+func ConfigureCommands(s CommandSettings) {
+	commandSettings = s
+}
+
+// commandLimits are per-process resource limits applied to the child.
+type commandLimits struct {
+	CPUSeconds uint64
+	MemoryMB   uint64
+}
+
+// commandLimit returns the payload's value for key, or the operator's
+// default, refusing more than the operator's maximum.
+func commandLimit(payload map[string]interface{}, key string, def, max int) (uint64, error) {
+
+	value := uint64(min(def, max))
+
+	if v, ok := payload[key].(float64); ok && v > 0 {
+		if v > float64(max) {
+			return 0, Permanent(fmt.Errorf("'%s' is over this server's limit of %d", key, max))
+		}
+		value = uint64(v)
+	}
+	return value, nil
+}
+
+func commandAllowed(command string) bool {
+
+	if !commandSettings.Enabled {
+		return false
+	}
+	return slices.Contains(commandSettings.Allowlist, command)
+}
+
+// cappedBuffer keeps at most limit bytes and silently drops the rest.
+type cappedBuffer struct {
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (c *cappedBuffer) Write(p []byte) (int, error) {
+	remaining := c.limit - c.buf.Len()
+	if remaining <= 0 {
+		c.truncated = true
+		return len(p), nil
+	}
+	if len(p) > remaining {
+		c.buf.Write(p[:remaining])
+		c.truncated = true
+		return len(p), nil
+	}
+	return c.buf.Write(p)
+}
+
+func executeRunCommand(ctx context.Context, payload map[string]interface{}) (int, []byte, error) {
+
+	if ctx.Err() == context.Canceled {
+		return 0, nil, fmt.Errorf("command cancelled")
+	}
+
+	command, ok := payload["command"].(string)
+	if !ok || command == "" {
+		return 0, nil, fmt.Errorf("missing 'command'")
+	}
+
+	if !commandAllowed(command) {
+		return 0, nil, fmt.Errorf("command not allowed: %s", command)
+	}
+
+	var args []string
+	if rawArgs, ok := payload["args"].([]interface{}); ok {
+		for _, a := range rawArgs {
+			s, ok := a.(string)
+			if !ok {
+				return 0, nil, fmt.Errorf("'args' must be strings")
+			}
+			args = append(args, s)
+		}
+	}
+
+	timeoutSeconds, err := commandLimit(payload, "timeout_seconds", commandSettings.TimeoutSeconds, commandSettings.MaxTimeoutSeconds)
+	if err != nil {
+		return 0, nil, err
+	}
+	timeout := time.Duration(timeoutSeconds) * time.Second
+
+	var limits commandLimits
+	limits.CPUSeconds, err = commandLimit(payload, "max_cpu_seconds", commandSettings.CPUSeconds, commandSettings.MaxCPUSeconds)
+	if err != nil {
+		return 0, nil, err
+	}
+	limits.MemoryMB, err = commandLimit(payload, "max_memory_mb", commandSettings.MemoryMB, commandSettings.MaxMemoryMB)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	runCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// Arguments are passed straight to the binary; nothing goes through a shell.
+	cmd, err := limitedCommand(runCtx, limits, command, args)
+	if err != nil {
+		return 0, nil, err
+	}
+	cmd.Env = []string{"PATH=/usr/local/bin:/usr/bin:/bin"}
+
+	// A child the command left behind can hold the output pipes open past
+	// the timeout; stop waiting for it
+	cmd.WaitDelay = 5 * time.Second
+
+	stdout := &cappedBuffer{limit: maxCommandOutput}
+	stderr := &cappedBuffer{limit: maxCommandOutput}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	start := time.Now()
+
+	if err := cmd.Start(); err != nil {
+		return 0, nil, err
+	}
+
+	waitErr := cmd.Wait()
+
+	exitCode := 0
+	if cmd.ProcessState != nil {
+		exitCode = cmd.ProcessState.ExitCode()
+	}
+
+	result := map[string]interface{}{
+		"command":          command,
+		"args":             args,
+		"exit_code":        exitCode,
+		"stdout":           stdout.buf.String(),
+		"stderr":           stderr.buf.String(),
+		"output_truncated": stdout.truncated || stderr.truncated,
+		"duration_ms":      time.Since(start).Milliseconds(),
+	}
+
+	jsonBytes, _ := json.Marshal(result)
+
+	if runCtx.Err() == context.DeadlineExceeded {
+		return 500, jsonBytes, fmt.Errorf("command timed out after %v", timeout)
+	}
+
+	if ctx.Err() == context.Canceled {
+		return 0, jsonBytes, fmt.Errorf("command cancelled")
+	}
+
+	if waitErr != nil {
+		return 500, jsonBytes, fmt.Errorf("command exited with code %d", exitCode)
+	}
+
+	return 200, jsonBytes, nil
+}
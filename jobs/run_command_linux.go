@@ -0,0 +1,110 @@
+//go:build linux
+
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// commandWrapperArg makes this binary a launcher for run_command: started
+// as "<self> commandWrapperArg <cpu seconds> <memory MB> <command> <args...>",
+// it sets the limits on itself and execs the command, so they are in
+// place before the command runs its first instruction and the command
+// cannot lift them.
+const commandWrapperArg = "__goflow_run_command"
+
+func init() {
+	if len(os.Args) >= 5 && os.Args[1] == commandWrapperArg {
+		os.Exit(execLimited(os.Args[2], os.Args[3], os.Args[4:]))
+	}
+}
+
+// limitedCommand returns the command that runs command with args under
+// limits, through this binary.
+func limitedCommand(ctx context.Context, limits commandLimits, command string, args []string) (*exec.Cmd, error) {
+
+	self, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("find the server binary: %w", err)
+	}
+
+	wrapped := append([]string{
+		commandWrapperArg,
+		strconv.FormatUint(limits.CPUSeconds, 10),
+		strconv.FormatUint(limits.MemoryMB, 10),
+		command,
+	}, args...)
+
+	return exec.CommandContext(ctx, self, wrapped...), nil
+}
+
+// execLimited applies the limits and replaces the process with argv. It
+// only returns, with an exit code, when that fails.
+func execLimited(cpu, memory string, argv []string) int {
+
+	cpuSeconds, err1 := strconv.ParseUint(cpu, 10, 64)
+	memoryMB, err2 := strconv.ParseUint(memory, 10, 64)
+	if err1 != nil || err2 != nil {
+		fmt.Fprintln(os.Stderr, "goflow: invalid command limits")
+		return 126
+	}
+
+	// Everything execve needs is allocated first: under the new address
+	// space limit the runtime may not be able to grow the heap
+	path, err := syscall.BytePtrFromString(argv[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "goflow:", err)
+		return 126
+	}
+	argvp, err := syscall.SlicePtrFromStrings(argv)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "goflow:", err)
+		return 126
+	}
+	envp, err := syscall.SlicePtrFromStrings(os.Environ())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "goflow:", err)
+		return 126
+	}
+
+	if err := prlimit(0, syscall.RLIMIT_CPU, cpuSeconds); err != nil {
+		fmt.Fprintln(os.Stderr, "goflow: set CPU limit:", err)
+		return 126
+	}
+	if err := prlimit(0, syscall.RLIMIT_AS, memoryMB<<20); err != nil {
+		fmt.Fprintln(os.Stderr, "goflow: set memory limit:", err)
+		return 126
+	}
+
+	_, _, errno := syscall.RawSyscall(
+		syscall.SYS_EXECVE,
+		uintptr(unsafe.Pointer(path)),
+		uintptr(unsafe.Pointer(&argvp[0])),
+		uintptr(unsafe.Pointer(&envp[0])),
+	)
+	fmt.Fprintln(os.Stderr, "goflow: exec "+argv[0]+":", errno)
+	return 127
+}
+
+// prlimit sets resource to value for pid, or for the calling process when
+// pid is 0.
+func prlimit(pid int, resource int, value uint64) error {
+	rlim := syscall.Rlimit{Cur: value, Max: value}
+	_, _, errno := syscall.RawSyscall6(
+		syscall.SYS_PRLIMIT64,
+		uintptr(pid),
+		uintptr(resource),
+		uintptr(unsafe.Pointer(&rlim)),
+		0, 0, 0,
+	)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+)
+
+// limitedCommand refuses to run commands: their resource limits are only
+// supported on Linux.
+func limitedCommand(ctx context.Context, limits commandLimits, command string, args []string) (*exec.Cmd, error) {
+	return nil, Permanent(fmt.Errorf("run_command needs Linux for its resource limits"))
+}
@@ -0,0 +1,323 @@
+package jobs
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// scan_file downloads a file, hashes it while streaming, and optionally
+// scans it:
+//
+//	{"url": "https://uploads.example.com/invoice.pdf",
+//	 "clamav": true, "virustotal": true, "expected_sha256": "9f86d0..."}
+//
+// ClamAV is reached over clamd's INSTREAM protocol at GOFLOW_CLAMAV_ADDR
+// (default localhost:3310). VirusTotal (GOFLOW_VIRUSTOTAL_KEY) is asked
+// about the SHA-256 first; with "virustotal_submit" an unknown file is
+// uploaded and its analysis awaited.
+//
+// The result's "verdict" is "clean", "infected" or "not_scanned", so a
+// workflow condition can gate later steps on it. With "fail_on_infected"
+// an infected file fails the job, which stops the workflow outright.
+
+const (
+	maxScanBytes          = 512 << 20
+	virusTotalUploadLimit = 32 << 20
+	clamChunkSize         = 64 << 10
+)
+
+func executeScanFile(ctx context.Context, payload map[string]interface{}) (int, []byte, error) {
+
+	source, ok := payload["url"].(string)
+	if !ok || source == "" {
+		return 0, nil, fmt.Errorf("missing 'url'")
+	}
+
+	useClam, _ := payload["clamav"].(bool)
+	useVT, _ := payload["virustotal"].(bool)
+
+	f, err := os.CreateTemp("", "goflow-scan-")
+	if err != nil {
+		return 0, nil, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	sha := sha256.New()
+	md := md5.New()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", source, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	client := &http.Client{Timeout: 10 * time.Minute, Transport: transportFor(ctx, nil)}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return 0, nil, fmt.Errorf("source returned status %d", resp.StatusCode)
+	}
+
+	size, err := io.Copy(io.MultiWriter(f, sha, md), io.LimitReader(resp.Body, maxScanBytes+1))
+	if err != nil {
+		return 0, nil, err
+	}
+	if size > maxScanBytes {
+		return 0, nil, fmt.Errorf("file is over the %d byte limit", maxScanBytes)
+	}
+
+	sum := hex.EncodeToString(sha.Sum(nil))
+
+	result := map[string]interface{}{
+		"url":     source,
+		"bytes":   size,
+		"sha256":  sum,
+		"md5":     hex.EncodeToString(md.Sum(nil)),
+		"verdict": "not_scanned",
+	}
+
+	if expected, ok := payload["expected_sha256"].(string); ok && expected != "" {
+		result["checksum_ok"] = strings.EqualFold(expected, sum)
+	}
+
+	infected := false
+	scanned := false
+
+	if useClam {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return 0, nil, err
+		}
+		found, signature, err := clamdScan(ctx, f)
+		if err != nil {
+			return 0, nil, fmt.Errorf("clamav: %w", err)
+		}
+		scanned = true
+		infected = infected || found
+		result["clamav"] = map[string]interface{}{"infected": found, "signature": signature}
+	}
+
+	if useVT {
+		submit, _ := payload["virustotal_submit"].(bool)
+		stats, err := virusTotalVerdict(ctx, f, sum, size, submit)
+		if err != nil {
+			return 0, nil, fmt.Errorf("virustotal: %w", err)
+		}
+		if stats != nil {
+			scanned = true
+			infected = infected || stats["malicious"] > 0
+			result["virustotal"] = stats
+		} else {
+			result["virustotal"] = "unknown"
+		}
+	}
+
+	if scanned {
+		result["verdict"] = "clean"
+		if infected {
+			result["verdict"] = "infected"
+		}
+	}
+
+	if failOnInfected, _ := payload["fail_on_infected"].(bool); failOnInfected && infected {
+		return 0, nil, fmt.Errorf("file is infected (sha256 %s)", sum)
+	}
+
+	jsonBytes, _ := json.Marshal(result)
+	return 200, jsonBytes, nil
+}
+
+// clamdScan streams r to clamd with INSTREAM and parses the reply,
+// "stream: OK" or "stream: <signature> FOUND".
+func clamdScan(ctx context.Context, r io.Reader) (bool, string, error) {
+
+	addr := os.Getenv("GOFLOW_CLAMAV_ADDR")
+	if addr == "" {
+		addr = "localhost:3310"
+	}
+
+	network := "tcp"
+	if strings.HasPrefix(addr, "/") {
+		network = "unix"
+	}
+
+	d := net.Dialer{Timeout: 5 * time.Second}
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return false, "", err
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(5 * time.Minute)
+	if dl, ok := ctx.Deadline(); ok && dl.Before(deadline) {
+		deadline = dl
+	}
+	conn.SetDeadline(deadline)
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return false, "", err
+	}
+
+	buf := make([]byte, clamChunkSize)
+	size := make([]byte, 4)
+
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size, uint32(n))
+			if _, werr := conn.Write(size); werr != nil {
+				return false, "", werr
+			}
+			if _, werr := conn.Write(buf[:n]); werr != nil {
+				return false, "", werr
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return false, "", err
+		}
+	}
+
+	// A zero-length chunk ends the stream
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return false, "", err
+	}
+
+	reply, err := io.ReadAll(conn)
+	if err != nil {
+		return false, "", err
+	}
+	answer := strings.TrimSpace(strings.TrimRight(string(reply), "\x00"))
+	answer = strings.TrimPrefix(answer, "stream: ")
+
+	switch {
+	case answer == "OK":
+		return false, "", nil
+	case strings.HasSuffix(answer, " FOUND"):
+		return true, strings.TrimSuffix(answer, " FOUND"), nil
+	default:
+		return false, "", fmt.Errorf("%s", answer)
+	}
+}
+
+// virusTotalVerdict returns the engine counts for the file, or nil if
+// VirusTotal has never seen it and submitting was not asked for.
+func virusTotalVerdict(ctx context.Context, f *os.File, sha string, size int64, submit bool) (map[string]int, error) {
+
+	apiKey := os.Getenv("GOFLOW_VIRUSTOTAL_KEY")
+	if apiKey == "" {
+		return nil, fmt.Errorf("GOFLOW_VIRUSTOTAL_KEY is not set")
+	}
+
+	var report struct {
+		Data struct {
+			Attributes struct {
+				Stats  map[string]int `json:"last_analysis_stats"`
+				Status string         `json:"status"`
+				Result map[string]int `json:"stats"`
+			} `json:"attributes"`
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+
+	status, err := virusTotalRequest(ctx, apiKey, "GET", "/files/"+sha, nil, "", &report)
+	if err != nil {
+		return nil, err
+	}
+	if status == http.StatusOK {
+		return report.Data.Attributes.Stats, nil
+	}
+	if !submit {
+		return nil, nil
+	}
+	if size > virusTotalUploadLimit {
+		return nil, fmt.Errorf("file is too large to submit (%d bytes)", size)
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", sha)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(part, f); err != nil {
+		return nil, err
+	}
+	form.Close()
+
+	if _, err := virusTotalRequest(ctx, apiKey, "POST", "/files", &body, form.FormDataContentType(), &report); err != nil {
+		return nil, err
+	}
+
+	// Analyses usually finish within a couple of minutes
+	analysisID := report.Data.ID
+	for i := 0; i < 20; i++ {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(15 * time.Second):
+		}
+
+		if _, err := virusTotalRequest(ctx, apiKey, "GET", "/analyses/"+analysisID, nil, "", &report); err != nil {
+			return nil, err
+		}
+		if report.Data.Attributes.Status == "completed" {
+			return report.Data.Attributes.Result, nil
+		}
+	}
+
+	return nil, fmt.Errorf("analysis %s did not finish in time", analysisID)
+}
+
+func virusTotalRequest(ctx context.Context, apiKey, method, path string, body io.Reader, contentType string, out interface{}) (int, error) {
+
+	req, err := http.NewRequestWithContext(ctx, method, "https://www.virustotal.com/api/v3"+path, body)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("x-apikey", apiKey)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	client := &http.Client{Timeout: 2 * time.Minute, Transport: transportFor(ctx, nil)}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return resp.StatusCode, nil
+	}
+	if resp.StatusCode >= 400 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return resp.StatusCode, fmt.Errorf("status %d: %s", resp.StatusCode, msg)
+	}
+
+	return resp.StatusCode, json.NewDecoder(resp.Body).Decode(out)
+}
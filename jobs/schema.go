@@ -0,0 +1,255 @@
+package jobs
+
+import (
+	"fmt"
+	"strings"
+)
+
+// payloadSchemas lists the fields each built-in job type cannot run
+// without, so a bad payload is turned away at submission instead of after
+// using up a worker and its retries. Only presence and JSON type are
+// checked; executors still validate values. Types without an entry, such
+// as WASM plugins and external executors, are not checked.
+var payloadSchemas = map[string][]payloadRule{
+	"http_request": {need("url", jsonString)},
+	"send_email":   {need("to", jsonString), need("subject", jsonString), need("body", jsonString)},
+	"send_sms":     {need("to", jsonString), need("body", jsonString)},
+	"push_notification": {
+		either(payloadField{"token", jsonString}, payloadField{"tokens", jsonArray}),
+		either(payloadField{"title", jsonString}, payloadField{"body", jsonString}, payloadField{"data", jsonObject}),
+	},
+	"webhook_delivery": {need("url", jsonString), need("event", jsonString), need("secret", jsonString)},
+	"delay":            {need("seconds", jsonNumber), need("next_job", jsonObject)},
+	"cron_schedule":    {need("cron", jsonString), need("job", jsonObject)},
+	"data_extract":     {need("url", jsonString), need("selector", jsonString)},
+	"ai_prompt":        {need("provider", jsonString), need("api_key", jsonString), need("model", jsonString), need("prompt", jsonString)},
+	"db_query":         {need("query", jsonString)},
+	"callback":         {need("url", jsonString), need("job_id", jsonNumber)},
+	"run_command":      {need("command", jsonString)},
+	"script":           {need("script", jsonString)},
+	"external":         {need("executor", jsonString)},
+	"k8s_job":          {need("image", jsonString)},
+	"container_run":    {need("image", jsonString)},
+	"fx_convert": {
+		need("from", jsonString),
+		need("to", jsonAny),
+		either(payloadField{"amount", jsonNumber}, payloadField{"amounts", jsonObject}),
+	},
+	"geocode":          {either(payloadField{"address", jsonString}, payloadField{"lat", jsonNumber})},
+	"weather_fetch":    {need("lat", jsonNumber), need("lon", jsonNumber)},
+	"uptime_check":     {need("url", jsonString)},
+	"dns_check":        {need("name", jsonString)},
+	"port_check":       {need("host", jsonString), either(payloadField{"port", jsonNumber}, payloadField{"icmp", jsonBool})},
+	"generate_sitemap": {need("url", jsonString)},
+	"link_check":       {need("url", jsonString)},
+	"pagespeed_audit":  {need("url", jsonString)},
+	"digest":           {need("name", jsonString), either(payloadField{"email", jsonString}, payloadField{"webhook_url", jsonString})},
+	"digest_event":     {need("digest", jsonString)},
+	"amqp_publish":     {either(payloadField{"routing_key", jsonString}, payloadField{"exchange", jsonString})},
+	"graphql_request":  {need("url", jsonString), need("query", jsonString)},
+	"export_report":    {need("query", jsonString), either(payloadField{"email", jsonString}, payloadField{"bucket", jsonString})},
+	"translate_text": {
+		either(payloadField{"text", jsonString}, payloadField{"texts", jsonArray}),
+		need("target_lang", jsonString),
+	},
+	"file_upload": {
+		either(payloadField{"source", jsonString}, payloadField{"content", jsonString}),
+		need("bucket", jsonString),
+		need("key", jsonString),
+	},
+	"image_process":   {need("source", jsonString), need("outputs", jsonArray)},
+	"transcode_media": {need("source", jsonString), need("outputs", jsonArray)},
+	"scan_file":       {need("url", jsonString)},
+	"webhook_fanout":  {need("event", jsonString), either(payloadField{"endpoints", jsonArray}, payloadField{"topic", jsonString})},
+	"ical_import":     {need("url", jsonString), either(payloadField{"job", jsonObject}, payloadField{"webhook_url", jsonString})},
+	"condition":       {need("path", jsonString), need("operator", jsonString), need("then", jsonObject)},
+	"workflow":        {need("steps", jsonArray)},
+}
+
+// JSON types a payload field can be required to have.
+const (
+	jsonAny    = ""
+	jsonString = "a string"
+	jsonNumber = "a number"
+	jsonBool   = "a boolean"
+	jsonObject = "an object"
+	jsonArray  = "an array"
+)
+
+type payloadField struct {
+	name string
+	kind string
+}
+
+// A payloadRule is met when any one of its fields is set: a single field
+// is required, several are alternatives.
+type payloadRule []payloadField
+
+func need(name, kind string) payloadRule {
+	return payloadRule{{name, kind}}
+}
+
+func either(fields ...payloadField) payloadRule {
+	return payloadRule(fields)
+}
+
+// PayloadError lists what is wrong with a submitted payload.
+type PayloadError struct {
+	JobType string
+	Missing []string
+	Invalid []string
+}
+
+func (e *PayloadError) Error() string {
+	var parts []string
+	if len(e.Missing) > 0 {
+		parts = append(parts, "missing "+strings.Join(e.Missing, ", "))
+	}
+	parts = append(parts, e.Invalid...)
+	return "Invalid " + e.JobType + " payload: " + strings.Join(parts, "; ")
+}
+
+// ValidatePayload checks a payload against its job type's schema. It
+// returns a *PayloadError naming every missing or mistyped field.
+func ValidatePayload(jobType string, payload map[string]interface{}) error {
+
+	rules, ok := payloadSchemas[jobType]
+	if !ok {
+		return nil
+	}
+
+	e := &PayloadError{JobType: jobType}
+
+	for _, rule := range rules {
+		met := false
+		var wrong []string
+		for _, f := range rule {
+			v, present := payload[f.name]
+			switch {
+			case !present || isEmpty(v):
+			case !hasKind(v, f.kind):
+				wrong = append(wrong, fmt.Sprintf("'%s' must be %s", f.name, f.kind))
+			default:
+				met = true
+			}
+		}
+		if met {
+			continue
+		}
+
+		if len(wrong) > 0 {
+			e.Invalid = append(e.Invalid, wrong...)
+			continue
+		}
+		names := make([]string, len(rule))
+		for i, f := range rule {
+			names[i] = "'" + f.name + "'"
+		}
+		e.Missing = append(e.Missing, strings.Join(names, " or "))
+	}
+
+	if len(e.Missing) == 0 && len(e.Invalid) == 0 {
+		return nil
+	}
+	return e
+}
+
+// PayloadSchema describes a job type's payload rules as a JSON Schema
+// object, for the API document. Alternatives become an anyOf of required
+// fields. Types without rules report false.
+func PayloadSchema(jobType string) (map[string]interface{}, bool) {
+
+	rules, ok := payloadSchemas[jobType]
+	if !ok {
+		return nil, false
+	}
+
+	properties := map[string]interface{}{}
+	required := []string{}
+	var alternatives []interface{}
+
+	for _, rule := range rules {
+		for _, f := range rule {
+			properties[f.name] = fieldSchema(f.kind)
+		}
+
+		if len(rule) == 1 {
+			required = append(required, rule[0].name)
+			continue
+		}
+
+		var anyOf []interface{}
+		for _, f := range rule {
+			anyOf = append(anyOf, map[string]interface{}{"required": []string{f.name}})
+		}
+		alternatives = append(alternatives, map[string]interface{}{"anyOf": anyOf})
+	}
+
+	schema := map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+		"required":   required,
+	}
+	if len(alternatives) > 0 {
+		schema["allOf"] = alternatives
+	}
+	return schema, true
+}
+
+// fieldSchema is the JSON Schema for a field of the given kind. Empty
+// strings and arrays count as missing, so required ones cannot be empty.
+func fieldSchema(kind string) map[string]interface{} {
+	switch kind {
+	case jsonString:
+		return map[string]interface{}{"type": "string", "minLength": 1}
+	case jsonNumber:
+		return map[string]interface{}{"type": "number"}
+	case jsonBool:
+		return map[string]interface{}{"type": "boolean"}
+	case jsonObject:
+		return map[string]interface{}{"type": "object"}
+	case jsonArray:
+		return map[string]interface{}{"type": "array", "minItems": 1}
+	}
+	return map[string]interface{}{}
+}
+
+// isEmpty reports values executors treat as not set.
+func isEmpty(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return true
+	case string:
+		return v == ""
+	case bool:
+		return !v
+	case []interface{}:
+		return len(v) == 0
+	}
+	return false
+}
+
+// hasKind accepts encrypted values as any kind; they were checked before
+// they were encrypted.
+func hasKind(v interface{}, kind string) bool {
+	if s, ok := v.(string); ok && IsEncrypted(s) {
+		return true
+	}
+	return kind == jsonAny || kindOf(v) == kind
+}
+
+func kindOf(v interface{}) string {
+	switch v.(type) {
+	case string:
+		return jsonString
+	case float64:
+		return jsonNumber
+	case bool:
+		return jsonBool
+	case map[string]interface{}:
+		return jsonObject
+	case []interface{}:
+		return jsonArray
+	}
+	return jsonAny
+}
@@ -0,0 +1,231 @@
+package jobs
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime/metrics"
+	"strings"
+	"time"
+
+	"github.com/dop251/goja"
+)
+
+const (
+	defaultScriptTimeout   = 5 * time.Second
+	maxScriptTimeout       = 30 * time.Second
+	defaultScriptMemoryMB  = 128
+	maxScriptMemoryMB      = 512
+	maxScriptFetches       = 20
+	maxScriptFetchBodySize = 1 << 20
+)
+
+// executeScript runs user-provided JavaScript against the job payload. The
+// script's completion value (the value of its last expression) becomes the
+// job response. Available globals: payload, JSON, console.log, fetch
+// (public destinations only) and crypto.
+func executeScript(ctx context.Context, payload map[string]interface{}) (int, []byte, error) {
+
+	if ctx.Err() == context.Canceled {
+		return 0, nil, fmt.Errorf("script cancelled")
+	}
+
+	source, ok := payload["script"].(string)
+	if !ok || source == "" {
+		return 0, nil, fmt.Errorf("missing 'script'")
+	}
+
+	if lang, ok := payload["language"].(string); ok && lang != "javascript" {
+		return 0, nil, fmt.Errorf("unsupported script language: %s", lang)
+	}
+
+	timeout := defaultScriptTimeout
+	if t, ok := payload["timeout_seconds"].(float64); ok && t > 0 {
+		timeout = time.Duration(t) * time.Second
+	}
+	if timeout > maxScriptTimeout {
+		timeout = maxScriptTimeout
+	}
+
+	memoryMB := uint64(defaultScriptMemoryMB)
+	if m, ok := payload["max_memory_mb"].(float64); ok && m > 0 {
+		memoryMB = uint64(m)
+	}
+	if memoryMB > maxScriptMemoryMB {
+		memoryMB = maxScriptMemoryMB
+	}
+
+	input := payload["input"]
+	if input == nil {
+		input = payload
+	}
+
+	vm := goja.New()
+	vm.SetFieldNameMapper(goja.TagFieldNameMapper("json", true))
+
+	var logs []string
+	sandbox := &scriptSandbox{ctx: ctx, vm: vm, client: newGuardedHTTPClient(ctx, 10*time.Second)}
+
+	vm.Set("payload", input)
+	vm.Set("fetch", sandbox.fetch)
+	vm.Set("console", map[string]interface{}{
+		"log": func(args ...interface{}) {
+			parts := make([]string, len(args))
+			for i, a := range args {
+				parts[i] = fmt.Sprint(a)
+			}
+			logs = append(logs, strings.Join(parts, " "))
+		},
+	})
+	vm.Set("crypto", map[string]interface{}{
+		"sha256": func(s string) string {
+			sum := sha256.Sum256([]byte(s))
+			return hex.EncodeToString(sum[:])
+		},
+		"hmacSha256": func(key, s string) string {
+			mac := hmac.New(sha256.New, []byte(key))
+			mac.Write([]byte(s))
+			return hex.EncodeToString(mac.Sum(nil))
+		},
+		"randomId": NewDeliveryID,
+	})
+
+	stop := watchScript(ctx, vm, timeout, memoryMB)
+	defer stop()
+
+	value, err := vm.RunString(source)
+	if err != nil {
+		if interrupted, ok := err.(*goja.InterruptedError); ok {
+			return 0, nil, fmt.Errorf("script interrupted: %v", interrupted.Value())
+		}
+		return 0, nil, fmt.Errorf("script error: %v", err)
+	}
+
+	var result interface{}
+	if value != nil && !goja.IsUndefined(value) && !goja.IsNull(value) {
+		result = value.Export()
+	}
+
+	jsonBytes, err := json.Marshal(map[string]interface{}{
+		"result": result,
+		"logs":   logs,
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return 200, jsonBytes, nil
+}
+
+// watchScript interrupts vm when the timeout expires, the job is cancelled,
+// or the live heap grows past memoryMB since the script started. Go cannot
+// attribute heap to one goroutine, so the figure is the whole server's:
+// other jobs allocating at the same time count against the script, and
+// memory they free can hide some of its growth. The limit is a coarse
+// guard against runaway allocations rather than exact accounting.
+func watchScript(ctx context.Context, vm *goja.Runtime, timeout time.Duration, memoryMB uint64) func() {
+
+	done := make(chan struct{})
+	sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+
+	metrics.Read(sample)
+	baseline := sample[0].Value.Uint64()
+	limit := memoryMB * 1024 * 1024
+
+	go func() {
+		deadline := time.NewTimer(timeout)
+		defer deadline.Stop()
+
+		ticker := time.NewTicker(50 * time.Millisecond)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				vm.Interrupt("cancelled")
+				return
+			case <-deadline.C:
+				vm.Interrupt("timeout")
+				return
+			case <-ticker.C:
+				metrics.Read(sample)
+				if used := sample[0].Value.Uint64(); used > baseline && used-baseline > limit {
+					vm.Interrupt("memory limit exceeded")
+					return
+				}
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+type scriptSandbox struct {
+	ctx     context.Context
+	vm      *goja.Runtime
+	client  *http.Client
+	fetches int
+}
+
+type scriptFetchOptions struct {
+	Method  string            `json:"method"`
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+}
+
+// fetch is a synchronous subset of the browser API:
+// fetch(url, {method, headers, body}) -> {status, headers, body}.
+func (s *scriptSandbox) fetch(url string, opts *scriptFetchOptions) map[string]interface{} {
+
+	s.fetches++
+	if s.fetches > maxScriptFetches {
+		panic(s.vm.NewGoError(fmt.Errorf("fetch limit of %d exceeded", maxScriptFetches)))
+	}
+
+	if opts == nil {
+		opts = &scriptFetchOptions{}
+	}
+
+	method := opts.Method
+	if method == "" {
+		method = "GET"
+	}
+
+	req, err := http.NewRequestWithContext(s.ctx, method, url, strings.NewReader(opts.Body))
+	if err != nil {
+		panic(s.vm.NewGoError(err))
+	}
+
+	for k, v := range opts.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		panic(s.vm.NewGoError(err))
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxScriptFetchBodySize))
+	if err != nil {
+		panic(s.vm.NewGoError(err))
+	}
+
+	headers := make(map[string]interface{})
+	for k := range resp.Header {
+		headers[strings.ToLower(k)] = resp.Header.Get(k)
+	}
+
+	return map[string]interface{}{
+		"status":  resp.StatusCode,
+		"headers": headers,
+		"body":    string(body),
+	}
+}
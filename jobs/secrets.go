@@ -0,0 +1,235 @@
+package jobs
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// A payload string of the form "secret://name" refers to the tenant's
+// secret of that name. References are resolved just before the executor
+// runs, on a copy of the payload, so the stored job, its history and API
+// responses only ever hold the name. Values are sealed with AES-256-GCM
+// under the server's secrets key; the tenant and name are bound to the
+// ciphertext so a sealed value cannot be moved to another secret.
+
+// SecretPrefix marks a payload value as a secret reference.
+const SecretPrefix = "secret://"
+
+// ErrNoSecretsKey is returned when secrets are used without a key.
+var ErrNoSecretsKey = errors.New("secrets are not configured: set secrets_key")
+
+// templateFields hold job definitions that an executor stores as new
+// jobs. Their references are left for those jobs to resolve.
+var templateFields = map[string]bool{
+	"job":        true,
+	"next_job":   true,
+	"steps":      true,
+	"on_success": true,
+	"on_failure": true,
+	"then":       true,
+	"else":       true,
+}
+
+var secretsAEAD cipher.AEAD
+
+// SetSecretsKey installs the 32-byte key secrets are sealed with.
+func SetSecretsKey(key []byte) error {
+
+	if len(key) != 32 {
+		return fmt.Errorf("secrets key must be 32 bytes, got %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	secretsAEAD = aead
+	return nil
+}
+
+// SecretsEnabled reports whether a secrets key is installed.
+func SecretsEnabled() bool {
+	return secretsAEAD != nil
+}
+
+// SealSecret encrypts a secret's value for storage.
+func SealSecret(tenant, name, value string) ([]byte, error) {
+
+	if secretsAEAD == nil {
+		return nil, ErrNoSecretsKey
+	}
+
+	nonce := make([]byte, secretsAEAD.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return secretsAEAD.Seal(nonce, nonce, []byte(value), secretAD(tenant, name)), nil
+}
+
+func openSecret(tenant, name string, sealed []byte) (string, error) {
+
+	n := secretsAEAD.NonceSize()
+	if len(sealed) < n {
+		return "", fmt.Errorf("secret %q is corrupt", name)
+	}
+
+	plain, err := secretsAEAD.Open(nil, sealed[:n], sealed[n:], secretAD(tenant, name))
+	if err != nil {
+		return "", fmt.Errorf("secret %q cannot be decrypted with this key", name)
+	}
+	return string(plain), nil
+}
+
+func secretAD(tenant, name string) []byte {
+	return []byte(tenant + "\x00" + name)
+}
+
+// LookupSecret returns the value of one of the tenant's secrets.
+func LookupSecret(ctx context.Context, tenant, name string) (string, error) {
+
+	if secretsAEAD == nil {
+		return "", ErrNoSecretsKey
+	}
+	if DB == nil {
+		return "", fmt.Errorf("secret %q: secrets need Postgres", name)
+	}
+	if tenant == "" {
+		tenant = "default"
+	}
+
+	var sealed []byte
+	err := DB.QueryRowContext(ctx, `
+		SELECT value FROM secrets WHERE tenant_id = $1 AND name = $2
+	`, tenant, name).Scan(&sealed)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("secret %q not found", name)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return openSecret(tenant, name, sealed)
+}
+
+// IsSecretRef reports whether v is a secret reference.
+func IsSecretRef(v string) bool {
+	return strings.HasPrefix(v, SecretPrefix)
+}
+
+// ResolveSecret returns v, or the secret it refers to, decrypting it
+// first if it is an encrypted payload value.
+func ResolveSecret(ctx context.Context, tenant, v string) (string, error) {
+
+	if IsEncrypted(v) {
+		plain, err := decryptValue(v)
+		if err != nil {
+			return "", err
+		}
+		s, ok := plain.(string)
+		if !ok {
+			return "", fmt.Errorf("encrypted value is not a string")
+		}
+		v = s
+	}
+
+	if !IsSecretRef(v) {
+		return v, nil
+	}
+	return LookupSecret(ctx, tenant, strings.TrimPrefix(v, SecretPrefix))
+}
+
+// ResolveSecrets returns a copy of payload with encrypted values
+// decrypted and every secret reference replaced by its value. The
+// payload itself is left untouched.
+func ResolveSecrets(ctx context.Context, tenant string, payload map[string]interface{}) (map[string]interface{}, error) {
+
+	out := make(map[string]interface{}, len(payload))
+	for k, v := range payload {
+		// parent is another job's output: data, never references
+		if templateFields[k] || k == "parent" {
+			out[k] = v
+			continue
+		}
+		resolved, err := resolveValue(ctx, tenant, v)
+		if err != nil {
+			return nil, fmt.Errorf("'%s': %w", k, err)
+		}
+		out[k] = resolved
+	}
+	return out, nil
+}
+
+func resolveValue(ctx context.Context, tenant string, v interface{}) (interface{}, error) {
+
+	switch v := v.(type) {
+	case string:
+		if IsEncrypted(v) {
+			plain, err := decryptValue(v)
+			if err != nil {
+				return nil, err
+			}
+			return resolveValue(ctx, tenant, plain)
+		}
+		return ResolveSecret(ctx, tenant, v)
+
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			resolved, err := resolveValue(ctx, tenant, item)
+			if err != nil {
+				return nil, err
+			}
+			out[k] = resolved
+		}
+		return out, nil
+
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			resolved, err := resolveValue(ctx, tenant, item)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = resolved
+		}
+		return out, nil
+	}
+
+	return v, nil
+}
+
+type storedPayloadKey struct{}
+
+// StoredPayload returns the payload as stored, before InjectSecrets
+// resolved it into payload, for an executor that stores it again.
+func StoredPayload(ctx context.Context, payload map[string]interface{}) map[string]interface{} {
+	if stored, ok := ctx.Value(storedPayloadKey{}).(map[string]interface{}); ok {
+		return stored
+	}
+	return payload
+}
+
+// InjectSecrets decrypts the payload and resolves its secret references
+// before the job runs, using the job's tenant.
+func InjectSecrets() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, jobType string, payload map[string]interface{}) (int, []byte, error) {
+			resolved, err := ResolveSecrets(ctx, TenantFromContext(ctx), payload)
+			if err != nil {
+				return 0, nil, err
+			}
+			ctx = context.WithValue(ctx, storedPayloadKey{}, payload)
+			return next(ctx, jobType, resolved)
+		}
+	}
+}
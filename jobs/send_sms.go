@@ -0,0 +1,312 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// send_sms sends a text message:
+//
+//	{"to": "+15551234567", "body": "Your code is 123456",
+//	 "from": "+15557654321", "idempotency_key": "otp-8812"}
+//
+// The provider is "provider" or GOFLOW_SMS_PROVIDER: "twilio" (the
+// default, credentials GOFLOW_TWILIO_ACCOUNT_SID and
+// GOFLOW_TWILIO_AUTH_TOKEN, or "account_sid" and "auth_token") or
+// "vonage" (GOFLOW_VONAGE_API_KEY and GOFLOW_VONAGE_API_SECRET, or
+// "api_key" and "api_secret"). "from" defaults to GOFLOW_SMS_FROM.
+//
+// The response body records the provider's message id and the delivery
+// status it reported on acceptance; "status_callback" asks the provider to
+// post later status changes to a URL. Provider errors the sender can fix
+// (a bad number, an unsubscribed recipient, bad credentials) fail the job
+// at once; throttling and provider outages are retried.
+
+type smsMessage struct {
+	from           string
+	to             string
+	body           string
+	statusCallback string
+}
+
+// smsResult is what send_sms reports for a message.
+type smsResult struct {
+	Provider  string `json:"provider"`
+	MessageID string `json:"message_id"`
+	Status    string `json:"status"`
+	To        string `json:"to"`
+	From      string `json:"from,omitempty"`
+	Segments  int    `json:"segments,omitempty"`
+	Price     string `json:"price,omitempty"`
+	Currency  string `json:"currency,omitempty"`
+}
+
+func executeSendSMS(ctx context.Context, payload map[string]interface{}) (int, []byte, error) {
+
+	msg := smsMessage{}
+	msg.to, _ = payload["to"].(string)
+	msg.body, _ = payload["body"].(string)
+	msg.from, _ = payload["from"].(string)
+	msg.statusCallback, _ = payload["status_callback"].(string)
+
+	if msg.to == "" {
+		return 0, nil, fmt.Errorf("missing 'to'")
+	}
+	if msg.body == "" {
+		return 0, nil, fmt.Errorf("missing 'body'")
+	}
+	if msg.from == "" {
+		msg.from = os.Getenv("GOFLOW_SMS_FROM")
+	}
+	if msg.from == "" {
+		return 0, nil, Permanent(fmt.Errorf("missing 'from' and GOFLOW_SMS_FROM is not set"))
+	}
+
+	provider, _ := payload["provider"].(string)
+	if provider == "" {
+		provider = os.Getenv("GOFLOW_SMS_PROVIDER")
+	}
+	if provider == "" {
+		provider = "twilio"
+	}
+
+	var result smsResult
+	var err error
+
+	switch provider {
+	case "twilio":
+		sid := payloadOrEnv(payload, "account_sid", "GOFLOW_TWILIO_ACCOUNT_SID")
+		token := payloadOrEnv(payload, "auth_token", "GOFLOW_TWILIO_AUTH_TOKEN")
+		if sid == "" || token == "" {
+			return 0, nil, Permanent(fmt.Errorf("no credentials for %s", provider))
+		}
+		result, err = sendTwilio(ctx, sid, token, msg)
+	case "vonage":
+		key := payloadOrEnv(payload, "api_key", "GOFLOW_VONAGE_API_KEY")
+		secret := payloadOrEnv(payload, "api_secret", "GOFLOW_VONAGE_API_SECRET")
+		if key == "" || secret == "" {
+			return 0, nil, Permanent(fmt.Errorf("no credentials for %s", provider))
+		}
+		result, err = sendVonage(ctx, key, secret, msg)
+	default:
+		return 0, nil, Permanent(fmt.Errorf("unsupported provider: %s", provider))
+	}
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	jsonBytes, _ := json.Marshal(result)
+	return 200, jsonBytes, nil
+}
+
+// payloadOrEnv returns the payload's string field, else the variable.
+func payloadOrEnv(payload map[string]interface{}, field, env string) string {
+	if v, ok := payload[field].(string); ok && v != "" {
+		return v
+	}
+	return os.Getenv(env)
+}
+
+// twilioRetryable are Twilio error codes that come with a 4xx status but
+// clear up on their own.
+var twilioRetryable = map[int]bool{
+	20429: true, // too many requests
+	21611: true, // the From number's queue is full
+	30001: true, // queue overflow
+}
+
+const twilioBaseURL = "https://api.twilio.com"
+
+func sendTwilio(ctx context.Context, sid, token string, msg smsMessage) (smsResult, error) {
+
+	form := url.Values{}
+	form.Set("To", msg.to)
+	form.Set("From", msg.from)
+	form.Set("Body", msg.body)
+	if msg.statusCallback != "" {
+		form.Set("StatusCallback", msg.statusCallback)
+	}
+
+	endpoint := twilioBaseURL + "/2010-04-01/Accounts/" + url.PathEscape(sid) + "/Messages.json"
+
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return smsResult{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(sid, token)
+
+	client := &http.Client{Timeout: 30 * time.Second, Transport: transportFor(ctx, nil)}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return smsResult{}, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return smsResult{}, err
+	}
+
+	if resp.StatusCode >= 400 {
+		var e struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		}
+		json.Unmarshal(body, &e)
+
+		err := fmt.Errorf("twilio returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+		if e.Code != 0 {
+			err = fmt.Errorf("twilio error %d: %s", e.Code, e.Message)
+		}
+		if twilioRetryable[e.Code] {
+			return smsResult{}, Retryable(err)
+		}
+		return smsResult{}, ResponseError(resp, err)
+	}
+
+	var m struct {
+		SID          string  `json:"sid"`
+		Status       string  `json:"status"`
+		To           string  `json:"to"`
+		From         string  `json:"from"`
+		NumSegments  string  `json:"num_segments"`
+		Price        *string `json:"price"`
+		PriceUnit    string  `json:"price_unit"`
+		ErrorMessage *string `json:"error_message"`
+	}
+	if err := json.Unmarshal(body, &m); err != nil {
+		return smsResult{}, fmt.Errorf("twilio returned invalid JSON: %w", err)
+	}
+
+	// A message can be refused outright in the create response
+	if m.Status == "failed" || m.Status == "undelivered" {
+		reason := m.Status
+		if m.ErrorMessage != nil {
+			reason = *m.ErrorMessage
+		}
+		return smsResult{}, Permanent(fmt.Errorf("twilio message %s %s: %s", m.SID, m.Status, reason))
+	}
+
+	result := smsResult{
+		Provider:  "twilio",
+		MessageID: m.SID,
+		Status:    m.Status,
+		To:        m.To,
+		From:      m.From,
+		Currency:  m.PriceUnit,
+	}
+	fmt.Sscan(m.NumSegments, &result.Segments)
+	if m.Price != nil {
+		result.Price = *m.Price
+	}
+	return result, nil
+}
+
+// vonageRetryable are Vonage SMS API status codes for failures that clear
+// up on their own: throttling, an internal error, too many binds.
+var vonageRetryable = map[string]bool{"1": true, "5": true, "10": true}
+
+const vonageBaseURL = "https://rest.nexmo.com"
+
+func sendVonage(ctx context.Context, key, secret string, msg smsMessage) (smsResult, error) {
+
+	form := url.Values{}
+	form.Set("api_key", key)
+	form.Set("api_secret", secret)
+	form.Set("from", strings.TrimPrefix(msg.from, "+"))
+	form.Set("to", strings.TrimPrefix(msg.to, "+"))
+	form.Set("text", msg.body)
+	// Plain GSM text fits 160 characters a part, unicode only 70
+	if strings.IndexFunc(msg.body, func(r rune) bool { return r > 0x7f }) >= 0 {
+		form.Set("type", "unicode")
+	}
+	if msg.statusCallback != "" {
+		form.Set("callback", msg.statusCallback)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", vonageBaseURL+"/sms/json", strings.NewReader(form.Encode()))
+	if err != nil {
+		return smsResult{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	client := &http.Client{Timeout: 30 * time.Second, Transport: transportFor(ctx, nil)}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return smsResult{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return smsResult{}, ResponseError(resp, fmt.Errorf("vonage returned status %d: %s", resp.StatusCode, msg))
+	}
+
+	// Errors come back with a 200 and a status per message part
+	var r struct {
+		Messages []struct {
+			Status    string `json:"status"`
+			MessageID string `json:"message-id"`
+			To        string `json:"to"`
+			Price     string `json:"message-price"`
+			ErrorText string `json:"error-text"`
+		} `json:"messages"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return smsResult{}, fmt.Errorf("vonage returned invalid JSON: %w", err)
+	}
+	if len(r.Messages) == 0 {
+		return smsResult{}, fmt.Errorf("vonage returned no messages")
+	}
+
+	// A long message goes out in parts; once one is sent, a retry would
+	// send it twice
+	sent := false
+	for _, m := range r.Messages {
+		sent = sent || m.Status == "0"
+	}
+
+	for _, m := range r.Messages {
+		if m.Status == "0" {
+			continue
+		}
+		err := fmt.Errorf("vonage status %s: %s", m.Status, m.ErrorText)
+		if vonageRetryable[m.Status] && !sent {
+			return smsResult{}, Retryable(err)
+		}
+		return smsResult{}, Permanent(err)
+	}
+
+	// The first part's id identifies the message; the price covers them
+	// all, in the account's currency
+	var total float64
+	for _, m := range r.Messages {
+		var p float64
+		fmt.Sscan(m.Price, &p)
+		total += p
+	}
+
+	result := smsResult{
+		Provider:  "vonage",
+		MessageID: r.Messages[0].MessageID,
+		Status:    "submitted",
+		To:        r.Messages[0].To,
+		From:      msg.from,
+		Segments:  len(r.Messages),
+	}
+	if total > 0 {
+		result.Price = fmt.Sprintf("%.8f", total)
+	}
+	return result, nil
+}
@@ -0,0 +1,232 @@
+package jobs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Sensitive payload fields are encrypted before the job is stored and
+// only decrypted by InjectSecrets, on the copy of the payload an executor
+// gets. An encrypted field is a string holding the value's JSON, sealed
+// with the secrets key:
+//
+//	{"url": "https://api.example.com", "api_key": "encrypted:v1:3q2+7w..."}
+//
+// Anything shown outside the server replaces it with "[redacted]".
+
+// EncryptedPrefix marks a payload value that is encrypted at rest.
+const EncryptedPrefix = "encrypted:v1:"
+
+// Redacted stands in for encrypted values in API responses.
+const Redacted = "[redacted]"
+
+// defaultSensitiveFields are encrypted in every payload that has them,
+// whatever the job type: the credential fields executors read.
+var defaultSensitiveFields = []string{
+	"api_key", "secret", "webhook_secret", "callback_secret",
+	"api_secret", "auth_token", "credentials", "private_key",
+	"secret_access_key", "session_token",
+}
+
+// payloadAD keeps sealed payload values apart from sealed secrets.
+var payloadAD = []byte("payload")
+
+// SensitiveFields returns the payload paths to encrypt for a job that
+// marks extra as sensitive.
+func SensitiveFields(extra []string) []string {
+	return append(append([]string{}, defaultSensitiveFields...), extra...)
+}
+
+// IsEncrypted reports whether v is an encrypted payload value.
+func IsEncrypted(v string) bool {
+	return strings.HasPrefix(v, EncryptedPrefix)
+}
+
+// EncryptFields encrypts, in place, the payload values at the given
+// dot-separated paths ("headers.Authorization"). Paths that are absent
+// and values that are already encrypted are left alone.
+func EncryptFields(payload map[string]interface{}, paths []string) error {
+
+	if secretsAEAD == nil {
+		return ErrNoSecretsKey
+	}
+
+	for _, path := range paths {
+		parts := strings.Split(path, ".")
+
+		obj := payload
+		for _, p := range parts[:len(parts)-1] {
+			next, ok := obj[p].(map[string]interface{})
+			if !ok {
+				obj = nil
+				break
+			}
+			obj = next
+		}
+
+		last := parts[len(parts)-1]
+		v, ok := obj[last]
+		if !ok || v == nil {
+			continue
+		}
+		if s, ok := v.(string); ok && IsEncrypted(s) {
+			continue
+		}
+
+		sealed, err := encryptValue(v)
+		if err != nil {
+			return err
+		}
+		obj[last] = sealed
+	}
+
+	return nil
+}
+
+// EncryptPayload encrypts the payload's credential fields and the paths
+// in sensitive, then the credential fields of every job definition it
+// holds (next_job, on_success, workflow steps and their branches, ...),
+// so the jobs made from them are stored encrypted too.
+func EncryptPayload(payload map[string]interface{}, sensitive []string) error {
+
+	if err := EncryptFields(payload, SensitiveFields(sensitive)); err != nil {
+		return err
+	}
+	for k, v := range payload {
+		if templateFields[k] {
+			if err := encryptTemplates(v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// encryptTemplates encrypts the payloads of the job definitions in v, a
+// template field's value: one definition or a list of them.
+func encryptTemplates(v interface{}) error {
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if p, ok := v["payload"].(map[string]interface{}); ok {
+			if err := EncryptPayload(p, nil); err != nil {
+				return err
+			}
+		}
+		for k, item := range v {
+			if templateFields[k] || k == "branches" {
+				if err := encryptTemplates(item); err != nil {
+					return err
+				}
+			}
+		}
+
+	case []interface{}:
+		for _, item := range v {
+			if err := encryptTemplates(item); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// SealPayload encrypts the credential fields of a payload the server
+// writes itself, such as a follow-up job or a workflow step, which may
+// hold values resolved or interpolated at run time. Without a secrets key
+// it does nothing.
+func SealPayload(payload map[string]interface{}) error {
+	if !SecretsEnabled() {
+		return nil
+	}
+	return EncryptPayload(payload, nil)
+}
+
+func encryptValue(v interface{}) (string, error) {
+
+	plain, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, secretsAEAD.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := secretsAEAD.Seal(nonce, nonce, plain, payloadAD)
+	return EncryptedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func decryptValue(v string) (interface{}, error) {
+
+	if secretsAEAD == nil {
+		return nil, fmt.Errorf("payload has encrypted values: %w", ErrNoSecretsKey)
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(v, EncryptedPrefix))
+	n := secretsAEAD.NonceSize()
+	if err != nil || len(sealed) < n {
+		return nil, fmt.Errorf("encrypted payload value is corrupt")
+	}
+
+	plain, err := secretsAEAD.Open(nil, sealed[:n], sealed[n:], payloadAD)
+	if err != nil {
+		return nil, fmt.Errorf("encrypted payload value cannot be decrypted with this key")
+	}
+
+	var out interface{}
+	return out, json.Unmarshal(plain, &out)
+}
+
+// RedactPayload returns a copy of payload with encrypted values replaced
+// by Redacted.
+func RedactPayload(payload map[string]interface{}) map[string]interface{} {
+	if payload == nil {
+		return nil
+	}
+	return redactValue(payload).(map[string]interface{})
+}
+
+func redactValue(v interface{}) interface{} {
+
+	switch v := v.(type) {
+	case string:
+		if IsEncrypted(v) {
+			return Redacted
+		}
+
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			out[k] = redactValue(item)
+		}
+		return out
+
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			out[i] = redactValue(item)
+		}
+		return out
+	}
+
+	return v
+}
+
+// encryptedJSON matches an encrypted value in a JSON document.
+var encryptedJSON = regexp.MustCompile(`"` + EncryptedPrefix + `[A-Za-z0-9+/=]*"`)
+
+// RedactJSON redacts a JSON document, such as a stored payload or an
+// exported row, leaving everything else as it was.
+func RedactJSON(doc []byte) []byte {
+	if !bytes.Contains(doc, []byte(EncryptedPrefix)) {
+		return doc
+	}
+	return encryptedJSON.ReplaceAll(doc, []byte(`"`+Redacted+`"`))
+}
@@ -0,0 +1,55 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// isPublicIP reports whether ip is routable on the public internet, i.e. not
+// loopback, private, link-local (cloud metadata) or otherwise special.
+func isPublicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() ||
+		ip.IsPrivate() ||
+		ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast() ||
+		ip.IsUnspecified())
+}
+
+// newGuardedHTTPClient returns a client that refuses to connect to
+// non-public addresses. The check runs on the resolved address at dial
+// time, so DNS rebinding cannot sneak a private IP past it.
+func newGuardedHTTPClient(ctx context.Context, timeout time.Duration) *http.Client {
+
+	dialer := &net.Dialer{
+		Timeout: 5 * time.Second,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || !isPublicIP(ip) {
+				return fmt.Errorf("destination %s is not allowed", host)
+			}
+			return nil
+		},
+	}
+
+	transport := &http.Transport{
+		Proxy: nil,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}
+
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transportFor(ctx, transport),
+	}
+}
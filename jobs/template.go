@@ -0,0 +1,120 @@
+package jobs
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// RenderTemplate fills {{path}} placeholders in a job template from data,
+// such as {{body.repository.full_name}} for an inbound webhook. Like job
+// output references, a string that is one placeholder takes the value
+// with its JSON type, and inside longer text the value is written as
+// text. A path with no value renders as null, or as nothing inside text.
+//
+// data usually comes from outside, so a value that is a secret reference
+// or an output placeholder is refused: the payload would resolve it later.
+func RenderTemplate(template interface{}, data map[string]interface{}) (interface{}, error) {
+
+	switch t := template.(type) {
+	case string:
+		return renderString(t, data)
+
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(t))
+		for k, item := range t {
+			v, err := RenderTemplate(item, data)
+			if err != nil {
+				return nil, err
+			}
+			out[k] = v
+		}
+		return out, nil
+
+	case []interface{}:
+		out := make([]interface{}, len(t))
+		for i, item := range t {
+			v, err := RenderTemplate(item, data)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = v
+		}
+		return out, nil
+	}
+
+	return template, nil
+}
+
+var templatePlaceholder = regexp.MustCompile(`\{\{\s*([^{}\s]+)\s*\}\}`)
+
+func renderString(s string, data map[string]interface{}) (interface{}, error) {
+
+	matches := templatePlaceholder.FindAllStringSubmatchIndex(s, -1)
+	if len(matches) == 0 {
+		return s, nil
+	}
+
+	lookup := func(path string) (interface{}, error) {
+		v, _ := lookupJSONPath(data, path)
+		if err := checkUntrusted(v); err != nil {
+			return nil, fmt.Errorf("{{%s}}: %w", path, err)
+		}
+		return v, nil
+	}
+
+	if len(matches) == 1 && matches[0][0] == 0 && matches[0][1] == len(s) {
+		return lookup(s[matches[0][2]:matches[0][3]])
+	}
+
+	var b strings.Builder
+	last := 0
+	for _, m := range matches {
+		v, err := lookup(s[m[2]:m[3]])
+		if err != nil {
+			return nil, err
+		}
+		b.WriteString(s[last:m[0]])
+		b.WriteString(outputText(v))
+		last = m[1]
+	}
+	b.WriteString(s[last:])
+
+	// Values can also add up to one with the text around them
+	out := b.String()
+	if (IsSecretRef(out) && !IsSecretRef(s)) || (outputPlaceholder.MatchString(out) && !outputPlaceholder.MatchString(s)) {
+		return nil, fmt.Errorf("%q renders as a reference", s)
+	}
+	return out, nil
+}
+
+// checkUntrusted refuses strings, at any depth, that the worker would
+// resolve before running the job.
+func checkUntrusted(v interface{}) error {
+
+	switch v := v.(type) {
+	case string:
+		if IsSecretRef(v) || IsEncrypted(v) {
+			return fmt.Errorf("value looks like a secret reference")
+		}
+		if outputPlaceholder.MatchString(v) {
+			return fmt.Errorf("value contains a job output placeholder")
+		}
+
+	case map[string]interface{}:
+		for _, item := range v {
+			if err := checkUntrusted(item); err != nil {
+				return err
+			}
+		}
+
+	case []interface{}:
+		for _, item := range v {
+			if err := checkUntrusted(item); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
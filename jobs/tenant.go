@@ -0,0 +1,27 @@
+package jobs
+
+import "context"
+
+type tenantKey struct{}
+
+// WithTenant records the tenant of the job being executed on ctx, so jobs
+// it starts belong to the same tenant.
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// TenantFromContext returns the tenant of the job being executed, or ""
+// outside a worker.
+func TenantFromContext(ctx context.Context) string {
+	t, _ := ctx.Value(tenantKey{}).(string)
+	return t
+}
+
+// tenantOrDefault is TenantFromContext, with the default tenant outside a
+// worker, for scoping queries.
+func tenantOrDefault(ctx context.Context) string {
+	if t := TenantFromContext(ctx); t != "" {
+		return t
+	}
+	return "default"
+}
@@ -0,0 +1,358 @@
+package jobs
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// transcode_media converts audio or video with ffmpeg:
+//
+//	{"source": "https://cdn.example.com/raw/talk.mov",
+//	 "outputs": [
+//	   {"format": "mp4", "video_codec": "libx264", "crf": 23, "scale": "1280:-2",
+//	    "upload": {"url": "https://bucket.s3.amazonaws.com/talk-720p.mp4?X-Amz-..."}},
+//	   {"format": "mp3", "audio_bitrate": "128k",
+//	    "upload": {"url": "https://bucket.s3.amazonaws.com/talk.mp3?X-Amz-..."}}]}
+//
+// The source is downloaded once and every output is encoded from it in
+// turn. Progress is written to the job log every 10%. Only the options
+// below are passed to ffmpeg; payloads cannot inject arbitrary arguments.
+//
+// GOFLOW_FFMPEG_PATH points at a bundled binary; otherwise ffmpeg is
+// looked up on PATH. GOFLOW_TRANSCODE_MAX_BYTES caps the source size
+// (default 2 GiB).
+
+const defaultTranscodeMaxBytes = 2 << 30
+
+var (
+	ffmpegDuration = regexp.MustCompile(`Duration: (\d+):(\d+):(\d+(?:\.\d+)?)`)
+	ffmpegBitrate  = regexp.MustCompile(`^\d+(\.\d+)?[kKmM]?$`)
+	ffmpegScale    = regexp.MustCompile(`^-?\d+:-?\d+$`)
+	ffmpegName     = regexp.MustCompile(`^[a-z0-9_]+$`)
+)
+
+type transcodeOutput struct {
+	Format       string `json:"format"`
+	VideoCodec   string `json:"video_codec,omitempty"`
+	AudioCodec   string `json:"audio_codec,omitempty"`
+	VideoBitrate string `json:"video_bitrate,omitempty"`
+	AudioBitrate string `json:"audio_bitrate,omitempty"`
+	CRF          *int   `json:"crf,omitempty"`
+	Preset       string `json:"preset,omitempty"`
+	Scale        string `json:"scale,omitempty"`
+	NoVideo      bool   `json:"no_video,omitempty"`
+	NoAudio      bool   `json:"no_audio,omitempty"`
+
+	Upload map[string]interface{} `json:"upload"`
+}
+
+// args validates the output and turns it into ffmpeg output options.
+func (o transcodeOutput) args() ([]string, error) {
+
+	if !ffmpegName.MatchString(o.Format) {
+		return nil, fmt.Errorf("invalid format %q", o.Format)
+	}
+
+	var args []string
+
+	for _, opt := range []struct{ flag, value string }{
+		{"-c:v", o.VideoCodec}, {"-c:a", o.AudioCodec}, {"-preset", o.Preset},
+	} {
+		if opt.value == "" {
+			continue
+		}
+		if !ffmpegName.MatchString(opt.value) {
+			return nil, fmt.Errorf("invalid %s %q", opt.flag, opt.value)
+		}
+		args = append(args, opt.flag, opt.value)
+	}
+
+	for _, opt := range []struct{ flag, value string }{
+		{"-b:v", o.VideoBitrate}, {"-b:a", o.AudioBitrate},
+	} {
+		if opt.value == "" {
+			continue
+		}
+		if !ffmpegBitrate.MatchString(opt.value) {
+			return nil, fmt.Errorf("invalid %s %q", opt.flag, opt.value)
+		}
+		args = append(args, opt.flag, opt.value)
+	}
+
+	if o.CRF != nil {
+		if *o.CRF < 0 || *o.CRF > 63 {
+			return nil, fmt.Errorf("crf must be between 0 and 63")
+		}
+		args = append(args, "-crf", strconv.Itoa(*o.CRF))
+	}
+
+	if o.Scale != "" {
+		if !ffmpegScale.MatchString(o.Scale) {
+			return nil, fmt.Errorf("scale must look like 1280:-2")
+		}
+		args = append(args, "-vf", "scale="+o.Scale)
+	}
+
+	if o.NoVideo {
+		args = append(args, "-vn")
+	}
+	if o.NoAudio {
+		args = append(args, "-an")
+	}
+
+	return append(args, "-f", ffmpegMuxer(o.Format)), nil
+}
+
+// ffmpegMuxer maps file extensions to muxer names where they differ.
+func ffmpegMuxer(format string) string {
+	switch format {
+	case "m4a":
+		return "ipod"
+	case "mkv":
+		return "matroska"
+	case "ts":
+		return "mpegts"
+	}
+	return format
+}
+
+func executeTranscodeMedia(ctx context.Context, payload map[string]interface{}) (int, []byte, error) {
+
+	source, ok := payload["source"].(string)
+	if !ok || source == "" {
+		return 0, nil, fmt.Errorf("missing 'source'")
+	}
+
+	var outputs []transcodeOutput
+	raw, _ := json.Marshal(payload["outputs"])
+	if err := json.Unmarshal(raw, &outputs); err != nil || len(outputs) == 0 {
+		return 0, nil, fmt.Errorf("missing 'outputs'")
+	}
+
+	outputArgs := make([][]string, len(outputs))
+	for i, o := range outputs {
+		args, err := o.args()
+		if err != nil {
+			return 0, nil, fmt.Errorf("output %d: %w", i, err)
+		}
+		if o.Upload == nil {
+			return 0, nil, fmt.Errorf("output %d: missing 'upload'", i)
+		}
+		outputArgs[i] = args
+	}
+
+	ffmpeg := os.Getenv("GOFLOW_FFMPEG_PATH")
+	if ffmpeg == "" {
+		path, err := exec.LookPath("ffmpeg")
+		if err != nil {
+			return 0, nil, fmt.Errorf("ffmpeg not found; install it or set GOFLOW_FFMPEG_PATH")
+		}
+		ffmpeg = path
+	}
+
+	dir, err := os.MkdirTemp("", "goflow-transcode-")
+	if err != nil {
+		return 0, nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	input := filepath.Join(dir, "source")
+	size, err := downloadMedia(ctx, source, input)
+	if err != nil {
+		return 0, nil, err
+	}
+	jobLog(ctx, "downloaded %s (%d bytes)", source, size)
+
+	results := []map[string]interface{}{}
+
+	for i, o := range outputs {
+		output := filepath.Join(dir, fmt.Sprintf("output-%d.%s", i, o.Format))
+
+		jobLog(ctx, "output %d: encoding %s", i, o.Format)
+
+		started := time.Now()
+		if err := runFFmpeg(ctx, ffmpeg, input, output, outputArgs[i], i); err != nil {
+			return 0, nil, fmt.Errorf("output %d: %w", i, err)
+		}
+
+		f, err := os.Open(output)
+		if err != nil {
+			return 0, nil, err
+		}
+		info, _ := f.Stat()
+
+		contentType := mime.TypeByExtension("." + o.Format)
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+
+		jobLog(ctx, "output %d: uploading %d bytes", i, info.Size())
+
+		status, err := uploadStream(ctx, o.Upload, f, info.Size(), contentType)
+		f.Close()
+		if err != nil {
+			return 0, nil, fmt.Errorf("output %d: %w", i, err)
+		}
+
+		results = append(results, map[string]interface{}{
+			"format":        o.Format,
+			"bytes":         info.Size(),
+			"encode_ms":     time.Since(started).Milliseconds(),
+			"upload_status": status,
+		})
+	}
+
+	jsonBytes, _ := json.Marshal(map[string]interface{}{
+		"source":       source,
+		"source_bytes": size,
+		"outputs":      results,
+	})
+	return 200, jsonBytes, nil
+}
+
+func downloadMedia(ctx context.Context, source, path string) (int64, error) {
+
+	maxBytes := int64(defaultTranscodeMaxBytes)
+	if v, err := strconv.ParseInt(os.Getenv("GOFLOW_TRANSCODE_MAX_BYTES"), 10, 64); err == nil && v > 0 {
+		maxBytes = v
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", source, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := (&http.Client{Transport: transportFor(ctx, nil)}).Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return 0, fmt.Errorf("source returned status %d", resp.StatusCode)
+	}
+	if resp.ContentLength > maxBytes {
+		return 0, fmt.Errorf("source is %d bytes, over the %d byte limit", resp.ContentLength, maxBytes)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	n, err := io.Copy(f, io.LimitReader(resp.Body, maxBytes+1))
+	if err != nil {
+		return n, err
+	}
+	if n > maxBytes {
+		return n, fmt.Errorf("source is over the %d byte limit", maxBytes)
+	}
+
+	return n, nil
+}
+
+// runFFmpeg encodes input to output, logging progress at every 10%. The
+// total duration comes from ffmpeg's own banner on stderr; progress from
+// the machine-readable -progress stream on stdout.
+func runFFmpeg(ctx context.Context, ffmpeg, input, output string, outputArgs []string, index int) error {
+
+	args := []string{"-hide_banner", "-nostdin", "-y", "-i", input, "-progress", "pipe:1", "-nostats"}
+	args = append(args, outputArgs...)
+	args = append(args, output)
+
+	cmd := exec.CommandContext(ctx, ffmpeg, args...)
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	durationCh := make(chan float64, 1)
+	var lastLines []string
+	stderrDone := make(chan struct{})
+
+	go func() {
+		defer close(stderrDone)
+		found := false
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if m := ffmpegDuration.FindStringSubmatch(line); m != nil && !found {
+				h, _ := strconv.ParseFloat(m[1], 64)
+				mins, _ := strconv.ParseFloat(m[2], 64)
+				secs, _ := strconv.ParseFloat(m[3], 64)
+				durationCh <- h*3600 + mins*60 + secs
+				found = true
+			}
+			// Errors are at the end of the output
+			lastLines = append(lastLines, line)
+			if len(lastLines) > 10 {
+				lastLines = lastLines[1:]
+			}
+		}
+	}()
+
+	var duration float64
+	nextReport := 10
+
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok || key != "out_time_us" {
+			continue
+		}
+
+		if duration == 0 {
+			select {
+			case duration = <-durationCh:
+			default:
+			}
+		}
+		if duration == 0 {
+			continue
+		}
+
+		us, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			continue
+		}
+		percent := int(us / 1e6 / duration * 100)
+		for percent >= nextReport && nextReport < 100 {
+			jobLog(ctx, "output %d: %d%%", index, nextReport)
+			nextReport += 10
+		}
+	}
+
+	<-stderrDone
+
+	if err := cmd.Wait(); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("ffmpeg failed: %v: %s", err, strings.Join(lastLines, "\n"))
+	}
+
+	jobLog(ctx, "output %d: done", index)
+	return nil
+}
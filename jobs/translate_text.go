@@ -0,0 +1,314 @@
+package jobs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// translate_text translates one text or a batch:
+//
+//	{"texts": ["Hello", "Goodbye"], "target_lang": "de", "source_lang": "en",
+//	 "provider": "deepl", "glossary": {"GoFlow": "GoFlow", "job": "Auftrag"}}
+//
+// "text" takes a single string, which a workflow can fill from an earlier
+// step ("{{steps.draft.response.content}}"). Without "source_lang" the
+// provider detects it and the detected language is reported per text.
+//
+// The provider is "provider" or GOFLOW_TRANSLATE_PROVIDER: "deepl" (the
+// default, key GOFLOW_DEEPL_KEY) or "google" (Cloud Translation v2, key
+// GOFLOW_GOOGLE_TRANSLATE_KEY). "api_key" overrides either. DeepL
+// glossaries can be referenced with "glossary_id". An inline "glossary"
+// works with both providers: each source term is replaced by its fixed
+// translation and marked as not to be translated.
+
+// Texts per request; the APIs cap these at 50 (DeepL) and 128 (Google)
+const (
+	deeplBatchSize  = 50
+	googleBatchSize = 128
+)
+
+type translation struct {
+	Text           string `json:"text"`
+	DetectedSource string `json:"detected_source_lang,omitempty"`
+}
+
+type translateRequest struct {
+	texts      []string
+	source     string
+	target     string
+	glossaryID string
+	markup     bool
+	apiKey     string
+}
+
+func executeTranslateText(ctx context.Context, payload map[string]interface{}) (int, []byte, error) {
+
+	texts := stringList(payload["texts"])
+	single := false
+	if t, ok := payload["text"].(string); ok && t != "" {
+		texts = []string{t}
+		single = true
+	}
+	if len(texts) == 0 {
+		return 0, nil, fmt.Errorf("missing 'text' or 'texts'")
+	}
+
+	target, ok := payload["target_lang"].(string)
+	if !ok || target == "" {
+		return 0, nil, fmt.Errorf("missing 'target_lang'")
+	}
+
+	provider, _ := payload["provider"].(string)
+	if provider == "" {
+		provider = os.Getenv("GOFLOW_TRANSLATE_PROVIDER")
+	}
+	if provider == "" {
+		provider = "deepl"
+	}
+
+	req := translateRequest{target: target}
+	req.source, _ = payload["source_lang"].(string)
+	req.glossaryID, _ = payload["glossary_id"].(string)
+	req.apiKey, _ = payload["api_key"].(string)
+
+	if req.glossaryID != "" && (provider != "deepl" || req.source == "") {
+		return 0, nil, fmt.Errorf("'glossary_id' needs the deepl provider and 'source_lang'")
+	}
+
+	var glossary map[string]string
+	if g, ok := payload["glossary"].(map[string]interface{}); ok && len(g) > 0 {
+		glossary = map[string]string{}
+		for term, v := range g {
+			if s, ok := v.(string); ok && term != "" {
+				glossary[term] = s
+			}
+		}
+	}
+
+	var translate func(context.Context, translateRequest) ([]translation, error)
+	batchSize := 0
+
+	switch provider {
+	case "deepl":
+		translate, batchSize = translateDeepL, deeplBatchSize
+		if req.apiKey == "" {
+			req.apiKey = os.Getenv("GOFLOW_DEEPL_KEY")
+		}
+	case "google":
+		translate, batchSize = translateGoogle, googleBatchSize
+		if req.apiKey == "" {
+			req.apiKey = os.Getenv("GOFLOW_GOOGLE_TRANSLATE_KEY")
+		}
+	default:
+		return 0, nil, fmt.Errorf("unsupported provider: %s", provider)
+	}
+
+	if req.apiKey == "" {
+		return 0, nil, fmt.Errorf("no API key for %s", provider)
+	}
+
+	input := texts
+	if glossary != nil {
+		req.markup = true
+		input = make([]string, len(texts))
+		for i, t := range texts {
+			input[i] = protectTerms(provider, t, glossary)
+		}
+	}
+
+	results := make([]translation, 0, len(texts))
+
+	for start := 0; start < len(input); start += batchSize {
+		end := min(start+batchSize, len(input))
+
+		batch := req
+		batch.texts = input[start:end]
+
+		out, err := translate(ctx, batch)
+		if err != nil {
+			return 0, nil, err
+		}
+		if len(out) != len(batch.texts) {
+			return 0, nil, fmt.Errorf("%s returned %d translations for %d texts", provider, len(out), len(batch.texts))
+		}
+
+		if req.markup {
+			for i := range out {
+				out[i].Text = unprotectTerms(out[i].Text)
+			}
+		}
+		results = append(results, out...)
+	}
+
+	result := map[string]interface{}{
+		"provider":     provider,
+		"target_lang":  target,
+		"translations": results,
+	}
+	if single {
+		result["text"] = results[0].Text
+		result["detected_source_lang"] = results[0].DetectedSource
+	}
+
+	jsonBytes, _ := json.Marshal(result)
+	return 200, jsonBytes, nil
+}
+
+func translateDeepL(ctx context.Context, r translateRequest) ([]translation, error) {
+
+	// Free-plan keys end in ":fx" and use a separate host
+	endpoint := "https://api.deepl.com/v2/translate"
+	if strings.HasSuffix(r.apiKey, ":fx") {
+		endpoint = "https://api-free.deepl.com/v2/translate"
+	}
+
+	body := map[string]interface{}{
+		"text":        r.texts,
+		"target_lang": strings.ToUpper(r.target),
+	}
+	if r.source != "" {
+		body["source_lang"] = strings.ToUpper(r.source)
+	}
+	if r.glossaryID != "" {
+		body["glossary_id"] = r.glossaryID
+	}
+	if r.markup {
+		body["tag_handling"] = "xml"
+		body["ignore_tags"] = []string{"x"}
+	}
+
+	bodyBytes, _ := json.Marshal(body)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(bodyBytes))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "DeepL-Auth-Key "+r.apiKey)
+
+	var resp struct {
+		Translations []struct {
+			Text                   string `json:"text"`
+			DetectedSourceLanguage string `json:"detected_source_language"`
+		} `json:"translations"`
+	}
+	if err := doTranslateRequest(req, "deepl", &resp); err != nil {
+		return nil, err
+	}
+
+	out := make([]translation, len(resp.Translations))
+	for i, t := range resp.Translations {
+		out[i] = translation{Text: t.Text, DetectedSource: strings.ToLower(t.DetectedSourceLanguage)}
+	}
+	return out, nil
+}
+
+func translateGoogle(ctx context.Context, r translateRequest) ([]translation, error) {
+
+	format := "text"
+	if r.markup {
+		format = "html"
+	}
+
+	body := map[string]interface{}{
+		"q":      r.texts,
+		"target": strings.ToLower(r.target),
+		"format": format,
+	}
+	if r.source != "" {
+		body["source"] = strings.ToLower(r.source)
+	}
+
+	bodyBytes, _ := json.Marshal(body)
+
+	endpoint := "https://translation.googleapis.com/language/translate/v2?key=" + url.QueryEscape(r.apiKey)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(bodyBytes))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	var resp struct {
+		Data struct {
+			Translations []struct {
+				TranslatedText         string `json:"translatedText"`
+				DetectedSourceLanguage string `json:"detectedSourceLanguage"`
+			} `json:"translations"`
+		} `json:"data"`
+	}
+	if err := doTranslateRequest(req, "google", &resp); err != nil {
+		return nil, err
+	}
+
+	out := make([]translation, len(resp.Data.Translations))
+	for i, t := range resp.Data.Translations {
+		text := t.TranslatedText
+		// Google escapes HTML entities even in text mode
+		if !r.markup {
+			text = html.UnescapeString(text)
+		}
+		out[i] = translation{Text: text, DetectedSource: t.DetectedSourceLanguage}
+	}
+	return out, nil
+}
+
+func doTranslateRequest(req *http.Request, provider string, out interface{}) error {
+
+	client := &http.Client{Timeout: 30 * time.Second, Transport: transportFor(req.Context(), nil)}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s returned status %d: %s", provider, resp.StatusCode, msg)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// protectTerms escapes text for the provider's markup mode and replaces
+// each glossary term, longest first and on word boundaries, with its
+// translation wrapped in a tag the provider leaves untranslated.
+func protectTerms(provider, text string, glossary map[string]string) string {
+
+	terms := make([]string, 0, len(glossary))
+	for term := range glossary {
+		terms = append(terms, regexp.QuoteMeta(html.EscapeString(term)))
+	}
+	sort.Slice(terms, func(i, j int) bool { return len(terms[i]) > len(terms[j]) })
+
+	escaped := html.EscapeString(text)
+	pattern := regexp.MustCompile(`\b(` + strings.Join(terms, "|") + `)\b`)
+
+	openTag, closeTag := "<x>", "</x>"
+	if provider == "google" {
+		openTag, closeTag = `<span translate="no">`, "</span>"
+	}
+
+	return pattern.ReplaceAllStringFunc(escaped, func(match string) string {
+		return openTag + html.EscapeString(glossary[html.UnescapeString(match)]) + closeTag
+	})
+}
+
+var protectTagPattern = regexp.MustCompile(`</?x>|<span translate="no">|</span>`)
+
+// unprotectTerms strips the glossary tags and the markup escaping.
+func unprotectTerms(text string) string {
+	return html.UnescapeString(protectTagPattern.ReplaceAllString(text, ""))
+}
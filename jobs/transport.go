@@ -0,0 +1,28 @@
+package jobs
+
+import (
+	"context"
+	"net/http"
+)
+
+type transportKey struct{}
+
+// WithTransport makes the executors running under ctx send their requests
+// through wrap, which is handed the transport they would otherwise use.
+// The test-job command puts its cassette in front of every executor this
+// way, without swapping http.DefaultTransport under running workers.
+func WithTransport(ctx context.Context, wrap func(http.RoundTripper) http.RoundTripper) context.Context {
+	return context.WithValue(ctx, transportKey{}, wrap)
+}
+
+// transportFor returns the transport an executor should use under ctx:
+// base (http.DefaultTransport when nil), wrapped if WithTransport was used.
+func transportFor(ctx context.Context, base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if wrap, ok := ctx.Value(transportKey{}).(func(http.RoundTripper) http.RoundTripper); ok {
+		return wrap(base)
+	}
+	return base
+}
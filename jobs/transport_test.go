@@ -0,0 +1,47 @@
+package jobs
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func TestWithTransportReachesEveryClient(t *testing.T) {
+
+	var seen []string
+	ctx := WithTransport(context.Background(), func(base http.RoundTripper) http.RoundTripper {
+		return roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			seen = append(seen, req.URL.String())
+			return &http.Response{
+				StatusCode: 200,
+				Body:       io.NopCloser(strings.NewReader("canned")),
+				Request:    req,
+			}, nil
+		})
+	})
+
+	status, body, err := executeHTTPRequest(ctx, map[string]interface{}{"url": "http://example.invalid/a"})
+	if err != nil || status != 200 || string(body) != "canned" {
+		t.Errorf("http_request: %d %q %v, want the canned response", status, body, err)
+	}
+
+	// The guarded client builds its own transport, and would refuse this
+	// address if it dialled
+	req, _ := http.NewRequestWithContext(ctx, "GET", "http://127.0.0.1:1/b", nil)
+	resp, err := newGuardedHTTPClient(ctx, time.Second).Do(req)
+	if err != nil {
+		t.Fatalf("guarded client: %v", err)
+	}
+	resp.Body.Close()
+
+	if len(seen) != 2 {
+		t.Errorf("the wrapper saw %v, want both requests", seen)
+	}
+}
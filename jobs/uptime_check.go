@@ -0,0 +1,208 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// uptime_check requests a URL once and records the outcome in
+// uptime_checks. Schedule it with cron_schedule to monitor a site:
+//
+//	{"url": "https://example.com/health", "expected_status": 200,
+//	 "failure_threshold": 3, "webhook_url": "https://hooks.example.com/uptime"}
+//
+// A monitor (named by "monitor", default the URL) goes down after
+// failure_threshold consecutive failed checks and up again after one
+// success. Each transition enqueues a webhook_delivery with the event
+// "uptime.incident" or "uptime.recovery". A failed check is a successful
+// job: the failure is data, not something to retry.
+
+type uptimeResult struct {
+	Monitor             string `json:"monitor"`
+	URL                 string `json:"url"`
+	OK                  bool   `json:"ok"`
+	StatusCode          int    `json:"status_code,omitempty"`
+	LatencyMs           int64  `json:"latency_ms"`
+	Error               string `json:"error,omitempty"`
+	State               string `json:"state"`
+	ConsecutiveFailures int    `json:"consecutive_failures"`
+	Changed             bool   `json:"changed"`
+}
+
+func executeUptimeCheck(ctx context.Context, payload map[string]interface{}) (int, []byte, error) {
+
+	target, ok := payload["url"].(string)
+	if !ok || target == "" {
+		return 0, nil, fmt.Errorf("missing url")
+	}
+
+	monitor, _ := payload["monitor"].(string)
+	if monitor == "" {
+		monitor = target
+	}
+
+	method := "GET"
+	if m, ok := payload["method"].(string); ok && m != "" {
+		method = m
+	}
+
+	timeout := 10 * time.Second
+	if t, ok := payload["timeout_seconds"].(float64); ok && t > 0 {
+		timeout = time.Duration(t * float64(time.Second))
+	}
+
+	threshold := 1
+	if t, ok := payload["failure_threshold"].(float64); ok && t >= 1 {
+		threshold = int(t)
+	}
+
+	expected, _ := payload["expected_status"].(float64)
+
+	result := uptimeResult{Monitor: monitor, URL: target}
+
+	client := &http.Client{
+		Timeout: timeout,
+		// Each check measures a fresh connection, not a pooled one
+		Transport: transportFor(ctx, &http.Transport{DisableKeepAlives: true}),
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, target, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("User-Agent", "GoFlow uptime_check")
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	result.LatencyMs = time.Since(start).Milliseconds()
+
+	if ctx.Err() != nil {
+		return 0, nil, ctx.Err()
+	}
+
+	if err != nil {
+		result.Error = err.Error()
+	} else {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+		resp.Body.Close()
+
+		result.StatusCode = resp.StatusCode
+		if expected > 0 {
+			result.OK = resp.StatusCode == int(expected)
+		} else {
+			result.OK = resp.StatusCode < 400
+		}
+		if !result.OK {
+			result.Error = fmt.Sprintf("unexpected status %d", resp.StatusCode)
+		}
+	}
+
+	if err := recordUptimeCheck(ctx, &result, threshold); err != nil {
+		return 0, nil, err
+	}
+
+	if result.Changed {
+		if hook, ok := payload["webhook_url"].(string); ok && hook != "" {
+			event := "uptime.recovery"
+			if result.State == "down" {
+				event = "uptime.incident"
+			}
+
+			secret, _ := payload["webhook_secret"].(string)
+
+			hookPayload, _ := json.Marshal(map[string]interface{}{
+				"url":    hook,
+				"event":  event,
+				"secret": secret,
+				"data":   result,
+			})
+
+			err := enqueueFollowUp(ctx, FollowUp{Type: "webhook_delivery", Payload: hookPayload})
+			if err != nil {
+				return 0, nil, err
+			}
+		}
+	}
+
+	jsonBytes, _ := json.Marshal(result)
+	return 200, jsonBytes, nil
+}
+
+// recordUptimeCheck stores the check and advances the monitor's state,
+// setting result.State, ConsecutiveFailures and Changed.
+func recordUptimeCheck(ctx context.Context, result *uptimeResult, threshold int) error {
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var errText *string
+	if result.Error != "" {
+		errText = &result.Error
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO uptime_checks (monitor, url, ok, status_code, latency_ms, error)
+		VALUES ($1, $2, $3, NULLIF($4, 0), $5, $6)
+	`, result.Monitor, result.URL, result.OK, result.StatusCode, result.LatencyMs, errText)
+	if err != nil {
+		return err
+	}
+
+	// New monitors start up; the row lock serialises overlapping checks
+	_, err = tx.Exec(`
+		INSERT INTO uptime_monitors (monitor, state, consecutive_failures)
+		VALUES ($1, 'up', 0)
+		ON CONFLICT (monitor) DO NOTHING
+	`, result.Monitor)
+	if err != nil {
+		return err
+	}
+
+	var state string
+	var failures int
+	err = tx.QueryRow(`
+		SELECT state, consecutive_failures
+		FROM uptime_monitors
+		WHERE monitor = $1
+		FOR UPDATE
+	`, result.Monitor).Scan(&state, &failures)
+	if err != nil {
+		return err
+	}
+
+	newState := state
+	if result.OK {
+		failures = 0
+		newState = "up"
+	} else {
+		failures++
+		if failures >= threshold {
+			newState = "down"
+		}
+	}
+
+	_, err = tx.Exec(`
+		UPDATE uptime_monitors
+		SET state = $2,
+		    consecutive_failures = $3,
+		    last_checked_at = NOW(),
+		    last_changed_at = CASE WHEN state <> $2 THEN NOW() ELSE last_changed_at END
+		WHERE monitor = $1
+	`, result.Monitor, newState, failures)
+	if err != nil {
+		return err
+	}
+
+	result.State = newState
+	result.ConsecutiveFailures = failures
+	result.Changed = newState != state
+
+	return tx.Commit()
+}
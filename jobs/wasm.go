@@ -0,0 +1,393 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// WASM plugins implement a job type as a WebAssembly module.
+//
+// Guest ABI: the module exports `memory`, `alloc(size u32) u32` and
+// `execute(ptr u32, len u32) u64`. execute receives the JSON payload and
+// returns (ptr << 32 | len) of a JSON result:
+//
+//	{"status": 200, "response": {...}, "error": "optional message"}
+//
+// Host functions are imported from the "goflow" module and only work when
+// the plugin was granted the matching capability:
+//
+//	log(ptr, len)                              always available
+//	http_request(ptr, len) u64                 capability "http"
+//	storage_get(keyPtr, keyLen) u64            capability "storage"
+//	storage_set(keyPtr, keyLen, valPtr, valLen) u32   capability "storage"
+type PluginConfig struct {
+	Name           string   `json:"name"`
+	Path           string   `json:"path"`
+	Executor       string   `json:"executor"`
+	Capabilities   []string `json:"capabilities"`
+	AllowedHosts   []string `json:"allowed_hosts"`
+	MemoryLimitMB  int      `json:"memory_limit_mb"`
+	TimeoutSeconds int      `json:"timeout_seconds"`
+}
+
+type wasmPlugin struct {
+	config   PluginConfig
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+	timeout  time.Duration
+}
+
+// LoadWASMPlugins compiles the plugins listed in a JSON config file of the
+// form {"plugins": [PluginConfig, ...]} and registers them by name. Entries
+// with "executor" instead of "path" register external stdio executors. A
+// name that is already a job type is an error.
+func LoadWASMPlugins(ctx context.Context, configPath string) error {
+
+	raw, err := os.ReadFile(configPath)
+	if err != nil {
+		return err
+	}
+
+	var cfg struct {
+		Plugins []PluginConfig `json:"plugins"`
+	}
+	if err := json.Unmarshal(raw, &cfg); err != nil {
+		return fmt.Errorf("invalid plugin config: %w", err)
+	}
+
+	for _, pc := range cfg.Plugins {
+		// Entries with an executor binary speak the stdio protocol
+		// instead of being WASM modules (see external.go).
+		if pc.Executor != "" {
+			if err := registerExternalExecutor(pc); err != nil {
+				return fmt.Errorf("executor %s: %w", pc.Name, err)
+			}
+			slog.Info("Registered external executor", "name", pc.Name, "executor", pc.Executor)
+			continue
+		}
+
+		p, err := loadWASMPlugin(ctx, pc)
+		if err != nil {
+			return fmt.Errorf("plugin %s: %w", pc.Name, err)
+		}
+		if err := register(pc.Name, p.execute, SourceWASM); err != nil {
+			p.runtime.Close(ctx)
+			return fmt.Errorf("plugin %s: %w", pc.Name, err)
+		}
+		slog.Info("Loaded WASM plugin", "name", pc.Name, "path", pc.Path)
+	}
+
+	return nil
+}
+
+func loadWASMPlugin(ctx context.Context, pc PluginConfig) (*wasmPlugin, error) {
+
+	if pc.Name == "" || pc.Path == "" {
+		return nil, fmt.Errorf("name and path are required")
+	}
+
+	wasmBytes, err := os.ReadFile(pc.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	memoryMB := pc.MemoryLimitMB
+	if memoryMB <= 0 {
+		memoryMB = 64
+	}
+
+	timeout := 30 * time.Second
+	if pc.TimeoutSeconds > 0 {
+		timeout = time.Duration(pc.TimeoutSeconds) * time.Second
+	}
+
+	// 64 KiB pages
+	runtimeConfig := wazero.NewRuntimeConfig().
+		WithCloseOnContextDone(true).
+		WithMemoryLimitPages(uint32(memoryMB * 16))
+
+	r := wazero.NewRuntimeWithConfig(ctx, runtimeConfig)
+
+	// No filesystem, env or args are mounted; WASI is only there so
+	// toolchains that expect it can link.
+	wasi_snapshot_preview1.MustInstantiate(ctx, r)
+
+	p := &wasmPlugin{config: pc, runtime: r, timeout: timeout}
+
+	_, err = r.NewHostModuleBuilder("goflow").
+		NewFunctionBuilder().WithFunc(p.hostLog).Export("log").
+		NewFunctionBuilder().WithFunc(p.hostHTTPRequest).Export("http_request").
+		NewFunctionBuilder().WithFunc(p.hostStorageGet).Export("storage_get").
+		NewFunctionBuilder().WithFunc(p.hostStorageSet).Export("storage_set").
+		Instantiate(ctx)
+	if err != nil {
+		r.Close(ctx)
+		return nil, err
+	}
+
+	compiled, err := r.CompileModule(ctx, wasmBytes)
+	if err != nil {
+		r.Close(ctx)
+		return nil, err
+	}
+
+	p.compiled = compiled
+	return p, nil
+}
+
+func (p *wasmPlugin) can(capability string) bool {
+	for _, c := range p.config.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *wasmPlugin) execute(ctx context.Context, payload map[string]interface{}) (int, []byte, error) {
+
+	if ctx.Err() == context.Canceled {
+		return 0, nil, fmt.Errorf("plugin cancelled")
+	}
+
+	input, err := json.Marshal(payload)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	runCtx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	// A fresh anonymous instance per execution: guest state never leaks
+	// between jobs and concurrent workers don't share memory.
+	mod, err := p.runtime.InstantiateModule(runCtx, p.compiled, wazero.NewModuleConfig().WithName(""))
+	if err != nil {
+		return 0, nil, err
+	}
+	defer mod.Close(runCtx)
+
+	alloc := mod.ExportedFunction("alloc")
+	execute := mod.ExportedFunction("execute")
+	if alloc == nil || execute == nil {
+		return 0, nil, fmt.Errorf("plugin must export alloc and execute")
+	}
+
+	ptr, err := writeGuest(runCtx, mod, input)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	results, err := execute.Call(runCtx, uint64(ptr), uint64(len(input)))
+	if err != nil {
+		if runCtx.Err() == context.DeadlineExceeded {
+			return 0, nil, fmt.Errorf("plugin timed out after %v", p.timeout)
+		}
+		return 0, nil, err
+	}
+
+	out, ok := readPacked(mod, results[0])
+	if !ok {
+		return 0, nil, fmt.Errorf("plugin returned an out of range result")
+	}
+
+	var result struct {
+		Status   int             `json:"status"`
+		Response json.RawMessage `json:"response"`
+		Error    string          `json:"error"`
+	}
+	if err := json.Unmarshal(out, &result); err != nil {
+		return 0, nil, fmt.Errorf("plugin returned invalid JSON: %w", err)
+	}
+
+	if result.Status == 0 {
+		result.Status = 200
+	}
+
+	if result.Error != "" {
+		return result.Status, result.Response, fmt.Errorf("%s", result.Error)
+	}
+
+	return result.Status, result.Response, nil
+}
+
+// writeGuest copies data into memory allocated by the guest's alloc export.
+func writeGuest(ctx context.Context, mod api.Module, data []byte) (uint32, error) {
+
+	results, err := mod.ExportedFunction("alloc").Call(ctx, uint64(len(data)))
+	if err != nil {
+		return 0, err
+	}
+
+	ptr := uint32(results[0])
+	if !mod.Memory().Write(ptr, data) {
+		return 0, fmt.Errorf("guest allocation out of range")
+	}
+
+	return ptr, nil
+}
+
+func readPacked(mod api.Module, packed uint64) ([]byte, bool) {
+	ptr := uint32(packed >> 32)
+	size := uint32(packed)
+	data, ok := mod.Memory().Read(ptr, size)
+	if !ok {
+		return nil, false
+	}
+	// Copy out: the view is invalidated once the instance closes
+	return append([]byte(nil), data...), true
+}
+
+// hostReturn hands a JSON value back to the guest as a packed pointer.
+func hostReturn(ctx context.Context, mod api.Module, v interface{}) uint64 {
+	data, _ := json.Marshal(v)
+	ptr, err := writeGuest(ctx, mod, data)
+	if err != nil {
+		return 0
+	}
+	return uint64(ptr)<<32 | uint64(len(data))
+}
+
+func (p *wasmPlugin) hostLog(ctx context.Context, mod api.Module, ptr, size uint32) {
+	if msg, ok := mod.Memory().Read(ptr, size); ok {
+		jobID, _ := JobIDFromContext(ctx)
+		slog.Info(string(msg), "plugin", p.config.Name, "job_id", jobID)
+	}
+}
+
+func (p *wasmPlugin) hostHTTPRequest(ctx context.Context, mod api.Module, ptr, size uint32) uint64 {
+
+	if !p.can("http") {
+		return hostReturn(ctx, mod, map[string]string{"error": "capability 'http' not granted"})
+	}
+
+	raw, ok := mod.Memory().Read(ptr, size)
+	if !ok {
+		return hostReturn(ctx, mod, map[string]string{"error": "request out of range"})
+	}
+
+	var in struct {
+		Method  string            `json:"method"`
+		URL     string            `json:"url"`
+		Headers map[string]string `json:"headers"`
+		Body    string            `json:"body"`
+	}
+	if err := json.Unmarshal(raw, &in); err != nil {
+		return hostReturn(ctx, mod, map[string]string{"error": err.Error()})
+	}
+
+	target, err := url.Parse(in.URL)
+	if err != nil || !p.hostAllowed(target.Hostname()) {
+		return hostReturn(ctx, mod, map[string]string{"error": "host not allowed"})
+	}
+
+	if in.Method == "" {
+		in.Method = "GET"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, in.Method, in.URL, strings.NewReader(in.Body))
+	if err != nil {
+		return hostReturn(ctx, mod, map[string]string{"error": err.Error()})
+	}
+	for k, v := range in.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := newGuardedHTTPClient(ctx, 10*time.Second).Do(req)
+	if err != nil {
+		return hostReturn(ctx, mod, map[string]string{"error": err.Error()})
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+
+	return hostReturn(ctx, mod, map[string]interface{}{
+		"status": resp.StatusCode,
+		"body":   string(body),
+	})
+}
+
+func (p *wasmPlugin) hostAllowed(host string) bool {
+	if len(p.config.AllowedHosts) == 0 {
+		return true
+	}
+	for _, h := range p.config.AllowedHosts {
+		if strings.EqualFold(h, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// Storage is a small key/value store namespaced per plugin.
+func (p *wasmPlugin) hostStorageGet(ctx context.Context, mod api.Module, keyPtr, keyLen uint32) uint64 {
+
+	if !p.can("storage") {
+		return hostReturn(ctx, mod, map[string]string{"error": "capability 'storage' not granted"})
+	}
+	if DB == nil {
+		return hostReturn(ctx, mod, map[string]string{"error": "storage needs Postgres"})
+	}
+
+	key, ok := mod.Memory().Read(keyPtr, keyLen)
+	if !ok {
+		return hostReturn(ctx, mod, map[string]string{"error": "key out of range"})
+	}
+
+	var value string
+	err := DB.QueryRowContext(ctx, `
+		SELECT value FROM plugin_storage
+		WHERE plugin = $1 AND key = $2
+	`, p.config.Name, string(key)).Scan(&value)
+
+	if err == sql.ErrNoRows {
+		return hostReturn(ctx, mod, map[string]interface{}{"found": false})
+	}
+	if err != nil {
+		return hostReturn(ctx, mod, map[string]string{"error": err.Error()})
+	}
+
+	return hostReturn(ctx, mod, map[string]interface{}{"found": true, "value": value})
+}
+
+func (p *wasmPlugin) hostStorageSet(ctx context.Context, mod api.Module, keyPtr, keyLen, valPtr, valLen uint32) uint32 {
+
+	if !p.can("storage") || DB == nil {
+		return 1
+	}
+
+	key, ok := mod.Memory().Read(keyPtr, keyLen)
+	if !ok {
+		return 1
+	}
+	value, ok := mod.Memory().Read(valPtr, valLen)
+	if !ok {
+		return 1
+	}
+
+	_, err := DB.ExecContext(ctx, `
+		INSERT INTO plugin_storage (plugin, key, value, updated_at)
+		VALUES ($1, $2, $3, NOW())
+		ON CONFLICT (plugin, key) DO UPDATE
+		SET value = EXCLUDED.value, updated_at = NOW()
+	`, p.config.Name, string(key), string(value))
+
+	if err != nil {
+		slog.Error("Plugin storage_set failed", "plugin", p.config.Name, "error", err)
+		return 1
+	}
+
+	return 0
+}
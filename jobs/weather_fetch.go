@@ -0,0 +1,375 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// weather_fetch returns current conditions and a daily forecast in one
+// provider-independent shape. "today" and "tomorrow" repeat the first two
+// days so workflow conditions can test paths like "weather.tomorrow.rain"
+// without knowing the provider:
+//
+//	{"lat": 52.52, "lon": 13.41, "days": 3, "provider": "open-meteo"}
+//
+// Providers: "open-meteo" (default, keyless) and "openweather" (needs
+// "api_key" or GOFLOW_OPENWEATHER_KEY). Units are always metric.
+
+type weatherCurrent struct {
+	Time            time.Time `json:"time"`
+	TemperatureC    float64   `json:"temperature_c"`
+	HumidityPct     float64   `json:"humidity_pct"`
+	WindSpeedMS     float64   `json:"wind_speed_ms"`
+	PrecipitationMM float64   `json:"precipitation_mm"`
+	Condition       string    `json:"condition"`
+}
+
+type weatherDay struct {
+	Date                string  `json:"date"`
+	TempMinC            float64 `json:"temp_min_c"`
+	TempMaxC            float64 `json:"temp_max_c"`
+	PrecipitationMM     float64 `json:"precipitation_mm"`
+	PrecipitationChance float64 `json:"precipitation_chance_pct"`
+	Condition           string  `json:"condition"`
+	Rain                bool    `json:"rain"`
+}
+
+type weatherReport struct {
+	Provider string         `json:"provider"`
+	Lat      float64        `json:"lat"`
+	Lon      float64        `json:"lon"`
+	Current  weatherCurrent `json:"current"`
+	Daily    []weatherDay   `json:"daily"`
+	Today    *weatherDay    `json:"today,omitempty"`
+	Tomorrow *weatherDay    `json:"tomorrow,omitempty"`
+}
+
+// weatherSeverity orders normalized conditions; a day's condition is the
+// most severe one reported for it.
+var weatherSeverity = map[string]int{
+	"clear": 0, "cloudy": 1, "fog": 2, "drizzle": 3, "rain": 4, "snow": 5, "thunderstorm": 6,
+}
+
+func executeWeatherFetch(ctx context.Context, payload map[string]interface{}) (int, []byte, error) {
+
+	lat, okLat := payload["lat"].(float64)
+	lon, okLon := payload["lon"].(float64)
+	if !okLat || !okLon {
+		return 0, nil, fmt.Errorf("missing 'lat'/'lon'")
+	}
+
+	days := 3
+	if d, ok := payload["days"].(float64); ok && d >= 1 {
+		days = int(d)
+	}
+
+	provider, _ := payload["provider"].(string)
+	if provider == "" {
+		provider = "open-meteo"
+	}
+
+	var report *weatherReport
+	var err error
+
+	switch provider {
+	case "open-meteo":
+		report, err = fetchOpenMeteo(ctx, lat, lon, days)
+	case "openweather":
+		apiKey, _ := payload["api_key"].(string)
+		if apiKey == "" {
+			apiKey = os.Getenv("GOFLOW_OPENWEATHER_KEY")
+		}
+		if apiKey == "" {
+			return 0, nil, fmt.Errorf("missing OpenWeather API key")
+		}
+		report, err = fetchOpenWeather(ctx, apiKey, lat, lon, days)
+	default:
+		return 0, nil, fmt.Errorf("unsupported weather provider: %s", provider)
+	}
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	report.Provider = provider
+	report.Lat = lat
+	report.Lon = lon
+
+	if len(report.Daily) > 0 {
+		report.Today = &report.Daily[0]
+	}
+	if len(report.Daily) > 1 {
+		report.Tomorrow = &report.Daily[1]
+	}
+
+	jsonBytes, _ := json.Marshal(report)
+	return 200, jsonBytes, nil
+}
+
+func fetchOpenMeteo(ctx context.Context, lat, lon float64, days int) (*weatherReport, error) {
+
+	if days > 16 {
+		days = 16
+	}
+
+	q := url.Values{}
+	q.Set("latitude", fmt.Sprint(lat))
+	q.Set("longitude", fmt.Sprint(lon))
+	q.Set("current", "temperature_2m,relative_humidity_2m,precipitation,weather_code,wind_speed_10m")
+	q.Set("daily", "weather_code,temperature_2m_max,temperature_2m_min,precipitation_sum,precipitation_probability_max")
+	q.Set("forecast_days", fmt.Sprint(max(days, 2)))
+	q.Set("wind_speed_unit", "ms")
+	q.Set("timezone", "auto")
+	q.Set("timeformat", "unixtime")
+
+	var body struct {
+		Current struct {
+			Time          int64   `json:"time"`
+			Temperature   float64 `json:"temperature_2m"`
+			Humidity      float64 `json:"relative_humidity_2m"`
+			Precipitation float64 `json:"precipitation"`
+			WeatherCode   int     `json:"weather_code"`
+			WindSpeed     float64 `json:"wind_speed_10m"`
+		} `json:"current"`
+		UTCOffset int `json:"utc_offset_seconds"`
+		Daily     struct {
+			Time          []int64   `json:"time"`
+			WeatherCode   []int     `json:"weather_code"`
+			TempMax       []float64 `json:"temperature_2m_max"`
+			TempMin       []float64 `json:"temperature_2m_min"`
+			Precipitation []float64 `json:"precipitation_sum"`
+			Probability   []float64 `json:"precipitation_probability_max"`
+		} `json:"daily"`
+	}
+
+	if err := getWeatherJSON(ctx, "https://api.open-meteo.com/v1/forecast?"+q.Encode(), &body); err != nil {
+		return nil, err
+	}
+
+	local := time.FixedZone("", body.UTCOffset)
+
+	report := &weatherReport{
+		Current: weatherCurrent{
+			Time:            time.Unix(body.Current.Time, 0).In(local),
+			TemperatureC:    body.Current.Temperature,
+			HumidityPct:     body.Current.Humidity,
+			WindSpeedMS:     body.Current.WindSpeed,
+			PrecipitationMM: body.Current.Precipitation,
+			Condition:       wmoCondition(body.Current.WeatherCode),
+		},
+		Daily: []weatherDay{},
+	}
+
+	d := body.Daily
+	for i := range d.Time {
+		if i >= len(d.WeatherCode) || i >= len(d.TempMax) || i >= len(d.TempMin) || i >= len(d.Precipitation) {
+			break
+		}
+		day := weatherDay{
+			Date:            time.Unix(d.Time[i], 0).In(local).Format("2006-01-02"),
+			TempMinC:        d.TempMin[i],
+			TempMaxC:        d.TempMax[i],
+			PrecipitationMM: d.Precipitation[i],
+			Condition:       wmoCondition(d.WeatherCode[i]),
+		}
+		if i < len(d.Probability) {
+			day.PrecipitationChance = d.Probability[i]
+		}
+		day.Rain = isWet(day.Condition) || day.PrecipitationMM > 0
+		report.Daily = append(report.Daily, day)
+	}
+
+	return report, nil
+}
+
+// fetchOpenWeather combines the current weather with the 3-hourly
+// forecast (5 days at most), folded into days in the location's timezone.
+func fetchOpenWeather(ctx context.Context, apiKey string, lat, lon float64, days int) (*weatherReport, error) {
+
+	q := url.Values{}
+	q.Set("lat", fmt.Sprint(lat))
+	q.Set("lon", fmt.Sprint(lon))
+	q.Set("units", "metric")
+	q.Set("appid", apiKey)
+
+	type owWeather struct {
+		Main string `json:"main"`
+	}
+
+	var current struct {
+		Dt   int64 `json:"dt"`
+		Main struct {
+			Temp     float64 `json:"temp"`
+			Humidity float64 `json:"humidity"`
+		} `json:"main"`
+		Wind struct {
+			Speed float64 `json:"speed"`
+		} `json:"wind"`
+		Weather []owWeather `json:"weather"`
+		Rain    struct {
+			OneHour float64 `json:"1h"`
+		} `json:"rain"`
+		Snow struct {
+			OneHour float64 `json:"1h"`
+		} `json:"snow"`
+		Timezone int `json:"timezone"`
+	}
+
+	if err := getWeatherJSON(ctx, "https://api.openweathermap.org/data/2.5/weather?"+q.Encode(), &current); err != nil {
+		return nil, err
+	}
+
+	var forecast struct {
+		List []struct {
+			Dt   int64 `json:"dt"`
+			Main struct {
+				TempMin float64 `json:"temp_min"`
+				TempMax float64 `json:"temp_max"`
+			} `json:"main"`
+			Weather []owWeather `json:"weather"`
+			Pop     float64     `json:"pop"`
+			Rain    struct {
+				ThreeHours float64 `json:"3h"`
+			} `json:"rain"`
+			Snow struct {
+				ThreeHours float64 `json:"3h"`
+			} `json:"snow"`
+		} `json:"list"`
+	}
+
+	if err := getWeatherJSON(ctx, "https://api.openweathermap.org/data/2.5/forecast?"+q.Encode(), &forecast); err != nil {
+		return nil, err
+	}
+
+	local := time.FixedZone("", current.Timezone)
+
+	condition := "clear"
+	if len(current.Weather) > 0 {
+		condition = openWeatherCondition(current.Weather[0].Main)
+	}
+
+	report := &weatherReport{
+		Current: weatherCurrent{
+			Time:            time.Unix(current.Dt, 0).In(local),
+			TemperatureC:    current.Main.Temp,
+			HumidityPct:     current.Main.Humidity,
+			WindSpeedMS:     current.Wind.Speed,
+			PrecipitationMM: current.Rain.OneHour + current.Snow.OneHour,
+			Condition:       condition,
+		},
+		Daily: []weatherDay{},
+	}
+
+	byDate := map[string]int{}
+
+	for _, entry := range forecast.List {
+		date := time.Unix(entry.Dt, 0).In(local).Format("2006-01-02")
+
+		i, ok := byDate[date]
+		if !ok {
+			if len(report.Daily) >= days {
+				continue
+			}
+			report.Daily = append(report.Daily, weatherDay{
+				Date:      date,
+				TempMinC:  math.Inf(1),
+				TempMaxC:  math.Inf(-1),
+				Condition: "clear",
+			})
+			i = len(report.Daily) - 1
+			byDate[date] = i
+		}
+		day := &report.Daily[i]
+
+		day.TempMinC = math.Min(day.TempMinC, entry.Main.TempMin)
+		day.TempMaxC = math.Max(day.TempMaxC, entry.Main.TempMax)
+		day.PrecipitationMM += entry.Rain.ThreeHours + entry.Snow.ThreeHours
+		day.PrecipitationChance = math.Max(day.PrecipitationChance, entry.Pop*100)
+
+		if len(entry.Weather) > 0 {
+			c := openWeatherCondition(entry.Weather[0].Main)
+			if weatherSeverity[c] > weatherSeverity[day.Condition] {
+				day.Condition = c
+			}
+		}
+	}
+
+	for i := range report.Daily {
+		day := &report.Daily[i]
+		day.PrecipitationMM = math.Round(day.PrecipitationMM*10) / 10
+		day.Rain = isWet(day.Condition) || day.PrecipitationMM > 0
+	}
+
+	return report, nil
+}
+
+// wmoCondition maps WMO weather interpretation codes (used by Open-Meteo).
+func wmoCondition(code int) string {
+	switch {
+	case code == 0:
+		return "clear"
+	case code <= 3:
+		return "cloudy"
+	case code == 45 || code == 48:
+		return "fog"
+	case code >= 51 && code <= 57:
+		return "drizzle"
+	case code >= 61 && code <= 67, code >= 80 && code <= 82:
+		return "rain"
+	case code >= 71 && code <= 77, code == 85 || code == 86:
+		return "snow"
+	case code >= 95:
+		return "thunderstorm"
+	}
+	return "cloudy"
+}
+
+func openWeatherCondition(main string) string {
+	switch main {
+	case "Clear":
+		return "clear"
+	case "Drizzle":
+		return "drizzle"
+	case "Rain":
+		return "rain"
+	case "Snow":
+		return "snow"
+	case "Thunderstorm":
+		return "thunderstorm"
+	case "Mist", "Fog", "Haze", "Smoke", "Dust", "Sand", "Ash":
+		return "fog"
+	}
+	return "cloudy"
+}
+
+func isWet(condition string) bool {
+	return condition == "drizzle" || condition == "rain" || condition == "thunderstorm"
+}
+
+func getWeatherJSON(ctx context.Context, endpoint string, out interface{}) error {
+
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second, Transport: transportFor(ctx, nil)}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("weather provider returned status %d", resp.StatusCode)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -22,24 +22,37 @@ func executeWebhookDelivery(ctx context.Context, payload map[string]interface{})
 
 	url, ok := payload["url"].(string)
 	if !ok {
-		return 0, nil, fmt.Errorf("missing url")
+		return 0, nil, Permanent(fmt.Errorf("missing url"))
 	}
 
 	event, ok := payload["event"].(string)
 	if !ok {
-		return 0, nil, fmt.Errorf("missing event")
+		return 0, nil, Permanent(fmt.Errorf("missing event"))
 	}
 
 	data := payload["data"]
 
 	secret, ok := payload["secret"].(string)
 	if !ok {
-		return 0, nil, fmt.Errorf("missing secret")
+		return 0, nil, Permanent(fmt.Errorf("missing secret"))
+	}
+
+	// Retries of the same job reuse the delivery ID; skip the send if the
+	// receiver already acknowledged it.
+	deliveryID := deliveryIDFor(ctx, "webhook")
+
+	acked, ackStatus, ackBody, err := DeliveryAcknowledged(ctx, deliveryID)
+	if err != nil {
+		return 0, nil, err
+	}
+	if acked {
+		return ackStatus, ackBody, nil
 	}
 
 	bodyMap := map[string]interface{}{
-		"event": event,
-		"data":  data,
+		"delivery_id": deliveryID,
+		"event":       event,
+		"data":        data,
 	}
 
 	bodyBytes, err := json.Marshal(bodyMap)
@@ -52,7 +65,8 @@ func executeWebhookDelivery(ctx context.Context, payload map[string]interface{})
 	signature := hex.EncodeToString(mac.Sum(nil))
 
 	client := &http.Client{
-		Timeout: 10 * time.Second,
+		Timeout:   10 * time.Second,
+		Transport: transportFor(ctx, nil),
 	}
 
 	// ✅ CONTEXT-AWARE REQUEST
@@ -63,8 +77,9 @@ func executeWebhookDelivery(ctx context.Context, payload map[string]interface{})
 
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("X-GoFlow-Signature", "sha256="+signature)
+	req.Header.Set(DeliveryHeader, deliveryID)
 
-	resp, err := client.Do(req)
+	resp, err := sendThroughBreaker(client, req)
 	if err != nil {
 
 		// 🔥 HANDLE CANCEL
@@ -72,6 +87,10 @@ func executeWebhookDelivery(ctx context.Context, payload map[string]interface{})
 			return 0, nil, fmt.Errorf("webhook cancelled")
 		}
 
+		// Deferred by the circuit breaker: nothing was sent
+		if _, deferred := DeferredBy(err); !deferred {
+			recordFanoutAttempt(ctx, payload, 0, err)
+		}
 		return 0, nil, err
 	}
 	defer resp.Body.Close()
@@ -79,9 +98,16 @@ func executeWebhookDelivery(ctx context.Context, payload map[string]interface{})
 	responseBytes, _ := io.ReadAll(resp.Body)
 
 	if resp.StatusCode >= 400 {
-		return resp.StatusCode, responseBytes,
-			fmt.Errorf("http status %d", resp.StatusCode)
+		err := httpStatusError(resp)
+		recordFanoutAttempt(ctx, payload, resp.StatusCode, err)
+		return resp.StatusCode, responseBytes, err
+	}
+
+	jobID, _ := JobIDFromContext(ctx)
+	if err := RecordDelivery(ctx, deliveryID, jobID, url, resp.StatusCode, responseBytes); err != nil {
+		return 0, nil, err
 	}
+	recordFanoutAttempt(ctx, payload, resp.StatusCode, nil)
 
 	return resp.StatusCode, responseBytes, nil
 }
\ No newline at end of file
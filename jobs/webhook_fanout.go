@@ -0,0 +1,156 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// webhook_fanout delivers one event to many endpoints:
+//
+//	{"event": "order.created", "data": {...}, "topic": "orders"}
+//	{"event": "order.created", "data": {...}, "secret": "s3cret",
+//	 "endpoints": [{"url": "https://a.example.com/hook"},
+//	               {"url": "https://b.example.com/hook", "secret": "other"}]}
+//
+// "topic" sends to every active subscription the job's tenant has in
+// webhook_subscriptions.
+// Each endpoint gets its own webhook_delivery job, signed with its own
+// secret, so one slow or failing receiver retries on its own schedule
+// without holding up or failing the others. Per-endpoint progress is kept
+// in webhook_fanout_deliveries and served by GET /webhooks/fanouts/{id}.
+
+type fanoutEndpoint struct {
+	URL    string `json:"url"`
+	Secret string `json:"secret"`
+}
+
+func executeWebhookFanout(ctx context.Context, payload map[string]interface{}) (int, []byte, error) {
+
+	event, ok := payload["event"].(string)
+	if !ok || event == "" {
+		return 0, nil, fmt.Errorf("missing 'event'")
+	}
+
+	fanoutID, ok := JobIDFromContext(ctx)
+	if !ok {
+		return 0, nil, fmt.Errorf("webhook_fanout must run as a job")
+	}
+
+	defaultSecret, _ := payload["secret"].(string)
+
+	var endpoints []fanoutEndpoint
+
+	if raw, ok := payload["endpoints"]; ok {
+		b, _ := json.Marshal(raw)
+		if err := json.Unmarshal(b, &endpoints); err != nil {
+			return 0, nil, fmt.Errorf("invalid 'endpoints'")
+		}
+	}
+
+	topic, _ := payload["topic"].(string)
+	if topic != "" {
+		rows, err := DB.QueryContext(ctx, `
+			SELECT url, secret FROM webhook_subscriptions
+			WHERE tenant_id = $1 AND topic = $2 AND active
+			ORDER BY id
+		`, tenantOrDefault(ctx), topic)
+		if err != nil {
+			return 0, nil, err
+		}
+		for rows.Next() {
+			var e fanoutEndpoint
+			if err := rows.Scan(&e.URL, &e.Secret); err != nil {
+				rows.Close()
+				return 0, nil, err
+			}
+			endpoints = append(endpoints, e)
+		}
+		rows.Close()
+	}
+
+	if len(endpoints) == 0 && topic == "" {
+		return 0, nil, fmt.Errorf("missing 'endpoints' or 'topic'")
+	}
+
+	seen := map[string]bool{}
+	queued := 0
+
+	for _, e := range endpoints {
+		if e.URL == "" || seen[e.URL] {
+			continue
+		}
+		seen[e.URL] = true
+
+		if e.Secret == "" {
+			e.Secret = defaultSecret
+		}
+		if e.Secret == "" {
+			return 0, nil, fmt.Errorf("no secret for %s", e.URL)
+		}
+
+		// A retried fanout keeps the rows from its earlier attempt
+		_, err := DB.ExecContext(ctx, `
+			INSERT INTO webhook_fanout_deliveries (fanout_job_id, url)
+			VALUES ($1, $2)
+			ON CONFLICT (fanout_job_id, url) DO NOTHING
+		`, fanoutID, e.URL)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		delivery, _ := json.Marshal(map[string]interface{}{
+			"url":       e.URL,
+			"event":     event,
+			"secret":    e.Secret,
+			"data":      payload["data"],
+			"fanout_id": fanoutID,
+		})
+		if err := enqueueFollowUp(ctx, FollowUp{Type: "webhook_delivery", Payload: delivery}); err != nil {
+			return 0, nil, err
+		}
+		queued++
+	}
+
+	jsonBytes, _ := json.Marshal(map[string]interface{}{
+		"fanout_id": fanoutID,
+		"event":     event,
+		"endpoints": queued,
+	})
+	return 200, jsonBytes, nil
+}
+
+// recordFanoutAttempt updates the fanout row for a webhook_delivery job
+// started by webhook_fanout. Other deliveries have no fanout_id and are
+// left alone.
+func recordFanoutAttempt(ctx context.Context, payload map[string]interface{}, status int, sendErr error) {
+
+	fanoutID, ok := payload["fanout_id"].(float64)
+	if !ok || DB == nil {
+		return
+	}
+	url, _ := payload["url"].(string)
+	jobID, _ := JobIDFromContext(ctx)
+
+	var lastError *string
+	if sendErr != nil {
+		msg := sendErr.Error()
+		lastError = &msg
+	}
+
+	var lastStatus *int
+	if status > 0 {
+		lastStatus = &status
+	}
+
+	DB.ExecContext(context.WithoutCancel(ctx), `
+		UPDATE webhook_fanout_deliveries
+		SET delivery_job_id = $3,
+		    attempts = attempts + 1,
+		    last_status = $4,
+		    last_error = $5,
+		    delivered_at = CASE WHEN $5::text IS NULL THEN NOW() ELSE NULL END,
+		    updated_at = NOW()
+		WHERE fanout_job_id = $1 AND url = $2
+	`, int(fanoutID), url, jobID, lastStatus, lastError)
+}
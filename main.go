@@ -1,892 +1,59 @@
+// Command goflow runs the GoFlow server. The server itself is package
+// engine; this wrapper reads the configuration, runs the engine until
+// SIGINT or SIGTERM, and dispatches the test-job and migrate subcommands.
 package main
 
 import (
-	"bytes"
 	"context"
-	"crypto/hmac"
-	"crypto/sha256"
-	"database/sql"
-	"encoding/hex"
-	"encoding/json"
-	"log"
-	"net/http"
+	"log/slog"
 	"os"
 	"os/signal"
-	"strconv"
-	"strings"
-	"sync"
 	"syscall"
-	"time"
 
-	_ "github.com/lib/pq"
-	"goflow/jobs"
-	"goflow/workflow"
+	"goflow/engine"
 )
 
-type Job struct {
-	ID      int                    `json:"id"`
-	Type    string                 `json:"type"`
-	Payload map[string]interface{} `json:"payload"`
-	Status  string                 `json:"status"`
-	RunAt   time.Time              `json:"run_at"`
-}
-
-type Workflow struct {
-	ID        int             `json:"id"`
-	Status    string          `json:"status"`
-	Steps     json.RawMessage `json:"steps"`
-	Context   json.RawMessage `json:"context"`
-	CreatedAt time.Time       `json:"created_at"`
-	UpdatedAt time.Time       `json:"updated_at"`
-
-	StartedAt       *time.Time `json:"started_at"`
-	FinishedAt      *time.Time `json:"finished_at"`
-	ExecutionTimeMs *int64     `json:"execution_time_ms"`
-}
-
-type WorkflowStepRun struct {
-	ID               int             `json:"id"`
-	WorkflowID       int             `json:"workflow_id"`
-	StepID           string          `json:"step_id"`
-	JobID            int             `json:"job_id"`
-	Status           string          `json:"status"`
-	StartedAt        time.Time       `json:"started_at"`
-	FinishedAt       *time.Time      `json:"finished_at"`
-	Error            *string         `json:"error"`
-	ResponseSnapshot json.RawMessage `json:"response_snapshot"`
-}
-
-var db *sql.DB
-var (
-	smtpHost = "smtp.gmail.com"
-	smtpPort = "587"
-	smtpUser = os.Getenv("SMTP_USER")
-	smtpPass = os.Getenv("SMTP_PASS")
-)
-
-const (
-	maxRetries = 3
-	baseDelay  = 5 * time.Second
-)
-
-const processingTimeout = 30 * time.Second
-
-func recoverStuckJobs() {
-	result, err := db.Exec(`
-		UPDATE jobs
-		SET status = 'pending',
-		    updated_at = NOW()
-		WHERE status = 'processing'
-		AND updated_at < NOW() - ($1 || ' seconds')::interval
-	`, int(processingTimeout.Seconds()))
-
-	if err != nil {
-		log.Println("Recovery failed:", err)
-		return
-	}
-
-	rowsAffected, _ := result.RowsAffected()
-	if rowsAffected > 0 {
-		log.Printf("Recovered %d stuck jobs\n", rowsAffected)
-	}
-}
-
-// ==================== WORKER ====================
-
-func startWorker(ctx context.Context, wg *sync.WaitGroup, workerID int) {
-	defer wg.Done()
-
-	for {
-		select {
-		case <-ctx.Done():
-			log.Printf("[Worker %d] Shutting down...\n", workerID)
-			return
-		default:
-		}
-
-		var id int
-
-		err := db.QueryRow(`
-			UPDATE jobs
-			SET status = 'processing',
-			    updated_at = NOW()
-			WHERE id = (
-				SELECT id FROM jobs
-				WHERE status = 'pending'
-				AND retry_count < $1
-				AND run_at <= NOW()
-				ORDER BY id
-				LIMIT 1
-				FOR UPDATE SKIP LOCKED
-			)
-			RETURNING id;
-		`, maxRetries).Scan(&id)
-
-		if err == sql.ErrNoRows {
-			time.Sleep(200 * time.Millisecond)
-			continue
-		}
-
-		if err != nil {
-			log.Println("Claim error:", err)
-			time.Sleep(500 * time.Millisecond)
-			continue
-		}
-
-		processJob(workerID, id)
-	}
-}
-
-func processJob(workerID int, id int) {
-
-	var job Job
-	var payloadBytes []byte
-
-	err := db.QueryRow(`
-		SELECT id, type, payload, status, run_at
-		FROM jobs
-		WHERE id = $1
-	`, id).Scan(&job.ID, &job.Type, &payloadBytes, &job.Status, &job.RunAt)
-
-	if err != nil {
-		log.Println("Fetch error:", err)
-		return
-	}
-
-	err = json.Unmarshal(payloadBytes, &job.Payload)
-	if err != nil {
-		log.Println("Unmarshal error:", err)
-		return
-	}
-
-	var workflowID float64
-	if wfID, ok := job.Payload["workflow_id"]; ok {
-		wfIDFloat, ok := wfID.(float64)
-		if !ok {
-			log.Println("Invalid workflow_id type")
-			return
-		}
-		workflowID = wfIDFloat
-
-		var status string
-		err := db.QueryRow(`
-        SELECT status FROM workflows WHERE id = $1
-    `, int(workflowID)).Scan(&status)
-
-		if err == nil && status == "cancelled" {
-			log.Printf("[Worker %d] Skipping job %d (workflow cancelled)\n", workerID, job.ID)
-
-			db.Exec(`
-            UPDATE jobs
-			SET status = 'cancelled',
-				last_error = 'workflow cancelled',
-				updated_at = NOW()
-			WHERE id = $1
-		`, job.ID)
-
-			return
-		}
-	}
-
-	log.Printf("[Worker %d] Executing job %d\n", workerID, job.ID)
-
-	start := time.Now()
-
-	ctx := context.Background()
-
-	// 🔴 DOUBLE CHECK BEFORE EXECUTION
-	if wfID, ok := job.Payload["workflow_id"]; ok {
-		wfIDFloat, ok := wfID.(float64)
-		if ok {
-			var status string
-			err := db.QueryRow(`
-			SELECT status FROM workflows WHERE id = $1
-		`, int(wfIDFloat)).Scan(&status)
-
-			if err == nil && status == "cancelled" {
-				log.Printf("[Worker %d] Skipping job %d before execution (cancelled)\n", workerID, job.ID)
-				return
-			}
-		}
-	}
-
-	statusCode, responseBody, execErr := jobs.Execute(ctx, job.Type, job.Payload)
-	// Ensure responseBody is valid JSON
-	var jsonCheck interface{}
-	if len(responseBody) > 0 && json.Unmarshal(responseBody, &jsonCheck) != nil {
-		// Not valid JSON → wrap it
-		wrapped := map[string]string{
-			"raw": string(responseBody),
-		}
-		responseBody, _ = json.Marshal(wrapped)
-	}
-
-	duration := time.Since(start).Milliseconds()
-
-	// 🔴 If execution failed
-	if execErr != nil {
-
-		_, _ = db.Exec(`
-			UPDATE jobs
-			SET last_error = $2,
-			    response_status = $3,
-			    response_body = $4,
-			    execution_time_ms = $5,
-			    updated_at = NOW()
-			WHERE id = $1
-		`, job.ID, execErr.Error(), statusCode, responseBody, duration)
-
-		handleRetry(workerID, job, execErr)
-		return
-	}
-
-	// 🟢 If execution succeeded
-	_, err = db.Exec(`
-		UPDATE jobs
-		SET status = 'completed',
-		    response_status = $2,
-		    response_body = $3,
-		    execution_time_ms = $4,
-		    last_error = NULL,
-		    updated_at = NOW()
-		WHERE id = $1
-	`, job.ID, statusCode, responseBody, duration)
-
-	if err != nil {
-		log.Println("Completion update failed:", err)
-	}
-
-	triggerAutoCallback(job.ID, job.Payload)
-	workflow.AdvanceIfNeeded(job.ID, job.Payload, responseBody)
-}
-
-func triggerAutoCallback(jobID int, payload map[string]interface{}) {
-
-	callbackURL, ok := payload["callback_url"].(string)
-	if !ok || callbackURL == "" {
-		return
-	}
-
-	secret, _ := payload["callback_secret"].(string)
-
-	var status string
-	var responseBody []byte
-	var lastError *string
-
-	err := db.QueryRow(`
-		SELECT status, response_body, last_error
-		FROM jobs
-		WHERE id = $1
-	`, jobID).Scan(&status, &responseBody, &lastError)
-
-	if err != nil {
-		log.Println("Auto callback fetch failed:", err)
-		return
-	}
-
-	body := map[string]interface{}{
-		"job_id": jobID,
-		"status": status,
-	}
-
-	if responseBody != nil {
-		var parsed interface{}
-		json.Unmarshal(responseBody, &parsed)
-		body["response"] = parsed
-	}
-
-	if lastError != nil {
-		body["error"] = *lastError
-	}
-
-	bodyBytes, _ := json.Marshal(body)
-
-	req, err := http.NewRequest("POST", callbackURL, bytes.NewBuffer(bodyBytes))
-	if err != nil {
-		log.Println("Auto callback request error:", err)
-		return
-	}
-
-	req.Header.Set("Content-Type", "application/json")
-
-	if secret != "" {
-		mac := hmac.New(sha256.New, []byte(secret))
-		mac.Write(bodyBytes)
-		signature := hex.EncodeToString(mac.Sum(nil))
-		req.Header.Set("X-GoFlow-Signature", "sha256="+signature)
-	}
-
-	client := &http.Client{Timeout: 10 * time.Second}
-
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Println("Auto callback send failed:", err)
-		return
-	}
-	defer resp.Body.Close()
-
-	log.Printf("Auto callback sent for job %d\n", jobID)
-}
-
-func enableCORS(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
-
-		if r.Method == "OPTIONS" {
-			return
-		}
-
-		next.ServeHTTP(w, r)
-	})
-}
-
-// ==================== DB INIT ====================
-
-func initDB() {
-	connStr := "host=127.0.0.1 port=5433 user=goflow password=goflowpass dbname=goflowdb sslmode=disable"
-
-	var err error
-	db, err = sql.Open("postgres", connStr)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	err = db.Ping()
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	createTable := `
-	CREATE TABLE IF NOT EXISTS jobs (
-	id SERIAL PRIMARY KEY,
-	type TEXT NOT NULL,
-	payload JSONB,
-	status TEXT NOT NULL,
-	retry_count INT DEFAULT 0,
-	run_at TIMESTAMPTZ DEFAULT NOW(),
-	last_error TEXT,
-	response_status INT,
-	response_body JSONB,
-	execution_time_ms INT,
-	created_at TIMESTAMP DEFAULT NOW(),
-	updated_at TIMESTAMP DEFAULT NOW()
-);
-	`
-	_, err = db.Exec(createTable)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	createReadyIndex := `
-	CREATE INDEX IF NOT EXISTS idx_jobs_ready
-	ON jobs (status, run_at);
-	`
-	_, err = db.Exec(createReadyIndex)
-	if err != nil {
-		log.Fatal("Failed to create ready index:", err)
-	}
-
-	createWorkflowTable := `
-	CREATE TABLE IF NOT EXISTS workflows (
-		id SERIAL PRIMARY KEY,
-		status TEXT NOT NULL,
-		current_step INT DEFAULT 0,
-		steps JSONB NOT NULL,
-		context JSONB DEFAULT '{}'::jsonb,
-
-		started_at TIMESTAMP,
-		finished_at TIMESTAMP,
-		execution_time_ms BIGINT,
-
-		barrier_resumed BOOLEAN DEFAULT FALSE,
-
-		created_at TIMESTAMP DEFAULT NOW(),
-		updated_at TIMESTAMP DEFAULT NOW()
-	);
-	`
-	_, err = db.Exec(createWorkflowTable)
-	if err != nil {
-		log.Fatal("Failed to create workflows table:", err)
-	}
-
-	createWorkflowStepRuns := `
-	CREATE TABLE IF NOT EXISTS workflow_step_runs (
-		id SERIAL PRIMARY KEY,
-		workflow_id INT NOT NULL,
-		step_id TEXT NOT NULL,
-		job_id INT NOT NULL,
-		status TEXT NOT NULL,
-
-		parent_step_id TEXT,
-		is_parallel_child BOOLEAN DEFAULT FALSE,
-
-		started_at TIMESTAMP DEFAULT NOW(),
-		finished_at TIMESTAMP,
-		error TEXT,
-		response_snapshot JSONB,
-		created_at TIMESTAMP DEFAULT NOW()
-	);
-	`
-	_, err = db.Exec(createWorkflowStepRuns)
-	if err != nil {
-		log.Fatal("Failed to create workflow_step_runs table:", err)
-	}
-
-	log.Println("Database ready")
-}
-
-func handleRetry(workerID int, job Job, execErr error) {
-
-	// DO NOT retry cancelled workflows
-	if wfID, ok := job.Payload["workflow_id"]; ok {
-		wfIDFloat, ok := wfID.(float64)
-		if ok {
-			var status string
-			err := db.QueryRow(`
-			SELECT status FROM workflows WHERE id = $1
-		`, int(wfIDFloat)).Scan(&status)
-
-			if err == nil && status == "cancelled" {
-				log.Println("Skipping retry - workflow cancelled")
-				return
-			}
-		}
-	}
-	log.Println("Execution failed:", execErr)
-
-	var retryCount int
-	err := db.QueryRow(`
-		SELECT retry_count FROM jobs WHERE id = $1
-	`, job.ID).Scan(&retryCount)
-
-	if err != nil {
-		log.Println("Retry fetch failed:", err)
-		return
-	}
-
-	if retryCount+1 >= maxRetries {
-		_, err = db.Exec(`
-        UPDATE jobs
-        SET status = 'failed',
-            retry_count = retry_count + 1,
-            updated_at = NOW()
-        WHERE id = $1
-    `, job.ID)
-
-		if err != nil {
-			log.Println("Failed to mark job failed:", err)
-		}
-
-		// 🔥 Notify workflow engine of terminal failure
-		workflow.AdvanceIfNeeded(job.ID, job.Payload, []byte(`{}`))
-
-		triggerAutoCallback(job.ID, job.Payload)
-		return
-	}
-
-	nextDelay := baseDelay * time.Duration(1<<retryCount)
-
-	log.Printf("[Worker %d] Retrying job %d in %v\n",
-		workerID, job.ID, nextDelay)
-
-	_, err = db.Exec(`
-		UPDATE jobs
-		SET status = 'pending',
-		    retry_count = retry_count + 1,
-		    run_at = NOW() + ($2 || ' seconds')::interval,
-		    updated_at = NOW()
-		WHERE id = $1
-	`, job.ID, int(nextDelay.Seconds()))
-
-	if err != nil {
-		log.Println("Failed scheduling retry:", err)
-	}
-}
-
-func startRecoveryLoop(ctx context.Context, wg *sync.WaitGroup) {
-	defer wg.Done()
-
-	ticker := time.NewTicker(15 * time.Second)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-ctx.Done():
-			log.Println("[Recovery] Shutting down...")
-			return
-		case <-ticker.C:
-			recoverStuckJobs()
-		}
-	}
-}
-
-// ==================== API ====================
-
 func main() {
 
-	initDB()
-	jobs.DB = db
-	workflow.DB = db
-	if smtpUser == "" || smtpPass == "" {
-		log.Fatal("SMTP credentials not set in environment variables")
-	}
-	recoverStuckJobs()
-
-	ctx, cancel := context.WithCancel(context.Background())
-	wg := &sync.WaitGroup{}
-
-	workerCount := 5
-
-	for i := 1; i <= workerCount; i++ {
-		wg.Add(1)
-		go startWorker(ctx, wg, i)
-	}
-
-	wg.Add(1)
-	go startRecoveryLoop(ctx, wg)
-
-	// Start HTTP server in goroutine
-	mux := http.NewServeMux()
-
-	mux.HandleFunc("/health", healthHandler)
-	mux.HandleFunc("/jobs", jobsHandler)
-	mux.HandleFunc("/workflows", workflowsHandler)
-	mux.HandleFunc("/workflows/", workflowDetailHandler)
-	mux.HandleFunc("/jobs/", jobDetailHandler)
-
-	server := &http.Server{
-		Addr:    ":8080",
-		Handler: enableCORS(mux),
-	}
-
-	go func() {
-		log.Println("Server running on :8080")
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatal(err)
-		}
-	}()
-
-	// Listen for OS signals
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
-
-	<-sigChan
-	log.Println("Shutdown signal received")
-
-	// Stop workers
-	cancel()
-
-	// Gracefully stop HTTP server
-	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer shutdownCancel()
-	server.Shutdown(shutdownCtx)
-
-	// Wait for workers
-	wg.Wait()
-
-	log.Println("Graceful shutdown complete")
-}
-
-func healthHandler(w http.ResponseWriter, r *http.Request) {
-	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
-}
-
-func jobsHandler(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-
-	case http.MethodPost:
-		var req Job
-
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "Invalid JSON", http.StatusBadRequest)
-			return
-		}
-
-		if req.RunAt.IsZero() {
-			req.RunAt = time.Now().UTC()
-		}
-
-		req.Status = "pending"
-
-		payloadJSON, err := json.Marshal(req.Payload)
-		if err != nil {
-			http.Error(w, "Payload error", http.StatusInternalServerError)
-			return
-		}
-
-		err = db.QueryRow(`
-			INSERT INTO jobs (type, payload, status, run_at)
-			VALUES ($1, $2, $3, $4)
-			RETURNING id
-		`, req.Type, payloadJSON, req.Status, req.RunAt).Scan(&req.ID)
-
-		if err != nil {
-			http.Error(w, "Insert failed", http.StatusInternalServerError)
-			return
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "test-job":
+			os.Exit(engine.RunTestJob(os.Args[2:]))
+		case "migrate":
+			os.Exit(engine.RunMigrate(os.Args[2:]))
 		}
-
-		json.NewEncoder(w).Encode(req)
-
-	case http.MethodGet:
-		rows, err := db.Query(`
-			SELECT id, type, payload, status, run_at
-			FROM jobs
-			ORDER BY id
-		`)
-		if err != nil {
-			http.Error(w, "Query failed", http.StatusInternalServerError)
-			return
-		}
-		defer rows.Close()
-
-		var jobs []Job
-
-		for rows.Next() {
-			var job Job
-			var payloadBytes []byte
-
-			err := rows.Scan(&job.ID, &job.Type, &payloadBytes, &job.Status, &job.RunAt)
-			if err != nil {
-				http.Error(w, "Scan failed", http.StatusInternalServerError)
-				return
-			}
-
-			json.Unmarshal(payloadBytes, &job.Payload)
-			jobs = append(jobs, job)
-		}
-
-		json.NewEncoder(w).Encode(jobs)
-
-	default:
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-	}
-}
-
-func workflowsHandler(w http.ResponseWriter, r *http.Request) {
-
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
 	}
 
-	rows, err := db.Query(`
-		SELECT id, status, steps, context, created_at, updated_at,
-       	started_at, finished_at, execution_time_ms
-		FROM workflows
-		ORDER BY id DESC
-	`)
+	cfg, err := engine.LoadConfig(os.Args[1:])
 	if err != nil {
-		http.Error(w, "Query failed", http.StatusInternalServerError)
-		return
+		fatal("Invalid configuration", err)
 	}
-	defer rows.Close()
 
-	var workflows []Workflow
-
-	for rows.Next() {
-		var wf Workflow
-		err := rows.Scan(
-			&wf.ID,
-			&wf.Status,
-			&wf.Steps,
-			&wf.Context,
-			&wf.CreatedAt,
-			&wf.UpdatedAt,
-			&wf.StartedAt,
-			&wf.FinishedAt,
-			&wf.ExecutionTimeMs,
-		)
-		if err != nil {
-			http.Error(w, "Scan failed", http.StatusInternalServerError)
-			return
-		}
-		workflows = append(workflows, wf)
+	if err := engine.SetupLogging(cfg.LogLevel, cfg.LogFormat); err != nil {
+		fatal("Invalid configuration", err)
 	}
 
-	json.NewEncoder(w).Encode(workflows)
-}
-
-func workflowDetailHandler(w http.ResponseWriter, r *http.Request) {
-
-	path := strings.TrimPrefix(r.URL.Path, "/workflows/")
-	parts := strings.Split(path, "/")
-
-	idStr := parts[0]
-	workflowID, err := strconv.Atoi(idStr)
+	e, err := engine.New(cfg)
 	if err != nil {
-		http.Error(w, "Invalid workflow id", http.StatusBadRequest)
-		return
-	}
-
-	// 🔴 CANCEL WORKFLOW
-	if len(parts) == 2 && parts[1] == "cancel" && r.Method == http.MethodPost {
-		err := workflow.CancelWorkflow(workflowID)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
-
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"workflow_id": workflowID,
-			"status":      "cancelled",
-		})
-		return
+		fatal("Failed to start", err)
 	}
 
-	// 🟢 RUN WORKFLOW
-	if len(parts) == 2 && parts[1] == "run" && r.Method == http.MethodPost {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-		err := workflow.RunWorkflow(workflowID)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
-
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"workflow_id": workflowID,
-			"status":      "started",
-		})
-
-		return
-	}
-
-	// /workflows/{id}/steps
-	if len(parts) == 2 && parts[1] == "steps" {
-		getWorkflowSteps(w, workflowID)
-		return
-	}
-
-	// /workflows/{id}/context
-	if len(parts) == 2 && parts[1] == "context" {
-		getWorkflowContext(w, workflowID)
-		return
+	if err := e.Start(context.Background()); err != nil {
+		fatal("Failed to start", err)
 	}
 
-	// Default: workflow metadata
-	var wf Workflow
-	err = db.QueryRow(`
-		SELECT id, status, steps, context, created_at, updated_at,
-       	started_at, finished_at, execution_time_ms
-		FROM workflows
-		WHERE id = $1
-	`, workflowID).Scan(
-		&wf.ID,
-		&wf.Status,
-		&wf.Steps,
-		&wf.Context,
-		&wf.CreatedAt,
-		&wf.UpdatedAt,
-		&wf.StartedAt,
-		&wf.FinishedAt,
-		&wf.ExecutionTimeMs,
-	)
+	<-ctx.Done()
+	slog.Info("Shutdown signal received")
 
-	if err != nil {
-		http.Error(w, "Workflow not found", http.StatusNotFound)
-		return
-	}
-
-	json.NewEncoder(w).Encode(wf)
-}
-
-func getWorkflowSteps(w http.ResponseWriter, workflowID int) {
-
-	rows, err := db.Query(`
-		SELECT id, workflow_id, step_id, job_id, status,
-		       started_at, finished_at, error, response_snapshot
-		FROM workflow_step_runs
-		WHERE workflow_id = $1
-		ORDER BY id
-	`, workflowID)
-
-	if err != nil {
-		http.Error(w, "Query failed", http.StatusInternalServerError)
-		return
-	}
-	defer rows.Close()
-
-	var steps []WorkflowStepRun
-
-	for rows.Next() {
-		var s WorkflowStepRun
-		var rawResp []byte
-		err := rows.Scan(
-			&s.ID,
-			&s.WorkflowID,
-			&s.StepID,
-			&s.JobID,
-			&s.Status,
-			&s.StartedAt,
-			&s.FinishedAt,
-			&s.Error,
-			&rawResp,
-		)
-		if err != nil {
-			log.Println("getWorkflowSteps scan error:", err)
-			http.Error(w, "Scan failed: "+err.Error(), http.StatusInternalServerError)
-			return
-		}
-		if rawResp != nil {
-			s.ResponseSnapshot = rawResp
-		}
-		steps = append(steps, s)
-	}
-
-	json.NewEncoder(w).Encode(steps)
+	e.Shutdown()
 }
 
-func getWorkflowContext(w http.ResponseWriter, workflowID int) {
-
-	var context json.RawMessage
-
-	err := db.QueryRow(`
-		SELECT context
-		FROM workflows
-		WHERE id = $1
-	`, workflowID).Scan(&context)
-
-	if err != nil {
-		http.Error(w, "Workflow not found", http.StatusNotFound)
-		return
-	}
-
-	json.NewEncoder(w).Encode(map[string]json.RawMessage{
-		"context": context,
-	})
-}
-
-func jobDetailHandler(w http.ResponseWriter, r *http.Request) {
-
-	idStr := strings.TrimPrefix(r.URL.Path, "/jobs/")
-	jobID, err := strconv.Atoi(idStr)
-	if err != nil {
-		http.Error(w, "Invalid job id", http.StatusBadRequest)
-		return
-	}
-
-	var job Job
-	var payloadBytes []byte
-
-	err = db.QueryRow(`
-		SELECT id, type, payload, status, run_at
-		FROM jobs
-		WHERE id = $1
-	`, jobID).Scan(
-		&job.ID,
-		&job.Type,
-		&payloadBytes,
-		&job.Status,
-		&job.RunAt,
-	)
-
-	if err != nil {
-		http.Error(w, "Job not found", http.StatusNotFound)
-		return
-	}
-
-	json.Unmarshal(payloadBytes, &job.Payload)
-	json.NewEncoder(w).Encode(job)
+// fatal logs err and exits, for startup failures the server cannot run
+// without.
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
 }
@@ -0,0 +1,293 @@
+// Package migrations builds and evolves the database schema in numbered
+// steps. 0001_baseline creates the schema as it was before migrations,
+// idempotently, so databases set up by older servers pass through it
+// unharmed; every later change is a migration of its own:
+//
+//	sql/0003_add_constraint.up.sql
+//	sql/0003_add_constraint.down.sql
+//
+// A migration that adds a column to jobs adds it to jobs_archive too.
+//
+// Files are embedded in the binary. Each migration runs in its own
+// transaction and is recorded in schema_migrations, and an advisory lock
+// keeps servers starting together from applying the same one twice.
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed sql/*.sql
+var files embed.FS
+
+// lockKey is the advisory lock held while migrating.
+const lockKey = 7246934
+
+const tableSQL = `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+	version INT PRIMARY KEY,
+	name TEXT NOT NULL,
+	applied_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+`
+
+// Migration is one schema change and the statements that undo it.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// State is a migration and when it was applied, if it was.
+type State struct {
+	Version   int        `json:"version"`
+	Name      string     `json:"name"`
+	AppliedAt *time.Time `json:"applied_at"`
+}
+
+// All returns the embedded migrations in version order.
+func All() ([]Migration, error) {
+
+	entries, err := fs.ReadDir(files, "sql")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, e := range entries {
+		name := e.Name()
+
+		base, direction, ok := strings.Cut(strings.TrimSuffix(name, ".sql"), ".")
+		if !ok || (direction != "up" && direction != "down") {
+			return nil, fmt.Errorf("%s: expected <version>_<name>.up.sql or .down.sql", name)
+		}
+
+		num, label, _ := strings.Cut(base, "_")
+		version, err := strconv.Atoi(num)
+		if err != nil || version < 1 {
+			return nil, fmt.Errorf("%s: version must be a positive number", name)
+		}
+
+		body, err := files.ReadFile(path.Join("sql", name))
+		if err != nil {
+			return nil, err
+		}
+
+		m := byVersion[version]
+		if m == nil {
+			m = &Migration{Version: version, Name: label}
+			byVersion[version] = m
+		} else if m.Name != label {
+			return nil, fmt.Errorf("version %d is used by %s and %s", version, m.Name, label)
+		}
+
+		if direction == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	all := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %d (%s) has no up file", m.Version, m.Name)
+		}
+		all = append(all, *m)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Version < all[j].Version })
+
+	return all, nil
+}
+
+// Status lists every migration with when it was applied.
+func Status(db *sql.DB) ([]State, error) {
+
+	all, err := All()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := db.Exec(tableSQL); err != nil {
+		return nil, err
+	}
+
+	applied, err := appliedAt(db)
+	if err != nil {
+		return nil, err
+	}
+
+	states := make([]State, len(all))
+	for i, m := range all {
+		states[i] = State{Version: m.Version, Name: m.Name}
+		if at, ok := applied[m.Version]; ok {
+			states[i].AppliedAt = &at
+		}
+	}
+	return states, nil
+}
+
+// Pending lists the migrations not applied yet.
+func Pending(db *sql.DB) ([]Migration, error) {
+
+	all, err := All()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := db.Exec(tableSQL); err != nil {
+		return nil, err
+	}
+
+	applied, err := appliedAt(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []Migration
+	for _, m := range all {
+		if _, ok := applied[m.Version]; !ok {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// Up applies every pending migration in order and returns those it
+// applied. It stops at the first failure, leaving that one unapplied.
+func Up(db *sql.DB) ([]Migration, error) {
+
+	var done []Migration
+
+	err := locked(db, func(conn *sql.Conn) error {
+
+		pending, err := Pending(db)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range pending {
+			err := inTx(conn, func(tx *sql.Tx) error {
+				if _, err := tx.Exec(m.Up); err != nil {
+					return err
+				}
+				_, err := tx.Exec(`INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`, m.Version, m.Name)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+			}
+			done = append(done, m)
+		}
+		return nil
+	})
+
+	return done, err
+}
+
+// Down reverts the last steps applied migrations, newest first, and
+// returns those it reverted.
+func Down(db *sql.DB, steps int) ([]Migration, error) {
+
+	var done []Migration
+
+	err := locked(db, func(conn *sql.Conn) error {
+
+		states, err := Status(db)
+		if err != nil {
+			return err
+		}
+		all, err := All()
+		if err != nil {
+			return err
+		}
+
+		for i := len(states) - 1; i >= 0 && len(done) < steps; i-- {
+			if states[i].AppliedAt == nil {
+				continue
+			}
+			m := all[i]
+			if m.Down == "" {
+				return fmt.Errorf("migration %d (%s) cannot be reverted: no down file", m.Version, m.Name)
+			}
+
+			err := inTx(conn, func(tx *sql.Tx) error {
+				if _, err := tx.Exec(m.Down); err != nil {
+					return err
+				}
+				_, err := tx.Exec(`DELETE FROM schema_migrations WHERE version = $1`, m.Version)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("revert %d (%s): %w", m.Version, m.Name, err)
+			}
+			done = append(done, m)
+		}
+		return nil
+	})
+
+	return done, err
+}
+
+func appliedAt(db *sql.DB) (map[int]time.Time, error) {
+
+	rows, err := db.Query(`SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		applied[version] = at
+	}
+	return applied, rows.Err()
+}
+
+// locked runs fn holding the migration lock on a dedicated connection.
+func locked(db *sql.DB, fn func(conn *sql.Conn) error) error {
+
+	ctx := context.Background()
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, lockKey); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, lockKey)
+
+	return fn(conn)
+}
+
+func inTx(conn *sql.Conn, fn func(tx *sql.Tx) error) error {
+
+	tx, err := conn.BeginTx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,39 @@
+-- Drops the whole schema, and every job with it
+DROP TABLE IF EXISTS jobs_archive;
+
+DROP TABLE IF EXISTS claim_pauses;
+DROP TABLE IF EXISTS bulk_operations;
+DROP TABLE IF EXISTS job_type_rates;
+DROP TABLE IF EXISTS batches;
+DROP TABLE IF EXISTS schedules;
+DROP TABLE IF EXISTS secrets;
+DROP TABLE IF EXISTS api_key_usage;
+DROP TABLE IF EXISTS idempotency_keys;
+
+DROP TABLE IF EXISTS dead_letter;
+DROP TRIGGER IF EXISTS jobs_record_event ON jobs;
+DROP TRIGGER IF EXISTS jobs_record_created ON jobs;
+DROP FUNCTION IF EXISTS record_job_event();
+DROP TABLE IF EXISTS job_events;
+DROP TABLE IF EXISTS job_logs;
+
+DROP TABLE IF EXISTS digest_events;
+DROP TABLE IF EXISTS pagespeed_results;
+DROP TABLE IF EXISTS dns_snapshots;
+DROP TABLE IF EXISTS uptime_checks;
+DROP TABLE IF EXISTS uptime_monitors;
+DROP TABLE IF EXISTS geocode_cache;
+DROP TABLE IF EXISTS plugin_storage;
+
+DROP TABLE IF EXISTS webhook_fanout_deliveries;
+DROP TABLE IF EXISTS webhook_subscriptions;
+DROP TABLE IF EXISTS job_executions;
+DROP TABLE IF EXISTS deliveries;
+DROP TABLE IF EXISTS outbox;
+
+DROP TABLE IF EXISTS workflow_step_runs;
+DROP TABLE IF EXISTS workflows;
+
+DROP TRIGGER IF EXISTS jobs_notify_pending ON jobs;
+DROP FUNCTION IF EXISTS notify_job_pending();
+DROP TABLE IF EXISTS jobs;
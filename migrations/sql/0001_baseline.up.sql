@@ -0,0 +1,484 @@
+-- The schema as the server built it before migrations. Tables and columns
+-- are created only if missing, so a database set up by an older server is
+-- brought to the same point instead of failing.
+
+-- ==== jobs ====
+
+CREATE TABLE IF NOT EXISTS jobs (
+	id SERIAL PRIMARY KEY,
+	type TEXT NOT NULL,
+	payload JSONB,
+	status TEXT NOT NULL,
+	retry_count INT DEFAULT 0,
+	run_at TIMESTAMPTZ DEFAULT NOW(),
+	last_error TEXT,
+	response_status INT,
+	response_body JSONB,
+	execution_time_ms INT,
+	created_at TIMESTAMPTZ DEFAULT NOW(),
+	updated_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+-- created_at and updated_at predate time zone awareness; retention and
+-- conditional reads compare them against NOW()
+ALTER TABLE jobs
+	ALTER COLUMN created_at TYPE TIMESTAMPTZ,
+	ALTER COLUMN updated_at TYPE TIMESTAMPTZ;
+
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS queue TEXT NOT NULL DEFAULT 'default';
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS tags TEXT[] NOT NULL DEFAULT '{}';
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS max_retries INT;
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS backoff TEXT;
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS base_delay_seconds INT;
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS max_delay_seconds INT;
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ;
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS attempt_errors JSONB NOT NULL DEFAULT '[]';
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS unique_key TEXT;
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS timeout_seconds INT;
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS claimed_by TEXT;
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS sensitive TEXT[];
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS tenant_id TEXT NOT NULL DEFAULT 'default';
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS priority INT NOT NULL DEFAULT 0;
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS batch_id TEXT;
+
+CREATE INDEX IF NOT EXISTS idx_jobs_expiring
+ON jobs (expires_at)
+WHERE status = 'pending' AND expires_at IS NOT NULL;
+
+-- Unique keys are per tenant; the index before tenants was global. The
+-- predicate matches uniqueJobPredicate in engine/server.go.
+CREATE UNIQUE INDEX IF NOT EXISTS idx_jobs_unique_tenant ON jobs (tenant_id, type, unique_key)
+WHERE unique_key IS NOT NULL AND status IN ('pending', 'processing');
+DROP INDEX IF EXISTS idx_jobs_unique;
+
+CREATE INDEX IF NOT EXISTS idx_jobs_tenant ON jobs (tenant_id, status, id);
+CREATE INDEX IF NOT EXISTS idx_jobs_tags ON jobs USING GIN (tags);
+CREATE INDEX IF NOT EXISTS idx_jobs_ready ON jobs (status, run_at);
+
+-- Matches the claim order, so workers read pending jobs off the index
+CREATE INDEX IF NOT EXISTS idx_jobs_priority
+ON jobs (priority DESC, run_at) WHERE status = 'pending';
+
+CREATE INDEX IF NOT EXISTS idx_jobs_payload
+ON jobs USING GIN (payload jsonb_path_ops);
+
+CREATE INDEX IF NOT EXISTS idx_jobs_batch
+ON jobs (tenant_id, batch_id)
+WHERE batch_id IS NOT NULL;
+
+-- Wakes idle workers (see engine/notify.go); scheduled jobs wake them too,
+-- so they can re-arm their timers for the new run_at
+CREATE OR REPLACE FUNCTION notify_job_pending() RETURNS trigger AS $$
+BEGIN
+	PERFORM pg_notify('goflow_jobs', NEW.queue);
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS jobs_notify_pending ON jobs;
+
+CREATE TRIGGER jobs_notify_pending
+AFTER INSERT OR UPDATE OF status, run_at ON jobs
+FOR EACH ROW WHEN (NEW.status = 'pending')
+EXECUTE FUNCTION notify_job_pending();
+
+-- ==== workflows ====
+
+CREATE TABLE IF NOT EXISTS workflows (
+	id SERIAL PRIMARY KEY,
+	status TEXT NOT NULL,
+	current_step INT DEFAULT 0,
+	steps JSONB NOT NULL,
+	context JSONB DEFAULT '{}'::jsonb,
+
+	started_at TIMESTAMP,
+	finished_at TIMESTAMP,
+	execution_time_ms BIGINT,
+
+	barrier_resumed BOOLEAN DEFAULT FALSE,
+
+	created_at TIMESTAMP DEFAULT NOW(),
+	updated_at TIMESTAMP DEFAULT NOW()
+);
+
+ALTER TABLE workflows ADD COLUMN IF NOT EXISTS dag BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE workflows ADD COLUMN IF NOT EXISTS tenant_id TEXT NOT NULL DEFAULT 'default';
+
+CREATE INDEX IF NOT EXISTS idx_workflows_tenant ON workflows (tenant_id, id);
+
+CREATE TABLE IF NOT EXISTS workflow_step_runs (
+	id SERIAL PRIMARY KEY,
+	workflow_id INT NOT NULL,
+	step_id TEXT NOT NULL,
+	job_id INT NOT NULL,
+	status TEXT NOT NULL,
+
+	parent_step_id TEXT,
+	is_parallel_child BOOLEAN DEFAULT FALSE,
+
+	started_at TIMESTAMP DEFAULT NOW(),
+	finished_at TIMESTAMP,
+	error TEXT,
+	response_snapshot JSONB,
+	created_at TIMESTAMP DEFAULT NOW()
+);
+
+-- ==== delivery ====
+
+CREATE TABLE IF NOT EXISTS outbox (
+	id SERIAL PRIMARY KEY,
+	job_id INT NOT NULL,
+	kind TEXT NOT NULL,
+	target_url TEXT NOT NULL,
+	secret TEXT,
+	body JSONB NOT NULL,
+	status TEXT NOT NULL DEFAULT 'pending',
+	attempts INT DEFAULT 0,
+	last_error TEXT,
+	next_attempt_at TIMESTAMPTZ DEFAULT NOW(),
+	delivered_at TIMESTAMPTZ,
+	created_at TIMESTAMP DEFAULT NOW()
+);
+
+ALTER TABLE outbox ADD COLUMN IF NOT EXISTS delivery_id TEXT;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_outbox_delivery
+ON outbox (delivery_id);
+
+CREATE INDEX IF NOT EXISTS idx_outbox_due
+ON outbox (status, next_attempt_at);
+
+CREATE TABLE IF NOT EXISTS deliveries (
+	delivery_id TEXT PRIMARY KEY,
+	job_id INT,
+	target_url TEXT NOT NULL,
+	response_status INT,
+	response_body BYTEA,
+	acknowledged_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS job_executions (
+	job_type TEXT NOT NULL,
+	idempotency_key TEXT NOT NULL,
+	job_id INT,
+	status TEXT NOT NULL,
+	response_status INT,
+	response_body BYTEA,
+	started_at TIMESTAMPTZ DEFAULT NOW(),
+	finished_at TIMESTAMPTZ,
+	PRIMARY KEY (job_type, idempotency_key)
+);
+
+CREATE TABLE IF NOT EXISTS webhook_subscriptions (
+	id SERIAL PRIMARY KEY,
+	topic TEXT NOT NULL,
+	url TEXT NOT NULL,
+	secret TEXT NOT NULL,
+	active BOOLEAN NOT NULL DEFAULT TRUE,
+	created_at TIMESTAMPTZ DEFAULT NOW(),
+	UNIQUE (topic, url)
+);
+
+CREATE TABLE IF NOT EXISTS webhook_fanout_deliveries (
+	fanout_job_id INT NOT NULL,
+	url TEXT NOT NULL,
+	delivery_job_id INT,
+	attempts INT NOT NULL DEFAULT 0,
+	last_status INT,
+	last_error TEXT,
+	delivered_at TIMESTAMPTZ,
+	updated_at TIMESTAMPTZ DEFAULT NOW(),
+	PRIMARY KEY (fanout_job_id, url)
+);
+
+-- ==== executor state ====
+
+CREATE TABLE IF NOT EXISTS plugin_storage (
+	plugin TEXT NOT NULL,
+	key TEXT NOT NULL,
+	value TEXT NOT NULL,
+	updated_at TIMESTAMPTZ DEFAULT NOW(),
+	PRIMARY KEY (plugin, key)
+);
+
+CREATE TABLE IF NOT EXISTS geocode_cache (
+	key TEXT PRIMARY KEY,
+	results JSONB NOT NULL,
+	fetched_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS uptime_monitors (
+	monitor TEXT PRIMARY KEY,
+	state TEXT NOT NULL,
+	consecutive_failures INT NOT NULL DEFAULT 0,
+	last_checked_at TIMESTAMPTZ,
+	last_changed_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS uptime_checks (
+	id SERIAL PRIMARY KEY,
+	monitor TEXT NOT NULL,
+	url TEXT NOT NULL,
+	ok BOOLEAN NOT NULL,
+	status_code INT,
+	latency_ms BIGINT NOT NULL,
+	error TEXT,
+	checked_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_uptime_checks_monitor
+ON uptime_checks (monitor, checked_at);
+
+CREATE TABLE IF NOT EXISTS dns_snapshots (
+	name TEXT NOT NULL,
+	record_type TEXT NOT NULL,
+	record_values TEXT[] NOT NULL,
+	checked_at TIMESTAMPTZ DEFAULT NOW(),
+	PRIMARY KEY (name, record_type)
+);
+
+CREATE TABLE IF NOT EXISTS pagespeed_results (
+	id SERIAL PRIMARY KEY,
+	url TEXT NOT NULL,
+	strategy TEXT NOT NULL,
+	scores JSONB NOT NULL,
+	metrics JSONB NOT NULL,
+	fetched_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_pagespeed_results_url
+ON pagespeed_results (url, strategy, fetched_at);
+
+CREATE TABLE IF NOT EXISTS digest_events (
+	id SERIAL PRIMARY KEY,
+	digest TEXT NOT NULL,
+	kind TEXT NOT NULL,
+	summary TEXT NOT NULL DEFAULT '',
+	data JSONB,
+	digest_job_id INT,
+	digested_at TIMESTAMPTZ,
+	created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_digest_events_pending
+ON digest_events (digest, id) WHERE digest_job_id IS NULL;
+
+-- ==== job history ====
+
+CREATE TABLE IF NOT EXISTS job_logs (
+	id BIGSERIAL PRIMARY KEY,
+	job_id INT NOT NULL REFERENCES jobs(id) ON DELETE CASCADE,
+	message TEXT NOT NULL,
+	created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_job_logs_job ON job_logs (job_id, id);
+
+-- Every status change of a job, recorded by a trigger (see
+-- engine/events.go) and sent on goflow_job_events for live streams
+CREATE TABLE IF NOT EXISTS job_events (
+	id BIGSERIAL PRIMARY KEY,
+	job_id INT NOT NULL REFERENCES jobs(id) ON DELETE CASCADE,
+	event TEXT NOT NULL,
+	status TEXT NOT NULL,
+	worker TEXT,
+	attempt INT,
+	error TEXT,
+	created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_job_events_job ON job_events (job_id, id);
+
+CREATE OR REPLACE FUNCTION record_job_event() RETURNS trigger AS $$
+DECLARE
+	ev TEXT;
+	e job_events%ROWTYPE;
+BEGIN
+	IF TG_OP = 'INSERT' THEN
+		ev := 'created';
+	ELSE
+		ev := CASE
+			WHEN NEW.status = 'processing' THEN 'claimed'
+			WHEN NEW.status = 'pending' AND OLD.status = 'processing' AND NEW.retry_count > OLD.retry_count THEN 'retried'
+			WHEN NEW.status = 'pending' AND OLD.status = 'processing' THEN 'released'
+			WHEN NEW.status = 'pending' THEN 'requeued'
+			ELSE NEW.status
+		END;
+	END IF;
+
+	INSERT INTO job_events (job_id, event, status, worker, attempt, error)
+	VALUES (
+		NEW.id, ev, NEW.status,
+		CASE WHEN ev IN ('created', 'requeued', 'cancelled', 'expired') THEN NULL ELSE NEW.claimed_by END,
+		CASE
+			WHEN ev IN ('claimed', 'completed') THEN NEW.retry_count + 1
+			WHEN ev IN ('retried', 'failed') THEN NEW.retry_count
+		END,
+		CASE WHEN ev IN ('retried', 'failed', 'cancelled', 'expired') THEN NEW.last_error END
+	)
+	RETURNING * INTO e;
+
+	-- Streamed to SSE clients (see engine/stream.go); NOTIFY payloads are
+	-- capped at 8000 bytes, so long errors are cut short
+	PERFORM pg_notify('goflow_job_events', (to_jsonb(e) || jsonb_build_object(
+		'error', left(e.error, 1000), 'job_type', NEW.type, 'queue', NEW.queue,
+		'tenant_id', NEW.tenant_id))::text);
+
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS jobs_record_created ON jobs;
+
+CREATE TRIGGER jobs_record_created
+AFTER INSERT ON jobs
+FOR EACH ROW EXECUTE FUNCTION record_job_event();
+
+DROP TRIGGER IF EXISTS jobs_record_event ON jobs;
+
+CREATE TRIGGER jobs_record_event
+AFTER UPDATE OF status ON jobs
+FOR EACH ROW WHEN (OLD.status IS DISTINCT FROM NEW.status)
+EXECUTE FUNCTION record_job_event();
+
+CREATE TABLE IF NOT EXISTS dead_letter (
+	id SERIAL PRIMARY KEY,
+	job_id INT NOT NULL UNIQUE,
+	type TEXT NOT NULL,
+	payload JSONB,
+	queue TEXT NOT NULL,
+	tags TEXT[] NOT NULL DEFAULT '{}',
+	attempts INT NOT NULL,
+	last_error TEXT,
+	errors JSONB NOT NULL DEFAULT '[]',
+	response_status INT,
+	response_body JSONB,
+	failed_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+ALTER TABLE dead_letter ADD COLUMN IF NOT EXISTS tenant_id TEXT NOT NULL DEFAULT 'default';
+
+CREATE INDEX IF NOT EXISTS idx_dead_letter_type ON dead_letter (type, failed_at);
+CREATE INDEX IF NOT EXISTS idx_dead_letter_tenant ON dead_letter (tenant_id, failed_at);
+
+-- ==== API and operations ====
+
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+	key TEXT PRIMARY KEY,
+	request_hash TEXT NOT NULL,
+	response_status INT,
+	response_body BYTEA,
+	created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS api_key_usage (
+	key_name TEXT NOT NULL,
+	period TEXT NOT NULL,
+	jobs INT NOT NULL DEFAULT 0,
+	PRIMARY KEY (key_name, period)
+);
+
+CREATE TABLE IF NOT EXISTS secrets (
+	tenant_id TEXT NOT NULL,
+	name TEXT NOT NULL,
+	value BYTEA NOT NULL,
+	created_at TIMESTAMPTZ DEFAULT NOW(),
+	updated_at TIMESTAMPTZ DEFAULT NOW(),
+	PRIMARY KEY (tenant_id, name)
+);
+
+CREATE TABLE IF NOT EXISTS schedules (
+	id SERIAL PRIMARY KEY,
+	tenant_id TEXT NOT NULL DEFAULT 'default',
+	name TEXT,
+	cron TEXT NOT NULL,
+	timezone TEXT NOT NULL DEFAULT 'UTC',
+	job_type TEXT NOT NULL,
+	payload JSONB NOT NULL,
+	queue TEXT NOT NULL DEFAULT 'default',
+	tags TEXT[] NOT NULL DEFAULT '{}',
+	priority INT NOT NULL DEFAULT 0,
+	sensitive TEXT[],
+	enabled BOOLEAN NOT NULL DEFAULT TRUE,
+	next_run_at TIMESTAMPTZ NOT NULL,
+	last_run_at TIMESTAMPTZ,
+	last_job_id INT,
+	created_at TIMESTAMPTZ DEFAULT NOW(),
+	updated_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+ALTER TABLE schedules ADD COLUMN IF NOT EXISTS overlap TEXT NOT NULL DEFAULT 'allow';
+
+CREATE INDEX IF NOT EXISTS idx_schedules_due
+ON schedules (next_run_at)
+WHERE enabled;
+
+CREATE TABLE IF NOT EXISTS batches (
+	tenant_id TEXT NOT NULL DEFAULT 'default',
+	id TEXT NOT NULL,
+	size INT,
+	callback_url TEXT,
+	callback_secret TEXT,
+	completed_at TIMESTAMPTZ,
+	created_at TIMESTAMPTZ DEFAULT NOW(),
+	PRIMARY KEY (tenant_id, id)
+);
+
+CREATE TABLE IF NOT EXISTS job_type_rates (
+	job_type TEXT PRIMARY KEY,
+	tat TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS bulk_operations (
+	id SERIAL PRIMARY KEY,
+	action TEXT NOT NULL,
+	filter JSONB NOT NULL,
+	run_at TIMESTAMPTZ,
+	status TEXT NOT NULL,
+	total INT,
+	processed INT NOT NULL DEFAULT 0,
+	error TEXT,
+	job_id INT,
+	created_at TIMESTAMPTZ DEFAULT NOW(),
+	started_at TIMESTAMPTZ,
+	finished_at TIMESTAMPTZ
+);
+
+ALTER TABLE bulk_operations ADD COLUMN IF NOT EXISTS tenant_id TEXT NOT NULL DEFAULT 'default';
+
+CREATE TABLE IF NOT EXISTS claim_pauses (
+	scope TEXT PRIMARY KEY,
+	reason TEXT,
+	paused_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+-- ==== archive ====
+
+-- Last, so the archive has every column of jobs. Later migrations that add
+-- a column to jobs add it here too.
+CREATE TABLE IF NOT EXISTS jobs_archive (LIKE jobs);
+
+ALTER TABLE jobs_archive ADD COLUMN IF NOT EXISTS archived_at TIMESTAMPTZ NOT NULL DEFAULT NOW();
+
+-- An archive made by an older server lacks the columns added since
+DO $$
+DECLARE
+	col RECORD;
+BEGIN
+	FOR col IN
+		SELECT attname, format_type(atttypid, atttypmod) AS typ
+		FROM pg_attribute
+		WHERE attrelid = 'jobs'::regclass AND attnum > 0 AND NOT attisdropped
+		ORDER BY attnum
+	LOOP
+		EXECUTE format('ALTER TABLE jobs_archive ADD COLUMN IF NOT EXISTS %I %s', col.attname, col.typ);
+	END LOOP;
+END;
+$$;
+
+ALTER TABLE jobs_archive
+	ALTER COLUMN created_at TYPE TIMESTAMPTZ,
+	ALTER COLUMN updated_at TYPE TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS idx_jobs_archive_tenant ON jobs_archive (tenant_id, id);
+CREATE INDEX IF NOT EXISTS idx_jobs_archive_archived ON jobs_archive (archived_at);
@@ -0,0 +1,5 @@
+DROP TRIGGER IF EXISTS jobs_reset_brokered ON jobs;
+DROP FUNCTION IF EXISTS reset_job_brokered();
+
+ALTER TABLE jobs_archive DROP COLUMN IF EXISTS brokered;
+ALTER TABLE jobs DROP COLUMN IF EXISTS brokered;
@@ -0,0 +1,22 @@
+-- Marks which pending jobs have been handed to Redis (see
+-- engine/broker.go). Any change that makes a job pending again, or moves
+-- it, clears the mark so the feeder hands it over anew.
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS brokered BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE jobs_archive ADD COLUMN IF NOT EXISTS brokered BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE INDEX IF NOT EXISTS idx_jobs_unbrokered ON jobs (id)
+WHERE status = 'pending' AND NOT brokered;
+
+CREATE OR REPLACE FUNCTION reset_job_brokered() RETURNS trigger AS $$
+BEGIN
+	NEW.brokered := FALSE;
+	RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS jobs_reset_brokered ON jobs;
+
+CREATE TRIGGER jobs_reset_brokered
+BEFORE UPDATE OF status, run_at, priority, queue ON jobs
+FOR EACH ROW WHEN (NEW.status = 'pending')
+EXECUTE FUNCTION reset_job_brokered();
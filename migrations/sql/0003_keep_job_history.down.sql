@@ -0,0 +1,8 @@
+-- The history of archived jobs goes, as it did before
+DELETE FROM job_events e WHERE NOT EXISTS (SELECT 1 FROM jobs j WHERE j.id = e.job_id);
+DELETE FROM job_logs l WHERE NOT EXISTS (SELECT 1 FROM jobs j WHERE j.id = l.job_id);
+
+ALTER TABLE job_events ADD CONSTRAINT job_events_job_id_fkey
+	FOREIGN KEY (job_id) REFERENCES jobs(id) ON DELETE CASCADE;
+ALTER TABLE job_logs ADD CONSTRAINT job_logs_job_id_fkey
+	FOREIGN KEY (job_id) REFERENCES jobs(id) ON DELETE CASCADE;
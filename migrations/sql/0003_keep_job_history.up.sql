@@ -0,0 +1,4 @@
+-- Events and logs outlive their job's move to jobs_archive; the server
+-- deletes them with the job when it is deleted for good
+ALTER TABLE job_events DROP CONSTRAINT IF EXISTS job_events_job_id_fkey;
+ALTER TABLE job_logs DROP CONSTRAINT IF EXISTS job_logs_job_id_fkey;
@@ -0,0 +1,8 @@
+-- Signatures of accepted signed submissions (see engine/signing.go), kept
+-- until their timestamp is too old to verify, so none is accepted twice
+CREATE TABLE IF NOT EXISTS used_signatures (
+	signature TEXT PRIMARY KEY,
+	expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_used_signatures_expires ON used_signatures (expires_at);
@@ -0,0 +1,16 @@
+DROP INDEX IF EXISTS idx_digest_events_pending;
+CREATE INDEX idx_digest_events_pending
+ON digest_events (digest, id) WHERE digest_job_id IS NULL;
+
+ALTER TABLE digest_events DROP COLUMN IF EXISTS tenant_id;
+
+-- Other tenants' copies of a subscription go; one per topic and URL is left
+DELETE FROM webhook_subscriptions s
+WHERE EXISTS (
+	SELECT 1 FROM webhook_subscriptions o
+	WHERE o.topic = s.topic AND o.url = s.url AND o.id < s.id
+);
+
+ALTER TABLE webhook_subscriptions DROP CONSTRAINT IF EXISTS webhook_subscriptions_tenant_id_topic_url_key;
+ALTER TABLE webhook_subscriptions ADD CONSTRAINT webhook_subscriptions_topic_url_key UNIQUE (topic, url);
+ALTER TABLE webhook_subscriptions DROP COLUMN IF EXISTS tenant_id;
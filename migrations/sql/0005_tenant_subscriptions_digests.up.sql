@@ -0,0 +1,12 @@
+-- Webhook subscriptions and digest events belong to a tenant; topics and
+-- digest names are only unique within one
+ALTER TABLE webhook_subscriptions ADD COLUMN IF NOT EXISTS tenant_id TEXT NOT NULL DEFAULT 'default';
+ALTER TABLE webhook_subscriptions DROP CONSTRAINT IF EXISTS webhook_subscriptions_topic_url_key;
+ALTER TABLE webhook_subscriptions ADD CONSTRAINT webhook_subscriptions_tenant_id_topic_url_key
+	UNIQUE (tenant_id, topic, url);
+
+ALTER TABLE digest_events ADD COLUMN IF NOT EXISTS tenant_id TEXT NOT NULL DEFAULT 'default';
+
+DROP INDEX IF EXISTS idx_digest_events_pending;
+CREATE INDEX idx_digest_events_pending
+ON digest_events (tenant_id, digest, id) WHERE digest_job_id IS NULL;
@@ -0,0 +1,11 @@
+-- Of the same key in several tenants, the earliest execution is kept
+DELETE FROM job_executions e
+WHERE EXISTS (
+	SELECT 1 FROM job_executions o
+	WHERE o.job_type = e.job_type AND o.idempotency_key = e.idempotency_key
+	  AND (o.started_at, o.tenant_id) < (e.started_at, e.tenant_id)
+);
+
+ALTER TABLE job_executions DROP CONSTRAINT IF EXISTS job_executions_pkey;
+ALTER TABLE job_executions ADD PRIMARY KEY (job_type, idempotency_key);
+ALTER TABLE job_executions DROP COLUMN tenant_id;
@@ -0,0 +1,10 @@
+-- Effectively-once executions are keyed per tenant, like Idempotency-Key
+ALTER TABLE job_executions ADD COLUMN IF NOT EXISTS tenant_id TEXT NOT NULL DEFAULT 'default';
+
+-- Rows written before this migration came from jobs of any tenant
+UPDATE job_executions e SET tenant_id = j.tenant_id
+FROM jobs j
+WHERE j.id = e.job_id AND j.tenant_id <> e.tenant_id;
+
+ALTER TABLE job_executions DROP CONSTRAINT IF EXISTS job_executions_pkey;
+ALTER TABLE job_executions ADD PRIMARY KEY (tenant_id, job_type, idempotency_key);
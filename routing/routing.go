@@ -0,0 +1,99 @@
+package routing
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Routing decides which worker group runs a job. The group is stored in the
+// job's queue column when the job is enqueued, and every claim query only
+// picks up the queues its workers (or remote agents) serve.
+//
+// Rules are evaluated in order and the first match wins:
+//
+//	{
+//	  "default_group": "default",
+//	  "rules": [
+//	    {"job_type": "data_extract", "group": "scraper"},
+//	    {"payload": {"region": "eu"}, "group": "eu-workers"}
+//	  ]
+//	}
+type Rule struct {
+	JobType string                 `json:"job_type"`
+	Payload map[string]interface{} `json:"payload"`
+	Group   string                 `json:"group"`
+}
+
+type Config struct {
+	DefaultGroup string `json:"default_group"`
+	Rules        []Rule `json:"rules"`
+}
+
+var config = Config{DefaultGroup: "default"}
+
+// DefaultGroup is the group of jobs no rule matches.
+func DefaultGroup() string {
+	return config.DefaultGroup
+}
+
+// Load reads routing rules from a JSON file.
+func Load(path string) error {
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var cfg Config
+	if err := json.Unmarshal(raw, &cfg); err != nil {
+		return fmt.Errorf("invalid routing config: %w", err)
+	}
+
+	for i, r := range cfg.Rules {
+		if r.Group == "" {
+			return fmt.Errorf("routing rule %d has no group", i)
+		}
+	}
+
+	if cfg.DefaultGroup == "" {
+		cfg.DefaultGroup = "default"
+	}
+
+	config = cfg
+	return nil
+}
+
+// GroupFor returns the worker group for a job. A matching rule always wins,
+// so submitters cannot route around it; otherwise the requested group (if
+// any) or the default group is used.
+func GroupFor(jobType string, payload map[string]interface{}, requested string) string {
+
+	for _, r := range config.Rules {
+		if r.matches(jobType, payload) {
+			return r.Group
+		}
+	}
+
+	if requested != "" {
+		return requested
+	}
+
+	return config.DefaultGroup
+}
+
+func (r Rule) matches(jobType string, payload map[string]interface{}) bool {
+
+	if r.JobType != "" && r.JobType != jobType {
+		return false
+	}
+
+	for key, want := range r.Payload {
+		got, ok := payload[key]
+		if !ok || fmt.Sprint(got) != fmt.Sprint(want) {
+			return false
+		}
+	}
+
+	return true
+}
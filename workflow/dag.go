@@ -0,0 +1,330 @@
+package workflow
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+
+	"goflow/routing"
+)
+
+// ============================
+// Dependency Graphs
+// ============================
+//
+// A workflow whose steps declare depends_on runs as a graph instead of a
+// list: every step starts as soon as all the steps it depends on have
+// completed, so independent steps run in parallel.
+//
+//	{"steps": [
+//	  {"id": "fetch",  "type": "http_request", "payload": {...}},
+//	  {"id": "rates",  "type": "fx_convert",   "payload": {...}},
+//	  {"id": "report", "type": "send_email",   "depends_on": ["fetch", "rates"],
+//	   "payload": {"body": "{{fetch.response.body}} at {{rates.response.rate}}"}}
+//	]}
+//
+// Outputs reach later steps through the workflow context, as in a list
+// workflow. A failed step fails the workflow and nothing new is started;
+// the workflow completes when every step has completed.
+
+// ValidateSteps checks that every step has an id, a type and, unless it
+// is a condition or parallel step, a payload, and that ids are unique.
+// In a graph it also checks that depends_on only names other steps and
+// has no cycles.
+func ValidateSteps(rawSteps []interface{}) error {
+
+	if len(rawSteps) == 0 {
+		return fmt.Errorf("missing or invalid 'steps'")
+	}
+
+	steps := make([]map[string]interface{}, len(rawSteps))
+	ids := make(map[string]bool, len(rawSteps))
+
+	for i, raw := range rawSteps {
+		step, ok := raw.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("step %d is not an object", i)
+		}
+
+		id, _ := step["id"].(string)
+		if id == "" {
+			return fmt.Errorf("step %d has no 'id'", i)
+		}
+		if ids[id] {
+			return fmt.Errorf("step id %q is used twice", id)
+		}
+		ids[id] = true
+
+		if t, _ := step["type"].(string); t == "" {
+			return fmt.Errorf("step %q has no 'type'", id)
+		}
+
+		switch step["type"] {
+		case "condition", "parallel":
+		default:
+			if _, ok := step["payload"].(map[string]interface{}); !ok {
+				return fmt.Errorf("step %q has no 'payload'", id)
+			}
+		}
+
+		if d, ok := step["depends_on"]; ok {
+			if _, ok := d.([]interface{}); !ok {
+				return fmt.Errorf("step %q: 'depends_on' must be an array of step ids", id)
+			}
+		}
+
+		steps[i] = step
+	}
+
+	if !isGraph(steps) {
+		return nil
+	}
+
+	for _, step := range steps {
+		id := step["id"].(string)
+
+		switch step["type"] {
+		case "condition", "parallel":
+			return fmt.Errorf("step %q: %s steps cannot be used with depends_on", id, step["type"])
+		}
+
+		for _, dep := range dependsOn(step) {
+			if !ids[dep] {
+				return fmt.Errorf("step %q depends on unknown step %q", id, dep)
+			}
+		}
+	}
+
+	if cycle := findCycle(steps); cycle != "" {
+		return fmt.Errorf("steps depend on each other in a cycle through %q", cycle)
+	}
+
+	return nil
+}
+
+// isGraph reports whether any step declares depends_on.
+func isGraph(steps []map[string]interface{}) bool {
+	for _, step := range steps {
+		if _, ok := step["depends_on"]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func dependsOn(step map[string]interface{}) []string {
+
+	raw, _ := step["depends_on"].([]interface{})
+
+	deps := make([]string, 0, len(raw))
+	for _, d := range raw {
+		if id, ok := d.(string); ok {
+			deps = append(deps, id)
+		}
+	}
+	return deps
+}
+
+// findCycle returns the id of a step on a dependency cycle, or "".
+func findCycle(steps []map[string]interface{}) string {
+
+	byID := make(map[string]map[string]interface{}, len(steps))
+	for _, step := range steps {
+		byID[step["id"].(string)] = step
+	}
+
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := make(map[string]int, len(steps))
+
+	var visit func(id string) string
+	visit = func(id string) string {
+		switch state[id] {
+		case visiting:
+			return id
+		case done:
+			return ""
+		}
+		state[id] = visiting
+		for _, dep := range dependsOn(byID[id]) {
+			if cycle := visit(dep); cycle != "" {
+				return cycle
+			}
+		}
+		state[id] = done
+		return ""
+	}
+
+	for _, step := range steps {
+		if cycle := visit(step["id"].(string)); cycle != "" {
+			return cycle
+		}
+	}
+	return ""
+}
+
+// advanceGraph records a completed step's response in the context and
+// starts the steps it unblocked.
+func advanceGraph(workflowID int, stepID string, response []byte) {
+
+	if len(response) == 0 {
+		response = nil
+	}
+
+	// Merged in place: sibling steps finishing at the same time would
+	// otherwise overwrite each other's output.
+	_, err := DB.Exec(`
+		UPDATE workflows
+		SET context = COALESCE(context, '{}'::jsonb) || jsonb_build_object($2::text, jsonb_build_object('response', $3::jsonb)),
+			updated_at = NOW()
+		WHERE id = $1
+	`, workflowID, stepID, response)
+
+	if err != nil {
+		slog.Error("Workflow context update failed", "workflow_id", workflowID, "error", err)
+		return
+	}
+
+	if err := spawnReadySteps(workflowID); err != nil {
+		slog.Error("Failed to start ready workflow steps", "workflow_id", workflowID, "error", err)
+	}
+}
+
+// spawnReadySteps starts every step whose dependencies have all completed
+// and that has not started yet, or completes the workflow when no step is
+// left. The workflow row is locked, so two steps finishing together start
+// a shared dependent once.
+func spawnReadySteps(workflowID int) error {
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var status string
+	var stepsJSON, contextJSON []byte
+
+	err = tx.QueryRow(`
+		SELECT status, steps, context FROM workflows WHERE id = $1 FOR UPDATE
+	`, workflowID).Scan(&status, &stepsJSON, &contextJSON)
+
+	if err != nil {
+		return err
+	}
+
+	if status != "running" {
+		return nil
+	}
+
+	var steps []map[string]interface{}
+	json.Unmarshal(stepsJSON, &steps)
+
+	contextMap := make(map[string]interface{})
+	if contextJSON != nil {
+		json.Unmarshal(contextJSON, &contextMap)
+	}
+
+	runs := make(map[string]string)
+
+	rows, err := tx.Query(`
+		SELECT step_id, status FROM workflow_step_runs WHERE workflow_id = $1
+	`, workflowID)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var id, runStatus string
+		if err := rows.Scan(&id, &runStatus); err != nil {
+			rows.Close()
+			return err
+		}
+		runs[id] = runStatus
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	completed := 0
+	for _, step := range steps {
+		id := step["id"].(string)
+
+		if runStatus, started := runs[id]; started {
+			if runStatus == "completed" {
+				completed++
+			}
+			continue
+		}
+
+		ready := true
+		for _, dep := range dependsOn(step) {
+			if runs[dep] != "completed" {
+				ready = false
+				break
+			}
+		}
+		if !ready {
+			continue
+		}
+
+		if err := spawnGraphStep(tx, workflowID, step, contextMap); err != nil {
+			return err
+		}
+	}
+
+	if completed == len(steps) {
+		_, err = tx.Exec(`
+			UPDATE workflows
+			SET status = 'completed',
+				finished_at = NOW(),
+				execution_time_ms = EXTRACT(EPOCH FROM (NOW() - started_at)) * 1000,
+				updated_at = NOW()
+			WHERE id = $1
+			AND status = 'running'
+		`, workflowID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func spawnGraphStep(tx *sql.Tx, workflowID int, step map[string]interface{}, context map[string]interface{}) error {
+
+	stepID := step["id"].(string)
+	stepType := step["type"].(string)
+
+	stepPayload := interpolatePayload(step["payload"].(map[string]interface{}), context)
+	stepPayload["workflow_id"] = workflowID
+	stepPayload["step_id"] = stepID
+
+	if err := SealPayload(stepPayload); err != nil {
+		return err
+	}
+
+	payloadJSON, _ := json.Marshal(stepPayload)
+
+	var jobID int
+
+	err := tx.QueryRow(`
+		INSERT INTO jobs (type, payload, status, queue, tenant_id)
+		SELECT $1, $2, 'pending', $3, tenant_id FROM workflows WHERE id = $4
+		RETURNING id
+	`, stepType, payloadJSON, routing.GroupFor(stepType, stepPayload, ""), workflowID).Scan(&jobID)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO workflow_step_runs (workflow_id, step_id, job_id, status)
+		VALUES ($1, $2, $3, 'running')
+	`, workflowID, stepID, jobID)
+
+	return err
+}
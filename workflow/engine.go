@@ -5,23 +5,30 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"regexp"
 	"strconv"
 	"strings"
+
+	"goflow/routing"
 )
 
 var DB *sql.DB
 
+// SealPayload encrypts the credential fields of a step's payload before
+// its job is stored, including values interpolated from earlier steps.
+// The server sets it; it does nothing by default.
+var SealPayload = func(payload map[string]interface{}) error { return nil }
+
 // ============================
 // Start Workflow
 // ============================
 
-func Start(ctx context.Context, payload map[string]interface{}) (int, []byte, error) {
+func Start(ctx context.Context, tenant string, payload map[string]interface{}) (int, []byte, error) {
 
-	rawSteps, ok := payload["steps"].([]interface{})
-	if !ok || len(rawSteps) == 0 {
-		return 0, nil, fmt.Errorf("missing or invalid 'steps'")
+	rawSteps, _ := payload["steps"].([]interface{})
+	if err := ValidateSteps(rawSteps); err != nil {
+		return 0, nil, err
 	}
 
 	stepsJSON, err := json.Marshal(rawSteps)
@@ -29,18 +36,36 @@ func Start(ctx context.Context, payload map[string]interface{}) (int, []byte, er
 		return 0, nil, err
 	}
 
+	var steps []map[string]interface{}
+	json.Unmarshal(stepsJSON, &steps)
+	graph := isGraph(steps)
+
 	var workflowID int
 
 	err = DB.QueryRow(`
-		INSERT INTO workflows (status, steps, started_at)
-		VALUES ('running', $1, NOW())
+		INSERT INTO workflows (status, steps, started_at, tenant_id, dag)
+		VALUES ('running', $1, NOW(), COALESCE(NULLIF($2, ''), 'default'), $3)
 		RETURNING id
-	`, stepsJSON).Scan(&workflowID)
+	`, stepsJSON, tenant, graph).Scan(&workflowID)
 
 	if err != nil {
 		return 0, nil, err
 	}
 
+	result := map[string]interface{}{
+		"workflow_id": workflowID,
+		"status":      "running",
+	}
+
+	respBytes, _ := json.Marshal(result)
+
+	if graph {
+		if err := spawnReadySteps(workflowID); err != nil {
+			return 0, nil, err
+		}
+		return workflowID, respBytes, nil
+	}
+
 	// Spawn first step
 	firstStep := rawSteps[0].(map[string]interface{})
 
@@ -51,15 +76,19 @@ func Start(ctx context.Context, payload map[string]interface{}) (int, []byte, er
 	stepPayload["step_index"] = 0
 	stepPayload["step_id"] = firstStep["id"]
 
+	if err := SealPayload(stepPayload); err != nil {
+		return 0, nil, err
+	}
+
 	payloadJSON, _ := json.Marshal(stepPayload)
 
 	var jobID int
 
 	err = DB.QueryRow(`
-		INSERT INTO jobs (type, payload, status)
-		VALUES ($1, $2, 'pending')
+		INSERT INTO jobs (type, payload, status, queue, tenant_id)
+		SELECT $1, $2, 'pending', $3, tenant_id FROM workflows WHERE id = $4
 		RETURNING id
-	`, stepType, payloadJSON).Scan(&jobID)
+	`, stepType, payloadJSON, routing.GroupFor(stepType, stepPayload, ""), workflowID).Scan(&jobID)
 
 	if err != nil {
 		return 0, nil, err
@@ -72,19 +101,13 @@ func Start(ctx context.Context, payload map[string]interface{}) (int, []byte, er
 	`, workflowID, firstStep["id"].(string), jobID)
 
 	if err != nil {
-		log.Println("Failed to insert workflow_step_run for first step:", err)
+		slog.Error("Failed to insert workflow_step_run for first step", "workflow_id", workflowID, "error", err)
 	}
 
 	if err != nil {
 		return 0, nil, err
 	}
 
-	result := map[string]interface{}{
-		"workflow_id": workflowID,
-		"status":      "running",
-	}
-
-	respBytes, _ := json.Marshal(result)
 	return workflowID, respBytes, nil
 }
 
@@ -103,15 +126,16 @@ func AdvanceIfNeeded(jobID int, payload map[string]interface{}, response []byte)
 
 	// 🔒 STATE MACHINE GUARD
 	var wfStatus string
+	var graph bool
 
 	err := DB.QueryRow(`
-    SELECT status
+    SELECT status, dag
     FROM workflows
     WHERE id = $1
-`, workflowID).Scan(&wfStatus)
+`, workflowID).Scan(&wfStatus, &graph)
 
 	if err != nil {
-		log.Println("Failed to fetch workflow status:", err)
+		slog.Error("Failed to fetch workflow status", "workflow_id", workflowID, "error", err)
 		return
 	}
 
@@ -126,7 +150,7 @@ func AdvanceIfNeeded(jobID int, payload map[string]interface{}, response []byte)
     `, jobID).Scan(&jobStatus)
 
 	if err != nil {
-		log.Println("Failed to fetch job status:", err)
+		slog.Error("Failed to fetch job status", "workflow_id", workflowID, "error", err)
 		return
 	}
 
@@ -136,15 +160,15 @@ func AdvanceIfNeeded(jobID int, payload map[string]interface{}, response []byte)
         SET status = $1,
             finished_at = NOW(),
             response_snapshot = $2,
-            error = CASE WHEN $1 = 'failed' THEN 'Step execution failed' ELSE NULL END
+            error = CASE WHEN $1 = 'failed' THEN 'Step execution failed' WHEN $1 = 'expired' THEN 'Step expired before it could run' ELSE NULL END
         WHERE job_id = $3
     `, jobStatus, response, jobID)
 
 	if err != nil {
-		log.Println("Failed to update workflow_step_run:", err)
+		slog.Error("Failed to update workflow_step_run", "workflow_id", workflowID, "error", err)
 	}
 
-	if jobStatus == "failed" {
+	if jobStatus == "failed" || jobStatus == "expired" {
 		DB.Exec(`
             UPDATE workflows
 			SET status = 'failed',
@@ -157,6 +181,12 @@ func AdvanceIfNeeded(jobID int, payload map[string]interface{}, response []byte)
 		return
 	}
 
+	if graph {
+		stepID, _ := payload["step_id"].(string)
+		advanceGraph(workflowID, stepID, response)
+		return
+	}
+
 	// Load workflow steps + context
 	var stepsJSON []byte
 	var contextJSON []byte
@@ -166,7 +196,7 @@ func AdvanceIfNeeded(jobID int, payload map[string]interface{}, response []byte)
     `, workflowID).Scan(&stepsJSON, &contextJSON)
 
 	if err != nil {
-		log.Println("Workflow fetch failed:", err)
+		slog.Error("Workflow fetch failed", "workflow_id", workflowID, "error", err)
 		return
 	}
 
@@ -224,7 +254,7 @@ func AdvanceIfNeeded(jobID int, payload map[string]interface{}, response []byte)
         `, workflowID, parentStepID).Scan(&total, &completed)
 
 		if err != nil {
-			log.Println("Parallel barrier check failed:", err)
+			slog.Error("Parallel barrier check failed", "workflow_id", workflowID, "error", err)
 			return
 		}
 
@@ -242,13 +272,13 @@ func AdvanceIfNeeded(jobID int, payload map[string]interface{}, response []byte)
 		`, workflowID)
 
 		if err != nil {
-			log.Println("Barrier lock acquisition failed:", err)
+			slog.Error("Barrier lock acquisition failed", "workflow_id", workflowID, "error", err)
 			return
 		}
 
 		rows, err := res.RowsAffected()
 		if err != nil {
-			log.Println("Failed reading barrier lock result:", err)
+			slog.Error("Failed reading barrier lock result", "workflow_id", workflowID, "error", err)
 			return
 		}
 
@@ -321,7 +351,7 @@ func handleCondition(workflowID int, steps []map[string]interface{}, step map[st
 
 	rawRules, ok := step["rules"].([]interface{})
 	if !ok {
-		log.Println("Invalid condition rules")
+		slog.Error("Invalid condition rules", "workflow_id", workflowID)
 		return
 	}
 
@@ -354,12 +384,12 @@ func handleParallel(workflowID int, steps []map[string]interface{}, step map[str
 	`, workflowID)
 
 	if err != nil {
-		log.Println("Failed to reset barrier lock:", err)
+		slog.Error("Failed to reset barrier lock", "workflow_id", workflowID, "error", err)
 	}
 
 	rawBranches, ok := step["branches"].([]interface{})
 	if !ok || len(rawBranches) == 0 {
-		log.Println("Invalid parallel branches")
+		slog.Error("Invalid parallel branches", "workflow_id", workflowID)
 		return
 	}
 
@@ -378,17 +408,22 @@ func handleParallel(workflowID int, steps []map[string]interface{}, step map[str
 		interpolated["step_id"] = branch["id"]
 		interpolated["parent_parallel_step"] = parentStepID
 
+		if err := SealPayload(interpolated); err != nil {
+			slog.Error("Failed sealing parallel branch payload", "workflow_id", workflowID, "error", err)
+			continue
+		}
+
 		payloadJSON, _ := json.Marshal(interpolated)
 
 		var jobID int
 		err := DB.QueryRow(`
-            INSERT INTO jobs (type, payload, status)
-            VALUES ($1, $2, 'pending')
+            INSERT INTO jobs (type, payload, status, queue, tenant_id)
+            SELECT $1, $2, 'pending', $3, tenant_id FROM workflows WHERE id = $4
             RETURNING id
-        `, branchType, payloadJSON).Scan(&jobID)
+        `, branchType, payloadJSON, routing.GroupFor(branchType, interpolated, ""), workflowID).Scan(&jobID)
 
 		if err != nil {
-			log.Println("Failed spawning parallel branch:", err)
+			slog.Error("Failed spawning parallel branch", "workflow_id", workflowID, "error", err)
 			continue
 		}
 
@@ -399,7 +434,7 @@ func handleParallel(workflowID int, steps []map[string]interface{}, step map[str
         `, workflowID, branch["id"].(string), jobID, parentStepID)
 
 		if err != nil {
-			log.Println("Failed inserting parallel step_run:", err)
+			slog.Error("Failed inserting parallel step_run", "workflow_id", workflowID, "error", err)
 		}
 	}
 }
@@ -424,18 +459,23 @@ func spawnStep(workflowID int, steps []map[string]interface{}, index int, contex
 		nextPayload["branch"] = true
 	}
 
+	if err := SealPayload(nextPayload); err != nil {
+		slog.Error("Failed to seal step payload", "workflow_id", workflowID, "error", err)
+		return
+	}
+
 	payloadJSON, _ := json.Marshal(nextPayload)
 
 	var jobID int
 
 	err := DB.QueryRow(`
-		INSERT INTO jobs (type, payload, status)
-		VALUES ($1, $2, 'pending')
+		INSERT INTO jobs (type, payload, status, queue, tenant_id)
+		SELECT $1, $2, 'pending', $3, tenant_id FROM workflows WHERE id = $4
 		RETURNING id
-	`, nextType, payloadJSON).Scan(&jobID)
+	`, nextType, payloadJSON, routing.GroupFor(nextType, nextPayload, ""), workflowID).Scan(&jobID)
 
 	if err != nil {
-		log.Println("Failed to spawn step:", err)
+		slog.Error("Failed to spawn step", "workflow_id", workflowID, "error", err)
 		return
 	}
 
@@ -445,7 +485,7 @@ func spawnStep(workflowID int, steps []map[string]interface{}, index int, contex
 	`, workflowID, nextStep["id"].(string), jobID)
 
 	if err != nil {
-		log.Println("Failed to insert workflow_step_run:", err)
+		slog.Error("Failed to insert workflow_step_run", "workflow_id", workflowID, "error", err)
 	}
 }
 
@@ -453,7 +493,7 @@ func spawnByID(workflowID int, steps []map[string]interface{}, targetID string,
 
 	index := findStepIndexByID(steps, targetID)
 	if index == -1 {
-		log.Println("Target step not found:", targetID)
+		slog.Error("Target step not found", "workflow_id", workflowID, "step_id", targetID)
 		return
 	}
 
@@ -694,10 +734,11 @@ func RunWorkflow(workflowID int) error {
 
 	// 3. Fetch steps
 	var stepsJSON []byte
+	var graph bool
 
 	err = DB.QueryRow(`
-		SELECT steps FROM workflows WHERE id = $1
-	`, workflowID).Scan(&stepsJSON)
+		SELECT steps, dag FROM workflows WHERE id = $1
+	`, workflowID).Scan(&stepsJSON, &graph)
 
 	if err != nil {
 		return err
@@ -710,10 +751,16 @@ func RunWorkflow(workflowID int) error {
 		return fmt.Errorf("no steps found")
 	}
 
-	// 4. Spawn first step (CRITICAL)
-	spawnStep(workflowID, steps, 0, map[string]interface{}{}, false)
+	// 4. Spawn first step (CRITICAL), or every root of a graph
+	if graph {
+		if err := spawnReadySteps(workflowID); err != nil {
+			return err
+		}
+	} else {
+		spawnStep(workflowID, steps, 0, map[string]interface{}{}, false)
+	}
 
-	log.Println("Workflow RUN triggered:", workflowID)
+	slog.Info("Workflow run triggered", "workflow_id", workflowID)
 
 	return nil
 }